@@ -0,0 +1,231 @@
+// Package clientid decodes BitTorrent client name and version from peer ID.
+// Azureus-style (`-TR3000-...`), Shadow-style (`S58B-----...`)
+// and Mainline-style (`M4-4-0--...`) peer IDs are supported.
+// Refer:
+// - https://wiki.theory.org/BitTorrentSpecification#peer_id
+// - https://www.bittorrent.org/beps/bep_0020.html
+package clientid
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// Peer ID styles
+const (
+	// StyleAzureus is `-` + two characters of client code + four characters
+	// of version + `-` (i.e. `-TR3000-`)
+	StyleAzureus Style = iota + 1
+	// StyleShadow is one character of client code + up to five characters
+	// of version padded with `-` (i.e. `S58B-----`)
+	StyleShadow
+	// StyleMainline is one character of client code + version numbers
+	// separated with `-` and padded with `-` to 8 characters (i.e. `M4-4-0--`)
+	StyleMainline
+)
+
+// Style is the encoding of client code and version in peer ID
+type Style uint8
+
+// Client is decoded client software information
+type Client struct {
+	// Style of peer ID
+	Style Style
+	// Code is the client identifier from peer ID (i.e. `TR` or `S`)
+	Code string
+	// Name is the client name from table or Code if client is unknown
+	Name string
+	// Version is dot-separated version numbers (i.e. `3.0`)
+	Version string
+}
+
+// String returns client name and version (i.e. `Transmission 3.0`)
+func (c Client) String() string {
+	if len(c.Version) == 0 {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+var (
+	tableMU sync.RWMutex
+	// table is the client code to name map, single character codes
+	// used by Shadow and Mainline styles, two character codes by Azureus style
+	table = map[string]string{
+		// Azureus style
+		"7T": "aTorrent",
+		"AG": "Ares",
+		"AR": "Arctic",
+		"AZ": "Vuze",
+		"BC": "BitComet",
+		"BI": "BiglyBT",
+		"BT": "BitTorrent",
+		"DE": "Deluge",
+		"FD": "Free Download Manager",
+		"FW": "FrostWire",
+		"KT": "KTorrent",
+		"LT": "libtorrent",
+		"lt": "libTorrent",
+		"PI": "PicoTorrent",
+		"qB": "qBittorrent",
+		"SD": "Thunder",
+		"TR": "Transmission",
+		"TX": "Tixati",
+		"UM": "µTorrent Mac",
+		"UT": "µTorrent",
+		"WW": "WebTorrent",
+		"XL": "Xunlei",
+		// Shadow style
+		"A": "ABC",
+		"O": "Osprey Permaseed",
+		"Q": "BTQueue",
+		"R": "Tribler",
+		"S": "Shadow",
+		"T": "BitTornado",
+		"U": "UPnP NAT Bit Torrent",
+		// Mainline style
+		"M": "Mainline",
+	}
+)
+
+// Register adds client code to table or replaces name of existing code.
+// Single character codes are used for Shadow and Mainline styles,
+// two character codes for Azureus style.
+func Register(code, name string) {
+	if l := len(code); l < 1 || l > 2 || len(name) == 0 {
+		panic("clientid: could not register client with empty name or code not of 1 or 2 characters")
+	}
+	tableMU.Lock()
+	defer tableMU.Unlock()
+	table[code] = name
+}
+
+func lookup(code string) (name string, found bool) {
+	tableMU.RLock()
+	name, found = table[code]
+	tableMU.RUnlock()
+	return
+}
+
+// digit decodes single character of version:
+// `0`-`9` are 0-9, `A`-`Z` are 10-35, `a`-`z` are 36-61, `.` is 62
+func digit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36, true
+	case c == '.':
+		return 62, true
+	}
+	return 0, false
+}
+
+// joinVersion joins version numbers with `.`, trailing zeros
+// are dropped, but at least two numbers are kept
+func joinVersion(parts []int) string {
+	for len(parts) > 2 && parts[len(parts)-1] == 0 {
+		parts = parts[:len(parts)-1]
+	}
+	var sb strings.Builder
+	for i, p := range parts {
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(strconv.Itoa(p))
+	}
+	return sb.String()
+}
+
+func parseAzureus(id bittorrent.PeerID) (c Client, ok bool) {
+	if id[0] != '-' || id[7] != '-' {
+		return
+	}
+	for _, b := range id[1:3] {
+		if b <= ' ' || b > '~' || b == '-' {
+			return
+		}
+	}
+	parts := make([]int, 0, 4)
+	for _, b := range id[3:7] {
+		d, valid := digit(b)
+		if !valid {
+			return
+		}
+		parts = append(parts, d)
+	}
+	c.Style, c.Code, c.Version, ok = StyleAzureus, string(id[1:3]), joinVersion(parts), true
+	return
+}
+
+func parseMainline(id bittorrent.PeerID) (c Client, ok bool) {
+	// version is padded with `-` to 8 characters
+	if id[7] != '-' {
+		return
+	}
+	parts := make([]int, 0, 3)
+	for _, p := range strings.Split(strings.TrimRight(string(id[1:8]), "-"), "-") {
+		n, err := strconv.Atoi(p)
+		if err != nil || p[0] == '+' {
+			return
+		}
+		parts = append(parts, n)
+	}
+	if len(parts) < 2 {
+		return
+	}
+	c.Style, c.Code, c.Version, ok = StyleMainline, string(id[:1]), joinVersion(parts), true
+	return
+}
+
+func parseShadow(id bittorrent.PeerID) (c Client, ok bool) {
+	parts := make([]int, 0, 5)
+	i := 1
+	for ; i < 6 && id[i] != '-'; i++ {
+		d, valid := digit(id[i])
+		if !valid {
+			return
+		}
+		parts = append(parts, d)
+	}
+	if len(parts) == 0 {
+		return
+	}
+	// version is padded with `-` and followed by `---`
+	for ; i < 9; i++ {
+		if id[i] != '-' {
+			return
+		}
+	}
+	c.Style, c.Code, c.Version, ok = StyleShadow, string(id[:1]), joinVersion(parts), true
+	return
+}
+
+// Parse decodes client code and version from peer ID.
+// Shadow-style and Mainline-style codes are recognized only if they are
+// registered in table, because peer IDs of other clients may look like them.
+// Client name is set to code if Azureus-style code is not registered.
+// Returns false if peer ID style is not recognized.
+func Parse(id bittorrent.PeerID) (c Client, ok bool) {
+	if c, ok = parseAzureus(id); ok {
+		if c.Name, ok = lookup(c.Code); !ok {
+			c.Name, ok = c.Code, true
+		}
+		return
+	}
+	if _, known := lookup(string(id[:1])); !known {
+		return
+	}
+	if c, ok = parseMainline(id); !ok {
+		c, ok = parseShadow(id)
+	}
+	if ok {
+		c.Name, _ = lookup(c.Code)
+	}
+	return
+}
@@ -0,0 +1,60 @@
+package clientid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func peerID(s string) (id bittorrent.PeerID) {
+	copy(id[:], s)
+	return
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		peerID string
+		client Client
+	}{
+		{"-TR3000-6ep6svaa61r4", Client{StyleAzureus, "TR", "Transmission", "3.0"}},
+		{"-qB4510-6ozMq5q6Q3NX", Client{StyleAzureus, "qB", "qBittorrent", "4.5.1"}},
+		{"-lt0D60-347143496631", Client{StyleAzureus, "lt", "libTorrent", "0.13.6"}},
+		{"-A~0010-a9mn9DFkj39J", Client{StyleAzureus, "A~", "A~", "0.0.1"}},
+		{"S58B-----nKl34GoNb75", Client{StyleShadow, "S", "Shadow", "5.8.11"}},
+		{"T03A0----f089kjsdf6e", Client{StyleShadow, "T", "BitTornado", "0.3.10"}},
+		{"M4-4-0--9aa757Efd5Bl", Client{StyleMainline, "M", "Mainline", "4.4"}},
+		{"M7-12-1-9aa757Efd5Bl", Client{StyleMainline, "M", "Mainline", "7.12.1"}},
+	} {
+		c, ok := Parse(peerID(tt.peerID))
+		require.True(t, ok, tt.peerID)
+		require.Equal(t, tt.client, c, tt.peerID)
+	}
+
+	for _, id := range []string{
+		"AZ2500BTeYUzyabAfo6U", // BitTyrant
+		"exbc0JdSklm834kj9Udf", // Old BitComet
+		"-ML2.7.2-kgjjfkd9762", // MLDonkey
+		"Z58B-----nKl34GoNb75", // unknown Shadow-style code
+		"S58B--x--nKl34GoNb75",
+		"\x00\x01",
+	} {
+		_, ok := Parse(peerID(id))
+		require.False(t, ok, id)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("Z", "Zed")
+	c, ok := Parse(peerID("Z58B-----nKl34GoNb75"))
+	require.True(t, ok)
+	require.Equal(t, "Zed 5.8.11", c.String())
+
+	Register("A~", "Tilde")
+	c, ok = Parse(peerID("-A~0010-a9mn9DFkj39J"))
+	require.True(t, ok)
+	require.Equal(t, "Tilde 0.0.1", c.String())
+
+	require.Panics(t, func() { Register("", "Empty") })
+}
@@ -5,7 +5,7 @@ import (
 )
 
 // ErrUnknownEvent is returned when New fails to return an event.
-var ErrUnknownEvent = ClientError("unknown event")
+var ErrUnknownEvent = NewClientError(ReasonBadRequest, "unknown event")
 
 // Event represents an event done by a BitTorrent client.
 type Event uint8
@@ -25,6 +25,10 @@ const (
 	// downloading all of the required chunks.
 	Completed
 
+	// Paused is the event sent by a BitTorrent client, which is a partial seed
+	// (does not download, but has only part of the torrent), see BEP 21.
+	Paused
+
 	// NoneStr string representation of None event
 	NoneStr = "none"
 
@@ -36,6 +40,9 @@ const (
 
 	// CompletedStr string representation of Completed event
 	CompletedStr = "completed"
+
+	// PausedStr string representation of Paused event
+	PausedStr = "paused"
 )
 
 // NewEvent returns the proper Event given a string.
@@ -49,6 +56,8 @@ func NewEvent(eventStr string) (evt Event, err error) {
 		evt = Stopped
 	case CompletedStr:
 		evt = Completed
+	case PausedStr:
+		evt = Paused
 	default:
 		evt, err = None, ErrUnknownEvent
 	}
@@ -66,6 +75,8 @@ func (e Event) String() (s string) {
 		s = StoppedStr
 	case Completed:
 		s = CompletedStr
+	case Paused:
+		s = PausedStr
 	default:
 		s = "<unknown>"
 	}
@@ -2,6 +2,7 @@ package bittorrent
 
 import (
 	"context"
+	"sync"
 
 	"github.com/rs/zerolog"
 )
@@ -20,6 +21,29 @@ type Params interface {
 	zerolog.LogObjectMarshaler
 }
 
+// ExtraParams is implemented by Params, which are able to provide
+// parameters not recognized by frontend, so middleware may implement
+// tracker-specific extensions.
+type ExtraParams interface {
+	// Extra returns copy of parameters, which are not parsed into
+	// request fields by frontend (for UDP these are all parameters from URLData).
+	// If key occurred multiple times, only the last value is kept.
+	Extra() map[string]string
+}
+
+// Option is the BEP41 option of UDP request, which is not handled by frontend.
+type Option struct {
+	Type  byte
+	Value []byte
+}
+
+// OptionParams is implemented by Params of UDP requests, which contain
+// BEP41 options not handled by frontend.
+type OptionParams interface {
+	// Options returns options in order of appearance in request
+	Options() []Option
+}
+
 type routeParamsKey struct{}
 
 // RouteParamsKey is a key for the context of a request that
@@ -60,13 +84,35 @@ func InjectRouteParamsToContext(ctx context.Context, rp RouteParams) context.Con
 	return context.WithValue(ctx, RouteParamsKey, rp)
 }
 
+var (
+	preservedKeysMU sync.RWMutex
+	preservedKeys   []any
+)
+
+// PreserveContextKey registers context key, which value should be copied
+// by RemapRouteParamsToBgContext along with RouteParams
+// (i.e. values set by pre hooks, which should be visible in post hooks).
+func PreserveContextKey(key any) {
+	preservedKeysMU.Lock()
+	defer preservedKeysMU.Unlock()
+	preservedKeys = append(preservedKeys, key)
+}
+
 // RemapRouteParamsToBgContext returns new context with context.Background parent
-// and copied RouteParams from inCtx
+// and copied RouteParams and values of keys registered with PreserveContextKey from inCtx
 func RemapRouteParamsToBgContext(inCtx context.Context) context.Context {
 	rp, isOk := inCtx.Value(RouteParamsKey).(RouteParams)
 	if !isOk {
 		logger.Warn().Msg("unable to fetch route parameters, probably jammed context")
 		rp = RouteParams{}
 	}
-	return context.WithValue(context.Background(), RouteParamsKey, rp)
+	outCtx := context.WithValue(context.Background(), RouteParamsKey, rp)
+	preservedKeysMU.RLock()
+	defer preservedKeysMU.RUnlock()
+	for _, k := range preservedKeys {
+		if v := inCtx.Value(k); v != nil {
+			outCtx = context.WithValue(outCtx, k, v)
+		}
+	}
+	return outCtx
 }
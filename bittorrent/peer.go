@@ -9,9 +9,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/netip"
+	"time"
 
 	"github.com/rs/zerolog"
 
+	"github.com/sot-tech/mochi/pkg/privacy"
 	"github.com/sot-tech/mochi/pkg/str2bytes"
 )
 
@@ -125,13 +127,46 @@ func (p Peer) Addr() netip.Addr {
 // MarshalZerologObject writes fields into zerolog event
 func (p Peer) MarshalZerologObject(e *zerolog.Event) {
 	e.Stringer("id", p.ID).
-		Stringer("addr", p.Addr()).
+		Stringer("addr", privacy.Stringer(p.Addr())).
 		Uint16("port", p.Port())
 }
 
 // ClientError represents an error that should be exposed to the client over
 // the BitTorrent protocol implementation.
-type ClientError string
+type ClientError struct {
+	// Code is the machine-readable reason of error (one of Reason* constants)
+	Code string
+	// Message is the human-readable description of error
+	Message string
+	// Retryable is set if request may succeed if repeated later
+	Retryable bool
+}
+
+// NewClientError creates ClientError with provided code and message
+func NewClientError(code, message string) ClientError {
+	return ClientError{Code: code, Message: message}
+}
+
+// NewRetryableError creates ClientError with provided code and message,
+// which may not happen if request is repeated later
+func NewRetryableError(code, message string) ClientError {
+	return ClientError{Code: code, Message: message, Retryable: true}
+}
 
 // Error implements the error interface for ClientError.
-func (c ClientError) Error() string { return string(c) }
+func (c ClientError) Error() string { return c.Message }
+
+// RetryError is the ClientError, which tells client to repeat
+// request not earlier than after RetryIn (`retry in` field of BEP 31).
+type RetryError struct {
+	ClientError
+	RetryIn time.Duration
+}
+
+// NewRetryError creates RetryError with ReasonRetry code
+func NewRetryError(message string, retryIn time.Duration) RetryError {
+	return RetryError{ClientError: NewRetryableError(ReasonRetry, message), RetryIn: retryIn}
+}
+
+// Unwrap returns ClientError, so RetryError may be matched as ClientError
+func (e RetryError) Unwrap() error { return e.ClientError }
@@ -0,0 +1,97 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Machine-readable reasons of rejected requests (codes of ClientError)
+const (
+	// ReasonBadRequest request is malformed or contains invalid parameters
+	ReasonBadRequest = "bad_request"
+	// ReasonUnapprovedTorrent info hash is not allowed
+	ReasonUnapprovedTorrent = "unapproved_torrent"
+	// ReasonUnapprovedClient client software is not allowed
+	ReasonUnapprovedClient = "unapproved_client"
+	// ReasonUnauthorized client's credentials are missing or invalid
+	ReasonUnauthorized = "unauthorized"
+	// ReasonBlocked client's address, network or port is blocked
+	ReasonBlocked = "blocked"
+	// ReasonBanned client is banned for misbehavior
+	ReasonBanned = "banned"
+	// ReasonRateLimited client sends requests too often
+	ReasonRateLimited = "rate_limited"
+	// ReasonLimitExceeded client exceeded limit of peers, connections or slots
+	ReasonLimitExceeded = "limit_exceeded"
+	// ReasonDisabled requested action is disabled
+	ReasonDisabled = "disabled"
+	// ReasonDeprecated announce URL or protocol is deprecated
+	ReasonDeprecated = "deprecated"
+	// ReasonNotFound requested resource does not exist
+	ReasonNotFound = "not_found"
+	// ReasonTimeout request is not processed in time (i.e. storage is slow)
+	ReasonTimeout = "timeout"
+	// ReasonRetry tracker asks client to retry later (RetryError)
+	ReasonRetry = "retry_later"
+	// ReasonOther ClientError without code
+	ReasonOther = "other"
+	// ReasonInternal error is not ClientError
+	ReasonInternal = "internal"
+	// ReasonCanceled request is canceled
+	ReasonCanceled = "canceled"
+)
+
+// RejectReason returns code of ClientError, ReasonOther for ClientError
+// without code and ReasonInternal for other errors.
+// It returns empty string if err is nil.
+func RejectReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	var clientErr ClientError
+	if errors.As(err, &clientErr) {
+		if len(clientErr.Code) == 0 {
+			return ReasonOther
+		}
+		return clientErr.Code
+	}
+	if errors.Is(err, context.Canceled) {
+		return ReasonCanceled
+	}
+	return ReasonInternal
+}
+
+// InternalErrorMessage is sent to client instead of
+// message of error, which is not ClientError
+const InternalErrorMessage = "mochi internal error"
+
+// ErrorFormatter returns the message of ClientError, which is sent to client
+type ErrorFormatter func(ClientError) string
+
+var errorFormatter atomic.Pointer[ErrorFormatter]
+
+// SetErrorFormatter sets process-wide formatter of messages, sent to
+// clients by frontends. Nil formatter restores the default one,
+// which returns ClientError.Message as is.
+func SetErrorFormatter(f ErrorFormatter) {
+	if f == nil {
+		errorFormatter.Store(nil)
+	} else {
+		errorFormatter.Store(&f)
+	}
+}
+
+// ClientMessage returns ClientError wrapped into err and its message
+// formatted with ErrorFormatter. If err is not ClientError,
+// InternalErrorMessage and false are returned.
+func ClientMessage(err error) (clientErr ClientError, message string, ok bool) {
+	if !errors.As(err, &clientErr) {
+		return clientErr, InternalErrorMessage, false
+	}
+	message = clientErr.Message
+	if f := errorFormatter.Load(); f != nil {
+		message = (*f)(clientErr)
+	}
+	return clientErr, message, true
+}
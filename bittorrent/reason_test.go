@@ -0,0 +1,35 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectReason(t *testing.T) {
+	blocked := NewClientError(ReasonBlocked, "blocked")
+	table := []struct {
+		err      error
+		expected string
+	}{
+		{nil, ""},
+		{blocked, ReasonBlocked},
+		{fmt.Errorf("hook: %w", blocked), ReasonBlocked},
+		{ErrInvalidPort, ReasonBadRequest},
+		{NewRetryError("overloaded", 0), ReasonRetry},
+		{ClientError{Message: "custom"}, ReasonOther},
+		{context.Canceled, ReasonCanceled},
+		{errors.New("storage failed"), ReasonInternal},
+	}
+	for _, tt := range table {
+		require.Equal(t, tt.expected, RejectReason(tt.err), tt.err)
+	}
+
+	var clientErr ClientError
+	require.True(t, errors.As(blocked, &clientErr))
+	require.Equal(t, "blocked", clientErr.Error())
+	require.Equal(t, "blocked", blocked.Error())
+}
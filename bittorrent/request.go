@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
+
+	"github.com/sot-tech/mochi/pkg/privacy"
 )
 
 // RequestAddress wrapper for netip.Addr with Provided flag.
@@ -25,7 +27,7 @@ func (a RequestAddress) IsValid() bool {
 
 // MarshalZerologObject writes fields into zerolog event
 func (a RequestAddress) MarshalZerologObject(e *zerolog.Event) {
-	e.Stringer("addr", a.Addr).Bool("provided", a.Provided)
+	e.Stringer("addr", privacy.Stringer(a.Addr)).Bool("provided", a.Provided)
 }
 
 // RequestAddresses is an array of RequestAddress used mainly for
@@ -97,6 +99,17 @@ func (aa *RequestAddresses) GetFirst() netip.Addr {
 	return a
 }
 
+// GetObserved returns first address, which is not provided by client,
+// i.e. the source address of connection, or empty netip.Addr if there is no such address
+func (aa *RequestAddresses) GetObserved() netip.Addr {
+	for _, a := range *aa {
+		if !a.Provided {
+			return a.Addr
+		}
+	}
+	return netip.Addr{}
+}
+
 // MarshalZerologArray writes array elements to zerolog event
 func (aa *RequestAddresses) MarshalZerologArray(a *zerolog.Array) {
 	if aa != nil {
@@ -143,6 +156,30 @@ func (rp RequestPeer) MarshalZerologObject(e *zerolog.Event) {
 		Uint16("port", rp.Port)
 }
 
+// Crypto is the level of peer's support of encrypted connections
+// (Message Stream Encryption), announced with `supportcrypto`
+// and `requirecrypto` parameters of HTTP announce
+type Crypto uint8
+
+const (
+	// CryptoNone peer did not announce support of encryption
+	CryptoNone Crypto = iota
+	// CryptoSupported peer accepts both encrypted and plain connections
+	CryptoSupported
+	// CryptoRequired peer accepts only encrypted connections
+	CryptoRequired
+)
+
+var cryptoNames = [...]string{"none", "supported", "required"}
+
+// String implements fmt.Stringer
+func (c Crypto) String() string {
+	if int(c) < len(cryptoNames) {
+		return cryptoNames[c]
+	}
+	return "unknown"
+}
+
 // AnnounceRequest represents the parsed parameters from an announce request.
 type AnnounceRequest struct {
 	Event           Event
@@ -153,6 +190,13 @@ type AnnounceRequest struct {
 	Left            uint64
 	Downloaded      uint64
 	Uploaded        uint64
+	// Corrupt is the number of downloaded bytes, which failed hash check,
+	// reported by client (not standard `corrupt` parameter)
+	Corrupt uint64
+	// Redundant is the number of bytes downloaded more than once,
+	// reported by client (not standard `redundant` parameter)
+	Redundant uint64
+	Crypto    Crypto
 
 	RequestPeer
 	Params
@@ -168,10 +212,31 @@ func (r AnnounceRequest) MarshalZerologObject(e *zerolog.Event) {
 		Uint64("left", r.Left).
 		Uint64("downloaded", r.Downloaded).
 		Uint64("uploaded", r.Uploaded).
+		Uint64("corrupt", r.Corrupt).
+		Uint64("redundant", r.Redundant).
+		Stringer("crypto", r.Crypto).
 		Object("source", r.RequestPeer).
 		Object("params", r.Params)
 }
 
+// ExtraParams returns parameters of request, which are not recognized
+// by frontend, or nil if Params do not implement ExtraParams.
+func (r *AnnounceRequest) ExtraParams() map[string]string {
+	if ep, ok := r.Params.(ExtraParams); ok {
+		return ep.Extra()
+	}
+	return nil
+}
+
+// Options returns BEP41 options of UDP request not handled by frontend,
+// or nil if Params do not implement OptionParams.
+func (r *AnnounceRequest) Options() []Option {
+	if op, ok := r.Params.(OptionParams); ok {
+		return op.Options()
+	}
+	return nil
+}
+
 // AnnounceResponse represents the parameters used to create an announce
 // response.
 type AnnounceResponse struct {
@@ -181,6 +246,24 @@ type AnnounceResponse struct {
 	MinInterval time.Duration
 	IPv4Peers   Peers
 	IPv6Peers   Peers
+	// WarningMessage is the human-readable message, which may be shown
+	// to user by client. Request is still processed as normal.
+	// Note: BEP 15 (UDP) does not support this field.
+	WarningMessage string
+	// WebSeeds are HTTP URLs of web seeds (BEP 19) of torrent,
+	// sent as `url-list` to clients, which honor it.
+	// Note: BEP 15 (UDP) does not support this field.
+	WebSeeds []string
+}
+
+// AddWarning appends message to AnnounceResponse.WarningMessage
+// separated by "; " if it is not empty.
+func (r *AnnounceResponse) AddWarning(message string) {
+	if len(r.WarningMessage) > 0 {
+		r.WarningMessage += "; " + message
+	} else {
+		r.WarningMessage = message
+	}
 }
 
 // MarshalZerologObject writes fields into zerolog event
@@ -190,7 +273,9 @@ func (r AnnounceResponse) MarshalZerologObject(e *zerolog.Event) {
 		Dur("interval", r.Interval).
 		Dur("minInterval", r.MinInterval).
 		Array("ipv4Peers", r.IPv4Peers).
-		Array("ipv6Peers", r.IPv6Peers)
+		Array("ipv6Peers", r.IPv6Peers).
+		Str("warningMessage", r.WarningMessage).
+		Strs("webSeeds", r.WebSeeds)
 }
 
 // InfoHashes wrapper of array of InfoHash-es
@@ -225,6 +310,13 @@ type Scrape struct {
 	Snatches   uint32
 	Complete   uint32
 	Incomplete uint32
+	// Downloaders is the number of active downloaders, which is Incomplete
+	// without partial seeds (BEP 21). Reported only if DownloadersProvided is set.
+	Downloaders         uint32
+	DownloadersProvided bool
+	// Failure is set if info hash is rejected by middleware, counters
+	// of such hash are not reported, but other hashes of scrape are
+	Failure error
 }
 
 // MarshalZerologObject writes fields into zerolog event
@@ -233,6 +325,12 @@ func (s Scrape) MarshalZerologObject(e *zerolog.Event) {
 		Uint32("snatches", s.Snatches).
 		Uint32("complete", s.Complete).
 		Uint32("incomplete", s.Incomplete)
+	if s.DownloadersProvided {
+		e.Uint32("downloaders", s.Downloaders)
+	}
+	if s.Failure != nil {
+		e.AnErr("failure", s.Failure)
+	}
 }
 
 // Scrapes wrapper of array of Scrape-s
@@ -251,6 +349,9 @@ func (s Scrapes) MarshalZerologArray(a *zerolog.Array) {
 // ScrapeRequest.
 type ScrapeResponse struct {
 	Data Scrapes
+	// Time is the time when swarm counters were read from storage,
+	// it is earlier than request if counters are cached
+	Time time.Time
 }
 
 // MarshalZerologObject writes fields into zerolog event
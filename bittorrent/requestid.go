@@ -0,0 +1,55 @@
+package bittorrent
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+)
+
+// RequestIDHeader is the HTTP header, which carries request ID
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the maximal length of request ID provided by client
+const maxRequestIDLen = 64
+
+type requestIDKey struct{}
+
+func init() {
+	// request ID is logged by post hooks
+	PreserveContextKey(requestIDKey{})
+}
+
+// NewRequestID generates random request ID
+func NewRequestID() string {
+	var b [16]byte
+	return string(strconv.AppendUint(b[:0], rand.Uint64(), 16))
+}
+
+// ValidRequestID checks if id, provided by client or proxy, is not empty,
+// not longer than 64 bytes and consists of letters, digits, `-`, `_`, `.` and `:`,
+// so it may be safely written to logs and headers
+func ValidRequestID(id []byte) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') &&
+			c != '-' && c != '_' && c != '.' && c != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequestID returns copy of ctx with request ID, which identifies
+// announce or scrape in logs, traces, error responses and webhook events.
+// Set by frontends.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns request ID set by WithRequestID or empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,26 @@
+package bittorrent
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidRequestID(t *testing.T) {
+	for _, id := range []string{NewRequestID(), "a-b_c.d:1", strings.Repeat("a", maxRequestIDLen)} {
+		require.True(t, ValidRequestID([]byte(id)), id)
+	}
+	for _, id := range []string{"", "a b", "a\nb", "<script>", strings.Repeat("a", maxRequestIDLen+1)} {
+		require.False(t, ValidRequestID([]byte(id)), id)
+	}
+}
+
+func TestRequestIDContext(t *testing.T) {
+	require.Empty(t, RequestID(context.Background()))
+	ctx := WithRequestID(InjectRouteParamsToContext(context.Background(), nil), "id")
+	require.Equal(t, "id", RequestID(ctx))
+	// request ID is available in post hooks
+	require.Equal(t, "id", RequestID(RemapRouteParamsToBgContext(ctx)))
+}
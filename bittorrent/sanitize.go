@@ -6,17 +6,19 @@ import (
 
 var (
 	logger = log.NewLogger("bittorrent/sanitize")
+	// sampledLogger used for per-request events
+	sampledLogger = log.NewSampledLogger("bittorrent/sanitize", 0, log.DefaultPerSecond)
 	// ErrInvalidIP indicates an invalid IP for an Announce.
-	ErrInvalidIP = ClientError("invalid IP")
+	ErrInvalidIP = NewClientError(ReasonBadRequest, "invalid IP")
 
 	// ErrInvalidPort indicates an invalid Port for an Announce.
-	ErrInvalidPort = ClientError("invalid port")
+	ErrInvalidPort = NewClientError(ReasonBadRequest, "invalid port")
 )
 
 // SanitizeAnnounce enforces a max and default NumWant and coerces the peer's
 // IP address into the proper format.
 func SanitizeAnnounce(r *AnnounceRequest, maxNumWant, defaultNumWant uint32, filterPrivate bool) error {
-	logger.Trace().Object("request", r).Msg("source announce")
+	sampledLogger.Trace("source announce").Object("request", r).Msg("source announce")
 	if r.Port == 0 {
 		return ErrInvalidPort
 	}
@@ -31,14 +33,14 @@ func SanitizeAnnounce(r *AnnounceRequest, maxNumWant, defaultNumWant uint32, fil
 		r.NumWant = maxNumWant
 	}
 
-	logger.Trace().Object("request", r).Msg("sanitized announce")
+	sampledLogger.Trace("sanitized announce").Object("request", r).Msg("sanitized announce")
 	return nil
 }
 
 // SanitizeScrape enforces a max number of infohashes for a single scrape
 // request and checks if addresses are valid.
 func SanitizeScrape(r *ScrapeRequest, maxScrapeInfoHashes uint32, filterPrivate bool) error {
-	logger.Trace().Object("request", r).Msg("source scrape")
+	sampledLogger.Trace("source scrape").Object("request", r).Msg("source scrape")
 	if len(r.InfoHashes) > int(maxScrapeInfoHashes) {
 		r.InfoHashes = r.InfoHashes[:maxScrapeInfoHashes]
 	}
@@ -47,6 +49,6 @@ func SanitizeScrape(r *ScrapeRequest, maxScrapeInfoHashes uint32, filterPrivate
 		return ErrInvalidIP
 	}
 
-	logger.Trace().Object("request", r).Msg("sanitized scrape")
+	sampledLogger.Trace("sanitized scrape").Object("request", r).Msg("sanitized scrape")
 	return nil
 }
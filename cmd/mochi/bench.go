@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	hf "github.com/sot-tech/mochi/frontend/http"
+	"github.com/sot-tech/mochi/pkg/str2bytes"
+)
+
+const (
+	benchDefaultAddr        = "udp://127.0.0.1:6969"
+	benchDefaultDuration    = 10 * time.Second
+	benchDefaultConcurrency = 8
+	benchDefaultSwarms      = 1000
+	benchDefaultPeers       = 10000
+	benchDefaultNumWant     = 50
+	benchDefaultTimeout     = 5 * time.Second
+
+	// UDP connection ID lifetime is two minutes (BEP-15), so it is renewed more often
+	benchConnIDLifetime = time.Minute
+
+	benchUDPProtocolID     = 0x41727101980
+	benchUDPActionConnect  = 0
+	benchUDPActionAnnounce = 1
+	benchUDPActionError    = 3
+	benchUDPAnnounceLen    = 98
+)
+
+var (
+	errBenchUDPResponse = errors.New("malformed UDP response")
+	errBenchTxID        = errors.New("transaction ID mismatch")
+)
+
+// benchConfig is the configuration of announce load generator
+type benchConfig struct {
+	// URL of tracker: udp://host:port or http(s)://host:port[/announce]
+	URL         *url.URL
+	Duration    time.Duration
+	Concurrency int
+	// Requests is the maximum number of announces, unlimited if 0
+	Requests int
+	Swarms   int
+	Peers    int
+	NumWant  int
+	Timeout  time.Duration
+}
+
+// benchResult is the outcome of load generation
+type benchResult struct {
+	Requests  int
+	Errors    int
+	Elapsed   time.Duration
+	Latencies []time.Duration
+	// LastError is the last occurred error, if any
+	LastError error
+}
+
+func (r benchResult) percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	return r.Latencies[int(float64(len(r.Latencies)-1)*p)]
+}
+
+func (r benchResult) String() string {
+	var rps float64
+	if r.Elapsed > 0 {
+		rps = float64(r.Requests) / r.Elapsed.Seconds()
+	}
+	var maxLat time.Duration
+	if len(r.Latencies) > 0 {
+		maxLat = r.Latencies[len(r.Latencies)-1]
+	}
+	s := fmt.Sprintf("requests: %d, errors: %d, elapsed: %s, rate: %.1f req/s\nlatency: p50 %s, p90 %s, p99 %s, max %s",
+		r.Requests, r.Errors, r.Elapsed.Round(time.Millisecond), rps,
+		r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), maxLat)
+	if r.LastError != nil {
+		s += "\nlast error: " + r.LastError.Error()
+	}
+	return s
+}
+
+// benchAnnouncer sends single announce to tracker
+type benchAnnouncer interface {
+	io.Closer
+	announce(ctx context.Context, ih []byte, peerID []byte, port uint16, left uint64) error
+}
+
+func benchAnnounceCommand(fs *flag.FlagSet) func() error {
+	addr := fs.String("addr", benchDefaultAddr, "tracker address: udp://host:port or http://host:port/announce")
+	duration := fs.Duration("duration", benchDefaultDuration, "test duration")
+	concurrency := fs.Int("concurrency", benchDefaultConcurrency, "number of concurrent clients")
+	requests := fs.Int("requests", 0, "maximum number of announces, 0 means unlimited")
+	swarms := fs.Int("swarms", benchDefaultSwarms, "number of distinct info hashes")
+	peers := fs.Int("peers", benchDefaultPeers, "number of distinct peers")
+	numWant := fs.Int("numwant", benchDefaultNumWant, "number of peers requested in announce")
+	timeout := fs.Duration("timeout", benchDefaultTimeout, "timeout of single request")
+	return func() error {
+		u, err := url.Parse(*addr)
+		if err != nil {
+			return err
+		}
+		cfg := benchConfig{
+			URL:         u,
+			Duration:    *duration,
+			Concurrency: *concurrency,
+			Requests:    *requests,
+			Swarms:      *swarms,
+			Peers:       *peers,
+			NumWant:     *numWant,
+			Timeout:     *timeout,
+		}
+		res, err := benchAnnounce(context.Background(), cfg)
+		if err == nil {
+			fmt.Println(res)
+		}
+		return err
+	}
+}
+
+// benchAnnounce sends announces with random info hashes and peers
+// from concurrent clients until duration elapsed or requests limit reached
+func benchAnnounce(ctx context.Context, cfg benchConfig) (res benchResult, err error) {
+	if cfg.Concurrency <= 0 || cfg.Swarms <= 0 || cfg.Peers <= 0 {
+		return res, errors.New("concurrency, swarms and peers must be positive")
+	}
+	var newAnnouncer func() (benchAnnouncer, error)
+	switch cfg.URL.Scheme {
+	case "udp":
+		newAnnouncer = func() (benchAnnouncer, error) { return newBenchUDP(cfg) }
+	case "http", "https":
+		if len(cfg.URL.Path) == 0 || cfg.URL.Path == "/" {
+			cfg.URL.Path = hf.DefaultAnnounceRoute
+		}
+		client := &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &http.Transport{MaxIdleConnsPerHost: cfg.Concurrency},
+		}
+		newAnnouncer = func() (benchAnnouncer, error) { return &benchHTTP{cfg: cfg, client: client}, nil }
+	default:
+		return res, fmt.Errorf("unsupported scheme '%s'", cfg.URL.Scheme)
+	}
+
+	hashes, peerIDs := benchRandom(cfg.Swarms, bittorrent.InfoHashV1Len), benchRandom(cfg.Peers, bittorrent.PeerIDLen)
+
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var sent int
+	// next returns false if requests limit reached
+	next := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if cfg.Requests > 0 && sent >= cfg.Requests {
+			return false
+		}
+		sent++
+		return true
+	}
+	start := time.Now()
+	for i := 0; i < cfg.Concurrency; i++ {
+		a, aErr := newAnnouncer()
+		if aErr != nil {
+			err = aErr
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer a.Close()
+			var latencies []time.Duration
+			var errCount int
+			var lastErr error
+			for ctx.Err() == nil && next() {
+				peer := mrand.IntN(len(peerIDs))
+				var left uint64
+				// half of peers are leechers
+				if peer%2 == 0 {
+					left = 1
+				}
+				reqStart := time.Now()
+				// nolint:gosec
+				aErr := a.announce(ctx, hashes[mrand.IntN(len(hashes))], peerIDs[peer], uint16(peer%(1<<16-1)+1), left)
+				if aErr != nil {
+					if ctx.Err() != nil {
+						break
+					}
+					errCount++
+					lastErr = aErr
+					continue
+				}
+				latencies = append(latencies, time.Since(reqStart))
+			}
+			mu.Lock()
+			res.Requests += len(latencies) + errCount
+			res.Errors += errCount
+			res.Latencies = append(res.Latencies, latencies...)
+			if lastErr != nil {
+				res.LastError = lastErr
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	slices.Sort(res.Latencies)
+	return
+}
+
+func benchRandom(n, size int) [][]byte {
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = make([]byte, size)
+		_, _ = rand.Read(out[i])
+	}
+	return out
+}
+
+type benchHTTP struct {
+	cfg    benchConfig
+	client *http.Client
+}
+
+func (b *benchHTTP) announce(ctx context.Context, ih []byte, peerID []byte, port uint16, left uint64) error {
+	u := *b.cfg.URL
+	u.RawQuery = url.Values{
+		"compact":    []string{"1"},
+		"left":       []string{strconv.FormatUint(left, 10)},
+		"downloaded": []string{"0"},
+		"uploaded":   []string{"0"},
+		"numwant":    []string{strconv.Itoa(b.cfg.NumWant)},
+		"port":       []string{strconv.FormatUint(uint64(port), 10)},
+		"info_hash":  []string{str2bytes.BytesToString(ih)},
+		"peer_id":    []string{str2bytes.BytesToString(peerID)},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errors.New(resp.Status)
+	}
+	if bytes.Contains(body, []byte("failure reason")) {
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+func (b *benchHTTP) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
+
+type benchUDP struct {
+	cfg      benchConfig
+	conn     net.Conn
+	connID   []byte
+	obtained time.Time
+	buf      []byte
+}
+
+func newBenchUDP(cfg benchConfig) (*benchUDP, error) {
+	conn, err := net.Dial("udp", cfg.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &benchUDP{cfg: cfg, conn: conn, buf: make([]byte, 2048)}, nil
+}
+
+// exchange sends request and reads response with the same transaction ID
+func (b *benchUDP) exchange(ctx context.Context, req []byte, expectedAction uint32) ([]byte, error) {
+	txID := req[12:16]
+	_, _ = rand.Read(txID)
+	deadline := time.Now().Add(b.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := b.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := b.conn.Write(req); err != nil {
+		return nil, err
+	}
+	n, err := b.conn.Read(b.buf)
+	if err != nil {
+		return nil, err
+	}
+	resp := b.buf[:n]
+	if n < 8 {
+		return nil, errBenchUDPResponse
+	}
+	if !bytes.Equal(resp[4:8], txID) {
+		return nil, errBenchTxID
+	}
+	switch action := binary.BigEndian.Uint32(resp[:4]); action {
+	case expectedAction:
+		return resp, nil
+	case benchUDPActionError:
+		return nil, errors.New(string(resp[8:]))
+	default:
+		return nil, fmt.Errorf("unexpected action %d", action)
+	}
+}
+
+func (b *benchUDP) connect(ctx context.Context) error {
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[:8], benchUDPProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], benchUDPActionConnect)
+	resp, err := b.exchange(ctx, req, benchUDPActionConnect)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 16 {
+		return errBenchUDPResponse
+	}
+	b.connID, b.obtained = bytes.Clone(resp[8:16]), time.Now()
+	return nil
+}
+
+func (b *benchUDP) announce(ctx context.Context, ih []byte, peerID []byte, port uint16, left uint64) error {
+	if b.connID == nil || time.Since(b.obtained) > benchConnIDLifetime {
+		if err := b.connect(ctx); err != nil {
+			return err
+		}
+	}
+	req := make([]byte, benchUDPAnnounceLen)
+	copy(req[:8], b.connID)
+	binary.BigEndian.PutUint32(req[8:12], benchUDPActionAnnounce)
+	copy(req[16:36], ih)
+	copy(req[36:56], peerID)
+	binary.BigEndian.PutUint64(req[64:72], left)
+	// nolint:gosec
+	binary.BigEndian.PutUint32(req[92:96], uint32(b.cfg.NumWant))
+	binary.BigEndian.PutUint16(req[96:98], port)
+	resp, err := b.exchange(ctx, req, benchUDPActionAnnounce)
+	if err == nil && len(resp) < 20 {
+		err = errBenchUDPResponse
+	}
+	if err != nil {
+		// connection ID may be expired
+		b.connID = nil
+	}
+	return err
+}
+
+func (b *benchUDP) Close() error {
+	return b.conn.Close()
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
+	fu "github.com/sot-tech/mochi/frontend/udp"
+	"github.com/sot-tech/mochi/middleware"
+	l "github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/tracker"
+)
+
+const (
+	outArg    = "out"
+	inArg     = "in"
+	lengthArg = "length"
+	rawArg    = "raw"
+
+	// stdio is the file name which means standard input or output
+	stdio            = "-"
+	defaultKeyLength = 32
+)
+
+var errDumpNotSupported = errors.New("storage does not support state dump")
+
+// command is the subcommand of main binary
+type command struct {
+	usage string
+	// setup registers command's flags and returns
+	// function, which executes command
+	setup func(fs *flag.FlagSet) func() error
+}
+
+var commands = map[string]command{
+	"serve":          {"start tracker (default)", serve},
+	"check-config":   {"validate configuration file", checkConfigCommand},
+	"dump-state":     {"write peers of configured storage as JSON lines", dumpStateCommand},
+	"import-state":   {"put peers written by dump-state into configured storage", importStateCommand},
+	"bench-announce": {"generate announce load against tracker", benchAnnounceCommand},
+	"keygen":         {"generate private key for UDP frontend", keygenCommand},
+	"components":     {"list compiled in frontends, hooks and storages", componentsCommand},
+}
+
+// configureCommandLogger sets up human-readable logging to stderr
+// for utility commands
+func configureCommandLogger() error {
+	return l.ConfigureLogger(l.OutputStderr, "warn", true, false)
+}
+
+func checkConfigCommand(fs *flag.FlagSet) func() error {
+	configPath := fs.String(configArg, defaultConfigPath, "location of configuration file")
+	return func() error {
+		if err := configureCommandLogger(); err != nil {
+			return err
+		}
+		cfg, err := tracker.ParseConfigFileStrict(*configPath)
+		if err != nil {
+			return fmt.Errorf("unable to read config file: %w", err)
+		}
+		errs, warns := checkConfig(cfg)
+		for _, w := range warns {
+			fmt.Println("warning:", w)
+		}
+		for _, e := range errs {
+			fmt.Println("error:", e)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%d error(s) found in %s", len(errs), *configPath)
+		}
+		fmt.Println("configuration is valid")
+		return nil
+	}
+}
+
+// checkConfig verifies that all referenced frontends, hooks and storage
+// are registered and sanity checks values, which are not validated
+// by components themselves
+func checkConfig(cfg *tracker.Config) (errs, warns []string) {
+	checkHooks := func(chain string, hooks []middleware.HookConfig) {
+		for i, h := range hooks {
+			if !middleware.Registered(h.Name) {
+				errs = append(errs, fmt.Sprintf("%s[%d]: unknown hook '%s'", chain, i, h.Name))
+			}
+			for _, t := range h.Handle {
+				if t != middleware.HandleAnnounce && t != middleware.HandleScrape {
+					errs = append(errs, fmt.Sprintf("%s[%d]: unknown request type '%s'", chain, i, t))
+				}
+			}
+		}
+	}
+
+	if len(cfg.Frontends) == 0 {
+		errs = append(errs, "no frontends configured")
+	}
+	for i, fc := range cfg.Frontends {
+		prefix := fmt.Sprintf("frontends[%d]", i)
+		if !frontend.Registered(fc.Name) {
+			errs = append(errs, fmt.Sprintf("%s: unknown frontend '%s'", prefix, fc.Name))
+		}
+		if fc.Name == fu.Name {
+			if key, _ := fc.Config["private_key"].(string); len(key) == 0 {
+				warns = append(warns, prefix+": private_key is not set, connection IDs will not survive restart")
+			}
+		}
+		checkHooks(prefix+".prehooks", fc.PreHooks)
+		checkHooks(prefix+".posthooks", fc.PostHooks)
+		checkHooks(prefix+".responsehooks", fc.ResponseHooks)
+	}
+	checkHooks("prehooks", cfg.PreHooks)
+	checkHooks("posthooks", cfg.PostHooks)
+	checkHooks("responsehooks", cfg.ResponseHooks)
+
+	if !storage.Registered(cfg.Storage.Name) {
+		errs = append(errs, fmt.Sprintf("storage: unknown storage '%s'", cfg.Storage.Name))
+	}
+
+	tenants := make(map[string]bool, len(cfg.Tenants))
+	for i, tc := range cfg.Tenants {
+		prefix := fmt.Sprintf("tenants[%d]", i)
+		if len(tc.Name) == 0 {
+			errs = append(errs, prefix+": name not provided")
+		} else if tenants[tc.Name] {
+			errs = append(errs, fmt.Sprintf("%s: duplicate name '%s'", prefix, tc.Name))
+		}
+		tenants[tc.Name] = true
+		if len(tc.Hosts) == 0 && len(tc.PathPrefix) == 0 {
+			errs = append(errs, prefix+": neither hosts nor path_prefix provided")
+		}
+		if tc.Storage != nil && !storage.Registered(tc.Storage.Name) {
+			errs = append(errs, fmt.Sprintf("%s.storage: unknown storage '%s'", prefix, tc.Storage.Name))
+		}
+		checkHooks(prefix+".prehooks", tc.PreHooks)
+		checkHooks(prefix+".posthooks", tc.PostHooks)
+		checkHooks(prefix+".responsehooks", tc.ResponseHooks)
+	}
+
+	if len(cfg.Replication.Peers) > 0 && len(cfg.AdminAddr) == 0 {
+		errs = append(errs, "replication: admin_addr is required to serve peers")
+	}
+	if len(cfg.AdminAddr) > 0 {
+		if err := cfg.AdminAuth.Validate(); err != nil {
+			errs = append(errs, "admin_auth: "+err.Error())
+		} else if !cfg.AdminAuth.Enabled() {
+			warns = append(warns, "admin_auth: no credentials configured, admin API is not authenticated")
+		}
+	}
+
+	if cfg.Log != nil {
+		if len(cfg.Log.Level) > 0 {
+			if _, err := zerolog.ParseLevel(strings.ToLower(cfg.Log.Level)); err != nil {
+				errs = append(errs, "log.level: "+err.Error())
+			}
+		}
+		for comp, lvl := range cfg.Log.Levels {
+			if _, err := zerolog.ParseLevel(strings.ToLower(lvl)); err != nil {
+				errs = append(errs, fmt.Sprintf("log.levels.%s: %s", comp, err))
+			}
+		}
+		for i, o := range cfg.Log.Outputs {
+			switch o.Type {
+			case l.OutputStderr, l.OutputStdout, l.OutputFile, l.OutputSyslog, l.OutputJournald, "":
+			default:
+				errs = append(errs, fmt.Sprintf("log.outputs[%d]: unknown type '%s'", i, o.Type))
+			}
+		}
+	}
+	if len(cfg.StatsD.Addr) > 0 {
+		if _, err := cfg.StatsD.Validate(); err != nil {
+			errs = append(errs, "statsd: "+err.Error())
+		}
+	}
+	if _, err := cfg.Privacy.Validate(); err != nil {
+		errs = append(errs, "privacy: "+err.Error())
+	}
+	if len(cfg.Ops.Addr) > 0 && len(cfg.Ops.Token) == 0 {
+		errs = append(errs, "ops: token not provided")
+	}
+	if cfg.Export.Enabled() {
+		if _, err := cfg.Export.Validate(); err != nil {
+			errs = append(errs, "export: "+err.Error())
+		}
+		if cfg.Export.Endpoint && len(cfg.Ops.Addr) == 0 {
+			errs = append(errs, "export: ops server is required to serve endpoint")
+		}
+	}
+	if cfg.Takedown.Enabled() {
+		if _, err := cfg.Takedown.Validate(); err != nil {
+			errs = append(errs, "takedown: "+err.Error())
+		}
+	}
+	if cfg.Admission.Enabled() {
+		if _, err := cfg.Admission.Validate(); err != nil {
+			errs = append(errs, "admission: "+err.Error())
+		}
+	}
+	return
+}
+
+// peerRecord is the line of state dump
+type peerRecord struct {
+	InfoHash string `json:"info_hash"`
+	PeerID   string `json:"peer_id"`
+	Addr     string `json:"addr"`
+	Seeder   bool   `json:"seeder"`
+}
+
+// dumpState writes all peers stored in ps as JSON lines.
+// If anonymize is set, addresses are replaced with privacy.String
+// representation without port, such dump cannot be imported.
+func dumpState(ctx context.Context, ps storage.PeerStorage, w io.Writer, anonymize bool) (n int, err error) {
+	d, ok := ps.(storage.Dumper)
+	if !ok {
+		return 0, errDumpNotSupported
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err = d.Dump(ctx, func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error {
+		n++
+		addr := netip.AddrPortFrom(peer.Addr(), peer.Port()).String()
+		if anonymize {
+			addr = privacy.String(peer.Addr())
+		}
+		return enc.Encode(peerRecord{
+			InfoHash: ih.String(),
+			PeerID:   peer.ID.String(),
+			Addr:     addr,
+			Seeder:   seeder,
+		})
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	return
+}
+
+// importState reads JSON lines written by dumpState and puts peers into ps
+func importState(ctx context.Context, ps storage.PeerStorage, r io.Reader) (n int, err error) {
+	dec := json.NewDecoder(r)
+	for {
+		var rec peerRecord
+		if err = dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return
+		}
+		var ih bittorrent.InfoHash
+		if ih, err = bittorrent.NewInfoHashString(rec.InfoHash); err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		var peer bittorrent.Peer
+		if peer.AddrPort, err = netip.ParseAddrPort(rec.Addr); err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		var id []byte
+		if id, err = hex.DecodeString(rec.PeerID); err == nil {
+			peer.ID, err = bittorrent.NewPeerID(id)
+		}
+		if err != nil {
+			return n, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		if rec.Seeder {
+			err = ps.PutSeeder(ctx, ih, peer)
+		} else {
+			err = ps.PutLeecher(ctx, ih, peer)
+		}
+		if err != nil {
+			return
+		}
+		n++
+	}
+}
+
+// openStateStorage parses configuration and creates configured storage,
+// which must be preservable to share state with tracker
+func openStateStorage(configPath string) (storage.PeerStorage, error) {
+	if err := configureCommandLogger(); err != nil {
+		return nil, err
+	}
+	cfg, err := tracker.ParseConfigFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+	if err = privacy.Configure(cfg.Privacy); err != nil {
+		return nil, fmt.Errorf("unable to configure privacy: %w", err)
+	}
+	ps, err := storage.NewPeerStorage(cfg.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+	if !ps.Preservable() {
+		_ = ps.Close()
+		return nil, fmt.Errorf("storage '%s' is not preservable", cfg.Storage.Name)
+	}
+	return ps, nil
+}
+
+func dumpStateCommand(fs *flag.FlagSet) func() error {
+	configPath := fs.String(configArg, defaultConfigPath, "location of configuration file")
+	out := fs.String(outArg, stdio, "output file, '-' means stdout")
+	raw := fs.Bool(rawArg, false, "write addresses as is even if privacy mode is enabled")
+	return func() (err error) {
+		var ps storage.PeerStorage
+		if ps, err = openStateStorage(*configPath); err != nil {
+			return
+		}
+		defer ps.Close()
+		w := os.Stdout
+		if *out != stdio {
+			if w, err = os.Create(*out); err != nil {
+				return
+			}
+			defer func() {
+				if cErr := w.Close(); err == nil {
+					err = cErr
+				}
+			}()
+		}
+		var n int
+		if n, err = dumpState(context.Background(), ps, w, privacy.Enabled() && !*raw); err == nil {
+			_, _ = fmt.Fprintln(os.Stderr, n, "peers dumped")
+		}
+		return
+	}
+}
+
+func importStateCommand(fs *flag.FlagSet) func() error {
+	configPath := fs.String(configArg, defaultConfigPath, "location of configuration file")
+	in := fs.String(inArg, stdio, "input file, '-' means stdin")
+	return func() (err error) {
+		var ps storage.PeerStorage
+		if ps, err = openStateStorage(*configPath); err != nil {
+			return
+		}
+		defer ps.Close()
+		r := os.Stdin
+		if *in != stdio {
+			if r, err = os.Open(*in); err != nil {
+				return
+			}
+			defer r.Close()
+		}
+		n, err := importState(context.Background(), ps, r)
+		_, _ = fmt.Fprintln(os.Stderr, n, "peers imported")
+		return err
+	}
+}
+
+func keygenCommand(fs *flag.FlagSet) func() error {
+	length := fs.Int(lengthArg, defaultKeyLength, "key length")
+	return func() error {
+		if *length <= 0 {
+			return fmt.Errorf("invalid key length %d", *length)
+		}
+		key, err := fu.GenerateKey(*length)
+		if err == nil {
+			fmt.Println(key)
+		}
+		return err
+	}
+}
+
+// componentsCommand prints names of registered components,
+// which may be used in configuration
+func componentsCommand(*flag.FlagSet) func() error {
+	return func() error {
+		writeComponents(os.Stdout)
+		return nil
+	}
+}
+
+func writeComponents(w io.Writer) {
+	for _, c := range []struct {
+		kind  string
+		names []string
+	}{
+		{"frontends", frontend.Names()},
+		{"hooks", middleware.Names()},
+		{"storages", storage.Names()},
+	} {
+		_, _ = fmt.Fprintf(w, "%s:\n", c.kind)
+		for _, n := range c.names {
+			_, _ = fmt.Fprintf(w, "  %s\n", n)
+		}
+	}
+}
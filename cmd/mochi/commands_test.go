@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/tracker"
+)
+
+func TestCheckConfig(t *testing.T) {
+	const cfgYAML = `
+storage:
+    name: unknown
+    config: {}
+frontends:
+    -   name: udp
+        config:
+            addr: "127.0.0.1:6969"
+        prehooks:
+            -   name: no such hook
+prehooks:
+    -   name: client approval
+        handle: [ announce, connect ]
+tenants:
+    -   name: tenant
+ops:
+    addr: "127.0.0.1:6880"
+admin_addr: "127.0.0.1:6881"
+admin_auth:
+    tokens:
+        -   token: secret
+            role: root
+`
+	path := filepath.Join(t.TempDir(), "mochi.yaml")
+	if err := os.WriteFile(path, []byte(cfgYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := tracker.ParseConfigFileStrict(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, warns := checkConfig(cfg)
+	expected := []string{
+		"frontends[0].prehooks[0]: unknown hook 'no such hook'",
+		"prehooks[0]: unknown request type 'connect'",
+		"storage: unknown storage 'unknown'",
+		"tenants[0]: neither hosts nor path_prefix provided",
+		"admin_auth: tokens[0]: unknown role 'root'",
+		"ops: token not provided",
+	}
+	if strings.Join(errs, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(warns) != 1 || !strings.Contains(warns[0], "private_key") {
+		t.Fatalf("unexpected warnings: %v", warns)
+	}
+
+	if errs, _ = checkConfig(tracker.QuickConfig); len(errs) > 0 {
+		t.Fatalf("quick config expected to be valid, got: %v", errs)
+	}
+
+	// unknown fields are rejected in strict mode only
+	if err = os.WriteFile(path, []byte("unknown_field: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tracker.ParseConfigFileStrict(path); err == nil {
+		t.Fatal("unknown field expected to be rejected")
+	}
+	if _, err = tracker.ParseConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteComponents(t *testing.T) {
+	var buf bytes.Buffer
+	writeComponents(&buf)
+	for _, s := range []string{"frontends:\n", "  http\n", "  udp\n", "hooks:\n", "  jwt\n", "storages:\n", "  memory\n"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%q expected in output:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestStateDumpImport(t *testing.T) {
+	newStorage := func() storage.PeerStorage {
+		ps, err := storage.NewPeerStorage(conf.NamedMapConfig{Name: "memory", Config: conf.MapConfig{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ps
+	}
+	src, dst := newStorage(), newStorage()
+	defer src.Close()
+	defer dst.Close()
+
+	ctx := context.Background()
+	ih, _ := bittorrent.NewInfoHash(hashes[0])
+	seeder := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	copy(seeder.ID[:], peers[0])
+	leecher := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("[2001:db8::1]:6882")}
+	copy(leecher.ID[:], peers[1])
+	if err := src.PutSeeder(ctx, ih, seeder); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.PutLeecher(ctx, ih, leecher); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := dumpState(ctx, src, &buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 dumped peers, got %d", n)
+	}
+	if n, err = importState(ctx, dst, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 imported peers, got %d", n)
+	}
+	leechers, seeders, _, err := dst.ScrapeSwarm(ctx, ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leechers != 1 || seeders != 1 {
+		t.Fatalf("expected 1 seeder and 1 leecher, got %d and %d", seeders, leechers)
+	}
+
+	if _, err = importState(ctx, dst, strings.NewReader(`{"info_hash":"00","peer_id":"00","addr":"1.2.3.4:1"}`)); err == nil {
+		t.Fatal("invalid record expected to be rejected")
+	}
+
+	if err = privacy.Configure(privacy.Config{Mode: privacy.ModeTruncate}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = privacy.Configure(privacy.Config{}) }()
+	buf.Reset()
+	if _, err = dumpState(ctx, src, &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); !strings.Contains(s, `"1.2.3.0/24"`) || !strings.Contains(s, `"2001:db8::/48"`) || strings.Contains(s, "1.2.3.4") {
+		t.Fatalf("expected anonymized addresses, got %s", s)
+	}
+}
+
+func TestBenchAnnounce(t *testing.T) {
+	const cfgYAML = `
+storage:
+    name: memory
+    config: {}
+frontends:
+    -   name: udp
+        config:
+            addr: "127.0.0.1:16972"
+    -   name: http
+        config:
+            addr: "127.0.0.1:16973"
+`
+	cfg := new(tracker.Config)
+	if err := yaml.Unmarshal([]byte(cfgYAML), cfg); err != nil {
+		t.Fatal(err)
+	}
+	s, err := tracker.New(cfg)
+	if err == nil {
+		err = s.Start()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for _, addr := range []string{"udp://127.0.0.1:16972", "http://127.0.0.1:16973"} {
+		u, err := url.Parse(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res benchResult
+		// wait until listener started
+		deadline := time.Now().Add(timeout)
+		for {
+			res, err = benchAnnounce(context.Background(), benchConfig{
+				URL:         u,
+				Concurrency: 2,
+				Requests:    20,
+				Swarms:      5,
+				Peers:       10,
+				NumWant:     5,
+				Timeout:     timeout,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Errors == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if res.Errors > 0 {
+			t.Fatalf("%s: %d errors, last: %v", addr, res.Errors, res.LastError)
+		}
+		if res.Requests != 20 || len(res.Latencies) != 20 {
+			t.Fatalf("%s: expected 20 requests, got %d", addr, res.Requests)
+		}
+	}
+}
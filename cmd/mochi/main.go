@@ -8,9 +8,12 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"slices"
 	"syscall"
 
 	l "github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/tracker"
 )
 
 const (
@@ -21,52 +24,102 @@ const (
 	configArg    = "config"
 	quickArg     = "quick"
 	versionArg   = "version"
+
+	defaultConfigPath = "/etc/mochi.yaml"
 )
 
 // Version is variable to set version number in build time
 var Version = "dev"
 
 func main() {
-	var err error
+	if len(os.Args) > 1 {
+		if c, ok := commands[os.Args[1]]; ok {
+			fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+			run := c.setup(fs)
+			_ = fs.Parse(os.Args[2:])
+			if err := run(); err != nil {
+				log.Fatal(os.Args[1], ": ", err)
+			}
+			return
+		}
+	}
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		_, _ = fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			_, _ = fmt.Fprintf(out, "  %-16s%s\n", name, commands[name].usage)
+		}
+		_, _ = fmt.Fprintf(out, "\nTracker is started if command is not provided. Flags:\n")
+		flag.PrintDefaults()
+	}
+	run := serve(flag.CommandLine)
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	logOut := flag.String(logOutArg, "stderr", "output for logging, might be 'stderr', 'stdout' or file path")
-	logLevel := flag.String(logLevelArg, "warn", "logging level: trace, debug, info, warn, error, fatal, panic")
-	logPretty := flag.Bool(logPrettyArg, false,
+// serve registers tracker flags and returns function,
+// which starts tracker and waits for termination signal
+func serve(fs *flag.FlagSet) func() error {
+	logOut := fs.String(logOutArg, "stderr", "output for logging, might be 'stderr', 'stdout' or file path. ignored if 'log' set in config")
+	logLevel := fs.String(logLevelArg, "warn", "logging level: trace, debug, info, warn, error, fatal, panic. ignored if 'log' set in config")
+	logPretty := fs.Bool(logPrettyArg, false,
 		"enable log pretty print. used only if 'logOut' set to 'stdout' or 'stderr'. if not set, log outputs json")
 	//goland:noinspection GoBoolExpressions
-	logColored := flag.Bool(logColorsArg, runtime.GOOS == "windows",
+	logColored := fs.Bool(logColorsArg, runtime.GOOS == "windows",
 		"enable log coloring. used only if set 'logPretty'")
-	configPath := flag.String(configArg, "/etc/mochi.yaml", "location of configuration file")
-	quickStart := flag.Bool(quickArg, false,
+	configPath := fs.String(configArg, defaultConfigPath, "location of configuration file")
+	quickStart := fs.Bool(quickArg, false,
 		"start tracker with default configuration (all frontends, in-memory store, no hooks)")
-	version := flag.Bool(versionArg, false, "print version and exit")
-	flag.Parse()
+	version := fs.Bool(versionArg, false, "print version and exit")
 
-	if *version {
-		fmt.Println("mochi:", Version)
-		return
-	}
+	return func() error {
+		if *version {
+			fmt.Println("mochi:", Version)
+			return nil
+		}
 
-	if err = l.ConfigureLogger(*logOut, *logLevel, *logPretty, *logColored); err != nil {
-		log.Fatal("unable to configure logger: ", err)
-	}
+		var cfg *tracker.Config
+		var err error
+		if *quickStart {
+			cfg = tracker.QuickConfig
+		} else {
+			cfg, err = tracker.ParseConfigFile(*configPath)
+			if err != nil {
+				return fmt.Errorf("unable to read config file: %w", err)
+			}
+		}
 
-	var cfg *Config
-	if *quickStart {
-		cfg = QuickConfig
-	} else {
-		cfg, err = ParseConfigFile(*configPath)
+		// logging configuration from file takes precedence over flags
+		if cfg.Log != nil {
+			err = l.Configure(*cfg.Log)
+		} else {
+			err = l.ConfigureLogger(*logOut, *logLevel, *logPretty, *logColored)
+		}
 		if err != nil {
-			log.Fatal("unable to read config file: ", err)
+			return fmt.Errorf("unable to configure logger: %w", err)
 		}
+		if err = privacy.Configure(cfg.Privacy); err != nil {
+			return fmt.Errorf("unable to configure privacy: %w", err)
+		}
+		defer l.Close()
+		t, err := tracker.New(cfg)
+		if err == nil {
+			err = t.Start()
+		}
+		if err != nil {
+			return fmt.Errorf("unable to start server: %w", err)
+		}
+		defer t.Stop()
+		ch := make(chan os.Signal, 2)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+		return nil
 	}
-	var s Server
-
-	if err = s.Run(cfg); err != nil {
-		log.Fatal("unable to start server: ", err)
-	}
-	defer s.Shutdown()
-	ch := make(chan os.Signal, 2)
-	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
-	<-ch
 }
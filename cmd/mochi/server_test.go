@@ -18,11 +18,14 @@ import (
 
 	cr "crypto/rand"
 
+	"gopkg.in/yaml.v3"
+
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/frontend"
 	hf "github.com/sot-tech/mochi/frontend/http"
 	l "github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/pkg/str2bytes"
+	"github.com/sot-tech/mochi/tracker"
 )
 
 const (
@@ -161,11 +164,14 @@ func buildAnnounceUDPReq(txID, connID []byte) []byte {
 }
 
 func BenchmarkServerUDPAnnounce(b *testing.B) {
-	var s Server
-	if err := s.Run(QuickConfig); err != nil {
+	s, err := tracker.New(tracker.QuickConfig)
+	if err == nil {
+		err = s.Start()
+	}
+	if err != nil {
 		b.Fatal(err)
 	}
-	defer s.Shutdown()
+	defer s.Stop()
 
 	addr := "127.0.0.1" + frontend.DefaultListenAddress
 
@@ -246,11 +252,14 @@ func sendHTTPReq(u string) (err error) {
 }
 
 func BenchmarkServerHTTPAnnounce(b *testing.B) {
-	var s Server
-	if err := s.Run(QuickConfig); err != nil {
+	s, err := tracker.New(tracker.QuickConfig)
+	if err == nil {
+		err = s.Start()
+	}
+	if err != nil {
 		b.Fatal(err)
 	}
-	defer s.Shutdown()
+	defer s.Stop()
 
 	reqs := make([]string, len(hashes)*len(peers))
 	addr := "127.0.0.1" + frontend.DefaultListenAddress
@@ -295,3 +304,154 @@ func BenchmarkServerHTTPAnnounce(b *testing.B) {
 		}
 	})
 }
+
+func TestFrontendChains(t *testing.T) {
+	const cfgYAML = `
+storage:
+    name: memory
+    config: {}
+frontends:
+    -   name: http
+        config:
+            addr: "127.0.0.1:16970"
+    -   name: http
+        config:
+            addr: "127.0.0.1:16971"
+        prehooks:
+            -   name: client approval
+                config:
+                    client_id_list: [ "XX0000" ]
+`
+	cfg := new(tracker.Config)
+	if err := yaml.Unmarshal([]byte(cfgYAML), cfg); err != nil {
+		t.Fatal(err)
+	}
+	s, err := tracker.New(cfg)
+	if err == nil {
+		err = s.Start()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// wait until listeners started
+	for _, addr := range []string{"127.0.0.1:16970", "127.0.0.1:16971"} {
+		deadline := time.Now().Add(timeout)
+		for {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				_ = conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	query := url.Values{
+		"event":      []string{bittorrent.StartedStr},
+		"compact":    []string{"1"},
+		"left":       []string{"1"},
+		"downloaded": []string{"0"},
+		"uploaded":   []string{"0"},
+		"port":       []string{"6881"},
+		"info_hash":  []string{str2bytes.BytesToString(hashes[0])},
+		"peer_id":    []string{"-TR3000-000000000000"},
+	}.Encode()
+	if err := sendHTTPReq("http://127.0.0.1:16970" + hf.DefaultAnnounceRoute + "?" + query); err != nil {
+		t.Fatalf("announce to public frontend failed: %v", err)
+	}
+	if err := sendHTTPReq("http://127.0.0.1:16971" + hf.DefaultAnnounceRoute + "?" + query); err == nil {
+		t.Fatal("announce to restricted frontend expected to be rejected")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	const cfgYAML = `
+storage:
+    name: memory
+    config: {}
+frontends:
+    -   name: http
+        config:
+            addr: "127.0.0.1:16972"
+tenants:
+    -   name: by host
+        hosts: [ tracker.example ]
+        prehooks:
+            -   name: client approval
+                config:
+                    client_id_list: [ "XX0000" ]
+    -   name: by path
+        path_prefix: /restricted
+        prehooks:
+            -   name: client approval
+                config:
+                    client_id_list: [ "XX0000" ]
+`
+	cfg := new(tracker.Config)
+	if err := yaml.Unmarshal([]byte(cfgYAML), cfg); err != nil {
+		t.Fatal(err)
+	}
+	s, err := tracker.New(cfg)
+	if err == nil {
+		err = s.Start()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("tcp", "127.0.0.1:16972")
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	query := url.Values{
+		"event":      []string{bittorrent.StartedStr},
+		"compact":    []string{"1"},
+		"left":       []string{"1"},
+		"downloaded": []string{"0"},
+		"uploaded":   []string{"0"},
+		"port":       []string{"6881"},
+		"info_hash":  []string{str2bytes.BytesToString(hashes[0])},
+		"peer_id":    []string{"-TR3000-000000000000"},
+	}.Encode()
+	if err := sendHTTPReq("http://127.0.0.1:16972" + hf.DefaultAnnounceRoute + "?" + query); err != nil {
+		t.Fatalf("announce to default tracker failed: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:16972"+hf.DefaultAnnounceRoute+"?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "tracker.example:16972"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "failure reason") {
+		t.Fatalf("announce to tenant matched by host expected to be rejected, got: %s", body)
+	}
+	if err := sendHTTPReq("http://127.0.0.1:16972/restricted" + hf.DefaultAnnounceRoute + "?" + query); err == nil {
+		t.Fatal("announce to tenant matched by path expected to be rejected")
+	}
+	if err := sendHTTPReq("http://127.0.0.1:16972/restricted/unknown"); err == nil {
+		t.Fatal("unknown route of tenant expected to be not found")
+	}
+}
@@ -0,0 +1,216 @@
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	rtmetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
+
+func init() {
+	prometheus.MustRegister(promAdmissionShed, promAdmissionMemory)
+}
+
+var (
+	promAdmissionShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_frontend_admission_shed_total",
+		Help: "The number of requests rejected because memory budget is exceeded",
+	}, []string{"frontend", "action"})
+	promAdmissionMemory = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mochi_frontend_admission_memory_bytes",
+		Help: "Approximate memory reserved by in-flight requests of all frontends",
+	}, func() float64 {
+		if a := admission.Load(); a != nil {
+			return float64(a.inFlight.Load())
+		}
+		return 0
+	})
+)
+
+// errMemoryBudget is the message of RetryError returned to shed requests
+const errMemoryBudget = "tracker is out of memory budget, retry later"
+
+// ErrRequestTooLarge is returned if scrape does not fit
+// AdmissionConfig.MaxRequestMemory
+var ErrRequestTooLarge = bittorrent.NewClientError(bittorrent.ReasonLimitExceeded, "too many info hashes requested")
+
+const (
+	defaultAdmissionRetryIn = time.Minute
+	heapSampleInterval      = time.Second
+	heapMetric              = "/memory/classes/heap/objects:bytes"
+
+	// approximate memory of request and response without peers or hashes
+	announceBaseMemory = 1024
+	scrapeBaseMemory   = 512
+	// approximate memory of single peer or scrape in response,
+	// including serialized form
+	peerMemory   = int64(unsafe.Sizeof(bittorrent.Peer{})) + 64
+	scrapeMemory = int64(unsafe.Sizeof(bittorrent.Scrape{})) + 64
+)
+
+var (
+	errNegativeBudget = errors.New("memory budget must not be negative")
+	errRequestBudget  = fmt.Errorf("request memory budget must be at least %d bytes", announceBaseMemory+peerMemory)
+
+	admission atomic.Pointer[Admission]
+)
+
+// AdmissionConfig limits approximate memory of in-flight requests
+// (announce's peers by numwant, scrape's hashes) of all frontends.
+// Zero values disable corresponding limits.
+type AdmissionConfig struct {
+	// MaxMemory is the budget of all in-flight requests in bytes,
+	// requests above it are rejected with `retry in`
+	MaxMemory int64 `yaml:"max_memory"`
+	// MaxRequestMemory is the budget of single request in bytes:
+	// numwant of announce is reduced to fit it, scrape is rejected
+	MaxRequestMemory int64 `yaml:"max_request_memory"`
+	// MaxHeap is the size of Go heap objects (live and not yet
+	// collected) in bytes, above which requests are rejected with `retry in`
+	MaxHeap int64 `yaml:"max_heap"`
+	// RetryIn is the time, after which rejected clients should retry (BEP 31)
+	RetryIn time.Duration `yaml:"retry_in"`
+}
+
+// Enabled returns true if any limit is set
+func (c AdmissionConfig) Enabled() bool {
+	return c.MaxMemory > 0 || c.MaxRequestMemory > 0 || c.MaxHeap > 0
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (c AdmissionConfig) Validate() (validCfg AdmissionConfig, err error) {
+	validCfg = c
+	if c.MaxMemory < 0 || c.MaxRequestMemory < 0 || c.MaxHeap < 0 {
+		return validCfg, errNegativeBudget
+	}
+	// announce with at least one peer must fit budget of single request
+	if c.MaxRequestMemory > 0 && c.MaxRequestMemory < announceBaseMemory+peerMemory {
+		return validCfg, errRequestBudget
+	}
+	if c.RetryIn < time.Minute {
+		validCfg.RetryIn = defaultAdmissionRetryIn
+		logger.Warn().
+			Str("name", "Admission.RetryIn").
+			Dur("provided", c.RetryIn).
+			Dur("default", validCfg.RetryIn).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// Admission tracks approximate memory of in-flight requests
+// and rejects requests, which exceed budget
+type Admission struct {
+	cfg      AdmissionConfig
+	errShed  error
+	inFlight atomic.Int64
+	heap     atomic.Int64
+	sampled  atomic.Int64
+}
+
+// ConfigureAdmission sets process-wide Admission built from cfg.
+// Config without limits disables admission control.
+func ConfigureAdmission(cfg AdmissionConfig) (err error) {
+	if !cfg.Enabled() {
+		admission.Store(nil)
+		return
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return
+	}
+	admission.Store(&Admission{cfg: cfg, errShed: bittorrent.NewRetryError(errMemoryBudget, cfg.RetryIn)})
+	logger.Debug().
+		Int64("maxMemory", cfg.MaxMemory).
+		Int64("maxRequestMemory", cfg.MaxRequestMemory).
+		Int64("maxHeap", cfg.MaxHeap).
+		Msg("admission control configured")
+	return
+}
+
+// Reservation is the memory reserved by admitted request,
+// Release must be called after request (including asynchronous
+// post hooks) is processed. Zero Reservation does nothing.
+type Reservation struct {
+	a *Admission
+	n int64
+}
+
+// Release returns reserved memory to budget
+func (r Reservation) Release() {
+	if r.a != nil {
+		r.a.inFlight.Add(-r.n)
+	}
+}
+
+// heapExceeded checks heap size, which is sampled
+// not more often than heapSampleInterval
+func (a *Admission) heapExceeded() bool {
+	if a.cfg.MaxHeap <= 0 {
+		return false
+	}
+	now, last := time.Now().UnixNano(), a.sampled.Load()
+	if now-last > int64(heapSampleInterval) && a.sampled.CompareAndSwap(last, now) {
+		sample := []rtmetrics.Sample{{Name: heapMetric}}
+		rtmetrics.Read(sample)
+		if sample[0].Value.Kind() == rtmetrics.KindUint64 {
+			a.heap.Store(int64(sample[0].Value.Uint64()))
+		}
+	}
+	return a.heap.Load() > a.cfg.MaxHeap
+}
+
+func (a *Admission) reserve(name, action string, n int64) (Reservation, error) {
+	if a.heapExceeded() {
+		return Reservation{}, a.shed(name, action)
+	}
+	if total := a.inFlight.Add(n); a.cfg.MaxMemory > 0 && total > a.cfg.MaxMemory {
+		a.inFlight.Add(-n)
+		return Reservation{}, a.shed(name, action)
+	}
+	return Reservation{a: a, n: n}, nil
+}
+
+func (a *Admission) shed(name, action string) error {
+	if metrics.Enabled() {
+		promAdmissionShed.WithLabelValues(name, action).Inc()
+	}
+	return a.errShed
+}
+
+// AdmitAnnounce reserves memory of announce received by frontend
+// with provided name. NumWant of req is reduced to fit per-request budget.
+// Returns RetryError if budget is exceeded.
+func AdmitAnnounce(name string, req *bittorrent.AnnounceRequest) (Reservation, error) {
+	a := admission.Load()
+	if a == nil {
+		return Reservation{}, nil
+	}
+	if a.cfg.MaxRequestMemory > 0 {
+		maxPeers := max((a.cfg.MaxRequestMemory-announceBaseMemory)/peerMemory, 0)
+		req.NumWant = uint32(min(int64(req.NumWant), maxPeers))
+	}
+	return a.reserve(name, "announce", announceBaseMemory+int64(req.NumWant)*peerMemory)
+}
+
+// AdmitScrape reserves memory of scrape received by frontend
+// with provided name. Returns ErrRequestTooLarge if scrape does not fit
+// per-request budget or RetryError if budget is exceeded.
+func AdmitScrape(name string, req *bittorrent.ScrapeRequest) (Reservation, error) {
+	a := admission.Load()
+	if a == nil {
+		return Reservation{}, nil
+	}
+	n := scrapeBaseMemory + int64(len(req.InfoHashes))*scrapeMemory
+	if a.cfg.MaxRequestMemory > 0 && n > a.cfg.MaxRequestMemory {
+		return Reservation{}, ErrRequestTooLarge
+	}
+	return a.reserve(name, "scrape", n)
+}
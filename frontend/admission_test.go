@@ -0,0 +1,58 @@
+package frontend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestAdmission(t *testing.T) {
+	require.Nil(t, ConfigureAdmission(AdmissionConfig{}))
+	r, err := AdmitAnnounce("test", &bittorrent.AnnounceRequest{NumWant: 1000})
+	require.Nil(t, err)
+	r.Release()
+	require.ErrorIs(t, ConfigureAdmission(AdmissionConfig{MaxMemory: -1, MaxHeap: 1}), errNegativeBudget)
+	require.ErrorIs(t, ConfigureAdmission(AdmissionConfig{MaxRequestMemory: announceBaseMemory}), errRequestBudget)
+
+	require.Nil(t, ConfigureAdmission(AdmissionConfig{
+		MaxMemory:        2 * (announceBaseMemory + 10*peerMemory),
+		MaxRequestMemory: announceBaseMemory + 10*peerMemory,
+	}))
+	defer func() { _ = ConfigureAdmission(AdmissionConfig{}) }()
+	a := admission.Load()
+	require.Equal(t, defaultAdmissionRetryIn, a.cfg.RetryIn)
+
+	// numwant is reduced to fit per-request budget
+	req := &bittorrent.AnnounceRequest{NumWant: 50}
+	r1, err := AdmitAnnounce("test", req)
+	require.Nil(t, err)
+	require.Equal(t, uint32(10), req.NumWant)
+	r2, err := AdmitAnnounce("test", &bittorrent.AnnounceRequest{NumWant: 5})
+	require.Nil(t, err)
+
+	// global budget is exceeded
+	_, err = AdmitAnnounce("test", &bittorrent.AnnounceRequest{NumWant: 10})
+	var retryErr bittorrent.RetryError
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, time.Minute, retryErr.RetryIn)
+	r1.Release()
+	r3, err := AdmitAnnounce("test", &bittorrent.AnnounceRequest{NumWant: 10})
+	require.Nil(t, err)
+	r2.Release()
+	r3.Release()
+	require.Zero(t, a.inFlight.Load())
+
+	_, err = AdmitScrape("test", &bittorrent.ScrapeRequest{InfoHashes: make([]bittorrent.InfoHash, 1000)})
+	require.ErrorIs(t, err, ErrRequestTooLarge)
+	r, err = AdmitScrape("test", &bittorrent.ScrapeRequest{InfoHashes: make([]bittorrent.InfoHash, 2)})
+	require.Nil(t, err)
+	r.Release()
+
+	// any live heap is above 1 byte
+	require.Nil(t, ConfigureAdmission(AdmissionConfig{MaxHeap: 1}))
+	_, err = AdmitScrape("test", &bittorrent.ScrapeRequest{InfoHashes: make([]bittorrent.InfoHash, 2)})
+	require.ErrorAs(t, err, &retryErr)
+}
@@ -0,0 +1,53 @@
+package frontend
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// ErrorsConfig customizes messages of errors sent to clients
+// by all frontends
+type ErrorsConfig struct {
+	// Messages replace messages of errors with matching codes
+	// (i.e. `unapproved_client`)
+	Messages map[string]string `yaml:"messages"`
+	// Template is the text/template of message, executed with error's
+	// .Code, .Message (replaced with one from Messages if set) and .Retryable,
+	// i.e. `{{.Message}}, see https://example.com/faq#{{.Code}}`
+	Template string `yaml:"template"`
+}
+
+// ConfigureErrors sets process-wide bittorrent.ErrorFormatter built from
+// cfg. Empty config restores default formatter.
+func ConfigureErrors(cfg ErrorsConfig) error {
+	if len(cfg.Messages) == 0 && len(cfg.Template) == 0 {
+		bittorrent.SetErrorFormatter(nil)
+		return nil
+	}
+	var tmpl *template.Template
+	if len(cfg.Template) > 0 {
+		var err error
+		if tmpl, err = template.New("error").Option("missingkey=error").Parse(cfg.Template); err != nil {
+			return fmt.Errorf("invalid error template: %w", err)
+		}
+	}
+	bittorrent.SetErrorFormatter(func(e bittorrent.ClientError) string {
+		if msg, isOk := cfg.Messages[e.Code]; isOk {
+			e.Message = msg
+		}
+		if tmpl == nil {
+			return e.Message
+		}
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, e); err != nil {
+			logger.Error().Err(err).Str("code", e.Code).Msg("unable to format error message")
+			return e.Message
+		}
+		return sb.String()
+	})
+	logger.Debug().Int("messages", len(cfg.Messages)).Str("template", cfg.Template).Msg("client errors configured")
+	return nil
+}
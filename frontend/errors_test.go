@@ -0,0 +1,31 @@
+package frontend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestConfigureErrors(t *testing.T) {
+	defer bittorrent.SetErrorFormatter(nil)
+	banned := bittorrent.NewClientError(bittorrent.ReasonBanned, "banned")
+	other := bittorrent.ClientError{Message: "other"}
+
+	require.NotNil(t, ConfigureErrors(ErrorsConfig{Template: "{{.Message"}))
+
+	require.Nil(t, ConfigureErrors(ErrorsConfig{
+		Messages: map[string]string{bittorrent.ReasonBanned: "you are banned"},
+		Template: "{{.Message}}{{if .Code}} (see https://example.com/faq#{{.Code}}){{end}}",
+	}))
+	_, msg, isClient := bittorrent.ClientMessage(banned)
+	require.True(t, isClient)
+	require.Equal(t, "you are banned (see https://example.com/faq#banned)", msg)
+	_, msg, _ = bittorrent.ClientMessage(other)
+	require.Equal(t, "other", msg)
+
+	require.Nil(t, ConfigureErrors(ErrorsConfig{}))
+	_, msg, _ = bittorrent.ClientMessage(banned)
+	require.Equal(t, "banned", msg)
+}
@@ -3,9 +3,11 @@
 package frontend
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
 	"sync"
 
@@ -46,30 +48,62 @@ func RegisterBuilder(name string, b Builder) {
 	builders[name] = b
 }
 
-// Frontend dummy interface for bittorrent frontends
+// Registered returns true if Builder with provided name is registered
+func Registered(name string) bool {
+	buildersMU.RLock()
+	defer buildersMU.RUnlock()
+	_, ok := builders[name]
+	return ok
+}
+
+// Names returns sorted names of all registered Builder-s
+func Names() []string {
+	buildersMU.RLock()
+	defer buildersMU.RUnlock()
+	names := make([]string, 0, len(builders))
+	for n := range builders {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Frontend interface for bittorrent frontends
 type Frontend interface {
 	io.Closer
+	// Drain stops accepting new requests and waits until in-flight
+	// requests (including asynchronous post hooks) are processed
+	// or ctx is done. Remaining requests are canceled after ctx is done.
+	Drain(ctx context.Context) error
+}
+
+// NewFrontend creates and starts Frontend with name and configuration
+// provided in config. Returns error if frontend with provided name
+// does not exist.
+func NewFrontend(c conf.NamedMapConfig, logic *middleware.Logic) (f Frontend, err error) {
+	buildersMU.RLock()
+	newFrontend, ok := builders[c.Name]
+	buildersMU.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("frontend with name '%s' does not exists", c.Name)
+	}
+	logger.Debug().Str("name", c.Name).Object("config", c).Msg("starting frontend")
+	if f, err = newFrontend(c.Config, logic); err == nil {
+		logger.Info().Str("name", c.Name).Msg("frontend started")
+	}
+	return
 }
 
 // NewFrontends is a utility function for initializing Frontend-s in bulk.
-// Returns nil hook and error if frontend with name provided in config
-// does not exists.
+// Returns already started frontends and error if frontend with
+// name provided in config does not exists.
 func NewFrontends(configs []conf.NamedMapConfig, logic *middleware.Logic) (fs []Frontend, err error) {
-	buildersMU.RLock()
-	defer buildersMU.RUnlock()
 	for _, c := range configs {
-		logger.Debug().Str("name", c.Name).Object("config", c).Msg("starting frontend")
-		newFrontend, ok := builders[c.Name]
-		if !ok {
-			err = fmt.Errorf("hook with name '%s' does not exists", c.Name)
-			break
-		}
 		var f Frontend
-		if f, err = newFrontend(c.Config, logic); err != nil {
+		if f, err = NewFrontend(c, logic); err != nil {
 			break
 		}
 		fs = append(fs, f)
-		logger.Info().Str("name", c.Name).Msg("frontend started")
 	}
 	return
 }
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"bytes"
+	"net/netip"
+	"strconv"
+)
+
+// bencoder appends bencoded values to the buffer. Numbers and addresses
+// are formatted in the spare capacity of the buffer, so once pooled buffer
+// has grown, response is encoded without allocations.
+type bencoder struct {
+	*bytes.Buffer
+}
+
+// digits writes decimal representation of n
+func (e bencoder) digits(n uint64) {
+	e.Write(strconv.AppendUint(e.AvailableBuffer(), n, 10))
+}
+
+// str writes bencoded string
+func (e bencoder) str(s string) {
+	e.digits(uint64(len(s)))
+	e.WriteByte(':')
+	e.WriteString(s)
+}
+
+// bytes writes bencoded string from raw bytes
+func (e bencoder) bytes(b []byte) {
+	e.digits(uint64(len(b)))
+	e.WriteByte(':')
+	e.Write(b)
+}
+
+// addr writes bencoded string with text representation of address
+func (e bencoder) addr(a netip.Addr) {
+	// the longest IPv6 address with zone fits into buffer
+	var scratch [64]byte
+	e.bytes(a.AppendTo(scratch[:0]))
+}
+
+// compact writes address and port in network byte order (BEP 23)
+func (e bencoder) compact(ap netip.AddrPort) {
+	if a := ap.Addr(); a.Is4() {
+		ip := a.As4()
+		e.Write(ip[:])
+	} else {
+		ip := a.As16()
+		e.Write(ip[:])
+	}
+	port := ap.Port()
+	e.WriteByte(byte(port >> 8))
+	e.WriteByte(byte(port))
+}
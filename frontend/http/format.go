@@ -0,0 +1,120 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
+)
+
+// formatParam is the query parameter, which selects format of response
+const formatParam = "format"
+
+const (
+	contentTypeBencode = "text/plain; charset=utf-8"
+	contentTypeJSON    = "application/json"
+)
+
+// responseFormat encodes responses of HTTP frontend
+type responseFormat interface {
+	contentType() string
+	announce(w io.Writer, resp *bittorrent.AnnounceResponse, compact bool, opts frontend.AnnounceOptions)
+	scrape(w io.Writer, resp *bittorrent.ScrapeResponse)
+	failure(w io.Writer, reqID string, err error)
+}
+
+// bencodeFormat is the default format of responses (BEP 3)
+type bencodeFormat struct{}
+
+func (bencodeFormat) contentType() string {
+	return contentTypeBencode
+}
+
+func (bencodeFormat) announce(w io.Writer, resp *bittorrent.AnnounceResponse, compact bool, opts frontend.AnnounceOptions) {
+	writeAnnounceResponse(w, resp, compact, opts.IncludePeerID, opts.OmitCounts, opts.TrackerID, opts.ExternalIP)
+}
+
+func (bencodeFormat) scrape(w io.Writer, resp *bittorrent.ScrapeResponse) {
+	writeScrapeResponse(w, resp)
+}
+
+func (bencodeFormat) failure(w io.Writer, reqID string, err error) {
+	writeErrorResponse(w, reqID, err)
+}
+
+// jsonFormat encodes responses as frontend.JSONAnnounce, frontend.JSONScrape
+// and frontend.JSONFailure. Peers are always encoded as dictionaries.
+type jsonFormat struct{}
+
+func (jsonFormat) contentType() string {
+	return contentTypeJSON
+}
+
+func (jsonFormat) announce(w io.Writer, resp *bittorrent.AnnounceResponse, _ bool, opts frontend.AnnounceOptions) {
+	writeJSON(w, frontend.NewJSONAnnounce(resp, opts))
+}
+
+func (jsonFormat) scrape(w io.Writer, resp *bittorrent.ScrapeResponse) {
+	writeJSON(w, frontend.NewJSONScrape(resp))
+}
+
+func (jsonFormat) failure(w io.Writer, reqID string, err error) {
+	if _, _, isClient := bittorrent.ClientMessage(err); !isClient {
+		logger.Error().Err(err).Str("requestID", reqID).Msg("internal error")
+	}
+	writeJSON(w, frontend.NewJSONFailure(err))
+}
+
+func writeJSON(w io.Writer, v any) {
+	bb := respBufferPool.Get()
+	defer respBufferPool.Put(bb)
+	if err := json.NewEncoder(bb).Encode(v); err != nil {
+		logger.Error().Err(err).Msg("unable to encode response")
+		return
+	}
+	_, _ = bb.WriteTo(w)
+}
+
+// negotiateFormat returns JSON format if it is requested by `format=json`
+// query parameter or accepted by client (`Accept: application/json`),
+// bencode format otherwise
+func negotiateFormat(ctx *fasthttp.RequestCtx) responseFormat {
+	if f := ctx.QueryArgs().Peek(formatParam); len(f) > 0 {
+		if string(f) == "json" {
+			return jsonFormat{}
+		}
+		return bencodeFormat{}
+	}
+	if bytes.Contains(ctx.Request.Header.Peek(fasthttp.HeaderAccept), []byte(contentTypeJSON)) {
+		return jsonFormat{}
+	}
+	return bencodeFormat{}
+}
+
+// format returns format of response to request, bencode
+// if JSON responses are not enabled
+func (f *httpFE) format(ctx *fasthttp.RequestCtx) responseFormat {
+	if !f.jsonResponses {
+		return bencodeFormat{}
+	}
+	// response depends on Accept header, so caches must not mix formats
+	ctx.Response.Header.Set(fasthttp.HeaderVary, fasthttp.HeaderAccept)
+	return negotiateFormat(ctx)
+}
+
+// announceOptions returns options of announce response of request
+func (f *httpFE) announceOptions(req *bittorrent.AnnounceRequest, includePeerID bool) (opts frontend.AnnounceOptions) {
+	opts = frontend.AnnounceOptions{
+		IncludePeerID: includePeerID,
+		OmitCounts:    f.omitCounts,
+		TrackerID:     f.TrackerID,
+	}
+	if f.externalIP {
+		opts.ExternalIP = req.GetObserved()
+	}
+	return
+}
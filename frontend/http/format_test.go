@@ -0,0 +1,40 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, tt := range []struct {
+		query, accept string
+		expected      responseFormat
+	}{
+		{"", "", bencodeFormat{}},
+		{"format=json", "", jsonFormat{}},
+		{"", "application/json, text/plain", jsonFormat{}},
+		{"format=bencode", "application/json", bencodeFormat{}},
+		{"", "text/plain", bencodeFormat{}},
+	} {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/announce?" + tt.query)
+		ctx.Request.Header.Set(fasthttp.HeaderAccept, tt.accept)
+		require.Equal(t, tt.expected, negotiateFormat(ctx), tt)
+	}
+
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/announce?format=json")
+	require.Equal(t, bencodeFormat{}, (&httpFE{}).format(ctx))
+	require.Equal(t, jsonFormat{}, (&httpFE{jsonResponses: true}).format(ctx))
+	require.Equal(t, fasthttp.HeaderAccept, string(ctx.Response.Header.Peek(fasthttp.HeaderVary)))
+}
+
+func TestJSONFailure(t *testing.T) {
+	ctx := new(fasthttp.RequestCtx)
+	jsonFormat{}.failure(ctx, "", bittorrent.ClientError{Message: "hello world"})
+	require.JSONEq(t, `{"failure reason": "hello world"}`, string(ctx.Response.Body()))
+}
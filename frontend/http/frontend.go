@@ -6,9 +6,9 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/netip"
-	"path"
 	"sync"
 	"time"
 
@@ -47,6 +47,22 @@ type Config struct {
 	AnnounceRoutes  []string      `cfg:"announce_routes"`
 	ScrapeRoutes    []string      `cfg:"scrape_routes"`
 	PingRoutes      []string      `cfg:"ping_routes"`
+	// Routes are additional routes with default parameters
+	Routes []RouteConfig `cfg:"routes"`
+	// ExternalIP enables `external ip` field (BEP 24) in announce response
+	ExternalIP bool `cfg:"external_ip"`
+	// Overload enables shedding of announces if frontend is overloaded
+	Overload frontend.OverloadOptions
+	// OmitCounts disables `complete` and `incomplete` fields in announce response
+	OmitCounts bool `cfg:"omit_counts"`
+	// JSONResponses enables JSON responses, requested with `format=json`
+	// query parameter or `Accept: application/json` header
+	JSONResponses bool `cfg:"json_responses"`
+	// ScrapeMaxAge enables caching headers (Cache-Control, ETag and
+	// Last-Modified) and conditional requests of scrape
+	ScrapeMaxAge time.Duration `cfg:"scrape_max_age"`
+	frontend.LifetimeOptions
+	frontend.DeadlineOptions
 	ParseOptions
 }
 
@@ -101,7 +117,16 @@ func (cfg Config) Validate() (validCfg Config, err error) {
 				Msg("falling back to default configuration")
 		}
 	}
-	if len(cfg.AnnounceRoutes) == 0 {
+	hasRoute := make(map[string]bool, len(cfg.Routes))
+	for i, r := range cfg.Routes {
+		if r.Type != RouteAnnounce && r.Type != RouteScrape && r.Type != RoutePing {
+			err = fmt.Errorf("routes[%d]: %w '%s'", i, errUnknownRouteType, r.Type)
+			return
+		}
+		hasRoute[r.Type] = true
+	}
+
+	if len(cfg.AnnounceRoutes) == 0 && !hasRoute[RouteAnnounce] {
 		validCfg.AnnounceRoutes = []string{DefaultAnnounceRoute}
 		logger.Warn().
 			Str("name", "AnnounceRoutes").
@@ -109,7 +134,7 @@ func (cfg Config) Validate() (validCfg Config, err error) {
 			Strs("default", validCfg.AnnounceRoutes).
 			Msg("falling back to default configuration")
 	}
-	if len(cfg.ScrapeRoutes) == 0 {
+	if len(cfg.ScrapeRoutes) == 0 && !hasRoute[RouteScrape] {
 		validCfg.ScrapeRoutes = []string{DefaultScrapeRoute}
 		logger.Warn().
 			Str("name", "ScrapeRoutes").
@@ -117,6 +142,9 @@ func (cfg Config) Validate() (validCfg Config, err error) {
 			Strs("default", validCfg.ScrapeRoutes).
 			Msg("falling back to default configuration")
 	}
+	validCfg.LifetimeOptions = cfg.LifetimeOptions.Validate(logger)
+	validCfg.DeadlineOptions = cfg.DeadlineOptions.Validate(logger)
+	validCfg.Overload = cfg.Overload.Validate(logger)
 	validCfg.ParseOptions.ParseOptions = cfg.ParseOptions.ParseOptions.Validate(logger)
 	return
 }
@@ -125,7 +153,19 @@ type httpFE struct {
 	*fasthttp.Server
 	logic          *middleware.Logic
 	collectTimings bool
-	onceCloser     sync.Once
+	externalIP     bool
+	omitCounts     bool
+	jsonResponses  bool
+	scrapeMaxAge   time.Duration
+	overload       *frontend.Overload
+	lifetime       frontend.LifetimeOptions
+	deadline       frontend.DeadlineOptions
+	// wg tracks asynchronous post hooks
+	wg sync.WaitGroup
+	// draining is set when wg is waited, so new post hooks are not tracked
+	draining   bool
+	drainMU    sync.RWMutex
+	onceCloser sync.Once
 
 	ParseOptions
 }
@@ -144,6 +184,13 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 	f := &httpFE{
 		logic:          logic,
 		collectTimings: cfg.EnableRequestTiming,
+		externalIP:     cfg.ExternalIP,
+		omitCounts:     cfg.OmitCounts,
+		jsonResponses:  cfg.JSONResponses,
+		scrapeMaxAge:   cfg.ScrapeMaxAge,
+		overload:       frontend.NewOverload(cfg.Overload, "http"),
+		lifetime:       cfg.LifetimeOptions,
+		deadline:       cfg.DeadlineOptions,
 		ParseOptions:   cfg.ParseOptions,
 		Server: &fasthttp.Server{
 			ReadTimeout:      cfg.ReadTimeout,
@@ -169,34 +216,34 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 		}
 	}
 
-	pathRouting := make(map[string]func(*fasthttp.RequestCtx),
-		len(cfg.AnnounceRoutes)+len(cfg.ScrapeRoutes)+len(cfg.PingRoutes))
-
-	for _, route := range cfg.AnnounceRoutes {
-		route = path.Clean(route)
-		if !path.IsAbs(route) {
-			route = "/" + route
-		}
-		pathRouting[route] = f.announceRoute
+	handlers := map[string]routeHandler{
+		RouteAnnounce: f.announceRoute,
+		RouteScrape:   f.scrapeRoute,
+		RoutePing:     f.ping,
 	}
-	for _, route := range cfg.ScrapeRoutes {
-		route = path.Clean(route)
-		if !path.IsAbs(route) {
-			route = "/" + route
-		}
-		pathRouting[path.Clean(route)] = f.scrapeRoute
+	routes := newRouter()
+	// routes from lists are matched after ones with parameter rules
+	for _, p := range cfg.AnnounceRoutes {
+		cfg.Routes = append(cfg.Routes, RouteConfig{Path: p, Type: RouteAnnounce})
+	}
+	for _, p := range cfg.ScrapeRoutes {
+		cfg.Routes = append(cfg.Routes, RouteConfig{Path: p, Type: RouteScrape})
+	}
+	for _, p := range cfg.PingRoutes {
+		cfg.Routes = append(cfg.Routes, RouteConfig{Path: p, Type: RoutePing})
 	}
-	for _, route := range cfg.PingRoutes {
-		route = path.Clean(route)
-		if !path.IsAbs(route) {
-			route = "/" + route
+	for _, r := range cfg.Routes {
+		if err = routes.add(r.Path, handlers[r.Type], r.Params); err != nil {
+			return nil, err
 		}
-		pathRouting[path.Clean(route)] = f.ping
 	}
 
 	f.Server.Handler = func(ctx *fasthttp.RequestCtx) {
-		if route, exists := pathRouting[string(ctx.Path())]; exists {
-			route(ctx)
+		// requests of virtual trackers are routed without tenant's path prefix
+		logic, p := f.logic.Tenant(ctx.Host(), ctx.Path())
+		if rt, rp := routes.match(p); rt != nil {
+			rt.apply(ctx.QueryArgs(), rp)
+			rt.handler(ctx, logic, rp)
 		} else {
 			ctx.NotFound()
 		}
@@ -224,19 +271,64 @@ func runServer(s *fasthttp.Server, cfg *Config) {
 	}
 }
 
-// Close provides a thread-safe way to gracefully shut down a currently running Frontend.
-func (f *httpFE) Close() (err error) {
+// Drain stops accepting new connections and waits until in-flight
+// requests and post hooks are processed or ctx is done.
+func (f *httpFE) Drain(ctx context.Context) (err error) {
 	f.onceCloser.Do(func() {
 		if f.Server != nil {
-			err = f.Server.Shutdown()
+			err = f.Server.ShutdownWithContext(ctx)
+		}
+		f.drainMU.Lock()
+		f.draining = true
+		f.drainMU.Unlock()
+		done := make(chan any)
+		go func() {
+			f.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
 		}
 	})
 
 	return
 }
 
+// track adds post hooks into wg, if frontend is not drained
+func (f *httpFE) track() bool {
+	f.drainMU.RLock()
+	defer f.drainMU.RUnlock()
+	if f.draining {
+		return false
+	}
+	f.wg.Add(1)
+	return true
+}
+
+// Close provides a thread-safe way to gracefully shut down a currently running Frontend.
+func (f *httpFE) Close() error {
+	return f.Drain(context.Background())
+}
+
+// requestID returns request ID provided in X-Request-ID header by proxy
+// from trusted networks or new one and sets it in response header
+func requestID(reqCtx *fasthttp.RequestCtx, opts ParseOptions) (id string) {
+	b := reqCtx.Request.Header.Peek(bittorrent.RequestIDHeader)
+	if bittorrent.ValidRequestID(b) && opts.Trusted(remoteAddr(reqCtx)) {
+		id = string(b)
+	} else {
+		id = bittorrent.NewRequestID()
+	}
+	reqCtx.Response.Header.Set(bittorrent.RequestIDHeader, id)
+	return
+}
+
 // announceRoute parses and responds to an Announce.
-func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx) {
+func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx, logic *middleware.Logic, rp bittorrent.RouteParams) {
 	var err error
 	var start time.Time
 	var addr netip.Addr
@@ -247,42 +339,84 @@ func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx) {
 			recordResponseDuration("announce", addr, err, time.Since(start))
 		}()
 	}
+	defer func() {
+		recordRejection("announce", err)
+	}()
 
+	reqID := requestID(reqCtx, f.ParseOptions)
+	format := f.format(reqCtx)
+	reqCtx.SetContentType(format.contentType())
 	aReq, err = parseAnnounce(reqCtx, f.ParseOptions)
 	if err != nil {
-		writeErrorResponse(reqCtx, err)
+		format.failure(reqCtx, reqID, err)
 		return
 	}
 	addr = aReq.GetFirst()
 
-	ctx := bittorrent.InjectRouteParamsToContext(reqCtx, nil)
-	ctx, aResp, err := f.logic.HandleAnnounce(ctx, aReq)
+	if err = f.overload.Begin(); err != nil {
+		format.failure(reqCtx, reqID, err)
+		return
+	}
+	var reservation frontend.Reservation
+	async := false
+	defer func() {
+		if !async {
+			f.overload.Done()
+			reservation.Release()
+		}
+	}()
+	if reservation, err = frontend.AdmitAnnounce(Name, aReq); err != nil {
+		format.failure(reqCtx, reqID, err)
+		return
+	}
+
+	ctx, cancel := f.deadline.WithDeadline(reqCtx)
+	defer cancel()
+	ctx = f.lifetime.InjectLifetime(bittorrent.InjectRouteParamsToContext(bittorrent.WithRequestID(ctx, reqID), rp))
+	handleStart := time.Now()
+	ctx, aResp, err := logic.HandleAnnounce(ctx, aReq)
+	f.overload.Observe(time.Since(handleStart))
 	if err != nil {
-		if !errors.Is(err, context.Canceled) {
-			writeErrorResponse(reqCtx, err)
+		if err = frontend.DeadlineError(err); !errors.Is(err, context.Canceled) {
+			format.failure(reqCtx, reqID, err)
 		}
 		return
 	}
 
 	if err = reqCtx.Err(); err == nil {
-		reqCtx.Response.Header.Set("Content-Type", "text/plain; charset=utf-8")
 		qArgs := reqCtx.QueryArgs()
 		// `compact` means that tracker should return addresses in
 		// binary (single concatenated string) mode instead of dictionary.
 		// `no_peer_id` means, that tracker may omit PeerID field in response dictionary.
 		// see https://wiki.theory.org/BitTorrentSpecification#Tracker_Request_Parameters
-		writeAnnounceResponse(reqCtx, aResp, qArgs.GetBool("compact"), !qArgs.GetBool("no_peer_id"))
+		format.announce(reqCtx, f.overload.Adjust(aResp), qArgs.GetBool("compact"), f.announceOptions(aReq, !qArgs.GetBool("no_peer_id")))
 
 		// next actions are background and should not be canceled after http writer closed
 		ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
 		// params mapped from fasthttp.QueryArgs will be reused in the next request
 		aReq.Params = nil
-		go f.logic.AfterAnnounce(ctx, aReq, aResp)
+		after := func() {
+			ctx, cancel := f.deadline.WithDeadline(ctx)
+			defer cancel()
+			logic.AfterAnnounce(ctx, aReq, aResp)
+		}
+		// announce is pending until post hooks are done
+		if async = f.track(); async {
+			go func() {
+				defer f.wg.Done()
+				defer f.overload.Done()
+				defer reservation.Release()
+				after()
+			}()
+		} else {
+			// drain timed out, post hooks are executed in place
+			after()
+		}
 	}
 }
 
 // scrapeRoute parses and responds to a Scrape.
-func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx) {
+func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx, logic *middleware.Logic, rp bittorrent.RouteParams) {
 	var err error
 	var start time.Time
 	var addr netip.Addr
@@ -292,38 +426,75 @@ func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx) {
 			recordResponseDuration("scrape", addr, err, time.Since(start))
 		}()
 	}
+	defer func() {
+		recordRejection("scrape", err)
+	}()
 
+	reqID := requestID(reqCtx, f.ParseOptions)
+	format := f.format(reqCtx)
+	reqCtx.SetContentType(format.contentType())
 	req, err := parseScrape(reqCtx, f.ParseOptions)
 	if err != nil {
-		writeErrorResponse(reqCtx, err)
+		format.failure(reqCtx, reqID, err)
 		return
 	}
 	addr = req.GetFirst()
 
-	ctx := bittorrent.InjectRouteParamsToContext(reqCtx, nil)
-	ctx, resp, err := f.logic.HandleScrape(ctx, req)
+	reservation, err := frontend.AdmitScrape(Name, req)
 	if err != nil {
-		if !errors.Is(err, context.Canceled) {
-			writeErrorResponse(reqCtx, err)
+		format.failure(reqCtx, reqID, err)
+		return
+	}
+	async := false
+	defer func() {
+		if !async {
+			reservation.Release()
+		}
+	}()
+
+	ctx, cancel := f.deadline.WithDeadline(reqCtx)
+	defer cancel()
+	ctx = bittorrent.InjectRouteParamsToContext(bittorrent.WithRequestID(ctx, reqID), rp)
+	ctx, resp, err := logic.HandleScrape(ctx, req)
+	if err != nil {
+		if err = frontend.DeadlineError(err); !errors.Is(err, context.Canceled) {
+			format.failure(reqCtx, reqID, err)
 		}
 		return
 	}
 
 	if err = reqCtx.Err(); err == nil {
-		reqCtx.SetContentType("text/plain; charset=utf-8")
-		writeScrapeResponse(reqCtx, resp)
+		if f.scrapeMaxAge > 0 {
+			writeConditionalScrape(reqCtx, format, resp, f.scrapeMaxAge)
+		} else {
+			format.scrape(reqCtx, resp)
+		}
 
 		// next actions are background and should not be canceled after http writer closed
 		ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
 		// params mapped from fasthttp.QueryArgs will in the next request
 		req.Params = nil
-		go f.logic.AfterScrape(ctx, req, resp)
+		after := func() {
+			ctx, cancel := f.deadline.WithDeadline(ctx)
+			defer cancel()
+			logic.AfterScrape(ctx, req, resp)
+		}
+		if async = f.track(); async {
+			go func() {
+				defer f.wg.Done()
+				defer reservation.Release()
+				after()
+			}()
+		} else {
+			// drain timed out, post hooks are executed in place
+			after()
+		}
 	}
 }
 
-func (f *httpFE) ping(ctx *fasthttp.RequestCtx) {
+func (f *httpFE) ping(ctx *fasthttp.RequestCtx, logic *middleware.Logic, _ bittorrent.RouteParams) {
 	status := http.StatusOK
-	err := f.logic.Ping(ctx)
+	err := logic.Ping(ctx)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			return
@@ -1,18 +1,26 @@
 package http
 
 import (
+	"context"
 	cr "crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
 	"github.com/sot-tech/mochi/middleware"
 	"github.com/sot-tech/mochi/pkg/log"
 )
@@ -133,3 +141,40 @@ func BenchmarkScrape(b *testing.B) {
 		}
 	}
 }
+
+func TestRequestID(t *testing.T) {
+	opts := ParseOptions{ParseOptions: frontend.ParseOptions{TrustedNetworks: []string{"10.0.0.0/8"}}.Validate(logger)}
+	newCtx := func(remote, id string) *fasthttp.RequestCtx {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.SetRemoteAddr(net.TCPAddrFromAddrPort(netip.MustParseAddrPort(remote)))
+		ctx.Request.Header.Set(bittorrent.RequestIDHeader, id)
+		return ctx
+	}
+	ctx := newCtx("10.1.2.3:1234", "proxy-id:1")
+	require.Equal(t, "proxy-id:1", requestID(ctx, opts))
+	require.Equal(t, "proxy-id:1", string(ctx.Response.Header.Peek(bittorrent.RequestIDHeader)))
+
+	// ID of client from untrusted network is replaced
+	ctx = newCtx("1.2.3.4:1234", "proxy-id:1")
+	id := requestID(ctx, opts)
+	require.NotEqual(t, "proxy-id:1", id)
+	require.True(t, bittorrent.ValidRequestID([]byte(id)))
+
+	ctx = newCtx("10.1.2.3:1234", "invalid id")
+	id = requestID(ctx, opts)
+	require.NotEqual(t, "invalid id", id)
+	require.True(t, bittorrent.ValidRequestID([]byte(id)))
+	require.Equal(t, id, string(ctx.Response.Header.Peek(bittorrent.RequestIDHeader)))
+}
+
+func TestDrainTrack(t *testing.T) {
+	f := &httpFE{}
+	require.True(t, f.track())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// tracked post hook is not finished
+	require.ErrorIs(t, f.Drain(ctx), context.DeadlineExceeded)
+	// post hooks of requests processed after drain timeout are not tracked
+	require.False(t, f.track())
+	f.wg.Done()
+}
@@ -3,10 +3,42 @@ package http
 import (
 	"github.com/rs/zerolog"
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/privacy"
 	"github.com/sot-tech/mochi/pkg/str2bytes"
 	"github.com/valyala/fasthttp"
 )
 
+// recognizedParams are query parameters parsed by frontend
+var recognizedParams = map[string]bool{
+	"info_hash":     true,
+	"peer_id":       true,
+	"event":         true,
+	"left":          true,
+	"downloaded":    true,
+	"uploaded":      true,
+	"numwant":       true,
+	"port":          true,
+	"ip":            true,
+	"ipv4":          true,
+	"ipv6":          true,
+	"compact":       true,
+	"no_peer_id":    true,
+	"trackerid":     true,
+	"supportcrypto": true,
+	"requirecrypto": true,
+	"cryptoport":    true,
+	"corrupt":       true,
+	"redundant":     true,
+	formatParam:     true,
+}
+
+// addressParams are query parameters, which contain peer's address
+var addressParams = map[string]bool{
+	"ip":   true,
+	"ipv4": true,
+	"ipv6": true,
+}
+
 // queryParams parses a URL Query and implements the Params interface with some
 // additional helpers.
 type queryParams struct {
@@ -21,17 +53,45 @@ func (qp queryParams) GetString(key string) (string, bool) {
 }
 
 // InfoHashes returns a list of requested infohashes.
-func (qp queryParams) InfoHashes() bittorrent.InfoHashes {
+// Raw or HEX encoded V1 (20 bytes), V2 (32 bytes) and truncated V2 hashes are accepted,
+// any other value causes errInvalidInfoHash.
+func (qp queryParams) InfoHashes() (bittorrent.InfoHashes, error) {
 	var ihs bittorrent.InfoHashes
 	for _, bb := range qp.PeekMulti("info_hash") {
-		if ih, err := bittorrent.NewInfoHash(bb); err == nil {
-			ihs = append(ihs, ih)
+		ih, err := bittorrent.NewInfoHash(bb)
+		if err != nil {
+			return nil, errInvalidInfoHash
 		}
+		ihs = append(ihs, ih)
 	}
-	return ihs
+	return ihs, nil
+}
+
+// Extra returns copy of query parameters, which are not parsed by frontend.
+func (qp queryParams) Extra() map[string]string {
+	out := make(map[string]string)
+	qp.VisitAll(func(k, v []byte) {
+		if key := string(k); !recognizedParams[key] {
+			out[key] = string(v)
+		}
+	})
+	return out
 }
 
 // MarshalZerologObject writes fields into zerolog event
 func (qp queryParams) MarshalZerologObject(e *zerolog.Event) {
-	e.Str("query", str2bytes.BytesToString(qp.Args.QueryString()))
+	if !privacy.Enabled() {
+		e.Str("query", str2bytes.BytesToString(qp.Args.QueryString()))
+		return
+	}
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+	qp.VisitAll(func(k, v []byte) {
+		if key := string(k); addressParams[key] {
+			args.Add(key, privacy.ParseString(string(v)))
+		} else {
+			args.AddBytesKV(k, v)
+		}
+	})
+	e.Str("query", args.String())
 }
@@ -2,10 +2,16 @@ package http
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
 )
 
 var (
@@ -101,6 +107,53 @@ func TestParseShouldNotPanicURLData(_ *testing.T) {
 	}
 }
 
+func TestInfoHashes(t *testing.T) {
+	v1 := strings.Repeat("1", bittorrent.InfoHashV1Len)
+	v2 := strings.Repeat("2", bittorrent.InfoHashV2Len)
+	q := parseURLData([]byte("/scrape?" + url.Values{"info_hash": {
+		v1,
+		v2,
+		v2[:bittorrent.InfoHashV1Len],
+		hex.EncodeToString([]byte(v2)),
+	}}.Encode()))
+	ihs, err := q.InfoHashes()
+	if err != nil {
+		t.Fatalf("expected no parsing error but got %s", err)
+	}
+	expected := bittorrent.InfoHashes{
+		bittorrent.InfoHash(v1),
+		bittorrent.InfoHash(v2),
+		bittorrent.InfoHash(v2).TruncateV1(),
+		bittorrent.InfoHash(v2),
+	}
+	if !reflect.DeepEqual(expected, ihs) {
+		t.Fatalf("Incorrect info hashes.\n Expected=%v\n Received=%v\n", expected, ihs)
+	}
+
+	q = parseURLData([]byte("/scrape?" + url.Values{"info_hash": {v1, "invalid"}}.Encode()))
+	if _, err = q.InfoHashes(); !errors.Is(err, errInvalidInfoHash) {
+		t.Fatalf("expected parsing error, but got %v", err)
+	}
+}
+
+func TestExtraParams(t *testing.T) {
+	q := parseURLData([]byte("/announce?" + url.Values{
+		"info_hash": {strings.Repeat("1", 20)},
+		"peer_id":   {testPeerID},
+		"port":      {"6881"},
+		"passkey":   {"secret"},
+		"x_ext":     {"1"},
+	}.Encode()))
+	req := &bittorrent.AnnounceRequest{Params: q}
+	expected := map[string]string{"passkey": "secret", "x_ext": "1"}
+	if extra := req.ExtraParams(); !reflect.DeepEqual(expected, extra) {
+		t.Fatalf("Incorrect extra params.\n Expected=%v\n Received=%v\n", expected, extra)
+	}
+	if options := req.Options(); options != nil {
+		t.Fatalf("HTTP request must not have options, but got %v", options)
+	}
+}
+
 func BenchmarkParseQuery(b *testing.B) {
 	announceStrings := make([][]byte, 0)
 	for i := range ValidAnnounceArguments {
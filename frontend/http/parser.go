@@ -3,6 +3,7 @@ package http
 import (
 	"bytes"
 	"errors"
+	"math"
 	"net/netip"
 
 	"github.com/valyala/fasthttp"
@@ -17,19 +18,26 @@ import (
 // If AllowIPSpoofing is true, IPs provided via BitTorrent params will be used.
 // If RealIPHeader is not empty string, the value of the first HTTP Header with
 // that name will be used.
+// If TrackerID is not empty string, it is returned in announce response
+// and `trackerid` parameter of announce (if provided) must match it.
 type ParseOptions struct {
 	frontend.ParseOptions
 	RealIPHeader string `cfg:"real_ip_header"`
+	TrackerID    string `cfg:"tracker_id"`
 }
 
 var (
-	errNoInfoHash                 = bittorrent.ClientError("no info hash supplied")
-	errMultipleInfoHashes         = bittorrent.ClientError("multiple info hashes supplied")
-	errInvalidPeerID              = bittorrent.ClientError("peer ID invalid or not provided")
-	errInvalidParameterLeft       = bittorrent.ClientError("parameter 'left' invalid or not provided")
-	errInvalidParameterDownloaded = bittorrent.ClientError("parameter 'downloaded' invalid or not provided")
-	errInvalidParameterUploaded   = bittorrent.ClientError("parameter 'uploaded' invalid or not provided")
-	errInvalidParameterNumWant    = bittorrent.ClientError("parameter 'num want' invalid or not provided")
+	errNoInfoHash                 = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "no info hash supplied")
+	errInvalidInfoHash            = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "invalid info hash")
+	errMultipleInfoHashes         = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "multiple info hashes supplied")
+	errInvalidTrackerID           = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "invalid tracker id")
+	errInvalidPeerID              = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "peer ID invalid or not provided")
+	errInvalidParameterLeft       = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "parameter 'left' invalid or not provided")
+	errInvalidParameterDownloaded = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "parameter 'downloaded' invalid or not provided")
+	errInvalidParameterUploaded   = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "parameter 'uploaded' invalid or not provided")
+	errInvalidParameterNumWant    = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "parameter 'num want' invalid or not provided")
+	errInvalidParameterCorrupt    = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "parameter 'corrupt' invalid")
+	errInvalidParameterRedundant  = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "parameter 'redundant' invalid")
 )
 
 // parseAnnounce parses an bittorrent.AnnounceRequest from an http.Request.
@@ -51,7 +59,10 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 	}
 
 	// Parse the info hash from the request.
-	infoHashes := qp.InfoHashes()
+	infoHashes, err := qp.InfoHashes()
+	if err != nil {
+		return nil, err
+	}
 	if len(infoHashes) < 1 {
 		return nil, errNoInfoHash
 	}
@@ -60,6 +71,13 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 	}
 	request.InfoHash = infoHashes[0]
 
+	// Tracker ID is returned by previous announce,
+	// different ID means that client announced to another tracker.
+	if trackerID, provided := qp.GetString("trackerid"); provided && len(opts.TrackerID) > 0 &&
+		len(trackerID) > 0 && trackerID != opts.TrackerID {
+		return nil, errInvalidTrackerID
+	}
+
 	// Parse the PeerID from the request.
 	request.ID, err = bittorrent.NewPeerID(qp.Peek("peer_id"))
 	if err != nil {
@@ -86,6 +104,20 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 	}
 	request.Uploaded = uint64(n)
 
+	// Optional statistics of wasted bytes, reported by some clients.
+	if qp.Has("corrupt") {
+		if n, err = qp.GetUint("corrupt"); err != nil {
+			return nil, errInvalidParameterCorrupt
+		}
+		request.Corrupt = uint64(n)
+	}
+	if qp.Has("redundant") {
+		if n, err = qp.GetUint("redundant"); err != nil {
+			return nil, errInvalidParameterRedundant
+		}
+		request.Redundant = uint64(n)
+	}
+
 	// Determine the number of peers the client wants in the response.
 	n, err = qp.GetUint("numwant")
 	if err != nil && !errors.Is(err, fasthttp.ErrNoArgValue) {
@@ -93,15 +125,32 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 	}
 	// If there were no errors, the user actually provided the numWant.
 	request.NumWantProvided = err == nil
-	request.NumWant = uint32(n)
+	// values larger than uint32 are capped by max_numwant
+	request.NumWant = uint32(min(n, math.MaxUint32))
 
 	// Parse the port where the client is listening.
 	n, err = qp.GetUint("port")
-	if err != nil {
+	if err != nil || n > math.MaxUint16 {
 		return nil, bittorrent.ErrInvalidPort
 	}
 	request.Port = uint16(n)
 
+	// Parse support of encryption. Clients, which require encryption,
+	// may announce `port=0` to be hidden from non-encrypting ones
+	// and provide real port in `cryptoport`, which is ignored for others.
+	if qp.GetBool("requirecrypto") {
+		request.Crypto = bittorrent.CryptoRequired
+	} else if qp.GetBool("supportcrypto") {
+		request.Crypto = bittorrent.CryptoSupported
+	}
+	if qp.Has("cryptoport") {
+		if n, err = qp.GetUint("cryptoport"); err != nil || n > math.MaxUint16 {
+			return nil, bittorrent.ErrInvalidPort
+		} else if n > 0 && request.Crypto == bittorrent.CryptoRequired {
+			request.Port = uint16(n)
+		}
+	}
+
 	// Parse the IP address where the client is listening.
 	request.RequestAddresses = requestedIPs(r, qp, opts)
 
@@ -116,7 +165,10 @@ func parseAnnounce(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.Annou
 func parseScrape(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.ScrapeRequest, error) {
 	qp := &queryParams{r.QueryArgs()}
 
-	infoHashes := qp.InfoHashes()
+	infoHashes, err := qp.InfoHashes()
+	if err != nil {
+		return nil, err
+	}
 	if len(infoHashes) < 1 {
 		return nil, errNoInfoHash
 	}
@@ -128,39 +180,52 @@ func parseScrape(r *fasthttp.RequestCtx, opts ParseOptions) (*bittorrent.ScrapeR
 		RequestAddresses: requestedIPs(r, qp, opts),
 	}
 
-	err := bittorrent.SanitizeScrape(request, opts.MaxScrapeInfoHashes, opts.FilterPrivateIPs)
+	err = bittorrent.SanitizeScrape(request, opts.MaxScrapeInfoHashes, opts.FilterPrivateIPs)
 
 	return request, err
 }
 
 // requestedIPs determines the IP address for a BitTorrent client request.
+// Provided IPs are used if spoofing is allowed or connection's remote address
+// belongs to trusted networks. If real IP header is used, the last address
+// of header is checked instead: it is appended by reverse proxy, while
+// preceding addresses may be forged by client.
 func requestedIPs(r *fasthttp.RequestCtx, p *queryParams, opts ParseOptions) (addresses bittorrent.RequestAddresses) {
-	if opts.AllowIPSpoofing {
-		for _, f := range []string{"ip", "ipv4", "ipv6"} {
-			if ipStr, ok := p.GetString(f); ok {
-				addresses.Add(parseRequestAddress(ipStr, true))
-			}
-		}
-	}
-
+	var source bittorrent.RequestAddresses
 	if ipValues := r.Request.Header.PeekAll(opts.RealIPHeader); len(ipValues) > 0 && opts.RealIPHeader != "" {
 		for _, ipStr := range ipValues {
 			for _, ipStr := range bytes.Split(ipStr, []byte{','}) {
 				if ipStr = bytes.TrimSpace(ipStr); len(ipStr) > 0 {
-					addresses.Add(parseRequestAddress(str2bytes.BytesToString(ipStr), false))
+					source.Add(parseRequestAddress(str2bytes.BytesToString(ipStr), false))
 				}
 			}
 		}
 	} else {
-		addrPort, _ := netip.ParseAddrPort(r.RemoteAddr().String())
-		addresses.Add(bittorrent.RequestAddress{
-			Addr:     addrPort.Addr(),
+		source.Add(bittorrent.RequestAddress{
+			Addr:     remoteAddr(r),
 			Provided: false,
 		})
 	}
+
+	if len(source) > 0 && opts.SpoofingAllowed(source[len(source)-1].Addr) {
+		for _, f := range []string{"ip", "ipv4", "ipv6"} {
+			if ipStr, ok := p.GetString(f); ok {
+				addresses.Add(parseRequestAddress(ipStr, true))
+			}
+		}
+	}
+	for _, a := range source {
+		addresses.Add(a)
+	}
 	return
 }
 
+// remoteAddr returns address of connection's remote side
+func remoteAddr(r *fasthttp.RequestCtx) netip.Addr {
+	addrPort, _ := netip.ParseAddrPort(r.RemoteAddr().String())
+	return addrPort.Addr()
+}
+
 func parseRequestAddress(s string, provided bool) (ra bittorrent.RequestAddress) {
 	if addr, err := netip.ParseAddr(s); err == nil {
 		ra.Addr, ra.Provided = addr, provided
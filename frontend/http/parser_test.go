@@ -0,0 +1,225 @@
+package http
+
+import (
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
+)
+
+func newRequestCtx(args url.Values) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI("/announce?" + args.Encode())
+	ctx.Request.Header.Set("X-Real-IP", "1.2.3.4")
+	return ctx
+}
+
+func TestParseAnnounceTrackerID(t *testing.T) {
+	opts := ParseOptions{
+		ParseOptions: frontend.ParseOptions{MaxNumWant: 50, DefaultNumWant: 50},
+		RealIPHeader: "X-Real-IP",
+		TrackerID:    "mochi-1",
+	}
+	args := url.Values{
+		"info_hash":  {strings.Repeat("1", 20)},
+		"peer_id":    {testPeerID},
+		"port":       {"6881"},
+		"uploaded":   {"0"},
+		"downloaded": {"0"},
+		"left":       {"0"},
+	}
+	_, err := parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+
+	args.Set("trackerid", "mochi-1")
+	_, err = parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+
+	args.Set("trackerid", "other")
+	_, err = parseAnnounce(newRequestCtx(args), opts)
+	require.Equal(t, errInvalidTrackerID, err)
+
+	// tracker ID is not checked if not configured
+	opts.TrackerID = ""
+	_, err = parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+}
+
+func TestParseAnnounceInvalidPort(t *testing.T) {
+	opts := ParseOptions{ParseOptions: frontend.ParseOptions{MaxNumWant: 50, DefaultNumWant: 50}}
+	args := url.Values{
+		"info_hash":  {strings.Repeat("1", 20)},
+		"peer_id":    {testPeerID},
+		"uploaded":   {"0"},
+		"downloaded": {"0"},
+		"left":       {"0"},
+	}
+	for _, port := range []string{"", "-1", "65536", "99999", "port"} {
+		args.Set("port", port)
+		_, err := parseAnnounce(newRequestCtx(args), opts)
+		require.Equal(t, bittorrent.ErrInvalidPort, err, port)
+	}
+}
+
+func TestParseAnnounceCrypto(t *testing.T) {
+	opts := ParseOptions{
+		ParseOptions: frontend.ParseOptions{MaxNumWant: 50, DefaultNumWant: 50},
+		RealIPHeader: "X-Real-IP",
+	}
+	args := url.Values{
+		"info_hash":  {strings.Repeat("1", 20)},
+		"peer_id":    {testPeerID},
+		"port":       {"6881"},
+		"uploaded":   {"0"},
+		"downloaded": {"0"},
+		"left":       {"0"},
+	}
+	req, err := parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.CryptoNone, req.Crypto)
+
+	args.Set("supportcrypto", "1")
+	req, err = parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.CryptoSupported, req.Crypto)
+	require.Equal(t, uint16(6881), req.Port)
+
+	// cryptoport is applied only to peers, which require encryption
+	args.Set("cryptoport", "6882")
+	req, err = parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+	require.Equal(t, uint16(6881), req.Port)
+
+	args.Set("requirecrypto", "1")
+	args.Set("port", "0")
+	args.Set("cryptoport", "6882")
+	req, err = parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.CryptoRequired, req.Crypto)
+	require.Equal(t, uint16(6882), req.Port)
+
+	args.Set("cryptoport", "65536")
+	_, err = parseAnnounce(newRequestCtx(args), opts)
+	require.Equal(t, bittorrent.ErrInvalidPort, err)
+}
+
+func TestParseAnnounceWasted(t *testing.T) {
+	opts := ParseOptions{
+		ParseOptions: frontend.ParseOptions{MaxNumWant: 50, DefaultNumWant: 50},
+		RealIPHeader: "X-Real-IP",
+	}
+	args := url.Values{
+		"info_hash":  {strings.Repeat("1", 20)},
+		"peer_id":    {testPeerID},
+		"port":       {"6881"},
+		"uploaded":   {"0"},
+		"downloaded": {"100"},
+		"left":       {"0"},
+		"corrupt":    {"10"},
+		"redundant":  {"20"},
+	}
+	req, err := parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), req.Corrupt)
+	require.Equal(t, uint64(20), req.Redundant)
+
+	args.Set("corrupt", "-1")
+	_, err = parseAnnounce(newRequestCtx(args), opts)
+	require.Equal(t, errInvalidParameterCorrupt, err)
+}
+
+func TestParseAnnounceTrustedNetworks(t *testing.T) {
+	opts := ParseOptions{
+		ParseOptions: frontend.ParseOptions{
+			TrustedNetworks:     []string{"1.2.3.0/24"},
+			MaxNumWant:          50,
+			DefaultNumWant:      50,
+			MaxScrapeInfoHashes: 50,
+		}.Validate(logger),
+		RealIPHeader: "X-Real-IP",
+	}
+	args := url.Values{
+		"info_hash":  {strings.Repeat("1", 20)},
+		"peer_id":    {testPeerID},
+		"port":       {"6881"},
+		"uploaded":   {"0"},
+		"downloaded": {"0"},
+		"left":       {"0"},
+		"ip":         {"5.6.7.8"},
+	}
+	provided := bittorrent.RequestAddress{Addr: netip.MustParseAddr("5.6.7.8"), Provided: true}
+	req, err := parseAnnounce(newRequestCtx(args), opts)
+	require.Nil(t, err)
+	require.Contains(t, req.RequestAddresses, provided)
+
+	// provided address of untrusted client is ignored
+	ctx := newRequestCtx(args)
+	ctx.Request.Header.Set("X-Real-IP", "4.3.2.1")
+	req, err = parseAnnounce(ctx, opts)
+	require.Nil(t, err)
+	require.NotContains(t, req.RequestAddresses, provided)
+	require.Len(t, req.RequestAddresses, 1)
+
+	// only address appended by proxy is checked
+	ctx = newRequestCtx(args)
+	ctx.Request.Header.Set("X-Real-IP", "1.2.3.4, 4.3.2.1")
+	req, err = parseAnnounce(ctx, opts)
+	require.Nil(t, err)
+	require.NotContains(t, req.RequestAddresses, provided)
+
+	ctx = newRequestCtx(args)
+	ctx.Request.Header.Set("X-Real-IP", "4.3.2.1, 1.2.3.4")
+	req, err = parseAnnounce(ctx, opts)
+	require.Nil(t, err)
+	require.Contains(t, req.RequestAddresses, provided)
+}
+
+func FuzzParseAnnounce(f *testing.F) {
+	f.Add("info_hash=11111111111111111111&peer_id=-TEST01-6wfG2wk6wWLc&port=6881&uploaded=0&downloaded=0&left=0")
+	f.Add("info_hash=%01%02%03&peer_id=%zz&port=99999&left=-1&event=started&numwant=100000")
+	f.Add("info_hash=1111111111111111111111111111111111111111&info_hash=2&ip=1.2.3.4&ipv6=::1&compact=1")
+	opts := ParseOptions{
+		ParseOptions: frontend.ParseOptions{AllowIPSpoofing: true, MaxNumWant: 50, DefaultNumWant: 50},
+		TrackerID:    "mochi-1",
+	}
+	f.Fuzz(func(t *testing.T, query string) {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/announce?" + query)
+		req, err := parseAnnounce(ctx, opts)
+		if err != nil {
+			require.Nil(t, req)
+			return
+		}
+		require.NotNil(t, req)
+		require.Contains(t, []int{bittorrent.InfoHashV1Len, bittorrent.InfoHashV2Len}, len(req.InfoHash))
+		require.NotZero(t, req.Port)
+		require.LessOrEqual(t, req.NumWant, opts.MaxNumWant)
+		require.NotEmpty(t, req.RequestAddresses)
+	})
+}
+
+func FuzzParseScrape(f *testing.F) {
+	f.Add("info_hash=11111111111111111111")
+	f.Add("info_hash=1111111111111111111111111111111111111111&info_hash=%zz")
+	f.Add("info_hash=&info_hash=11111111111111111111&info_hash=11111111111111111111")
+	opts := ParseOptions{ParseOptions: frontend.ParseOptions{MaxScrapeInfoHashes: 10}}
+	f.Fuzz(func(t *testing.T, query string) {
+		ctx := new(fasthttp.RequestCtx)
+		ctx.Request.SetRequestURI("/scrape?" + query)
+		req, err := parseScrape(ctx, opts)
+		if err != nil {
+			return
+		}
+		require.NotEmpty(t, req.InfoHashes)
+		require.LessOrEqual(t, len(req.InfoHashes), int(opts.MaxScrapeInfoHashes))
+		for _, ih := range req.InfoHashes {
+			require.Contains(t, []int{bittorrent.InfoHashV1Len, bittorrent.InfoHashV2Len}, len(ih))
+		}
+	})
+}
@@ -12,9 +12,18 @@ import (
 )
 
 func init() {
-	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(promResponseDurationMilliseconds, promRejections)
 }
 
+// promRejections is the number of requests rejected with error by reason
+var promRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_http_rejections_total",
+		Help: "The number of requests rejected with error by machine-readable reason",
+	},
+	[]string{"action", "reason"},
+)
+
 var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
 		Name:    "mochi_http_response_duration_milliseconds",
@@ -41,3 +50,10 @@ func recordResponseDuration(action string, addr netip.Addr, err error, duration
 		WithLabelValues(action, metrics.AddressFamily(addr), errString).
 		Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
 }
+
+// recordRejection counts request rejected with err, if err is not nil
+func recordRejection(action string, err error) {
+	if err != nil && metrics.Enabled() {
+		promRejections.WithLabelValues(action, bittorrent.RejectReason(err)).Inc()
+	}
+}
@@ -0,0 +1,159 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+)
+
+// Types of routes
+const (
+	RouteAnnounce = "announce"
+	RouteScrape   = "scrape"
+	RoutePing     = "ping"
+)
+
+var (
+	errUnknownRouteType = errors.New("unknown route type")
+	errDuplicateRoute   = errors.New("duplicate route")
+	errInvalidRoute     = errors.New("invalid route parameter")
+)
+
+// RouteConfig is the announce, scrape or ping route with its own parameter rules,
+// i.e. `/announce.php` of legacy site templates or `/a/{passkey}/announce`.
+type RouteConfig struct {
+	// Path of route, segments in braces (`{passkey}`) match any non-empty
+	// segment of request path and are passed to middleware as request
+	// parameters, overriding query parameters with the same name
+	Path string `cfg:"path"`
+	// Type is `announce`, `scrape` or `ping`
+	Type string `cfg:"type"`
+	// Params are default query parameters, set if not provided by client
+	Params map[string]string `cfg:"params"`
+}
+
+type routeHandler func(*fasthttp.RequestCtx, *middleware.Logic, bittorrent.RouteParams)
+
+type route struct {
+	handler routeHandler
+	// segments of path, parameter segments are in braces, nil for static route
+	segments []string
+	defaults map[string]string
+}
+
+// router matches request paths with configured routes.
+// Static routes are looked up by exact path, routes with parameters
+// are matched segment by segment in order of configuration.
+type router struct {
+	static    map[string]*route
+	templated []*route
+	// paths of templated routes with parameter names removed (`/a/{}/announce`)
+	patterns map[string]bool
+}
+
+func newRouter() *router {
+	return &router{static: make(map[string]*route), patterns: make(map[string]bool)}
+}
+
+// cleanRoute returns clean absolute path of route
+func cleanRoute(p string) string {
+	p = path.Clean(p)
+	if !path.IsAbs(p) {
+		p = "/" + p
+	}
+	return p
+}
+
+// routeParam returns name of parameter if segment is in braces
+func routeParam(segment string) (string, bool) {
+	if len(segment) > 1 && segment[0] == '{' && segment[len(segment)-1] == '}' {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+// add registers handler of path with default parameters.
+// Parameters must not duplicate each other or override parameters
+// recognized by frontend (i.e. `info_hash`).
+func (r *router) add(p string, h routeHandler, defaults map[string]string) error {
+	p = cleanRoute(p)
+	segments := strings.Split(p[1:], "/")
+	pattern, names := make([]string, len(segments)), make(map[string]bool)
+	for i, s := range segments {
+		name, isParam := routeParam(s)
+		switch {
+		case !isParam:
+			pattern[i] = s
+			continue
+		case len(name) == 0, strings.ContainsAny(name, "{}"), recognizedParams[name], names[name]:
+			return fmt.Errorf("%w '%s' in route '%s'", errInvalidRoute, s, p)
+		}
+		names[name], pattern[i] = true, "{}"
+	}
+	rt := &route{handler: h, defaults: defaults}
+	if len(names) == 0 {
+		if r.static[p] != nil {
+			return fmt.Errorf("%w '%s'", errDuplicateRoute, p)
+		}
+		r.static[p] = rt
+		return nil
+	}
+	key := strings.Join(pattern, "/")
+	if r.patterns[key] {
+		return fmt.Errorf("%w '%s'", errDuplicateRoute, p)
+	}
+	r.patterns[key], rt.segments = true, segments
+	r.templated = append(r.templated, rt)
+	return nil
+}
+
+// match returns route of path p and values of its parameters
+func (r *router) match(p []byte) (*route, bittorrent.RouteParams) {
+	if rt := r.static[string(p)]; rt != nil {
+		return rt, nil
+	}
+	if len(r.templated) == 0 || len(p) < 2 || p[0] != '/' {
+		return nil, nil
+	}
+	segments := strings.Split(string(p[1:]), "/")
+	for _, rt := range r.templated {
+		if len(rt.segments) != len(segments) {
+			continue
+		}
+		var rp bittorrent.RouteParams
+		for i, s := range rt.segments {
+			if name, isParam := routeParam(s); isParam {
+				if len(segments[i]) == 0 {
+					rp = nil
+					break
+				}
+				rp = append(rp, bittorrent.RouteParam{Key: name, Value: segments[i]})
+			} else if s != segments[i] {
+				rp = nil
+				break
+			}
+		}
+		if rp != nil {
+			return rt, rp
+		}
+	}
+	return nil, nil
+}
+
+// apply sets route parameters and default parameters of rt into query arguments
+func (rt *route) apply(args *fasthttp.Args, rp bittorrent.RouteParams) {
+	for k, v := range rt.defaults {
+		if !args.Has(k) {
+			args.Set(k, v)
+		}
+	}
+	for _, p := range rp {
+		args.Set(p.Key, p.Value)
+	}
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+)
+
+func TestRouter(t *testing.T) {
+	var called string
+	handler := func(name string) routeHandler {
+		return func(*fasthttp.RequestCtx, *middleware.Logic, bittorrent.RouteParams) {
+			called = name
+		}
+	}
+	r := newRouter()
+	require.Nil(t, r.add("announce", handler("announce"), nil))
+	require.Nil(t, r.add("/announce.php", handler("legacy"), map[string]string{"compact": "0"}))
+	require.Nil(t, r.add("/a/{passkey}/announce", handler("passkey"), nil))
+	require.Nil(t, r.add("/{site}/{passkey}/scrape", handler("scrape"), nil))
+
+	for _, tt := range []struct {
+		path     string
+		expected string
+		params   bittorrent.RouteParams
+	}{
+		{"/announce", "announce", nil},
+		{"/announce.php", "legacy", nil},
+		{"/a/abc/announce", "passkey", bittorrent.RouteParams{{Key: "passkey", Value: "abc"}}},
+		{"/x/abc/scrape", "scrape", bittorrent.RouteParams{{Key: "site", Value: "x"}, {Key: "passkey", Value: "abc"}}},
+		{"/a//announce", "", nil},
+		{"/a/abc/def/announce", "", nil},
+		{"/a/abc/scrape", "scrape", bittorrent.RouteParams{{Key: "site", Value: "a"}, {Key: "passkey", Value: "abc"}}},
+		{"/", "", nil},
+	} {
+		called = ""
+		rt, rp := r.match([]byte(tt.path))
+		if len(tt.expected) == 0 {
+			require.Nil(t, rt, tt.path)
+			continue
+		}
+		require.NotNil(t, rt, tt.path)
+		rt.handler(nil, nil, rp)
+		require.Equal(t, tt.expected, called, tt.path)
+		require.Equal(t, tt.params, rp, tt.path)
+	}
+
+	for _, p := range []string{"/announce", "/a/{key}/announce", "/a/{}/x", "/a/{info_hash}/x", "/{a}/{a}/x"} {
+		require.NotNil(t, r.add(p, handler("invalid"), nil), p)
+	}
+}
+
+func TestRouteApply(t *testing.T) {
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+	args.Parse("compact=1&passkey=spoofed")
+	rt := &route{defaults: map[string]string{"compact": "0", "no_peer_id": "1"}}
+	rt.apply(args, bittorrent.RouteParams{{Key: "passkey", Value: "abc"}})
+	qp := queryParams{args}
+	for k, v := range map[string]string{"compact": "1", "no_peer_id": "1", "passkey": "abc"} {
+		actual, _ := qp.GetString(k)
+		require.Equal(t, v, actual, k)
+	}
+}
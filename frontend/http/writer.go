@@ -1,14 +1,16 @@
 package http
 
 import (
-	"bytes"
 	"errors"
 	"io"
 	"net"
-	"sort"
+	"net/netip"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/valyala/fasthttp"
 
 	"github.com/sot-tech/mochi/bittorrent"
@@ -17,117 +19,227 @@ import (
 
 var respBufferPool = bytepool.NewBufferPool()
 
-func writeErrorResponse(w io.StringWriter, err error) {
-	message := "mochi internal error"
-	var clientErr bittorrent.ClientError
-	if errors.As(err, &clientErr) {
-		message = clientErr.Error()
-	} else {
-		logger.Error().Err(err).Msg("internal error")
+func writeErrorResponse(w io.Writer, reqID string, err error) {
+	clientErr, message, isClient := bittorrent.ClientMessage(err)
+	if !isClient {
+		logger.Error().Err(err).Str("requestID", reqID).Msg("internal error")
+	}
+	bb := respBufferPool.Get()
+	defer respBufferPool.Put(bb)
+	e := bencoder{bb}
+
+	e.WriteByte('d')
+	// not standard field, machine-readable reason of failure
+	if len(clientErr.Code) > 0 {
+		e.WriteString("12:failure code")
+		e.str(clientErr.Code)
 	}
-	_, _ = w.WriteString("d14:failure reason" + strconv.Itoa(len(message)) + ":" + message + "e")
+	e.WriteString("14:failure reason")
+	e.str(message)
+	// BEP 31, retry interval is set in minutes
+	var retryErr bittorrent.RetryError
+	if errors.As(err, &retryErr) {
+		e.WriteString("8:retry ini")
+		e.digits(max(uint64(retryErr.RetryIn/time.Minute), 1))
+		e.WriteByte('e')
+	}
+	e.WriteByte('e')
+
+	_, _ = bb.WriteTo(w)
 }
 
-func writeAnnounceResponse(w io.Writer, resp *bittorrent.AnnounceResponse, compact, includePeerID bool) {
+// writeConditionalScrape writes scrape response with Cache-Control, ETag
+// (hash of response) and Last-Modified (time of swarm counters) headers.
+// If response is not modified since the one, cached by client,
+// 304 status is written without body.
+func writeConditionalScrape(ctx *fasthttp.RequestCtx, format responseFormat, resp *bittorrent.ScrapeResponse, maxAge time.Duration) {
 	bb := respBufferPool.Get()
 	defer respBufferPool.Put(bb)
+	format.scrape(bb, resp)
+	etag := `"` + strconv.FormatUint(xxhash.Sum64(bb.Bytes()), 16) + `"`
 
-	if resp.Interval > 0 {
-		resp.Interval /= time.Second
+	if inm := ctx.Request.Header.Peek(fasthttp.HeaderIfNoneMatch); len(inm) > 0 {
+		if etagMatches(string(inm), etag) {
+			ctx.NotModified()
+		}
+	} else if !resp.Time.IsZero() && !ctx.IfModifiedSince(resp.Time) {
+		ctx.NotModified()
 	}
-	if resp.Interval > 0 {
-		resp.MinInterval /= time.Second
+	h := &ctx.Response.Header
+	h.Set(fasthttp.HeaderCacheControl, "max-age="+strconv.FormatUint(seconds(maxAge), 10))
+	h.Set(fasthttp.HeaderETag, etag)
+	if !resp.Time.IsZero() {
+		h.SetLastModified(resp.Time)
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusNotModified {
+		ctx.SetContentType(format.contentType())
+		_, _ = bb.WriteTo(ctx)
+	}
+}
+
+// etagMatches checks if any of tags in If-None-Match header
+// (strong or weak) is the same as etag
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// seconds returns non-negative number of whole seconds in d
+func seconds(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
 	}
+	return uint64(d / time.Second)
+}
 
-	bb.WriteString("d8:completei")
-	bb.Write(fasthttp.AppendUint(nil, int(resp.Complete)))
-	bb.WriteString("e10:incompletei")
-	bb.Write(fasthttp.AppendUint(nil, int(resp.Incomplete)))
-	bb.WriteString("e8:intervali")
-	bb.Write(fasthttp.AppendUint(nil, int(resp.Interval)))
-	bb.WriteString("e12:min intervali")
-	bb.Write(fasthttp.AppendUint(nil, int(resp.MinInterval)))
-	bb.WriteByte('e')
+// writeAnnounceResponse encodes announce response. If externalIP is valid,
+// it is returned in `external ip` field (BEP 24). If omitCounts is set,
+// `complete` and `incomplete` fields are not written.
+func writeAnnounceResponse(w io.Writer, resp *bittorrent.AnnounceResponse, compact, includePeerID, omitCounts bool, trackerID string, externalIP netip.Addr) {
+	bb := respBufferPool.Get()
+	defer respBufferPool.Put(bb)
+	e := bencoder{bb}
+
+	e.WriteByte('d')
+	if !omitCounts {
+		e.WriteString("8:completei")
+		e.digits(uint64(resp.Complete))
+		e.WriteByte('e')
+	}
+	// keys must be sorted, so `external ip` is between `complete` and `incomplete`
+	if externalIP.IsValid() {
+		e.WriteString("11:external ip")
+		if externalIP.Is4() {
+			ip := externalIP.As4()
+			e.bytes(ip[:])
+		} else {
+			ip := externalIP.As16()
+			e.bytes(ip[:])
+		}
+	}
+	if !omitCounts {
+		e.WriteString("10:incompletei")
+		e.digits(uint64(resp.Incomplete))
+		e.WriteByte('e')
+	}
+	e.WriteString("8:intervali")
+	e.digits(seconds(resp.Interval))
+	e.WriteString("e12:min intervali")
+	e.digits(seconds(resp.MinInterval))
+	e.WriteByte('e')
 
 	// Add the peers to the dictionary in the compact format.
 	if compact {
 		// Add the IPv4 peers to the dictionary.
-		compactAddresses(bb, resp.IPv4Peers, false)
+		compactAddresses(e, resp.IPv4Peers, false)
 		// Add the IPv6 peers to the dictionary.
-		compactAddresses(bb, resp.IPv6Peers, true)
+		compactAddresses(e, resp.IPv6Peers, true)
 	} else {
 		// Add the peers to the dictionary.
-		bb.WriteString("5:peersl")
+		e.WriteString("5:peersl")
 		for _, peer := range resp.IPv4Peers {
-			dictAddress(bb, peer, includePeerID)
+			dictAddress(e, peer, includePeerID)
 		}
 		for _, peer := range resp.IPv6Peers {
-			dictAddress(bb, peer, includePeerID)
+			dictAddress(e, peer, includePeerID)
 		}
-		bb.WriteByte('e')
+		e.WriteByte('e')
+	}
+	if len(trackerID) > 0 {
+		e.WriteString("10:tracker id")
+		e.str(trackerID)
 	}
-	bb.WriteByte('e')
+	if len(resp.WebSeeds) > 0 {
+		e.WriteString("8:url-listl")
+		for _, u := range resp.WebSeeds {
+			e.str(u)
+		}
+		e.WriteByte('e')
+	}
+	if len(resp.WarningMessage) > 0 {
+		e.WriteString("15:warning message")
+		e.str(resp.WarningMessage)
+	}
+	e.WriteByte('e')
 
 	_, _ = bb.WriteTo(w)
 }
 
-func compactAddresses(bb *bytes.Buffer, peers bittorrent.Peers, v6 bool) {
+func compactAddresses(e bencoder, peers bittorrent.Peers, v6 bool) {
 	l := len(peers)
 	if l > 0 {
 		key, al := "5:peers", net.IPv4len
 		if v6 {
 			key, al = "6:peers6", net.IPv6len
 		}
-		bb.WriteString(key)
-		bb.Write(fasthttp.AppendUint(nil, (al+2)*l))
-		bb.WriteByte(':')
+		e.WriteString(key)
+		e.digits(uint64((al + 2) * l))
+		e.WriteByte(':')
+		e.Grow((al + 2) * l)
 		for _, peer := range peers {
-			bb.Write(peer.Addr().AsSlice())
-			port := peer.Port()
-			bb.Write([]byte{byte(port >> 8), byte(port)})
+			e.compact(peer.AddrPort)
 		}
 	}
 }
 
-func dictAddress(bb *bytes.Buffer, peer bittorrent.Peer, includePeerID bool) {
-	bb.WriteString("d2:ip")
-	addr := peer.Addr().String()
-	bb.Write(fasthttp.AppendUint(nil, len(addr)))
-	bb.WriteByte(':')
-	bb.WriteString(addr)
+func dictAddress(e bencoder, peer bittorrent.Peer, includePeerID bool) {
+	e.WriteString("d2:ip")
+	e.addr(peer.Addr())
 	if includePeerID {
-		bb.WriteString("7:peer id20:")
-		bb.Write(peer.ID.Bytes())
+		e.WriteString("7:peer id20:")
+		e.Write(peer.ID[:])
 	}
-	bb.WriteString("4:porti")
-	port := peer.Port()
-	bb.Write([]byte{byte(port >> 8), byte(port), 'e', 'e'})
+	e.WriteString("4:porti")
+	e.digits(uint64(peer.Port()))
+	e.WriteString("ee")
 }
 
 func writeScrapeResponse(w io.Writer, resp *bittorrent.ScrapeResponse) {
 	bb := respBufferPool.Get()
 	defer respBufferPool.Put(bb)
-	bb.WriteString("d5:filesd")
-	l := len(resp.Data)
-	if l > 0 {
-		if l > 1 {
-			sort.Slice(resp.Data, func(i, j int) bool {
-				return resp.Data[i].InfoHash < resp.Data[j].InfoHash
-			})
+	e := bencoder{bb}
+
+	e.WriteString("d5:filesd")
+	if len(resp.Data) > 1 {
+		slices.SortFunc(resp.Data, func(a, b bittorrent.Scrape) int {
+			return strings.Compare(string(a.InfoHash), string(b.InfoHash))
+		})
+	}
+	for i, scrape := range resp.Data {
+		// info hash may be requested several times, but
+		// bencoded dictionary must not contain duplicate keys
+		if i > 0 && scrape.InfoHash == resp.Data[i-1].InfoHash {
+			continue
 		}
-		for _, scrape := range resp.Data {
-			bb.Write(fasthttp.AppendUint(nil, len(scrape.InfoHash)))
-			bb.WriteByte(':')
-			bb.Write([]byte(scrape.InfoHash))
-			bb.WriteString("d8:completei")
-			bb.Write(fasthttp.AppendUint(nil, int(scrape.Complete)))
-			bb.WriteString("e10:downloadedi")
-			bb.Write(fasthttp.AppendUint(nil, int(scrape.Snatches)))
-			bb.WriteString("e10:incompletei")
-			bb.Write(fasthttp.AppendUint(nil, int(scrape.Incomplete)))
-			bb.Write([]byte{'e', 'e'})
+		e.str(string(scrape.InfoHash))
+		if scrape.Failure != nil {
+			_, message, isClient := bittorrent.ClientMessage(scrape.Failure)
+			if !isClient {
+				logger.Error().Err(scrape.Failure).Msg("internal error")
+			}
+			e.WriteString("d14:failure reason")
+			e.str(message)
+			e.WriteByte('e')
+			continue
 		}
+		e.WriteString("d8:completei")
+		e.digits(uint64(scrape.Complete))
+		e.WriteString("e10:downloadedi")
+		e.digits(uint64(scrape.Snatches))
+		if scrape.DownloadersProvided {
+			e.WriteString("e11:downloadersi")
+			e.digits(uint64(scrape.Downloaders))
+		}
+		e.WriteString("e10:incompletei")
+		e.digits(uint64(scrape.Incomplete))
+		e.WriteString("ee")
 	}
-	bb.Write([]byte{'e', 'e'})
+	e.WriteString("ee")
+
 	_, _ = bb.WriteTo(w)
 }
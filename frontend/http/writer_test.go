@@ -1,11 +1,20 @@
 package http
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http/httptest"
+	"net/netip"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/pkg/log"
@@ -26,7 +35,7 @@ func TestWriteError(t *testing.T) {
 	for _, tt := range table {
 		t.Run(fmt.Sprintf("%s expecting %s", tt.reason, tt.expected), func(t *testing.T) {
 			r := httptest.NewRecorder()
-			writeErrorResponse(r, bittorrent.ClientError(tt.reason))
+			writeErrorResponse(r, "", bittorrent.ClientError{Message: tt.reason})
 			require.Equal(t, r.Body.String(), tt.expected)
 		})
 	}
@@ -42,8 +51,367 @@ func TestWriteStatus(t *testing.T) {
 	for _, tt := range table {
 		t.Run(fmt.Sprintf("%s expecting %s", tt.reason, tt.expected), func(t *testing.T) {
 			r := httptest.NewRecorder()
-			writeErrorResponse(r, bittorrent.ClientError(tt.reason))
+			writeErrorResponse(r, "", bittorrent.ClientError{Message: tt.reason})
 			require.Equal(t, r.Body.String(), tt.expected)
 		})
 	}
 }
+
+func TestWriteRetryErrorResponse(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeErrorResponse(r, "", bittorrent.NewRetryError("overloaded", 5*time.Minute))
+	require.Equal(t, "d12:failure code11:retry_later14:failure reason10:overloaded8:retry ini5ee", r.Body.String())
+}
+
+func TestWriteFormattedErrorResponse(t *testing.T) {
+	bittorrent.SetErrorFormatter(func(e bittorrent.ClientError) string {
+		return e.Message + ", see https://example.com/" + e.Code
+	})
+	defer bittorrent.SetErrorFormatter(nil)
+	r := httptest.NewRecorder()
+	writeErrorResponse(r, "", bittorrent.NewClientError(bittorrent.ReasonBanned, "banned"))
+	require.Equal(t, "d12:failure code6:banned14:failure reason38:banned, see https://example.com/bannede", r.Body.String())
+
+	r = httptest.NewRecorder()
+	writeErrorResponse(r, "", errors.New("storage failed"))
+	require.Equal(t, "d14:failure reason20:mochi internal errore", r.Body.String())
+}
+
+func TestWriteAnnounceWarning(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeAnnounceResponse(r, &bittorrent.AnnounceResponse{WarningMessage: "your client is outdated"}, true, false, false, "", netip.Addr{})
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e"+
+		"15:warning message23:your client is outdatede", r.Body.String())
+}
+
+func TestWriteAnnounceWebSeeds(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeAnnounceResponse(r, &bittorrent.AnnounceResponse{
+		WarningMessage: "w",
+		WebSeeds:       []string{"http://a/", "https://b/f"},
+	}, true, false, false, "", netip.Addr{})
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e"+
+		"8:url-listl9:http://a/11:https://b/fe15:warning message1:we", r.Body.String())
+}
+
+func TestWriteScrapeDownloaders(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeScrapeResponse(r, &bittorrent.ScrapeResponse{Data: bittorrent.Scrapes{
+		{InfoHash: "11111111111111111111", Complete: 1, Incomplete: 3, Downloaders: 2, DownloadersProvided: true},
+		{InfoHash: "22222222222222222222", Complete: 1, Incomplete: 3},
+	}})
+	require.Equal(t, "d5:filesd"+
+		"20:11111111111111111111d8:completei1e10:downloadedi0e11:downloadersi2e10:incompletei3ee"+
+		"20:22222222222222222222d8:completei1e10:downloadedi0e10:incompletei3ee"+
+		"ee", r.Body.String())
+}
+
+func TestWriteScrapeFailure(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeScrapeResponse(r, &bittorrent.ScrapeResponse{Data: bittorrent.Scrapes{
+		{InfoHash: "22222222222222222222", Failure: bittorrent.ClientError{Message: "not allowed"}},
+		{InfoHash: "11111111111111111111", Complete: 1, Incomplete: 3},
+	}})
+	require.Equal(t, "d5:filesd"+
+		"20:11111111111111111111d8:completei1e10:downloadedi0e10:incompletei3ee"+
+		"20:22222222222222222222d14:failure reason11:not allowede"+
+		"ee", r.Body.String())
+}
+
+func TestWriteConditionalScrape(t *testing.T) {
+	resp := &bittorrent.ScrapeResponse{
+		Data: bittorrent.Scrapes{{InfoHash: "11111111111111111111", Complete: 1}},
+		Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	write := func(header, value string) *fasthttp.Response {
+		ctx := new(fasthttp.RequestCtx)
+		if len(header) > 0 {
+			ctx.Request.Header.Set(header, value)
+		}
+		writeConditionalScrape(ctx, bencodeFormat{}, resp, 10*time.Second)
+		return &ctx.Response
+	}
+
+	r := write("", "")
+	require.Equal(t, fasthttp.StatusOK, r.StatusCode())
+	require.Equal(t, "max-age=10", string(r.Header.Peek(fasthttp.HeaderCacheControl)))
+	require.Equal(t, "Fri, 02 Jan 2026 03:04:05 GMT", string(r.Header.Peek(fasthttp.HeaderLastModified)))
+	etag := string(r.Header.Peek(fasthttp.HeaderETag))
+	require.NotEmpty(t, etag)
+	require.Contains(t, string(r.Body()), "8:completei1e")
+
+	r = write(fasthttp.HeaderIfNoneMatch, `"other", W/`+etag)
+	require.Equal(t, fasthttp.StatusNotModified, r.StatusCode())
+	require.Empty(t, r.Body())
+	require.Equal(t, etag, string(r.Header.Peek(fasthttp.HeaderETag)))
+
+	require.Equal(t, fasthttp.StatusOK, write(fasthttp.HeaderIfNoneMatch, `"other"`).StatusCode())
+	require.Equal(t, fasthttp.StatusNotModified, write(fasthttp.HeaderIfModifiedSince, "Fri, 02 Jan 2026 03:04:05 GMT").StatusCode())
+	require.Equal(t, fasthttp.StatusOK, write(fasthttp.HeaderIfModifiedSince, "Fri, 02 Jan 2026 03:04:04 GMT").StatusCode())
+}
+
+func TestWriteAnnounceTrackerID(t *testing.T) {
+	resp := &bittorrent.AnnounceResponse{IPv4Peers: bittorrent.Peers{{
+		ID:       bittorrent.PeerID{'1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1', '1'},
+		AddrPort: netip.MustParseAddrPort("1.2.3.4:6881"),
+	}}}
+	r := httptest.NewRecorder()
+	writeAnnounceResponse(r, resp, false, true, false, "mochi-1", netip.Addr{})
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e"+
+		"5:peersld2:ip7:1.2.3.47:peer id20:111111111111111111114:porti6881eee"+
+		"10:tracker id7:mochi-1e", r.Body.String())
+
+	// no_peer_id
+	r = httptest.NewRecorder()
+	writeAnnounceResponse(r, resp, false, false, false, "", netip.Addr{})
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e"+
+		"5:peersld2:ip7:1.2.3.44:porti6881eeee", r.Body.String())
+}
+
+func TestWriteAnnounceOmitCounts(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeAnnounceResponse(r, &bittorrent.AnnounceResponse{Complete: 1, Incomplete: 2}, true, false, true, "", netip.MustParseAddr("1.2.3.4"))
+	require.Equal(t, "d11:external ip4:\x01\x02\x03\x048:intervali0e12:min intervali0ee", r.Body.String())
+}
+
+func TestWriteAnnounceExternalIP(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeAnnounceResponse(r, &bittorrent.AnnounceResponse{}, true, false, false, "", netip.MustParseAddr("1.2.3.4"))
+	require.Equal(t, "d8:completei0e11:external ip4:\x01\x02\x03\x0410:incompletei0e8:intervali0e12:min intervali0ee",
+		r.Body.String())
+
+	r = httptest.NewRecorder()
+	writeAnnounceResponse(r, &bittorrent.AnnounceResponse{}, true, false, false, "", netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, checkBencode(r.Body.Bytes()))
+	require.Contains(t, r.Body.String(), "11:external ip16:\x20\x01\x0d\xb8")
+}
+
+// checkBencode verifies that b is the single valid bencoded value
+// with sorted unique dictionary keys
+func checkBencode(b []byte) error {
+	var check func(b []byte) ([]byte, string, error)
+	check = func(b []byte) (rest []byte, str string, err error) {
+		if len(b) == 0 {
+			return nil, "", errors.New("unexpected end")
+		}
+		switch c := b[0]; {
+		case c == 'i':
+			end := bytes.IndexByte(b, 'e')
+			if end < 0 {
+				return nil, "", errors.New("unterminated integer")
+			}
+			s := string(b[1:end])
+			if _, err = strconv.ParseInt(s, 10, 64); err != nil || (len(s) > 1 && (s[0] == '0' || s[:2] == "-0")) {
+				return nil, "", fmt.Errorf("invalid integer %q", s)
+			}
+			return b[end+1:], "", nil
+		case c >= '0' && c <= '9':
+			colon := bytes.IndexByte(b, ':')
+			if colon < 0 {
+				return nil, "", errors.New("unterminated string length")
+			}
+			l, err := strconv.Atoi(string(b[:colon]))
+			if err != nil || l > len(b)-colon-1 {
+				return nil, "", fmt.Errorf("invalid string length %q", b[:colon])
+			}
+			return b[colon+1+l:], string(b[colon+1 : colon+1+l]), nil
+		case c == 'l' || c == 'd':
+			var prev *string
+			for b = b[1:]; len(b) > 0 && b[0] != 'e'; {
+				if c == 'd' {
+					var key string
+					if b[0] < '0' || b[0] > '9' {
+						return nil, "", errors.New("non-string dictionary key")
+					}
+					if b, key, err = check(b); err != nil {
+						return
+					}
+					if prev != nil && *prev >= key {
+						return nil, "", fmt.Errorf("unsorted or duplicate key %q", key)
+					}
+					prev = &key
+				}
+				if b, _, err = check(b); err != nil {
+					return
+				}
+			}
+			if len(b) == 0 {
+				return nil, "", errors.New("unterminated list or dictionary")
+			}
+			return b[1:], "", nil
+		default:
+			return nil, "", fmt.Errorf("unexpected byte %q", c)
+		}
+	}
+	rest, _, err := check(b)
+	if err == nil && len(rest) > 0 {
+		err = errors.New("trailing data")
+	}
+	return err
+}
+
+// fuzzPeers splits data into peers: first byte selects address family,
+// then address and port follow
+func fuzzPeers(data []byte) (v4, v6 bittorrent.Peers) {
+	for len(data) > 0 {
+		is6 := data[0]&1 == 1
+		l := 1 + net.IPv4len + 2
+		if is6 {
+			l = 1 + net.IPv6len + 2
+		}
+		if len(data) < l {
+			break
+		}
+		addr, _ := netip.AddrFromSlice(data[1 : l-2])
+		p := bittorrent.Peer{AddrPort: netip.AddrPortFrom(addr, binary.BigEndian.Uint16(data[l-2:l]))}
+		copy(p.ID[:], data)
+		if is6 {
+			v6 = append(v6, p)
+		} else {
+			v4 = append(v4, p)
+		}
+		data = data[l:]
+	}
+	return
+}
+
+func FuzzWriteAnnounceResponse(f *testing.F) {
+	f.Add(uint32(1), uint32(2), int64(1800), int64(900), "", "", []byte{0, 1, 2, 3, 4, 0x1a, 0xe1}, true, false)
+	f.Add(uint32(0), uint32(0), int64(0), int64(0), "warning", "mochi-1", []byte{1}, false, true)
+	f.Fuzz(func(t *testing.T, complete, incomplete uint32, interval, minInterval int64,
+		warning, trackerID string, peers []byte, compact, includePeerID bool,
+	) {
+		if interval < 0 || minInterval < 0 {
+			// intervals are set in configuration and validated
+			t.Skip()
+		}
+		resp := &bittorrent.AnnounceResponse{
+			Complete:       complete,
+			Incomplete:     incomplete,
+			Interval:       time.Duration(interval),
+			MinInterval:    time.Duration(minInterval),
+			WarningMessage: warning,
+		}
+		resp.IPv4Peers, resp.IPv6Peers = fuzzPeers(peers)
+		var externalIP netip.Addr
+		if len(resp.IPv4Peers) > 0 {
+			externalIP = resp.IPv4Peers[0].Addr()
+		}
+		r := httptest.NewRecorder()
+		writeAnnounceResponse(r, resp, compact, includePeerID, false, trackerID, externalIP)
+		require.NoError(t, checkBencode(r.Body.Bytes()), "%q", r.Body.String())
+	})
+}
+
+func FuzzWriteScrapeResponse(f *testing.F) {
+	f.Add([]byte("11111111111111111111"), uint32(1), uint32(2), uint32(3), false)
+	f.Add([]byte("1111111111111111111111111111111111111111"), uint32(0), uint32(0), uint32(0), true)
+	f.Fuzz(func(t *testing.T, infoHashes []byte, complete, incomplete, snatches uint32, downloaders bool) {
+		resp := new(bittorrent.ScrapeResponse)
+		// split data into 20-byte hashes
+		for ; len(infoHashes) >= bittorrent.InfoHashV1Len; infoHashes = infoHashes[bittorrent.InfoHashV1Len:] {
+			resp.Data = append(resp.Data, bittorrent.Scrape{
+				InfoHash:            bittorrent.InfoHash(infoHashes[:bittorrent.InfoHashV1Len]),
+				Complete:            complete,
+				Incomplete:          incomplete,
+				Snatches:            snatches,
+				Downloaders:         complete,
+				DownloadersProvided: downloaders,
+			})
+		}
+		r := httptest.NewRecorder()
+		writeScrapeResponse(r, resp)
+		require.NoError(t, checkBencode(r.Body.Bytes()), "%q", r.Body.String())
+	})
+}
+
+func FuzzWriteError(f *testing.F) {
+	f.Add("hello world")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, reason string) {
+		r := httptest.NewRecorder()
+		writeErrorResponse(r, "", bittorrent.ClientError{Message: reason})
+		require.NoError(t, checkBencode(r.Body.Bytes()), "%q", r.Body.String())
+	})
+}
+
+func TestWriteScrapeDuplicates(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeScrapeResponse(r, &bittorrent.ScrapeResponse{Data: bittorrent.Scrapes{
+		{InfoHash: "11111111111111111111", Complete: 1},
+		{InfoHash: "11111111111111111111", Complete: 1},
+	}})
+	require.Equal(t, "d5:filesd"+
+		"20:11111111111111111111d8:completei1e10:downloadedi0e10:incompletei0ee"+
+		"ee", r.Body.String())
+}
+
+func testAnnounceResponse(peers int) *bittorrent.AnnounceResponse {
+	resp := &bittorrent.AnnounceResponse{
+		Complete:    uint32(peers),
+		Incomplete:  uint32(peers),
+		Interval:    30 * time.Minute,
+		MinInterval: 15 * time.Minute,
+	}
+	for i := 0; i < peers; i++ {
+		p := bittorrent.Peer{AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881)}
+		resp.IPv4Peers = append(resp.IPv4Peers, p)
+		p.AddrPort = netip.AddrPortFrom(netip.AddrFrom16([16]byte{0x20, 0x01, 14: byte(i >> 8), 15: byte(i)}), 6881)
+		resp.IPv6Peers = append(resp.IPv6Peers, p)
+	}
+	return resp
+}
+
+func testScrapeResponse(n int) *bittorrent.ScrapeResponse {
+	resp := new(bittorrent.ScrapeResponse)
+	for i := 0; i < n; i++ {
+		ih := make([]byte, bittorrent.InfoHashV1Len)
+		binary.BigEndian.PutUint32(ih, uint32(n-i))
+		resp.Data = append(resp.Data, bittorrent.Scrape{InfoHash: bittorrent.InfoHash(ih), Complete: 1, Incomplete: 2})
+	}
+	return resp
+}
+
+func TestWriteAllocations(t *testing.T) {
+	if testing.CoverMode() != "" {
+		t.Skip("coverage instrumentation affects allocations")
+	}
+	aResp, sResp := testAnnounceResponse(50), testScrapeResponse(10)
+	for name, fn := range map[string]func(){
+		"compact":    func() { writeAnnounceResponse(io.Discard, aResp, true, true, false, "mochi", netip.Addr{}) },
+		"dictionary": func() { writeAnnounceResponse(io.Discard, aResp, false, true, false, "mochi", netip.Addr{}) },
+		"no peer id": func() { writeAnnounceResponse(io.Discard, aResp, false, false, false, "", netip.Addr{}) },
+		"scrape":     func() { writeScrapeResponse(io.Discard, sResp) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			// warm up pool, so buffer is already grown
+			fn()
+			require.Zero(t, testing.AllocsPerRun(100, fn))
+		})
+	}
+	require.Equal(t, 30*time.Minute, aResp.Interval, "response must not be modified")
+}
+
+func BenchmarkWriteAnnounceCompact(b *testing.B) {
+	resp := testAnnounceResponse(50)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeAnnounceResponse(io.Discard, resp, true, true, false, "", netip.Addr{})
+	}
+}
+
+func BenchmarkWriteAnnounceDictionary(b *testing.B) {
+	resp := testAnnounceResponse(50)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeAnnounceResponse(io.Discard, resp, false, true, false, "", netip.Addr{})
+	}
+}
+
+func BenchmarkWriteScrape(b *testing.B) {
+	resp := testScrapeResponse(10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeScrapeResponse(io.Discard, resp)
+	}
+}
@@ -0,0 +1,141 @@
+package frontend
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// JSON representations of responses mirror bencoded dictionaries of HTTP
+// frontend (keys are the same), so they may be shared by frontends and tools,
+// which can not decode bencode (i.e. web pages). Binary values are encoded
+// as text: addresses in their string form, peer IDs and info hashes in hex.
+
+// JSONPeer is the peer of JSON announce response
+type JSONPeer struct {
+	IP     string `json:"ip"`
+	PeerID string `json:"peer id,omitempty"`
+	Port   uint16 `json:"port"`
+}
+
+// JSONAnnounce is the JSON representation of announce response.
+// IPv4 and IPv6 peers are always written as list of dictionaries.
+type JSONAnnounce struct {
+	Complete       *uint32    `json:"complete,omitempty"`
+	ExternalIP     string     `json:"external ip,omitempty"`
+	Incomplete     *uint32    `json:"incomplete,omitempty"`
+	Interval       uint64     `json:"interval"`
+	MinInterval    uint64     `json:"min interval"`
+	Peers          []JSONPeer `json:"peers"`
+	TrackerID      string     `json:"tracker id,omitempty"`
+	URLList        []string   `json:"url-list,omitempty"`
+	WarningMessage string     `json:"warning message,omitempty"`
+}
+
+// AnnounceOptions are the fields of announce response, which are set
+// by frontend, not by middleware
+type AnnounceOptions struct {
+	// IncludePeerID writes IDs of peers
+	IncludePeerID bool
+	// OmitCounts omits `complete` and `incomplete` fields
+	OmitCounts bool
+	TrackerID  string
+	// ExternalIP is written in `external ip` field (BEP 24) if valid
+	ExternalIP netip.Addr
+}
+
+// NewJSONAnnounce creates JSON representation of announce response
+func NewJSONAnnounce(resp *bittorrent.AnnounceResponse, opts AnnounceOptions) *JSONAnnounce {
+	out := &JSONAnnounce{
+		Interval:       seconds(resp.Interval),
+		MinInterval:    seconds(resp.MinInterval),
+		Peers:          make([]JSONPeer, 0, len(resp.IPv4Peers)+len(resp.IPv6Peers)),
+		TrackerID:      opts.TrackerID,
+		URLList:        resp.WebSeeds,
+		WarningMessage: resp.WarningMessage,
+	}
+	if !opts.OmitCounts {
+		out.Complete, out.Incomplete = &resp.Complete, &resp.Incomplete
+	}
+	if opts.ExternalIP.IsValid() {
+		out.ExternalIP = opts.ExternalIP.String()
+	}
+	for _, peers := range []bittorrent.Peers{resp.IPv4Peers, resp.IPv6Peers} {
+		for _, p := range peers {
+			jp := JSONPeer{IP: p.Addr().String(), Port: p.Port()}
+			if opts.IncludePeerID {
+				jp.PeerID = p.ID.String()
+			}
+			out.Peers = append(out.Peers, jp)
+		}
+	}
+	return out
+}
+
+// JSONScrapeFile is the swarm counters of info hash in JSON scrape response
+type JSONScrapeFile struct {
+	Complete    uint32  `json:"complete"`
+	Downloaded  uint32  `json:"downloaded"`
+	Downloaders *uint32 `json:"downloaders,omitempty"`
+	Incomplete  uint32  `json:"incomplete"`
+}
+
+// JSONScrape is the JSON representation of scrape response.
+// Files are keyed by hex-encoded info hash, value is JSONScrapeFile
+// or JSONFailure if info hash is rejected by middleware.
+type JSONScrape struct {
+	Files map[string]any `json:"files"`
+}
+
+// NewJSONScrape creates JSON representation of scrape response.
+// Internal errors of info hashes are logged and replaced as described
+// in bittorrent.ClientMessage.
+func NewJSONScrape(resp *bittorrent.ScrapeResponse) *JSONScrape {
+	out := &JSONScrape{Files: make(map[string]any, len(resp.Data))}
+	for _, s := range resp.Data {
+		if s.Failure != nil {
+			if _, _, isClient := bittorrent.ClientMessage(s.Failure); !isClient {
+				logger.Error().Err(s.Failure).Msg("internal error")
+			}
+			out.Files[s.InfoHash.String()] = NewJSONFailure(s.Failure)
+			continue
+		}
+		f := JSONScrapeFile{Complete: s.Complete, Downloaded: s.Snatches, Incomplete: s.Incomplete}
+		if s.DownloadersProvided {
+			f.Downloaders = &s.Downloaders
+		}
+		out.Files[s.InfoHash.String()] = f
+	}
+	return out
+}
+
+// JSONFailure is the JSON representation of failed request
+type JSONFailure struct {
+	// FailureCode is the machine-readable reason of failure (bittorrent.ClientError.Code)
+	FailureCode   string `json:"failure code,omitempty"`
+	FailureReason string `json:"failure reason"`
+	// RetryIn is the interval in minutes (BEP 31), after which request may be retried
+	RetryIn uint64 `json:"retry in,omitempty"`
+}
+
+// NewJSONFailure creates JSON representation of error.
+// Messages of internal errors are replaced as described in bittorrent.ClientMessage.
+func NewJSONFailure(err error) *JSONFailure {
+	clientErr, message, _ := bittorrent.ClientMessage(err)
+	out := &JSONFailure{FailureCode: clientErr.Code, FailureReason: message}
+	var retryErr bittorrent.RetryError
+	if errors.As(err, &retryErr) {
+		out.RetryIn = max(uint64(retryErr.RetryIn/time.Minute), 1)
+	}
+	return out
+}
+
+// seconds returns non-negative number of whole seconds in d
+func seconds(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64(d / time.Second)
+}
@@ -0,0 +1,77 @@
+package frontend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func marshal(t *testing.T, v any) string {
+	b, err := json.Marshal(v)
+	require.Nil(t, err)
+	return string(b)
+}
+
+func TestJSONAnnounce(t *testing.T) {
+	var id bittorrent.PeerID
+	id[0] = 0xab
+	resp := &bittorrent.AnnounceResponse{
+		Complete:       1,
+		Incomplete:     0,
+		Interval:       30 * time.Minute,
+		MinInterval:    time.Minute,
+		IPv4Peers:      bittorrent.Peers{{ID: id, AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}},
+		IPv6Peers:      bittorrent.Peers{{ID: id, AddrPort: netip.MustParseAddrPort("[::1]:6882")}},
+		WebSeeds:       []string{"https://example.com/file"},
+		WarningMessage: "warning",
+	}
+	require.JSONEq(t, `{
+		"complete": 1,
+		"external ip": "5.6.7.8",
+		"incomplete": 0,
+		"interval": 1800,
+		"min interval": 60,
+		"peers": [
+			{"ip": "1.2.3.4", "peer id": "ab00000000000000000000000000000000000000", "port": 6881},
+			{"ip": "::1", "peer id": "ab00000000000000000000000000000000000000", "port": 6882}
+		],
+		"tracker id": "tracker",
+		"url-list": ["https://example.com/file"],
+		"warning message": "warning"
+	}`, marshal(t, NewJSONAnnounce(resp, AnnounceOptions{
+		IncludePeerID: true,
+		TrackerID:     "tracker",
+		ExternalIP:    netip.MustParseAddr("5.6.7.8"),
+	})))
+
+	require.JSONEq(t, `{
+		"interval": 0,
+		"min interval": 0,
+		"peers": []
+	}`, marshal(t, NewJSONAnnounce(&bittorrent.AnnounceResponse{Complete: 1}, AnnounceOptions{OmitCounts: true})))
+}
+
+func TestJSONScrape(t *testing.T) {
+	resp := &bittorrent.ScrapeResponse{Data: []bittorrent.Scrape{
+		{InfoHash: "11111111111111111111", Snatches: 3, Complete: 2, Incomplete: 1},
+		{InfoHash: "22222222222222222222", Complete: 1, Downloaders: 0, DownloadersProvided: true},
+		{InfoHash: "33333333333333333333", Failure: bittorrent.NewClientError(bittorrent.ReasonUnapprovedTorrent, "unapproved")},
+	}}
+	require.JSONEq(t, `{"files": {
+		"3131313131313131313131313131313131313131": {"complete": 2, "downloaded": 3, "incomplete": 1},
+		"3232323232323232323232323232323232323232": {"complete": 1, "downloaded": 0, "downloaders": 0, "incomplete": 0},
+		"3333333333333333333333333333333333333333": {"failure code": "unapproved_torrent", "failure reason": "unapproved"}
+	}}`, marshal(t, NewJSONScrape(resp)))
+}
+
+func TestJSONFailure(t *testing.T) {
+	require.JSONEq(t, `{"failure reason": "`+bittorrent.InternalErrorMessage+`"}`, marshal(t, NewJSONFailure(errors.New("storage failed"))))
+	require.JSONEq(t, `{"failure code": "retry_later", "failure reason": "overloaded", "retry in": 2}`,
+		marshal(t, NewJSONFailure(bittorrent.NewRetryError("overloaded", 2*time.Minute))))
+}
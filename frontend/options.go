@@ -1,10 +1,15 @@
 package frontend
 
 import (
+	"context"
 	"errors"
 	"net"
+	"net/netip"
+	"time"
 
+	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
 
 	"github.com/libp2p/go-reuseport"
 )
@@ -80,15 +85,107 @@ func (lo ListenOptions) ListenUDP() (conn *net.UDPConn, err error) {
 	return
 }
 
+// LifetimeOptions overrides storage's peer_lifetime for peers
+// announced through frontend. Zero values mean storage's lifetime.
+type LifetimeOptions struct {
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+	// PeerLifetimeV4 is the lifetime of IPv4 peers, PeerLifetime if not set
+	PeerLifetimeV4 time.Duration `cfg:"peer_lifetime_v4"`
+	// PeerLifetimeV6 is the lifetime of IPv6 peers, PeerLifetime if not set
+	PeerLifetimeV6 time.Duration `cfg:"peer_lifetime_v6"`
+}
+
+// Validate resets negative lifetimes and sets lifetimes
+// of address families from PeerLifetime if they are not set
+func (lo LifetimeOptions) Validate(logger *log.Logger) (validOptions LifetimeOptions) {
+	validOptions = lo
+	if lo.PeerLifetime < 0 {
+		validOptions.PeerLifetime = 0
+		logger.Warn().
+			Str("name", "PeerLifetime").
+			Dur("provided", lo.PeerLifetime).
+			Dur("default", validOptions.PeerLifetime).
+			Msg("falling back to default configuration")
+	}
+	if lo.PeerLifetimeV4 <= 0 {
+		validOptions.PeerLifetimeV4 = validOptions.PeerLifetime
+	}
+	if lo.PeerLifetimeV6 <= 0 {
+		validOptions.PeerLifetimeV6 = validOptions.PeerLifetime
+	}
+	return
+}
+
+// InjectLifetime returns context, which makes storage keep
+// peers for configured lifetimes
+func (lo LifetimeOptions) InjectLifetime(ctx context.Context) context.Context {
+	return storage.WithPeerLifetime(ctx, lo.PeerLifetimeV4, lo.PeerLifetimeV6)
+}
+
+// ErrRequestTimeout is returned to client if request is not processed
+// within DeadlineOptions.RequestTimeout
+var ErrRequestTimeout = bittorrent.NewRetryableError(bittorrent.ReasonTimeout, "request timed out, retry later")
+
+// DeadlineOptions limits time of request processing by middleware
+// and storage, so requests to slow storage are canceled instead of
+// piling up. Zero RequestTimeout disables limit.
+type DeadlineOptions struct {
+	// RequestTimeout is the maximum time of announce or scrape processing.
+	// Post hooks (i.e. storing of peer) are limited separately with the same timeout.
+	RequestTimeout time.Duration `cfg:"request_timeout"`
+}
+
+// Validate resets negative timeout
+func (do DeadlineOptions) Validate(logger *log.Logger) (validOptions DeadlineOptions) {
+	validOptions = do
+	if do.RequestTimeout < 0 {
+		validOptions.RequestTimeout = 0
+		logger.Warn().
+			Str("name", "RequestTimeout").
+			Dur("provided", do.RequestTimeout).
+			Dur("default", validOptions.RequestTimeout).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// WithDeadline returns context, which is done after RequestTimeout
+// or when ctx is done. Cancel function must be called after request processed.
+func (do DeadlineOptions) WithDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if do.RequestTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, do.RequestTimeout)
+}
+
+// DeadlineError returns ErrRequestTimeout if err is caused by
+// exceeded deadline, err otherwise
+func DeadlineError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		var clientErr bittorrent.ClientError
+		if !errors.As(err, &clientErr) {
+			return ErrRequestTimeout
+		}
+	}
+	return err
+}
+
 // ParseOptions is the configuration used to parse an Announce Request.
 //
 // If AllowIPSpoofing is true, IPs provided via params will be used.
 type ParseOptions struct {
-	AllowIPSpoofing     bool   `cfg:"allow_ip_spoofing"`
-	FilterPrivateIPs    bool   `cfg:"filter_private_ips"`
-	MaxNumWant          uint32 `cfg:"max_numwant"`
-	DefaultNumWant      uint32 `cfg:"default_numwant"`
-	MaxScrapeInfoHashes uint32 `cfg:"max_scrape_infohashes"`
+	AllowIPSpoofing bool `cfg:"allow_ip_spoofing"`
+	// TrustedNetworks is the list of networks in CIDR notation,
+	// clients from which may provide IPs via params even if
+	// AllowIPSpoofing is false (i.e. seedboxes behind NAT).
+	TrustedNetworks     []string `cfg:"trusted_networks"`
+	FilterPrivateIPs    bool     `cfg:"filter_private_ips"`
+	MaxNumWant          uint32   `cfg:"max_numwant"`
+	DefaultNumWant      uint32   `cfg:"default_numwant"`
+	MaxScrapeInfoHashes uint32   `cfg:"max_scrape_infohashes"`
+
+	// trusted is parsed TrustedNetworks
+	trusted []netip.Prefix
 }
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -121,9 +218,36 @@ func (op ParseOptions) Validate(logger *log.Logger) ParseOptions {
 			Uint32("default", valid.MaxScrapeInfoHashes).
 			Msg("falling back to default configuration")
 	}
+
+	valid.trusted = make([]netip.Prefix, 0, len(op.TrustedNetworks))
+	for _, n := range op.TrustedNetworks {
+		if pr, err := netip.ParsePrefix(n); err == nil {
+			valid.trusted = append(valid.trusted, pr.Masked())
+		} else {
+			logger.Warn().Err(err).Str("network", n).Msg("ignoring invalid trusted network")
+		}
+	}
 	return valid
 }
 
+// SpoofingAllowed checks if IPs provided via params may be used
+// for request from addr: AllowIPSpoofing is set or addr
+// belongs to any of TrustedNetworks.
+func (op ParseOptions) SpoofingAllowed(addr netip.Addr) bool {
+	return op.AllowIPSpoofing || op.Trusted(addr)
+}
+
+// Trusted checks if addr belongs to any of TrustedNetworks.
+func (op ParseOptions) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, n := range op.trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // Default parser config constants.
 const (
 	defaultMaxNumWant          = 100
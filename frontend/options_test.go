@@ -0,0 +1,35 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func TestDeadlineOptions(t *testing.T) {
+	opts := DeadlineOptions{RequestTimeout: -time.Second}.Validate(log.NewLogger("test"))
+	require.Zero(t, opts.RequestTimeout)
+	ctx, cancel := opts.WithDeadline(context.Background())
+	cancel()
+	_, ok := ctx.Deadline()
+	require.False(t, ok)
+	require.Nil(t, ctx.Err())
+
+	ctx, cancel = DeadlineOptions{RequestTimeout: time.Millisecond}.WithDeadline(context.Background())
+	defer cancel()
+	<-ctx.Done()
+	err := DeadlineError(fmt.Errorf("storage: %w", ctx.Err()))
+	require.Equal(t, ErrRequestTimeout, err)
+	require.Equal(t, bittorrent.ReasonTimeout, bittorrent.RejectReason(err))
+
+	clientErr := bittorrent.NewClientError(bittorrent.ReasonBlocked, "blocked")
+	require.Equal(t, clientErr, DeadlineError(clientErr))
+	require.True(t, errors.Is(DeadlineError(context.Canceled), context.Canceled))
+}
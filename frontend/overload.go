@@ -0,0 +1,177 @@
+package frontend
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func init() {
+	prometheus.MustRegister(promShedAnnounces, promOverloaded)
+}
+
+var (
+	promShedAnnounces = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_frontend_shed_announces_total",
+		Help: "The number of announces rejected with `retry in` because frontend is overloaded",
+	}, []string{"frontend"})
+	promOverloaded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mochi_frontend_overloaded",
+		Help: "Whether frontend is overloaded (1) and sheds announces",
+	}, []string{"frontend"})
+)
+
+// errOverloaded is the message of RetryError returned to shed announces
+const errOverloaded = "tracker is overloaded, retry later"
+
+const (
+	defaultShedFraction   = 0.1
+	defaultRetryIn        = 5 * time.Minute
+	defaultIntervalFactor = 2
+	// latencyWeight is the reciprocal of weight of new sample
+	// in exponentially weighted moving average of latency
+	latencyWeight = 16
+)
+
+// OverloadOptions enables load shedding, if announces are processed too
+// long or too many of them are pending. Zero MaxPending and MaxLatency
+// disable detection.
+type OverloadOptions struct {
+	// MaxPending is the number of announces being processed (including
+	// asynchronous post hooks), above which frontend is overloaded
+	MaxPending int64 `cfg:"max_pending"`
+	// MaxLatency is the average time of announce processing (mostly storage
+	// requests), above which frontend is overloaded
+	MaxLatency time.Duration `cfg:"max_latency"`
+	// ShedFraction is the fraction of announces, rejected while overloaded,
+	// it is less than 1, so latency is still measured
+	ShedFraction float64 `cfg:"shed_fraction"`
+	// RetryIn is the time, after which rejected clients should retry (BEP 31)
+	RetryIn time.Duration `cfg:"retry_in"`
+	// IntervalFactor multiplies intervals of not rejected announces while overloaded
+	IntervalFactor float64 `cfg:"interval_factor"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (oo OverloadOptions) Validate(logger *log.Logger) (validOptions OverloadOptions) {
+	validOptions = oo
+	if oo.MaxPending <= 0 && oo.MaxLatency <= 0 {
+		return
+	}
+	if oo.ShedFraction <= 0 || oo.ShedFraction >= 1 {
+		validOptions.ShedFraction = defaultShedFraction
+		logger.Warn().
+			Str("name", "Overload.ShedFraction").
+			Float64("provided", oo.ShedFraction).
+			Float64("default", validOptions.ShedFraction).
+			Msg("falling back to default configuration")
+	}
+	if oo.RetryIn < time.Minute {
+		validOptions.RetryIn = defaultRetryIn
+		logger.Warn().
+			Str("name", "Overload.RetryIn").
+			Dur("provided", oo.RetryIn).
+			Dur("default", validOptions.RetryIn).
+			Msg("falling back to default configuration")
+	}
+	if oo.IntervalFactor < 1 {
+		validOptions.IntervalFactor = defaultIntervalFactor
+		logger.Warn().
+			Str("name", "Overload.IntervalFactor").
+			Float64("provided", oo.IntervalFactor).
+			Float64("default", validOptions.IntervalFactor).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// Overload detects overload of frontend by the number of pending
+// announces and average announce latency. All methods of nil
+// Overload (detection disabled) do nothing.
+type Overload struct {
+	opts       OverloadOptions
+	pending    atomic.Int64
+	latency    atomic.Int64
+	overloaded atomic.Bool
+	shed       prometheus.Counter
+	gauge      prometheus.Gauge
+}
+
+// NewOverload creates overload detector of frontend with provided name,
+// returns nil if detection is disabled
+func NewOverload(opts OverloadOptions, name string) *Overload {
+	if opts.MaxPending <= 0 && opts.MaxLatency <= 0 {
+		return nil
+	}
+	return &Overload{
+		opts:  opts,
+		shed:  promShedAnnounces.WithLabelValues(name),
+		gauge: promOverloaded.WithLabelValues(name),
+	}
+}
+
+// Begin registers new pending announce or returns RetryError for
+// configured fraction of announces if frontend is overloaded.
+// If error is not returned, Done must be called after announce processed.
+func (o *Overload) Begin() error {
+	if o == nil {
+		return nil
+	}
+	pending := o.pending.Add(1)
+	overloaded := (o.opts.MaxPending > 0 && pending > o.opts.MaxPending) ||
+		(o.opts.MaxLatency > 0 && time.Duration(o.latency.Load()) > o.opts.MaxLatency)
+	if o.overloaded.Swap(overloaded) != overloaded {
+		if overloaded {
+			o.gauge.Set(1)
+			logger.Warn().Int64("pending", pending).Dur("latency", time.Duration(o.latency.Load())).
+				Msg("frontend is overloaded, shedding announces")
+		} else {
+			o.gauge.Set(0)
+			logger.Info().Msg("frontend is not overloaded anymore")
+		}
+	}
+	if overloaded && rand.Float64() < o.opts.ShedFraction {
+		o.pending.Add(-1)
+		o.shed.Inc()
+		return bittorrent.NewRetryError(errOverloaded, o.opts.RetryIn)
+	}
+	return nil
+}
+
+// Observe records duration of announce processing
+func (o *Overload) Observe(d time.Duration) {
+	if o == nil {
+		return
+	}
+	for {
+		old := o.latency.Load()
+		if o.latency.CompareAndSwap(old, old+(int64(d)-old)/latencyWeight) {
+			break
+		}
+	}
+}
+
+// Adjust returns copy of resp with stretched intervals if frontend
+// is overloaded, resp itself is not modified, since it may be cached
+func (o *Overload) Adjust(resp *bittorrent.AnnounceResponse) *bittorrent.AnnounceResponse {
+	if o == nil || !o.overloaded.Load() {
+		return resp
+	}
+	adjusted := *resp
+	adjusted.Interval = time.Duration(float64(resp.Interval) * o.opts.IntervalFactor)
+	adjusted.MinInterval = time.Duration(float64(resp.MinInterval) * o.opts.IntervalFactor)
+	return &adjusted
+}
+
+// Done unregisters pending announce
+func (o *Overload) Done() {
+	if o != nil {
+		o.pending.Add(-1)
+	}
+}
@@ -0,0 +1,58 @@
+package frontend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func TestOverload(t *testing.T) {
+	require.Nil(t, NewOverload(OverloadOptions{}, "test"))
+	var disabled *Overload
+	require.Nil(t, disabled.Begin())
+	disabled.Done()
+
+	opts := OverloadOptions{MaxPending: 2, MaxLatency: time.Second, ShedFraction: 2}.Validate(log.NewLogger("test"))
+	require.Equal(t, defaultShedFraction, opts.ShedFraction)
+	opts.ShedFraction = 0.999
+	o := NewOverload(opts, "test")
+	resp := &bittorrent.AnnounceResponse{Interval: time.Minute, MinInterval: time.Second}
+
+	require.Nil(t, o.Begin())
+	require.Nil(t, o.Begin())
+	require.Same(t, resp, o.Adjust(resp))
+
+	// pending announces above MaxPending overload frontend
+	var err error
+	for err == nil {
+		err = o.Begin()
+	}
+	var retryErr bittorrent.RetryError
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, defaultRetryIn, retryErr.RetryIn)
+	adjusted := o.Adjust(resp)
+	require.Equal(t, 2*time.Minute, adjusted.Interval)
+	require.Equal(t, time.Minute, resp.Interval)
+
+	for o.pending.Load() > 0 {
+		o.Done()
+	}
+	require.Nil(t, o.Begin())
+	o.Done()
+
+	// slow announces overload frontend too
+	for range 100 {
+		o.Observe(2 * time.Second)
+	}
+	for {
+		if err = o.Begin(); err != nil {
+			break
+		}
+		o.Done()
+	}
+	require.ErrorAs(t, err, &retryErr)
+}
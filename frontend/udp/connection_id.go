@@ -6,11 +6,12 @@ import (
 	"encoding/binary"
 	"hash"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
 
-	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/privacy"
 	"github.com/sot-tech/mochi/pkg/xorshift"
 )
 
@@ -121,8 +122,8 @@ func (g *ConnectionIDGenerator) Generate(ip netip.Addr, now time.Time) (out []by
 	g.connID[0], g.connID[1], g.connID[2] = g.buff[0], g.buff[7], g.buff[8]
 	copy(g.connID[connIDLen-hmacLen:], g.scratch[:hmacLen])
 
-	log.Trace().
-		Stringer("ip", ip).
+	sampledLogger.Trace("generate").
+		Stringer("ip", privacy.Stringer(ip)).
 		Hex("connID", g.connID).
 		Msg("generated connection ID")
 	return g.connID[:connIDLen]
@@ -145,10 +146,44 @@ func (g *ConnectionIDGenerator) Validate(connectionID []byte, ip netip.Addr, now
 	// ts-skew < now < ts+ttl+skew
 	res = ts-g.maxClockSkew < nowTS && res
 	res = nowTS < ts+ttl+g.maxClockSkew && res
-	log.Trace().
-		Stringer("ip", ip).
+	sampledLogger.Trace("validate").
+		Stringer("ip", privacy.Stringer(ip)).
 		Hex("connID", connectionID).
 		Bool("result", res).
 		Msg("validating connection ID")
 	return res
 }
+
+// generatorPool is the pool of connection ID generators
+// which records hits, misses and creations of generators
+type generatorPool struct {
+	pool         sync.Pool
+	key          []byte
+	maxClockSkew time.Duration
+}
+
+func newGeneratorPool(key []byte, maxClockSkew time.Duration) *generatorPool {
+	return &generatorPool{key: key, maxClockSkew: maxClockSkew}
+}
+
+// create returns new generator, which is not taken from pool,
+// used for handlers, which own generator during their lifetime
+func (p *generatorPool) create() *ConnectionIDGenerator {
+	recordGenerator(generatorCreated)
+	return NewConnectionIDGenerator(p.key, p.maxClockSkew)
+}
+
+// Get returns generator from pool or creates new one
+func (p *generatorPool) Get() *ConnectionIDGenerator {
+	if g, ok := p.pool.Get().(*ConnectionIDGenerator); ok {
+		recordGenerator(generatorHit)
+		return g
+	}
+	recordGenerator(generatorMiss)
+	return p.create()
+}
+
+// Put returns generator to pool
+func (p *generatorPool) Put(g *ConnectionIDGenerator) {
+	p.pool.Put(g)
+}
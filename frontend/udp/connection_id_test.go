@@ -127,6 +127,22 @@ func TestReuseGeneratorValidate(t *testing.T) {
 	}
 }
 
+func TestGeneratorPool(t *testing.T) {
+	ip := netip.MustParseAddr("127.0.0.1")
+	now := time.Now()
+	pool := newGeneratorPool([]byte("key"), time.Minute)
+	pinned := pool.create()
+
+	gen := pool.Get()
+	cid := bytes.Clone(gen.Generate(ip, now))
+	pool.Put(gen)
+	require.True(t, pinned.Validate(cid, ip, now))
+
+	gen = pool.Get()
+	require.True(t, gen.Validate(pinned.Generate(ip, now), ip, now))
+	pool.Put(gen)
+}
+
 func BenchmarkSimpleNewConnectionID(b *testing.B) {
 	ip := netip.MustParseAddr("127.0.0.1")
 	key := []byte("some random string that is hopefully at least this long")
@@ -220,3 +236,36 @@ func BenchmarkConnectionIDGenerator_Validate(b *testing.B) {
 		}
 	})
 }
+
+func FuzzConnectionID(f *testing.F) {
+	f.Add([]byte("key"), []byte{127, 0, 0, 1}, int64(1700000000), int64(30), []byte{0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{}, netip.IPv6Loopback().AsSlice(), int64(0), int64(-1), []byte{1})
+	f.Fuzz(func(t *testing.T, key, ipBytes []byte, created, delta int64, tamper []byte) {
+		ip, ok := netip.AddrFromSlice(ipBytes)
+		if !ok || created < 0 || created > 1<<40 || delta < -1<<40 || delta > 1<<40 {
+			t.Skip()
+		}
+		gen := NewConnectionIDGenerator(key, time.Minute)
+		createdAt := time.Unix(created, 0)
+		cid := bytes.Clone(gen.Generate(ip, createdAt))
+		require.Len(t, cid, 8)
+		require.True(t, gen.Validate(cid, ip, createdAt))
+
+		// should not panic at any time
+		_ = gen.Validate(cid, ip, createdAt.Add(time.Duration(delta)*time.Second))
+
+		other := ip.AsSlice()
+		other[len(other)-1]++
+		otherIP, _ := netip.AddrFromSlice(other)
+		require.False(t, gen.Validate(cid, otherIP, createdAt))
+
+		tampered, changed := bytes.Clone(cid), false
+		for i := 0; i < len(tamper) && i < len(tampered); i++ {
+			tampered[i] ^= tamper[i]
+			changed = changed || tamper[i] != 0
+		}
+		if changed {
+			require.False(t, gen.Validate(tampered, ip, createdAt))
+		}
+	})
+}
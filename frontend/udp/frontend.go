@@ -11,16 +11,19 @@ import (
 	"io"
 	"net"
 	"net/netip"
+	"runtime"
 	"sync"
 	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/frontend"
 	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/affinity"
 	"github.com/sot-tech/mochi/pkg/bytepool"
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/str2bytes"
 	"github.com/sot-tech/mochi/pkg/timecache"
 )
 
@@ -33,7 +36,11 @@ const (
 	allowedGeneratedPrivateKeyRunes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 )
 
-var logger = log.NewLogger("frontend/udp")
+var (
+	logger = log.NewLogger("frontend/udp")
+	// sampledLogger used for per-packet events
+	sampledLogger = log.NewSampledLogger("frontend/udp", 0, log.DefaultPerSecond)
+)
 
 func init() {
 	frontend.RegisterBuilder(Name, NewFrontend)
@@ -45,9 +52,37 @@ type Config struct {
 	frontend.ListenOptions
 	PrivateKey   string        `cfg:"private_key"`
 	MaxClockSkew time.Duration `cfg:"max_clock_skew"`
+	// CPUAffinity is the list of CPU sets (i.e. `0-3`), worker N
+	// and its request handlers are bound to set N modulo list length
+	CPUAffinity []string `cfg:"cpu_affinity"`
+	// ExternalIP enables appending of requester's source
+	// address to announce response
+	ExternalIP bool `cfg:"external_ip"`
+	// Overload enables shedding of announces if frontend is overloaded
+	Overload frontend.OverloadOptions
+	// OmitCounts makes seeders and leechers zero in announce response
+	OmitCounts bool `cfg:"omit_counts"`
+	// NAT64 enables translation of announces from NAT64 addresses
+	NAT64 NAT64Options `cfg:"nat64"`
+	frontend.LifetimeOptions
+	frontend.DeadlineOptions
 	frontend.ParseOptions
 }
 
+// GenerateKey returns random alphanumeric key with provided length,
+// which may be used as Config.PrivateKey
+func GenerateKey(length int) (string, error) {
+	pkeyRunes := make([]byte, length)
+	if _, err := rand.Read(pkeyRunes); err != nil {
+		return "", err
+	}
+	l := len(allowedGeneratedPrivateKeyRunes)
+	for i := range pkeyRunes {
+		pkeyRunes[i] = allowedGeneratedPrivateKeyRunes[int(pkeyRunes[i])%l]
+	}
+	return string(pkeyRunes), nil
+}
+
 // Validate sanity checks values set in a config and returns a new config with
 // default values replacing anything that is invalid.
 func (cfg Config) Validate() (validCfg Config) {
@@ -64,15 +99,10 @@ func (cfg Config) Validate() (validCfg Config) {
 
 	// Generate a private key if one isn't provided by the user.
 	if cfg.PrivateKey == "" {
-		pkeyRunes := make([]byte, defaultKeyLen)
-		if _, err := rand.Read(pkeyRunes); err != nil {
+		var err error
+		if validCfg.PrivateKey, err = GenerateKey(defaultKeyLen); err != nil {
 			panic(err)
 		}
-		l := len(allowedGeneratedPrivateKeyRunes)
-		for i := range pkeyRunes {
-			pkeyRunes[i] = allowedGeneratedPrivateKeyRunes[int(pkeyRunes[i])%l]
-		}
-		validCfg.PrivateKey = string(pkeyRunes)
 
 		logger.Warn().
 			Str("name", "PrivateKey").
@@ -94,6 +124,10 @@ func (cfg Config) Validate() (validCfg Config) {
 			Msg("falling back to default configuration")
 	}
 
+	validCfg.LifetimeOptions = cfg.LifetimeOptions.Validate(logger)
+	validCfg.DeadlineOptions = cfg.DeadlineOptions.Validate(logger)
+	validCfg.Overload = cfg.Overload.Validate(logger)
+	validCfg.NAT64 = cfg.NAT64.Validate(logger)
 	validCfg.ParseOptions = cfg.ParseOptions.Validate(logger)
 
 	return
@@ -104,9 +138,16 @@ type udpFE struct {
 	sockets        []*net.UDPConn
 	closing        chan any
 	wg             sync.WaitGroup
-	genPool        *sync.Pool
+	genPool        *generatorPool
+	respPool       *bytepool.BytePool
 	logic          *middleware.Logic
 	collectTimings bool
+	externalIP     bool
+	omitCounts     bool
+	nat64          NAT64Options
+	overload       *frontend.Overload
+	lifetime       frontend.LifetimeOptions
+	deadline       frontend.DeadlineOptions
 	ctxCancel      context.CancelFunc
 	onceCloser     sync.Once
 	frontend.ParseOptions
@@ -120,6 +161,15 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 		return nil, err
 	}
 	cfg = cfg.Validate()
+	cpuSets := make([]affinity.CPUSet, len(cfg.CPUAffinity))
+	for i, s := range cfg.CPUAffinity {
+		if cpuSets[i], err = affinity.Parse(s); err != nil {
+			return nil, err
+		}
+	}
+	if len(cpuSets) > 0 && !affinity.Supported {
+		return nil, affinity.ErrUnsupported
+	}
 	pKey := []byte(cfg.PrivateKey)
 
 	f := &udpFE{
@@ -127,12 +177,15 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 		closing:        make(chan any),
 		logic:          logic,
 		collectTimings: cfg.EnableRequestTiming,
+		externalIP:     cfg.ExternalIP,
+		omitCounts:     cfg.OmitCounts,
+		nat64:          cfg.NAT64,
+		overload:       frontend.NewOverload(cfg.Overload, "udp"),
+		lifetime:       cfg.LifetimeOptions,
+		deadline:       cfg.DeadlineOptions,
 		ParseOptions:   cfg.ParseOptions,
-		genPool: &sync.Pool{
-			New: func() any {
-				return NewConnectionIDGenerator(pKey, cfg.MaxClockSkew)
-			},
-		},
+		respPool:       newResponsePool(cfg.MaxNumWant, cfg.MaxScrapeInfoHashes),
+		genPool:        newGeneratorPool(pKey, cfg.MaxClockSkew),
 	}
 
 	var ctx context.Context
@@ -140,9 +193,13 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 	logger.Debug().Str("addr", cfg.Addr).Msg("starting listener")
 	for i := range f.sockets {
 		if f.sockets[i], err = cfg.ListenUDP(); err == nil {
+			var cpus affinity.CPUSet
+			if len(cpuSets) > 0 {
+				cpus = cpuSets[i%len(cpuSets)]
+			}
 			f.wg.Add(1)
 			go func(socket *net.UDPConn, ctx context.Context) {
-				if err := f.serve(ctx, socket); err != nil {
+				if err := f.serve(ctx, socket, cpus); err != nil {
 					logger.Fatal().Str("addr", cfg.Addr).Err(err).Msg("listener failed")
 				} else {
 					logger.Info().Str("addr", cfg.Addr).Msg("listener stopped")
@@ -157,32 +214,124 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 	return f, err
 }
 
-// Close provides a thread-safe way to shut down a currently running Frontend.
-func (f *udpFE) Close() (err error) {
+// Drain stops reading new packets and waits until in-flight
+// requests and post hooks are processed or ctx is done.
+func (f *udpFE) Drain(ctx context.Context) (err error) {
 	f.onceCloser.Do(func() {
 		close(f.closing)
-		f.ctxCancel()
 		cls := make([]io.Closer, 0, len(f.sockets))
 		now := time.Now()
 		for _, s := range f.sockets {
 			if s != nil {
-				_ = s.SetDeadline(now)
+				// interrupt blocked reads, but allow to write responses
+				_ = s.SetReadDeadline(now)
 				cls = append(cls, s)
 			}
 		}
-		f.wg.Wait()
-		err = frontend.CloseGroup(cls)
+		done := make(chan any)
+		go func() {
+			f.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		f.ctxCancel()
+		if closeErr := frontend.CloseGroup(cls); closeErr != nil {
+			err = closeErr
+		}
 	})
 
 	return
 }
 
+// Close provides a thread-safe way to shut down a currently running Frontend.
+func (f *udpFE) Close() error {
+	return f.Drain(context.Background())
+}
+
+// packet is the received request, which is passed to handler
+type packet struct {
+	buffer   *[]byte
+	n        int
+	addrPort netip.AddrPort
+}
+
+// pinThread locks goroutine to its OS thread and binds
+// the thread to cpus. If binding failed, thread is unlocked.
+// Bound thread is never unlocked, so it is terminated with goroutine
+// instead of returning to scheduler with modified affinity.
+func pinThread(cpus affinity.CPUSet) {
+	runtime.LockOSThread()
+	if err := cpus.Pin(); err != nil {
+		runtime.UnlockOSThread()
+		logger.Warn().Err(err).Stringer("cpus", cpus).Msg("unable to set cpu affinity")
+	}
+}
+
 // serve blocks while listening and serving UDP BitTorrent requests
 // until Stop() is called or an error is returned.
-func (f *udpFE) serve(ctx context.Context, socket *net.UDPConn) error {
+// If cpus set, read loop and request handlers (one per CPU in set)
+// are bound to cpus, otherwise new goroutine handles each request.
+func (f *udpFE) serve(ctx context.Context, socket *net.UDPConn, cpus affinity.CPUSet) error {
 	pool := bytepool.NewBytePool(2048)
 	defer f.wg.Done()
 
+	handle := func(p packet, gen *ConnectionIDGenerator) {
+		defer pool.Put(p.buffer)
+
+		// Handle the request.
+		addr := p.addrPort.Addr().Unmap()
+		var start time.Time
+		if f.collectTimings && metrics.Enabled() {
+			start = time.Now()
+		}
+		action, err := f.handleRequest(ctx,
+			Request{(*p.buffer)[:p.n], addr},
+			ResponseWriter{socket, p.addrPort},
+			gen,
+		)
+		if f.collectTimings && metrics.Enabled() {
+			recordResponseDuration(action, addr, err, time.Since(start))
+		}
+		recordRejection(action, err)
+	}
+	dispatch := func(p packet) {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			// get a connection ID generator/validator from the pool.
+			gen := f.genPool.Get()
+			defer f.genPool.Put(gen)
+			handle(p, gen)
+		}()
+	}
+
+	if len(cpus) > 0 {
+		pinThread(cpus)
+		packets := make(chan packet, len(cpus))
+		defer close(packets)
+		for range cpus {
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				pinThread(cpus)
+				// bound handler owns generator, so HMAC state
+				// stays in caches of the same CPUs
+				gen := f.genPool.create()
+				for p := range packets {
+					handle(p, gen)
+				}
+			}()
+		}
+		dispatch = func(p packet) {
+			packets <- p
+		}
+		logger.Debug().Stringer("cpus", cpus).Msg("listener bound to cpus")
+	}
+
 	for {
 		// Check to see if we need shutdown.
 		select {
@@ -211,25 +360,7 @@ func (f *udpFE) serve(ctx context.Context, socket *net.UDPConn) error {
 			continue
 		}
 
-		f.wg.Add(1)
-		go func() {
-			defer f.wg.Done()
-			defer pool.Put(buffer)
-
-			// Handle the request.
-			addr := addrPort.Addr().Unmap()
-			var start time.Time
-			if f.collectTimings && metrics.Enabled() {
-				start = time.Now()
-			}
-			action, err := f.handleRequest(ctx,
-				Request{(*buffer)[:n], addr},
-				ResponseWriter{socket, addrPort},
-			)
-			if f.collectTimings && metrics.Enabled() {
-				recordResponseDuration(action, addr, err, time.Since(start))
-			}
-		}()
+		dispatch(packet{buffer, n, addrPort})
 	}
 }
 
@@ -251,8 +382,24 @@ func (w ResponseWriter) Write(b []byte) (int, error) {
 	return w.socket.WriteToUDPAddrPort(b, w.addrPort)
 }
 
+// parseAnnounce parses announce of client with clientIP. If request is
+// received from NAT64 address, it is replaced or complemented with
+// embedded IPv4 address (clientIP) depending on NAT64Options.Advertise.
+func (f *udpFE) parseAnnounce(r Request, clientIP netip.Addr, nat64, v6Action bool) (*bittorrent.AnnounceRequest, error) {
+	if !nat64 || f.nat64.Advertise == NAT64AdvertiseV6 {
+		return parseAnnounce(r, v6Action, f.ParseOptions)
+	}
+	source := r.IP
+	r.IP = clientIP
+	req, err := parseAnnounce(r, v6Action, f.ParseOptions)
+	if err == nil && f.nat64.Advertise == NAT64AdvertiseBoth {
+		req.Add(bittorrent.RequestAddress{Addr: source})
+	}
+	return req, err
+}
+
 // handleRequest parses and responds to a UDP Request.
-func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter) (actionName string, err error) {
+func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter, gen *ConnectionIDGenerator) (actionName string, err error) {
 	if len(r.Packet) < 16 {
 		// Malformed, no client packets are less than 16 bytes.
 		// We explicitly return nothing in case this is a DoS attempt.
@@ -264,16 +411,19 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 	connID := r.Packet[0:8]
 	actionID := binary.BigEndian.Uint32(r.Packet[8:12])
 	txID := r.Packet[12:16]
+	// request ID is generated for announces and scrapes only
+	var reqID string
 
-	// get a connection ID generator/validator from the pool.
-	gen := f.genPool.Get().(*ConnectionIDGenerator)
-	defer f.genPool.Put(gen)
+	// get a response buffer, which fits any response, from the pool.
+	respBuf := f.respPool.Get()
+	defer f.respPool.Put(respBuf)
+	buf := (*respBuf)[:0]
 
 	// If this isn't requesting a new connection ID and the connection ID is
 	// invalid, then fail.
 	if actionID != connectActionID && !gen.Validate(connID, r.IP, timecache.Now()) {
 		err = errBadConnectionID
-		writeErrorResponse(w, txID, err)
+		writeErrorResponse(w, buf, txID, reqID, err)
 		return
 	}
 
@@ -287,65 +437,139 @@ func (f *udpFE) handleRequest(ctx context.Context, r Request, w ResponseWriter)
 			return
 		}
 
-		writeConnectionID(w, txID, gen.Generate(r.IP, timecache.Now()))
+		writeConnectionID(w, buf, txID, gen.Generate(r.IP, timecache.Now()))
 
 	case announceActionID, announceV6ActionID:
 		actionName = "announce"
+		reqID = bittorrent.NewRequestID()
+
+		// client behind NAT64 is IPv4 client, so it receives IPv4 response
+		clientIP, nat64 := r.IP, false
+		if f.nat64.Enabled() {
+			var embedded netip.Addr
+			if embedded, nat64 = f.nat64.Embedded(r.IP); nat64 {
+				clientIP = embedded
+			}
+		}
 
 		var req *bittorrent.AnnounceRequest
-		req, err = parseAnnounce(r, actionID == announceV6ActionID, f.ParseOptions)
+		req, err = f.parseAnnounce(r, clientIP, nat64, actionID == announceV6ActionID)
 		if err != nil {
-			writeErrorResponse(w, txID, err)
+			writeErrorResponse(w, buf, txID, reqID, err)
+			return
+		}
+
+		logic := f.logic
+		if qp, isOk := req.Params.(*queryParams); isOk {
+			// virtual trackers are matched by path of BEP41 URL data
+			logic, _ = f.logic.Tenant(nil, str2bytes.StringToBytes(qp.path))
+		}
+
+		if err = f.overload.Begin(); err != nil {
+			writeErrorResponse(w, buf, txID, reqID, err)
+			return
+		}
+		var reservation frontend.Reservation
+		async := false
+		defer func() {
+			if !async {
+				f.overload.Done()
+				reservation.Release()
+			}
+		}()
+		if reservation, err = frontend.AdmitAnnounce(Name, req); err != nil {
+			writeErrorResponse(w, buf, txID, reqID, err)
 			return
 		}
 
 		var resp *bittorrent.AnnounceResponse
-		ctx := bittorrent.InjectRouteParamsToContext(ctx, bittorrent.RouteParams{})
-		ctx, resp, err = f.logic.HandleAnnounce(ctx, req)
+		hCtx, cancel := f.deadline.WithDeadline(ctx)
+		defer cancel()
+		hCtx = f.lifetime.InjectLifetime(bittorrent.InjectRouteParamsToContext(bittorrent.WithRequestID(hCtx, reqID), bittorrent.RouteParams{}))
+		handleStart := time.Now()
+		hCtx, resp, err = logic.HandleAnnounce(hCtx, req)
+		f.overload.Observe(time.Since(handleStart))
 		if err != nil {
-			if !errors.Is(err, context.Canceled) {
-				writeErrorResponse(w, txID, err)
+			if err = frontend.DeadlineError(err); !errors.Is(err, context.Canceled) {
+				writeErrorResponse(w, buf, txID, reqID, err)
 			}
 			return
 		}
 
 		if err = ctx.Err(); err == nil {
-			writeAnnounceResponse(w, txID, resp, actionID == announceV6ActionID, r.IP.Is6())
+			var externalIP netip.Addr
+			if f.externalIP {
+				externalIP = clientIP
+			}
+			writeAnnounceResponse(w, buf, txID, f.overload.Adjust(resp), actionID == announceV6ActionID, clientIP.Is6(), f.omitCounts, externalIP)
 
-			ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
-			go f.logic.AfterAnnounce(ctx, req, resp)
+			bgCtx := bittorrent.RemapRouteParamsToBgContext(hCtx)
+			f.wg.Add(1)
+			// announce is pending until post hooks are done
+			async = true
+			go func() {
+				defer f.wg.Done()
+				defer f.overload.Done()
+				defer reservation.Release()
+				bgCtx, cancel := f.deadline.WithDeadline(bgCtx)
+				defer cancel()
+				logic.AfterAnnounce(bgCtx, req, resp)
+			}()
 		}
 
 	case scrapeActionID:
 		actionName = "scrape"
+		reqID = bittorrent.NewRequestID()
 
 		var req *bittorrent.ScrapeRequest
 		req, err = parseScrape(r, f.ParseOptions)
 		if err != nil {
-			writeErrorResponse(w, txID, err)
+			writeErrorResponse(w, buf, txID, reqID, err)
 			return
 		}
 
+		var reservation frontend.Reservation
+		if reservation, err = frontend.AdmitScrape(Name, req); err != nil {
+			writeErrorResponse(w, buf, txID, reqID, err)
+			return
+		}
+		async := false
+		defer func() {
+			if !async {
+				reservation.Release()
+			}
+		}()
+
 		var resp *bittorrent.ScrapeResponse
-		ctx := bittorrent.InjectRouteParamsToContext(ctx, bittorrent.RouteParams{})
-		ctx, resp, err = f.logic.HandleScrape(ctx, req)
+		hCtx, cancel := f.deadline.WithDeadline(ctx)
+		defer cancel()
+		hCtx = bittorrent.InjectRouteParamsToContext(bittorrent.WithRequestID(hCtx, reqID), bittorrent.RouteParams{})
+		hCtx, resp, err = f.logic.HandleScrape(hCtx, req)
 		if err != nil {
-			if !errors.Is(err, context.Canceled) {
-				writeErrorResponse(w, txID, err)
+			if err = frontend.DeadlineError(err); !errors.Is(err, context.Canceled) {
+				writeErrorResponse(w, buf, txID, reqID, err)
 			}
 			return
 		}
 
 		if err = ctx.Err(); err == nil {
-			writeScrapeResponse(w, txID, resp)
+			writeScrapeResponse(w, buf, txID, resp)
 
-			ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
-			go f.logic.AfterScrape(ctx, req, resp)
+			bgCtx := bittorrent.RemapRouteParamsToBgContext(hCtx)
+			f.wg.Add(1)
+			async = true
+			go func() {
+				defer f.wg.Done()
+				defer reservation.Release()
+				bgCtx, cancel := f.deadline.WithDeadline(bgCtx)
+				defer cancel()
+				f.logic.AfterScrape(bgCtx, req, resp)
+			}()
 		}
 
 	default:
 		err = errUnknownAction
-		writeErrorResponse(w, txID, err)
+		writeErrorResponse(w, buf, txID, reqID, err)
 	}
 
 	return
@@ -1,10 +1,16 @@
 package udp_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/sot-tech/mochi/frontend/udp"
 	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/affinity"
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/storage"
@@ -23,7 +29,7 @@ func TestStartStopRaceIssue437(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	lgc := middleware.NewLogic(0, 0, ps, nil, nil)
+	lgc := middleware.NewLogic(0, 0, ps, nil, nil, nil)
 	fe, err := udp.NewFrontend(conf.MapConfig{"addr": "127.0.0.1:0"}, lgc)
 	if err != nil {
 		t.Fatal(err)
@@ -32,3 +38,87 @@ func TestStartStopRaceIssue437(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDrain(t *testing.T) {
+	ps, err := storage.NewPeerStorage(conf.NamedMapConfig{
+		Name:   "memory",
+		Config: conf.MapConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lgc := middleware.NewLogic(0, 0, ps, nil, nil, nil)
+	fe, err := udp.NewFrontend(conf.MapConfig{"addr": "127.0.0.1:0", "workers": 2}, lgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = fe.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// subsequent calls are no-op
+	if err = fe.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCPUAffinity(t *testing.T) {
+	ps, err := storage.NewPeerStorage(conf.NamedMapConfig{
+		Name:   "memory",
+		Config: conf.MapConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lgc := middleware.NewLogic(0, 0, ps, nil, nil, nil)
+	if _, err = udp.NewFrontend(conf.MapConfig{"addr": "127.0.0.1:0", "cpu_affinity": []any{"1-0"}}, lgc); err == nil {
+		t.Fatal("invalid cpu list expected to be rejected")
+	}
+
+	// reserve free port
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	_ = conn.Close()
+
+	fe, err := udp.NewFrontend(conf.MapConfig{
+		"addr":         addr,
+		"workers":      2,
+		"cpu_affinity": []any{"0", "0-1"},
+	}, lgc)
+	if !affinity.Supported {
+		if !errors.Is(err, affinity.ErrUnsupported) {
+			t.Fatalf("expected %v, got %v", affinity.ErrUnsupported, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fe.Close()
+
+	// requests are handled by bound handlers
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req := []byte{0, 0, 0x04, 0x17, 0x27, 0x10, 0x19, 0x80, 0, 0, 0, 0, 1, 2, 3, 4}
+	resp := make([]byte, 64)
+	for i := 0; i < 10; i++ {
+		_ = client.SetDeadline(time.Now().Add(time.Second))
+		if _, err = client.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if n, err = client.Read(resp); err != nil {
+			t.Fatal(err)
+		}
+		if n != 16 || !bytes.Equal(resp[4:8], req[12:16]) {
+			t.Fatalf("unexpected connect response %v", resp[:n])
+		}
+	}
+}
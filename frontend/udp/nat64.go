@@ -0,0 +1,106 @@
+package udp
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+// Families, where peers announced from NAT64 addresses are advertised
+const (
+	// NAT64AdvertiseV4 peer is stored with embedded IPv4 address
+	NAT64AdvertiseV4 = "v4"
+	// NAT64AdvertiseV6 peer is stored with NAT64 address
+	NAT64AdvertiseV6 = "v6"
+	// NAT64AdvertiseBoth peer is stored with both addresses
+	NAT64AdvertiseBoth = "both"
+)
+
+// WellKnownNAT64Prefixes are the default NAT64 prefixes:
+// well-known (RFC 6052) and local-use (RFC 8215)
+var WellKnownNAT64Prefixes = []string{"64:ff9b::/96", "64:ff9b:1::/48"}
+
+// NAT64Options configures handling of announces received from NAT64
+// addresses (i.e. IPv4 clients of IPv6-only tracker behind translator),
+// which embed client's IPv4 address.
+type NAT64Options struct {
+	// Prefixes list of NAT64 prefixes with lengths 32, 40, 48, 56, 64 or 96,
+	// WellKnownNAT64Prefixes if empty
+	Prefixes []string `cfg:"prefixes"`
+	// Advertise is the family, where peers are advertised: NAT64AdvertiseV4,
+	// NAT64AdvertiseV6 or NAT64AdvertiseBoth. Empty value disables detection.
+	Advertise string `cfg:"advertise"`
+
+	// prefixes is parsed Prefixes
+	prefixes []netip.Prefix
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (o NAT64Options) Validate(logger *log.Logger) (validOptions NAT64Options) {
+	validOptions = o
+	switch o.Advertise {
+	case "":
+		return
+	case NAT64AdvertiseV4, NAT64AdvertiseV6, NAT64AdvertiseBoth:
+	default:
+		validOptions.Advertise = NAT64AdvertiseV4
+		logger.Warn().
+			Str("name", "NAT64.Advertise").
+			Str("provided", o.Advertise).
+			Str("default", validOptions.Advertise).
+			Msg("falling back to default configuration")
+	}
+	prefixes := o.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = WellKnownNAT64Prefixes
+	}
+	validOptions.prefixes = make([]netip.Prefix, 0, len(prefixes))
+	for _, s := range prefixes {
+		pr, err := netip.ParsePrefix(s)
+		if err == nil && pr.Addr().Is6() && !pr.Addr().Is4In6() {
+			switch pr.Bits() {
+			case 32, 40, 48, 56, 64, 96:
+				validOptions.prefixes = append(validOptions.prefixes, pr.Masked())
+				continue
+			}
+		}
+		logger.Warn().Err(err).Str("prefix", s).Msg("ignoring invalid NAT64 prefix")
+	}
+	// the longest prefix is matched first
+	slices.SortFunc(validOptions.prefixes, func(a, b netip.Prefix) int {
+		return b.Bits() - a.Bits()
+	})
+	return
+}
+
+// Enabled returns true if detection of NAT64 addresses is enabled
+func (o NAT64Options) Enabled() bool {
+	return len(o.Advertise) > 0 && len(o.prefixes) > 0
+}
+
+// Embedded returns IPv4 address embedded into addr (RFC 6052)
+// if addr belongs to any of NAT64 prefixes.
+func (o NAT64Options) Embedded(addr netip.Addr) (netip.Addr, bool) {
+	if !addr.Is6() || addr.Is4In6() {
+		return netip.Addr{}, false
+	}
+	for _, pr := range o.prefixes {
+		if pr.Contains(addr) {
+			a := addr.As16()
+			var v4 [4]byte
+			off := pr.Bits() / 8
+			for i := range v4 {
+				// bits 64-71 (octet `u`) are reserved
+				if off == 8 {
+					off++
+				}
+				v4[i] = a[off]
+				off++
+			}
+			return netip.AddrFrom4(v4), true
+		}
+	}
+	return netip.Addr{}, false
+}
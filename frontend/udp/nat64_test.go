@@ -0,0 +1,69 @@
+package udp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/frontend"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func TestNAT64Embedded(t *testing.T) {
+	o := NAT64Options{
+		Advertise: NAT64AdvertiseV4,
+		Prefixes:  []string{"64:ff9b::/96", "2001:db8:100::/40", "2001:db8:122:344::/64", "2001:db8::/32", "1.2.3.0/24", "invalid"},
+	}.Validate(log.NewLogger("test"))
+	require.True(t, o.Enabled())
+	require.Len(t, o.prefixes, 4)
+	for addr, expected := range map[string]string{
+		// RFC 6052 2.4 examples of 192.0.2.33
+		"64:ff9b::192.0.2.33":          "192.0.2.33",
+		"2001:db8:1c0:2:21::":          "192.0.2.33",
+		"2001:db8:122:344:c0:2:2100::": "192.0.2.33",
+		"2001:db8:c000:221::":          "192.0.2.33",
+	} {
+		v4, ok := o.Embedded(netip.MustParseAddr(addr))
+		require.True(t, ok, addr)
+		require.Equal(t, expected, v4.String(), addr)
+	}
+	for _, addr := range []string{"2001:db9::1", "192.0.2.33", "::ffff:192.0.2.33"} {
+		_, ok := o.Embedded(netip.MustParseAddr(addr))
+		require.False(t, ok, addr)
+	}
+
+	require.False(t, NAT64Options{}.Validate(log.NewLogger("test")).Enabled())
+	o = NAT64Options{Advertise: "invalid"}.Validate(log.NewLogger("test"))
+	require.Equal(t, NAT64AdvertiseV4, o.Advertise)
+	require.Len(t, o.prefixes, len(WellKnownNAT64Prefixes))
+}
+
+func TestNAT64ParseAnnounce(t *testing.T) {
+	packet := make([]byte, 98)
+	copy(packet[16:], bytes.Repeat([]byte{1}, 40))
+	packet[83], packet[97] = 2, 0xe1
+	source, embedded := netip.MustParseAddr("64:ff9b::203.0.113.1"), netip.MustParseAddr("203.0.113.1")
+
+	for advertise, expected := range map[string][]netip.Addr{
+		NAT64AdvertiseV4:   {embedded},
+		NAT64AdvertiseV6:   {source},
+		NAT64AdvertiseBoth: {embedded, source},
+	} {
+		f := &udpFE{
+			ParseOptions: frontend.ParseOptions{MaxNumWant: 50, DefaultNumWant: 50},
+			nat64:        NAT64Options{Advertise: advertise}.Validate(log.NewLogger("test")),
+		}
+		clientIP, nat64 := f.nat64.Embedded(source)
+		require.True(t, nat64)
+		req, err := f.parseAnnounce(Request{Packet: packet, IP: source}, clientIP, nat64, false)
+		require.Nil(t, err)
+		var addrs []netip.Addr
+		for _, a := range req.RequestAddresses {
+			addrs = append(addrs, a.Addr)
+		}
+		require.ElementsMatch(t, expected, addrs, advertise)
+		require.Equal(t, expected[0], req.GetFirst(), advertise)
+	}
+}
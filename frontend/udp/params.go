@@ -8,16 +8,27 @@ import (
 	"github.com/rs/zerolog"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/privacy"
 	"github.com/sot-tech/mochi/pkg/str2bytes"
 )
 
 // ErrInvalidQueryEscape is returned when a query string contains invalid
 // escapes.
-var ErrInvalidQueryEscape = bittorrent.ClientError("invalid query escape")
+var ErrInvalidQueryEscape = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "invalid query escape")
+
+// addressParams are query parameters, which may contain peer's address
+var addressParams = map[string]bool{
+	"ip":   true,
+	"ipv4": true,
+	"ipv6": true,
+}
 
 // queryParams parses a URL Query and implements the Params interface
 type queryParams struct {
-	params map[string]string
+	params  map[string]string
+	options []bittorrent.Option
+	// path is the path part of URLData, used to match virtual tracker
+	path string
 }
 
 // parseQuery parses a request URL or UDP URLData as defined in BEP41.
@@ -36,14 +47,18 @@ type queryParams struct {
 // ClientError, as this method is expected to be used to parse client-provided
 // data.
 func parseQuery(query []byte) (q *queryParams, err error) {
+	var urlPath []byte
 	queryDelim := bytes.IndexRune(query, '?')
 	if queryDelim != -1 {
-		query = query[queryDelim+1:]
+		urlPath, query = query[:queryDelim], query[queryDelim+1:]
+	} else if len(query) > 0 && query[0] == '/' {
+		urlPath, query = query, nil
 	}
 	// This is basically url.ParseQuery, but with a map[string]string
 	// instead of map[string][]string for the values.
 	q = &queryParams{
 		params: make(map[string]string),
+		path:   string(urlPath),
 	}
 
 	for len(query) > 0 {
@@ -91,9 +106,27 @@ func (qp queryParams) GetString(key string) (string, bool) {
 	return value, ok
 }
 
+// Extra returns copy of all parsed parameters, because
+// UDP frontend does not parse any of them into request fields.
+func (qp queryParams) Extra() map[string]string {
+	out := make(map[string]string, len(qp.params))
+	for k, v := range qp.params {
+		out[k] = v
+	}
+	return out
+}
+
+// Options returns BEP41 options, which are not handled by frontend
+func (qp queryParams) Options() []bittorrent.Option {
+	return qp.options
+}
+
 // MarshalZerologObject writes fields into zerolog event
 func (qp queryParams) MarshalZerologObject(e *zerolog.Event) {
 	for k, v := range qp.params {
+		if addressParams[k] {
+			v = privacy.ParseString(v)
+		}
 		e.Str(k, v)
 	}
 }
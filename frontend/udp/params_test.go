@@ -125,3 +125,34 @@ func BenchmarkURLParseQuery(b *testing.B) {
 		}
 	}
 }
+
+func FuzzParseQuery(f *testing.F) {
+	for _, q := range shouldNotPanicQueries {
+		f.Add(q)
+	}
+	for _, v := range ValidAnnounceArguments {
+		f.Add([]byte("/announce?" + v.Encode()))
+	}
+	f.Fuzz(func(t *testing.T, query []byte) {
+		q, err := parseQuery(query)
+		if err == nil && q == nil {
+			t.Fatal("expected query or error")
+		}
+	})
+}
+
+func TestParseURLDataPath(t *testing.T) {
+	for query, expected := range map[string]string{
+		"/t1/announce?auth=1": "/t1/announce",
+		"/t1":                 "/t1",
+		"?auth=1":             "",
+	} {
+		parsedQuery, err := parseQuery([]byte(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsedQuery.path != expected {
+			t.Fatalf("Incorrect path of %s: %s, expected: %s", query, parsedQuery.path, expected)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package udp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -33,20 +34,21 @@ var (
 	// initialConnectionID is the magic initial connection ID specified by BEP 15.
 	initialConnectionID = []byte{0, 0, 0x04, 0x17, 0x27, 0x10, 0x19, 0x80}
 
-	// eventIDs map values described in BEP 15 to Events.
+	// eventIDs map values described in BEP 15 and BEP 21 to Events.
 	eventIDs = []bittorrent.Event{
 		bittorrent.None,
 		bittorrent.Completed,
 		bittorrent.Started,
 		bittorrent.Stopped,
+		// BEP 21
+		bittorrent.Paused,
 	}
 
-	errMalformedPacket   = bittorrent.ClientError("malformed packet")
-	errUnknownAction     = bittorrent.ClientError("unknown action ID")
-	errBadConnectionID   = bittorrent.ClientError("bad connection ID")
-	errUnknownOptionType = bittorrent.ClientError("unknown option type")
-	errInvalidInfoHash   = bittorrent.ClientError("invalid info hash")
-	errInvalidPeerID     = bittorrent.ClientError("invalid info hash")
+	errMalformedPacket = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "malformed packet")
+	errUnknownAction   = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "unknown action ID")
+	errBadConnectionID = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "bad connection ID")
+	errInvalidInfoHash = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "invalid info hash")
+	errInvalidPeerID   = bittorrent.NewClientError(bittorrent.ReasonBadRequest, "invalid info hash")
 
 	reqRespBufferPool = bytepool.NewBufferPool()
 )
@@ -69,8 +71,8 @@ func parseAnnounce(r Request, v6Action bool, opts frontend.ParseOptions) (*bitto
 
 	request := new(bittorrent.AnnounceRequest)
 
-	// XXX: pure V2 hashes will cause invalid parsing,
-	// but BEP-52 says, that V2 hashes SHOULD be truncated
+	// UDP packet has room only for 20 bytes, so V2 clients send
+	// truncated hash (BEP 52), which addresses the same swarm as full V2 hash
 	request.InfoHash, err = bittorrent.NewInfoHash(r.Packet[16:36])
 	if err != nil {
 		return nil, errInvalidInfoHash
@@ -92,13 +94,16 @@ func parseAnnounce(r Request, v6Action bool, opts frontend.ParseOptions) (*bitto
 	request.Event, request.EventProvided = eventIDs[eventID], true
 
 	request.Add(bittorrent.RequestAddress{Addr: r.IP})
-	if opts.AllowIPSpoofing {
+	if opts.SpoofingAllowed(r.IP) {
 		if spoofed, ok := netip.AddrFromSlice(r.Packet[84:ipEnd]); ok {
 			request.Add(bittorrent.RequestAddress{Addr: spoofed, Provided: true})
 		}
 	}
 
-	request.NumWant, request.NumWantProvided = binary.BigEndian.Uint32(r.Packet[ipEnd+4:ipEnd+8]), true
+	// num_want is signed, -1 (default) and other negative values mean default number of peers
+	if n := int32(binary.BigEndian.Uint32(r.Packet[ipEnd+4 : ipEnd+8])); n >= 0 {
+		request.NumWant, request.NumWantProvided = uint32(n), true
+	}
 	request.Port = binary.BigEndian.Uint16(r.Packet[ipEnd+8 : ipEnd+10])
 	request.Params, err = handleOptionalParameters(r.Packet[ipEnd+10:])
 	if err != nil {
@@ -114,6 +119,8 @@ func parseAnnounce(r Request, v6Action bool, opts frontend.ParseOptions) (*bitto
 
 // handleOptionalParameters parses the optional parameters as described in BEP
 // 41 and updates an announce with the values parsed.
+// Options of unknown types are not parsed, but available via Options method of
+// returned bittorrent.Params.
 func handleOptionalParameters(packet []byte) (bittorrent.Params, error) {
 	if len(packet) == 0 {
 		return parseQuery(nil)
@@ -122,14 +129,23 @@ func handleOptionalParameters(packet []byte) (bittorrent.Params, error) {
 	buf := reqRespBufferPool.Get()
 	defer reqRespBufferPool.Put(buf)
 
+	var options []bittorrent.Option
+	parse := func() (bittorrent.Params, error) {
+		q, err := parseQuery(buf.Bytes())
+		if err == nil {
+			q.options = options
+		}
+		return q, err
+	}
+
 	for i := 0; i < len(packet); {
 		option := packet[i]
 		switch option {
 		case optionEndOfOptions:
-			return parseQuery(buf.Bytes())
+			return parse()
 		case optionNOP:
 			i++
-		case optionURLData:
+		default:
 			if i+1 >= len(packet) {
 				return nil, errMalformedPacket
 			}
@@ -139,21 +155,24 @@ func handleOptionalParameters(packet []byte) (bittorrent.Params, error) {
 				return nil, errMalformedPacket
 			}
 
-			n, err := buf.Write(packet[i+2 : i+2+length])
-			if err != nil {
-				return nil, err
-			}
-			if n != length {
-				return nil, fmt.Errorf("expected to write %d bytes, wrote %d", length, n)
+			value := packet[i+2 : i+2+length]
+			if option == optionURLData {
+				n, err := buf.Write(value)
+				if err != nil {
+					return nil, err
+				}
+				if n != length {
+					return nil, fmt.Errorf("expected to write %d bytes, wrote %d", length, n)
+				}
+			} else {
+				options = append(options, bittorrent.Option{Type: option, Value: bytes.Clone(value)})
 			}
 
 			i += 2 + length
-		default:
-			return nil, errUnknownOptionType
 		}
 	}
 
-	return parseQuery(buf.Bytes())
+	return parse()
 }
 
 // parseScrape parses a ScrapeRequest from a UDP request.
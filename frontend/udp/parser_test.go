@@ -1,9 +1,15 @@
 package udp
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"net/netip"
+	"reflect"
 	"testing"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/frontend"
 )
 
 var table = []struct {
@@ -75,3 +81,134 @@ func TestHandleOptionalParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestParseScrapeHybrid(t *testing.T) {
+	v1 := bytes.Repeat([]byte{1}, bittorrent.InfoHashV1Len)
+	v2 := bytes.Repeat([]byte{2}, bittorrent.InfoHashV2Len)
+	packet := append(make([]byte, 16), v1...)
+	// V2 hash truncated by client
+	packet = append(packet, v2[:bittorrent.InfoHashV1Len]...)
+
+	req, err := parseScrape(Request{Packet: packet, IP: netip.MustParseAddr("1.2.3.4")}, frontend.ParseOptions{MaxScrapeInfoHashes: 10})
+	if err != nil {
+		t.Fatalf("expected no parsing error but got %s", err)
+	}
+	if len(req.InfoHashes) != 2 {
+		t.Fatalf("expected 2 info hashes but got %d", len(req.InfoHashes))
+	}
+	if req.InfoHashes[0] != bittorrent.InfoHash(v1) {
+		t.Fatalf("expected info hash %x but got %s", v1, req.InfoHashes[0])
+	}
+	if req.InfoHashes[1] != bittorrent.InfoHash(v2).TruncateV1() {
+		t.Fatalf("expected truncated info hash %x but got %s", v2[:bittorrent.InfoHashV1Len], req.InfoHashes[1])
+	}
+
+	// full V2 hash does not fit into the list of 20-byte hashes
+	packet = append(make([]byte, 16), v2...)
+	if _, err = parseScrape(Request{Packet: packet, IP: netip.MustParseAddr("1.2.3.4")}, frontend.ParseOptions{}); !errors.Is(err, errMalformedPacket) {
+		t.Fatalf("expected parsing error for %x", packet)
+	}
+}
+
+func TestHandleUnknownOptions(t *testing.T) {
+	params, err := handleOptionalParameters([]byte{0x2, 0x5, '/', '?', 'a', '=', 'b', 0x10, 0x2, 'x', 'y', 0x1, 0x11, 0x0, 0x0})
+	if err != nil {
+		t.Fatalf("expected no parsing error but got %s", err)
+	}
+	req := &bittorrent.AnnounceRequest{Params: params}
+	if extra := req.ExtraParams(); len(extra) != 1 || extra["a"] != "b" {
+		t.Fatalf("expected extra params map[a:b], but got %v", extra)
+	}
+	expected := []bittorrent.Option{{Type: 0x10, Value: []byte("xy")}, {Type: 0x11, Value: []byte{}}}
+	if options := req.Options(); !reflect.DeepEqual(expected, options) {
+		t.Fatalf("expected options %v, but got %v", expected, options)
+	}
+
+	if _, err = handleOptionalParameters([]byte{0x10, 0x5, 'x'}); !errors.Is(err, errMalformedPacket) {
+		t.Fatalf("expected parsing error, but got %v", err)
+	}
+}
+
+func TestParseAnnounceNumWant(t *testing.T) {
+	opts := frontend.ParseOptions{MaxNumWant: 50, DefaultNumWant: 30}
+	for _, tt := range []struct {
+		numWant  []byte
+		expected uint32
+	}{
+		{[]byte{0, 0, 0, 10}, 10},
+		{[]byte{0, 0, 0, 0}, 0},
+		{[]byte{0, 0, 1, 0}, 50},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, 30},
+		{[]byte{0x80, 0, 0, 0}, 30},
+	} {
+		packet := make([]byte, 98)
+		copy(packet[16:], bytes.Repeat([]byte{1}, 40))
+		packet[83], packet[97] = 2, 0xe1
+		copy(packet[92:], tt.numWant)
+		req, err := parseAnnounce(Request{Packet: packet, IP: netip.MustParseAddr("1.2.3.4")}, false, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.NumWant != tt.expected {
+			t.Fatalf("num want %v: expected %d, got %d", tt.numWant, tt.expected, req.NumWant)
+		}
+	}
+}
+
+func FuzzParseAnnounce(f *testing.F) {
+	packet := make([]byte, 98)
+	copy(packet[16:], bytes.Repeat([]byte{1}, 40))
+	packet[83], packet[97] = 2, 0xe1
+	f.Add(packet, false)
+	f.Add(append(packet[:98:98], 0x2, 0x5, '/', '?', 'a', '=', 'b', 0x1), false)
+	f.Add(make([]byte, 110), true)
+	opts := frontend.ParseOptions{AllowIPSpoofing: true, MaxNumWant: 50, DefaultNumWant: 50}
+	f.Fuzz(func(t *testing.T, packet []byte, v6Action bool) {
+		req, err := parseAnnounce(Request{Packet: packet, IP: netip.MustParseAddr("1.2.3.4")}, v6Action, opts)
+		if err != nil {
+			if req != nil {
+				t.Fatalf("expected no request on error %s", err)
+			}
+			return
+		}
+		if len(req.InfoHash) != bittorrent.InfoHashV1Len {
+			t.Fatalf("unexpected info hash length %d", len(req.InfoHash))
+		}
+		if req.Port == 0 || req.NumWant > opts.MaxNumWant || len(req.RequestAddresses) == 0 {
+			t.Fatalf("request is not sanitized: %+v", req)
+		}
+	})
+}
+
+func FuzzParseScrape(f *testing.F) {
+	f.Add(append(make([]byte, 16), bytes.Repeat([]byte{1}, 40)...))
+	f.Add(make([]byte, 16+bittorrent.InfoHashV2Len))
+	opts := frontend.ParseOptions{MaxScrapeInfoHashes: 10}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		req, err := parseScrape(Request{Packet: packet, IP: netip.MustParseAddr("1.2.3.4")}, opts)
+		if err != nil {
+			return
+		}
+		if len(req.InfoHashes) == 0 || len(req.InfoHashes) > int(opts.MaxScrapeInfoHashes) {
+			t.Fatalf("unexpected number of info hashes %d", len(req.InfoHashes))
+		}
+		for _, ih := range req.InfoHashes {
+			if len(ih) != bittorrent.InfoHashV1Len {
+				t.Fatalf("unexpected info hash length %d", len(ih))
+			}
+		}
+	})
+}
+
+func FuzzHandleOptionalParameters(f *testing.F) {
+	for _, tt := range table {
+		f.Add(tt.data)
+	}
+	f.Add([]byte{0x2, 0x5, '/', '?', 'a', '=', 'b', 0x10, 0x2, 'x', 'y', 0x1, 0x11, 0x0, 0x0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		params, err := handleOptionalParameters(data)
+		if err == nil && params == nil {
+			t.Fatal("expected params or error")
+		}
+	})
+}
@@ -12,9 +12,18 @@ import (
 )
 
 func init() {
-	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(promResponseDurationMilliseconds, promGenerators, promRejections)
 }
 
+// promRejections is the number of requests rejected with error by reason
+var promRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_udp_rejections_total",
+		Help: "The number of requests rejected with error by machine-readable reason",
+	},
+	[]string{"action", "reason"},
+)
+
 var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
 		Name:    "mochi_udp_response_duration_milliseconds",
@@ -24,6 +33,21 @@ var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	[]string{"action", "address_family", "error"},
 )
 
+// Events of connection ID generators
+const (
+	generatorHit     = "hit"
+	generatorMiss    = "miss"
+	generatorCreated = "created"
+)
+
+var promGenerators = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_udp_connection_id_generators_total",
+		Help: "The number of connection ID generators taken from pool (hit), not found in pool (miss) and created",
+	},
+	[]string{"event"},
+)
+
 // recordResponseDuration records the duration of time to respond to a UDP
 // Request in milliseconds.
 func recordResponseDuration(action string, addr netip.Addr, err error, duration time.Duration) {
@@ -41,3 +65,17 @@ func recordResponseDuration(action string, addr netip.Addr, err error, duration
 		WithLabelValues(action, metrics.AddressFamily(addr), errString).
 		Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
 }
+
+// recordGenerator records event of connection ID generator
+func recordGenerator(event string) {
+	if metrics.Enabled() {
+		promGenerators.WithLabelValues(event).Inc()
+	}
+}
+
+// recordRejection counts request rejected with err, if err is not nil
+func recordRejection(action string, err error) {
+	if err != nil && metrics.Enabled() {
+		promRejections.WithLabelValues(action, bittorrent.RejectReason(err)).Inc()
+	}
+}
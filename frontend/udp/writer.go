@@ -2,29 +2,47 @@ package udp
 
 import (
 	"encoding/binary"
-	"errors"
 	"io"
+	"net"
+	"net/netip"
 	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/bytepool"
 )
 
+const (
+	headerLen         = 8
+	announceHeaderLen = headerLen + 12
+	compactPeerV6Len  = net.IPv6len + 2
+	scrapeEntryLen    = 12
+	// errorMessageLen is the reserved space for failure reason,
+	// longer messages cause buffer to grow
+	errorMessageLen = 256
+)
+
+// newResponsePool creates pool of buffers, which fit the largest
+// response (announce with maxNumWant IPv6 peers, scrape with
+// maxScrapeInfoHashes entries or error), so that serialization
+// does not reallocate memory.
+func newResponsePool(maxNumWant, maxScrapeInfoHashes uint32) *bytepool.BytePool {
+	l := max(announceHeaderLen+compactPeerV6Len*int(maxNumWant)+net.IPv6len,
+		headerLen+scrapeEntryLen*int(maxScrapeInfoHashes),
+		headerLen+errorMessageLen)
+	return bytepool.NewBytePool(l)
+}
+
 // writeErrorResponse writes the failure reason as a null-terminated string.
-func writeErrorResponse(w io.Writer, txID []byte, err error) {
-	buf := reqRespBufferPool.Get()
-	defer reqRespBufferPool.Put(buf)
-	writeHeader(buf, txID, errorActionID)
-	message := "mochi internal error"
-	var clientErr bittorrent.ClientError
+func writeErrorResponse(w io.Writer, buf []byte, txID []byte, reqID string, err error) {
+	buf = appendHeader(buf, txID, errorActionID)
 	// If the client wasn't at fault, acknowledge it.
-	if errors.As(err, &clientErr) {
-		message = clientErr.Error()
-	} else {
-		logger.Error().Err(err).Msg("internal error")
+	_, message, isClient := bittorrent.ClientMessage(err)
+	if !isClient {
+		logger.Error().Err(err).Str("requestID", reqID).Msg("internal error")
 	}
-	buf.WriteString(message)
-	buf.WriteByte('\000')
-	_, _ = buf.WriteTo(w)
+	buf = append(buf, message...)
+	buf = append(buf, 0)
+	_, _ = w.Write(buf)
 }
 
 // writeAnnounceResponse encodes an announce response according to BEP 15.
@@ -32,60 +50,82 @@ func writeErrorResponse(w io.Writer, txID []byte, err error) {
 // whether v6Peers is set.
 // If v6Action is set, the action will be 4, according to
 // https://web.archive.org/web/20170503181830/http://opentracker.blog.h3q.com/2007/12/28/the-ipv6-situation/
-func writeAnnounceResponse(w io.Writer, txID []byte, resp *bittorrent.AnnounceResponse, v6Action, v6Peers bool) {
-	buf := reqRespBufferPool.Get()
-	defer reqRespBufferPool.Put(buf)
+// BEP 15 does not define warning message field, so resp.WarningMessage
+// is only logged.
+// If externalIP is valid, it is appended after peers: 4 bytes in IPv4 response
+// or 16 bytes (IPv4 is mapped) in IPv6 response. Trailer is shorter than peer entry,
+// so clients, which determine the number of peers by packet length, ignore it.
+// Fields of leechers and seeders are mandatory, so they are zero if omitCounts set.
+func writeAnnounceResponse(w io.Writer, buf []byte, txID []byte, resp *bittorrent.AnnounceResponse, v6Action, v6Peers, omitCounts bool, externalIP netip.Addr) {
+	if len(resp.WarningMessage) > 0 {
+		sampledLogger.Debug("warning message").Str("warningMessage", resp.WarningMessage).Msg("warning message not supported by UDP protocol")
+	}
 
 	if v6Action {
-		writeHeader(buf, txID, announceV6ActionID)
+		buf = appendHeader(buf, txID, announceV6ActionID)
 	} else {
-		writeHeader(buf, txID, announceActionID)
+		buf = appendHeader(buf, txID, announceActionID)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(resp.Interval/time.Second))
+	if omitCounts {
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	} else {
+		buf = binary.BigEndian.AppendUint32(buf, resp.Incomplete)
+		buf = binary.BigEndian.AppendUint32(buf, resp.Complete)
 	}
-	_ = binary.Write(buf, binary.BigEndian, uint32(resp.Interval/time.Second))
-	_ = binary.Write(buf, binary.BigEndian, resp.Incomplete)
-	_ = binary.Write(buf, binary.BigEndian, resp.Complete)
 
-	peers := resp.IPv4Peers
 	if v6Peers {
-		peers = resp.IPv6Peers
+		for _, peer := range resp.IPv6Peers {
+			ip := peer.Addr().As16()
+			buf = binary.BigEndian.AppendUint16(append(buf, ip[:]...), peer.Port())
+		}
+	} else {
+		for _, peer := range resp.IPv4Peers {
+			ip := peer.Addr().As4()
+			buf = binary.BigEndian.AppendUint16(append(buf, ip[:]...), peer.Port())
+		}
 	}
 
-	for _, peer := range peers {
-		buf.Write(peer.Addr().AsSlice())
-		_ = binary.Write(buf, binary.BigEndian, peer.Port())
+	if externalIP.IsValid() {
+		if v6Peers {
+			ip := externalIP.As16()
+			buf = append(buf, ip[:]...)
+		} else if externalIP.Is4() {
+			ip := externalIP.As4()
+			buf = append(buf, ip[:]...)
+		}
 	}
 
-	_, _ = buf.WriteTo(w)
+	_, _ = w.Write(buf)
 }
 
 // writeScrapeResponse encodes a scrape response according to BEP 15.
-func writeScrapeResponse(w io.Writer, txID []byte, resp *bittorrent.ScrapeResponse) {
-	buf := reqRespBufferPool.Get()
-	defer reqRespBufferPool.Put(buf)
-
-	writeHeader(buf, txID, scrapeActionID)
+// BEP 15 does not define failure of single info hash, so zeroed
+// data is written for rejected hashes.
+func writeScrapeResponse(w io.Writer, buf []byte, txID []byte, resp *bittorrent.ScrapeResponse) {
+	buf = appendHeader(buf, txID, scrapeActionID)
 
 	for _, scrape := range resp.Data {
-		_ = binary.Write(buf, binary.BigEndian, scrape.Complete)
-		_ = binary.Write(buf, binary.BigEndian, scrape.Snatches)
-		_ = binary.Write(buf, binary.BigEndian, scrape.Incomplete)
+		if scrape.Failure != nil {
+			buf = append(buf, make([]byte, scrapeEntryLen)...)
+			continue
+		}
+		buf = binary.BigEndian.AppendUint32(buf, scrape.Complete)
+		buf = binary.BigEndian.AppendUint32(buf, scrape.Snatches)
+		buf = binary.BigEndian.AppendUint32(buf, scrape.Incomplete)
 	}
-	_, _ = buf.WriteTo(w)
+	_, _ = w.Write(buf)
 }
 
 // writeConnectionID encodes a new connection response according to BEP 15.
-func writeConnectionID(w io.Writer, txID, connID []byte) {
-	buf := reqRespBufferPool.Get()
-	defer reqRespBufferPool.Put(buf)
-
-	writeHeader(buf, txID, connectActionID)
-	buf.Write(connID)
-	_, _ = buf.WriteTo(w)
+func writeConnectionID(w io.Writer, buf []byte, txID, connID []byte) {
+	buf = appendHeader(buf, txID, connectActionID)
+	buf = append(buf, connID...)
+	_, _ = w.Write(buf)
 }
 
-// writeHeader writes the action and transaction ID to the provided response
+// appendHeader appends the action and transaction ID to the provided response
 // buffer.
-func writeHeader(w io.Writer, txID []byte, action uint32) {
-	_ = binary.Write(w, binary.BigEndian, action)
-	_, _ = w.Write(txID)
+func appendHeader(buf []byte, txID []byte, action uint32) []byte {
+	return append(binary.BigEndian.AppendUint32(buf, action), txID...)
 }
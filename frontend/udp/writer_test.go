@@ -0,0 +1,138 @@
+package udp
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+var testTxID = []byte{0xde, 0xad, 0xbe, 0xef}
+
+func testAnnounceResponse(peers int) *bittorrent.AnnounceResponse {
+	resp := &bittorrent.AnnounceResponse{Complete: 2, Incomplete: 3, Interval: 30 * time.Minute}
+	for i := 0; i < peers; i++ {
+		resp.IPv4Peers = append(resp.IPv4Peers, bittorrent.Peer{
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881),
+		})
+		resp.IPv6Peers = append(resp.IPv6Peers, bittorrent.Peer{
+			AddrPort: netip.AddrPortFrom(netip.AddrFrom16([16]byte{0x20, 0x01, 14: byte(i >> 8), 15: byte(i)}), 6881),
+		})
+	}
+	return resp
+}
+
+func TestWriteAnnounceResponse(t *testing.T) {
+	resp := testAnnounceResponse(1)
+	header := []byte{
+		0, 0, 0, 1, 0xde, 0xad, 0xbe, 0xef,
+		0, 0, 0x07, 0x08, 0, 0, 0, 3, 0, 0, 0, 2,
+	}
+	var w bytes.Buffer
+	writeAnnounceResponse(&w, nil, testTxID, resp, false, false, false, netip.Addr{})
+	if expected := append(bytes.Clone(header), 10, 0, 0, 0, 0x1a, 0xe1); !bytes.Equal(expected, w.Bytes()) {
+		t.Fatalf("expected %v, got %v", expected, w.Bytes())
+	}
+
+	w.Reset()
+	writeAnnounceResponse(&w, nil, testTxID, resp, true, true, false, netip.Addr{})
+	header[3] = byte(announceV6ActionID)
+	expected := append(bytes.Clone(header), 0x20, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x1a, 0xe1)
+	if !bytes.Equal(expected, w.Bytes()) {
+		t.Fatalf("expected %v, got %v", expected, w.Bytes())
+	}
+}
+
+func TestWriteAnnounceOmitCounts(t *testing.T) {
+	resp := testAnnounceResponse(1)
+	var w bytes.Buffer
+	writeAnnounceResponse(&w, nil, testTxID, resp, false, false, true, netip.Addr{})
+	if b := w.Bytes(); len(b) != announceHeaderLen+6 || !bytes.Equal(b[12:20], make([]byte, 8)) {
+		t.Fatalf("unexpected response %v", b)
+	}
+}
+
+func TestWriteAnnounceExternalIP(t *testing.T) {
+	resp := testAnnounceResponse(1)
+	var w bytes.Buffer
+	writeAnnounceResponse(&w, nil, testTxID, resp, false, false, false, netip.MustParseAddr("1.2.3.4"))
+	if b := w.Bytes(); len(b) != announceHeaderLen+6+4 || !bytes.Equal(b[len(b)-4:], []byte{1, 2, 3, 4}) {
+		t.Fatalf("unexpected response %v", b)
+	}
+
+	w.Reset()
+	writeAnnounceResponse(&w, nil, testTxID, resp, true, true, false, netip.MustParseAddr("1.2.3.4"))
+	if b := w.Bytes(); len(b) != announceHeaderLen+compactPeerV6Len+16 || !bytes.Equal(b[len(b)-6:], []byte{0xff, 0xff, 1, 2, 3, 4}) {
+		t.Fatalf("unexpected response %v", b)
+	}
+
+	// IPv6 address does not fit IPv4 response
+	w.Reset()
+	writeAnnounceResponse(&w, nil, testTxID, resp, false, false, false, netip.MustParseAddr("2001:db8::1"))
+	if l := w.Len(); l != announceHeaderLen+6 {
+		t.Fatalf("unexpected response length %d", l)
+	}
+}
+
+func TestWriteScrapeResponse(t *testing.T) {
+	var w bytes.Buffer
+	writeScrapeResponse(&w, nil, testTxID, &bittorrent.ScrapeResponse{Data: bittorrent.Scrapes{
+		{Complete: 1, Snatches: 2, Incomplete: 3},
+	}})
+	expected := []byte{0, 0, 0, 2, 0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}
+	if !bytes.Equal(expected, w.Bytes()) {
+		t.Fatalf("expected %v, got %v", expected, w.Bytes())
+	}
+}
+
+func TestWriteErrorResponse(t *testing.T) {
+	var w bytes.Buffer
+	writeErrorResponse(&w, nil, testTxID, "", errMalformedPacket)
+	expected := append([]byte{0, 0, 0, 3, 0xde, 0xad, 0xbe, 0xef}, "malformed packet\000"...)
+	if !bytes.Equal(expected, w.Bytes()) {
+		t.Fatalf("expected %q, got %q", expected, w.Bytes())
+	}
+}
+
+func TestWriteAllocations(t *testing.T) {
+	if testing.CoverMode() != "" {
+		t.Skip("coverage instrumentation affects allocations")
+	}
+	pool := newResponsePool(100, 50)
+	aResp := testAnnounceResponse(100)
+	sResp := &bittorrent.ScrapeResponse{Data: make(bittorrent.Scrapes, 50)}
+	for name, fn := range map[string]func(buf []byte){
+		"announce": func(buf []byte) {
+			writeAnnounceResponse(io.Discard, buf, testTxID, aResp, false, false, false, netip.Addr{})
+		},
+		"announce v6": func(buf []byte) {
+			writeAnnounceResponse(io.Discard, buf, testTxID, aResp, true, true, false, netip.Addr{})
+		},
+		"scrape":  func(buf []byte) { writeScrapeResponse(io.Discard, buf, testTxID, sResp) },
+		"connect": func(buf []byte) { writeConnectionID(io.Discard, buf, testTxID, initialConnectionID) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			if allocs := testing.AllocsPerRun(100, func() {
+				buf := pool.Get()
+				fn((*buf)[:0])
+				pool.Put(buf)
+			}); allocs != 0 {
+				t.Fatalf("expected no allocations, got %v", allocs)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteAnnounceResponse(b *testing.B) {
+	pool := newResponsePool(100, 50)
+	resp := testAnnounceResponse(50)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := pool.Get()
+		writeAnnounceResponse(io.Discard, (*buf)[:0], testTxID, resp, false, false, false, netip.Addr{})
+		pool.Put(buf)
+	}
+}
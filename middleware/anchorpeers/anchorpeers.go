@@ -0,0 +1,144 @@
+// Package anchorpeers implements a Hook that places configured
+// always-available peers (i.e. operator's seedboxes) at the
+// beginning of announce response, before peers from storage.
+package anchorpeers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "anchor peers"
+
+var errNoPeers = errors.New("neither peers nor torrents provided")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Torrent holds anchor peers of specific torrent
+type Torrent struct {
+	// InfoHash HEX-encoded info hash
+	InfoHash string `cfg:"info_hash"`
+	// Peers list of addresses in `ip:port` form
+	Peers []string `cfg:"peers"`
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Peers list of addresses in `ip:port` form,
+	// which are returned for all torrents.
+	Peers []string `cfg:"peers"`
+	// Torrents list of anchor peers of specific torrents,
+	// returned before global Peers.
+	Torrents []Torrent `cfg:"torrents"`
+	// IncludeSeeders if true, anchor peers are returned to seeders too.
+	IncludeSeeders bool `cfg:"include_seeders"`
+}
+
+func parsePeers(addrs []string) ([]bittorrent.Peer, error) {
+	peers := make([]bittorrent.Peer, 0, len(addrs))
+	for _, a := range addrs {
+		ap, err := netip.ParseAddrPort(a)
+		if err != nil {
+			return nil, err
+		}
+		if ap.Port() == 0 {
+			return nil, fmt.Errorf("%s: port not provided", a)
+		}
+		peers = append(peers, bittorrent.Peer{AddrPort: netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())})
+	}
+	return peers, nil
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if len(cfg.Peers) == 0 && len(cfg.Torrents) == 0 {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errNoPeers)
+	}
+	h := &hook{
+		torrents:       make(map[bittorrent.InfoHash][]bittorrent.Peer, len(cfg.Torrents)),
+		includeSeeders: cfg.IncludeSeeders,
+	}
+	if h.global, err = parsePeers(cfg.Peers); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	for _, t := range cfg.Torrents {
+		var ih bittorrent.InfoHash
+		if ih, err = bittorrent.NewInfoHashString(t.InfoHash); err != nil {
+			return nil, fmt.Errorf("invalid config for middleware %s: %s: %w", Name, t.InfoHash, err)
+		}
+		var peers []bittorrent.Peer
+		if peers, err = parsePeers(t.Peers); err != nil {
+			return nil, fmt.Errorf("invalid config for middleware %s: %s: %w", Name, t.InfoHash, err)
+		}
+		ih = ih.TruncateV1()
+		h.torrents[ih] = append(h.torrents[ih], peers...)
+	}
+	return h, nil
+}
+
+type hook struct {
+	global         []bittorrent.Peer
+	torrents       map[bittorrent.InfoHash][]bittorrent.Peer
+	includeSeeders bool
+}
+
+// RankPeers implements middleware.PeerRanker.
+// It places anchor peers of torrent and global anchor peers before peers
+// returned by storage and truncates response to requested number of peers.
+// Anchor peer is not returned to itself.
+func (h *hook) RankPeers(_ context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if req.Left == 0 && !h.includeSeeders {
+		return peers
+	}
+	torrent := h.torrents[req.InfoHash.TruncateV1()]
+	if len(torrent) == 0 && len(h.global) == 0 {
+		return peers
+	}
+	self := make(map[netip.AddrPort]bool, len(req.Peers()))
+	for _, p := range req.Peers() {
+		self[netip.AddrPortFrom(p.Addr(), p.Port())] = true
+	}
+	out := make([]bittorrent.Peer, 0, len(torrent)+len(h.global)+len(peers))
+	added := make(map[netip.AddrPort]bool, cap(out))
+	for _, anchors := range [][]bittorrent.Peer{torrent, h.global} {
+		for _, p := range anchors {
+			if !self[p.AddrPort] && !added[p.AddrPort] {
+				added[p.AddrPort] = true
+				out = append(out, p)
+			}
+		}
+	}
+	for _, p := range peers {
+		if !added[netip.AddrPortFrom(p.Addr(), p.Port())] {
+			out = append(out, p)
+		}
+	}
+	if l := int(req.NumWant); len(out) > l {
+		out = out[:l]
+	}
+	return out
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Anchor peers are added in RankPeers after storage returned peers.
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't contain peers.
+	return ctx, nil
+}
@@ -0,0 +1,74 @@
+package anchorpeers
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+const ih = "0123456789abcdef0123456789abcdef01234567"
+
+func newPeer(addr string) bittorrent.Peer {
+	return bittorrent.Peer{AddrPort: netip.MustParseAddrPort(addr)}
+}
+
+func newRequest(addr string, left uint64, numWant uint32) *bittorrent.AnnounceRequest {
+	ap := netip.MustParseAddrPort(addr)
+	h, _ := bittorrent.NewInfoHashString(ih)
+	return &bittorrent.AnnounceRequest{
+		InfoHash: h,
+		Left:     left,
+		NumWant:  numWant,
+		RequestPeer: bittorrent.RequestPeer{
+			Port:             ap.Port(),
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: ap.Addr()}},
+		},
+	}
+}
+
+func TestRankPeers(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"peers": []any{"10.0.0.1:6881", "[2001:db8::1]:6881"},
+		"torrents": []any{
+			map[string]any{"info_hash": ih, "peers": []any{"10.0.0.2:6881"}},
+		},
+	}, nil)
+	require.Nil(t, err)
+	pr := h.(middleware.PeerRanker)
+
+	peers := []bittorrent.Peer{newPeer("1.2.3.4:6881"), newPeer("10.0.0.1:6881"), newPeer("5.6.7.8:6881")}
+	out := pr.RankPeers(context.Background(), newRequest("9.9.9.9:6881", 1, 50), peers)
+	require.Equal(t, []bittorrent.Peer{
+		newPeer("10.0.0.2:6881"),
+		newPeer("10.0.0.1:6881"),
+		newPeer("[2001:db8::1]:6881"),
+		newPeer("1.2.3.4:6881"),
+		newPeer("5.6.7.8:6881"),
+	}, out)
+
+	// truncated to numwant, anchor is not returned to itself
+	peers = []bittorrent.Peer{newPeer("1.2.3.4:6881")}
+	out = pr.RankPeers(context.Background(), newRequest("10.0.0.2:6881", 1, 2), peers)
+	require.Equal(t, []bittorrent.Peer{newPeer("10.0.0.1:6881"), newPeer("[2001:db8::1]:6881")}, out)
+
+	// seeders receive only storage peers
+	out = pr.RankPeers(context.Background(), newRequest("9.9.9.9:6881", 0, 50), []bittorrent.Peer{newPeer("1.2.3.4:6881")})
+	require.Equal(t, []bittorrent.Peer{newPeer("1.2.3.4:6881")}, out)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, errNoPeers)
+	_, err = build(conf.MapConfig{"peers": []any{"10.0.0.1"}}, nil)
+	require.NotNil(t, err)
+	_, err = build(conf.MapConfig{"peers": []any{"10.0.0.1:0"}}, nil)
+	require.NotNil(t, err)
+	_, err = build(conf.MapConfig{"torrents": []any{map[string]any{"info_hash": "invalid", "peers": []any{"10.0.0.1:6881"}}}}, nil)
+	require.NotNil(t, err)
+}
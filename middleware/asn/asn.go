@@ -0,0 +1,154 @@
+// Package asn implements a Hook that resolves autonomous system of
+// announcing peer, fails an Announce from blocked autonomous systems
+// and limits number of peers from the same autonomous system in response.
+package asn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "asn"
+
+var (
+	logger = log.NewLogger("middleware/asn")
+
+	// ErrBlockedASN is returned by a middleware if announcing
+	// address belongs to blocked autonomous system.
+	ErrBlockedASN = bittorrent.NewClientError(bittorrent.ReasonBlocked, "announces from your network are not allowed")
+
+	errNoDatabase = errors.New("database not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Database is the path to MaxMind GeoLite2-ASN database file (mmdb).
+	Database string
+	// ReloadInterval is the period between two database file modification checks.
+	// Zero means database is not reloaded.
+	ReloadInterval time.Duration `cfg:"reload_interval"`
+	// BlockedASNs list of autonomous system numbers,
+	// announces from which are rejected.
+	BlockedASNs []uint32 `cfg:"blocked_asns"`
+	// MaxPeersPerASN is the maximum number of peers from the same
+	// autonomous system returned in response. Zero means no limit.
+	MaxPeersPerASN int `cfg:"max_peers_per_asn"`
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if len(cfg.Database) == 0 {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errNoDatabase)
+	}
+	db, err := OpenDatabase(cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("middleware %s: unable to open database: %w", Name, err)
+	}
+	h := &hook{
+		cfg:     cfg,
+		db:      db,
+		blocked: make(map[uint32]bool, len(cfg.BlockedASNs)),
+		closed:  make(chan any),
+	}
+	for _, n := range cfg.BlockedASNs {
+		h.blocked[n] = true
+	}
+	if cfg.ReloadInterval > 0 {
+		go h.runReload()
+	}
+	return h, nil
+}
+
+type hook struct {
+	cfg        Config
+	db         *Database
+	blocked    map[uint32]bool
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// HandleAnnounce places announcer's autonomous system and Database into context
+// and rejects announces from blocked autonomous systems.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	ctx = context.WithValue(ctx, databaseKey{}, h.db)
+	info, found := h.db.Lookup(req.GetFirst())
+	if !found {
+		return ctx, nil
+	}
+	if h.blocked[info.Number] {
+		logger.Debug().
+			Object("source", req.RequestPeer).
+			Uint32("asn", info.Number).
+			Msg("announce from blocked autonomous system")
+		return ctx, ErrBlockedASN
+	}
+	return context.WithValue(ctx, infoKey{}, info), nil
+}
+
+// RankPeers implements middleware.PeerRanker.
+// It drops peers of autonomous systems, which already have
+// MaxPeersPerASN peers in response.
+func (h *hook) RankPeers(_ context.Context, _ *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if h.cfg.MaxPeersPerASN <= 0 {
+		return peers
+	}
+	counts := make(map[uint32]int)
+	out := peers[:0]
+	for _, p := range peers {
+		if info, found := h.db.Lookup(p.Addr()); found {
+			if counts[info.Number] >= h.cfg.MaxPeersPerASN {
+				continue
+			}
+			counts[info.Number]++
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not restricted.
+	return ctx, nil
+}
+
+func (h *hook) runReload() {
+	t := time.NewTicker(h.cfg.ReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			if reloaded, err := h.db.Reload(); err != nil {
+				logger.Error().Err(err).Str("path", h.cfg.Database).Msg("unable to reload database")
+			} else if reloaded {
+				logger.Info().Str("path", h.cfg.Database).Msg("database reloaded")
+			}
+		}
+	}
+}
+
+// Close stops database reloading
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
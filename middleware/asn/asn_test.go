@@ -0,0 +1,89 @@
+package asn
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/mmdb/test"
+)
+
+func writeDatabase(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "asn.mmdb")
+	require.Nil(t, os.WriteFile(path, test.Build("GeoLite2-ASN", map[netip.Prefix]any{
+		netip.MustParsePrefix("1.2.3.0/24"): map[string]any{
+			"autonomous_system_number":       uint32(64500),
+			"autonomous_system_organization": "Example Hosting",
+		},
+		netip.MustParsePrefix("5.6.7.0/24"): map[string]any{
+			"autonomous_system_number":       uint32(64501),
+			"autonomous_system_organization": "Example ISP",
+		},
+	}), 0o600))
+	return path
+}
+
+func newRequest(addr string) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}},
+		},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"database":     writeDatabase(t),
+		"blocked_asns": []any{64500},
+	}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(context.Background(), newRequest("1.2.3.4"), resp)
+	require.Equal(t, ErrBlockedASN, err)
+
+	ctx, err := h.HandleAnnounce(context.Background(), newRequest("5.6.7.8"), resp)
+	require.Nil(t, err)
+	info, found := FromContext(ctx)
+	require.True(t, found)
+	require.Equal(t, Info{Number: 64501, Organization: "Example ISP"}, info)
+	db, found := DatabaseFromContext(ctx)
+	require.True(t, found)
+	_, found = db.Lookup(netip.MustParseAddr("9.9.9.9"))
+	require.False(t, found)
+
+	ctx, err = h.HandleAnnounce(context.Background(), newRequest("9.9.9.9"), resp)
+	require.Nil(t, err)
+	_, found = FromContext(ctx)
+	require.False(t, found)
+}
+
+func TestRankPeers(t *testing.T) {
+	h, err := build(conf.MapConfig{"database": writeDatabase(t), "max_peers_per_asn": 1}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	peer := func(s string) bittorrent.Peer {
+		return bittorrent.Peer{AddrPort: netip.MustParseAddrPort(s)}
+	}
+	out := h.(*hook).RankPeers(context.Background(), nil, []bittorrent.Peer{
+		peer("1.2.3.4:6881"), peer("1.2.3.5:6881"), peer("5.6.7.8:6881"), peer("9.9.9.9:6881"), peer("9.9.9.8:6881"),
+	})
+	require.Equal(t, []bittorrent.Peer{peer("1.2.3.4:6881"), peer("5.6.7.8:6881"), peer("9.9.9.9:6881"), peer("9.9.9.8:6881")}, out)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, errNoDatabase)
+	_, err = build(conf.MapConfig{"database": filepath.Join(t.TempDir(), "missing.mmdb")}, nil)
+	require.NotNil(t, err)
+}
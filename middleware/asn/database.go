@@ -0,0 +1,87 @@
+package asn
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/pkg/mmdb"
+	"github.com/sot-tech/mochi/pkg/privacy"
+)
+
+// Info is the autonomous system which announces network
+type Info struct {
+	// Number of autonomous system
+	Number uint32
+	// Organization which owns autonomous system
+	Organization string
+}
+
+// Database resolves addresses into autonomous systems
+// using MaxMind GeoLite2-ASN (or GeoIP2-ISP) database.
+// Database is safe for concurrent use.
+type Database struct {
+	path    string
+	reader  atomic.Pointer[mmdb.Reader]
+	modTime time.Time
+}
+
+// OpenDatabase loads database from file
+func OpenDatabase(path string) (*Database, error) {
+	db := &Database{path: path}
+	if _, err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload loads database from file if it was modified since previous load.
+// Must not be called concurrently.
+func (db *Database) Reload() (reloaded bool, err error) {
+	var fi os.FileInfo
+	if fi, err = os.Stat(db.path); err != nil || fi.ModTime().Equal(db.modTime) {
+		return
+	}
+	var r *mmdb.Reader
+	if r, err = mmdb.Open(db.path); err == nil {
+		db.reader.Store(r)
+		db.modTime, reloaded = fi.ModTime(), true
+	}
+	return
+}
+
+// Lookup returns autonomous system of address
+func (db *Database) Lookup(addr netip.Addr) (info Info, found bool) {
+	v, found, err := db.reader.Load().Lookup(addr)
+	if err != nil {
+		logger.Warn().Err(err).Stringer("addr", privacy.Stringer(addr)).Msg("unable to lookup address")
+		return info, false
+	}
+	if m, ok := v.(map[string]any); ok && found {
+		n, _ := m["autonomous_system_number"].(uint64)
+		info.Number = uint32(n)
+		info.Organization, _ = m["autonomous_system_organization"].(string)
+		found = info.Number != 0
+	}
+	return
+}
+
+type infoKey struct{}
+
+type databaseKey struct{}
+
+// FromContext returns autonomous system of announcing peer
+// resolved by this middleware
+func FromContext(ctx context.Context) (info Info, found bool) {
+	info, found = ctx.Value(infoKey{}).(Info)
+	return
+}
+
+// DatabaseFromContext returns Database placed by this middleware,
+// so next hooks may resolve other addresses (i.e. peers)
+func DatabaseFromContext(ctx context.Context) (db *Database, found bool) {
+	db, found = ctx.Value(databaseKey{}).(*Database)
+	return
+}
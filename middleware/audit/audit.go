@@ -0,0 +1,341 @@
+// Package audit implements a Hook that keeps the last announces
+// of every swarm or user with their outcome in memory and exposes
+// them via admin API to debug rejections without access logging.
+package audit
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "audit"
+
+// Kinds of keys of announces buffers
+const (
+	ByInfoHash = "info_hash"
+	ByUser     = "user"
+)
+
+const (
+	defaultSize    = 20
+	defaultMaxKeys = 10000
+)
+
+var (
+	logger = log.NewLogger("middleware/audit")
+
+	errUserParamNotProvided = errors.New("user_param not provided")
+	errUnknownKey           = errors.New("unknown key kind")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// By is the kind of key, announces are grouped by:
+	// info_hash (default) or user.
+	By string
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey). Required if By is user.
+	UserParam string `cfg:"user_param"`
+	// Size is the number of last announces kept for each key.
+	Size int
+	// MaxKeys is the maximum number of keys. If reached,
+	// announces of the least recently announced key are dropped.
+	MaxKeys int `cfg:"max_keys"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	switch cfg.By {
+	case "":
+		validCfg.By = ByInfoHash
+		logger.Warn().
+			Str("name", "By").
+			Str("provided", cfg.By).
+			Str("default", validCfg.By).
+			Msg("falling back to default configuration")
+	case ByInfoHash:
+	case ByUser:
+		if len(cfg.UserParam) == 0 {
+			err = errUserParamNotProvided
+			return
+		}
+	default:
+		err = fmt.Errorf("%w '%s'", errUnknownKey, cfg.By)
+		return
+	}
+	if cfg.Size <= 0 {
+		validCfg.Size = defaultSize
+		logger.Warn().
+			Str("name", "Size").
+			Int("provided", cfg.Size).
+			Int("default", validCfg.Size).
+			Msg("falling back to default configuration")
+	}
+	if cfg.MaxKeys <= 0 {
+		validCfg.MaxKeys = defaultMaxKeys
+		logger.Warn().
+			Str("name", "MaxKeys").
+			Int("provided", cfg.MaxKeys).
+			Int("default", validCfg.MaxKeys).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:  cfg,
+		keys: make(map[string]*list.Element),
+		lru:  list.New(),
+	}
+	admin.Handle(http.MethodGet, "/audit/{key}", h.handleGet)
+	return h, nil
+}
+
+// record is the stored announce
+type record struct {
+	time                       time.Time
+	infoHash                   bittorrent.InfoHash
+	id                         bittorrent.PeerID
+	addr                       netip.Addr
+	port                       uint16
+	event                      bittorrent.Event
+	left, uploaded, downloaded uint64
+	user                       string
+	peers                      int
+	err                        error
+}
+
+// Record is the announce with its outcome
+type Record struct {
+	Time       time.Time `json:"time"`
+	InfoHash   string    `json:"info_hash"`
+	PeerID     string    `json:"peer_id"`
+	Addr       string    `json:"addr"`
+	Port       uint16    `json:"port"`
+	Event      string    `json:"event"`
+	Left       uint64    `json:"left"`
+	Uploaded   uint64    `json:"uploaded"`
+	Downloaded uint64    `json:"downloaded"`
+	// Peers is the number of peers returned in response
+	Peers int `json:"peers"`
+	// Error is the reason of rejection, empty if announce succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// ring holds the last announces of key
+type ring struct {
+	key     string
+	records []record
+	// next is the position of the next record if buffer is full
+	next int
+}
+
+func (r *ring) add(rec record, size int) {
+	if len(r.records) < size {
+		r.records = append(r.records, rec)
+		return
+	}
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % size
+}
+
+// newest returns records starting from the most recent one
+func (r *ring) newest() []record {
+	out := make([]record, 0, len(r.records))
+	for i := range r.records {
+		out = append(out, r.records[(r.next+len(r.records)-1-i)%len(r.records)])
+	}
+	return out
+}
+
+type hook struct {
+	cfg Config
+
+	keys map[string]*list.Element
+	// lru is the list of rings, the most recently updated is at front
+	lru *list.List
+	sync.Mutex
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Announces are recorded after outcome is known.
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not recorded.
+	return ctx, nil
+}
+
+// AnnounceRejected records rejected announce with rejection reason
+func (h *hook) AnnounceRejected(_ context.Context, req *bittorrent.AnnounceRequest, err error) {
+	h.record(req, nil, err)
+}
+
+// AnnounceResponded records successful announce with number of returned peers
+func (h *hook) AnnounceResponded(_ context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	h.record(req, resp, nil)
+}
+
+func (h *hook) record(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, err error) {
+	var user string
+	if len(h.cfg.UserParam) > 0 && req.Params != nil {
+		user, _ = req.Params.GetString(h.cfg.UserParam)
+		// parameter value may refer to request buffer, which is reused
+		user = strings.Clone(user)
+	}
+	key := string(req.InfoHash)
+	if h.cfg.By == ByUser {
+		if len(user) == 0 {
+			return
+		}
+		key = user
+	}
+	rec := record{
+		time:       time.Now(),
+		infoHash:   req.InfoHash,
+		id:         req.ID,
+		addr:       req.GetFirst(),
+		port:       req.Port,
+		event:      req.Event,
+		left:       req.Left,
+		uploaded:   req.Uploaded,
+		downloaded: req.Downloaded,
+		user:       user,
+		err:        err,
+	}
+	if resp != nil {
+		rec.peers = len(resp.IPv4Peers) + len(resp.IPv6Peers)
+	}
+	h.Lock()
+	defer h.Unlock()
+	e, found := h.keys[key]
+	if found {
+		h.lru.MoveToFront(e)
+	} else {
+		if h.lru.Len() >= h.cfg.MaxKeys {
+			oldest := h.lru.Back()
+			delete(h.keys, oldest.Value.(*ring).key)
+			h.lru.Remove(oldest)
+		}
+		e = h.lru.PushFront(&ring{key: key, records: make([]record, 0, 1)})
+		h.keys[key] = e
+	}
+	e.Value.(*ring).add(rec, h.cfg.Size)
+}
+
+// Records returns the last announces of key (raw info hash or user)
+// starting from the most recent one
+func (h *hook) Records(key string) []Record {
+	h.Lock()
+	var recs []record
+	if e, found := h.keys[key]; found {
+		recs = e.Value.(*ring).newest()
+	}
+	h.Unlock()
+	out := make([]Record, 0, len(recs))
+	for _, r := range recs {
+		rec := Record{
+			Time:       r.time,
+			InfoHash:   r.infoHash.String(),
+			PeerID:     r.id.String(),
+			Addr:       privacy.String(r.addr),
+			Port:       r.port,
+			Event:      r.event.String(),
+			Left:       r.left,
+			Uploaded:   r.uploaded,
+			Downloaded: r.downloaded,
+			Peers:      r.peers,
+		}
+		if r.err != nil {
+			rec.Error = r.err.Error()
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// Erase deletes announces of user or with address or peer ID of Subject
+func (h *hook) Erase(_ context.Context, s middleware.Subject) (middleware.ErasureReport, error) {
+	n := 0
+	h.Lock()
+	defer h.Unlock()
+	for e := h.lru.Front(); e != nil; {
+		next := e.Next()
+		r := e.Value.(*ring)
+		recs := r.newest()
+		kept := recs[:0]
+		for _, rec := range recs {
+			if (len(s.User) > 0 && rec.user == s.User) ||
+				(s.Addr.IsValid() && rec.addr.Unmap() == s.Addr.Unmap()) ||
+				(s.PeerID != bittorrent.PeerID{} && rec.id == s.PeerID) {
+				n++
+			} else {
+				kept = append(kept, rec)
+			}
+		}
+		if len(kept) == 0 {
+			delete(h.keys, r.key)
+			h.lru.Remove(e)
+		} else if len(kept) < len(recs) {
+			// restore chronological order
+			r.records, r.next = r.records[:0], 0
+			for i := len(kept) - 1; i >= 0; i-- {
+				r.records = append(r.records, kept[i])
+			}
+		}
+		e = next
+	}
+	return middleware.ErasureReport{"announces": n}, nil
+}
+
+// handleGet returns announces of key, which is hex-encoded
+// info hash or user depending on configuration
+func (h *hook) handleGet(ctx *fasthttp.RequestCtx) {
+	key, _ := ctx.UserValue("key").(string)
+	if h.cfg.By == ByInfoHash {
+		ih, err := bittorrent.NewInfoHashString(key)
+		if err != nil {
+			admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+			return
+		}
+		key = string(ih)
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, map[string]any{
+		"by":        h.cfg.By,
+		"announces": h.Records(key),
+	})
+}
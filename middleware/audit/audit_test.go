@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+type params map[string]string
+
+func (p params) GetString(key string) (out string, found bool) {
+	out, found = p[key]
+	return
+}
+
+func (params) MarshalZerologObject(*zerolog.Event) {}
+
+var errRejected = bittorrent.ClientError{Message: "rejected"}
+
+// rejectHook rejects announces of user2
+type rejectHook struct{}
+
+func (rejectHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if user, _ := req.Params.GetString("passkey"); user == "user2" {
+		return ctx, errRejected
+	}
+	return ctx, nil
+}
+
+func (rejectHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func newRequest(ih string, id byte, user string, left uint64) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash(ih),
+		Left:     left,
+		NumWant:  10,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{1, 2, 3, id})}},
+		},
+		Params: params{"passkey": user},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := Config{}.Validate()
+	require.Nil(t, err)
+	require.Equal(t, Config{By: ByInfoHash, Size: defaultSize, MaxKeys: defaultMaxKeys}, cfg)
+
+	_, err = Config{By: ByUser}.Validate()
+	require.ErrorIs(t, err, errUserParamNotProvided)
+	_, err = Config{By: "peer"}.Validate()
+	require.ErrorIs(t, err, errUnknownKey)
+}
+
+func TestRecords(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"user_param": "passkey", "size": 2, "max_keys": 2}, ps)
+	require.Nil(t, err)
+	hk := h.(*hook)
+	l := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{rejectHook{}, h}, nil, nil)
+
+	ctx := context.Background()
+	ih1, ih2, ih3 := "11111111111111111111", "22222222222222222222", "33333333333333333333"
+	for i, user := range []string{"user1", "user2", "user1"} {
+		_, _, _ = l.HandleAnnounce(ctx, newRequest(ih1, byte(i+1), user, 0))
+	}
+	recs := hk.Records(ih1)
+	require.Len(t, recs, 2)
+	// the most recent first, the oldest is dropped
+	require.Equal(t, bittorrent.PeerID{3}.String(), recs[0].PeerID)
+	require.Equal(t, "1.2.3.3", recs[0].Addr)
+	require.Empty(t, recs[0].Error)
+	require.Equal(t, bittorrent.PeerID{2}.String(), recs[1].PeerID)
+	require.Equal(t, errRejected.Error(), recs[1].Error)
+	require.Zero(t, recs[1].Peers)
+
+	// the least recently announced key is dropped
+	_, _, _ = l.HandleAnnounce(ctx, newRequest(ih2, 1, "user1", 1))
+	_, _, _ = l.HandleAnnounce(ctx, newRequest(ih1, 1, "user1", 1))
+	_, _, _ = l.HandleAnnounce(ctx, newRequest(ih3, 1, "user1", 1))
+	require.Empty(t, hk.Records(ih2))
+	require.Len(t, hk.Records(ih1), 2)
+	require.Len(t, hk.Records(ih3), 1)
+
+	report, err := hk.Erase(ctx, middleware.Subject{PeerID: bittorrent.PeerID{1}})
+	require.Nil(t, err)
+	require.Equal(t, middleware.ErasureReport{"announces": 2}, report)
+	recs = hk.Records(ih1)
+	require.Len(t, recs, 1)
+	require.Equal(t, bittorrent.PeerID{3}.String(), recs[0].PeerID)
+	require.Empty(t, hk.Records(ih3))
+}
+
+func TestByUser(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"by": ByUser, "user_param": "passkey"}, ps)
+	require.Nil(t, err)
+	hk := h.(*hook)
+	l := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{rejectHook{}, h}, nil, nil)
+
+	ctx := context.Background()
+	_, _, _ = l.HandleAnnounce(ctx, newRequest("11111111111111111111", 1, "user2", 0))
+	_, _, _ = l.HandleAnnounce(ctx, newRequest("22222222222222222222", 1, "user2", 0))
+	_, _, _ = l.HandleAnnounce(ctx, newRequest("22222222222222222222", 2, "", 0))
+
+	request := func(key string) (int, []Record) {
+		rCtx := new(fasthttp.RequestCtx)
+		rCtx.SetUserValue("key", key)
+		hk.handleGet(rCtx)
+		var resp struct {
+			Announces []Record `json:"announces"`
+		}
+		_ = json.Unmarshal(rCtx.Response.Body(), &resp)
+		return rCtx.Response.StatusCode(), resp.Announces
+	}
+	status, recs := request("user2")
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Len(t, recs, 2)
+	require.Equal(t, bittorrent.InfoHash("22222222222222222222").String(), recs[0].InfoHash)
+	require.Equal(t, errRejected.Error(), recs[0].Error)
+	require.Len(t, hk.keys, 1)
+
+	report, err := hk.Erase(ctx, middleware.Subject{User: "user2"})
+	require.Nil(t, err)
+	require.Equal(t, middleware.ErasureReport{"announces": 2}, report)
+	_, recs = request("user2")
+	require.Empty(t, recs)
+}
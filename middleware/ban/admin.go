@@ -0,0 +1,129 @@
+package ban
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+var errInvalidTTL = errors.New("ttl must be positive")
+
+// banRequest is the request of ban issue, expiration
+// may be set by absolute time or by TTL
+type banRequest struct {
+	Ban
+	TTL string `json:"ttl,omitempty"`
+}
+
+// find returns ban with the same kind and value as b, if any
+func find(bans []Ban, b Ban) *Ban {
+	if i := slices.IndexFunc(bans, func(o Ban) bool { return o.key() == b.key() }); i >= 0 {
+		return &bans[i]
+	}
+	return nil
+}
+
+// handleList returns active bans, optionally filtered by `kind` query argument
+func (h *hook) handleList(ctx *fasthttp.RequestCtx) {
+	bans := slices.Clone(h.idx.Load().bans)
+	if kind := string(ctx.QueryArgs().Peek("kind")); len(kind) > 0 {
+		bans = slices.DeleteFunc(bans, func(b Ban) bool { return b.Kind != kind })
+	}
+	if bans == nil {
+		bans = []Ban{}
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, bans)
+}
+
+// handleAdd issues ban provided in JSON body, existing ban
+// with the same kind and value is replaced
+func (h *hook) handleAdd(ctx *fasthttp.RequestCtx) {
+	var req banRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	b := req.Ban
+	if err := b.normalize(); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	b.Created = timecache.Now().UTC()
+	if len(req.TTL) > 0 {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err == nil && ttl <= 0 {
+			err = errInvalidTTL
+		}
+		if err != nil {
+			admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+			return
+		}
+		b.Expires = b.Created.Add(ttl)
+	}
+	b.IssuedBy = admin.Actor(ctx)
+	old, err := h.modify(ctx, func(bans []Ban) []Ban {
+		bans = slices.DeleteFunc(bans, func(o Ban) bool { return o.key() == b.key() })
+		return append(bans, b)
+	})
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	logger.Info().Str("kind", b.Kind).Str("value", b.Value).Str("reason", b.Reason).
+		Str("issuedBy", b.IssuedBy).Time("expires", b.Expires).Msg("ban issued")
+	admin.SetAuditValues(ctx, find(old, b), b)
+	admin.WriteJSON(ctx, fasthttp.StatusOK, b)
+}
+
+// handleDelete lifts ban identified by `kind` and `value` query arguments
+func (h *hook) handleDelete(ctx *fasthttp.RequestCtx) {
+	b := Ban{Kind: string(ctx.QueryArgs().Peek("kind")), Value: string(ctx.QueryArgs().Peek("value"))}
+	if err := b.normalize(); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	old, err := h.modify(ctx, func(bans []Ban) []Ban {
+		return slices.DeleteFunc(bans, func(o Ban) bool { return o.key() == b.key() })
+	})
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	h.forget(b)
+	logger.Info().Str("kind", b.Kind).Str("value", b.Value).Msg("ban lifted")
+	admin.SetAuditValues(ctx, find(old, b), nil)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// forget deletes lifted ban from middleware.RejectCache,
+// so banned requests recorded by other hooks (i.e. cheat detection)
+// are not rejected anymore. Ban must be normalized.
+func (h *hook) forget(b Ban) {
+	switch b.Kind {
+	case KindIP:
+		h.Forget(middleware.AddressKey(netip.MustParseAddr(b.Value)))
+	case KindCIDR:
+		p := netip.MustParsePrefix(b.Value)
+		h.ForgetFunc(func(key middleware.RejectKey, _ error) bool {
+			a, err := netip.ParseAddr(key.Value)
+			return key.Kind == middleware.RejectAddress && err == nil && p.Contains(a)
+		})
+	case KindPeerID:
+		raw, _ := hex.DecodeString(b.Value)
+		h.Forget(middleware.PeerIDKey(bittorrent.PeerID(raw)))
+	case KindPasskey:
+		if len(h.cfg.UserParam) > 0 {
+			h.Forget(middleware.ParamKey(h.cfg.UserParam, b.Value))
+		}
+	}
+}
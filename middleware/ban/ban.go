@@ -0,0 +1,448 @@
+// Package ban implements a Hook that rejects requests of banned addresses,
+// networks, peer IDs, users (passkeys) and info hashes. Bans are stored
+// in DataStorage with reason, issuer and expiration time and are managed
+// through admin API.
+package ban
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "ban"
+
+// Kinds of bans
+const (
+	// KindIP bans single address
+	KindIP = "ip"
+	// KindCIDR bans network
+	KindCIDR = "cidr"
+	// KindPeerID bans HEX-encoded peer ID
+	KindPeerID = "peer_id"
+	// KindPasskey bans user identified by Config.UserParam
+	KindPasskey = "passkey"
+	// KindInfoHash bans HEX-encoded info hash
+	KindInfoHash = "info_hash"
+)
+
+const (
+	// DefaultStorageCtx is the name of storage context where bans are stored
+	DefaultStorageCtx      = "MW_BAN"
+	defaultRefreshInterval = time.Minute
+	// storageKey is the key of bans list in storage context
+	storageKey = "bans"
+)
+
+var (
+	logger = log.NewLogger("middleware/ban")
+
+	// ErrBanned is returned by a middleware if any of announcing
+	// addresses, peer ID or user is banned.
+	ErrBanned = bittorrent.NewClientError(bittorrent.ReasonBanned, "you are banned")
+	// ErrTorrentBanned is returned by a middleware if the torrent is banned.
+	ErrTorrentBanned = bittorrent.NewClientError(bittorrent.ReasonBanned, "torrent is banned")
+
+	errUnknownKind   = errors.New("unknown ban kind")
+	errEmptyValue    = errors.New("ban value not provided")
+	errInvalidPeerID = errors.New("peer ID must be 20 bytes HEX-encoded")
+
+	errStorageNotProvided = errors.New("storage not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Ban is the single ban entry
+type Ban struct {
+	// Kind is one of KindIP, KindCIDR, KindPeerID, KindPasskey or KindInfoHash
+	Kind string `json:"kind"`
+	// Value is the banned address, network, peer ID, passkey or info hash
+	Value string `json:"value"`
+	// Reason of ban, sent to client if Config.ShowReason is set
+	Reason string `json:"reason,omitempty"`
+	// IssuedBy is the administrator, who issued ban
+	IssuedBy string `json:"issued_by,omitempty"`
+	// Created is the time of ban issue
+	Created time.Time `json:"created"`
+	// Expires is the time of ban expiration, if zero, ban is permanent
+	Expires time.Time `json:"expires"`
+}
+
+func (b Ban) key() string {
+	return b.Kind + ":" + b.Value
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !now.Before(b.Expires)
+}
+
+// normalize checks value of ban and converts it to canonical form
+func (b *Ban) normalize() error {
+	b.Value = strings.TrimSpace(b.Value)
+	if len(b.Value) == 0 {
+		return errEmptyValue
+	}
+	switch b.Kind {
+	case KindIP:
+		a, err := netip.ParseAddr(b.Value)
+		if err != nil {
+			return err
+		}
+		b.Value = a.Unmap().String()
+	case KindCIDR:
+		p, err := netip.ParsePrefix(b.Value)
+		if err != nil {
+			return err
+		}
+		b.Value = p.Masked().String()
+	case KindPeerID:
+		raw, err := hex.DecodeString(b.Value)
+		if err != nil {
+			return err
+		}
+		if len(raw) != bittorrent.PeerIDLen {
+			return errInvalidPeerID
+		}
+		b.Value = hex.EncodeToString(raw)
+	case KindInfoHash:
+		ih, err := bittorrent.NewInfoHashString(b.Value)
+		if err != nil {
+			return err
+		}
+		b.Value = ih.String()
+	case KindPasskey:
+	default:
+		return fmt.Errorf("%w '%s'", errUnknownKind, b.Kind)
+	}
+	return nil
+}
+
+// index is the lookup structure of active bans
+type index struct {
+	bans     []Ban
+	addrs    map[netip.Addr]*Ban
+	prefixes map[netip.Prefix]*Ban
+	// bits4, bits6 are distinct lengths of banned networks
+	bits4, bits6 []int
+	peerIDs      map[bittorrent.PeerID]*Ban
+	users        map[string]*Ban
+	infoHashes   map[bittorrent.InfoHash]*Ban
+}
+
+// newIndex creates index of bans, which are not expired.
+// Bans must be normalized.
+func newIndex(bans []Ban, now time.Time) *index {
+	idx := &index{
+		addrs:      make(map[netip.Addr]*Ban),
+		prefixes:   make(map[netip.Prefix]*Ban),
+		peerIDs:    make(map[bittorrent.PeerID]*Ban),
+		users:      make(map[string]*Ban),
+		infoHashes: make(map[bittorrent.InfoHash]*Ban),
+	}
+	for _, b := range bans {
+		if !b.expired(now) {
+			idx.bans = append(idx.bans, b)
+		}
+	}
+	for i := range idx.bans {
+		b := &idx.bans[i]
+		switch b.Kind {
+		case KindIP:
+			idx.addrs[netip.MustParseAddr(b.Value)] = b
+		case KindCIDR:
+			p := netip.MustParsePrefix(b.Value)
+			idx.prefixes[p] = b
+			if p.Addr().Is4() {
+				idx.bits4 = append(idx.bits4, p.Bits())
+			} else {
+				idx.bits6 = append(idx.bits6, p.Bits())
+			}
+		case KindPeerID:
+			raw, _ := hex.DecodeString(b.Value)
+			idx.peerIDs[bittorrent.PeerID(raw)] = b
+		case KindPasskey:
+			idx.users[b.Value] = b
+		case KindInfoHash:
+			ih, _ := bittorrent.NewInfoHashString(b.Value)
+			idx.infoHashes[ih] = b
+		}
+	}
+	slices.Sort(idx.bits4)
+	idx.bits4 = slices.Compact(idx.bits4)
+	slices.Sort(idx.bits6)
+	idx.bits6 = slices.Compact(idx.bits6)
+	return idx
+}
+
+func (idx *index) addr(a netip.Addr) *Ban {
+	a = a.Unmap()
+	if b := idx.addrs[a]; b != nil {
+		return b
+	}
+	bits := idx.bits6
+	if a.Is4() {
+		bits = idx.bits4
+	}
+	for _, n := range bits {
+		if p, err := a.Prefix(n); err == nil {
+			if b := idx.prefixes[p]; b != nil {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// infoHash returns active ban of ih or its truncated form (BEP 52)
+func (idx *index) infoHash(ih bittorrent.InfoHash, now time.Time) *Ban {
+	b := idx.infoHashes[ih]
+	if b == nil && len(ih) == bittorrent.InfoHashV2Len {
+		b = idx.infoHashes[ih.TruncateV1()]
+	}
+	if b != nil && b.expired(now) {
+		b = nil
+	}
+	return b
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey), required to check passkey bans.
+	UserParam string `cfg:"user_param"`
+	// StorageCtx is the name of storage context where bans are stored.
+	StorageCtx string `cfg:"storage_ctx"`
+	// RefreshInterval is the period between two loads of bans from storage,
+	// so bans issued by other instances are applied.
+	RefreshInterval time.Duration `cfg:"refresh_interval"`
+	// ShowReason adds reason of ban to the message sent to client.
+	ShowReason bool `cfg:"show_reason"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config) {
+	validCfg = cfg
+	if len(cfg.UserParam) == 0 {
+		logger.Info().Msg("user_param not provided, passkey bans are not checked")
+	}
+	if len(cfg.StorageCtx) == 0 {
+		validCfg.StorageCtx = DefaultStorageCtx
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", validCfg.StorageCtx).
+			Msg("falling back to default configuration")
+	}
+	if cfg.RefreshInterval <= 0 {
+		validCfg.RefreshInterval = defaultRefreshInterval
+		logger.Warn().
+			Str("name", "RefreshInterval").
+			Dur("provided", cfg.RefreshInterval).
+			Dur("default", validCfg.RefreshInterval).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if st == nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errStorageNotProvided)
+	}
+	h := &hook{
+		cfg:     cfg.Validate(),
+		storage: st,
+		closed:  make(chan any),
+	}
+	h.idx.Store(newIndex(nil, timecache.Now()))
+	if err := h.reload(context.Background()); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	admin.Handle(http.MethodGet, "/bans", h.handleList)
+	admin.HandleModerated(http.MethodPost, "/bans", h.handleAdd)
+	admin.HandleModerated(http.MethodDelete, "/bans", h.handleDelete)
+	h.wg.Add(1)
+	go h.runRefresh()
+	return h, nil
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.DataStorage
+	idx     atomic.Pointer[index]
+	// mu serializes modifications of stored bans
+	mu sync.Mutex
+	middleware.RejectCaches
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+// load returns stored bans
+func (h *hook) load(ctx context.Context) ([]Ban, error) {
+	b, err := h.storage.Load(ctx, h.cfg.StorageCtx, storageKey)
+	if err != nil {
+		return nil, err
+	}
+	return decode(b)
+}
+
+// decode returns valid bans of stored value
+func decode(b []byte) (bans []Ban, err error) {
+	if len(b) == 0 {
+		return
+	}
+	if err = json.Unmarshal(b, &bans); err != nil {
+		return
+	}
+	valid := bans[:0]
+	for _, b := range bans {
+		if err := b.normalize(); err != nil {
+			logger.Warn().Err(err).Str("kind", b.Kind).Str("value", b.Value).Msg("ignoring invalid stored ban")
+			continue
+		}
+		valid = append(valid, b)
+	}
+	return valid, nil
+}
+
+// reload replaces active bans with stored ones
+func (h *hook) reload(ctx context.Context) error {
+	bans, err := h.load(ctx)
+	if err == nil {
+		h.idx.Store(newIndex(bans, timecache.Now()))
+	}
+	return err
+}
+
+// modify applies fn to stored bans, expired bans are dropped.
+// Bans are replaced with storage.Update, so modifications made
+// concurrently by other tracker instances are not overwritten,
+// fn is called again if bans are modified concurrently.
+// Returns bans stored before modification.
+func (h *hook) modify(ctx context.Context, fn func([]Ban) []Ban) (old []Ban, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := timecache.Now()
+	var bans []Ban
+	err = storage.Update(ctx, h.storage, h.cfg.StorageCtx, storageKey, func(b []byte) (_ []byte, err error) {
+		if old, err = decode(b); err != nil {
+			return
+		}
+		bans = slices.DeleteFunc(fn(slices.Clone(old)), func(b Ban) bool { return b.expired(now) })
+		return json.Marshal(bans)
+	})
+	if err == nil {
+		h.idx.Store(newIndex(bans, now))
+	}
+	return
+}
+
+func (h *hook) runRefresh() {
+	defer h.wg.Done()
+	t := time.NewTicker(h.cfg.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			if err := h.reload(context.Background()); err != nil {
+				logger.Error().Err(err).Msg("unable to load bans")
+			}
+		}
+	}
+}
+
+// reject returns err with reason of ban if Config.ShowReason set
+func (h *hook) reject(err bittorrent.ClientError, b *Ban) error {
+	if h.cfg.ShowReason && len(b.Reason) > 0 {
+		return bittorrent.NewClientError(err.Code, err.Message+": "+b.Reason)
+	}
+	return err
+}
+
+// match returns active ban of the request properties
+func (h *hook) match(addrs bittorrent.RequestAddresses, id bittorrent.PeerID, params bittorrent.Params) *Ban {
+	idx, now := h.idx.Load(), timecache.Now()
+	var b *Ban
+	if id != (bittorrent.PeerID{}) {
+		b = idx.peerIDs[id]
+	}
+	if b == nil && len(h.cfg.UserParam) > 0 && params != nil {
+		if user, _ := params.GetString(h.cfg.UserParam); len(user) > 0 {
+			b = idx.users[user]
+		}
+	}
+	for i := 0; b == nil && i < len(addrs); i++ {
+		b = idx.addr(addrs[i].Addr)
+	}
+	if b != nil && b.expired(now) {
+		b = nil
+	}
+	return b
+}
+
+// HandleAnnounce rejects announces of banned torrents or from banned
+// addresses, peer IDs or users.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if b := h.idx.Load().infoHash(req.InfoHash, timecache.Now()); b != nil {
+		return ctx, h.reject(ErrTorrentBanned, b)
+	}
+	if b := h.match(req.RequestAddresses, req.ID, req.Params); b != nil {
+		logger.Debug().Object("source", req.RequestPeer).Str("kind", b.Kind).Msg("announce is banned")
+		return ctx, h.reject(ErrBanned, b)
+	}
+	return ctx, nil
+}
+
+// HandleScrape rejects scrapes from banned addresses or users
+// and fails scrapes of banned torrents.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if b := h.match(req.RequestAddresses, bittorrent.PeerID{}, req.Params); b != nil {
+		return ctx, h.reject(ErrBanned, b)
+	}
+	idx, now := h.idx.Load(), timecache.Now()
+	if len(idx.infoHashes) > 0 {
+		for _, ih := range req.InfoHashes {
+			if b := idx.infoHash(ih, now); b != nil {
+				resp.Data = append(resp.Data, bittorrent.Scrape{InfoHash: ih, Failure: h.reject(ErrTorrentBanned, b)})
+			}
+		}
+	}
+	return ctx, nil
+}
+
+// Close stops refresh of bans
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		h.wg.Wait()
+	})
+	return nil
+}
@@ -0,0 +1,221 @@
+package ban
+
+import (
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	sm "github.com/sot-tech/mochi/storage/memory"
+)
+
+const (
+	ih     = "0123456789abcdef0123456789abcdef01234567"
+	peerID = "2d4f50313031312d000000000000000000000001"
+)
+
+func newStorage(t *testing.T) storage.PeerStorage {
+	st, err := sm.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func newHook(t *testing.T, st storage.PeerStorage) *hook {
+	h, err := build(conf.MapConfig{"user_param": "passkey", "show_reason": true}, st)
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = h.(*hook).Close() })
+	return h.(*hook)
+}
+
+func newRequest(addr string, params bittorrent.Params) *bittorrent.AnnounceRequest {
+	h, _ := bittorrent.NewInfoHashString(ih)
+	return &bittorrent.AnnounceRequest{
+		InfoHash: h,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}},
+		},
+		Params: params,
+	}
+}
+
+type params map[string]string
+
+func (p params) GetString(key string) (out string, found bool) {
+	out, found = p[key]
+	return
+}
+
+func (params) MarshalZerologObject(*zerolog.Event) {}
+
+func add(t *testing.T, h *hook, body string) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetBodyString(body)
+	h.handleAdd(&ctx)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), string(ctx.Response.Body()))
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tt := range []struct {
+		in, out Ban
+		valid   bool
+	}{
+		{Ban{Kind: KindIP, Value: "::ffff:10.0.0.1"}, Ban{Kind: KindIP, Value: "10.0.0.1"}, true},
+		{Ban{Kind: KindCIDR, Value: "10.1.2.3/16"}, Ban{Kind: KindCIDR, Value: "10.1.0.0/16"}, true},
+		{Ban{Kind: KindPeerID, Value: "2D4F50313031312D000000000000000000000001"}, Ban{Kind: KindPeerID, Value: peerID}, true},
+		{Ban{Kind: KindInfoHash, Value: " " + ih + " "}, Ban{Kind: KindInfoHash, Value: ih}, true},
+		{Ban{Kind: KindPasskey, Value: "secret"}, Ban{Kind: KindPasskey, Value: "secret"}, true},
+		{Ban{Kind: KindIP, Value: "10.0.0.0/8"}, Ban{}, false},
+		{Ban{Kind: KindPeerID, Value: "2d4f"}, Ban{}, false},
+		{Ban{Kind: KindPasskey}, Ban{}, false},
+		{Ban{Kind: "unknown", Value: "1"}, Ban{}, false},
+	} {
+		b := tt.in
+		err := b.normalize()
+		if !tt.valid {
+			require.NotNil(t, err, tt.in)
+			continue
+		}
+		require.Nil(t, err)
+		require.Equal(t, tt.out, b)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	st := newStorage(t)
+	h := newHook(t, st)
+	other := newHook(t, st)
+
+	_, err := h.HandleAnnounce(context.Background(), newRequest("10.1.2.3", nil), nil)
+	require.Nil(t, err)
+
+	add(t, h, `{"kind":"cidr","value":"10.1.0.0/16","reason":"abuse","issued_by":"admin"}`)
+	// instances sharing storage apply bans after reload
+	require.Nil(t, other.reload(context.Background()))
+	for _, hk := range []*hook{h, other} {
+		_, err = hk.HandleAnnounce(context.Background(), newRequest("10.1.2.3", nil), nil)
+		var clientErr bittorrent.ClientError
+		require.ErrorAs(t, err, &clientErr)
+		require.Equal(t, bittorrent.ReasonBanned, clientErr.Code)
+		require.Equal(t, ErrBanned.Message+": abuse", clientErr.Message)
+	}
+	_, err = h.HandleAnnounce(context.Background(), newRequest("10.2.0.1", nil), nil)
+	require.Nil(t, err)
+
+	add(t, h, `{"kind":"passkey","value":"secret","ttl":"1h"}`)
+	_, err = h.HandleAnnounce(context.Background(), newRequest("10.2.0.1", params{"passkey": "secret"}), nil)
+	require.ErrorIs(t, err, ErrBanned)
+
+	add(t, h, `{"kind":"info_hash","value":"`+ih+`"}`)
+	_, err = h.HandleAnnounce(context.Background(), newRequest("10.2.0.1", nil), nil)
+	require.ErrorIs(t, err, ErrTorrentBanned)
+
+	// bans are stored and loaded by new instance
+	require.Len(t, newHook(t, st).idx.Load().bans, 3)
+
+	var ctx fasthttp.RequestCtx
+	ctx.QueryArgs().Set("kind", "info_hash")
+	ctx.QueryArgs().Set("value", ih)
+	other.handleDelete(&ctx)
+	require.Equal(t, fasthttp.StatusNoContent, ctx.Response.StatusCode())
+	_, err = other.HandleAnnounce(context.Background(), newRequest("10.2.0.1", nil), nil)
+	require.Nil(t, err)
+
+	// expired bans are ignored
+	require.Nil(t, h.reload(context.Background()))
+	b := h.idx.Load().users["secret"]
+	require.NotNil(t, b)
+	b.Expires = time.Now().Add(-time.Second)
+	_, err = h.HandleAnnounce(context.Background(), newRequest("10.2.0.1", params{"passkey": "secret"}), nil)
+	require.Nil(t, err)
+}
+
+func TestForget(t *testing.T) {
+	h := newHook(t, newStorage(t))
+	c := middleware.NewRejectCache(middleware.DefaultRejectCacheSize)
+	h.UseRejectCache(c)
+
+	id, _ := bittorrent.NewPeerID([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20})
+	addrs := bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.1.2.3")}}
+	until := time.Now().Add(time.Hour)
+	c.Reject(middleware.AddressKey(addrs[0].Addr), until, ErrBanned)
+	c.Reject(middleware.AddressKey(netip.MustParseAddr("10.2.0.1")), until, ErrBanned)
+	c.Reject(middleware.PeerIDKey(id), until, ErrBanned)
+	c.Reject(middleware.ParamKey("passkey", "secret"), until, ErrBanned)
+
+	// lifted ban is not rejected by other hooks anymore
+	for _, b := range []Ban{
+		{Kind: KindCIDR, Value: "10.1.0.0/16"},
+		{Kind: KindPeerID, Value: hex.EncodeToString(id[:])},
+		{Kind: KindPasskey, Value: "secret"},
+	} {
+		var ctx fasthttp.RequestCtx
+		ctx.QueryArgs().Set("kind", b.Kind)
+		ctx.QueryArgs().Set("value", b.Value)
+		h.handleDelete(&ctx)
+		require.Equal(t, fasthttp.StatusNoContent, ctx.Response.StatusCode())
+	}
+	require.Nil(t, c.Check(addrs, id, params{"passkey": "secret"}))
+	require.ErrorIs(t, c.Check(bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.2.0.1")}}, bittorrent.PeerID{}, nil), ErrBanned)
+}
+
+func TestHandleScrape(t *testing.T) {
+	h := newHook(t, newStorage(t))
+	add(t, h, `{"kind":"info_hash","value":"`+ih+`"}`)
+	add(t, h, `{"kind":"ip","value":"2001:db8::1"}`)
+
+	ih1, _ := bittorrent.NewInfoHashString(ih)
+	ih2, _ := bittorrent.NewInfoHashString("1123456789abcdef0123456789abcdef01234567")
+	req := &bittorrent.ScrapeRequest{
+		RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+		InfoHashes:       bittorrent.InfoHashes{ih1, ih2},
+	}
+	resp := &bittorrent.ScrapeResponse{}
+	_, err := h.HandleScrape(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Len(t, resp.Data, 1)
+	require.Equal(t, ih1, resp.Data[0].InfoHash)
+	require.ErrorIs(t, resp.Data[0].Failure, ErrTorrentBanned)
+
+	req.RequestAddresses = bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("2001:db8::1")}}
+	_, err = h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.ErrorIs(t, err, ErrBanned)
+}
+
+func TestConcurrentModify(t *testing.T) {
+	_, err := build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, errStorageNotProvided)
+
+	// instances sharing storage do not overwrite bans of each other
+	st := newStorage(t)
+	hooks := []*hook{newHook(t, st), newHook(t, st)}
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := Ban{Kind: KindPasskey, Value: strconv.Itoa(i)}
+			_, err := hooks[i%len(hooks)].modify(context.Background(), func(bans []Ban) []Ban {
+				return append(bans, b)
+			})
+			require.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	bans, err := hooks[0].load(context.Background())
+	require.Nil(t, err)
+	require.Len(t, bans, 20)
+}
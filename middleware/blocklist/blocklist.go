@@ -0,0 +1,420 @@
+// Package blocklist implements a Hook that fails an Announce if any of
+// announcing addresses is listed in configured DNSBL zones or
+// in downloadable blocklists.
+package blocklist
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/pkg/replica"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "blocklist"
+
+const (
+	// DefaultStorageCtx is the name of storage context where DNSBL verdicts are cached
+	DefaultStorageCtx      = "MW_BLOCKLIST"
+	defaultRefreshInterval = 24 * time.Hour
+	defaultCacheTTL        = time.Hour
+	defaultTimeout         = 5 * time.Second
+)
+
+var (
+	logger = log.NewLogger("middleware/blocklist")
+
+	// ErrBlocked is returned by a middleware if any of announcing
+	// addresses is blocked.
+	ErrBlocked = bittorrent.NewClientError(bittorrent.ReasonBlocked, "your address is blocked")
+
+	errNoSources = errors.New("neither dnsbl, feeds nor replica provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to check addresses.
+type Config struct {
+	// DNSBL list of DNSBL zones (i.e. `dnsbl.example.org`)
+	// to check addresses in.
+	DNSBL []string
+	// Feeds list of HTTP(S) URLs or local paths of blocklists
+	// in P2P, eMule DAT or CIDR format, possibly gzip-compressed.
+	Feeds []string
+	// RefreshInterval is the period between two feeds downloads.
+	RefreshInterval time.Duration `cfg:"refresh_interval"`
+	// CacheTTL is the period while DNSBL verdict for address is cached.
+	CacheTTL time.Duration `cfg:"cache_ttl"`
+	// StorageCtx is the name of storage context where DNSBL verdicts are cached.
+	StorageCtx string `cfg:"storage_ctx"`
+	// Timeout of single DNS query or feed download.
+	Timeout time.Duration
+	// Replica is the name of replicated set of banned addresses and ranges,
+	// which may be modified through admin API and is synchronized
+	// with other instances.
+	Replica string
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.DNSBL) == 0 && len(cfg.Feeds) == 0 && len(cfg.Replica) == 0 {
+		err = errNoSources
+		return
+	}
+	if len(cfg.Feeds) > 0 && cfg.RefreshInterval <= 0 {
+		validCfg.RefreshInterval = defaultRefreshInterval
+		logger.Warn().
+			Str("name", "RefreshInterval").
+			Dur("provided", cfg.RefreshInterval).
+			Dur("default", validCfg.RefreshInterval).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.DNSBL) > 0 {
+		if cfg.CacheTTL <= 0 {
+			validCfg.CacheTTL = defaultCacheTTL
+			logger.Warn().
+				Str("name", "CacheTTL").
+				Dur("provided", cfg.CacheTTL).
+				Dur("default", validCfg.CacheTTL).
+				Msg("falling back to default configuration")
+		}
+		if len(cfg.StorageCtx) == 0 {
+			validCfg.StorageCtx = DefaultStorageCtx
+			logger.Warn().
+				Str("name", "StorageCtx").
+				Str("provided", cfg.StorageCtx).
+				Str("default", validCfg.StorageCtx).
+				Msg("falling back to default configuration")
+		}
+	}
+	if cfg.Timeout <= 0 {
+		validCfg.Timeout = defaultTimeout
+		logger.Warn().
+			Str("name", "Timeout").
+			Dur("provided", cfg.Timeout).
+			Dur("default", validCfg.Timeout).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:     cfg,
+		storage: st,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		lookup:  net.DefaultResolver.LookupHost,
+		expiry:  make(map[string]int64),
+		closed:  make(chan any),
+	}
+	h.ranges.Store(&rangeList{})
+	h.bans.Store(&rangeList{})
+	if len(cfg.Replica) > 0 {
+		if h.set, err = replica.NewSet(replica.SetConfig{
+			Name:      cfg.Replica,
+			Storage:   st,
+			Normalize: normalizeRange,
+			OnChange:  h.rebuildBans,
+		}); err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", Name, err)
+		}
+		h.rebuildBans(nil, nil)
+	}
+	if len(cfg.Feeds) > 0 {
+		h.refresh()
+		h.wg.Add(1)
+		go h.runRefresh()
+	}
+	if len(cfg.DNSBL) > 0 && h.storage != nil {
+		h.wg.Add(1)
+		go h.runGC()
+	}
+	return h, nil
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.DataStorage
+	client  *http.Client
+	lookup  func(context.Context, string) ([]string, error)
+	ranges  atomic.Pointer[rangeList]
+	// bans are ranges of replicated set
+	bans atomic.Pointer[rangeList]
+	set  *replica.Set
+	middleware.RejectCaches
+	// expiry holds expiration Unix time of verdicts cached by this
+	// instance, so expired verdicts are deleted from storage
+	expiry   map[string]int64
+	expiryMu sync.Mutex
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	for _, a := range req.RequestAddresses {
+		if h.blocked(ctx, a.Addr) {
+			logger.Debug().
+				Object("source", req.RequestPeer).
+				Stringer("addr", privacy.Stringer(a.Addr)).
+				Msg("address is blocked")
+			if ttl := h.rejectTTL(); ttl > 0 {
+				middleware.RejectUntil(ctx, middleware.AddressKey(a.Addr), timecache.Now().Add(ttl), ErrBlocked)
+			}
+			return ctx, ErrBlocked
+		}
+	}
+	return ctx, nil
+}
+
+// rejectTTL returns period while blocked address is rejected by middleware.RejectCache:
+// the lowest of CacheTTL and RefreshInterval, because verdict may change after that.
+// If neither is set, address is not cached.
+func (h *hook) rejectTTL() time.Duration {
+	if h.cfg.CacheTTL > 0 && (h.cfg.RefreshInterval <= 0 || h.cfg.CacheTTL < h.cfg.RefreshInterval) {
+		return h.cfg.CacheTTL
+	}
+	return h.cfg.RefreshInterval
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't register peers.
+	return ctx, nil
+}
+
+func (h *hook) blocked(ctx context.Context, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if h.ranges.Load().contains(addr) || h.bans.Load().contains(addr) {
+		return true
+	}
+	if len(h.cfg.DNSBL) == 0 {
+		return false
+	}
+	key := addr.String()
+	if verdict, ok := h.cached(ctx, key); ok {
+		return verdict
+	}
+	var listed bool
+	qCtx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+	for _, zone := range h.cfg.DNSBL {
+		var err error
+		if listed, err = dnsblListed(qCtx, h.lookup, addr, zone); err != nil {
+			// do not cache verdict if zone is unavailable
+			logger.Warn().Err(err).Str("zone", zone).Stringer("addr", privacy.Stringer(addr)).Msg("unable to query DNSBL")
+			return false
+		}
+		if listed {
+			break
+		}
+	}
+	h.cache(ctx, key, listed)
+	return listed
+}
+
+// cached returns DNSBL verdict stored in DataStorage if it is not expired.
+// Value is 8 bytes of big-endian expiration Unix time and 1 byte of verdict.
+func (h *hook) cached(ctx context.Context, key string) (verdict, ok bool) {
+	if h.storage == nil {
+		return
+	}
+	b, err := h.storage.Load(ctx, h.cfg.StorageCtx, key)
+	if err != nil {
+		logger.Warn().Err(err).Str("key", key).Msg("unable to load cached verdict")
+		return
+	}
+	if len(b) == 9 && !expired(b, timecache.NowUnix()) {
+		verdict, ok = b[8] == 1, true
+	}
+	return
+}
+
+func expired(b []byte, now int64) bool {
+	return int64(binary.BigEndian.Uint64(b)) <= now
+}
+
+func (h *hook) cache(ctx context.Context, key string, verdict bool) {
+	if h.storage == nil {
+		return
+	}
+	until := timecache.Now().Add(h.cfg.CacheTTL).Unix()
+	b := make([]byte, 9)
+	binary.BigEndian.PutUint64(b, uint64(until))
+	if verdict {
+		b[8] = 1
+	}
+	if err := h.storage.Put(ctx, h.cfg.StorageCtx, storage.Entry{Key: key, Value: b}); err != nil {
+		logger.Warn().Err(err).Str("key", key).Msg("unable to cache verdict")
+		return
+	}
+	h.expiryMu.Lock()
+	h.expiry[key] = until
+	h.expiryMu.Unlock()
+}
+
+// gc deletes verdicts cached by this instance, which expired before now.
+// Verdicts renewed by other instances are kept.
+func (h *hook) gc(now int64) {
+	var keys []string
+	h.expiryMu.Lock()
+	for k, until := range h.expiry {
+		if until <= now {
+			keys = append(keys, k)
+			delete(h.expiry, k)
+		}
+	}
+	h.expiryMu.Unlock()
+	ctx := context.Background()
+	for _, k := range keys {
+		err := storage.Update(ctx, h.storage, h.cfg.StorageCtx, k, func(b []byte) ([]byte, error) {
+			if len(b) == 9 && !expired(b, now) {
+				return b, nil
+			}
+			return nil, nil
+		})
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			logger.Warn().Err(err).Str("key", k).Msg("unable to delete expired verdict")
+		}
+	}
+}
+
+func (h *hook) runGC() {
+	defer h.wg.Done()
+	t := time.NewTicker(h.cfg.CacheTTL)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.gc(timecache.NowUnix())
+		}
+	}
+}
+
+// normalizeRange returns canonical form of address, CIDR or range
+func normalizeRange(s string) (string, error) {
+	r, ok, err := parseRange(s)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("invalid range '%s'", s)
+	}
+	if r.from == r.to {
+		return r.from.String(), nil
+	}
+	return r.from.String() + "-" + r.to.String(), nil
+}
+
+// rebuildBans replaces banned ranges with actual keys of replicated set
+func (h *hook) rebuildBans(_, _ []string) {
+	if h.set == nil {
+		// called while set is being restored, ranges are built after that
+		return
+	}
+	keys := h.set.Keys()
+	rr := make([]ipRange, 0, len(keys))
+	for _, k := range keys {
+		if r, ok, err := parseRange(k); ok && err == nil {
+			rr = append(rr, r)
+		}
+	}
+	rl := newRangeList(rr)
+	h.bans.Store(&rl)
+	h.forgetUnblocked()
+}
+
+// forgetUnblocked deletes addresses, which are not in ranges anymore,
+// from middleware.RejectCache
+func (h *hook) forgetUnblocked() {
+	ranges, bans := h.ranges.Load(), h.bans.Load()
+	h.ForgetFunc(func(key middleware.RejectKey, err error) bool {
+		if key.Kind != middleware.RejectAddress || !errors.Is(err, ErrBlocked) {
+			return false
+		}
+		a, pErr := netip.ParseAddr(key.Value)
+		return pErr == nil && !ranges.contains(a) && !bans.contains(a)
+	})
+}
+
+// refresh downloads all feeds and replaces ranges.
+// If any feed failed, previous ranges are kept.
+func (h *hook) refresh() {
+	var all []ipRange
+	for _, f := range h.cfg.Feeds {
+		ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+		rr, err := fetchFeed(ctx, h.client, f)
+		cancel()
+		if err != nil {
+			logger.Error().Err(err).Str("feed", f).Msg("unable to load blocklist, keeping previous")
+			return
+		}
+		all = append(all, rr...)
+	}
+	rl := newRangeList(all)
+	h.ranges.Store(&rl)
+	h.forgetUnblocked()
+	logger.Info().Int("ranges", len(rl)).Msg("blocklist refreshed")
+}
+
+func (h *hook) runRefresh() {
+	defer h.wg.Done()
+	t := time.NewTicker(h.cfg.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.refresh()
+		}
+	}
+}
+
+// Erase deletes cached DNSBL verdict of address
+func (h *hook) Erase(ctx context.Context, s middleware.Subject) (middleware.ErasureReport, error) {
+	if h.storage == nil || !s.Addr.IsValid() {
+		return nil, nil
+	}
+	n, err := middleware.EraseKeys(ctx, h.storage, h.cfg.StorageCtx, s.Addr.Unmap().String())
+	return middleware.ErasureReport{"verdicts": n}, err
+}
+
+// Close stops feeds refreshing
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		h.wg.Wait()
+	})
+	return nil
+}
@@ -0,0 +1,163 @@
+package blocklist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/replica"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+const feed = `# comment
+Some network:1.2.3.0-1.2.3.255
+010.000.000.000 - 010.000.000.255 , 000 , eMule entry
+192.168.0.0/16
+8.8.8.8
+2001:db8::/32
+garbage line
+`
+
+func TestParseFeed(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write([]byte(feed))
+	require.Nil(t, w.Close())
+
+	for _, in := range [][]byte{[]byte(feed), gz.Bytes()} {
+		rr, err := parseFeed(bytes.NewReader(in))
+		require.Nil(t, err)
+		require.Len(t, rr, 5)
+		rl := newRangeList(rr)
+		for _, a := range []string{"1.2.3.0", "1.2.3.128", "10.0.0.255", "192.168.10.1", "8.8.8.8", "2001:db8::1"} {
+			require.True(t, rl.contains(netip.MustParseAddr(a)), a)
+		}
+		for _, a := range []string{"1.2.4.0", "10.0.1.0", "8.8.8.9", "2001:db9::1", "::1"} {
+			require.False(t, rl.contains(netip.MustParseAddr(a)), a)
+		}
+	}
+}
+
+func TestNewRangeList(t *testing.T) {
+	rr, err := parseFeed(bytes.NewReader([]byte("1.0.0.0-1.0.0.10\n1.0.0.5-1.0.0.20\n1.0.0.21\n2.0.0.0/8")))
+	require.Nil(t, err)
+	rl := newRangeList(rr)
+	require.Len(t, rl, 2)
+	require.Equal(t, netip.MustParseAddr("1.0.0.21"), rl[0].to)
+	require.Equal(t, netip.MustParseAddr("2.255.255.255"), rl[1].to)
+}
+
+func TestDNSBLQuery(t *testing.T) {
+	require.Equal(t, "4.3.2.1.bl.example.org", dnsblQuery(netip.MustParseAddr("1.2.3.4"), "bl.example.org."))
+	require.Equal(t,
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example.org",
+		dnsblQuery(netip.MustParseAddr("2001:db8::1"), "bl.example.org"))
+}
+
+func newRequest(addr string) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		RequestPeer: bittorrent.RequestPeer{
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}},
+		},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(feed))
+	}))
+	defer srv.Close()
+
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"dnsbl": []string{"bl.example.org"}, "feeds": []string{srv.URL}}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	queries := 0
+	h.(*hook).lookup = func(_ context.Context, host string) ([]string, error) {
+		queries++
+		if host == "4.0.0.127.bl.example.org" {
+			return []string{"127.0.0.2"}, nil
+		}
+		return nil, &net.DNSError{IsNotFound: true}
+	}
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(ctx, newRequest("1.2.3.4"), resp)
+	require.Equal(t, ErrBlocked, err)
+	require.Equal(t, 0, queries)
+
+	for i := 0; i < 2; i++ {
+		_, err = h.HandleAnnounce(ctx, newRequest("127.0.0.4"), resp)
+		require.Equal(t, ErrBlocked, err)
+		_, err = h.HandleAnnounce(ctx, newRequest("127.0.0.5"), resp)
+		require.Nil(t, err)
+	}
+	// second time verdicts are taken from cache
+	require.Equal(t, 2, queries)
+
+	// expired verdicts are deleted from storage
+	h.(*hook).gc(0)
+	found, err := ps.Contains(ctx, DefaultStorageCtx, "127.0.0.4")
+	require.Nil(t, err)
+	require.True(t, found)
+	h.(*hook).gc(1 << 62)
+	found, err = ps.Contains(ctx, DefaultStorageCtx, "127.0.0.4")
+	require.Nil(t, err)
+	require.False(t, found)
+	require.Empty(t, h.(*hook).expiry)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, errNoSources)
+}
+
+func TestReplica(t *testing.T) {
+	h, err := build(conf.MapConfig{"replica": "bans"}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(ctx, newRequest("10.0.0.1"), resp)
+	require.Nil(t, err)
+
+	// addresses are not cached without refresh, but deleted from cache after removal
+	require.Zero(t, h.(*hook).rejectTTL())
+	c := middleware.NewRejectCache(middleware.DefaultRejectCacheSize)
+	h.(*hook).UseRejectCache(c)
+
+	set := replica.Lookup("bans")
+	require.NotNil(t, set)
+	require.Nil(t, set.Add("10.0.0.0/24", "192.168.0.1"))
+	require.NotNil(t, set.Add("invalid"))
+	require.Equal(t, []string{"10.0.0.0-10.0.0.255", "192.168.0.1"}, set.Keys())
+	_, err = h.HandleAnnounce(ctx, newRequest("10.0.0.1"), resp)
+	require.Equal(t, ErrBlocked, err)
+
+	until := time.Now().Add(time.Hour)
+	c.Reject(middleware.AddressKey(netip.MustParseAddr("10.0.0.1")), until, ErrBlocked)
+	c.Reject(middleware.AddressKey(netip.MustParseAddr("192.168.0.1")), until, ErrBlocked)
+
+	require.Nil(t, set.Remove("10.0.0.0-10.0.0.255"))
+	_, err = h.HandleAnnounce(ctx, newRequest("10.0.0.1"), resp)
+	require.Nil(t, err)
+	require.Nil(t, c.Check(newRequest("10.0.0.1").RequestAddresses, bittorrent.PeerID{}, nil))
+	require.Equal(t, ErrBlocked, c.Check(newRequest("192.168.0.1").RequestAddresses, bittorrent.PeerID{}, nil))
+}
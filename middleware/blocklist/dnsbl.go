@@ -0,0 +1,49 @@
+package blocklist
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// dnsblQuery builds DNSBL query name: reversed address octets
+// (nibbles for IPv6) followed by zone
+func dnsblQuery(addr netip.Addr, zone string) string {
+	var sb strings.Builder
+	b := addr.AsSlice()
+	for i := len(b) - 1; i >= 0; i-- {
+		if addr.Is4() {
+			sb.WriteString(strconv.Itoa(int(b[i])))
+			sb.WriteByte('.')
+		} else {
+			sb.WriteString(strconv.FormatUint(uint64(b[i]&0xf), 16))
+			sb.WriteByte('.')
+			sb.WriteString(strconv.FormatUint(uint64(b[i]>>4), 16))
+			sb.WriteByte('.')
+		}
+	}
+	sb.WriteString(strings.TrimSuffix(zone, "."))
+	return sb.String()
+}
+
+// dnsblListed checks if addr listed in zone.
+// Address is listed if zone returned any 127.0.0.0/8 address.
+func dnsblListed(ctx context.Context, lookup func(context.Context, string) ([]string, error), addr netip.Addr, zone string) (bool, error) {
+	res, err := lookup(ctx, dnsblQuery(addr, zone))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			err = nil
+		}
+		return false, err
+	}
+	for _, r := range res {
+		if a, err := netip.ParseAddr(r); err == nil && a.Is4() && a.As4()[0] == 127 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,180 @@
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ipRange is the closed interval of addresses
+type ipRange struct {
+	from, to netip.Addr
+}
+
+// rangeList is the sorted list of non-overlapping ranges
+type rangeList []ipRange
+
+// newRangeList sorts provided ranges and merges overlapping ones
+func newRangeList(rr []ipRange) rangeList {
+	slices.SortFunc(rr, func(a, b ipRange) int {
+		return a.from.Compare(b.from)
+	})
+	out := make(rangeList, 0, len(rr))
+	for _, r := range rr {
+		if l := len(out) - 1; l >= 0 && out[l].to.BitLen() == r.from.BitLen() &&
+			(out[l].to.Compare(r.from) >= 0 || out[l].to.Next() == r.from) {
+			if r.to.Compare(out[l].to) > 0 {
+				out[l].to = r.to
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func (rl rangeList) contains(addr netip.Addr) bool {
+	i, found := slices.BinarySearchFunc(rl, addr, func(r ipRange, a netip.Addr) int {
+		return r.from.Compare(a)
+	})
+	if found {
+		return true
+	}
+	return i > 0 && rl[i-1].to.BitLen() == addr.BitLen() && rl[i-1].to.Compare(addr) >= 0
+}
+
+// parseRange parses single blocklist line in one of formats:
+//   - P2P: `description:1.2.3.0-1.2.3.255`;
+//   - eMule DAT: `001.002.003.000 - 001.002.003.255 , 000 , description`;
+//   - CIDR: `1.2.3.0/24`;
+//   - single address: `1.2.3.4`.
+//
+// Empty lines and comments (starting with `#` or `//`) are skipped (ok is false).
+func parseRange(line string) (r ipRange, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' || strings.HasPrefix(line, "//") {
+		return
+	}
+	ok = true
+	if i := strings.IndexByte(line, ','); i >= 0 {
+		// eMule: range , level , description
+		line = strings.TrimSpace(line[:i])
+	} else if i = strings.LastIndexByte(line, ':'); i >= 0 && strings.IndexByte(line[i:], '-') > 0 &&
+		strings.IndexByte(line[i:], '.') > 0 {
+		// P2P: description may contain colons, IPv4 range may not
+		line = line[i+1:]
+	}
+	if from, to, isRange := strings.Cut(line, "-"); isRange {
+		if r.from, err = parseAddr(from); err == nil {
+			r.to, err = parseAddr(to)
+		}
+		if err == nil && (r.from.BitLen() != r.to.BitLen() || r.from.Compare(r.to) > 0) {
+			err = fmt.Errorf("invalid range '%s'", line)
+		}
+		return
+	}
+	if strings.IndexByte(line, '/') >= 0 {
+		var p netip.Prefix
+		if p, err = netip.ParsePrefix(line); err == nil {
+			p = p.Masked()
+			r.from, r.to = p.Addr(), lastAddr(p)
+		}
+		return
+	}
+	r.from, err = parseAddr(line)
+	r.to = r.from
+	return
+}
+
+// parseAddr parses address, which may contain leading zeroes in octets (eMule format)
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if strings.IndexByte(s, ':') < 0 {
+		octets := strings.Split(s, ".")
+		for i, o := range octets {
+			if t := strings.TrimLeft(o, "0"); len(t) > 0 {
+				octets[i] = t
+			} else {
+				octets[i] = "0"
+			}
+		}
+		s = strings.Join(octets, ".")
+	}
+	a, err := netip.ParseAddr(s)
+	return a.Unmap(), err
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// parseFeed reads all ranges from plain or gzip-compressed reader.
+// Invalid lines are skipped.
+func parseFeed(r io.Reader) ([]ipRange, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	var out []ipRange
+	var invalid int
+	s := bufio.NewScanner(br)
+	for s.Scan() {
+		rng, ok, err := parseRange(s.Text())
+		if err != nil {
+			invalid++
+			continue
+		}
+		if ok {
+			out = append(out, rng)
+		}
+	}
+	if invalid > 0 {
+		logger.Debug().Int("count", invalid).Msg("invalid lines skipped")
+	}
+	return out, s.Err()
+}
+
+// fetchFeed loads ranges from HTTP(S) URL or local file
+func fetchFeed(ctx context.Context, client *http.Client, source string) ([]ipRange, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(strings.TrimPrefix(source, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseFeed(f)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return parseFeed(resp.Body)
+}
@@ -0,0 +1,353 @@
+// Package bonus implements a Hook that accrues bonus points to users
+// for seeding. Points are stored in DataStorage and may be queried
+// and adjusted via admin API.
+package bonus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "bonus points"
+
+const (
+	// DefaultStorageCtx is the name of storage context where points are stored
+	DefaultStorageCtx = "MW_BONUS"
+	// DefaultSizeStorageCtx is the name of storage context where torrent sizes are stored
+	DefaultSizeStorageCtx = "MW_BONUS_SIZE"
+	defaultMaxGap         = time.Hour
+	gib                   = 1 << 30
+)
+
+var (
+	logger = log.NewLogger("middleware/bonus points")
+
+	errUserParamNotProvided = errors.New("user_param not provided")
+	errInvalidPoints        = errors.New("invalid points value")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to accrue points.
+type Config struct {
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey).
+	UserParam string `cfg:"user_param"`
+	// PointsPerHour base amount of points accrued for one hour of seeding one torrent.
+	PointsPerHour float64 `cfg:"points_per_hour"`
+	// SizeWeight additional multiplier for every GiB of torrent size.
+	// Points per hour are multiplied by (1 + SizeWeight * size in GiB).
+	SizeWeight float64 `cfg:"size_weight"`
+	// ScarcityWeight additional multiplier for swarms with few seeders.
+	// Points per hour are multiplied by (1 + ScarcityWeight / seeders).
+	ScarcityWeight float64 `cfg:"scarcity_weight"`
+	// MaxGap maximal period between two announces of seeder, which is accrued.
+	// If seeder announces after longer period, previous period is not accrued.
+	MaxGap time.Duration `cfg:"max_gap"`
+	// StorageCtx is the name of storage context where points are stored.
+	StorageCtx string `cfg:"storage_ctx"`
+	// SizeStorageCtx is the name of storage context where torrent sizes
+	// (decimal number of bytes) are stored. If size is not set,
+	// it is calculated from leechers announces.
+	SizeStorageCtx string `cfg:"size_storage_ctx"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.UserParam) == 0 {
+		err = errUserParamNotProvided
+		return
+	}
+	if cfg.PointsPerHour <= 0 {
+		err = fmt.Errorf("invalid points_per_hour: %f", cfg.PointsPerHour)
+		return
+	}
+	if cfg.MaxGap <= 0 {
+		validCfg.MaxGap = defaultMaxGap
+		logger.Warn().
+			Str("name", "MaxGap").
+			Dur("provided", cfg.MaxGap).
+			Dur("default", validCfg.MaxGap).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.StorageCtx) == 0 {
+		validCfg.StorageCtx = DefaultStorageCtx
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", validCfg.StorageCtx).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.SizeStorageCtx) == 0 {
+		validCfg.SizeStorageCtx = DefaultSizeStorageCtx
+		logger.Warn().
+			Str("name", "SizeStorageCtx").
+			Str("provided", cfg.SizeStorageCtx).
+			Str("default", validCfg.SizeStorageCtx).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:      cfg,
+		storage:  st,
+		lastSeen: make(map[string]int64),
+		closed:   make(chan any),
+	}
+	admin.Handle(http.MethodGet, "/bonus/{user}", h.handleGet)
+	admin.HandleModerated(http.MethodPost, "/bonus/{user}", h.handleAdjust)
+	go h.runGC()
+	return h, nil
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.PeerStorage
+
+	lastSeen   map[string]int64
+	seenMU     sync.Mutex
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// seedingTime returns period since the previous seeder announce
+// if it is not longer than MaxGap and remembers current announce time
+func (h *hook) seedingTime(key string, stopped bool) (d time.Duration) {
+	now := timecache.NowUnixNano()
+	h.seenMU.Lock()
+	defer h.seenMU.Unlock()
+	if last, exists := h.lastSeen[key]; exists && now-last <= int64(h.cfg.MaxGap) {
+		d = time.Duration(now - last)
+	}
+	if stopped {
+		delete(h.lastSeen, key)
+	} else {
+		h.lastSeen[key] = now
+	}
+	return
+}
+
+func (h *hook) size(ctx context.Context, req *bittorrent.AnnounceRequest) (size uint64) {
+	key := req.InfoHash.RawString()
+	b, err := h.storage.Load(ctx, h.cfg.SizeStorageCtx, key)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to load torrent size")
+		return
+	}
+	if len(b) > 0 {
+		size, _ = strconv.ParseUint(string(b), 10, 64)
+	}
+	if req.Left > 0 && size == 0 {
+		if size = req.Left + req.Downloaded; size > 0 {
+			err = h.storage.Put(ctx, h.cfg.SizeStorageCtx, storage.Entry{
+				Key:   key,
+				Value: []byte(strconv.FormatUint(size, 10)),
+			})
+			if err != nil {
+				logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to store torrent size")
+			}
+		}
+	}
+	return
+}
+
+// HandleAnnounce accrues points for seeding time since previous announce.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Params == nil || middleware.DryRun(ctx) {
+		return ctx, nil
+	}
+	user, _ := req.Params.GetString(h.cfg.UserParam)
+	if len(user) == 0 {
+		return ctx, nil
+	}
+	size := h.size(ctx, req)
+	if req.Left > 0 {
+		return ctx, nil
+	}
+	d := h.seedingTime(user+req.InfoHash.RawString(), req.Event == bittorrent.Stopped)
+	if d <= 0 {
+		return ctx, nil
+	}
+	points := d.Hours() * h.cfg.PointsPerHour * (1 + h.cfg.SizeWeight*float64(size)/gib)
+	if h.cfg.ScarcityWeight > 0 {
+		if _, seeders, _, err := h.storage.ScrapeSwarm(ctx, req.InfoHash.TruncateV1()); err == nil {
+			// requester is not counted if it is not stored yet
+			points *= 1 + h.cfg.ScarcityWeight/float64(max(seeders, 1))
+		}
+	}
+	if _, err := h.add(ctx, user, points); err != nil {
+		logger.Error().Err(err).Str("user", user).Msg("unable to accrue points")
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't accrue points.
+	return ctx, nil
+}
+
+// Points returns current points of user
+func (h *hook) Points(ctx context.Context, user string) (float64, error) {
+	b, err := h.storage.Load(ctx, h.cfg.StorageCtx, user)
+	if err != nil || len(b) == 0 {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// add adds delta (may be negative) to user's points and returns new value.
+// Points are modified with storage.Update, so concurrent modifications
+// (from other tracker instances too) are not lost.
+func (h *hook) add(ctx context.Context, user string, delta float64) (points float64, err error) {
+	err = storage.Update(ctx, h.storage, h.cfg.StorageCtx, user, func(old []byte) ([]byte, error) {
+		points = 0
+		if len(old) > 0 {
+			var err error
+			if points, err = strconv.ParseFloat(string(old), 64); err != nil {
+				return nil, err
+			}
+		}
+		points += delta
+		return []byte(strconv.FormatFloat(points, 'f', -1, 64)), nil
+	})
+	return
+}
+
+func (h *hook) set(ctx context.Context, user string, points float64) error {
+	return h.storage.Put(ctx, h.cfg.StorageCtx, storage.Entry{
+		Key:   user,
+		Value: []byte(strconv.FormatFloat(points, 'f', -1, 64)),
+	})
+}
+
+// Erase deletes points and seeding sessions of user
+func (h *hook) Erase(ctx context.Context, s middleware.Subject) (middleware.ErasureReport, error) {
+	if len(s.User) == 0 {
+		return nil, nil
+	}
+	report := middleware.ErasureReport{}
+	h.seenMU.Lock()
+	for k := range h.lastSeen {
+		// key is user and info hash
+		if l := len(k) - len(s.User); (l == bittorrent.InfoHashV1Len || l == bittorrent.InfoHashV2Len) &&
+			strings.HasPrefix(k, s.User) {
+			delete(h.lastSeen, k)
+			report["sessions"]++
+		}
+	}
+	h.seenMU.Unlock()
+	n, err := middleware.EraseKeys(ctx, h.storage, h.cfg.StorageCtx, s.User)
+	report["points"] = n
+	return report, err
+}
+
+type pointsResponse struct {
+	User   string  `json:"user"`
+	Points float64 `json:"points"`
+}
+
+func (h *hook) handleGet(ctx *fasthttp.RequestCtx) {
+	user, _ := ctx.UserValue("user").(string)
+	points, err := h.Points(ctx, user)
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, pointsResponse{User: user, Points: points})
+}
+
+// handleAdjust adds `delta` or sets `points` query argument value to user's points
+func (h *hook) handleAdjust(ctx *fasthttp.RequestCtx) {
+	user, _ := ctx.UserValue("user").(string)
+	args := ctx.QueryArgs()
+	var points float64
+	var err error
+	if args.Has("points") {
+		if points, err = strconv.ParseFloat(string(args.Peek("points")), 64); err == nil && finite(points) {
+			err = h.set(ctx, user, points)
+		} else {
+			err = errInvalidPoints
+		}
+	} else {
+		var delta float64
+		if delta, err = strconv.ParseFloat(string(args.Peek("delta")), 64); err == nil && finite(delta) {
+			points, err = h.add(ctx, user, delta)
+		} else {
+			err = errInvalidPoints
+		}
+	}
+	switch {
+	case errors.Is(err, errInvalidPoints):
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+	case err != nil:
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+	default:
+		admin.WriteJSON(ctx, fasthttp.StatusOK, pointsResponse{User: user, Points: points})
+	}
+}
+
+// finite returns true if v is neither NaN nor infinity
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.MaxGap)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			cutoff := timecache.Now().Add(-h.cfg.MaxGap).UnixNano()
+			h.seenMU.Lock()
+			for k, last := range h.lastSeen {
+				if last < cutoff {
+					delete(h.lastSeen, k)
+				}
+			}
+			h.seenMU.Unlock()
+		}
+	}
+}
+
+// Close stops stale seeders collection
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
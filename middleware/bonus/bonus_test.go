@@ -0,0 +1,183 @@
+package bonus
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+type params map[string]string
+
+func (p params) GetString(key string) (out string, found bool) {
+	out, found = p[key]
+	return
+}
+
+func (params) MarshalZerologObject(*zerolog.Event) {}
+
+func newRequest(left uint64) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("11111111111111111111"),
+		Left:     left,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+		Params: params{"passkey": "user1"},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{
+		"user_param":      "passkey",
+		"points_per_hour": 10,
+		"size_weight":     1,
+		"scarcity_weight": 1,
+	}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	hk := h.(*hook)
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+
+	// leecher announce stores torrent size: 1GiB
+	req := newRequest(gib / 2)
+	req.Downloaded = gib / 2
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+
+	// first seeder announce only remembers time
+	_, err = h.HandleAnnounce(ctx, newRequest(0), resp)
+	require.Nil(t, err)
+	points, err := hk.Points(ctx, "user1")
+	require.Nil(t, err)
+	require.Zero(t, points)
+
+	// one hour of seeding: 10 * (1 + 1) * (1 + 1/1)
+	key := "user1" + req.InfoHash.RawString()
+	hk.lastSeen[key] = timecache.Now().Add(-time.Hour).UnixNano()
+	_, err = h.HandleAnnounce(ctx, newRequest(0), resp)
+	require.Nil(t, err)
+	points, err = hk.Points(ctx, "user1")
+	require.Nil(t, err)
+	require.InDelta(t, 40, points, 0.1)
+
+	// gap is too long
+	hk.lastSeen[key] = timecache.Now().Add(-2 * time.Hour).UnixNano()
+	_, err = h.HandleAnnounce(ctx, newRequest(0), resp)
+	require.Nil(t, err)
+	points, err = hk.Points(ctx, "user1")
+	require.Nil(t, err)
+	require.InDelta(t, 40, points, 0.1)
+}
+
+func request(h fasthttp.RequestHandler, method, uri string) (int, pointsResponse) {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.SetUserValue("user", "user1")
+	h(ctx)
+	var resp pointsResponse
+	_ = json.Unmarshal(ctx.Response.Body(), &resp)
+	return ctx.Response.StatusCode(), resp
+}
+
+func TestAdmin(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"user_param": "passkey", "points_per_hour": 1}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	hk := h.(*hook)
+
+	status, resp := request(hk.handleAdjust, fasthttp.MethodPost, "/bonus/user1?points=100")
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Equal(t, 100.0, resp.Points)
+
+	status, resp = request(hk.handleAdjust, fasthttp.MethodPost, "/bonus/user1?delta=-30.5")
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Equal(t, 69.5, resp.Points)
+
+	for _, q := range []string{"delta=abc", "delta=NaN", "delta=Inf", "delta=-Inf", "points=+Inf"} {
+		status, _ = request(hk.handleAdjust, fasthttp.MethodPost, "/bonus/user1?"+q)
+		require.Equal(t, fasthttp.StatusBadRequest, status, q)
+	}
+
+	// instances sharing storage do not lose modifications of each other
+	other, err := build(conf.MapConfig{"user_param": "passkey", "points_per_hour": 1}, ps)
+	require.Nil(t, err)
+	defer other.(*hook).Close()
+	var wg sync.WaitGroup
+	for _, ih := range []*hook{hk, other.(*hook)} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				_, err := ih.add(context.Background(), "user1", 1)
+				require.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	points, err := hk.Points(context.Background(), "user1")
+	require.Nil(t, err)
+	require.Equal(t, 169.5, points)
+	require.Nil(t, hk.set(context.Background(), "user1", 69.5))
+
+	status, resp = request(hk.handleGet, fasthttp.MethodGet, "/bonus/user1")
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Equal(t, pointsResponse{User: "user1", Points: 69.5}, resp)
+}
+
+func TestErase(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"user_param": "passkey", "points_per_hour": 1}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	hk := h.(*hook)
+
+	ctx := context.Background()
+	require.Nil(t, hk.set(ctx, "user1", 10))
+	require.Nil(t, hk.set(ctx, "user10", 10))
+	_, err = h.HandleAnnounce(ctx, newRequest(0), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Len(t, hk.lastSeen, 1)
+
+	report, err := hk.Erase(ctx, middleware.Subject{User: "user1"})
+	require.Nil(t, err)
+	require.Equal(t, middleware.ErasureReport{"points": 1, "sessions": 1}, report)
+	points, err := hk.Points(ctx, "user1")
+	require.Nil(t, err)
+	require.Zero(t, points)
+	points, err = hk.Points(ctx, "user10")
+	require.Nil(t, err)
+	require.Equal(t, 10.0, points)
+
+	report, err = hk.Erase(ctx, middleware.Subject{Addr: netip.MustParseAddr("1.2.3.4")})
+	require.Nil(t, err)
+	require.Empty(t, report)
+}
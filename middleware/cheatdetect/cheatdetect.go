@@ -0,0 +1,411 @@
+// Package cheatdetect implements a Hook that compares consecutive announces
+// of the same peer and flags transfers exceeding configured rate, which
+// can not be reached in reality. Violations are recorded per user,
+// and user may be banned after configured amount of violations.
+// Peers reporting excessive amount of corrupt data, which often indicates
+// poisoning of swarm, are flagged too.
+package cheatdetect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/events"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "cheat detection"
+
+const (
+	// DefaultStorageCtx is the name of storage context where violations are stored
+	DefaultStorageCtx   = "MW_CHEAT_DETECTION"
+	defaultPeerLifetime = storage.DefaultPeerLifetime
+)
+
+var (
+	logger = log.NewLogger("middleware/cheat detection")
+
+	// ErrBanned is returned when user exceeded maximum number of violations.
+	ErrBanned = bittorrent.NewClientError(bittorrent.ReasonBanned, "banned for reporting impossible transfer")
+
+	errNoLimits = errors.New("neither max_upload_rate, max_download_rate nor max_corrupt_ratio provided")
+
+	// PromCorruptionReports is the number of announces with excessive amount of corrupt data
+	PromCorruptionReports = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mochi_middleware_cheat_detection_corruption_reports_total",
+		Help: "The number of announces, which reported excessive amount of corrupt data",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(PromCorruptionReports)
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to detect cheaters.
+type Config struct {
+	// MaxUploadRate maximum possible upload rate in bytes per second,
+	// zero disables check.
+	MaxUploadRate uint64 `cfg:"max_upload_rate"`
+	// MaxDownloadRate maximum possible download rate in bytes per second,
+	// zero disables check.
+	MaxDownloadRate uint64 `cfg:"max_download_rate"`
+	// MaxCorruptRatio maximum ratio of corrupt bytes (`corrupt` announce parameter)
+	// to downloaded bytes since the previous announce, zero disables check.
+	// Exceeding reports are flagged, but not counted as violations.
+	MaxCorruptRatio float64 `cfg:"max_corrupt_ratio"`
+	// MinCorrupt minimum number of corrupt bytes since the previous announce
+	// to check MaxCorruptRatio.
+	MinCorrupt uint64 `cfg:"min_corrupt"`
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey). If empty or not provided in request,
+	// the first announce address is used.
+	UserParam string `cfg:"user_param"`
+	// StrikesToBan number of violations after which user is banned,
+	// zero disables banning.
+	StrikesToBan int `cfg:"strikes_to_ban"`
+	// BanDuration period after the last violation while user is banned,
+	// after that violations counter is reset. Zero means permanent ban.
+	BanDuration time.Duration `cfg:"ban_duration"`
+	// StorageCtx is the name of storage context where violations are stored.
+	StorageCtx string `cfg:"storage_ctx"`
+	// PeerLifetime is the period after which previous announce of
+	// inactive peer is forgotten. Should be the same as storage's peer_lifetime.
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if cfg.MaxUploadRate == 0 && cfg.MaxDownloadRate == 0 && cfg.MaxCorruptRatio <= 0 {
+		err = errNoLimits
+		return
+	}
+	if len(cfg.StorageCtx) == 0 {
+		validCfg.StorageCtx = DefaultStorageCtx
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", validCfg.StorageCtx).
+			Msg("falling back to default configuration")
+	}
+	if cfg.PeerLifetime <= 0 {
+		validCfg.PeerLifetime = defaultPeerLifetime
+		logger.Warn().
+			Str("name", "PeerLifetime").
+			Dur("provided", cfg.PeerLifetime).
+			Dur("default", validCfg.PeerLifetime).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:     cfg,
+		storage: st,
+		last:    make(map[string]transfer),
+		closed:  make(chan any),
+	}
+	go h.runGC()
+	return h, nil
+}
+
+// transfer is the state of peer reported in announce
+type transfer struct {
+	uploaded, downloaded, corrupt uint64
+	time                          int64
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.DataStorage
+
+	last map[string]transfer
+	sync.Mutex
+	closed     chan any
+	onceCloser sync.Once
+}
+
+func (h *hook) userKey(req *bittorrent.AnnounceRequest) (key string) {
+	if len(h.cfg.UserParam) > 0 && req.Params != nil {
+		key, _ = req.Params.GetString(h.cfg.UserParam)
+	}
+	if len(key) == 0 {
+		key = req.GetFirst().String()
+	}
+	return
+}
+
+// rememberBan records ban into middleware.RejectCache, so next announces
+// of user are rejected without loading violations. Permanent ban is cached
+// for PeerLifetime.
+func (h *hook) rememberBan(ctx context.Context, req *bittorrent.AnnounceRequest, lastStrike int64) {
+	key := middleware.AddressKey(req.GetFirst())
+	if len(h.cfg.UserParam) > 0 && req.Params != nil {
+		if user, _ := req.Params.GetString(h.cfg.UserParam); len(user) > 0 {
+			key = middleware.ParamKey(h.cfg.UserParam, user)
+		}
+	}
+	until := timecache.Now().Add(h.cfg.PeerLifetime)
+	if h.cfg.BanDuration > 0 {
+		until = time.Unix(0, lastStrike).Add(h.cfg.BanDuration)
+	}
+	middleware.RejectUntil(ctx, key, until, ErrBanned)
+}
+
+// exchange stores current peer transfer and returns previous one.
+// If dry is set, current transfer is not stored.
+func (h *hook) exchange(key string, req *bittorrent.AnnounceRequest, now int64, dry bool) (prev transfer, found bool) {
+	h.Lock()
+	defer h.Unlock()
+	prev, found = h.last[key]
+	if dry {
+		return
+	}
+	if req.Event == bittorrent.Stopped {
+		delete(h.last, key)
+	} else {
+		h.last[key] = transfer{uploaded: req.Uploaded, downloaded: req.Downloaded, corrupt: req.Corrupt, time: now}
+	}
+	return
+}
+
+// exceeds checks if delta between two counters reached in elapsed nanoseconds
+// exceeds rate (bytes per second). If counter decreased (client restarted), returns false.
+func exceeds(prev, cur uint64, elapsed int64, rate uint64) (exceeded bool, actual uint64) {
+	if rate == 0 || cur <= prev {
+		return
+	}
+	sec := uint64(elapsed / int64(time.Second))
+	if sec == 0 {
+		sec = 1
+	}
+	actual = (cur - prev) / sec
+	return actual > rate, actual
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	user := h.userKey(req)
+	strikes, lastStrike := h.strikes(ctx, user)
+	now := timecache.NowUnixNano()
+	if h.banned(strikes, lastStrike, now) {
+		h.rememberBan(ctx, req, lastStrike)
+		return ctx, ErrBanned
+	}
+
+	dry := middleware.DryRun(ctx)
+	prev, found := h.exchange(req.InfoHash.RawString()+req.ID.RawString(), req, now, dry)
+	if !found || req.Event == bittorrent.Started {
+		// counters of new session start from zero
+		prev = transfer{}
+	}
+	if !dry {
+		h.checkCorruption(ctx, user, req, prev)
+	}
+	if !found || req.Event == bittorrent.Started {
+		return ctx, nil
+	}
+	elapsed := now - prev.time
+	up, upRate := exceeds(prev.uploaded, req.Uploaded, elapsed, h.cfg.MaxUploadRate)
+	down, downRate := exceeds(prev.downloaded, req.Downloaded, elapsed, h.cfg.MaxDownloadRate)
+	if !up && !down {
+		return ctx, nil
+	}
+	if dry {
+		strikes = h.nextStrikes(strikes, lastStrike, now)
+	} else {
+		var err error
+		if strikes, err = h.strike(ctx, user, now); err != nil {
+			logger.Error().Err(err).Str("user", user).Msg("unable to store violation")
+		}
+		logger.Warn().
+			Str("user", user).
+			Object("source", req.RequestPeer).
+			Stringer("infoHash", req.InfoHash).
+			Uint64("uploadRate", upRate).
+			Uint64("downloadRate", downRate).
+			Int("strikes", strikes).
+			Msg("impossible transfer reported")
+	}
+	if h.banned(strikes, now, now) {
+		h.rememberBan(ctx, req, now)
+		return ctx, ErrBanned
+	}
+	return ctx, nil
+}
+
+// checkCorruption flags announce if ratio of corrupt to downloaded bytes
+// since previous announce exceeds MaxCorruptRatio
+func (h *hook) checkCorruption(ctx context.Context, user string, req *bittorrent.AnnounceRequest, prev transfer) {
+	if h.cfg.MaxCorruptRatio <= 0 || req.Corrupt <= prev.corrupt {
+		return
+	}
+	corrupt := req.Corrupt - prev.corrupt
+	if corrupt < h.cfg.MinCorrupt {
+		return
+	}
+	var downloaded uint64
+	if req.Downloaded > prev.downloaded {
+		downloaded = req.Downloaded - prev.downloaded
+	}
+	// nothing is downloaded correctly
+	ratio := math.Inf(1)
+	if downloaded > 0 {
+		ratio = float64(corrupt) / float64(downloaded)
+	}
+	if ratio <= h.cfg.MaxCorruptRatio {
+		return
+	}
+	PromCorruptionReports.Inc()
+	logger.Warn().
+		Str("user", user).
+		Object("source", req.RequestPeer).
+		Stringer("infoHash", req.InfoHash).
+		Uint64("corrupt", corrupt).
+		Uint64("downloaded", downloaded).
+		Msg("excessive corruption reported")
+	if events.Enabled() {
+		events.Publish(events.Event{
+			Type:      events.TypeCorruption,
+			InfoHash:  req.InfoHash.String(),
+			PeerID:    req.ID.String(),
+			Addr:      privacy.String(req.GetFirst()),
+			Port:      req.Port,
+			RequestID: bittorrent.RequestID(ctx),
+			Reason:    fmt.Sprintf("%d corrupt bytes of %d downloaded", corrupt, downloaded),
+		})
+	}
+}
+
+func (h *hook) banned(strikes int, lastStrike, now int64) bool {
+	return h.cfg.StrikesToBan > 0 && strikes >= h.cfg.StrikesToBan &&
+		(h.cfg.BanDuration <= 0 || now-lastStrike <= int64(h.cfg.BanDuration))
+}
+
+// strikes loads number of violations and Unix time (in nanoseconds) of the last one.
+// Value in storage is stored in format `strikes:time`.
+func (h *hook) strikes(ctx context.Context, user string) (strikes int, last int64) {
+	b, err := h.storage.Load(ctx, h.cfg.StorageCtx, user)
+	if err != nil {
+		logger.Error().Err(err).Str("user", user).Msg("unable to load violations")
+		return
+	}
+	return parseStrikes(b)
+}
+
+// parseStrikes decodes violations stored in format `strikes:last strike time`
+func parseStrikes(b []byte) (strikes int, last int64) {
+	if len(b) > 0 {
+		s, t, _ := strings.Cut(string(b), ":")
+		strikes, _ = strconv.Atoi(s)
+		last, _ = strconv.ParseInt(t, 10, 64)
+	}
+	return
+}
+
+// nextStrikes returns number of strikes after violation at now,
+// strikes older than BanDuration are forgotten
+func (h *hook) nextStrikes(strikes int, last, now int64) int {
+	if h.cfg.BanDuration > 0 && now-last > int64(h.cfg.BanDuration) {
+		strikes = 0
+	}
+	return strikes + 1
+}
+
+// strike increments stored violations of user with storage.Update,
+// so concurrent violations (from other tracker instances too)
+// are not lost, and returns the number of strikes
+func (h *hook) strike(ctx context.Context, user string, now int64) (strikes int, err error) {
+	err = storage.Update(ctx, h.storage, h.cfg.StorageCtx, user, func(old []byte) ([]byte, error) {
+		prev, last := parseStrikes(old)
+		strikes = h.nextStrikes(prev, last, now)
+		return []byte(strconv.Itoa(strikes) + ":" + strconv.FormatInt(now, 10)), nil
+	})
+	return
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't report transfer.
+	return ctx, nil
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.PeerLifetime / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			cutoff := timecache.Now().Add(-h.cfg.PeerLifetime).UnixNano()
+			h.Lock()
+			for k, tr := range h.last {
+				if tr.time < cutoff {
+					delete(h.last, k)
+				}
+			}
+			h.Unlock()
+		}
+	}
+}
+
+// Erase deletes violations of user (or address, if user is not provided
+// in request) and transfers remembered for peer ID
+func (h *hook) Erase(ctx context.Context, s middleware.Subject) (middleware.ErasureReport, error) {
+	var keys []string
+	if len(s.User) > 0 && len(h.cfg.UserParam) > 0 {
+		keys = append(keys, s.User)
+	}
+	if s.Addr.IsValid() {
+		keys = append(keys, s.Addr.Unmap().String())
+	}
+	report := middleware.ErasureReport{}
+	if s.PeerID != (bittorrent.PeerID{}) {
+		id := s.PeerID.RawString()
+		h.Lock()
+		for k := range h.last {
+			if strings.HasSuffix(k, id) {
+				delete(h.last, k)
+				report["sessions"]++
+			}
+		}
+		h.Unlock()
+	}
+	n, err := middleware.EraseKeys(ctx, h.storage, h.cfg.StorageCtx, keys...)
+	report["violations"] = n
+	return report, err
+}
+
+// Close stops stale transfers collection
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
@@ -0,0 +1,167 @@
+package cheatdetect
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/events"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func newRequest(id byte, uploaded uint64) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("11111111111111111111"),
+		Uploaded: uploaded,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"max_upload_rate": 1000, "strikes_to_ban": 2}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+
+	// first announce is not compared with anything
+	_, err = h.HandleAnnounce(ctx, newRequest(1, 1<<30), resp)
+	require.Nil(t, err)
+	// possible delta
+	_, err = h.HandleAnnounce(ctx, newRequest(1, 1<<30+100), resp)
+	require.Nil(t, err)
+	// client restarted and reset counters
+	_, err = h.HandleAnnounce(ctx, newRequest(1, 0), resp)
+	require.Nil(t, err)
+
+	_, err = h.HandleAnnounce(ctx, newRequest(1, 1<<20), resp)
+	require.Nil(t, err)
+	strikes, _ := h.(*hook).strikes(ctx, "1.2.3.4")
+	require.Equal(t, 1, strikes)
+
+	_, err = h.HandleAnnounce(ctx, newRequest(1, 1<<21), resp)
+	require.Equal(t, ErrBanned, err)
+
+	// another peer of banned user
+	_, err = h.HandleAnnounce(ctx, newRequest(2, 0), resp)
+	require.Equal(t, ErrBanned, err)
+}
+
+func TestConcurrentStrikes(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	// instances sharing storage do not overwrite strikes of each other
+	const instances, strikes = 4, 25
+	var wg sync.WaitGroup
+	for range instances {
+		h, err := build(conf.MapConfig{"max_upload_rate": 1000, "strikes_to_ban": 1000}, ps)
+		require.Nil(t, err)
+		defer h.(*hook).Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range strikes {
+				_, err := h.(*hook).strike(context.Background(), "1.2.3.4", time.Now().UnixNano())
+				require.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	n, _ := (&hook{storage: ps, cfg: Config{StorageCtx: DefaultStorageCtx}}).strikes(context.Background(), "1.2.3.4")
+	require.Equal(t, instances*strikes, n)
+}
+
+func TestCorruption(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"max_corrupt_ratio": 0.5, "min_corrupt": 100, "strikes_to_ban": 1}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	sub := events.Subscribe(10, events.Filter{Types: []string{events.TypeCorruption}})
+	defer sub.Close()
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+	reports := metricValue(PromCorruptionReports)
+	announce := func(downloaded, corrupt uint64) {
+		req := newRequest(1, 0)
+		req.Downloaded, req.Corrupt = downloaded, corrupt
+		_, err := h.HandleAnnounce(ctx, req, resp)
+		// corruption is not violation
+		require.Nil(t, err)
+	}
+	// less than min_corrupt
+	announce(10, 50)
+	// ratio is less than max_corrupt_ratio
+	announce(1000, 200)
+	require.Equal(t, reports, metricValue(PromCorruptionReports))
+
+	announce(1100, 400)
+	require.Equal(t, reports+1, metricValue(PromCorruptionReports))
+	e := <-sub.C
+	require.Equal(t, bittorrent.InfoHash("11111111111111111111").String(), e.InfoHash)
+	require.Equal(t, "200 corrupt bytes of 100 downloaded", e.Reason)
+	strikes, _ := h.(*hook).strikes(ctx, "1.2.3.4")
+	require.Zero(t, strikes)
+}
+
+func TestErase(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"max_upload_rate": 1000, "strikes_to_ban": 2}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(ctx, newRequest(1, 0), resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, newRequest(1, 1<<20), resp)
+	require.Nil(t, err)
+
+	report, err := h.(middleware.Eraser).Erase(ctx, middleware.Subject{
+		Addr:   netip.MustParseAddr("1.2.3.4"),
+		PeerID: bittorrent.PeerID{1},
+	})
+	require.Nil(t, err)
+	require.Equal(t, middleware.ErasureReport{"violations": 1, "sessions": 1}, report)
+	strikes, _ := h.(*hook).strikes(ctx, "1.2.3.4")
+	require.Equal(t, 0, strikes)
+	require.Empty(t, h.(*hook).last)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{"strikes_to_ban": 1}, nil)
+	require.ErrorIs(t, err, errNoLimits)
+}
+
+// metricValue returns current value of counter or gauge
+func metricValue(m prometheus.Metric) float64 {
+	var out dto.Metric
+	_ = m.Write(&out)
+	return out.GetCounter().GetValue() + out.GetGauge().GetValue()
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/middleware"
 	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/replica"
 	"github.com/sot-tech/mochi/storage"
 )
 
@@ -21,7 +22,7 @@ func init() {
 }
 
 // ErrClientUnapproved is the error returned when a client's PeerID is invalid.
-var ErrClientUnapproved = bittorrent.ClientError("client not allowed by mochi")
+var ErrClientUnapproved = bittorrent.NewClientError(bittorrent.ReasonUnapprovedClient, "client not allowed by mochi")
 
 // Config represents all the values required by this middleware to validate
 // peers based on their BitTorrent client ID.
@@ -30,14 +31,25 @@ type Config struct {
 	ClientIDList []string `cfg:"client_id_list"`
 	// If Invert set to true, all client IDs stored in ClientIDList should be blacklisted.
 	Invert bool
+	// Replica is the name of replicated set. If set, list may be modified
+	// through admin API and is synchronized with other instances.
+	Replica string
 }
 
 type hook struct {
 	clientIDs map[ClientID]any
+	set       *replica.Set
 	invert    bool
 }
 
-func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+func normalizeClientID(s string) (string, error) {
+	if len(s) != 6 {
+		return "", errors.New("client ID " + s + " must be 6 bytes")
+	}
+	return s, nil
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
 	var cfg Config
 
 	if err := config.Unmarshal(&cfg); err != nil {
@@ -49,6 +61,21 @@ func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error
 		invert:    cfg.Invert,
 	}
 
+	if len(cfg.Replica) > 0 {
+		var err error
+		if h.set, err = replica.NewSet(replica.SetConfig{
+			Name:      cfg.Replica,
+			Storage:   st,
+			Normalize: normalizeClientID,
+		}); err == nil {
+			err = h.set.Seed(cfg.ClientIDList...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", Name, err)
+		}
+		return h, nil
+	}
+
 	for _, cidString := range cfg.ClientIDList {
 		cidBytes := []byte(cidString)
 		if len(cidBytes) != 6 {
@@ -65,7 +92,14 @@ func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error
 // that means that ClientID is blacklisted.
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
 	var err error
-	if _, contains := h.clientIDs[NewClientID(req.ID)]; contains == h.invert {
+	cid := NewClientID(req.ID)
+	var contains bool
+	if h.set != nil {
+		contains = h.set.Contains(string(cid[:]))
+	} else {
+		_, contains = h.clientIDs[cid]
+	}
+	if contains == h.invert {
 		err = ErrClientUnapproved
 	}
 
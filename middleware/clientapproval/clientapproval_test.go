@@ -9,6 +9,7 @@ import (
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/replica"
 )
 
 var cases = []struct {
@@ -77,3 +78,22 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestReplica(t *testing.T) {
+	h, err := build(conf.MapConfig{"client_id_list": []string{"010203"}, "replica": "clients"}, nil)
+	require.Nil(t, err)
+	set := replica.Lookup("clients")
+	require.NotNil(t, set)
+	require.NotNil(t, set.Add("0102"))
+
+	peerID, err := bittorrent.NewPeerID([]byte("12345678900000000000"))
+	require.Nil(t, err)
+	req := &bittorrent.AnnounceRequest{}
+	req.ID = peerID
+	_, err = h.HandleAnnounce(context.Background(), req, nil)
+	require.Equal(t, ErrClientUnapproved, err)
+
+	require.Nil(t, set.Add("123456"))
+	_, err = h.HandleAnnounce(context.Background(), req, nil)
+	require.Nil(t, err)
+}
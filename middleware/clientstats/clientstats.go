@@ -0,0 +1,294 @@
+// Package clientstats implements a Hook that maintains rolling aggregates of
+// announces by client software, country and address family, exported
+// as Prometheus metrics and via admin API.
+package clientstats
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/bittorrent/clientid"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/mmdb"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "client statistics"
+
+const (
+	defaultWindow    = time.Hour
+	defaultBuckets   = 12
+	defaultMaxLabels = 1000
+
+	// labelUnknown is used if value can not be determined
+	labelUnknown = "unknown"
+	// labelOther is used if number of distinct values exceeded MaxLabels
+	labelOther = "other"
+)
+
+// Dimensions of aggregates
+const (
+	DimensionClient  = "client"
+	DimensionCountry = "country"
+	DimensionFamily  = "family"
+)
+
+var (
+	logger = log.NewLogger("middleware/client statistics")
+
+	dimensions = []string{DimensionClient, DimensionCountry, DimensionFamily}
+
+	// PromAnnounces is a gauge of announces made during rolling window
+	// by client, country or address family
+	PromAnnounces = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mochi_middleware_client_stats_announces",
+		Help: "The number of announces during rolling window by dimension (client, country, family)",
+	}, []string{"dimension", "value"})
+)
+
+func init() {
+	prometheus.MustRegister(PromAnnounces)
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Window is the period of rolling aggregates.
+	Window time.Duration
+	// Buckets is the number of parts of Window, aggregates are shifted
+	// every Window/Buckets.
+	Buckets int
+	// CountryDatabase is the path to MaxMind GeoLite2-Country database file (mmdb).
+	// If empty, countries are not aggregated.
+	CountryDatabase string `cfg:"country_database"`
+	// MaxLabels is the maximum number of distinct values of one dimension,
+	// values over the limit are aggregated as `other`.
+	MaxLabels int `cfg:"max_labels"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.Window <= 0 {
+		validCfg.Window = defaultWindow
+		logger.Warn().
+			Str("name", "Window").
+			Dur("provided", cfg.Window).
+			Dur("default", validCfg.Window).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Buckets <= 0 {
+		validCfg.Buckets = defaultBuckets
+		logger.Warn().
+			Str("name", "Buckets").
+			Int("provided", cfg.Buckets).
+			Int("default", validCfg.Buckets).
+			Msg("falling back to default configuration")
+	}
+	if cfg.MaxLabels <= 0 {
+		validCfg.MaxLabels = defaultMaxLabels
+		logger.Warn().
+			Str("name", "MaxLabels").
+			Int("provided", cfg.MaxLabels).
+			Int("default", validCfg.MaxLabels).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	cfg = cfg.Validate()
+	h := &hook{
+		cfg:     cfg,
+		buckets: make([]aggregate, cfg.Buckets),
+		closed:  make(chan any),
+	}
+	for i := range h.buckets {
+		h.buckets[i] = newAggregate()
+	}
+	h.totals = newAggregate()
+	if len(cfg.CountryDatabase) > 0 {
+		var err error
+		if h.countries, err = mmdb.Open(cfg.CountryDatabase); err != nil {
+			return nil, fmt.Errorf("middleware %s: unable to open country database: %w", Name, err)
+		}
+	}
+	admin.Handle(http.MethodGet, "/stats/clients", h.handleGetStats)
+	go h.run()
+	return h, nil
+}
+
+// aggregate holds announce counters by dimension and value
+type aggregate map[string]map[string]uint64
+
+func newAggregate() aggregate {
+	a := make(aggregate, len(dimensions))
+	for _, d := range dimensions {
+		a[d] = make(map[string]uint64)
+	}
+	return a
+}
+
+type hook struct {
+	cfg       Config
+	countries *mmdb.Reader
+
+	// buckets ring of aggregates, current is the one where announces are counted
+	buckets []aggregate
+	current int
+	// totals sum of all buckets except current, updated on every shift
+	totals aggregate
+	sync.Mutex
+
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// clientName returns client name and version decoded from peer ID
+// (i.e. `Transmission 3.0` for `-TR3000-...`)
+func clientName(id bittorrent.PeerID) string {
+	if c, ok := clientid.Parse(id); ok {
+		return c.String()
+	}
+	return labelUnknown
+}
+
+func (h *hook) country(addr netip.Addr) string {
+	v, found, err := h.countries.Lookup(addr)
+	if err != nil || !found {
+		return labelUnknown
+	}
+	if m, ok := v.(map[string]any); ok {
+		if c, ok := m["country"].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok && len(code) > 0 {
+				return code
+			}
+		}
+	}
+	return labelUnknown
+}
+
+// HandleAnnounce counts announce. May be used as post hook.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if middleware.DryRun(ctx) {
+		return ctx, nil
+	}
+	addr := req.GetFirst()
+	family := "ipv4"
+	if addr.Is6() {
+		family = "ipv6"
+	}
+	values := map[string]string{
+		DimensionClient: clientName(req.ID),
+		DimensionFamily: family,
+	}
+	if h.countries != nil {
+		values[DimensionCountry] = h.country(addr)
+	}
+	h.Lock()
+	cur := h.buckets[h.current]
+	for d, v := range values {
+		if _, exists := cur[d][v]; !exists && h.totals[d][v] == 0 && len(cur[d])+len(h.totals[d]) >= h.cfg.MaxLabels {
+			v = labelOther
+		}
+		cur[d][v]++
+	}
+	h.Unlock()
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not counted.
+	return ctx, nil
+}
+
+// Stats returns announce counters during Window
+func (h *hook) Stats() aggregate {
+	out := newAggregate()
+	h.Lock()
+	defer h.Unlock()
+	for _, a := range []aggregate{h.totals, h.buckets[h.current]} {
+		for d, vv := range a {
+			for v, n := range vv {
+				out[d][v] += n
+			}
+		}
+	}
+	return out
+}
+
+// shift starts new bucket, drops the oldest one and recalculates totals
+func (h *hook) shift() {
+	h.Lock()
+	h.current = (h.current + 1) % len(h.buckets)
+	h.buckets[h.current] = newAggregate()
+	h.totals = newAggregate()
+	for i, b := range h.buckets {
+		if i == h.current {
+			continue
+		}
+		for d, vv := range b {
+			for v, n := range vv {
+				h.totals[d][v] += n
+			}
+		}
+	}
+	h.Unlock()
+	h.export()
+}
+
+// export sets Prometheus gauges to current statistics
+func (h *hook) export() {
+	stats := h.Stats()
+	PromAnnounces.Reset()
+	for d, vv := range stats {
+		for v, n := range vv {
+			PromAnnounces.WithLabelValues(d, v).Set(float64(n))
+		}
+	}
+}
+
+func (h *hook) run() {
+	t := time.NewTicker(h.cfg.Window / time.Duration(h.cfg.Buckets))
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.shift()
+		}
+	}
+}
+
+func (h *hook) handleGetStats(ctx *fasthttp.RequestCtx) {
+	admin.WriteJSON(ctx, fasthttp.StatusOK, map[string]any{
+		"window":     h.cfg.Window.String(),
+		"statistics": h.Stats(),
+	})
+}
+
+// Close stops aggregates shifting
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
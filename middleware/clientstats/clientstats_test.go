@@ -0,0 +1,89 @@
+package clientstats
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/mmdb/test"
+)
+
+func writeDatabase(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	require.Nil(t, os.WriteFile(path, test.Build("GeoLite2-Country", map[netip.Prefix]any{
+		netip.MustParsePrefix("1.2.3.0/24"): map[string]any{
+			"country": map[string]any{"iso_code": "DE"},
+		},
+		netip.MustParsePrefix("2001:db8::/32"): map[string]any{
+			"country": map[string]any{"iso_code": "NL"},
+		},
+	}), 0o600))
+	return path
+}
+
+func newRequest(id, addr string) *bittorrent.AnnounceRequest {
+	req := &bittorrent.AnnounceRequest{
+		RequestPeer: bittorrent.RequestPeer{
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}},
+		},
+	}
+	copy(req.ID[:], id)
+	return req
+}
+
+func TestClientName(t *testing.T) {
+	for id, name := range map[string]string{
+		"-TR3000-123456789012":       "Transmission 3.0",
+		"-qB4500-123456789012":       "qBittorrent 4.5",
+		"M7-2-2--123456789012":       "Mainline 7.2.2",
+		"\x00\x01":                   labelUnknown,
+		"-\x01\x02\x03\x04\x05\x06-": labelUnknown,
+	} {
+		var pid bittorrent.PeerID
+		copy(pid[:], id)
+		require.Equal(t, name, clientName(pid), id)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"country_database": writeDatabase(t),
+		"buckets":          2,
+		"max_labels":       2,
+	}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	sh := h.(*hook)
+
+	ctx := context.Background()
+	for _, r := range [][2]string{
+		{"-TR3000-123456789012", "1.2.3.4"},
+		{"-TR3000-123456789012", "2001:db8::1"},
+		{"-qB4500-123456789012", "5.6.7.8"},
+		{"-DE2000-123456789012", "1.2.3.5"},
+	} {
+		_, err = h.HandleAnnounce(ctx, newRequest(r[0], r[1]), nil)
+		require.Nil(t, err)
+	}
+
+	expected := aggregate{
+		DimensionClient:  {"Transmission 3.0": 2, "qBittorrent 4.5": 1, labelOther: 1},
+		DimensionCountry: {"DE": 2, "NL": 1, labelOther: 1},
+		DimensionFamily:  {"ipv4": 3, "ipv6": 1},
+	}
+	require.Equal(t, expected, sh.Stats())
+
+	// aggregates are kept during whole window
+	sh.shift()
+	require.Equal(t, expected, sh.Stats())
+
+	sh.shift()
+	require.Equal(t, newAggregate(), sh.Stats())
+}
@@ -0,0 +1,179 @@
+// Package dedup implements a Hook that detects identical announces
+// of the same peer sent within short window (i.e. by misbehaving clients,
+// which retry requests) and responds with cached response without
+// touching storage.
+package dedup
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "announce dedup"
+
+const defaultWindow = 5 * time.Second
+
+var (
+	logger = log.NewLogger("middleware/announce dedup")
+
+	// PromCollapsedAnnounces is a counter of announces responded from cache
+	PromCollapsedAnnounces = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mochi_middleware_dedup_collapsed_announces_total",
+		Help: "The number of duplicate announces responded from cache",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(PromCollapsedAnnounces)
+	middleware.RegisterBuilder(Name, build)
+}
+
+type collapsed struct{}
+
+// collapsedKey marks announce context responded from cache
+var collapsedKey = collapsed{}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Window is the period while repeated identical announce
+	// is responded from cache.
+	Window time.Duration
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg.Window <= 0 {
+		logger.Warn().
+			Str("name", "Window").
+			Dur("provided", cfg.Window).
+			Dur("default", defaultWindow).
+			Msg("falling back to default configuration")
+		cfg.Window = defaultWindow
+	}
+	h := &hook{
+		cfg:    cfg,
+		cache:  make(map[string]entry),
+		closed: make(chan any),
+	}
+	go h.runGC()
+	return h, nil
+}
+
+type entry struct {
+	resp    bittorrent.AnnounceResponse
+	created int64
+}
+
+type hook struct {
+	cfg   Config
+	cache map[string]entry
+	sync.RWMutex
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// announceKey builds key from all announce fields, which affect
+// the response or storage
+func announceKey(req *bittorrent.AnnounceRequest) string {
+	var sb strings.Builder
+	sb.WriteString(req.InfoHash.RawString())
+	sb.WriteString(req.ID.RawString())
+	b := make([]byte, 0, 8*3+4+2+1)
+	b = binary.BigEndian.AppendUint64(b, req.Uploaded)
+	b = binary.BigEndian.AppendUint64(b, req.Downloaded)
+	b = binary.BigEndian.AppendUint64(b, req.Left)
+	b = binary.BigEndian.AppendUint32(b, req.NumWant)
+	b = binary.BigEndian.AppendUint16(b, req.Port)
+	b = append(b, byte(req.Event))
+	sb.Write(b)
+	for _, a := range req.RequestAddresses {
+		sb.Write(a.AsSlice())
+	}
+	return sb.String()
+}
+
+// HandleAnnounce fills response from cache if the same announce
+// was responded within Window and skips the remaining hooks, response
+// generation and storage update. Announces with events are never collapsed.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Event != bittorrent.None {
+		return ctx, nil
+	}
+	h.RLock()
+	e, found := h.cache[announceKey(req)]
+	h.RUnlock()
+	if !found || timecache.NowUnixNano()-e.created > int64(h.cfg.Window) {
+		return ctx, nil
+	}
+	*resp = e.resp
+	resp.IPv4Peers, resp.IPv6Peers = slices.Clone(e.resp.IPv4Peers), slices.Clone(e.resp.IPv6Peers)
+	PromCollapsedAnnounces.Inc()
+	logger.Debug().Object("source", req.RequestPeer).Msg("duplicate announce collapsed")
+	ctx = context.WithValue(ctx, collapsedKey, true)
+	ctx = context.WithValue(ctx, middleware.ResponseCompleteKey, true)
+	ctx = context.WithValue(ctx, middleware.SkipSwarmInteractionKey, true)
+	return ctx, nil
+}
+
+// AnnounceResponded implements middleware.ResponseObserver
+func (h *hook) AnnounceResponded(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	if req.Event != bittorrent.None || ctx.Value(collapsedKey) != nil {
+		return
+	}
+	e := entry{resp: *resp, created: timecache.NowUnixNano()}
+	e.resp.IPv4Peers, e.resp.IPv6Peers = slices.Clone(resp.IPv4Peers), slices.Clone(resp.IPv6Peers)
+	h.Lock()
+	h.cache[announceKey(req)] = e
+	h.Unlock()
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are cheap and not collapsed.
+	return ctx, nil
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.Window)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			cutoff := timecache.Now().Add(-h.cfg.Window).UnixNano()
+			h.Lock()
+			for k, e := range h.cache {
+				if e.created < cutoff {
+					delete(h.cache, k)
+				}
+			}
+			h.Unlock()
+		}
+	}
+}
+
+// Close stops stale responses collection
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
@@ -0,0 +1,92 @@
+package dedup
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func newRequest(id byte) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("11111111111111111111"),
+		Left:     100,
+		NumWant:  10,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3." + string('0'+id))}},
+		},
+	}
+}
+
+// countingHook counts announces it handled
+type countingHook struct {
+	announces int
+}
+
+func (h *countingHook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.announces++
+	return ctx, nil
+}
+
+func (h *countingHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"window": "1m"}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHash("11111111111111111111")
+	next := new(countingHook)
+	l := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{h, next}, nil, nil)
+
+	// another peer in swarm
+	require.Nil(t, ps.PutLeecher(ctx, ih, newRequest(2).Peers()[0]))
+
+	before := metricValue(PromCollapsedAnnounces)
+	_, first, err := l.HandleAnnounce(ctx, newRequest(1))
+	require.Nil(t, err)
+	require.Equal(t, newRequest(2).Peers(), first.IPv4Peers)
+
+	// swarm changed, but response is the same
+	require.Nil(t, ps.DeleteLeecher(ctx, ih, newRequest(2).Peers()[0]))
+	outCtx, second, err := l.HandleAnnounce(ctx, newRequest(1))
+	require.Nil(t, err)
+	require.Equal(t, first, second)
+	require.Equal(t, before+1, metricValue(PromCollapsedAnnounces))
+	// hooks after dedup do not process cached response
+	require.Equal(t, 1, next.announces)
+	// swarm interaction is skipped in post hooks too
+	require.NotNil(t, bittorrent.RemapRouteParamsToBgContext(outCtx).Value(middleware.SkipSwarmInteractionKey))
+
+	// changed announce is not collapsed
+	req := newRequest(1)
+	req.Uploaded = 1
+	_, third, err := l.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.NotEqual(t, first.IPv4Peers, third.IPv4Peers)
+}
+
+// metricValue returns current value of counter or gauge
+func metricValue(m prometheus.Metric) float64 {
+	var out dto.Metric
+	_ = m.Write(&out)
+	return out.GetCounter().GetValue() + out.GetGauge().GetValue()
+}
@@ -0,0 +1,163 @@
+// Package deprecation implements a Hook that points announces of
+// configured torrents to replacement trackers, so swarms may be
+// migrated to new announce URL gracefully.
+package deprecation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/replica"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "deprecation"
+
+const defaultMessage = "tracker is deprecated for this torrent, use"
+
+var (
+	logger = log.NewLogger("middleware/deprecation")
+
+	errNoTrackers = errors.New("replacement trackers not provided")
+	errNoHashes   = errors.New("neither hash_list nor replica provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to deprecate tracker for torrents.
+type Config struct {
+	// HashList is the list of HEX-encoded InfoHashes, for which tracker is deprecated.
+	HashList []string `cfg:"hash_list"`
+	// Replica is the name of replicated set of InfoHashes, which may be
+	// modified through admin API and is synchronized with other instances.
+	// HashList is the initial content of set.
+	Replica string
+	// Trackers are announce URLs of replacement trackers.
+	Trackers []string
+	// Message is the text, which precedes list of replacement trackers.
+	Message string
+	// FailAfter is the moment, since which announces are rejected.
+	// Before that, message is sent as warning and announces are processed.
+	// If not set, announces are rejected immediately.
+	FailAfter time.Time `cfg:"fail_after"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.Trackers) == 0 {
+		err = errNoTrackers
+		return
+	}
+	if len(cfg.HashList) == 0 && len(cfg.Replica) == 0 {
+		err = errNoHashes
+		return
+	}
+	if len(cfg.Message) == 0 {
+		validCfg.Message = defaultMessage
+		logger.Warn().
+			Str("name", "Message").
+			Str("provided", cfg.Message).
+			Str("default", validCfg.Message).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+type hook struct {
+	hashes    map[bittorrent.InfoHash]struct{}
+	set       *replica.Set
+	message   string
+	failAfter int64
+}
+
+// normalizeHash returns HEX-encoded hash, V2 hashes are truncated,
+// so hybrid torrents are matched by both hashes
+func normalizeHash(s string) (string, error) {
+	ih, err := bittorrent.NewInfoHashString(s)
+	if err != nil {
+		return "", err
+	}
+	return ih.TruncateV1().String(), nil
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		message: cfg.Message + ": " + strings.Join(cfg.Trackers, " "),
+	}
+	if !cfg.FailAfter.IsZero() {
+		h.failAfter = cfg.FailAfter.Unix()
+	}
+	if len(cfg.Replica) > 0 {
+		if h.set, err = replica.NewSet(replica.SetConfig{
+			Name:      cfg.Replica,
+			Storage:   st,
+			Normalize: normalizeHash,
+		}); err == nil {
+			err = h.set.Seed(cfg.HashList...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", Name, err)
+		}
+		return h, nil
+	}
+	h.hashes = make(map[bittorrent.InfoHash]struct{}, len(cfg.HashList))
+	for _, s := range cfg.HashList {
+		ih, err := bittorrent.NewInfoHashString(s)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %s: %w", Name, s, err)
+		}
+		h.hashes[ih.TruncateV1()] = struct{}{}
+	}
+	return h, nil
+}
+
+func (h *hook) deprecated(ih bittorrent.InfoHash) (found bool) {
+	ih = ih.TruncateV1()
+	if h.set != nil {
+		found = h.set.Contains(ih.String())
+	} else {
+		_, found = h.hashes[ih]
+	}
+	return
+}
+
+// HandleAnnounce rejects announce of deprecated torrent with message, which
+// contains replacement trackers, or adds this message as warning
+// if Config.FailAfter is not reached yet.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.deprecated(req.InfoHash) {
+		return ctx, nil
+	}
+	if h.failAfter > 0 && timecache.NowUnix() < h.failAfter {
+		resp.AddWarning(h.message)
+		return ctx, nil
+	}
+	return ctx, bittorrent.NewClientError(bittorrent.ReasonDeprecated, h.message)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes of deprecated torrents are still served, so statistics are available while migrating.
+	return ctx, nil
+}
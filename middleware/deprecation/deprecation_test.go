@@ -0,0 +1,67 @@
+package deprecation
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/replica"
+)
+
+const (
+	v1Hash = "0123456789abcdef0123456789abcdef01234567"
+	v2Hash = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+func announce(t *testing.T, h any, hash string) (*bittorrent.AnnounceResponse, error) {
+	ih, err := bittorrent.NewInfoHashString(hash)
+	require.Nil(t, err)
+	resp := new(bittorrent.AnnounceResponse)
+	_, err = h.(*hook).HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, resp)
+	return resp, err
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	trackers := []string{"https://new.example/announce", "udp://new.example:6969/announce"}
+	h, err := build(conf.MapConfig{"hash_list": []string{v2Hash}, "trackers": trackers}, nil)
+	require.Nil(t, err)
+
+	_, err = announce(t, h, v1Hash)
+	require.Equal(t, bittorrent.NewClientError(bittorrent.ReasonDeprecated, defaultMessage+": "+strings.Join(trackers, " ")), err)
+	_, err = announce(t, h, strings.Repeat("f", 40))
+	require.Nil(t, err)
+
+	h, err = build(conf.MapConfig{
+		"hash_list":  []string{v1Hash},
+		"trackers":   trackers[:1],
+		"message":    "moved",
+		"fail_after": time.Now().Add(time.Hour),
+	}, nil)
+	require.Nil(t, err)
+	resp, err := announce(t, h, v2Hash)
+	require.Nil(t, err)
+	require.Equal(t, "moved: "+trackers[0], resp.WarningMessage)
+}
+
+func TestReplica(t *testing.T) {
+	h, err := build(conf.MapConfig{"replica": "deprecated", "trackers": []string{"https://new.example/announce"}}, nil)
+	require.Nil(t, err)
+	_, err = announce(t, h, v1Hash)
+	require.Nil(t, err)
+
+	require.Nil(t, replica.Lookup("deprecated").Add(v2Hash))
+	_, err = announce(t, h, v1Hash)
+	require.NotNil(t, err)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{"hash_list": []string{v1Hash}}, nil)
+	require.ErrorIs(t, err, errNoTrackers)
+	_, err = build(conf.MapConfig{"trackers": []string{"https://new.example/announce"}}, nil)
+	require.ErrorIs(t, err, errNoHashes)
+}
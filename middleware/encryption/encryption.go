@@ -0,0 +1,218 @@
+// Package encryption implements a Hook that tracks support of encrypted
+// connections (Message Stream Encryption) announced by peers and ranks peers
+// in announce responses, so announcers, which require encryption, receive
+// peers able to accept encrypted connections first.
+package encryption
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "encryption"
+
+const (
+	defaultPeerLifetime = storage.DefaultPeerLifetime
+	// storageCtx is the name of storage context where support levels are stored
+	storageCtx = "MW_ENCRYPTION"
+)
+
+var (
+	logger = log.NewLogger("middleware/encryption")
+
+	errStorageNotProvided = errors.New("storage not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to track encryption support of peers.
+type Config struct {
+	// PeerLifetime is the period after which inactive peer
+	// is not tracked anymore. Should be the same as storage's peer_lifetime.
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+	// ExcludePlain drops peers, which did not announce support of encryption,
+	// from responses to announcers, which require it. If not set,
+	// such peers are returned after encryption-capable ones.
+	ExcludePlain bool `cfg:"exclude_plain"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.PeerLifetime <= 0 {
+		validCfg.PeerLifetime = defaultPeerLifetime
+		logger.Warn().
+			Str("name", "PeerLifetime").
+			Dur("provided", cfg.PeerLifetime).
+			Dur("default", validCfg.PeerLifetime).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if st == nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errStorageNotProvided)
+	}
+	return &hook{cfg: cfg.Validate(), storage: st}, nil
+}
+
+type entry struct {
+	crypto bittorrent.Crypto
+	mtime  int64
+}
+
+// entryLen is the length of stored entry: support level of encryption
+// and time of the last announce
+const entryLen = 1 + 8
+
+// peerKey returns storage key of peer in swarm ih:
+// info hash, peer ID, IPv6 (or mapped IPv4) address and port
+func peerKey(ih bittorrent.InfoHash, p bittorrent.Peer) string {
+	ih = ih.TruncateV1()
+	b := make([]byte, 0, len(ih)+bittorrent.PeerIDLen+16+2)
+	b = append(b, ih...)
+	b = append(b, p.ID[:]...)
+	a16 := p.Addr().As16()
+	b = append(b, a16[:]...)
+	b = binary.BigEndian.AppendUint16(b, p.Port())
+	return string(b)
+}
+
+// decodeEntry decodes stored entry, entry of peer announced
+// before cutoff is not valid
+func decodeEntry(b []byte, cutoff int64) (e entry, ok bool) {
+	if len(b) < entryLen {
+		return
+	}
+	e = entry{crypto: bittorrent.Crypto(b[0]), mtime: int64(binary.BigEndian.Uint64(b[1:]))}
+	return e, e.mtime > cutoff
+}
+
+func (e entry) encode() []byte {
+	return binary.BigEndian.AppendUint64([]byte{byte(e.crypto)}, uint64(e.mtime))
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.DataStorage
+}
+
+// load returns stored entries of peers of swarm ih
+func (h *hook) load(ctx context.Context, ih bittorrent.InfoHash, peers []bittorrent.Peer) (map[bittorrent.Peer]entry, error) {
+	known, cutoff := make(map[bittorrent.Peer]entry), timecache.NowUnixNano()-int64(h.cfg.PeerLifetime)
+	for _, p := range peers {
+		b, err := h.storage.Load(ctx, storageCtx, peerKey(ih, p))
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := decodeEntry(b, cutoff); ok {
+			known[p] = e
+		}
+	}
+	return known, nil
+}
+
+// HandleAnnounce stores encryption support of peer, peers without
+// support and stopped peers are not tracked. Support level is stored
+// for every peer in storage, so it is shared between instances.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if middleware.DryRun(ctx) {
+		return ctx, nil
+	}
+	peers := req.Peers()
+	known, err := h.load(ctx, req.InfoHash, peers)
+	if err != nil {
+		return ctx, err
+	}
+	track, now := req.Crypto != bittorrent.CryptoNone && req.Event != bittorrent.Stopped, timecache.NowUnixNano()
+	// announce time of tracked peer is refreshed if half of lifetime passed
+	refresh := now - int64(h.cfg.PeerLifetime/2)
+	var put []storage.Entry
+	var del []string
+	for _, p := range peers {
+		e, exists := known[p]
+		if track && (!exists || e.crypto != req.Crypto || e.mtime <= refresh) {
+			put = append(put, storage.Entry{Key: peerKey(req.InfoHash, p), Value: entry{crypto: req.Crypto, mtime: now}.encode()})
+		} else if !track && exists {
+			del = append(del, peerKey(req.InfoHash, p))
+		}
+	}
+	if len(put) > 0 {
+		err = h.storage.Put(ctx, storageCtx, put...)
+	}
+	if len(del) > 0 {
+		err = errors.Join(err, h.storage.Delete(ctx, storageCtx, del...))
+	}
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to store encryption support")
+	}
+	return ctx, nil
+}
+
+// RankPeers implements middleware.PeerRanker. Peers able to accept encrypted
+// connections are moved to the beginning of response to announcers, which
+// require encryption, and peers, which require encryption, are moved to the
+// end of response to announcers, which did not announce its support.
+func (h *hook) RankPeers(ctx context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if req.Crypto == bittorrent.CryptoSupported || len(peers) == 0 {
+		return peers
+	}
+	known, err := h.load(ctx, req.InfoHash, peers)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to load encryption support")
+		return peers
+	}
+	if len(known) == 0 {
+		if req.Crypto == bittorrent.CryptoRequired && h.cfg.ExcludePlain {
+			return peers[:0]
+		}
+		return peers
+	}
+	last := bittorrent.CryptoRequired
+	if req.Crypto == bittorrent.CryptoRequired {
+		if h.cfg.ExcludePlain {
+			return slices.DeleteFunc(peers, func(p bittorrent.Peer) bool {
+				return known[p].crypto == bittorrent.CryptoNone
+			})
+		}
+		last = bittorrent.CryptoNone
+	}
+	slices.SortStableFunc(peers, func(a, b bittorrent.Peer) int {
+		return cmp.Compare(rank(known[a].crypto, last), rank(known[b].crypto, last))
+	})
+	return peers
+}
+
+// rank returns 1 if peer with crypto should be placed after other peers
+func rank(crypto, last bittorrent.Crypto) int {
+	if crypto == last {
+		return 1
+	}
+	return 0
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, nil
+}
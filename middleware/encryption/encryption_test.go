@@ -0,0 +1,115 @@
+package encryption
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	sm "github.com/sot-tech/mochi/storage/memory"
+)
+
+func newStorage(t *testing.T) storage.PeerStorage {
+	st, err := sm.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func newRequest(ih bittorrent.InfoHash, id byte, crypto bittorrent.Crypto) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Crypto:   crypto,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{1, 2, 3, id})}},
+		},
+	}
+}
+
+func TestRankPeers(t *testing.T) {
+	for _, exclude := range []bool{false, true} {
+		st := newStorage(t)
+		h, err := build(conf.MapConfig{"exclude_plain": exclude}, st)
+		require.Nil(t, err)
+		ranker := h.(*hook)
+
+		ctx := context.Background()
+		ih := bittorrent.InfoHash("11111111111111111111")
+		plain := newRequest(ih, 1, bittorrent.CryptoNone)
+		required := newRequest(ih, 2, bittorrent.CryptoRequired)
+		supported := newRequest(ih, 3, bittorrent.CryptoSupported)
+		for _, req := range []*bittorrent.AnnounceRequest{plain, required, supported} {
+			_, err = h.HandleAnnounce(ctx, req, nil)
+			require.Nil(t, err)
+		}
+		peers := []bittorrent.Peer{plain.Peers()[0], required.Peers()[0], supported.Peers()[0]}
+		rank := func(req *bittorrent.AnnounceRequest) []bittorrent.Peer {
+			return ranker.RankPeers(ctx, req, append([]bittorrent.Peer{}, peers...))
+		}
+
+		require.Equal(t, peers, rank(supported))
+		require.Equal(t, []bittorrent.Peer{peers[0], peers[2], peers[1]}, rank(plain))
+		if exclude {
+			require.Equal(t, []bittorrent.Peer{peers[1], peers[2]}, rank(required))
+		} else {
+			require.Equal(t, []bittorrent.Peer{peers[1], peers[2], peers[0]}, rank(required))
+		}
+
+		// stopped peers are not tracked
+		required.Event, supported.Event = bittorrent.Stopped, bittorrent.Stopped
+		for _, req := range []*bittorrent.AnnounceRequest{required, supported} {
+			_, err = h.HandleAnnounce(ctx, req, nil)
+			require.Nil(t, err)
+		}
+		known, err := ranker.load(ctx, ih, peers)
+		require.Nil(t, err)
+		require.Len(t, known, 0)
+		// entries of stopped peers are deleted
+		contains, err := st.Contains(ctx, storageCtx, peerKey(ih, peers[1]))
+		require.Nil(t, err)
+		require.False(t, contains)
+	}
+}
+
+func TestShared(t *testing.T) {
+	st := newStorage(t)
+	h1, err := build(conf.MapConfig{"exclude_plain": true}, st)
+	require.Nil(t, err)
+	h2, err := build(conf.MapConfig{"exclude_plain": true}, st)
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHash("11111111111111111111")
+	plain, supported := newRequest(ih, 1, bittorrent.CryptoNone), newRequest(ih, 2, bittorrent.CryptoSupported)
+	_, err = h1.HandleAnnounce(ctx, supported, nil)
+	require.Nil(t, err)
+	ctx, err = h2.HandleAnnounce(ctx, newRequest(ih, 3, bittorrent.CryptoRequired), nil)
+	require.Nil(t, err)
+	peers := []bittorrent.Peer{plain.Peers()[0], supported.Peers()[0]}
+	require.Equal(t, peers[1:], h2.(*hook).RankPeers(ctx, newRequest(ih, 3, bittorrent.CryptoRequired), append([]bittorrent.Peer{}, peers...)))
+}
+
+func TestExpire(t *testing.T) {
+	b := entry{crypto: bittorrent.CryptoSupported, mtime: 10}.encode()
+	e, ok := decodeEntry(b, 0)
+	require.True(t, ok)
+	require.Equal(t, entry{crypto: bittorrent.CryptoSupported, mtime: 10}, e)
+	_, ok = decodeEntry(b, 10)
+	require.False(t, ok)
+	_, ok = decodeEntry(nil, 0)
+	require.False(t, ok)
+}
+
+func TestPeerKey(t *testing.T) {
+	p := newRequest("11111111111111111111", 1, bittorrent.CryptoSupported).Peers()[0]
+	v2 := bittorrent.InfoHash("1111111111111111111111111111111\x00")
+	require.Len(t, peerKey("11111111111111111111", p), bittorrent.InfoHashV1Len+bittorrent.PeerIDLen+16+2)
+	require.NotEqual(t, peerKey("11111111111111111111", p), peerKey("22222222222222222222", p))
+	require.Equal(t, peerKey(v2.TruncateV1(), p), peerKey(v2, p))
+}
@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// ReportPeers is the ErasureReport key of deleted swarm peers
+// and ReportBans is the key of deleted RejectCache entries
+const (
+	ReportPeers = "peers"
+	ReportBans  = "bans"
+)
+
+var (
+	// ErrEmptySubject returned if none of Subject fields provided
+	ErrEmptySubject = errors.New("address, peer ID or user not provided")
+	// ErrEraseNotSupported returned if peer storage is not able
+	// to find peers of Subject
+	ErrEraseNotSupported = errors.New("storage does not support peers lookup")
+)
+
+// Subject identifies the owner of data deleted by Eraser.
+// Zero fields are not matched.
+type Subject struct {
+	Addr   netip.Addr
+	PeerID bittorrent.PeerID
+	// User is the value of request parameter, which identifies user (i.e. passkey)
+	User string
+}
+
+// IsZero checks if none of Subject fields provided
+func (s Subject) IsZero() bool {
+	return !s.Addr.IsValid() && s.PeerID == bittorrent.PeerID{} && len(s.User) == 0
+}
+
+func (s Subject) matches(p bittorrent.Peer) bool {
+	return (s.Addr.IsValid() && p.Addr().Unmap() == s.Addr.Unmap()) ||
+		(s.PeerID != bittorrent.PeerID{} && p.ID == s.PeerID)
+}
+
+// ErasureReport holds number of deleted records by kind
+type ErasureReport map[string]int
+
+func (r ErasureReport) merge(prefix string, other ErasureReport) {
+	for k, n := range other {
+		if n > 0 {
+			r[prefix+k] += n
+		}
+	}
+}
+
+// Eraser is implemented by hooks, which keep data related to peer's
+// address, peer ID or user, so that such data can be deleted on request.
+type Eraser interface {
+	// Erase deletes all data related to Subject and returns number
+	// of deleted records by kind (i.e. `points`, `violations`).
+	Erase(ctx context.Context, s Subject) (ErasureReport, error)
+}
+
+// EraseKeys deletes existing keys from storeCtx and returns
+// the number of deleted keys
+func EraseKeys(ctx context.Context, ds storage.DataStorage, storeCtx string, keys ...string) (n int, err error) {
+	for _, k := range keys {
+		var found bool
+		if found, err = ds.Contains(ctx, storeCtx, k); err != nil {
+			return
+		}
+		if found {
+			if err = ds.Delete(ctx, storeCtx, k); err != nil {
+				return
+			}
+			n++
+		}
+	}
+	return
+}
+
+// ErasePeers deletes all seeders and leechers of all swarms, which
+// have address or ID of Subject. Storage must implement storage.Dumper.
+func ErasePeers(ctx context.Context, ps storage.PeerStorage, s Subject) (n int, err error) {
+	d, ok := ps.(storage.Dumper)
+	if !ok {
+		return 0, ErrEraseNotSupported
+	}
+	type swarmPeer struct {
+		ih     bittorrent.InfoHash
+		peer   bittorrent.Peer
+		seeder bool
+	}
+	var found []swarmPeer
+	// peers are deleted after iteration, because storage
+	// may hold locks while calling fn
+	err = d.Dump(ctx, func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error {
+		if s.matches(peer) {
+			found = append(found, swarmPeer{ih, peer, seeder})
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, sp := range found {
+		if sp.seeder {
+			err = ps.DeleteSeeder(ctx, sp.ih, sp.peer)
+		} else {
+			err = ps.DeleteLeecher(ctx, sp.ih, sp.peer)
+		}
+		if err == nil {
+			n++
+		} else if !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// Erase deletes data related to Subject from RejectCache
+// and from all hooks of Logic, which implement Eraser.
+// Keys of hook's report are prefixed with hook name.
+// Errors of hooks do not interrupt erasure.
+func (l *Logic) Erase(ctx context.Context, s Subject) (ErasureReport, error) {
+	report := ErasureReport{}
+	if n := l.rejectCache.Erase(s); n > 0 {
+		report[ReportBans] = n
+	}
+	var errs []error
+	for _, e := range l.erasers {
+		r, err := e.Erase(ctx, s)
+		report.merge("", r)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+type eraseResponse struct {
+	Deleted ErasureReport `json:"deleted"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// EraseHandler creates admin API handler, which deletes peers
+// from all stores and data of all logics related to Subject, provided
+// in `addr`, `peer_id` (hex) or `user` query arguments.
+func EraseHandler(stores []storage.PeerStorage, logics ...*Logic) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		var s Subject
+		var err error
+		args := ctx.QueryArgs()
+		if v := args.Peek("addr"); len(v) > 0 {
+			if s.Addr, err = netip.ParseAddr(string(v)); err != nil {
+				admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+				return
+			}
+		}
+		if v := args.Peek("peer_id"); len(v) > 0 {
+			var id []byte
+			if id, err = hex.DecodeString(string(v)); err == nil {
+				s.PeerID, err = bittorrent.NewPeerID(id)
+			}
+			if err != nil {
+				admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+				return
+			}
+		}
+		s.User = string(args.Peek("user"))
+		if s.IsZero() {
+			admin.WriteError(ctx, fasthttp.StatusBadRequest, ErrEmptySubject)
+			return
+		}
+
+		report := ErasureReport{}
+		var errs []error
+		if s.Addr.IsValid() || s.PeerID != (bittorrent.PeerID{}) {
+			report[ReportPeers] = 0
+			for _, ps := range stores {
+				n, err := ErasePeers(ctx, ps, s)
+				report[ReportPeers] += n
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		for _, l := range logics {
+			r, err := l.Erase(ctx, s)
+			report.merge("", r)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		logger.Info().
+			Stringer("addr", privacy.Stringer(s.Addr)).
+			Stringer("peerID", s.PeerID).
+			Bool("user", len(s.User) > 0).
+			Interface("deleted", report).
+			Errs("errors", errs).
+			Msg("subject data erased")
+		resp, status := eraseResponse{Deleted: report}, fasthttp.StatusOK
+		if err = errors.Join(errs...); err != nil {
+			resp.Error, status = err.Error(), fasthttp.StatusInternalServerError
+		}
+		admin.WriteJSON(ctx, status, resp)
+	}
+}
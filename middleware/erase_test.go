@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+// eraseHook records erased subjects
+type eraseHook struct {
+	nopHook
+	subjects []Subject
+}
+
+func (h *eraseHook) Erase(_ context.Context, s Subject) (ErasureReport, error) {
+	h.subjects = append(h.subjects, s)
+	return ErasureReport{"records": 1}, nil
+}
+
+func TestRejectCacheErase(t *testing.T) {
+	c := NewRejectCache(DefaultRejectCacheSize)
+	until := time.Now().Add(time.Hour)
+	c.Reject(AddressKey(netip.MustParseAddr("1.2.3.4")), until, errRejected)
+	c.Reject(AddressKey(netip.MustParseAddr("1.2.3.5")), until, errRejected)
+	c.Reject(PeerIDKey(bittorrent.PeerID{1}), until, errRejected)
+	c.Reject(ParamKey("passkey", "user1"), until, errRejected)
+
+	require.Equal(t, 0, c.Erase(Subject{User: "user2"}))
+	require.Equal(t, 3, c.Erase(Subject{
+		Addr:   netip.MustParseAddr("::ffff:1.2.3.4"),
+		PeerID: bittorrent.PeerID{1},
+		User:   "user1",
+	}))
+	require.Len(t, c.entries, 1)
+	require.Empty(t, c.params)
+}
+
+func TestEraseHandler(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ctx := context.Background()
+	ih1, ih2 := bittorrent.InfoHash("11111111111111111111"), bittorrent.InfoHash("22222222222222222222")
+	subject := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	other := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("1.2.3.5:6881")}
+	require.Nil(t, ps.PutSeeder(ctx, ih1, subject))
+	require.Nil(t, ps.PutLeecher(ctx, ih2, subject))
+	require.Nil(t, ps.PutLeecher(ctx, ih1, other))
+
+	h := &eraseHook{}
+	l := NewLogic(time.Minute, time.Minute, ps, []Hook{&timedHook{Hook: h, name: "test"}}, nil, nil)
+	l.rejectCache.Reject(ParamKey("passkey", "user1"), time.Now().Add(time.Hour), errRejected)
+	handler := EraseHandler([]storage.PeerStorage{ps}, l)
+
+	request := func(uri string) (int, eraseResponse) {
+		var req fasthttp.Request
+		req.Header.SetMethod(fasthttp.MethodDelete)
+		req.SetRequestURI(uri)
+		// Init binds context to fake server, required by storage to check cancellation
+		rCtx := new(fasthttp.RequestCtx)
+		rCtx.Init(&req, nil, nil)
+		handler(rCtx)
+		var resp eraseResponse
+		require.Nil(t, json.Unmarshal(rCtx.Response.Body(), &resp))
+		return rCtx.Response.StatusCode(), resp
+	}
+
+	status, _ := request("/data")
+	require.Equal(t, fasthttp.StatusBadRequest, status)
+	status, _ = request("/data?addr=abc")
+	require.Equal(t, fasthttp.StatusBadRequest, status)
+	status, _ = request("/data?peer_id=01")
+	require.Equal(t, fasthttp.StatusBadRequest, status)
+
+	status, resp := request("/data?addr=1.2.3.4&user=user1")
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Equal(t, ErasureReport{ReportPeers: 2, ReportBans: 1, "test.records": 1}, resp.Deleted)
+	require.Empty(t, resp.Error)
+	require.Equal(t, []Subject{{Addr: subject.Addr(), User: "user1"}}, h.subjects)
+
+	leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih1)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), leechers)
+	require.Equal(t, uint32(0), seeders)
+	leechers, _, _, err = ps.ScrapeSwarm(ctx, ih2)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), leechers)
+
+	// user only subject does not match peers
+	status, resp = request("/data?user=user2")
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Equal(t, ErasureReport{"test.records": 1}, resp.Deleted)
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/events"
+	"github.com/sot-tech/mochi/pkg/privacy"
+)
+
+// rejectCacheHookName is the name of hook in events of
+// announces rejected by RejectCache
+const rejectCacheHookName = "reject cache"
+
+func newEvent(ctx context.Context, typ string, req *bittorrent.AnnounceRequest) events.Event {
+	return events.Event{
+		Type:      typ,
+		InfoHash:  req.InfoHash.String(),
+		PeerID:    req.ID.String(),
+		Addr:      privacy.String(req.GetFirst()),
+		Port:      req.Port,
+		RequestID: bittorrent.RequestID(ctx),
+	}
+}
+
+// publishAnnounce publishes completion of torrent by announce
+func publishAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) {
+	if events.Enabled() && req.Event == bittorrent.Completed {
+		events.Publish(newEvent(ctx, events.TypeCompleted, req))
+	}
+}
+
+// publishSwarmChange publishes swarm lifecycle event detected
+// by the swarm update, the same way as webhook middleware
+func publishSwarmChange(ctx context.Context, req *bittorrent.AnnounceRequest, change SwarmChange) {
+	if !events.Enabled() {
+		return
+	}
+	switch change {
+	case SwarmCreated:
+		events.Publish(newEvent(ctx, events.TypeNewTorrent, req))
+	case SwarmEmptied:
+		events.Publish(newEvent(ctx, events.TypeSwarmEmptied, req))
+	}
+}
+
+// publishRejected publishes rejection of announce by hook, reason of
+// not client errors is replaced with `internal error`, like in metrics
+func publishRejected(ctx context.Context, req *bittorrent.AnnounceRequest, h Hook, err error) {
+	if !events.Enabled() {
+		return
+	}
+	e := newEvent(ctx, events.TypeRejected, req)
+	if h == nil {
+		e.Hook = rejectCacheHookName
+	} else {
+		e.Hook = hookName(h)
+	}
+	e.Reason = errorLabel(err)
+	events.Publish(e)
+}
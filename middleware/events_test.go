@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/events"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestPublishEvents(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	sub := events.Subscribe(10, events.Filter{})
+	defer sub.Close()
+
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("11111111111111111111"),
+		Event:    bittorrent.Started,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+		Params: testParams{"passkey": "user1"},
+	}
+	announce := func(l *Logic, req *bittorrent.AnnounceRequest) {
+		ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+		l.AfterAnnounce(ctx, req, resp)
+	}
+	// swarm is updated in post hooks
+	l := NewLogic(time.Minute, time.Minute, ps, nil, nil, nil)
+	announce(l, req)
+	e := <-sub.C
+	require.Equal(t, events.TypeNewTorrent, e.Type)
+	require.Equal(t, req.InfoHash.String(), e.InfoHash)
+	require.Equal(t, uint16(6881), e.Port)
+
+	// swarm is not created or emptied by announces of other peers
+	other := *req
+	other.ID = bittorrent.PeerID{2}
+	announce(l, &other)
+	other.Event = bittorrent.Stopped
+	announce(l, &other)
+	req.Event = bittorrent.Stopped
+	announce(l, req)
+	e = <-sub.C
+	require.Equal(t, events.TypeSwarmEmptied, e.Type)
+	require.Equal(t, req.ID.String(), e.PeerID)
+	req.Event = bittorrent.Started
+
+	h := &rejectHook{key: func(req *bittorrent.AnnounceRequest) RejectKey {
+		return PeerIDKey(req.ID)
+	}}
+	l = NewLogic(time.Minute, time.Minute, ps, []Hook{&timedHook{Hook: h, name: "test"}}, nil, nil)
+	for _, hook := range []string{"test", rejectCacheHookName} {
+		_, _, err = l.HandleAnnounce(context.Background(), req)
+		require.Equal(t, errRejected, err)
+		e = <-sub.C
+		require.Equal(t, events.TypeRejected, e.Type)
+		require.Equal(t, hook, e.Hook)
+		require.Equal(t, errRejected.Error(), e.Reason)
+	}
+}
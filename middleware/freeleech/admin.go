@@ -0,0 +1,94 @@
+package freeleech
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/admin"
+)
+
+// storageKey converts path parameter (HEX-encoded info hash, GlobalKey
+// or category with CategoryKeyPrefix) into storage key
+func storageKey(ctx *fasthttp.RequestCtx) (string, bool) {
+	key, _ := ctx.UserValue("key").(string)
+	if key == GlobalKey || (strings.HasPrefix(key, CategoryKeyPrefix) && len(key) > len(CategoryKeyPrefix)) {
+		return key, true
+	}
+	ih, err := bittorrent.NewInfoHashString(key)
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return "", false
+	}
+	return ih.RawString(), true
+}
+
+func (h *hook) handleGetWindows(ctx *fasthttp.RequestCtx) {
+	key, ok := storageKey(ctx)
+	if !ok {
+		return
+	}
+	ww, err := h.windows(ctx, key)
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	if ww == nil {
+		ww = []Window{}
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, ww)
+}
+
+// handlePutWindows replaces windows with JSON array provided in body
+func (h *hook) handlePutWindows(ctx *fasthttp.RequestCtx) {
+	key, ok := storageKey(ctx)
+	if !ok {
+		return
+	}
+	var ww []Window
+	if err := json.Unmarshal(ctx.PostBody(), &ww); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	for _, w := range ww {
+		if err := w.Validate(); err != nil {
+			admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := h.putWindows(ctx, key, ww); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, ww)
+}
+
+func (h *hook) handleDeleteWindows(ctx *fasthttp.RequestCtx) {
+	key, ok := storageKey(ctx)
+	if !ok {
+		return
+	}
+	if err := h.storage.Delete(ctx, h.cfg.StorageCtx, key); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+type transferResponse struct {
+	User       string `json:"user"`
+	Uploaded   uint64 `json:"uploaded"`
+	Downloaded uint64 `json:"downloaded"`
+}
+
+func (h *hook) handleGetTransfer(ctx *fasthttp.RequestCtx) {
+	user, _ := ctx.UserValue("user").(string)
+	up, down, err := h.Transfer(ctx, user)
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, transferResponse{User: user, Uploaded: up, Downloaded: down})
+}
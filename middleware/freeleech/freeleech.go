@@ -0,0 +1,484 @@
+// Package freeleech implements a Hook that applies download and upload
+// multipliers (i.e. freeleech, when downloaded bytes are not counted)
+// to specific torrents or to all torrents during scheduled windows.
+// Multipliers are passed to the next hooks through context and,
+// if user is identified, transfer adjusted by multipliers is
+// accumulated per user in DataStorage.
+package freeleech
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/session"
+	"github.com/sot-tech/mochi/middleware/userclass"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/lru"
+	"github.com/sot-tech/mochi/pkg/metadata"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "freeleech"
+
+const (
+	// DefaultStorageCtx is the name of storage context where windows are stored
+	DefaultStorageCtx = "MW_FREELEECH"
+	// DefaultStatsStorageCtx is the name of storage context where
+	// adjusted user's transfer is stored
+	DefaultStatsStorageCtx = "MW_TRANSFER"
+	// GlobalKey is the storage key of windows applied to all torrents
+	GlobalKey = "global"
+	// CategoryKeyPrefix is the prefix of storage key of windows
+	// applied to torrents of category
+	CategoryKeyPrefix        = "category:"
+	defaultPeerLifetime      = storage.DefaultPeerLifetime
+	defaultCategoryCacheTTL  = time.Minute
+	defaultCategoryCacheSize = 10000
+)
+
+var (
+	logger = log.NewLogger("middleware/freeleech")
+
+	errInvalidMultiplier = errors.New("multiplier must not be negative")
+	errInvalidWindow     = errors.New("window end is before start")
+	errAmbiguousWindow   = errors.New("window must not have both info hash and category")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Multipliers applied to transfer reported by peer
+type Multipliers struct {
+	// Download multiplier of downloaded bytes, 0 means freeleech
+	Download float64 `json:"download"`
+	// Upload multiplier of uploaded bytes
+	Upload float64 `json:"upload"`
+}
+
+// DefaultMultipliers returned if there is no active window
+var DefaultMultipliers = Multipliers{Download: 1, Upload: 1}
+
+type multipliersKey struct{}
+
+// FromContext returns multipliers set by this middleware
+// or DefaultMultipliers if not set
+func FromContext(ctx context.Context) Multipliers {
+	if m, ok := ctx.Value(multipliersKey{}).(Multipliers); ok {
+		return m
+	}
+	return DefaultMultipliers
+}
+
+// Window is the period when multipliers are applied
+type Window struct {
+	// InfoHash HEX-encoded info hash, if empty, window is global.
+	// Used only in configuration.
+	InfoHash string `cfg:"info_hash" json:"-"`
+	// Category of torrents, see Config.ApprovalStorageCtx.
+	// Used only in configuration.
+	Category string `cfg:"category" json:"-"`
+	// Start of window, if zero, window is active since forever
+	Start time.Time `json:"start"`
+	// End of window, if zero, window is active forever
+	End time.Time `json:"end"`
+	// DownloadMultiplier multiplier of downloaded bytes
+	DownloadMultiplier float64 `cfg:"download_multiplier" json:"download_multiplier"`
+	// UploadMultiplier multiplier of uploaded bytes
+	UploadMultiplier float64 `cfg:"upload_multiplier" json:"upload_multiplier"`
+}
+
+// Validate checks if window is correct
+func (w Window) Validate() error {
+	if len(w.InfoHash) > 0 && len(w.Category) > 0 {
+		return errAmbiguousWindow
+	}
+	if w.DownloadMultiplier < 0 || w.UploadMultiplier < 0 {
+		return errInvalidMultiplier
+	}
+	if !w.Start.IsZero() && !w.End.IsZero() && w.End.Before(w.Start) {
+		return errInvalidWindow
+	}
+	return nil
+}
+
+func (w Window) active(now time.Time) bool {
+	return (w.Start.IsZero() || !now.Before(w.Start)) && (w.End.IsZero() || now.Before(w.End))
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Windows static list of windows, put into storage on start.
+	Windows []Window
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey). If empty, transfer is not accumulated.
+	UserParam string `cfg:"user_param"`
+	// StorageCtx is the name of storage context where windows are stored.
+	StorageCtx string `cfg:"storage_ctx"`
+	// StatsStorageCtx is the name of storage context where adjusted
+	// user's transfer is stored.
+	StatsStorageCtx string `cfg:"stats_storage_ctx"`
+	// PeerLifetime is the period after which previous announce of
+	// inactive peer is forgotten. Should be the same as storage's peer_lifetime.
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+	// ApprovalStorageCtx is the name of storage context where `torrent approval`
+	// middleware stores torrents with metadata. If set, windows of torrent's
+	// category are also applied. Approval middleware must use internal storage.
+	ApprovalStorageCtx string `cfg:"approval_storage_ctx"`
+	// CategoryCacheTTL is the period while category of torrent loaded
+	// from ApprovalStorageCtx is cached, negative value disables cache.
+	CategoryCacheTTL time.Duration `cfg:"category_cache_ttl"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	for _, w := range cfg.Windows {
+		if err = w.Validate(); err != nil {
+			return
+		}
+	}
+	if len(cfg.StorageCtx) == 0 {
+		validCfg.StorageCtx = DefaultStorageCtx
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", validCfg.StorageCtx).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.UserParam) > 0 {
+		if len(cfg.StatsStorageCtx) == 0 {
+			validCfg.StatsStorageCtx = DefaultStatsStorageCtx
+			logger.Warn().
+				Str("name", "StatsStorageCtx").
+				Str("provided", cfg.StatsStorageCtx).
+				Str("default", validCfg.StatsStorageCtx).
+				Msg("falling back to default configuration")
+		}
+		if cfg.PeerLifetime <= 0 {
+			validCfg.PeerLifetime = defaultPeerLifetime
+			logger.Warn().
+				Str("name", "PeerLifetime").
+				Dur("provided", cfg.PeerLifetime).
+				Dur("default", validCfg.PeerLifetime).
+				Msg("falling back to default configuration")
+		}
+	}
+	if len(cfg.ApprovalStorageCtx) > 0 && cfg.CategoryCacheTTL == 0 {
+		validCfg.CategoryCacheTTL = defaultCategoryCacheTTL
+		logger.Warn().
+			Str("name", "CategoryCacheTTL").
+			Dur("provided", cfg.CategoryCacheTTL).
+			Dur("default", validCfg.CategoryCacheTTL).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:        cfg,
+		storage:    st,
+		last:       make(map[string]transfer),
+		categories: lru.New[bittorrent.InfoHash, string](defaultCategoryCacheSize),
+		closed:     make(chan any),
+	}
+	if len(cfg.Windows) > 0 {
+		byKey := make(map[string][]Window)
+		for _, w := range cfg.Windows {
+			key := GlobalKey
+			if len(w.Category) > 0 {
+				key = CategoryKeyPrefix + w.Category
+			} else if len(w.InfoHash) > 0 {
+				var ih bittorrent.InfoHash
+				if ih, err = bittorrent.NewInfoHashString(w.InfoHash); err != nil {
+					return nil, fmt.Errorf("invalid config for middleware %s: %s: %w", Name, w.InfoHash, err)
+				}
+				key = ih.RawString()
+			}
+			byKey[key] = append(byKey[key], w)
+		}
+		for k, ww := range byKey {
+			if err = h.putWindows(context.Background(), k, ww); err != nil {
+				return nil, fmt.Errorf("middleware %s: unable to put initial data: %w", Name, err)
+			}
+		}
+	}
+	admin.Handle(http.MethodGet, "/freeleech/{key}", h.handleGetWindows)
+	admin.HandleModerated(http.MethodPost, "/freeleech/{key}", h.handlePutWindows)
+	admin.HandleModerated(http.MethodDelete, "/freeleech/{key}", h.handleDeleteWindows)
+	if len(cfg.UserParam) > 0 {
+		admin.Handle(http.MethodGet, "/transfer/{user}", h.handleGetTransfer)
+		go h.runGC()
+	}
+	return h, nil
+}
+
+// transfer is the state of peer reported in announce
+type transfer struct {
+	uploaded, downloaded uint64
+	time                 int64
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.DataStorage
+
+	last   map[string]transfer
+	lastMU sync.Mutex
+	// categories of torrents, see Config.CategoryCacheTTL
+	categories *lru.Cache[bittorrent.InfoHash, string]
+	closed     chan any
+	onceCloser sync.Once
+}
+
+func (h *hook) windows(ctx context.Context, key string) (ww []Window, err error) {
+	var b []byte
+	if b, err = h.storage.Load(ctx, h.cfg.StorageCtx, key); err == nil && len(b) > 0 {
+		err = json.Unmarshal(b, &ww)
+	}
+	return
+}
+
+func (h *hook) putWindows(ctx context.Context, key string, ww []Window) error {
+	b, err := json.Marshal(ww)
+	if err == nil {
+		err = h.storage.Put(ctx, h.cfg.StorageCtx, storage.Entry{Key: key, Value: b})
+	}
+	return err
+}
+
+// keys returns storage keys of windows applicable to info hash
+func (h *hook) keys(ctx context.Context, ih bittorrent.InfoHash) ([]string, error) {
+	keys := []string{GlobalKey, ih.RawString()}
+	if len(h.cfg.ApprovalStorageCtx) > 0 {
+		c, err := h.category(ctx, ih)
+		if err != nil {
+			return nil, err
+		}
+		if len(c) > 0 {
+			keys = append(keys, CategoryKeyPrefix+c)
+		}
+	}
+	return keys, nil
+}
+
+// category returns cached category of torrent or loads it from storage
+func (h *hook) category(ctx context.Context, ih bittorrent.InfoHash) (string, error) {
+	now := timecache.NowUnixNano()
+	if h.cfg.CategoryCacheTTL > 0 {
+		if c, found := h.categories.Get(ih, now); found {
+			return c, nil
+		}
+	}
+	t, _, err := metadata.Load(ctx, h.storage, h.cfg.ApprovalStorageCtx, ih)
+	if err != nil || h.cfg.CategoryCacheTTL <= 0 {
+		return t.Category, err
+	}
+	h.categories.Put(ih, t.Category, now+int64(h.cfg.CategoryCacheTTL))
+	return t.Category, nil
+}
+
+// Multipliers returns effective multipliers for info hash:
+// the lowest download and the highest upload multipliers of
+// all active global, category and torrent windows
+func (h *hook) Multipliers(ctx context.Context, ih bittorrent.InfoHash) (m Multipliers, err error) {
+	m = DefaultMultipliers
+	now := timecache.Now()
+	found := false
+	var keys []string
+	if keys, err = h.keys(ctx, ih); err != nil {
+		return
+	}
+	for _, key := range keys {
+		var ww []Window
+		if ww, err = h.windows(ctx, key); err != nil {
+			return
+		}
+		for _, w := range ww {
+			if !w.active(now) {
+				continue
+			}
+			if !found {
+				m, found = Multipliers{Download: w.DownloadMultiplier, Upload: w.UploadMultiplier}, true
+			} else {
+				m.Download, m.Upload = min(m.Download, w.DownloadMultiplier), max(m.Upload, w.UploadMultiplier)
+			}
+		}
+	}
+	return
+}
+
+// HandleAnnounce places multipliers (multiplied by user class multipliers,
+// if user class middleware configured before) into context and accumulates
+// user's adjusted transfer. Should be used as pre hook.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	m, err := h.Multipliers(ctx, req.InfoHash)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to load freeleech windows")
+	}
+	if c, ok := userclass.FromContext(ctx); ok {
+		m.Download, m.Upload = m.Download*c.DownloadMultiplier, m.Upload*c.UploadMultiplier
+	}
+	ctx = context.WithValue(ctx, multipliersKey{}, m)
+	if len(h.cfg.UserParam) == 0 || req.Params == nil {
+		return ctx, nil
+	}
+	user, _ := req.Params.GetString(h.cfg.UserParam)
+	if len(user) == 0 {
+		return ctx, nil
+	}
+	var up, down uint64
+	if s, ok := session.FromContext(ctx); ok {
+		// session middleware already merged transfer across address changes
+		up, down = s.Uploaded, s.Downloaded
+	} else {
+		up, down = h.delta(user+req.InfoHash.RawString()+req.ID.RawString(), req, middleware.DryRun(ctx))
+	}
+	if (up > 0 || down > 0) && !middleware.DryRun(ctx) {
+		if err = h.account(ctx, user, uint64(float64(up)*m.Upload), uint64(float64(down)*m.Download)); err != nil {
+			logger.Error().Err(err).Str("user", user).Msg("unable to store transfer")
+		}
+	}
+	return ctx, nil
+}
+
+// delta returns transfer since previous announce of the same peer.
+// If counters decreased (client restarted), current values are returned.
+// The first announce of peer is not accounted: it can't be
+// determined which part of transfer was already counted.
+// If dry is set, current transfer is not stored.
+func (h *hook) delta(key string, req *bittorrent.AnnounceRequest, dry bool) (up, down uint64) {
+	h.lastMU.Lock()
+	defer h.lastMU.Unlock()
+	prev, found := h.last[key]
+	switch {
+	case dry:
+	case req.Event == bittorrent.Stopped:
+		delete(h.last, key)
+	default:
+		h.last[key] = transfer{uploaded: req.Uploaded, downloaded: req.Downloaded, time: timecache.NowUnixNano()}
+	}
+	if !found {
+		// first announce of peer sets the baseline
+		return 0, 0
+	}
+	if req.Uploaded < prev.uploaded || req.Downloaded < prev.downloaded {
+		// counters of new session
+		prev = transfer{}
+	}
+	return req.Uploaded - prev.uploaded, req.Downloaded - prev.downloaded
+}
+
+// Transfer returns accumulated adjusted transfer of user.
+// Value in storage is stored in format `uploaded:downloaded`.
+func (h *hook) Transfer(ctx context.Context, user string) (up, down uint64, err error) {
+	var b []byte
+	if b, err = h.storage.Load(ctx, h.cfg.StatsStorageCtx, user); err == nil {
+		up, down, err = parseTransfer(b)
+	}
+	return
+}
+
+// parseTransfer parses stored "up:down" value, empty value is zero transfer
+func parseTransfer(b []byte) (up, down uint64, err error) {
+	if len(b) > 0 {
+		u, d, _ := strings.Cut(string(b), ":")
+		if up, err = strconv.ParseUint(u, 10, 64); err == nil {
+			down, err = strconv.ParseUint(d, 10, 64)
+		}
+	}
+	return
+}
+
+func (h *hook) account(ctx context.Context, user string, up, down uint64) error {
+	return storage.Update(ctx, h.storage, h.cfg.StatsStorageCtx, user, func(old []byte) ([]byte, error) {
+		u, d, err := parseTransfer(old)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatUint(u+up, 10) + ":" + strconv.FormatUint(d+down, 10)), nil
+	})
+}
+
+// Erase deletes accumulated transfer of user and remembered
+// transfer of user's or peer ID's sessions
+func (h *hook) Erase(ctx context.Context, s middleware.Subject) (middleware.ErasureReport, error) {
+	if len(h.cfg.UserParam) == 0 {
+		return nil, nil
+	}
+	report := middleware.ErasureReport{}
+	id := s.PeerID.RawString()
+	h.lastMU.Lock()
+	for k := range h.last {
+		// key is user, info hash and peer ID
+		l := len(k) - len(s.User) - bittorrent.PeerIDLen
+		if (len(s.User) > 0 && (l == bittorrent.InfoHashV1Len || l == bittorrent.InfoHashV2Len) && strings.HasPrefix(k, s.User)) ||
+			(s.PeerID != bittorrent.PeerID{} && strings.HasSuffix(k, id)) {
+			delete(h.last, k)
+			report["sessions"]++
+		}
+	}
+	h.lastMU.Unlock()
+	if len(s.User) == 0 {
+		return report, nil
+	}
+	n, err := middleware.EraseKeys(ctx, h.storage, h.cfg.StatsStorageCtx, s.User)
+	report["transfer"] = n
+	return report, err
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't report transfer.
+	return ctx, nil
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.PeerLifetime / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			cutoff := timecache.Now().Add(-h.cfg.PeerLifetime).UnixNano()
+			h.lastMU.Lock()
+			for k, tr := range h.last {
+				if tr.time < cutoff {
+					delete(h.last, k)
+				}
+			}
+			h.lastMU.Unlock()
+		}
+	}
+}
+
+// Close stops stale transfers collection
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
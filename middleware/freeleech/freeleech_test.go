@@ -0,0 +1,244 @@
+package freeleech
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/metadata"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+const (
+	ih1 = "1111111111111111111111111111111111111111"
+	ih2 = "2222222222222222222222222222222222222222"
+)
+
+type params map[string]string
+
+func (p params) GetString(key string) (out string, found bool) {
+	out, found = p[key]
+	return
+}
+
+func (params) MarshalZerologObject(*zerolog.Event) {}
+
+func newRequest(ih string, up, down uint64) *bittorrent.AnnounceRequest {
+	h, _ := bittorrent.NewInfoHashString(ih)
+	return &bittorrent.AnnounceRequest{
+		InfoHash:   h,
+		Uploaded:   up,
+		Downloaded: down,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+		Params: params{"passkey": "user1"},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{
+		"windows": []any{
+			map[string]any{"info_hash": ih1, "download_multiplier": 0, "upload_multiplier": 1},
+			map[string]any{"info_hash": ih1, "download_multiplier": 0.5, "upload_multiplier": 2},
+			map[string]any{
+				"info_hash": ih2, "download_multiplier": 0, "upload_multiplier": 1,
+				"end": time.Now().Add(-time.Hour).Format(time.RFC3339),
+			},
+		},
+		"user_param": "passkey",
+	}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	hk := h.(*hook)
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+
+	// the lowest download and the highest upload multipliers
+	rctx, err := h.HandleAnnounce(ctx, newRequest(ih1, 0, 0), resp)
+	require.Nil(t, err)
+	require.Equal(t, Multipliers{Download: 0, Upload: 2}, FromContext(rctx))
+
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 100, 1000), resp)
+	require.Nil(t, err)
+	up, down, err := hk.Transfer(ctx, "user1")
+	require.Nil(t, err)
+	require.Equal(t, uint64(200), up)
+	require.Equal(t, uint64(0), down)
+
+	// expired window
+	rctx, err = h.HandleAnnounce(ctx, newRequest(ih2, 0, 0), resp)
+	require.Nil(t, err)
+	require.Equal(t, DefaultMultipliers, FromContext(rctx))
+	_, err = h.HandleAnnounce(ctx, newRequest(ih2, 10, 100), resp)
+	require.Nil(t, err)
+	up, down, err = hk.Transfer(ctx, "user1")
+	require.Nil(t, err)
+	require.Equal(t, uint64(210), up)
+	require.Equal(t, uint64(100), down)
+
+	// global window
+	require.Nil(t, hk.putWindows(ctx, GlobalKey, []Window{{DownloadMultiplier: 0, UploadMultiplier: 1}}))
+	rctx, err = h.HandleAnnounce(ctx, newRequest(ih2, 10, 200), resp)
+	require.Nil(t, err)
+	require.Equal(t, Multipliers{Download: 0, Upload: 1}, FromContext(rctx))
+	_, down, err = hk.Transfer(ctx, "user1")
+	require.Nil(t, err)
+	require.Equal(t, uint64(100), down)
+}
+
+func TestConcurrentAccount(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	// instances sharing storage do not lose transfer of each other
+	var wg sync.WaitGroup
+	for range 2 {
+		h, err := build(conf.MapConfig{"user_param": "passkey"}, ps)
+		require.Nil(t, err)
+		defer h.(*hook).Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				require.Nil(t, h.(*hook).account(context.Background(), "user1", 1, 2))
+			}
+		}()
+	}
+	wg.Wait()
+	h, err := build(conf.MapConfig{"user_param": "passkey"}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	up, down, err := h.(*hook).Transfer(context.Background(), "user1")
+	require.Nil(t, err)
+	require.Equal(t, uint64(100), up)
+	require.Equal(t, uint64(200), down)
+}
+
+func TestAdmin(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	hk := h.(*hook)
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	body, _ := json.Marshal([]Window{{Start: start, DownloadMultiplier: 0, UploadMultiplier: 1}})
+	var rctx fasthttp.RequestCtx
+	rctx.SetUserValue("key", ih1)
+	rctx.Request.SetBody(body)
+	hk.handlePutWindows(&rctx)
+	require.Equal(t, fasthttp.StatusOK, rctx.Response.StatusCode())
+
+	ih, _ := bittorrent.NewInfoHashString(ih1)
+	ww, err := hk.windows(context.Background(), ih.RawString())
+	require.Nil(t, err)
+	require.Len(t, ww, 1)
+	require.True(t, start.Equal(ww[0].Start))
+
+	// window is not started yet
+	m, err := hk.Multipliers(context.Background(), ih)
+	require.Nil(t, err)
+	require.Equal(t, DefaultMultipliers, m)
+
+	rctx = fasthttp.RequestCtx{}
+	rctx.SetUserValue("key", "invalid")
+	hk.handleGetWindows(&rctx)
+	require.Equal(t, fasthttp.StatusBadRequest, rctx.Response.StatusCode())
+}
+
+func TestCategory(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ctx := context.Background()
+	h1, _ := bittorrent.NewInfoHashString(ih1)
+	require.Nil(t, ps.Put(ctx, "MW_APPROVAL", storage.Entry{
+		Key:   h1.RawString(),
+		Value: metadata.Torrent{Name: "pd", Category: "public domain"}.Value(),
+	}))
+
+	h, err := build(conf.MapConfig{
+		"windows": []any{
+			map[string]any{"category": "public domain", "download_multiplier": 0, "upload_multiplier": 1},
+		},
+		"approval_storage_ctx": "MW_APPROVAL",
+	}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	resp := &bittorrent.AnnounceResponse{}
+	rctx, err := h.HandleAnnounce(ctx, newRequest(ih1, 0, 0), resp)
+	require.Nil(t, err)
+	require.Equal(t, Multipliers{Download: 0, Upload: 1}, FromContext(rctx))
+	rctx, err = h.HandleAnnounce(ctx, newRequest(ih2, 0, 0), resp)
+	require.Nil(t, err)
+	require.Equal(t, DefaultMultipliers, FromContext(rctx))
+
+	// category is cached
+	require.Nil(t, ps.Delete(ctx, "MW_APPROVAL", h1.RawString()))
+	rctx, err = h.HandleAnnounce(ctx, newRequest(ih1, 0, 0), resp)
+	require.Nil(t, err)
+	require.Equal(t, Multipliers{Download: 0, Upload: 1}, FromContext(rctx))
+	h.(*hook).categories.Delete(h1)
+	rctx, err = h.HandleAnnounce(ctx, newRequest(ih1, 0, 0), resp)
+	require.Nil(t, err)
+	require.Equal(t, DefaultMultipliers, FromContext(rctx))
+
+	_, err = build(conf.MapConfig{
+		"windows": []any{map[string]any{"category": "public domain", "info_hash": ih1}},
+	}, ps)
+	require.ErrorIs(t, err, errAmbiguousWindow)
+}
+
+func TestDryRun(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+	h, err := build(conf.MapConfig{"user_param": "passkey"}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx, resp := context.Background(), &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 0, 0), resp)
+	require.Nil(t, err)
+	// traced announces change neither baseline, nor transfer
+	for range 2 {
+		_, err = h.HandleAnnounce(middleware.WithDryRun(ctx), newRequest(ih1, 100, 1000), resp)
+		require.Nil(t, err)
+	}
+	up, down, err := h.(*hook).Transfer(ctx, "user1")
+	require.Nil(t, err)
+	require.Zero(t, up)
+	require.Zero(t, down)
+
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 100, 1000), resp)
+	require.Nil(t, err)
+	up, down, err = h.(*hook).Transfer(ctx, "user1")
+	require.Nil(t, err)
+	require.Equal(t, uint64(100), up)
+	require.Equal(t, uint64(1000), down)
+}
@@ -3,8 +3,12 @@ package middleware
 import (
 	"context"
 	"errors"
+	"io"
+	"slices"
+	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/events"
 	"github.com/sot-tech/mochi/storage"
 )
 
@@ -28,6 +32,191 @@ type Pinger interface {
 	Ping(ctx context.Context) error
 }
 
+// RejectObserver is an optional interface that may be implemented by a Hook
+// to be notified about requests rejected by any of pre Hook-s.
+// Used in frontend.Logic.
+//
+// Implementation must not block, because it is called
+// before error is returned to the client.
+type RejectObserver interface {
+	AnnounceRejected(ctx context.Context, req *bittorrent.AnnounceRequest, err error)
+}
+
+// ResponseObserver is an optional interface that may be implemented by a pre
+// or response Hook to get the final response generated for announce.
+// Used in frontend.Logic.
+//
+// Implementation must not block, because it is called
+// before response is returned to the client.
+type ResponseObserver interface {
+	AnnounceResponded(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse)
+}
+
+// SwarmChange is the change of swarm made by announce
+type SwarmChange uint8
+
+const (
+	// SwarmCreated means that the first peer joined empty swarm
+	SwarmCreated SwarmChange = iota + 1
+	// SwarmEmptied means that the last peer left swarm
+	SwarmEmptied
+)
+
+// swarmChange returns change of swarm by the number of its peers
+// before and after announce, zero if swarm is neither created nor emptied
+func swarmChange(before, after uint32) SwarmChange {
+	switch {
+	case before == 0 && after > 0:
+		return SwarmCreated
+	case before > 0 && after == 0:
+		return SwarmEmptied
+	}
+	return 0
+}
+
+// SwarmObserver is an optional interface that may be implemented by any Hook
+// to be notified when announce with started or stopped event creates or
+// empties swarm. Change is detected by the number of peers in storage before
+// and after swarm update, so observer is called after storage is updated
+// regardless of whether swarm is updated in response or post hooks.
+// Used in frontend.Logic.
+//
+// Implementation must not block.
+type SwarmObserver interface {
+	SwarmChanged(ctx context.Context, req *bittorrent.AnnounceRequest, change SwarmChange)
+}
+
+// PeerRanker is an optional interface that may be implemented by a pre Hook
+// to reorder or filter peers returned by storage before they are placed
+// into announce response. Used in frontend.Logic.
+//
+// Rankers are applied in the order of hooks, each of them receives
+// result of the previous one. Because peers are filtered after storage
+// returned them, response may contain less than requested peers.
+type PeerRanker interface {
+	RankPeers(ctx context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer
+}
+
+// Authenticator is an optional interface that may be implemented by a pre Hook
+// which verifies client's identity (i.e. by token or passkey).
+// Used in private mode to check if tracker is not available for anonymous clients.
+type Authenticator interface {
+	// Authenticates returns whether hook verifies announce and scrape requests
+	Authenticates() (announce, scrape bool)
+}
+
+// Authenticates checks if any of provided hooks verifies announce and scrape requests
+func Authenticates(hooks []Hook) (announce, scrape bool) {
+	for _, h := range hooks {
+		if a, ok := h.(Authenticator); ok {
+			ann, scr := a.Authenticates()
+			announce, scrape = announce || ann, scrape || scr
+		}
+	}
+	return
+}
+
+// filterHook passes to wrapped Hook only requests of allowed types.
+// Optional interfaces are forwarded to wrapped Hook.
+type filterHook struct {
+	Hook
+	announce, scrape bool
+}
+
+// Unwrap returns wrapped Hook
+func (h *filterHook) Unwrap() Hook { return h.Hook }
+
+// as returns h as T if the innermost Hook, wrapped by filterHook
+// and timedHook, implements T. Wrappers implement all optional
+// interfaces, so h itself can't be checked.
+func as[T any](h Hook) (t T, ok bool) {
+	inner := h
+	for {
+		w, isOk := inner.(interface{ Unwrap() Hook })
+		if !isOk {
+			break
+		}
+		inner = w.Unwrap()
+	}
+	if _, ok = inner.(T); ok {
+		t, ok = h.(T)
+	}
+	return
+}
+
+func (h *filterHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.announce {
+		return ctx, nil
+	}
+	return h.Hook.HandleAnnounce(ctx, req, resp)
+}
+
+func (h *filterHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if !h.scrape {
+		return ctx, nil
+	}
+	return h.Hook.HandleScrape(ctx, req, resp)
+}
+
+func (h *filterHook) Ping(ctx context.Context) error {
+	if p, ok := h.Hook.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (h *filterHook) AnnounceRejected(ctx context.Context, req *bittorrent.AnnounceRequest, err error) {
+	if ro, ok := h.Hook.(RejectObserver); ok && h.announce {
+		ro.AnnounceRejected(ctx, req, err)
+	}
+}
+
+func (h *filterHook) AnnounceResponded(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	if ro, ok := h.Hook.(ResponseObserver); ok && h.announce {
+		ro.AnnounceResponded(ctx, req, resp)
+	}
+}
+
+func (h *filterHook) SwarmChanged(ctx context.Context, req *bittorrent.AnnounceRequest, change SwarmChange) {
+	if so, ok := h.Hook.(SwarmObserver); ok && h.announce {
+		so.SwarmChanged(ctx, req, change)
+	}
+}
+
+func (h *filterHook) RankPeers(ctx context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if pr, ok := h.Hook.(PeerRanker); ok && h.announce {
+		return pr.RankPeers(ctx, req, peers)
+	}
+	return peers
+}
+
+func (h *filterHook) Authenticates() (announce, scrape bool) {
+	if a, ok := h.Hook.(Authenticator); ok {
+		announce, scrape = a.Authenticates()
+	}
+	return announce && h.announce, scrape && h.scrape
+}
+
+func (h *filterHook) Erase(ctx context.Context, s Subject) (ErasureReport, error) {
+	if e, ok := h.Hook.(Eraser); ok {
+		return e.Erase(ctx, s)
+	}
+	return nil, nil
+}
+
+func (h *filterHook) UseRejectCache(c *RejectCache) {
+	if u, ok := h.Hook.(RejectCacheUser); ok {
+		u.UseRejectCache(c)
+	}
+}
+
+func (h *filterHook) Close() error {
+	if c, ok := h.Hook.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 type skipSwarmInteraction struct{}
 
 // SkipSwarmInteractionKey is a key for the context of an Announce to control
@@ -36,8 +225,22 @@ type skipSwarmInteraction struct{}
 // middleware to skip.
 var SkipSwarmInteractionKey = skipSwarmInteraction{}
 
+func init() {
+	// swarm interaction may be executed in post hooks
+	bittorrent.PreserveContextKey(SkipSwarmInteractionKey)
+}
+
 type swarmInteractionHook struct {
 	store storage.PeerStorage
+	// stopped are peers kept in swarm after stopped event
+	stopped   *stoppedPeers
+	observers []SwarmObserver
+}
+
+// peers returns the number of peers in swarm
+func (h *swarmInteractionHook) peers(ctx context.Context, ih bittorrent.InfoHash) (uint32, error) {
+	leechers, seeders, err := storage.Counts(ctx, h.store, ih)
+	return leechers + seeders, err
 }
 
 func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (outCtx context.Context, err error) {
@@ -49,6 +252,22 @@ func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorre
 	var storeFn func(context.Context, bittorrent.InfoHash, bittorrent.Peer) error
 
 	switch {
+	case req.Event == bittorrent.Stopped && h.stopped.enabled():
+		// stopping peer is stored with lifetime of grace period instead
+		// of deletion, so it is removed by garbage collection if not
+		// re-announced, counters are not changed if it is
+		ctx = storage.WithPeerLifetime(ctx, h.stopped.grace, h.stopped.grace)
+		put := h.store.PutLeecher
+		if req.Left == 0 {
+			put = h.store.PutSeeder
+		}
+		// peer is excluded from peers selection till grace period expires
+		storeFn = func(ctx context.Context, hash bittorrent.InfoHash, peer bittorrent.Peer) error {
+			if err := put(ctx, hash, peer); err != nil {
+				return err
+			}
+			return h.stopped.update(ctx, hash, []bittorrent.Peer{peer}, true)
+		}
 	case req.Event == bittorrent.Stopped:
 		storeFn = func(ctx context.Context, hash bittorrent.InfoHash, peer bittorrent.Peer) error {
 			err = h.store.DeleteSeeder(ctx, hash, peer)
@@ -73,12 +292,32 @@ func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorre
 	default:
 		storeFn = h.store.PutLeecher
 	}
+	// V2 peers are stored in the swarm of truncated hash, which is
+	// the same swarm for HTTP (full hash) and UDP (truncated hash) clients
+	ih := req.InfoHash.TruncateV1()
+	var before uint32
+	track := (req.Event == bittorrent.Started || req.Event == bittorrent.Stopped) &&
+		(len(h.observers) > 0 || events.Enabled())
+	if track {
+		if before, err = h.peers(ctx, ih); err != nil {
+			return
+		}
+	}
 	for _, p := range req.Peers() {
-		if err = storeFn(ctx, req.InfoHash, p); err == nil && len(req.InfoHash) == bittorrent.InfoHashV2Len {
-			err = storeFn(ctx, req.InfoHash.TruncateV1(), p)
+		if err = storeFn(ctx, ih, p); err != nil {
+			return
 		}
-		if err != nil {
-			break
+	}
+	if track {
+		var after uint32
+		if after, err = h.peers(ctx, ih); err != nil {
+			return
+		}
+		if change := swarmChange(before, after); change != 0 {
+			publishSwarmChange(ctx, req, change)
+			for _, so := range h.observers {
+				so.SwarmChanged(ctx, req, change)
+			}
 		}
 	}
 
@@ -90,6 +329,14 @@ func (h *swarmInteractionHook) HandleScrape(ctx context.Context, _ *bittorrent.S
 	return ctx, nil
 }
 
+type responseComplete struct{}
+
+// ResponseCompleteKey is a key for the context of an Announce to mark
+// response as already complete (i.e. served from cache).
+// Any non-nil value set for this key will cause Logic to skip
+// the remaining pre and response hooks.
+var ResponseCompleteKey = responseComplete{}
+
 type skipResponseHook struct{}
 
 // SkipResponseHookKey is a key for the context of an Announce or Scrape to
@@ -99,23 +346,14 @@ type skipResponseHook struct{}
 var SkipResponseHookKey = skipResponseHook{}
 
 type responseHook struct {
-	store storage.PeerStorage
+	store   storage.PeerStorage
+	stopped *stoppedPeers
+	rankers []PeerRanker
+	cache   *scrapeCache
 }
 
 func (h *responseHook) scrape(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
-	leechers, seeders, snatched, err = h.store.ScrapeSwarm(ctx, ih)
-	if err != nil {
-		return
-	}
-	if len(ih) == bittorrent.InfoHashV2Len {
-		var l, s, n uint32
-		l, s, n, err = h.store.ScrapeSwarm(ctx, ih.TruncateV1())
-		if err != nil {
-			return
-		}
-		leechers, seeders, snatched = leechers+l, seeders+s, snatched+n
-	}
-	return
+	return h.store.ScrapeSwarm(ctx, ih.TruncateV1())
 }
 
 func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
@@ -123,13 +361,47 @@ func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.Annou
 		return ctx, nil
 	}
 
-	// Add the Scrape data to the response.
-	resp.Incomplete, resp.Complete, _, err = h.scrape(ctx, req.InfoHash)
+	ih := req.InfoHash.TruncateV1()
+	// storage limits (i.e. peers per IP address) are checked before response,
+	// because swarm may be updated after it is sent
+	if req.Event != bittorrent.Stopped {
+		for _, p := range req.Peers() {
+			if err = storage.Admit(ctx, h.store, ih, p); err != nil {
+				return
+			}
+		}
+	}
+
+	// Add the swarm counts to the response, downloads are not needed.
+	resp.Incomplete, resp.Complete, err = storage.Counts(ctx, h.store, ih)
 	if err != nil {
 		return
 	}
 
-	err = h.appendPeers(ctx, req, resp)
+	var stopped map[bittorrent.Peer]int64
+	if h.stopped.enabled() {
+		if stopped, err = h.stopped.load(ctx, ih); err != nil {
+			return
+		}
+		// peer announced again before its grace period expired
+		if req.Event != bittorrent.Stopped && !DryRun(ctx) && slices.ContainsFunc(req.Peers(), func(p bittorrent.Peer) bool {
+			_, found := stopped[p]
+			return found
+		}) {
+			if err = h.stopped.update(ctx, ih, req.Peers(), false); err != nil {
+				return
+			}
+		}
+	}
+
+	// stats-only announce (numwant=0), peers are neither selected
+	// from storage nor allocated, requester is just stored in swarm
+	if req.NumWant == 0 {
+		resp.IPv4Peers, resp.IPv6Peers = nil, nil
+		return ctx, nil
+	}
+
+	err = h.appendPeers(ctx, req, resp, stopped)
 	return ctx, err
 }
 
@@ -138,18 +410,15 @@ type fetchArgs struct {
 	v6 bool
 }
 
-func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (err error) {
+// appendPeers selects peers from storage, peers in stopped grace period are skipped
+func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, stopped map[bittorrent.Peer]int64) (err error) {
 	seeding := req.Left == 0
 	maxPeers := int(req.NumWant)
-	peers := make([]bittorrent.Peer, 0, len(resp.IPv4Peers)+len(resp.IPv6Peers))
+	peers := make([]bittorrent.Peer, 0, max(maxPeers, len(resp.IPv4Peers)+len(resp.IPv6Peers)))
 	primaryIP := req.GetFirst()
 	v6First := primaryIP.Is6()
-	args := []fetchArgs{{req.InfoHash, v6First}, {req.InfoHash, !v6First}}
-
-	if len(req.InfoHash) == bittorrent.InfoHashV2Len {
-		ih := req.InfoHash.TruncateV1()
-		args = append(args, fetchArgs{ih, v6First}, fetchArgs{ih, !v6First})
-	}
+	ih := req.InfoHash.TruncateV1()
+	args := []fetchArgs{{ih, v6First}, {ih, !v6First}}
 
 	if v6First {
 		peers = append(peers, resp.IPv6Peers...)
@@ -168,19 +437,29 @@ func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.Announce
 		if maxPeers <= 0 {
 			break
 		}
-		var storePeers []bittorrent.Peer
-		storePeers, err = h.store.AnnouncePeers(ctx, a.ih, seeding, maxPeers, a.v6)
+		// stopped peers are requested additionally, because they are skipped
+		err = h.store.AnnouncePeersFunc(ctx, a.ih, seeding, maxPeers+len(stopped), a.v6, func(p bittorrent.Peer) bool {
+			if _, found := stopped[p]; !found {
+				peers = append(peers, p)
+				maxPeers--
+			}
+			return maxPeers > 0
+		})
 		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
 			return err
 		}
 		err = nil
-		peers = append(peers, storePeers...)
-		maxPeers -= len(storePeers)
+	}
+
+	// rankers may drop all peers, requester is returned only if swarm is empty
+	empty := len(peers) == 0
+	for _, r := range h.rankers {
+		peers = r.RankPeers(ctx, req, peers)
 	}
 
 	// Some clients expect a minimum of their own peer representation returned to
 	// them if they are the only peer in a swarm.
-	if len(peers) == 0 {
+	if empty {
 		if seeding {
 			resp.Complete++
 		} else {
@@ -217,14 +496,46 @@ func (h *responseHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeR
 		return ctx, nil
 	}
 
+	// pre hooks may provide data for some hashes (i.e. zeroed data for hidden hashes),
+	// such data is not overwritten, but placed in order of requested hashes
+	var provided map[string]bittorrent.Scrape
+	if len(resp.Data) > 0 {
+		provided = make(map[string]bittorrent.Scrape, len(resp.Data))
+		for _, scr := range resp.Data {
+			provided[scr.InfoHash.RawString()] = scr
+		}
+		resp.Data = make([]bittorrent.Scrape, 0, len(req.InfoHashes))
+	}
+	var key string
+	var cached map[bittorrent.InfoHash]bittorrent.Scrape
+	var fetched []bittorrent.Scrape
+	now := time.Now()
+	resp.Time = now
+	if h.cache != nil {
+		key = scrapeKey(req.InfoHashes)
+		cached, resp.Time = h.cache.get(key)
+	}
 	for _, infoHash := range req.InfoHashes {
-		scr := bittorrent.Scrape{InfoHash: infoHash}
-		scr.Incomplete, scr.Complete, scr.Snatches, err = h.scrape(ctx, infoHash)
-		if err != nil {
-			return
+		scr, found := provided[infoHash.RawString()]
+		if !found {
+			scr, found = cached[infoHash]
+		}
+		if !found {
+			scr = bittorrent.Scrape{InfoHash: infoHash}
+			scr.Incomplete, scr.Complete, scr.Snatches, err = h.scrape(ctx, infoHash)
+			if err != nil {
+				return
+			}
+			fetched = append(fetched, scr)
 		}
 		resp.Data = append(resp.Data, scr)
 	}
+	if len(fetched) > 0 || resp.Time.IsZero() {
+		resp.Time = now
+	}
+	if h.cache != nil && cached == nil && len(fetched) > 0 {
+		h.cache.put(key, fetched, now)
+	}
 
 	return ctx, nil
 }
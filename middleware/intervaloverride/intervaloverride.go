@@ -0,0 +1,139 @@
+// Package intervaloverride implements a Hook that replaces announce intervals
+// returned to clients with custom values set for specific info hashes.
+package intervaloverride
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "interval override"
+
+// DefaultStorageCtx is the name of storage context where overrides are stored
+const DefaultStorageCtx = "MW_INTERVAL_OVERRIDE"
+
+var logger = log.NewLogger("middleware/interval override")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Override is the custom intervals for single info hash
+type Override struct {
+	// InfoHash HEX-encoded info hash
+	InfoHash string `cfg:"info_hash"`
+	// Interval announce interval returned to clients
+	Interval time.Duration
+	// MinInterval minimal announce interval returned to clients,
+	// if zero, tracker's value is returned
+	MinInterval time.Duration `cfg:"min_interval"`
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Overrides static list of overrides, put into storage on start.
+	Overrides []Override
+	// StorageCtx is the name of storage context where overrides are stored.
+	StorageCtx string `cfg:"storage_ctx"`
+}
+
+// EncodeValue converts intervals into storage value:
+// comma separated durations, i.e. `5m0s,1m0s`.
+func EncodeValue(interval, minInterval time.Duration) []byte {
+	return []byte(interval.String() + "," + minInterval.String())
+}
+
+// DecodeValue parses storage value created by EncodeValue.
+// Minimal interval may be omitted.
+func DecodeValue(b []byte) (interval, minInterval time.Duration, err error) {
+	i, mi, hasMin := strings.Cut(string(b), ",")
+	if interval, err = time.ParseDuration(strings.TrimSpace(i)); err == nil && hasMin {
+		minInterval, err = time.ParseDuration(strings.TrimSpace(mi))
+	}
+	return
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if len(cfg.StorageCtx) == 0 {
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", DefaultStorageCtx).
+			Msg("falling back to default configuration")
+		cfg.StorageCtx = DefaultStorageCtx
+	}
+	if len(cfg.Overrides) > 0 {
+		init := make([]storage.Entry, 0, len(cfg.Overrides))
+		for _, o := range cfg.Overrides {
+			ih, err := bittorrent.NewInfoHashString(o.InfoHash)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config for middleware %s: %s: %w", Name, o.InfoHash, err)
+			}
+			if o.Interval <= 0 || o.MinInterval < 0 {
+				return nil, fmt.Errorf("invalid config for middleware %s: %s: invalid interval", Name, o.InfoHash)
+			}
+			init = append(init, storage.Entry{Key: ih.RawString(), Value: EncodeValue(o.Interval, o.MinInterval)})
+		}
+		if err := st.Put(context.Background(), cfg.StorageCtx, init...); err != nil {
+			return nil, fmt.Errorf("middleware %s: unable to put initial data: %w", Name, err)
+		}
+	}
+	return &hook{cfg: cfg, storage: st}, nil
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.DataStorage
+}
+
+func (h *hook) load(ctx context.Context, ih bittorrent.InfoHash) (b []byte, err error) {
+	if b, err = h.storage.Load(ctx, h.cfg.StorageCtx, ih.RawString()); err == nil &&
+		len(b) == 0 && len(ih) == bittorrent.InfoHashV2Len {
+		b, err = h.storage.Load(ctx, h.cfg.StorageCtx, ih.TruncateV1().RawString())
+	}
+	return
+}
+
+// HandleAnnounce replaces response intervals if override for requested
+// info hash exists. Should be used as pre hook.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	b, err := h.load(ctx, req.InfoHash)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to load interval override")
+		return ctx, nil
+	}
+	if len(b) == 0 {
+		return ctx, nil
+	}
+	interval, minInterval, err := DecodeValue(b)
+	if err != nil || interval <= 0 {
+		logger.Warn().Err(err).Stringer("infoHash", req.InfoHash).Bytes("value", b).Msg("invalid interval override")
+		return ctx, nil
+	}
+	resp.Interval = interval
+	if minInterval > 0 {
+		resp.MinInterval = minInterval
+	}
+	if resp.MinInterval > resp.Interval {
+		resp.MinInterval = resp.Interval
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't have intervals.
+	return ctx, nil
+}
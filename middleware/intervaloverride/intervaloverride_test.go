@@ -0,0 +1,61 @@
+package intervaloverride
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	const hash = "3532cf2d327fad8448c075b4cb42c8136964a435"
+	h, err := build(conf.MapConfig{
+		"overrides": []map[string]any{
+			{"info_hash": hash, "interval": "5m", "min_interval": "1m"},
+		},
+	}, ps)
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	ih, err := bittorrent.NewInfoHashString(hash)
+	require.Nil(t, err)
+
+	resp := &bittorrent.AnnounceResponse{Interval: time.Hour, MinInterval: 30 * time.Minute}
+	_, err = h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{InfoHash: ih}, resp)
+	require.Nil(t, err)
+	require.Equal(t, 5*time.Minute, resp.Interval)
+	require.Equal(t, time.Minute, resp.MinInterval)
+
+	// override set directly in storage without min interval
+	other := bittorrent.InfoHash("11111111111111111111")
+	require.Nil(t, ps.Put(ctx, DefaultStorageCtx, storage.Entry{Key: other.RawString(), Value: []byte("10m")}))
+	resp = &bittorrent.AnnounceResponse{Interval: time.Hour, MinInterval: 30 * time.Minute}
+	_, err = h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{InfoHash: other}, resp)
+	require.Nil(t, err)
+	require.Equal(t, 10*time.Minute, resp.Interval)
+	require.Equal(t, 10*time.Minute, resp.MinInterval)
+
+	resp = &bittorrent.AnnounceResponse{Interval: time.Hour}
+	_, err = h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{InfoHash: bittorrent.InfoHash("22222222222222222222")}, resp)
+	require.Nil(t, err)
+	require.Equal(t, time.Hour, resp.Interval)
+}
+
+func TestDecodeValue(t *testing.T) {
+	i, mi, err := DecodeValue(EncodeValue(time.Hour, time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, time.Hour, i)
+	require.Equal(t, time.Minute, mi)
+	_, _, err = DecodeValue([]byte("abc"))
+	require.NotNil(t, err)
+}
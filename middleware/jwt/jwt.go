@@ -35,10 +35,10 @@ func init() {
 var (
 	logger = log.NewLogger("middleware/jwt")
 	// ErrMissingJWT is returned when a JWT is missing from a request.
-	ErrMissingJWT = bittorrent.ClientError("request not allowed by mochi: missing jwt")
+	ErrMissingJWT = bittorrent.NewClientError(bittorrent.ReasonUnauthorized, "request not allowed by mochi: missing jwt")
 
 	// ErrInvalidJWT is returned when a JWT fails to verify.
-	ErrInvalidJWT = bittorrent.ClientError("request not allowed by mochi: invalid jwt")
+	ErrInvalidJWT = bittorrent.NewClientError(bittorrent.ReasonUnauthorized, "request not allowed by mochi: invalid jwt")
 
 	errJWKsNotSet = errors.New("required parameters not provided: Issuer/Audience/JWKSetURL")
 
@@ -162,6 +162,11 @@ func (h *hook) HandleAnnounce(
 	return ctx, err
 }
 
+// Authenticates implements middleware.Authenticator
+func (h *hook) Authenticates() (announce, scrape bool) {
+	return h.cfg.HandleAnnounce, h.cfg.HandleScrape
+}
+
 type scrapeClaims struct {
 	jwt.RegisteredClaims
 	InfoHashes []string `json:"infohashes,omitempty"`
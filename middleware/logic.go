@@ -2,6 +2,8 @@ package middleware
 
 import (
 	"context"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
@@ -12,48 +14,190 @@ import (
 // response from a parsed request, and (2) asynchronously observe anything
 // after the response has been delivered to the client.
 type Logic struct {
-	announceInterval    time.Duration
-	minAnnounceInterval time.Duration
+	announceInterval    atomic.Int64
+	minAnnounceInterval atomic.Int64
 	preHooks            []Hook
+	responseHooks       []Hook
 	postHooks           []Hook
 	pingers             []Pinger
+	rejectObservers     []RejectObserver
+	respObservers       []ResponseObserver
+	erasers             []Eraser
+	rejectCache         *RejectCache
+	tenants             []Tenant
+	swarm               *swarmInteractionHook
+	peers               *responseHook
+	// tenant is the name of tenant, served by this Logic, empty for default one
+	tenant string
+	// maxNumWant limits numwant of announces, zero - not limited
+	maxNumWant atomic.Uint32
 }
 
 // NewLogic creates a new instance of a Logic that executes the provided
 // middleware hooks.
-func NewLogic(annInterval, minAnnInterval time.Duration, peerStore storage.PeerStorage, preHooks, postHooks []Hook) *Logic {
+//
+// If any of responseHooks provided, swarm is updated synchronously
+// right after peers selection and responseHooks are executed after that,
+// before response returned to the client. Otherwise, swarm is updated
+// asynchronously after all postHooks.
+func NewLogic(annInterval, minAnnInterval time.Duration, peerStore storage.PeerStorage, preHooks, postHooks, responseHooks []Hook) *Logic {
+	stopped := &stoppedPeers{store: peerStore}
+	rh := &responseHook{store: peerStore, stopped: stopped}
+	for _, h := range preHooks {
+		if pr, isOk := as[PeerRanker](h); isOk {
+			rh.rankers = append(rh.rankers, pr)
+		}
+	}
 	l := &Logic{
-		announceInterval:    annInterval,
-		minAnnounceInterval: minAnnInterval,
-		preHooks:            append(preHooks, &responseHook{store: peerStore}),
-		postHooks:           append(postHooks, &swarmInteractionHook{store: peerStore}),
-		pingers:             make([]Pinger, 0, 1),
-	}
-	for _, h := range l.preHooks {
-		if ph, isOk := h.(Pinger); isOk {
-			l.pingers = append(l.pingers, ph)
+		preHooks:    slices.Concat(preHooks, []Hook{&timedHook{Hook: rh, name: peersHookName}}),
+		pingers:     make([]Pinger, 0, 1),
+		rejectCache: NewRejectCache(DefaultRejectCacheSize),
+	}
+	l.SetIntervals(annInterval, minAnnInterval)
+	l.peers = rh
+	l.swarm = &swarmInteractionHook{store: peerStore, stopped: stopped}
+	sh := &timedHook{Hook: l.swarm, name: swarmHookName}
+	if len(responseHooks) > 0 {
+		l.responseHooks = append([]Hook{sh}, responseHooks...)
+		l.postHooks = postHooks
+	} else {
+		l.postHooks = slices.Concat(postHooks, []Hook{sh})
+	}
+	for _, hooks := range [][]Hook{l.preHooks, responseHooks} {
+		for _, h := range hooks {
+			if ph, isOk := as[Pinger](h); isOk {
+				l.pingers = append(l.pingers, ph)
+			}
+		}
+	}
+	for _, hooks := range [][]Hook{preHooks, responseHooks} {
+		for _, h := range hooks {
+			if ro, isOk := as[ResponseObserver](h); isOk {
+				l.respObservers = append(l.respObservers, ro)
+			}
+		}
+	}
+	for _, hooks := range [][]Hook{preHooks, responseHooks, postHooks} {
+		for _, h := range hooks {
+			if so, isOk := as[SwarmObserver](h); isOk {
+				l.swarm.observers = append(l.swarm.observers, so)
+			}
+			if ro, isOk := as[RejectObserver](h); isOk {
+				l.rejectObservers = append(l.rejectObservers, ro)
+			}
+			if e, isOk := as[Eraser](h); isOk {
+				l.erasers = append(l.erasers, e)
+			}
+			if u, isOk := as[RejectCacheUser](h); isOk {
+				u.UseRejectCache(l.rejectCache)
+			}
 		}
 	}
 	return l
 }
 
+// SetStoppedGracePeriod sets the time, during which peer sent stopped event
+// is kept in swarm instead of immediate deletion. Such peer is not returned
+// to other peers until it announces again. Zero value disables grace period.
+func (l *Logic) SetStoppedGracePeriod(d time.Duration) {
+	l.swarm.stopped.grace = max(d, 0)
+}
+
+// SetIntervals sets announce interval and minimal announce
+// interval returned in responses
+func (l *Logic) SetIntervals(interval, minInterval time.Duration) {
+	l.announceInterval.Store(int64(interval))
+	l.minAnnounceInterval.Store(int64(minInterval))
+}
+
+// Intervals returns announce interval and minimal announce
+// interval returned in responses
+func (l *Logic) Intervals() (interval, minInterval time.Duration) {
+	return time.Duration(l.announceInterval.Load()), time.Duration(l.minAnnounceInterval.Load())
+}
+
+// SetMaxNumWant limits numwant of announces processed by Logic below
+// frontends' max_numwant. Zero value disables limit.
+func (l *Logic) SetMaxNumWant(n uint32) {
+	l.maxNumWant.Store(n)
+}
+
+// MaxNumWant returns limit set by SetMaxNumWant
+func (l *Logic) MaxNumWant() uint32 {
+	return l.maxNumWant.Load()
+}
+
+// newAnnounceResponse limits numwant of req and creates
+// empty response with configured intervals
+func (l *Logic) newAnnounceResponse(req *bittorrent.AnnounceRequest) *bittorrent.AnnounceResponse {
+	if n := l.maxNumWant.Load(); n > 0 && req.NumWant > n {
+		req.NumWant = n
+	}
+	interval, minInterval := l.Intervals()
+	return &bittorrent.AnnounceResponse{
+		Interval:    interval,
+		MinInterval: minInterval,
+	}
+}
+
+// SetScrapeCacheTTL enables cache of swarm counters returned by scrape,
+// so repeated scrapes of the same set of hashes do not query storage
+// during ttl. Zero value disables cache.
+func (l *Logic) SetScrapeCacheTTL(ttl time.Duration) {
+	if ttl > 0 {
+		l.peers.cache = newScrapeCache(ttl, DefaultScrapeCacheSize)
+	} else {
+		l.peers.cache = nil
+	}
+}
+
 // HandleAnnounce generates a response for an Announce.
 //
 // Returns the updated context, the generated AnnounceResponse and no error
 // on success; nil and error on failure.
 func (l *Logic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (_ context.Context, resp *bittorrent.AnnounceResponse, err error) {
-	logger.Debug().Object("request", req).Msg("new announce request")
-	resp = &bittorrent.AnnounceResponse{
-		Interval:    l.announceInterval,
-		MinInterval: l.minAnnounceInterval,
+	reqID := bittorrent.RequestID(ctx)
+	sampledLogger.Debug("announce").Str("requestID", reqID).Object("request", req).Msg("new announce request")
+	l.recordTenant("announce")
+	if err = l.rejectCache.Check(req.RequestAddresses, req.ID, req.Params); err != nil {
+		sampledLogger.Debug("announce rejected").Err(err).Str("requestID", reqID).Object("request", req).Msg("announce rejected by cache")
+		for _, ro := range l.rejectObservers {
+			ro.AnnounceRejected(ctx, req, err)
+		}
+		publishRejected(ctx, req, nil, err)
+		return nil, nil, err
 	}
-	for _, h := range l.preHooks {
-		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
-			return nil, nil, err
+	ctx = context.WithValue(ctx, rejectCacheKey{}, l.rejectCache)
+	resp = l.newAnnounceResponse(req)
+hooksLoop:
+	for _, hooks := range [][]Hook{l.preHooks, l.responseHooks} {
+		for _, h := range hooks {
+			// request is canceled or deadline exceeded,
+			// remaining hooks (and storage) are not called
+			if err = ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+			var hCtx context.Context
+			if hCtx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
+				for _, ro := range l.rejectObservers {
+					ro.AnnounceRejected(ctx, req, err)
+				}
+				publishRejected(ctx, req, h, err)
+				return nil, nil, err
+			}
+			ctx = hCtx
+			if ctx.Value(ResponseCompleteKey) != nil {
+				break hooksLoop
+			}
 		}
 	}
 
-	logger.Debug().Object("response", resp).Msg("generated announce response")
+	for _, ro := range l.respObservers {
+		ro.AnnounceResponded(ctx, req, resp)
+	}
+	publishAnnounce(ctx, req)
+
+	sampledLogger.Debug("announce response").Str("requestID", reqID).Object("response", resp).Msg("generated announce response")
 	return ctx, resp, nil
 }
 
@@ -64,6 +208,7 @@ func (l *Logic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 	for _, h := range l.postHooks {
 		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
 			logger.Error().Err(err).
+				Str("requestID", bittorrent.RequestID(ctx)).
 				Object("request", req).
 				Object("response", resp).
 				Msg("post-announce hooks failed")
@@ -77,17 +222,29 @@ func (l *Logic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 // Returns the updated context, the generated AnnounceResponse and no error
 // on success; nil and error on failure.
 func (l *Logic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (_ context.Context, resp *bittorrent.ScrapeResponse, err error) {
-	logger.Debug().Object("request", req).Msg("new scrape request")
+	reqID := bittorrent.RequestID(ctx)
+	sampledLogger.Debug("scrape").Str("requestID", reqID).Object("request", req).Msg("new scrape request")
+	l.recordTenant("scrape")
+	if err = l.rejectCache.Check(req.RequestAddresses, bittorrent.PeerID{}, req.Params); err != nil {
+		sampledLogger.Debug("scrape rejected").Err(err).Str("requestID", reqID).Object("request", req).Msg("scrape rejected by cache")
+		return nil, nil, err
+	}
+	ctx = context.WithValue(ctx, rejectCacheKey{}, l.rejectCache)
 	resp = &bittorrent.ScrapeResponse{
 		Data: make([]bittorrent.Scrape, 0, len(req.InfoHashes)),
 	}
-	for _, h := range l.preHooks {
-		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
-			return nil, nil, err
+	for _, hooks := range [][]Hook{l.preHooks, l.responseHooks} {
+		for _, h := range hooks {
+			if err = ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+			if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 
-	logger.Debug().Object("response", resp).Msg("generated scrape response")
+	sampledLogger.Debug("scrape response").Str("requestID", reqID).Object("response", resp).Msg("generated scrape response")
 	return ctx, resp, nil
 }
 
@@ -98,6 +255,7 @@ func (l *Logic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest,
 		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
 			logger.Error().
 				Err(err).
+				Str("requestID", bittorrent.RequestID(ctx)).
 				Object("request", req).
 				Object("response", resp).
 				Msg("post-scrape hooks failed")
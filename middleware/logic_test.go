@@ -4,12 +4,18 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
+	"slices"
 	"testing"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
 )
 
 func init() {
@@ -89,3 +95,500 @@ func BenchmarkHookOverhead(b *testing.B) {
 		})
 	}
 }
+
+// swarmSizeHook overwrites response with actual swarm size from storage
+type swarmSizeHook struct {
+	nopHook
+	store storage.PeerStorage
+}
+
+func (h *swarmSizeHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	leechers, seeders, _, err := h.store.ScrapeSwarm(ctx, req.InfoHash)
+	resp.Incomplete, resp.Complete = leechers, seeders
+	return ctx, err
+}
+
+func TestResponseHooks(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	l := NewLogic(time.Minute, time.Minute, ps, nil, nil, []Hook{&swarmSizeHook{store: ps}})
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("11111111111111111111"),
+		Left:     1,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+	}
+	_, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	// peer is already stored when response hooks executed
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Equal(t, uint32(0), resp.Complete)
+}
+
+// portRanker drops peers with specified port
+type portRanker struct {
+	nopHook
+	port uint16
+}
+
+func (h *portRanker) RankPeers(_ context.Context, _ *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	out := peers[:0]
+	for _, p := range peers {
+		if p.Port() != h.port {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func TestPeerRanker(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ih := bittorrent.InfoHash("11111111111111111111")
+	for i, port := range []uint16{6881, 6882, 6883} {
+		err = ps.PutSeeder(context.Background(), ih, bittorrent.Peer{
+			ID:       bittorrent.PeerID{byte(i + 10)},
+			AddrPort: netip.AddrPortFrom(netip.MustParseAddr("1.2.3.4"), port),
+		})
+		require.Nil(t, err)
+	}
+
+	l := NewLogic(time.Minute, time.Minute, ps, []Hook{&portRanker{port: 6882}}, nil, nil)
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Left:     1,
+		NumWant:  10,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.5")}},
+		},
+	}
+	_, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Len(t, resp.IPv4Peers, 2)
+	for _, p := range resp.IPv4Peers {
+		require.NotEqual(t, uint16(6882), p.Port())
+	}
+
+	// requester is not returned if ranker dropped all peers of not empty swarm
+	l = NewLogic(time.Minute, time.Minute, ps, []Hook{&portRanker{port: 6881}}, nil, nil)
+	req.InfoHash = "22222222222222222222"
+	err = ps.PutSeeder(context.Background(), req.InfoHash, bittorrent.Peer{
+		ID:       bittorrent.PeerID{10},
+		AddrPort: netip.AddrPortFrom(netip.MustParseAddr("1.2.3.4"), 6881),
+	})
+	require.Nil(t, err)
+	_, resp, err = l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Empty(t, resp.IPv4Peers)
+	require.Equal(t, uint32(0), resp.Incomplete)
+}
+
+// rejectHook rejects every announce and records rejection into cache
+type rejectHook struct {
+	nopHook
+	calls int
+	key   func(*bittorrent.AnnounceRequest) RejectKey
+}
+
+var errRejected = bittorrent.ClientError{Message: "rejected"}
+
+func (h *rejectHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.calls++
+	RejectUntil(ctx, h.key(req), time.Now().Add(time.Hour), errRejected)
+	return ctx, errRejected
+}
+
+type testParams map[string]string
+
+func (p testParams) GetString(key string) (out string, found bool) {
+	out, found = p[key]
+	return
+}
+
+func (testParams) MarshalZerologObject(*zerolog.Event) {}
+
+func TestRejectCache(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h := &rejectHook{key: func(req *bittorrent.AnnounceRequest) RejectKey {
+		v, _ := req.Params.GetString("passkey")
+		return ParamKey("passkey", v)
+	}}
+	l := NewLogic(time.Minute, time.Minute, ps, []Hook{h}, nil, nil)
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("11111111111111111111"),
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+		Params: testParams{"passkey": "user1"},
+	}
+	for i := 0; i < 3; i++ {
+		_, _, err = l.HandleAnnounce(context.Background(), req)
+		require.Equal(t, errRejected, err)
+	}
+	require.Equal(t, 1, h.calls)
+
+	// another user is not affected
+	req.Params = testParams{"passkey": "user2"}
+	_, _, err = l.HandleAnnounce(context.Background(), req)
+	require.Equal(t, errRejected, err)
+	require.Equal(t, 2, h.calls)
+
+	l.rejectCache.Forget(ParamKey("passkey", "user1"))
+	req.Params = testParams{"passkey": "user1"}
+	_, _, err = l.HandleAnnounce(context.Background(), req)
+	require.Equal(t, errRejected, err)
+	require.Equal(t, 3, h.calls)
+}
+
+// forgetHook deletes entries of RejectCache
+type forgetHook struct {
+	nopHook
+	RejectCaches
+}
+
+func TestRejectCacheUser(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	f := &forgetHook{}
+	l := NewLogic(time.Minute, time.Minute, ps, []Hook{&filterHook{Hook: &timedHook{Hook: f, name: "forget"}, announce: true}}, nil, nil)
+	addrs := bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}}
+	l.rejectCache.Reject(AddressKey(addrs[0].Addr), time.Now().Add(time.Hour), errRejected)
+	l.rejectCache.Reject(PeerIDKey(bittorrent.PeerID{1}), time.Now().Add(time.Hour), errRejected)
+	f.Forget(AddressKey(addrs[0].Addr))
+	require.Nil(t, l.rejectCache.Check(addrs, bittorrent.PeerID{}, nil))
+	require.Equal(t, errRejected, l.rejectCache.Check(addrs, bittorrent.PeerID{1}, nil))
+	f.ForgetFunc(func(key RejectKey, _ error) bool { return key.Kind == RejectPeerID })
+	require.Nil(t, l.rejectCache.Check(addrs, bittorrent.PeerID{1}, nil))
+
+	// shadowed hook does not delete entries of enforced hooks
+	f = &forgetHook{}
+	l = NewLogic(time.Minute, time.Minute, ps, []Hook{&timedHook{Hook: f, name: "forget", shadow: true}}, nil, nil)
+	l.rejectCache.Reject(AddressKey(addrs[0].Addr), time.Now().Add(time.Hour), errRejected)
+	f.Forget(AddressKey(addrs[0].Addr))
+	require.Equal(t, errRejected, l.rejectCache.Check(addrs, bittorrent.PeerID{}, nil))
+}
+
+func TestRejectCacheSize(t *testing.T) {
+	c := NewRejectCache(2)
+	addrs := bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}}
+	c.Reject(AddressKey(netip.MustParseAddr("1.2.3.4")), time.Now().Add(-time.Second), errRejected)
+	require.Nil(t, c.Check(addrs, bittorrent.PeerID{}, nil))
+
+	c.Reject(PeerIDKey(bittorrent.PeerID{1}), time.Now().Add(time.Hour), errRejected)
+	// expired entry is dropped
+	c.Reject(PeerIDKey(bittorrent.PeerID{2}), time.Now().Add(time.Hour), errRejected)
+	// cache is full
+	c.Reject(PeerIDKey(bittorrent.PeerID{3}), time.Now().Add(time.Hour), errRejected)
+	require.Equal(t, errRejected, c.Check(addrs, bittorrent.PeerID{2}, nil))
+	require.Nil(t, c.Check(addrs, bittorrent.PeerID{3}, nil))
+}
+
+func TestHybridSwarm(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	l := NewLogic(time.Minute, time.Minute, ps, nil, nil, nil)
+	// hybrid torrent has both V1 (SHA-1) and V2 (SHA-256) hashes
+	v1 := bittorrent.InfoHash("11111111111111111111")
+	v2 := bittorrent.InfoHash("22222222222222222222222222222222")
+	announce := func(ih bittorrent.InfoHash, id byte) *bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Left:     1,
+			NumWant:  10,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{id},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{1, 2, 3, id})}},
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+		l.AfterAnnounce(ctx, req, resp)
+		return resp
+	}
+
+	// hybrid HTTP client announces both hashes
+	announce(v1, 1)
+	announce(v2, 1)
+	// V2 UDP client announces truncated hash
+	resp := announce(v2.TruncateV1(), 2)
+	require.Len(t, resp.IPv4Peers, 1)
+	require.Equal(t, bittorrent.PeerID{1}, resp.IPv4Peers[0].ID)
+	// V1 client
+	resp = announce(v1, 3)
+	require.Len(t, resp.IPv4Peers, 1)
+	require.Equal(t, bittorrent.PeerID{1}, resp.IPv4Peers[0].ID)
+
+	// full and truncated V2 hashes address the same swarm without duplicates
+	resp = announce(v2, 1)
+	require.Equal(t, uint32(2), resp.Incomplete)
+	require.Len(t, resp.IPv4Peers, 2)
+
+	_, scrape, err := l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{
+		InfoHashes: bittorrent.InfoHashes{v1, v2, v2.TruncateV1()},
+	})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{
+		{InfoHash: v1, Incomplete: 2},
+		{InfoHash: v2, Incomplete: 2},
+		{InfoHash: v2.TruncateV1(), Incomplete: 2},
+	}, bittorrent.Scrapes(scrape.Data))
+}
+
+func TestStoppedGracePeriod(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ih := bittorrent.InfoHash("11111111111111111111")
+	announceAs := func(l *Logic, id byte, event bittorrent.Event) *bittorrent.AnnounceResponse {
+		// the first peer is seeder, others are leechers
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih,
+			Event:    event,
+			Left:     uint64(id - 1),
+			NumWant:  10,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{id},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{1, 2, 3, id})}},
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+		l.AfterAnnounce(ctx, req, resp)
+		return resp
+	}
+	announce := func(l *Logic, event bittorrent.Event) {
+		announceAs(l, 1, event)
+	}
+	seeders := func() uint32 {
+		_, seeders, _, err := ps.ScrapeSwarm(context.Background(), ih)
+		require.Nil(t, err)
+		return seeders
+	}
+
+	l := NewLogic(time.Minute, time.Minute, ps, nil, nil, nil)
+	l.SetStoppedGracePeriod(time.Minute)
+	announce(l, bittorrent.Started)
+	announce(l, bittorrent.Stopped)
+	require.Equal(t, uint32(1), seeders())
+	// stopped peer is not returned to other peers
+	resp := announceAs(l, 2, bittorrent.Started)
+	require.Len(t, resp.IPv4Peers, 1)
+	require.Equal(t, bittorrent.PeerID{2}, resp.IPv4Peers[0].ID)
+	// restarted peer is not duplicated and is returned again
+	announce(l, bittorrent.Started)
+	require.Equal(t, uint32(1), seeders())
+	// record of swarm without peers in grace period is deleted
+	b, err := ps.Load(context.Background(), stoppedPeersCtx, ih.RawString())
+	require.Nil(t, err)
+	require.Empty(t, b)
+	resp = announceAs(l, 2, bittorrent.None)
+	require.True(t, slices.ContainsFunc(resp.IPv4Peers, func(p bittorrent.Peer) bool {
+		return p.ID == bittorrent.PeerID{1}
+	}))
+	announceAs(l, 2, bittorrent.Stopped)
+	announce(l, bittorrent.Stopped)
+
+	l.SetStoppedGracePeriod(0)
+	announceAs(l, 2, bittorrent.Stopped)
+	announce(l, bittorrent.Stopped)
+	require.Zero(t, seeders())
+}
+
+func TestStoppedExpired(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ctx, ih := context.Background(), bittorrent.InfoHash("11111111111111111111")
+	sp := stoppedPeers{store: ps, grace: time.Minute}
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	require.Nil(t, ps.Put(ctx, stoppedPeersCtx, storage.Entry{
+		Key:   ih.RawString(),
+		Value: encodeStopped(map[bittorrent.Peer]int64{peer: 1}),
+	}))
+	m, err := sp.load(ctx, ih)
+	require.Nil(t, err)
+	require.Empty(t, m)
+	b, err := ps.Load(ctx, stoppedPeersCtx, ih.RawString())
+	require.Nil(t, err)
+	require.Empty(t, b)
+}
+
+func TestScrapeCache(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ih1, ih2 := bittorrent.InfoHash("11111111111111111111"), bittorrent.InfoHash("22222222222222222222")
+	peer := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	require.Nil(t, ps.PutSeeder(context.Background(), ih1, peer))
+	scrape := func(l *Logic, ihs ...bittorrent.InfoHash) *bittorrent.ScrapeResponse {
+		_, resp, err := l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: ihs})
+		require.Nil(t, err)
+		return resp
+	}
+
+	l := NewLogic(time.Minute, time.Minute, ps, nil, nil, nil)
+	l.SetScrapeCacheTTL(time.Minute)
+	first := scrape(l, ih1, ih2)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih1, Complete: 1}, {InfoHash: ih2}}, first.Data)
+	require.Nil(t, ps.PutLeecher(context.Background(), ih2, peer))
+
+	// the same hash set in other order is served from cache
+	resp := scrape(l, ih2, ih1)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih2}, {InfoHash: ih1, Complete: 1}}, resp.Data)
+	require.True(t, first.Time.Equal(resp.Time))
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih2, Incomplete: 1}}, scrape(l, ih2).Data)
+
+	l.SetScrapeCacheTTL(0)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih1, Complete: 1}, {InfoHash: ih2, Incomplete: 1}}, scrape(l, ih1, ih2).Data)
+}
+
+func TestStatsOnlyAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	l := NewLogic(time.Minute, time.Minute, ps, nil, nil, nil)
+	announce := func(id byte, numWant uint32) *bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: bittorrent.InfoHash("11111111111111111111"),
+			Left:     1,
+			NumWant:  numWant,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{id},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{1, 2, 3, id})}},
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+		l.AfterAnnounce(ctx, req, resp)
+		return resp
+	}
+
+	announce(1, 10)
+	resp := announce(2, 0)
+	require.Nil(t, resp.IPv4Peers)
+	require.Nil(t, resp.IPv6Peers)
+	require.Equal(t, uint32(1), resp.Incomplete)
+	// stats-only peer is still stored in swarm
+	resp = announce(1, 10)
+	require.Equal(t, uint32(2), resp.Incomplete)
+	require.Len(t, resp.IPv4Peers, 2)
+}
+
+// slowHook waits until context is done
+type slowHook struct{ nopHook }
+
+func (h *slowHook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	<-ctx.Done()
+	return ctx, nil
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	l := NewLogic(time.Minute, time.Minute, ps, []Hook{&slowHook{}}, nil, nil)
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("11111111111111111111"),
+		Left:     1,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = l.HandleAnnounce(ctx, req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	// storage is not requested after deadline
+	leechers, _, err := storage.Counts(context.Background(), ps, req.InfoHash)
+	require.Nil(t, err)
+	require.Zero(t, leechers)
+
+	_, _, err = l.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{req.InfoHash}})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestAdmitPeer(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{"max_peers_per_ip": 1})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	l := NewLogic(time.Minute, time.Minute, ps, nil, nil, nil)
+	announce := func(id byte) error {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: "11111111111111111111",
+			NumWant:  10,
+			RequestPeer: bittorrent.RequestPeer{
+				ID:               bittorrent.PeerID{id},
+				Port:             6881,
+				RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+			},
+		}
+		ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+		if err == nil {
+			l.AfterAnnounce(ctx, req, resp)
+		}
+		return err
+	}
+	require.Nil(t, announce(1))
+	// limit is returned to client instead of being lost in post hooks
+	require.ErrorIs(t, announce(2), storage.ErrTooManyPeersPerIP)
+	require.Nil(t, announce(1))
+}
+
+func TestWrappedCapabilities(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	// wrappers implement all optional interfaces, only the wrapped hook counts
+	plain := &filterHook{Hook: &timedHook{Hook: &nopHook{}, name: "plain"}, announce: true}
+	ranker := &timedHook{Hook: &portRanker{}, name: "ranker"}
+	l := NewLogic(time.Minute, time.Minute, ps, []Hook{plain, ranker}, []Hook{plain}, nil)
+	require.Len(t, l.peers.rankers, 1)
+	require.Same(t, ranker, l.peers.rankers[0])
+	require.Empty(t, l.swarm.observers)
+	require.Empty(t, l.rejectObservers)
+	require.Empty(t, l.respObservers)
+	require.Empty(t, l.erasers)
+}
+
+func TestLogicHooksNotShared(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	// internal hooks are not appended into spare capacity of caller's slices
+	pre, post := make([]Hook, 1, 2), make([]Hook, 1, 2)
+	pre[0], post[0] = &nopHook{}, &nopHook{}
+	NewLogic(time.Minute, time.Minute, ps, pre, post, nil)
+	require.Nil(t, pre[:2][1])
+	require.Nil(t, post[:2][1])
+}
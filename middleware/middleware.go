@@ -3,18 +3,24 @@
 package middleware
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
 	"sync"
 
+	"github.com/rs/zerolog"
+
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/storage"
 )
 
 var (
-	logger     = log.NewLogger("middleware")
-	buildersMU sync.RWMutex
-	builders   = make(map[string]Builder)
+	logger = log.NewLogger("middleware")
+	// sampledLogger used for per-request events
+	sampledLogger = log.NewSampledLogger("middleware", 0, log.DefaultPerSecond)
+	buildersMU    sync.RWMutex
+	builders      = make(map[string]Builder)
 )
 
 // Builder is the function used to initialize a new Hook
@@ -43,10 +49,70 @@ func RegisterBuilder(name string, b Builder) {
 	builders[name] = b
 }
 
+// Registered returns true if Builder with provided name is registered
+func Registered(name string) bool {
+	buildersMU.RLock()
+	defer buildersMU.RUnlock()
+	_, ok := builders[name]
+	return ok
+}
+
+// Names returns sorted names of all registered Builder-s
+func Names() []string {
+	buildersMU.RLock()
+	defer buildersMU.RUnlock()
+	names := make([]string, 0, len(builders))
+	for n := range builders {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Request types, which may be provided in HookConfig.Handle
+const (
+	HandleAnnounce = "announce"
+	HandleScrape   = "scrape"
+)
+
+// HookConfig is the configuration of single Hook.
+// Besides Hook's own configuration, it specifies
+// which requests should be processed by Hook and
+// position of Hook in the chain.
+type HookConfig struct {
+	conf.NamedMapConfig `yaml:",inline"`
+	// Handle list of request types (announce, scrape) processed by Hook.
+	// If empty, Hook processes all requests.
+	Handle []string `yaml:"handle"`
+	// Order of Hook in the chain. Hooks are executed in ascending order,
+	// Hooks with the same Order are executed in order of declaration.
+	Order int `yaml:"order"`
+	// Enforce if set to false, requests are not rejected by Hook,
+	// would-be rejections are logged and counted instead (shadow mode).
+	// Default is true.
+	Enforce *bool `yaml:"enforce"`
+}
+
+// Enforced returns false if Hook configured in shadow mode
+func (hc HookConfig) Enforced() bool {
+	return hc.Enforce == nil || *hc.Enforce
+}
+
+// MarshalZerologObject writes HookConfig into zerolog event
+func (hc HookConfig) MarshalZerologObject(e *zerolog.Event) {
+	hc.NamedMapConfig.MarshalZerologObject(e)
+	e.Strs("handle", hc.Handle).Int("order", hc.Order).Bool("enforce", hc.Enforced())
+}
+
 // NewHooks is a utility function for initializing Hooks in bulk.
-func NewHooks(configs []conf.NamedMapConfig, storage storage.PeerStorage) (hooks []Hook, err error) {
+// Returned Hooks are sorted by HookConfig.Order.
+func NewHooks(configs []HookConfig, storage storage.PeerStorage) (hooks []Hook, err error) {
 	buildersMU.RLock()
 	defer buildersMU.RUnlock()
+	configs = slices.Clone(configs)
+	slices.SortStableFunc(configs, func(a, b HookConfig) int {
+		return cmp.Compare(a.Order, b.Order)
+	})
 	for _, c := range configs {
 		logger.Debug().Str("name", c.Name).Object("hook", c).Msg("starting hook")
 		newHook, ok := builders[c.Name]
@@ -54,12 +120,30 @@ func NewHooks(configs []conf.NamedMapConfig, storage storage.PeerStorage) (hooks
 			err = fmt.Errorf("hook with name '%s' does not exists", c.Name)
 			break
 		}
+		announce, scrape := len(c.Handle) == 0, len(c.Handle) == 0
+		for _, t := range c.Handle {
+			switch t {
+			case HandleAnnounce:
+				announce = true
+			case HandleScrape:
+				scrape = true
+			default:
+				err = fmt.Errorf("hook '%s': unknown request type '%s'", c.Name, t)
+			}
+		}
+		if err != nil {
+			break
+		}
 		var h Hook
 		if h, err = newHook(c.Config, storage); err != nil {
 			break
 		}
+		h = &timedHook{Hook: h, name: c.Name, shadow: !c.Enforced()}
+		if !announce || !scrape {
+			h = &filterHook{Hook: h, announce: announce, scrape: scrape}
+		}
 		hooks = append(hooks, h)
-		logger.Info().Str("name", c.Name).Msg("hook started")
+		logger.Info().Str("name", c.Name).Bool("enforce", c.Enforced()).Msg("hook started")
 	}
 
 	return
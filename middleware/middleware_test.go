@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+type orderKey struct{}
+
+// appendHook appends its name into context value
+type appendHook string
+
+func (h appendHook) add(ctx context.Context) context.Context {
+	v, _ := ctx.Value(orderKey{}).([]string)
+	return context.WithValue(ctx, orderKey{}, append(v, string(h)))
+}
+
+func (h appendHook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	return h.add(ctx), nil
+}
+
+func (h appendHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return h.add(ctx), nil
+}
+
+// shadowedHook rejects every request and records rejection of announce into RejectCache
+type shadowedHook struct {
+	nopHook
+}
+
+func (h shadowedHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	RejectUntil(ctx, PeerIDKey(req.ID), time.Now().Add(time.Hour), errRejected)
+	return ctx, errRejected
+}
+
+func (h shadowedHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, errRejected
+}
+
+func (h shadowedHook) Authenticates() (announce, scrape bool) {
+	return true, true
+}
+
+func init() {
+	RegisterBuilder("test append", func(c conf.MapConfig, _ storage.PeerStorage) (Hook, error) {
+		return appendHook(c["id"].(string)), nil
+	})
+	RegisterBuilder("test reject", func(conf.MapConfig, storage.PeerStorage) (Hook, error) {
+		return shadowedHook{}, nil
+	})
+}
+
+func TestNewHooks(t *testing.T) {
+	var configs []HookConfig
+	require.Nil(t, yaml.Unmarshal([]byte(`
+- name: test append
+  config:
+    id: a
+  order: 2
+- name: test append
+  config:
+    id: b
+  handle: [ scrape ]
+- name: test append
+  config:
+    id: c
+  handle: [ announce ]
+  order: 2
+- name: test append
+  config:
+    id: d
+`), &configs))
+
+	hooks, err := NewHooks(configs, nil)
+	require.Nil(t, err)
+	require.Len(t, hooks, 4)
+
+	ctx := context.Background()
+	aCtx := ctx
+	sCtx := ctx
+	for _, h := range hooks {
+		aCtx, _ = h.HandleAnnounce(aCtx, nil, nil)
+		sCtx, _ = h.HandleScrape(sCtx, nil, nil)
+	}
+	require.Equal(t, []string{"d", "a", "c"}, aCtx.Value(orderKey{}))
+	require.Equal(t, []string{"b", "d", "a"}, sCtx.Value(orderKey{}))
+
+	configs[0].Handle = []string{"unknown"}
+	_, err = NewHooks(configs, nil)
+	require.NotNil(t, err)
+}
+
+func TestShadowHook(t *testing.T) {
+	var configs []HookConfig
+	require.Nil(t, yaml.Unmarshal([]byte(`
+- name: test reject
+  enforce: false
+- name: test append
+  config:
+    id: a
+`), &configs))
+	require.False(t, configs[0].Enforced())
+	require.True(t, configs[1].Enforced())
+	hooks, err := NewHooks(configs, nil)
+	require.Nil(t, err)
+	announce, scrape := Authenticates(hooks)
+	require.False(t, announce)
+	require.False(t, scrape)
+
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+	l := NewLogic(time.Minute, time.Minute, ps, hooks, nil, nil)
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("00000000000000000001"),
+		RequestPeer: bittorrent.RequestPeer{ID: bittorrent.PeerID{1}, Port: 6881, RequestAddresses: bittorrent.RequestAddresses{
+			{Addr: netip.MustParseAddr("1.2.3.4")},
+		}},
+	}
+	ctx, _, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	// next hooks are executed and receive RejectCache
+	require.Equal(t, []string{"a"}, ctx.Value(orderKey{}))
+	require.NotNil(t, ctx.Value(rejectCacheKey{}))
+	require.Nil(t, l.rejectCache.Check(req.RequestAddresses, req.ID, nil))
+	_, _, err = l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{req.InfoHash}})
+	require.Nil(t, err)
+
+	tr := l.TraceAnnounce(context.Background(), req)
+	require.Equal(t, TracePassed, tr.Result)
+	require.Equal(t, "test reject", tr.Steps[0].Hook)
+	require.Equal(t, TraceShadowed, tr.Steps[0].Result)
+	require.Equal(t, errRejected.Error(), tr.Steps[0].Reason)
+
+	*configs[0].Enforce = true
+	hooks, err = NewHooks(configs, nil)
+	require.Nil(t, err)
+	l = NewLogic(time.Minute, time.Minute, ps, hooks, nil, nil)
+	_, _, err = l.HandleAnnounce(context.Background(), req)
+	require.ErrorIs(t, err, errRejected)
+	require.ErrorIs(t, l.rejectCache.Check(req.RequestAddresses, req.ID, nil), errRejected)
+}
+
+// hashFailureHook fails scrape of every info hash of request
+type hashFailureHook struct {
+	nopHook
+}
+
+func (hashFailureHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	for i := range resp.Data {
+		resp.Data[i].Failure = errRejected
+	}
+	for _, ih := range req.InfoHashes[len(resp.Data):] {
+		resp.Data = append(resp.Data, bittorrent.Scrape{InfoHash: ih, Failure: errRejected})
+	}
+	return ctx, nil
+}
+
+func TestShadowScrapeFailure(t *testing.T) {
+	h := &timedHook{Hook: &hashFailureHook{}, name: "test shadow failure", shadow: true}
+	ih1, ih2 := bittorrent.InfoHash("00000000000000000001"), bittorrent.InfoHash("00000000000000000002")
+	req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih1, ih2}}
+	resp := &bittorrent.ScrapeResponse{Data: bittorrent.Scrapes{{InfoHash: ih1}}}
+	_, err := h.HandleScrape(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{{InfoHash: ih1}}, resp.Data)
+
+	h.shadow = false
+	_, err = h.HandleScrape(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Len(t, resp.Data, 2)
+	require.ErrorIs(t, resp.Data[0].Failure, errRejected)
+
+	// failures set before shadowed hook are kept
+	h.shadow = true
+	_, err = h.HandleScrape(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Len(t, resp.Data, 2)
+	require.ErrorIs(t, resp.Data[1].Failure, errRejected)
+}
+
+func TestRecordHook(t *testing.T) {
+	errRejected := bittorrent.ClientError{Message: "rejected"}
+	recordHook("test record", "announce", nil, time.Now())
+	recordHook("test record", "announce", errRejected, time.Now())
+	recordHook("test record", "announce", errors.New("storage failed"), time.Now())
+
+	require.Equal(t, 1.0, metricValue(PromHookRejections.WithLabelValues("test record", "announce", "rejected")))
+	require.Equal(t, 1.0, metricValue(PromHookRejections.WithLabelValues("test record", "announce", "internal error")))
+	var m dto.Metric
+	require.Nil(t, PromHookDurationMilliseconds.WithLabelValues("test record", "announce").(prometheus.Histogram).Write(&m))
+	require.Equal(t, uint64(3), m.GetHistogram().GetSampleCount())
+}
+
+// metricValue returns current value of counter or gauge
+func metricValue(m prometheus.Metric) float64 {
+	var out dto.Metric
+	_ = m.Write(&out)
+	return out.GetCounter().GetValue() + out.GetGauge().GetValue()
+}
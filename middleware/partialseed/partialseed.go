@@ -0,0 +1,203 @@
+// Package partialseed implements a Hook that handles partial seeds
+// (peers announced with `paused` event, BEP 21): partial seeds are excluded
+// from downloaders in scrapes and returned only to leechers.
+package partialseed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "partial seed"
+
+const defaultPeerLifetime = storage.DefaultPeerLifetime
+
+var (
+	logger = log.NewLogger("middleware/partial seed")
+
+	errStorageNotProvided = errors.New("storage not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to track partial seeds.
+type Config struct {
+	// PeerLifetime is the period after which inactive partial seed
+	// is not tracked anymore. Should be the same as storage's peer_lifetime.
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.PeerLifetime <= 0 {
+		validCfg.PeerLifetime = defaultPeerLifetime
+		logger.Warn().
+			Str("name", "PeerLifetime").
+			Dur("provided", cfg.PeerLifetime).
+			Dur("default", validCfg.PeerLifetime).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if st == nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errStorageNotProvided)
+	}
+	h := &hook{
+		cfg:     cfg.Validate(),
+		storage: st,
+		swarms:  make(map[string]map[bittorrent.Peer]int64),
+		closed:  make(chan any),
+	}
+	go h.runGC()
+	return h, nil
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.PeerStorage
+	// swarms maps truncated info hash to partial seeds
+	// of swarm and time of their last announce
+	swarms     map[string]map[bittorrent.Peer]int64
+	mu         sync.RWMutex
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// HandleAnnounce marks peer as partial seed if announce contains `paused` event,
+// or unmarks it otherwise. Partial seeds are stored as leechers, so they
+// are counted as incomplete.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if middleware.DryRun(ctx) {
+		return ctx, nil
+	}
+	ih, partial := req.InfoHash.TruncateV1().RawString(), req.Event == bittorrent.Paused && req.Left > 0
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers, ok := h.swarms[ih]
+	if !ok {
+		if !partial {
+			return ctx, nil
+		}
+		peers = make(map[bittorrent.Peer]int64, 1)
+		h.swarms[ih] = peers
+	}
+	for _, p := range req.Peers() {
+		if partial {
+			peers[p] = timecache.NowUnixNano()
+		} else {
+			delete(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		delete(h.swarms, ih)
+	}
+	return ctx, nil
+}
+
+// RankPeers implements middleware.PeerRanker. Partial seeds do not download,
+// so they are dropped from peers returned to seeders and other partial seeds.
+func (h *hook) RankPeers(_ context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if req.Left > 0 && req.Event != bittorrent.Paused {
+		return peers
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	partials := h.swarms[req.InfoHash.TruncateV1().RawString()]
+	if len(partials) == 0 {
+		return peers
+	}
+	out := peers[:0]
+	for _, p := range peers {
+		if _, found := partials[p]; !found {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (h *hook) partials(ih bittorrent.InfoHash) uint32 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return uint32(len(h.swarms[ih.TruncateV1().RawString()]))
+}
+
+// HandleScrape fills scrape data with number of downloaders (BEP 21).
+// Data already provided by previous hooks is not changed.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (_ context.Context, err error) {
+	provided := make(map[bittorrent.InfoHash]bool, len(resp.Data))
+	for _, scr := range resp.Data {
+		provided[scr.InfoHash] = true
+	}
+	for _, ih := range req.InfoHashes {
+		if provided[ih] {
+			continue
+		}
+		scr := bittorrent.Scrape{InfoHash: ih, DownloadersProvided: true}
+		if scr.Incomplete, scr.Complete, scr.Snatches, err = h.storage.ScrapeSwarm(ctx, ih.TruncateV1()); err != nil {
+			return
+		}
+		if p := h.partials(ih); p < scr.Incomplete {
+			scr.Downloaders = scr.Incomplete - p
+		}
+		resp.Data = append(resp.Data, scr)
+	}
+	return ctx, nil
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.PeerLifetime / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.gc(timecache.Now().Add(-h.cfg.PeerLifetime).UnixNano())
+		}
+	}
+}
+
+func (h *hook) gc(cutoff int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ih, peers := range h.swarms {
+		for p, mtime := range peers {
+			if mtime <= cutoff {
+				delete(peers, p)
+			}
+		}
+		if len(peers) == 0 {
+			delete(h.swarms, ih)
+		}
+	}
+}
+
+// Close stops stale partial seeds collection
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
@@ -0,0 +1,76 @@
+package partialseed
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func newRequest(ih bittorrent.InfoHash, id byte, left uint64, event bittorrent.Event) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Left:     left,
+		Event:    event,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{1, 2, 3, id})}},
+		},
+	}
+}
+
+func TestPartialSeed(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+	h, err := build(conf.MapConfig{}, ps)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	ranker := h.(*hook)
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHash("11111111111111111111")
+	partial := newRequest(ih, 1, 100, bittorrent.Paused)
+	leecher := newRequest(ih, 2, 100, bittorrent.None)
+	seeder := newRequest(ih, 3, 0, bittorrent.None)
+	for _, req := range []*bittorrent.AnnounceRequest{partial, leecher, seeder} {
+		_, err = h.HandleAnnounce(ctx, req, nil)
+		require.Nil(t, err)
+	}
+	// partial seeds are stored as leechers by swarm interaction
+	require.Nil(t, ps.PutLeecher(ctx, ih, partial.Peers()[0]))
+	require.Nil(t, ps.PutLeecher(ctx, ih, leecher.Peers()[0]))
+	require.Nil(t, ps.PutSeeder(ctx, ih, seeder.Peers()[0]))
+
+	peers := []bittorrent.Peer{partial.Peers()[0], leecher.Peers()[0]}
+	require.Equal(t, []bittorrent.Peer{leecher.Peers()[0]}, ranker.RankPeers(ctx, seeder, append([]bittorrent.Peer{}, peers...)))
+	require.Equal(t, []bittorrent.Peer{leecher.Peers()[0]}, ranker.RankPeers(ctx, partial, append([]bittorrent.Peer{}, peers...)))
+	require.Equal(t, peers, ranker.RankPeers(ctx, leecher, append([]bittorrent.Peer{}, peers...)))
+
+	resp := &bittorrent.ScrapeResponse{}
+	_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih}}, resp)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{
+		{InfoHash: ih, Complete: 1, Incomplete: 2, Downloaders: 1, DownloadersProvided: true},
+	}, resp.Data)
+
+	// peer resumed downloading
+	_, err = h.HandleAnnounce(ctx, newRequest(ih, 1, 100, bittorrent.None), nil)
+	require.Nil(t, err)
+	resp = &bittorrent.ScrapeResponse{}
+	_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih}}, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), resp.Data[0].Downloaders)
+	require.Empty(t, ranker.swarms)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, errStorageNotProvided)
+}
@@ -0,0 +1,125 @@
+// Package peerfilter implements a Hook that removes peers with
+// blocked ports or addresses from announce response and rejects
+// announces of peers with not allowed ports.
+package peerfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "peer filter"
+
+var (
+	// ErrPortNotAllowed is returned if peer announces port,
+	// which is below Config.MinPort or is in Config.RejectedPorts.
+	ErrPortNotAllowed = bittorrent.NewClientError(bittorrent.ReasonBlocked, "port is not allowed")
+
+	errNoRules = errors.New("neither blocked_ports, blocked_networks, rejected_ports nor min_port provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to filter peers.
+type Config struct {
+	// BlockedPorts list of ports, peers with which are not returned
+	// (i.e. 0, 25 or well-known ports, which clients use to attack other hosts).
+	BlockedPorts []uint16 `cfg:"blocked_ports"`
+	// BlockedNetworks list of networks in CIDR notation,
+	// peers from which are not returned.
+	BlockedNetworks []string `cfg:"blocked_networks"`
+	// RejectedPorts list of ports, announces with which are rejected
+	// (i.e. 6969, which is mostly announced by broken clients).
+	// Peers with such ports are not returned too.
+	RejectedPorts []uint16 `cfg:"rejected_ports"`
+	// MinPort is the minimal allowed port, announces with lower (privileged)
+	// ports are rejected and peers with them are not returned.
+	MinPort uint16 `cfg:"min_port"`
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if len(cfg.BlockedPorts) == 0 && len(cfg.BlockedNetworks) == 0 && len(cfg.RejectedPorts) == 0 && cfg.MinPort == 0 {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errNoRules)
+	}
+	h := &hook{
+		ports:    make(map[uint16]bool, len(cfg.BlockedPorts)),
+		rejected: make(map[uint16]bool, len(cfg.RejectedPorts)),
+		networks: make([]netip.Prefix, 0, len(cfg.BlockedNetworks)),
+		minPort:  cfg.MinPort,
+	}
+	for _, p := range cfg.BlockedPorts {
+		h.ports[p] = true
+	}
+	for _, p := range cfg.RejectedPorts {
+		h.ports[p], h.rejected[p] = true, true
+	}
+	for _, n := range cfg.BlockedNetworks {
+		pr, err := netip.ParsePrefix(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+		}
+		h.networks = append(h.networks, pr.Masked())
+	}
+	return h, nil
+}
+
+type hook struct {
+	// ports contains both blocked and rejected ports
+	ports    map[uint16]bool
+	rejected map[uint16]bool
+	networks []netip.Prefix
+	minPort  uint16
+}
+
+func (h *hook) blocked(p bittorrent.Peer) bool {
+	if port := p.Port(); port < h.minPort || h.ports[port] {
+		return true
+	}
+	addr := p.Addr()
+	for _, n := range h.networks {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RankPeers implements middleware.PeerRanker
+func (h *hook) RankPeers(_ context.Context, _ *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	out := peers[:0]
+	for _, p := range peers {
+		if !h.blocked(p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// HandleAnnounce rejects announce if port is not allowed,
+// other peers are filtered in RankPeers after storage returned them.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Port < h.minPort || h.rejected[req.Port] {
+		return ctx, ErrPortNotAllowed
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't contain peers.
+	return ctx, nil
+}
@@ -0,0 +1,64 @@
+package peerfilter
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+func newPeer(addr string) bittorrent.Peer {
+	return bittorrent.Peer{AddrPort: netip.MustParseAddrPort(addr)}
+}
+
+func TestRankPeers(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"blocked_ports":    []any{0, 25},
+		"blocked_networks": []any{"10.0.0.0/8", "fd00::/8"},
+	}, nil)
+	require.Nil(t, err)
+
+	peers := []bittorrent.Peer{
+		newPeer("1.2.3.4:6881"),
+		newPeer("1.2.3.4:25"),
+		newPeer("10.1.2.3:6881"),
+		newPeer("[fd00::1]:6881"),
+		newPeer("[2001:db8::1]:6881"),
+	}
+	out := h.(middleware.PeerRanker).RankPeers(context.Background(), nil, peers)
+	require.Equal(t, []bittorrent.Peer{newPeer("1.2.3.4:6881"), newPeer("[2001:db8::1]:6881")}, out)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, errNoRules)
+	_, err = build(conf.MapConfig{"blocked_networks": []any{"invalid"}}, nil)
+	require.NotNil(t, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"rejected_ports": []any{6969},
+		"min_port":       1024,
+	}, nil)
+	require.Nil(t, err)
+
+	for port, allowed := range map[uint16]bool{6881: true, 1024: true, 6969: false, 80: false, 1023: false} {
+		req := &bittorrent.AnnounceRequest{RequestPeer: bittorrent.RequestPeer{Port: port}}
+		_, err = h.HandleAnnounce(context.Background(), req, nil)
+		if allowed {
+			require.Nil(t, err, port)
+		} else {
+			require.ErrorIs(t, err, ErrPortNotAllowed, port)
+		}
+	}
+
+	peers := []bittorrent.Peer{newPeer("1.2.3.4:6881"), newPeer("1.2.3.4:6969"), newPeer("1.2.3.4:443")}
+	out := h.(middleware.PeerRanker).RankPeers(context.Background(), nil, peers)
+	require.Equal(t, []bittorrent.Peer{newPeer("1.2.3.4:6881")}, out)
+}
@@ -0,0 +1,249 @@
+// Package peerlimit implements a Hook that fails an Announce if single
+// address or user registered too many peers in one swarm or
+// has too many active connections across all swarms.
+package peerlimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "peer limit"
+
+const defaultPeerLifetime = storage.DefaultPeerLifetime
+
+var (
+	logger = log.NewLogger("middleware/peer limit")
+
+	// ErrTooManyPeersPerIP is returned when address has already registered
+	// maximum allowed peers in swarm.
+	ErrTooManyPeersPerIP = bittorrent.NewRetryableError(bittorrent.ReasonLimitExceeded, "too many peers from your address for this torrent")
+
+	// ErrTooManyConnections is returned when user has already reached
+	// maximum allowed active connections across all swarms.
+	ErrTooManyConnections = bittorrent.NewRetryableError(bittorrent.ReasonLimitExceeded, "too many active connections")
+
+	errNoLimits = errors.New("neither max_peers_per_ip nor max_connections_per_user provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to limit peers.
+type Config struct {
+	// MaxPeersPerIP is the maximum number of distinct peer IDs,
+	// which single IP address (or user, if UserParam is set)
+	// may register in one swarm. Zero means no limit.
+	MaxPeersPerIP int `cfg:"max_peers_per_ip"`
+	// MaxConnectionsPerUser is the maximum number of swarm/peer ID pairs
+	// which single user may hold across all swarms. Zero means no limit.
+	MaxConnectionsPerUser int `cfg:"max_connections_per_user"`
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey). If empty or not provided in request,
+	// the first announce address is used.
+	UserParam string `cfg:"user_param"`
+	// PeerLifetime is the period after which inactive peer
+	// is not counted anymore. Should be the same as storage's peer_lifetime.
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+
+	if cfg.MaxPeersPerIP <= 0 && cfg.MaxConnectionsPerUser <= 0 {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errNoLimits)
+	}
+
+	if cfg.PeerLifetime <= 0 {
+		logger.Warn().
+			Str("name", "PeerLifetime").
+			Dur("provided", cfg.PeerLifetime).
+			Dur("default", defaultPeerLifetime).
+			Msg("falling back to default configuration")
+		cfg.PeerLifetime = defaultPeerLifetime
+	}
+
+	h := &hook{
+		cfg:         cfg,
+		swarmPeers:  newMemberSet(),
+		connections: newMemberSet(),
+		closed:      make(chan any),
+	}
+	go h.runGC()
+	return h, nil
+}
+
+type hook struct {
+	cfg         Config
+	swarmPeers  *memberSet
+	connections *memberSet
+	closed      chan any
+	onceCloser  sync.Once
+}
+
+func (h *hook) userKey(req *bittorrent.AnnounceRequest) (key string) {
+	if len(h.cfg.UserParam) > 0 && req.Params != nil {
+		key, _ = req.Params.GetString(h.cfg.UserParam)
+	}
+	if len(key) == 0 {
+		key = req.GetFirst().String()
+	}
+	return
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	user := h.userKey(req)
+	ih := req.InfoHash.TruncateV1().RawString()
+	swarmKey := ih + user
+	peerKey := req.ID.RawString()
+	connKey := ih + peerKey
+
+	if middleware.DryRun(ctx) {
+		switch {
+		case req.Event == bittorrent.Stopped:
+		case !h.swarmPeers.admits(swarmKey, peerKey, h.cfg.MaxPeersPerIP):
+			return ctx, ErrTooManyPeersPerIP
+		case !h.connections.admits(user, connKey, h.cfg.MaxConnectionsPerUser):
+			return ctx, ErrTooManyConnections
+		}
+		return ctx, nil
+	}
+
+	if req.Event == bittorrent.Stopped {
+		h.swarmPeers.remove(swarmKey, peerKey)
+		h.connections.remove(user, connKey)
+		return ctx, nil
+	}
+
+	now := timecache.NowUnixNano()
+	if !h.swarmPeers.touch(swarmKey, peerKey, now, h.cfg.MaxPeersPerIP) {
+		logger.Debug().
+			Object("source", req.RequestPeer).
+			Stringer("infoHash", req.InfoHash).
+			Msg("peers per address limit reached")
+		return ctx, ErrTooManyPeersPerIP
+	}
+	if !h.connections.touch(user, connKey, now, h.cfg.MaxConnectionsPerUser) {
+		h.swarmPeers.remove(swarmKey, peerKey)
+		logger.Debug().
+			Object("source", req.RequestPeer).
+			Stringer("infoHash", req.InfoHash).
+			Msg("connections per user limit reached")
+		return ctx, ErrTooManyConnections
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't register peers.
+	return ctx, nil
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.PeerLifetime / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			cutoff := timecache.Now().Add(-h.cfg.PeerLifetime).UnixNano()
+			h.swarmPeers.gc(cutoff)
+			h.connections.gc(cutoff)
+		}
+	}
+}
+
+// Close stops stale peers collection
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
+
+// memberSet holds groups of members with their last activity time
+type memberSet struct {
+	m map[string]map[string]int64
+	sync.Mutex
+}
+
+func newMemberSet() *memberSet {
+	return &memberSet{m: make(map[string]map[string]int64)}
+}
+
+// touch updates member's activity time in group. If member is new for the group
+// and group already contains limit members, touch returns false and
+// does not add member. Zero or negative limit means no limit.
+func (ms *memberSet) touch(group, member string, now int64, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	g, ok := ms.m[group]
+	if !ok {
+		g = make(map[string]int64, 1)
+		ms.m[group] = g
+	}
+	if _, exists := g[member]; !exists && len(g) >= limit {
+		return false
+	}
+	g[member] = now
+	return true
+}
+
+// admits checks if member may be touched without exceeding limit
+func (ms *memberSet) admits(group, member string, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	g := ms.m[group]
+	_, exists := g[member]
+	return exists || len(g) < limit
+}
+
+func (ms *memberSet) remove(group, member string) {
+	ms.Lock()
+	if g, ok := ms.m[group]; ok {
+		delete(g, member)
+		if len(g) == 0 {
+			delete(ms.m, group)
+		}
+	}
+	ms.Unlock()
+}
+
+func (ms *memberSet) gc(cutoff int64) {
+	ms.Lock()
+	for k, g := range ms.m {
+		for member, mtime := range g {
+			if mtime <= cutoff {
+				delete(g, member)
+			}
+		}
+		if len(g) == 0 {
+			delete(ms.m, k)
+		}
+	}
+	ms.Unlock()
+}
@@ -0,0 +1,65 @@
+package peerlimit
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+func newRequest(ih bittorrent.InfoHash, id byte, addr string) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}},
+		},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{"max_peers_per_ip": 2, "max_connections_per_user": 3}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	ih1, ih2 := bittorrent.InfoHash("11111111111111111111"), bittorrent.InfoHash("22222222222222222222")
+	resp := &bittorrent.AnnounceResponse{}
+
+	for i := byte(1); i <= 2; i++ {
+		_, err = h.HandleAnnounce(ctx, newRequest(ih1, i, "1.2.3.4"), resp)
+		require.Nil(t, err)
+	}
+	// same peer announces again
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 1, "1.2.3.4"), resp)
+	require.Nil(t, err)
+
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 3, "1.2.3.4"), resp)
+	require.Equal(t, ErrTooManyPeersPerIP, err)
+
+	// another address is not affected
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 3, "1.2.3.5"), resp)
+	require.Nil(t, err)
+
+	_, err = h.HandleAnnounce(ctx, newRequest(ih2, 1, "1.2.3.4"), resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, newRequest(ih2, 2, "1.2.3.4"), resp)
+	require.Equal(t, ErrTooManyConnections, err)
+
+	stopped := newRequest(ih1, 1, "1.2.3.4")
+	stopped.Event = bittorrent.Stopped
+	_, err = h.HandleAnnounce(ctx, stopped, resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, newRequest(ih2, 2, "1.2.3.4"), resp)
+	require.Nil(t, err)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{"peer_lifetime": "1m"}, nil)
+	require.ErrorIs(t, err, errNoLimits)
+}
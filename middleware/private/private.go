@@ -0,0 +1,145 @@
+// Package private implements a Hook used in private tracker mode.
+// It rejects announces sent more often than minimal interval
+// and, optionally, all scrapes.
+package private
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/pkg/tunable"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "private"
+
+var (
+	// ErrAnnounceTooOften is returned when peer announces
+	// before minimal interval passed since the previous announce.
+	ErrAnnounceTooOften = bittorrent.NewRetryableError(bittorrent.ReasonRateLimited, "announce interval is too small")
+
+	// ErrScrapeDisabled is returned for scrape requests if scrapes are not allowed.
+	ErrScrapeDisabled = bittorrent.NewClientError(bittorrent.ReasonDisabled, "scrape is disabled")
+
+	errMinIntervalNotProvided = errors.New("min_interval not provided")
+	errInvalidMinInterval     = errors.New("min_interval must be positive")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// MinInterval is the minimal period between two regular announces
+	// of one peer in one swarm.
+	MinInterval time.Duration `cfg:"min_interval"`
+	// AllowScrape specifies if scrape requests are processed.
+	AllowScrape bool `cfg:"allow_scrape"`
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg.MinInterval <= 0 {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errMinIntervalNotProvided)
+	}
+	h := &hook{
+		cfg:          cfg,
+		lastAnnounce: make(map[string]int64),
+		closed:       make(chan any),
+	}
+	h.minInterval.Store(int64(cfg.MinInterval))
+	tunable.Register(tunable.Duration(Name+".min_interval", "minimal period between two regular announces",
+		func() time.Duration { return time.Duration(h.minInterval.Load()) },
+		func(d time.Duration) error {
+			if d <= 0 {
+				return errInvalidMinInterval
+			}
+			h.minInterval.Store(int64(d))
+			return nil
+		}))
+	go h.runGC()
+	return h, nil
+}
+
+type hook struct {
+	cfg Config
+	// minInterval is Config.MinInterval, which may be changed at runtime
+	minInterval  atomic.Int64
+	lastAnnounce map[string]int64
+	sync.Mutex
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// HandleAnnounce rejects announces without event sent before MinInterval
+// passed. Announces with any event are always allowed.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	key := req.InfoHash.RawString() + req.ID.RawString()
+	now, dry := timecache.NowUnixNano(), middleware.DryRun(ctx)
+	h.Lock()
+	defer h.Unlock()
+	switch req.Event {
+	case bittorrent.Stopped:
+		if !dry {
+			delete(h.lastAnnounce, key)
+		}
+		return ctx, nil
+	case bittorrent.None:
+		if last, exists := h.lastAnnounce[key]; exists && now-last < h.minInterval.Load() {
+			return ctx, ErrAnnounceTooOften
+		}
+	}
+	if !dry {
+		h.lastAnnounce[key] = now
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	if !h.cfg.AllowScrape {
+		return ctx, ErrScrapeDisabled
+	}
+	return ctx, nil
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.MinInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			// entries older than MinInterval do not affect anything
+			cutoff := timecache.NowUnixNano() - h.minInterval.Load()
+			h.Lock()
+			for k, t := range h.lastAnnounce {
+				if t < cutoff {
+					delete(h.lastAnnounce, k)
+				}
+			}
+			h.Unlock()
+		}
+	}
+}
+
+// Close stops stale announces collection
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
@@ -0,0 +1,57 @@
+package private
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{"min_interval": time.Hour}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	req := &bittorrent.AnnounceRequest{
+		InfoHash:      bittorrent.InfoHash("11111111111111111111"),
+		RequestPeer:   bittorrent.RequestPeer{ID: bittorrent.PeerID{1}},
+		EventProvided: true,
+		Event:         bittorrent.Started,
+	}
+	resp := &bittorrent.AnnounceResponse{}
+
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+
+	req.Event = bittorrent.None
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Equal(t, ErrAnnounceTooOften, err)
+
+	req.Event = bittorrent.Completed
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+
+	req.Event = bittorrent.Stopped
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+
+	req.Event = bittorrent.None
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+}
+
+func TestHandleScrape(t *testing.T) {
+	h, err := build(conf.MapConfig{"min_interval": "1m"}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{}, &bittorrent.ScrapeResponse{})
+	require.Equal(t, ErrScrapeDisabled, err)
+
+	_, err = build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, errMinIntervalNotProvided)
+}
@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
+
+// Names of internal hooks used in metrics
+const (
+	peersHookName = "peers"
+	swarmHookName = "swarm interaction"
+)
+
+func init() {
+	prometheus.MustRegister(PromHookDurationMilliseconds, PromHookRejections, PromHookShadowRejections, PromTenantRequests)
+}
+
+var (
+	// PromHookDurationMilliseconds is the duration of hook's request processing
+	PromHookDurationMilliseconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mochi_middleware_hook_duration_milliseconds",
+		Help:    "The duration of time it takes to process request by hook",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"hook", "action"})
+
+	// PromHookRejections is the number of requests rejected (or failed) by hook
+	PromHookRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_middleware_hook_rejections_total",
+		Help: "The number of requests rejected by hook",
+	}, []string{"hook", "action", "error"})
+
+	// PromHookShadowRejections is the number of requests, which would be
+	// rejected (or failed) by not enforced hook
+	PromHookShadowRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_middleware_hook_shadow_rejections_total",
+		Help: "The number of requests which would be rejected by not enforced hook",
+	}, []string{"hook", "action", "error"})
+
+	// PromTenantRequests is the number of requests processed by tenant's Logic
+	PromTenantRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_tenant_requests_total",
+		Help: "The number of requests processed by virtual tracker",
+	}, []string{"tenant", "action"})
+)
+
+func (l *Logic) recordTenant(action string) {
+	if len(l.tenant) > 0 && metrics.Enabled() {
+		PromTenantRequests.WithLabelValues(l.tenant, action).Inc()
+	}
+}
+
+func recordHook(name, action string, err error, start time.Time) {
+	PromHookDurationMilliseconds.
+		WithLabelValues(name, action).
+		Observe(float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond))
+	if err != nil {
+		PromHookRejections.WithLabelValues(name, action, errorLabel(err)).Inc()
+	}
+}
+
+// errorLabel returns message of client error or `internal error` otherwise
+func errorLabel(err error) string {
+	var clientErr bittorrent.ClientError
+	if errors.As(err, &clientErr) {
+		return clientErr.Error()
+	}
+	return "internal error"
+}
+
+// timedHook records duration and errors of wrapped Hook
+// if metrics enabled. Optional interfaces are forwarded to wrapped Hook.
+// Errors of not enforced (shadow) Hook are recorded, but not returned.
+type timedHook struct {
+	Hook
+	name   string
+	shadow bool
+}
+
+// Unwrap returns wrapped Hook
+func (h *timedHook) Unwrap() Hook { return h.Hook }
+
+func (h *timedHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.shadow {
+		return h.shadowAnnounce(ctx, req, resp)
+	}
+	if !metrics.Enabled() {
+		return h.Hook.HandleAnnounce(ctx, req, resp)
+	}
+	start := time.Now()
+	outCtx, err := h.Hook.HandleAnnounce(ctx, req, resp)
+	recordHook(h.name, "announce", err, start)
+	return outCtx, err
+}
+
+func (h *timedHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.shadow {
+		return h.shadowScrape(ctx, req, resp)
+	}
+	if !metrics.Enabled() {
+		return h.Hook.HandleScrape(ctx, req, resp)
+	}
+	start := time.Now()
+	outCtx, err := h.Hook.HandleScrape(ctx, req, resp)
+	recordHook(h.name, "scrape", err, start)
+	return outCtx, err
+}
+
+func (h *timedHook) Ping(ctx context.Context) error {
+	if p, ok := h.Hook.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (h *timedHook) AnnounceRejected(ctx context.Context, req *bittorrent.AnnounceRequest, err error) {
+	if ro, ok := h.Hook.(RejectObserver); ok {
+		ro.AnnounceRejected(ctx, req, err)
+	}
+}
+
+func (h *timedHook) AnnounceResponded(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	if ro, ok := h.Hook.(ResponseObserver); ok {
+		ro.AnnounceResponded(ctx, req, resp)
+	}
+}
+
+func (h *timedHook) SwarmChanged(ctx context.Context, req *bittorrent.AnnounceRequest, change SwarmChange) {
+	if so, ok := h.Hook.(SwarmObserver); ok {
+		so.SwarmChanged(ctx, req, change)
+	}
+}
+
+func (h *timedHook) RankPeers(ctx context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if pr, ok := h.Hook.(PeerRanker); ok {
+		return pr.RankPeers(ctx, req, peers)
+	}
+	return peers
+}
+
+// Authenticates returns false for not enforced Hook, because
+// it does not actually verify requests
+func (h *timedHook) Authenticates() (announce, scrape bool) {
+	if a, ok := h.Hook.(Authenticator); ok && !h.shadow {
+		announce, scrape = a.Authenticates()
+	}
+	return
+}
+
+// Erase prefixes keys of wrapped Eraser's report with hook name
+func (h *timedHook) Erase(ctx context.Context, s Subject) (ErasureReport, error) {
+	e, ok := h.Hook.(Eraser)
+	if !ok {
+		return nil, nil
+	}
+	r, err := e.Erase(ctx, s)
+	out := make(ErasureReport, len(r))
+	out.merge(h.name+".", r)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", h.name, err)
+	}
+	return out, err
+}
+
+func (h *timedHook) UseRejectCache(c *RejectCache) {
+	if u, ok := h.Hook.(RejectCacheUser); ok && !h.shadow {
+		u.UseRejectCache(c)
+	}
+}
+
+func (h *timedHook) Close() error {
+	if c, ok := h.Hook.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
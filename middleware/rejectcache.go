@@ -0,0 +1,252 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+// DefaultRejectCacheSize is the maximum number of entries in RejectCache
+const DefaultRejectCacheSize = 100000
+
+// RejectKind is the kind of request property checked by RejectCache
+type RejectKind uint8
+
+const (
+	// RejectAddress rejects requests from address
+	RejectAddress RejectKind = iota
+	// RejectPeerID rejects announces with peer ID
+	RejectPeerID
+	// RejectParam rejects requests with parameter value (i.e. passkey)
+	RejectParam
+)
+
+// RejectKey identifies requests which should be rejected
+type RejectKey struct {
+	Kind RejectKind
+	// Param is the name of request parameter, used only with RejectParam
+	Param string
+	Value string
+}
+
+// AddressKey creates RejectKey for requests from address
+func AddressKey(addr netip.Addr) RejectKey {
+	return RejectKey{Kind: RejectAddress, Value: addr.Unmap().String()}
+}
+
+// PeerIDKey creates RejectKey for announces with peer ID
+func PeerIDKey(id bittorrent.PeerID) RejectKey {
+	return RejectKey{Kind: RejectPeerID, Value: id.RawString()}
+}
+
+// ParamKey creates RejectKey for requests with parameter value
+func ParamKey(param, value string) RejectKey {
+	return RejectKey{Kind: RejectParam, Param: param, Value: value}
+}
+
+type rejectEntry struct {
+	until int64
+	err   error
+}
+
+// RejectCache is the negative cache of requests, which are known to be
+// rejected. It is consulted by Logic before any hook executed,
+// so repeated requests of offenders are rejected without hooks overhead.
+type RejectCache struct {
+	size    int
+	entries map[RejectKey]rejectEntry
+	// params counts entries with the same parameter name
+	params map[string]int
+	sync.RWMutex
+}
+
+// NewRejectCache creates RejectCache with maximum number of entries.
+// If cache is full, expired entries are dropped, if there are no
+// such entries, new entry is not added.
+func NewRejectCache(size int) *RejectCache {
+	return &RejectCache{
+		size:    size,
+		entries: make(map[RejectKey]rejectEntry),
+		params:  make(map[string]int),
+	}
+}
+
+// Reject records that requests matched key should be rejected with err until time
+func (c *RejectCache) Reject(key RejectKey, until time.Time, err error) {
+	now := timecache.NowUnixNano()
+	c.Lock()
+	defer c.Unlock()
+	if _, exists := c.entries[key]; !exists {
+		if len(c.entries) >= c.size {
+			for k, e := range c.entries {
+				if e.until <= now {
+					c.delete(k)
+				}
+			}
+			if len(c.entries) >= c.size {
+				logger.Warn().Int("size", c.size).Msg("reject cache is full")
+				return
+			}
+		}
+		if key.Kind == RejectParam {
+			c.params[key.Param]++
+		}
+	}
+	c.entries[key] = rejectEntry{until: until.UnixNano(), err: err}
+}
+
+// Forget deletes key from cache
+func (c *RejectCache) Forget(key RejectKey) {
+	c.Lock()
+	if _, exists := c.entries[key]; exists {
+		c.delete(key)
+	}
+	c.Unlock()
+}
+
+// ForgetFunc deletes entries for which fn returns true
+func (c *RejectCache) ForgetFunc(fn func(key RejectKey, err error) bool) {
+	c.Lock()
+	defer c.Unlock()
+	for k, e := range c.entries {
+		if fn(k, e.err) {
+			c.delete(k)
+		}
+	}
+}
+
+// Erase deletes entries with address, peer ID or parameter value
+// (of any parameter) of Subject and returns the number of deleted entries
+func (c *RejectCache) Erase(s Subject) (n int) {
+	var addr string
+	if s.Addr.IsValid() {
+		addr = s.Addr.Unmap().String()
+	}
+	c.Lock()
+	defer c.Unlock()
+	for k := range c.entries {
+		var matched bool
+		switch k.Kind {
+		case RejectAddress:
+			matched = len(addr) > 0 && k.Value == addr
+		case RejectPeerID:
+			matched = s.PeerID != (bittorrent.PeerID{}) && k.Value == s.PeerID.RawString()
+		case RejectParam:
+			matched = len(s.User) > 0 && k.Value == s.User
+		}
+		if matched {
+			c.delete(k)
+			n++
+		}
+	}
+	return
+}
+
+// delete must be called with locked mutex
+func (c *RejectCache) delete(key RejectKey) {
+	delete(c.entries, key)
+	if key.Kind == RejectParam {
+		if c.params[key.Param]--; c.params[key.Param] <= 0 {
+			delete(c.params, key.Param)
+		}
+	}
+}
+
+func (c *RejectCache) get(key RejectKey, now int64) error {
+	if e, exists := c.entries[key]; exists && e.until > now {
+		return e.err
+	}
+	return nil
+}
+
+// Check returns error recorded for any of request's addresses, peer ID
+// (if not empty) or parameters.
+func (c *RejectCache) Check(addrs bittorrent.RequestAddresses, id bittorrent.PeerID, params bittorrent.Params) error {
+	now := timecache.NowUnixNano()
+	c.RLock()
+	defer c.RUnlock()
+	if len(c.entries) == 0 {
+		return nil
+	}
+	for _, a := range addrs {
+		if err := c.get(AddressKey(a.Addr), now); err != nil {
+			return err
+		}
+	}
+	if id != (bittorrent.PeerID{}) {
+		if err := c.get(PeerIDKey(id), now); err != nil {
+			return err
+		}
+	}
+	if params != nil {
+		for p := range c.params {
+			if v, found := params.GetString(p); found {
+				if err := c.get(ParamKey(p, v), now); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type rejectCacheKey struct{}
+
+func init() {
+	// rejections may be recorded in post hooks
+	bittorrent.PreserveContextKey(rejectCacheKey{})
+}
+
+// RejectUntil records key into RejectCache of Logic which executes hook,
+// so next requests matched key are rejected with err until time
+// without executing hooks. Should be called by hook, which rejected request.
+// Rejections of not enforced hooks are not recorded.
+func RejectUntil(ctx context.Context, key RejectKey, until time.Time, err error) {
+	if c, ok := ctx.Value(rejectCacheKey{}).(*RejectCache); ok && c != nil {
+		c.Reject(key, until, err)
+	}
+}
+
+// RejectCacheUser is an optional interface that may be implemented by a Hook
+// which deletes RejectCache entries outside of request processing
+// (i.e. when ban is lifted). Used in NewLogic.
+type RejectCacheUser interface {
+	UseRejectCache(c *RejectCache)
+}
+
+// RejectCaches is the set of RejectCache of Logics which execute hook.
+// It may be embedded into a Hook to implement RejectCacheUser.
+// Zero value is ready to use.
+type RejectCaches struct {
+	caches []*RejectCache
+	mu     sync.RWMutex
+}
+
+// UseRejectCache implements RejectCacheUser
+func (cc *RejectCaches) UseRejectCache(c *RejectCache) {
+	cc.mu.Lock()
+	cc.caches = append(cc.caches, c)
+	cc.mu.Unlock()
+}
+
+// Forget deletes key from all caches
+func (cc *RejectCaches) Forget(key RejectKey) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	for _, c := range cc.caches {
+		c.Forget(key)
+	}
+}
+
+// ForgetFunc deletes entries for which fn returns true from all caches
+func (cc *RejectCaches) ForgetFunc(fn func(key RejectKey, err error) bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	for _, c := range cc.caches {
+		c.ForgetFunc(fn)
+	}
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+// DefaultScrapeCacheSize is the maximum number of hash sets in scrape cache
+const DefaultScrapeCacheSize = 10000
+
+type scrapeEntry struct {
+	created int64
+	scrapes map[bittorrent.InfoHash]bittorrent.Scrape
+}
+
+// scrapeCache keeps swarm counters of recently scraped hash sets,
+// so repeated scrapes of the same hashes (i.e. by indexers)
+// do not query storage. Hooks are executed as usual.
+type scrapeCache struct {
+	ttl     int64
+	size    int
+	entries map[string]scrapeEntry
+	sync.RWMutex
+}
+
+func newScrapeCache(ttl time.Duration, size int) *scrapeCache {
+	return &scrapeCache{
+		ttl:     int64(ttl),
+		size:    size,
+		entries: make(map[string]scrapeEntry),
+	}
+}
+
+// scrapeKey returns the key of hash set, which does not depend
+// on order of hashes in request
+func scrapeKey(ihs bittorrent.InfoHashes) string {
+	if len(ihs) == 1 {
+		return ihs[0].RawString()
+	}
+	keys := make([]string, len(ihs))
+	for i, ih := range ihs {
+		keys[i] = ih.RawString()
+	}
+	slices.Sort(keys)
+	return strings.Join(slices.Compact(keys), "")
+}
+
+// get returns not expired scrapes of hash set and the time they were read
+func (c *scrapeCache) get(key string) (map[bittorrent.InfoHash]bittorrent.Scrape, time.Time) {
+	now := timecache.NowUnixNano()
+	c.RLock()
+	e, exists := c.entries[key]
+	c.RUnlock()
+	if !exists || e.created+c.ttl <= now {
+		return nil, time.Time{}
+	}
+	return e.scrapes, time.Unix(0, e.created)
+}
+
+// put stores scrapes of hash set read at created time. If cache is full,
+// expired entries are dropped, if there are no such entries, scrapes are not stored.
+func (c *scrapeCache) put(key string, scrapes []bittorrent.Scrape, created time.Time) {
+	e := scrapeEntry{created: created.UnixNano(), scrapes: make(map[bittorrent.InfoHash]bittorrent.Scrape, len(scrapes))}
+	for _, scr := range scrapes {
+		e.scrapes[scr.InfoHash] = scr
+	}
+	now := timecache.NowUnixNano()
+	c.Lock()
+	defer c.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.size {
+		for k, old := range c.entries {
+			if old.created+c.ttl <= now {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			return
+		}
+	}
+	c.entries[key] = e
+}
@@ -0,0 +1,322 @@
+// Package session implements a Hook that correlates announces of
+// the same peer across address changes and client restarts by peer ID
+// and `key` parameter, calculates transfer since previous announce
+// of the session and detects users announcing from too many
+// addresses simultaneously.
+package session
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/webhook"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "session"
+
+const (
+	defaultKeyParam      = "key"
+	defaultPeerLifetime  = storage.DefaultPeerLifetime
+	defaultAlertInterval = time.Hour
+)
+
+var logger = log.NewLogger("middleware/session")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Session is the state of announcing peer passed to the next hooks
+type Session struct {
+	// ID is the identifier of session: info hash, peer ID and key
+	ID string
+	// Uploaded bytes since previous announce of session
+	Uploaded uint64
+	// Downloaded bytes since previous announce of session
+	Downloaded uint64
+	// AddressChanged is true if peer announced from new address
+	AddressChanged bool
+}
+
+type sessionKey struct{}
+
+// FromContext returns session of peer set by this middleware
+func FromContext(ctx context.Context) (s Session, found bool) {
+	s, found = ctx.Value(sessionKey{}).(Session)
+	return
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// KeyParam is the name of announce query parameter, which
+	// client keeps across address changes.
+	KeyParam string `cfg:"key_param"`
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey). If empty, addresses are not counted.
+	UserParam string `cfg:"user_param"`
+	// MaxAddresses is the maximum number of distinct addresses which
+	// single user may announce from simultaneously. Zero means no limit.
+	MaxAddresses int `cfg:"max_addresses"`
+	// AlertInterval is the minimal period between two alerts about the same user.
+	AlertInterval time.Duration `cfg:"alert_interval"`
+	// PeerLifetime is the period after which inactive session and
+	// address are forgotten. Should be the same as storage's peer_lifetime.
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+	// Webhook is the configuration of endpoint where alerts are sent.
+	// If not set, alerts are only logged.
+	Webhook webhook.SenderConfig
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.KeyParam) == 0 {
+		validCfg.KeyParam = defaultKeyParam
+		logger.Warn().
+			Str("name", "KeyParam").
+			Str("provided", cfg.KeyParam).
+			Str("default", validCfg.KeyParam).
+			Msg("falling back to default configuration")
+	}
+	if cfg.PeerLifetime <= 0 {
+		validCfg.PeerLifetime = defaultPeerLifetime
+		logger.Warn().
+			Str("name", "PeerLifetime").
+			Dur("provided", cfg.PeerLifetime).
+			Dur("default", validCfg.PeerLifetime).
+			Msg("falling back to default configuration")
+	}
+	if cfg.MaxAddresses > 0 && cfg.AlertInterval <= 0 {
+		validCfg.AlertInterval = defaultAlertInterval
+		logger.Warn().
+			Str("name", "AlertInterval").
+			Dur("provided", cfg.AlertInterval).
+			Dur("default", validCfg.AlertInterval).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.Webhook.URL) > 0 {
+		validCfg.Webhook, err = cfg.Webhook.Validate()
+	}
+	return
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:       cfg,
+		sessions:  make(map[string]state),
+		addresses: make(map[string]map[string]int64),
+		lastAlert: make(map[string]int64),
+		closed:    make(chan any),
+	}
+	if len(cfg.Webhook.URL) > 0 {
+		h.sender = webhook.NewSender(cfg.Webhook)
+	}
+	go h.runGC()
+	return h, nil
+}
+
+// state is the last announce of session
+type state struct {
+	uploaded, downloaded uint64
+	addr                 string
+	time                 int64
+}
+
+type hook struct {
+	cfg    Config
+	sender *webhook.Sender
+
+	sessions   map[string]state
+	sessionsMU sync.Mutex
+	// addresses maps user to addresses with the last announce time
+	addresses   map[string]map[string]int64
+	lastAlert   map[string]int64
+	addressesMU sync.Mutex
+
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// HandleAnnounce places Session into context, so it should be configured
+// before middlewares which account transfer.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	id := req.InfoHash.RawString() + req.ID.RawString()
+	if req.Params != nil {
+		if key, _ := req.Params.GetString(h.cfg.KeyParam); len(key) > 0 {
+			id += key
+		}
+	}
+	addr := req.GetFirst().String()
+	now := timecache.NowUnixNano()
+	dry := middleware.DryRun(ctx)
+	s := h.update(id, addr, req, now, dry)
+	ctx = context.WithValue(ctx, sessionKey{}, s)
+
+	if !dry && h.cfg.MaxAddresses > 0 && len(h.cfg.UserParam) > 0 && req.Params != nil {
+		if user, _ := req.Params.GetString(h.cfg.UserParam); len(user) > 0 {
+			if addrs := h.touchAddress(user, addr, req.Event == bittorrent.Stopped, now); len(addrs) > 0 {
+				h.alert(ctx, req, user, addrs)
+			}
+		}
+	}
+	return ctx, nil
+}
+
+// update stores current state of session and calculates transfer since previous announce.
+// If counters decreased (client restarted), current values are counted.
+// The first announce of session only sets the baseline.
+func (h *hook) update(id, addr string, req *bittorrent.AnnounceRequest, now int64, dry bool) (s Session) {
+	s.ID = id
+	h.sessionsMU.Lock()
+	defer h.sessionsMU.Unlock()
+	prev, found := h.sessions[id]
+	switch {
+	case dry:
+	case req.Event == bittorrent.Stopped:
+		delete(h.sessions, id)
+	default:
+		h.sessions[id] = state{uploaded: req.Uploaded, downloaded: req.Downloaded, addr: addr, time: now}
+	}
+	if !found {
+		return
+	}
+	if prev.addr != addr {
+		s.AddressChanged = true
+		logger.Debug().
+			Object("source", req.RequestPeer).
+			Stringer("infoHash", req.InfoHash).
+			Str("previous", privacy.ParseString(prev.addr)).
+			Msg("peer address changed")
+	}
+	if req.Uploaded < prev.uploaded || req.Downloaded < prev.downloaded {
+		prev.uploaded, prev.downloaded = 0, 0
+	}
+	s.Uploaded, s.Downloaded = req.Uploaded-prev.uploaded, req.Downloaded-prev.downloaded
+	return
+}
+
+// touchAddress updates address activity of user and returns active addresses
+// if there are more than MaxAddresses of them and AlertInterval passed since previous alert
+func (h *hook) touchAddress(user, addr string, stopped bool, now int64) (out []string) {
+	if stopped {
+		// address may still be used by other peers of user,
+		// it will be forgotten after PeerLifetime
+		return
+	}
+	h.addressesMU.Lock()
+	defer h.addressesMU.Unlock()
+	addrs, ok := h.addresses[user]
+	if !ok {
+		addrs = make(map[string]int64, 1)
+		h.addresses[user] = addrs
+	}
+	addrs[addr] = now
+	if len(addrs) <= h.cfg.MaxAddresses {
+		return
+	}
+	if last, exists := h.lastAlert[user]; exists && now-last < int64(h.cfg.AlertInterval) {
+		return
+	}
+	h.lastAlert[user] = now
+	out = make([]string, 0, len(addrs))
+	for a := range addrs {
+		out = append(out, a)
+	}
+	sort.Strings(out)
+	return
+}
+
+func (h *hook) alert(ctx context.Context, req *bittorrent.AnnounceRequest, user string, addrs []string) {
+	if privacy.Enabled() {
+		anonymized := make([]string, 0, len(addrs))
+		for _, a := range addrs {
+			anonymized = append(anonymized, privacy.ParseString(a))
+		}
+		addrs = anonymized
+	}
+	logger.Warn().
+		Str("user", user).
+		Strs("addresses", addrs).
+		Msg("user announced from too many addresses")
+	if h.sender != nil {
+		e := webhook.NewEvent(ctx, webhook.EventTooManyAddresses, req)
+		e.User, e.Addresses = user, addrs
+		h.sender.Push(e)
+	}
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't belong to sessions.
+	return ctx, nil
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.PeerLifetime / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.gc(timecache.Now().Add(-h.cfg.PeerLifetime).UnixNano())
+		}
+	}
+}
+
+func (h *hook) gc(cutoff int64) {
+	h.sessionsMU.Lock()
+	for k, s := range h.sessions {
+		if s.time <= cutoff {
+			delete(h.sessions, k)
+		}
+	}
+	h.sessionsMU.Unlock()
+	h.addressesMU.Lock()
+	for user, addrs := range h.addresses {
+		for a, t := range addrs {
+			if t <= cutoff {
+				delete(addrs, a)
+			}
+		}
+		if len(addrs) == 0 {
+			delete(h.addresses, user)
+		}
+	}
+	for user, t := range h.lastAlert {
+		if t <= cutoff-int64(h.cfg.AlertInterval) {
+			delete(h.lastAlert, user)
+		}
+	}
+	h.addressesMU.Unlock()
+}
+
+// Close stops stale sessions collection and sends pending alerts
+func (h *hook) Close() (err error) {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		if h.sender != nil {
+			err = h.sender.Close()
+		}
+	})
+	return
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+type params map[string]string
+
+func (p params) GetString(key string) (out string, found bool) {
+	out, found = p[key]
+	return
+}
+
+func (params) MarshalZerologObject(*zerolog.Event) {}
+
+func newRequest(addr string, up, down uint64) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash:   bittorrent.InfoHash("11111111111111111111"),
+		Uploaded:   up,
+		Downloaded: down,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}},
+		},
+		Params: params{"passkey": "user1", "key": "abcdef"},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+
+	rctx, err := h.HandleAnnounce(ctx, newRequest("1.2.3.4", 100, 100), resp)
+	require.Nil(t, err)
+	s, found := FromContext(rctx)
+	require.True(t, found)
+	require.Equal(t, uint64(0), s.Uploaded)
+
+	// address changed, session continues
+	rctx, err = h.HandleAnnounce(ctx, newRequest("1.2.3.5", 150, 300), resp)
+	require.Nil(t, err)
+	s, _ = FromContext(rctx)
+	require.True(t, s.AddressChanged)
+	require.Equal(t, uint64(50), s.Uploaded)
+	require.Equal(t, uint64(200), s.Downloaded)
+
+	// client restarted
+	rctx, err = h.HandleAnnounce(ctx, newRequest("1.2.3.5", 10, 20), resp)
+	require.Nil(t, err)
+	s, _ = FromContext(rctx)
+	require.False(t, s.AddressChanged)
+	require.Equal(t, uint64(10), s.Uploaded)
+	require.Equal(t, uint64(20), s.Downloaded)
+
+	// another key is another session
+	req := newRequest("1.2.3.5", 100, 100)
+	req.Params = params{"key": "012345"}
+	rctx, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	s2, _ := FromContext(rctx)
+	require.NotEqual(t, s.ID, s2.ID)
+	require.Equal(t, uint64(0), s2.Uploaded)
+}
+
+func TestTooManyAddresses(t *testing.T) {
+	h, err := build(conf.MapConfig{"user_param": "passkey", "max_addresses": 2}, nil)
+	require.Nil(t, err)
+	hk := h.(*hook)
+	defer hk.Close()
+
+	now := int64(1)
+	require.Empty(t, hk.touchAddress("user1", "1.2.3.4", false, now))
+	require.Empty(t, hk.touchAddress("user1", "1.2.3.5", false, now))
+	require.Empty(t, hk.touchAddress("user1", "1.2.3.5", false, now))
+	require.Equal(t, []string{"1.2.3.4", "1.2.3.5", "1.2.3.6"}, hk.touchAddress("user1", "1.2.3.6", false, now))
+	// alert interval not passed
+	require.Empty(t, hk.touchAddress("user1", "1.2.3.7", false, now))
+	require.Empty(t, hk.touchAddress("user2", "1.2.3.7", false, now))
+
+	hk.gc(now)
+	require.Empty(t, hk.addresses)
+}
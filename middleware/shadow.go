@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
+
+// shadowContext hides RejectCache from not enforced hook,
+// so its rejections are not recorded
+func shadowContext(ctx context.Context) context.Context {
+	if ctx.Value(rejectCacheKey{}) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, rejectCacheKey{}, (*RejectCache)(nil))
+}
+
+// restoreContext makes RejectCache of ctx visible in context
+// returned by not enforced hook for the next hooks
+func restoreContext(outCtx, ctx context.Context) context.Context {
+	if c := ctx.Value(rejectCacheKey{}); c != nil {
+		return context.WithValue(outCtx, rejectCacheKey{}, c)
+	}
+	return outCtx
+}
+
+// recordShadow logs and counts request, which would be rejected by hook
+func (h *timedHook) recordShadow(action string, err error, req zerolog.LogObjectMarshaler) {
+	sampledLogger.Info("shadow rejection").
+		Str("hook", h.name).
+		Str("action", action).
+		Err(err).
+		Object("request", req).
+		Msg("request would be rejected by not enforced hook")
+	if metrics.Enabled() {
+		PromHookShadowRejections.WithLabelValues(h.name, action, errorLabel(err)).Inc()
+	}
+}
+
+func (h *timedHook) shadowAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	var start time.Time
+	timed := metrics.Enabled()
+	if timed {
+		start = time.Now()
+	}
+	outCtx, err := h.Hook.HandleAnnounce(shadowContext(ctx), req, resp)
+	if timed {
+		recordHook(h.name, "announce", nil, start)
+	}
+	if err != nil {
+		h.recordShadow("announce", err, req)
+		return ctx, nil
+	}
+	return restoreContext(outCtx, ctx), nil
+}
+
+func (h *timedHook) shadowScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	var start time.Time
+	timed := metrics.Enabled()
+	if timed {
+		start = time.Now()
+	}
+	data := slices.Clone(resp.Data)
+	outCtx, err := h.Hook.HandleScrape(shadowContext(ctx), req, resp)
+	if timed {
+		recordHook(h.name, "scrape", nil, start)
+	}
+	h.restoreScrapes(data, resp, req)
+	if err != nil {
+		h.recordShadow("scrape", err, req)
+		return ctx, nil
+	}
+	return restoreContext(outCtx, ctx), nil
+}
+
+// restoreScrapes removes failures of info hashes set by hook from resp
+// and records them, data is the content of resp before hook is called
+func (h *timedHook) restoreScrapes(data bittorrent.Scrapes, resp *bittorrent.ScrapeResponse, req *bittorrent.ScrapeRequest) {
+	out := resp.Data[:0]
+	for i, scr := range resp.Data {
+		if scr.Failure == nil || i < len(data) && data[i].Failure != nil {
+			out = append(out, scr)
+			continue
+		}
+		h.recordShadow("scrape", scr.Failure, req)
+		if i < len(data) {
+			out = append(out, data[i])
+		}
+	}
+	resp.Data = out
+}
@@ -0,0 +1,253 @@
+// Package slots implements a Hook that fails an Announce if user
+// is already leeching maximum allowed number of torrents.
+package slots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/userclass"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "slots"
+
+const defaultPeerLifetime = storage.DefaultPeerLifetime
+
+var (
+	logger = log.NewLogger("middleware/slots")
+
+	// ErrNoFreeSlots is returned when user is already leeching
+	// maximum allowed number of torrents.
+	ErrNoFreeSlots = bittorrent.NewRetryableError(bittorrent.ReasonLimitExceeded, "maximum active downloads reached")
+
+	errNoUserParam = errors.New("user_param not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+type acquired struct{}
+
+// acquiredKey marks announce context, which added peer into slots
+var acquiredKey = acquired{}
+
+// Config represents all the values required by this middleware
+// to limit active downloads.
+type Config struct {
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey).
+	UserParam string `cfg:"user_param"`
+	// MaxSlots is the maximum number of distinct torrents which
+	// single user may leech at the same time. Zero means no limit.
+	MaxSlots int `cfg:"max_slots"`
+	// PeerLifetime is the period after which inactive peer
+	// does not hold slot anymore. Should be the same as storage's peer_lifetime.
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.UserParam) == 0 {
+		err = errNoUserParam
+		return
+	}
+	if cfg.MaxSlots < 0 {
+		validCfg.MaxSlots = 0
+		logger.Warn().
+			Str("name", "MaxSlots").
+			Int("provided", cfg.MaxSlots).
+			Int("default", validCfg.MaxSlots).
+			Msg("falling back to default configuration")
+	}
+	if cfg.PeerLifetime <= 0 {
+		validCfg.PeerLifetime = defaultPeerLifetime
+		logger.Warn().
+			Str("name", "PeerLifetime").
+			Dur("provided", cfg.PeerLifetime).
+			Dur("default", validCfg.PeerLifetime).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:    cfg,
+		users:  make(map[string]map[string]map[string]int64),
+		closed: make(chan any),
+	}
+	go h.runGC()
+	return h, nil
+}
+
+type hook struct {
+	cfg Config
+	// users maps user to leeching torrents, each of them
+	// maps peer ID to the last announce time
+	users      map[string]map[string]map[string]int64
+	mu         sync.Mutex
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// limit returns maximum slots of user, which may be overridden by user class
+func (h *hook) limit(ctx context.Context) int {
+	if c, ok := userclass.FromContext(ctx); ok && c.MaxSlots != 0 {
+		return max(c.MaxSlots, 0)
+	}
+	return h.cfg.MaxSlots
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Params == nil {
+		return ctx, nil
+	}
+	user, _ := req.Params.GetString(h.cfg.UserParam)
+	if len(user) == 0 {
+		return ctx, nil
+	}
+	ih, id := req.InfoHash.TruncateV1().RawString(), req.ID.RawString()
+
+	dry := middleware.DryRun(ctx)
+	if req.Event == bittorrent.Stopped || req.Left == 0 {
+		if !dry {
+			h.release(user, ih, id)
+		}
+		return ctx, nil
+	}
+
+	ok, added := h.acquire(user, ih, id, h.limit(ctx), dry)
+	if !ok {
+		logger.Debug().
+			Object("source", req.RequestPeer).
+			Stringer("infoHash", req.InfoHash).
+			Str("user", user).
+			Msg("slots limit reached")
+		return ctx, ErrNoFreeSlots
+	}
+	if added {
+		ctx = context.WithValue(ctx, acquiredKey, user)
+	}
+	return ctx, nil
+}
+
+// AnnounceRejected implements middleware.RejectObserver and releases
+// slot acquired by announce, which was rejected by subsequent hook.
+func (h *hook) AnnounceRejected(ctx context.Context, req *bittorrent.AnnounceRequest, _ error) {
+	if user, ok := ctx.Value(acquiredKey).(string); ok {
+		h.release(user, req.InfoHash.TruncateV1().RawString(), req.ID.RawString())
+	}
+}
+
+// acquire updates peer's activity time. If torrent is new for the user
+// and user already leeches limit torrents, acquire returns false.
+// Zero limit means no limit. If dry is set, activity is not updated.
+// added is set if peer was not holding slot before.
+func (h *hook) acquire(user, ih, id string, limit int, dry bool) (ok, added bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if dry {
+		torrents := h.users[user]
+		_, ok = torrents[ih]
+		return ok || limit <= 0 || len(torrents) < limit, false
+	}
+	torrents, ok := h.users[user]
+	if !ok {
+		torrents = make(map[string]map[string]int64, 1)
+		h.users[user] = torrents
+	}
+	peers, ok := torrents[ih]
+	if !ok {
+		if limit > 0 && len(torrents) >= limit {
+			return false, false
+		}
+		peers = make(map[string]int64, 1)
+		torrents[ih] = peers
+	}
+	_, ok = peers[id]
+	peers[id] = timecache.NowUnixNano()
+	return true, !ok
+}
+
+func (h *hook) release(user, ih, id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if torrents, ok := h.users[user]; ok {
+		if peers, ok := torrents[ih]; ok {
+			delete(peers, id)
+			if len(peers) == 0 {
+				delete(torrents, ih)
+			}
+		}
+		if len(torrents) == 0 {
+			delete(h.users, user)
+		}
+	}
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't occupy slots.
+	return ctx, nil
+}
+
+func (h *hook) runGC() {
+	t := time.NewTicker(h.cfg.PeerLifetime / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.gc(timecache.Now().Add(-h.cfg.PeerLifetime).UnixNano())
+		}
+	}
+}
+
+func (h *hook) gc(cutoff int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for user, torrents := range h.users {
+		for ih, peers := range torrents {
+			for id, mtime := range peers {
+				if mtime <= cutoff {
+					delete(peers, id)
+				}
+			}
+			if len(peers) == 0 {
+				delete(torrents, ih)
+			}
+		}
+		if len(torrents) == 0 {
+			delete(h.users, user)
+		}
+	}
+}
+
+// Close stops stale peers collection
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
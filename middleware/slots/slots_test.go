@@ -0,0 +1,161 @@
+package slots
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/userclass"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+type params map[string]string
+
+func (p params) GetString(key string) (out string, found bool) {
+	out, found = p[key]
+	return
+}
+
+func (params) MarshalZerologObject(*zerolog.Event) {}
+
+func newRequest(ih string, id byte, left uint64) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash(ih),
+		Left:     left,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+		Params: params{"passkey": "user1"},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{"user_param": "passkey", "max_slots": 2}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{}
+	ih1, ih2, ih3 := "11111111111111111111", "22222222222222222222", "33333333333333333333"
+
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 1, 100), resp)
+	require.Nil(t, err)
+	// second peer of user in the same swarm does not occupy slot
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 2, 100), resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, newRequest(ih2, 1, 100), resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, newRequest(ih3, 1, 100), resp)
+	require.Equal(t, ErrNoFreeSlots, err)
+
+	// seeding does not occupy slot
+	_, err = h.HandleAnnounce(ctx, newRequest(ih3, 1, 0), resp)
+	require.Nil(t, err)
+
+	// the first peer finished, but the second is still leeching
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 1, 0), resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, newRequest(ih3, 1, 100), resp)
+	require.Equal(t, ErrNoFreeSlots, err)
+
+	stopped := newRequest(ih1, 2, 100)
+	stopped.Event = bittorrent.Stopped
+	_, err = h.HandleAnnounce(ctx, stopped, resp)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(ctx, newRequest(ih3, 1, 100), resp)
+	require.Nil(t, err)
+
+	// stale peers release slots
+	h.(*hook).gc(timecache.NowUnixNano())
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 1, 100), resp)
+	require.Nil(t, err)
+}
+
+func TestUserClass(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	hooks, err := middleware.NewHooks([]middleware.HookConfig{{NamedMapConfig: conf.NamedMapConfig{
+		Name: userclass.Name,
+		Config: conf.MapConfig{
+			"user_param":    "passkey",
+			"classes":       []any{map[string]any{"name": "user", "max_slots": 1}},
+			"default_class": "user",
+		},
+	}}}, ps)
+	require.Nil(t, err)
+	h, err := build(conf.MapConfig{"user_param": "passkey", "max_slots": 2}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	resp := &bittorrent.AnnounceResponse{}
+	for i, ih := range []string{"11111111111111111111", "22222222222222222222"} {
+		req := newRequest(ih, 1, 100)
+		ctx, err := hooks[0].HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		_, err = h.HandleAnnounce(ctx, req, resp)
+		if i == 0 {
+			require.Nil(t, err)
+		} else {
+			require.Equal(t, ErrNoFreeSlots, err)
+		}
+	}
+}
+
+// rejectHook rejects announces of the specified info hash
+type rejectHook struct {
+	ih bittorrent.InfoHash
+}
+
+func (h rejectHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.InfoHash == h.ih {
+		return ctx, bittorrent.ClientError{Message: "rejected"}
+	}
+	return ctx, nil
+}
+
+func (rejectHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func TestRejected(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"user_param": "passkey", "max_slots": 1}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	ih1, ih2 := "11111111111111111111", "22222222222222222222"
+	l := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{h, rejectHook{bittorrent.InfoHash(ih1)}}, nil, nil)
+
+	// announce rejected by the next hook does not hold slot
+	ctx := context.Background()
+	_, _, err = l.HandleAnnounce(ctx, newRequest(ih1, 1, 100))
+	require.NotNil(t, err)
+	_, _, err = l.HandleAnnounce(ctx, newRequest(ih2, 1, 100))
+	require.Nil(t, err)
+
+	// slot acquired before is not released
+	l = middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{h, rejectHook{bittorrent.InfoHash(ih2)}}, nil, nil)
+	_, _, err = l.HandleAnnounce(ctx, newRequest(ih2, 1, 100))
+	require.NotNil(t, err)
+	_, err = h.HandleAnnounce(ctx, newRequest(ih1, 1, 100), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrNoFreeSlots, err)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{"max_slots": 1}, nil)
+	require.ErrorIs(t, err, errNoUserParam)
+}
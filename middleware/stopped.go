@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// stoppedPeersCtx is the name of storage context where peers
+// in stopped grace period are stored
+const stoppedPeersCtx = "STOPPED_PEERS"
+
+// stoppedRecordLen is the length of stored peer: ID, IPv6 (or mapped IPv4)
+// address, port and end of grace period
+const stoppedRecordLen = bittorrent.PeerIDLen + 16 + 2 + 8
+
+// stoppedPeers holds peers, which sent stopped event and are kept in swarm
+// for grace period (see Logic.SetStoppedGracePeriod). Peers of swarm are
+// stored as single value in data storage, so they are not returned to other
+// peers by any tracker instance until they announce again.
+type stoppedPeers struct {
+	store storage.DataStorage
+	grace time.Duration
+}
+
+func decodeStopped(b []byte, now int64) map[bittorrent.Peer]int64 {
+	m := make(map[bittorrent.Peer]int64, len(b)/stoppedRecordLen)
+	for ; len(b) >= stoppedRecordLen; b = b[stoppedRecordLen:] {
+		until := int64(binary.BigEndian.Uint64(b[stoppedRecordLen-8:]))
+		if until <= now {
+			continue
+		}
+		var p bittorrent.Peer
+		copy(p.ID[:], b)
+		addr := netip.AddrFrom16([16]byte(b[bittorrent.PeerIDLen:])).Unmap()
+		p.AddrPort = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b[bittorrent.PeerIDLen+16:]))
+		m[p] = until
+	}
+	return m
+}
+
+func encodeStopped(m map[bittorrent.Peer]int64) []byte {
+	out := make([]byte, 0, len(m)*stoppedRecordLen)
+	for p, until := range m {
+		out = append(out, p.ID[:]...)
+		a16 := p.Addr().As16()
+		out = append(out, a16[:]...)
+		out = binary.BigEndian.AppendUint16(out, p.Port())
+		out = binary.BigEndian.AppendUint64(out, uint64(until))
+	}
+	return out
+}
+
+// enabled returns true if grace period is set
+func (sp *stoppedPeers) enabled() bool {
+	return sp.grace > 0
+}
+
+// load returns peers of swarm ih in grace period,
+// stored value is deleted if grace period of all peers is expired
+func (sp *stoppedPeers) load(ctx context.Context, ih bittorrent.InfoHash) (map[bittorrent.Peer]int64, error) {
+	b, err := sp.store.Load(ctx, stoppedPeersCtx, ih.RawString())
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+	m := decodeStopped(b, timecache.NowUnixNano())
+	if len(m) == 0 && !DryRun(ctx) {
+		err = sp.update(ctx, ih, nil, false)
+	}
+	return m, err
+}
+
+// update adds peers to grace period if stopped is set or removes them otherwise,
+// peers with expired grace period are removed as well.
+// Value is deleted if there are no peers left in grace period.
+func (sp *stoppedPeers) update(ctx context.Context, ih bittorrent.InfoHash, peers []bittorrent.Peer, stopped bool) error {
+	now := timecache.NowUnixNano()
+	return storage.Update(ctx, sp.store, stoppedPeersCtx, ih.RawString(), func(b []byte) ([]byte, error) {
+		m := decodeStopped(b, now)
+		for _, p := range peers {
+			if stopped {
+				m[p] = now + int64(sp.grace)
+			} else {
+				delete(m, p)
+			}
+		}
+		if len(m) == 0 {
+			return nil, nil
+		}
+		return encodeStopped(m), nil
+	})
+}
@@ -0,0 +1,34 @@
+package stream
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func init() {
+	RegisterPublisher("kafka", newKafkaPublisher)
+}
+
+type kafkaPublisher struct {
+	*kafka.Writer
+}
+
+func newKafkaPublisher(cfg Config) (Publisher, error) {
+	return &kafkaPublisher{&kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Balancer:     &kafka.Hash{},
+		BatchSize:    cfg.BatchSize,
+		BatchTimeout: cfg.FlushInterval,
+		WriteTimeout: cfg.Timeout,
+		RequiredAcks: kafka.RequireOne,
+	}}, nil
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, records []Record) error {
+	msgs := make([]kafka.Message, 0, len(records))
+	for _, r := range records {
+		msgs = append(msgs, kafka.Message{Topic: r.Topic, Key: r.Key, Value: r.Value})
+	}
+	return p.WriteMessages(ctx, msgs...)
+}
@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"encoding/json"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/privacy"
+)
+
+// Supported message formats
+const (
+	// FormatJSON serializes Message as JSON object
+	FormatJSON = "json"
+	// FormatProtobuf serializes Message as protobuf message,
+	// see Message for field numbers
+	FormatProtobuf = "protobuf"
+)
+
+// Message types
+const (
+	TypeAnnounce = "announce"
+	TypeScrape   = "scrape"
+)
+
+// Message is the structure published into broker.
+// Protobuf field numbers are specified in `pb` tag.
+type Message struct {
+	Type       string   `json:"type" pb:"1"`
+	Time       int64    `json:"time" pb:"2"`
+	InfoHashes []string `json:"info_hashes" pb:"3"`
+	PeerID     string   `json:"peer_id,omitempty" pb:"4"`
+	Addresses  []string `json:"addresses" pb:"5"`
+	Port       uint16   `json:"port,omitempty" pb:"6"`
+	Event      string   `json:"event,omitempty" pb:"7"`
+	Uploaded   uint64   `json:"uploaded,omitempty" pb:"8"`
+	Downloaded uint64   `json:"downloaded,omitempty" pb:"9"`
+	Left       uint64   `json:"left,omitempty" pb:"10"`
+	NumWant    uint32   `json:"num_want,omitempty" pb:"11"`
+}
+
+func addresses(aa bittorrent.RequestAddresses) []string {
+	out := make([]string, 0, len(aa))
+	for _, a := range aa {
+		out = append(out, privacy.String(a.Addr))
+	}
+	return out
+}
+
+func newAnnounceMessage(req *bittorrent.AnnounceRequest) *Message {
+	return &Message{
+		Type:       TypeAnnounce,
+		Time:       time.Now().UnixNano(),
+		InfoHashes: []string{req.InfoHash.String()},
+		PeerID:     req.ID.String(),
+		Addresses:  addresses(req.RequestAddresses),
+		Port:       req.Port,
+		Event:      req.Event.String(),
+		Uploaded:   req.Uploaded,
+		Downloaded: req.Downloaded,
+		Left:       req.Left,
+		NumWant:    req.NumWant,
+	}
+}
+
+func newScrapeMessage(req *bittorrent.ScrapeRequest) *Message {
+	ihs := make([]string, 0, len(req.InfoHashes))
+	for _, ih := range req.InfoHashes {
+		ihs = append(ihs, ih.String())
+	}
+	return &Message{
+		Type:       TypeScrape,
+		Time:       time.Now().UnixNano(),
+		InfoHashes: ihs,
+		Addresses:  addresses(req.RequestAddresses),
+	}
+}
+
+func encodeJSON(m *Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// encodeProtobuf serializes Message in protobuf wire format
+// without generated code. Fields with default values are omitted.
+func encodeProtobuf(m *Message) ([]byte, error) {
+	b := make([]byte, 0, 128)
+	appendString := func(n protowire.Number, s string) {
+		if len(s) > 0 {
+			b = protowire.AppendTag(b, n, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+	appendVarint := func(n protowire.Number, v uint64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, n, protowire.VarintType)
+			b = protowire.AppendVarint(b, v)
+		}
+	}
+	appendString(1, m.Type)
+	appendVarint(2, uint64(m.Time))
+	for _, ih := range m.InfoHashes {
+		appendString(3, ih)
+	}
+	appendString(4, m.PeerID)
+	for _, a := range m.Addresses {
+		appendString(5, a)
+	}
+	appendVarint(6, uint64(m.Port))
+	appendString(7, m.Event)
+	appendVarint(8, m.Uploaded)
+	appendVarint(9, m.Downloaded)
+	appendVarint(10, m.Left)
+	appendVarint(11, uint64(m.NumWant))
+	return b, nil
+}
@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func init() {
+	RegisterPublisher("nats", newNATSPublisher)
+}
+
+type natsPublisher struct {
+	conn *nats.Conn
+	js   jetstream.JetStream
+}
+
+func newNATSPublisher(cfg Config) (Publisher, error) {
+	conn, err := nats.Connect(strings.Join(cfg.Brokers, ","), nats.Timeout(cfg.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &natsPublisher{conn: conn, js: js}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, records []Record) (err error) {
+	futures := make([]jetstream.PubAckFuture, 0, len(records))
+	for _, r := range records {
+		var f jetstream.PubAckFuture
+		if f, err = p.js.PublishAsync(r.Topic, r.Value); err != nil {
+			break
+		}
+		futures = append(futures, f)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Ok():
+		case e := <-f.Err():
+			err = errors.Join(err, e)
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		}
+	}
+	return
+}
+
+func (p *natsPublisher) Close() error {
+	return p.conn.Drain()
+}
@@ -0,0 +1,303 @@
+// Package stream implements a Hook that publishes every announce and scrape
+// as structured message to message broker (Kafka or NATS JetStream).
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "stream"
+
+const (
+	defaultAnnounceTopic = "mochi.announce"
+	defaultScrapeTopic   = "mochi.scrape"
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultQueueSize     = 10000
+	defaultTimeout       = 5 * time.Second
+)
+
+var (
+	logger = log.NewLogger("middleware/stream")
+
+	errNoBrokers = errors.New("brokers not provided")
+
+	buildersMU sync.Mutex
+	builders   = make(map[string]PublisherBuilder)
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Record is the single message to publish
+type Record struct {
+	// Topic (or subject) where to publish message
+	Topic string
+	// Key used for partitioning, may be empty
+	Key []byte
+	// Value serialized message
+	Value []byte
+}
+
+// Publisher sends records to message broker
+type Publisher interface {
+	io.Closer
+	// Publish sends batch of records and waits until broker
+	// acknowledged them or error occurred
+	Publish(ctx context.Context, records []Record) error
+}
+
+// PublisherBuilder function that creates and configures specific Publisher
+type PublisherBuilder func(Config) (Publisher, error)
+
+// RegisterPublisher used to register specific PublisherBuilder in registry
+func RegisterPublisher(name string, b PublisherBuilder) {
+	if len(name) == 0 {
+		panic("stream: could not register a Publisher with an empty name")
+	}
+	if b == nil {
+		panic("stream: could not register a Publisher with nil builder constructor")
+	}
+
+	buildersMU.Lock()
+	defer buildersMU.Unlock()
+	builders[name] = b
+}
+
+// Config represents all the values required by this middleware
+// to connect to broker and publish messages.
+type Config struct {
+	// Driver is the name of broker: kafka or nats
+	Driver string
+	// Brokers list of broker addresses (host:port for kafka, nats://... URLs for nats)
+	Brokers []string
+	// AnnounceTopic topic (subject) where to publish announces
+	AnnounceTopic string `cfg:"announce_topic"`
+	// ScrapeTopic topic (subject) where to publish scrapes,
+	// if set to "-", scrapes are not published
+	ScrapeTopic string `cfg:"scrape_topic"`
+	// Format of serialized message: json (default) or protobuf
+	Format string
+	// BatchSize maximum number of messages published at once
+	BatchSize int `cfg:"batch_size"`
+	// FlushInterval maximum time between request and publishing
+	FlushInterval time.Duration `cfg:"flush_interval"`
+	// QueueSize maximum number of pending messages,
+	// new messages are dropped if queue is full
+	QueueSize int `cfg:"queue_size"`
+	// Timeout of single publish operation
+	Timeout time.Duration
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.Brokers) == 0 {
+		err = errNoBrokers
+		return
+	}
+	switch cfg.Format {
+	case "":
+		validCfg.Format = FormatJSON
+	case FormatJSON, FormatProtobuf:
+	default:
+		err = fmt.Errorf("unknown format '%s'", cfg.Format)
+		return
+	}
+	if len(cfg.AnnounceTopic) == 0 {
+		validCfg.AnnounceTopic = defaultAnnounceTopic
+		logger.Warn().
+			Str("name", "AnnounceTopic").
+			Str("provided", cfg.AnnounceTopic).
+			Str("default", validCfg.AnnounceTopic).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.ScrapeTopic) == 0 {
+		validCfg.ScrapeTopic = defaultScrapeTopic
+		logger.Warn().
+			Str("name", "ScrapeTopic").
+			Str("provided", cfg.ScrapeTopic).
+			Str("default", validCfg.ScrapeTopic).
+			Msg("falling back to default configuration")
+	}
+	if cfg.BatchSize <= 0 {
+		validCfg.BatchSize = defaultBatchSize
+		logger.Warn().
+			Str("name", "BatchSize").
+			Int("provided", cfg.BatchSize).
+			Int("default", validCfg.BatchSize).
+			Msg("falling back to default configuration")
+	}
+	if cfg.FlushInterval <= 0 {
+		validCfg.FlushInterval = defaultFlushInterval
+		logger.Warn().
+			Str("name", "FlushInterval").
+			Dur("provided", cfg.FlushInterval).
+			Dur("default", validCfg.FlushInterval).
+			Msg("falling back to default configuration")
+	}
+	if cfg.QueueSize <= 0 {
+		validCfg.QueueSize = defaultQueueSize
+		logger.Warn().
+			Str("name", "QueueSize").
+			Int("provided", cfg.QueueSize).
+			Int("default", validCfg.QueueSize).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Timeout <= 0 {
+		validCfg.Timeout = defaultTimeout
+		logger.Warn().
+			Str("name", "Timeout").
+			Dur("provided", cfg.Timeout).
+			Dur("default", validCfg.Timeout).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+
+	buildersMU.Lock()
+	pb, exists := builders[cfg.Driver]
+	buildersMU.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("invalid config for middleware %s: publisher '%s' does not exist", Name, cfg.Driver)
+	}
+
+	var p Publisher
+	if p, err = pb(cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	return newHook(cfg, p), nil
+}
+
+func newHook(cfg Config, p Publisher) *hook {
+	h := &hook{
+		cfg:       cfg,
+		publisher: p,
+		queue:     make(chan Record, cfg.QueueSize),
+		closed:    make(chan any),
+	}
+	if cfg.Format == FormatProtobuf {
+		h.encode = encodeProtobuf
+	} else {
+		h.encode = encodeJSON
+	}
+	h.wg.Add(1)
+	go h.run()
+	return h
+}
+
+type hook struct {
+	cfg        Config
+	publisher  Publisher
+	encode     func(*Message) ([]byte, error)
+	queue      chan Record
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func (h *hook) push(topic string, key []byte, m *Message) {
+	b, err := h.encode(m)
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to serialize message")
+		return
+	}
+	select {
+	case h.queue <- Record{Topic: topic, Key: key, Value: b}:
+	default:
+		logger.Warn().Str("topic", topic).Msg("stream queue is full, dropping message")
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if middleware.DryRun(ctx) {
+		return ctx, nil
+	}
+	h.push(h.cfg.AnnounceTopic, req.InfoHash.Bytes(), newAnnounceMessage(req))
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.cfg.ScrapeTopic != "-" && !middleware.DryRun(ctx) {
+		h.push(h.cfg.ScrapeTopic, nil, newScrapeMessage(req))
+	}
+	return ctx, nil
+}
+
+func (h *hook) run() {
+	defer h.wg.Done()
+	t := time.NewTicker(h.cfg.FlushInterval)
+	defer t.Stop()
+	batch := make([]Record, 0, h.cfg.BatchSize)
+	add := func(r Record) {
+		batch = append(batch, r)
+		if len(batch) >= h.cfg.BatchSize {
+			h.publish(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case <-h.closed:
+			for {
+				select {
+				case r := <-h.queue:
+					add(r)
+				default:
+					h.publish(batch)
+					return
+				}
+			}
+		case r := <-h.queue:
+			add(r)
+		case <-t.C:
+			h.publish(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (h *hook) publish(batch []Record) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	if err := h.publisher.Publish(ctx, batch); err != nil {
+		logger.Error().Err(err).Int("count", len(batch)).Msg("unable to publish messages")
+	}
+}
+
+// Close publishes pending messages and closes broker connection
+func (h *hook) Close() (err error) {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		h.wg.Wait()
+		err = h.publisher.Close()
+	})
+	return
+}
@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+type testPublisher struct {
+	sync.Mutex
+	records []Record
+}
+
+func (p *testPublisher) Publish(_ context.Context, records []Record) error {
+	p.Lock()
+	p.records = append(p.records, records...)
+	p.Unlock()
+	return nil
+}
+
+func (p *testPublisher) Close() error { return nil }
+
+var (
+	testPub = new(testPublisher)
+	testReq = &bittorrent.AnnounceRequest{
+		InfoHash: "11111111111111111111",
+		Event:    bittorrent.Started,
+		Left:     100,
+		RequestPeer: bittorrent.RequestPeer{
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+	}
+)
+
+func init() {
+	RegisterPublisher("test", func(Config) (Publisher, error) { return testPub, nil })
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	for _, format := range []string{FormatJSON, FormatProtobuf} {
+		t.Run(format, func(t *testing.T) {
+			testPub.records = nil
+			h, err := build(conf.MapConfig{
+				"driver":       "test",
+				"brokers":      []string{"localhost"},
+				"format":       format,
+				"scrape_topic": "-",
+			}, nil)
+			require.Nil(t, err)
+			ctx := context.Background()
+			_, err = h.HandleAnnounce(ctx, testReq, nil)
+			require.Nil(t, err)
+			_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{testReq.InfoHash}}, nil)
+			require.Nil(t, err)
+			require.Nil(t, h.(*hook).Close())
+
+			require.Len(t, testPub.records, 1)
+			r := testPub.records[0]
+			require.Equal(t, defaultAnnounceTopic, r.Topic)
+			require.Equal(t, testReq.InfoHash.Bytes(), r.Key)
+			if format == FormatJSON {
+				var m Message
+				require.Nil(t, json.Unmarshal(r.Value, &m))
+				require.Equal(t, TypeAnnounce, m.Type)
+				require.Equal(t, []string{testReq.InfoHash.String()}, m.InfoHashes)
+				require.Equal(t, []string{"1.2.3.4"}, m.Addresses)
+				require.Equal(t, uint64(100), m.Left)
+			} else {
+				fields := make(map[protowire.Number]int)
+				for b := r.Value; len(b) > 0; {
+					n, typ, l := protowire.ConsumeTag(b)
+					require.True(t, l > 0)
+					b = b[l:]
+					l = protowire.ConsumeFieldValue(n, typ, b)
+					require.True(t, l > 0)
+					b = b[l:]
+					fields[n]++
+				}
+				for _, n := range []protowire.Number{1, 2, 3, 4, 5, 6, 7, 10} {
+					require.Equal(t, 1, fields[n], "field %d", n)
+				}
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	testPub.records = nil
+	h, err := build(conf.MapConfig{"driver": "test", "brokers": []string{"localhost"}}, nil)
+	require.Nil(t, err)
+	ctx := middleware.WithDryRun(context.Background())
+	_, err = h.HandleAnnounce(ctx, testReq, nil)
+	require.Nil(t, err)
+	_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{testReq.InfoHash}}, nil)
+	require.Nil(t, err)
+	require.Nil(t, h.(*hook).Close())
+	require.Empty(t, testPub.records)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{"driver": "unknown", "brokers": []string{"localhost"}}, nil)
+	require.NotNil(t, err)
+	_, err = build(conf.MapConfig{"driver": "test"}, nil)
+	require.ErrorIs(t, err, errNoBrokers)
+	_, err = build(conf.MapConfig{"driver": "test", "brokers": []string{"localhost"}, "format": "xml"}, nil)
+	require.NotNil(t, err)
+}
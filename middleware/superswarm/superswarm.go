@@ -0,0 +1,329 @@
+// Package superswarm implements a Hook that protects tracker from flash
+// crowds of single torrent: if announce rate of info hash exceeds limit,
+// announces of this hash are responded with cached peer lists and
+// stretched intervals, so the rest of torrents are not affected.
+package superswarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "superswarm"
+
+const (
+	defaultWindow             = 10 * time.Second
+	defaultProtectFor         = 5 * time.Minute
+	defaultCacheTTL           = 10 * time.Second
+	defaultIntervalMultiplier = 2
+	// shardCount is the number of independently locked parts of state
+	shardCount = 64
+)
+
+var (
+	logger = log.NewLogger("middleware/superswarm")
+
+	errNoRate = errors.New("max_rate not provided")
+
+	// PromProtectedHashes is the number of info hashes currently protected
+	PromProtectedHashes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mochi_middleware_superswarm_protected_hashes",
+		Help: "The number of info hashes, announces of which are responded from cache",
+	})
+
+	// PromCachedAnnounces is the number of announces responded with cached peers
+	PromCachedAnnounces = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mochi_middleware_superswarm_cached_announces_total",
+		Help: "The number of announces of protected info hashes responded with cached peers",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(PromProtectedHashes, PromCachedAnnounces)
+	middleware.RegisterBuilder(Name, build)
+}
+
+type cached struct{}
+
+// cachedKey marks announce context responded from cache
+var cachedKey = cached{}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// MaxRate is the number of announces of single info hash per second,
+	// above which info hash is protected.
+	MaxRate float64 `cfg:"max_rate"`
+	// Window is the period, during which announce rate is measured.
+	Window time.Duration
+	// ProtectFor is the time, during which info hash stays protected
+	// after its announce rate exceeded MaxRate.
+	ProtectFor time.Duration `cfg:"protect_for"`
+	// CacheTTL is the time, during which cached peers of protected
+	// info hash are returned before they are selected from storage again.
+	CacheTTL time.Duration `cfg:"cache_ttl"`
+	// IntervalMultiplier is the multiplier applied to interval and
+	// min interval returned for protected info hash.
+	// Values less or equal to 1 disable modification.
+	IntervalMultiplier float64 `cfg:"interval_multiplier"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if cfg.MaxRate <= 0 {
+		err = errNoRate
+		return
+	}
+	if cfg.Window <= 0 {
+		validCfg.Window = defaultWindow
+		logger.Warn().
+			Str("name", "Window").
+			Dur("provided", cfg.Window).
+			Dur("default", validCfg.Window).
+			Msg("falling back to default configuration")
+	}
+	if cfg.ProtectFor <= 0 {
+		validCfg.ProtectFor = defaultProtectFor
+		logger.Warn().
+			Str("name", "ProtectFor").
+			Dur("provided", cfg.ProtectFor).
+			Dur("default", validCfg.ProtectFor).
+			Msg("falling back to default configuration")
+	}
+	if cfg.CacheTTL <= 0 {
+		validCfg.CacheTTL = defaultCacheTTL
+		logger.Warn().
+			Str("name", "CacheTTL").
+			Dur("provided", cfg.CacheTTL).
+			Dur("default", validCfg.CacheTTL).
+			Msg("falling back to default configuration")
+	}
+	if cfg.IntervalMultiplier == 0 {
+		validCfg.IntervalMultiplier = defaultIntervalMultiplier
+		logger.Warn().
+			Str("name", "IntervalMultiplier").
+			Float64("provided", cfg.IntervalMultiplier).
+			Float64("default", validCfg.IntervalMultiplier).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:    cfg,
+		limit:  uint64(cfg.MaxRate * cfg.Window.Seconds()),
+		seed:   maphash.MakeSeed(),
+		closed: make(chan any),
+	}
+	for i := range h.shards {
+		h.shards[i] = newShard()
+	}
+	go h.run()
+	return h, nil
+}
+
+// cacheKey separates peers for seeders and leechers,
+// because storage returns only leechers to seeders,
+// and for address families of requesters, because
+// peers of requester's family are selected first
+type cacheKey struct {
+	ih      bittorrent.InfoHash
+	seeding bool
+	v6      bool
+}
+
+func newCacheKey(req *bittorrent.AnnounceRequest) cacheKey {
+	return cacheKey{req.InfoHash.TruncateV1(), req.Left == 0, req.GetFirst().Is6()}
+}
+
+type entry struct {
+	incomplete, complete uint32
+	v4, v6               []bittorrent.Peer
+	expire               int64
+}
+
+// shard is the part of hook state with info hashes of the same shard index
+type shard struct {
+	// counts is the number of announces of each info hash during current window
+	counts map[bittorrent.InfoHash]uint64
+	// protected contains moments, until which info hashes are protected
+	protected map[bittorrent.InfoHash]int64
+	cache     map[cacheKey]entry
+	sync.Mutex
+}
+
+func newShard() *shard {
+	return &shard{
+		counts:    make(map[bittorrent.InfoHash]uint64),
+		protected: make(map[bittorrent.InfoHash]int64),
+		cache:     make(map[cacheKey]entry),
+	}
+}
+
+type hook struct {
+	cfg Config
+	// limit is the maximum number of announces of info hash during window
+	limit  uint64
+	shards [shardCount]*shard
+	// seed is the random per-process key of shard index hash
+	seed maphash.Seed
+
+	closed     chan any
+	onceCloser sync.Once
+}
+
+func (h *hook) shard(ih bittorrent.InfoHash) *shard {
+	return h.shards[maphash.String(h.seed, string(ih))%shardCount]
+}
+
+// HandleAnnounce counts announce of info hash and, if info hash is protected,
+// stretches intervals and fills response with cached peers and counts,
+// if they are not expired. Swarm is still updated with requesting peer.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	key, now := newCacheKey(req), timecache.NowUnixNano()
+	sh := h.shard(key.ih)
+	sh.Lock()
+	if !middleware.DryRun(ctx) {
+		sh.counts[key.ih]++
+	}
+	_, isProtected := sh.protected[key.ih]
+	e, found := sh.cache[key]
+	sh.Unlock()
+	if !isProtected {
+		return ctx, nil
+	}
+	if m := h.cfg.IntervalMultiplier; m > 1 {
+		resp.Interval = time.Duration(float64(resp.Interval) * m)
+		resp.MinInterval = time.Duration(float64(resp.MinInterval) * m)
+	}
+	if !found || e.expire <= now {
+		return ctx, nil
+	}
+	resp.Incomplete, resp.Complete = e.incomplete, e.complete
+	if n := int(req.NumWant); n > 0 {
+		// peers of requester's family are returned first
+		if key.v6 {
+			v6 := min(n, len(e.v6))
+			resp.IPv6Peers = slices.Clone(e.v6[:v6])
+			resp.IPv4Peers = slices.Clone(e.v4[:min(n-v6, len(e.v4))])
+		} else {
+			v4 := min(n, len(e.v4))
+			resp.IPv4Peers = slices.Clone(e.v4[:v4])
+			resp.IPv6Peers = slices.Clone(e.v6[:min(n-v4, len(e.v6))])
+		}
+	} else {
+		resp.IPv4Peers, resp.IPv6Peers = nil, nil
+	}
+	PromCachedAnnounces.Inc()
+	ctx = context.WithValue(ctx, cachedKey, true)
+	ctx = context.WithValue(ctx, middleware.SkipResponseHookKey, true)
+	return ctx, nil
+}
+
+// AnnounceResponded implements middleware.ResponseObserver,
+// it caches peers selected for protected info hash
+func (h *hook) AnnounceResponded(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	if req.NumWant == 0 || ctx.Value(cachedKey) != nil {
+		return
+	}
+	key := newCacheKey(req)
+	sh := h.shard(key.ih)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, isProtected := sh.protected[key.ih]; isProtected {
+		sh.cache[key] = entry{
+			incomplete: resp.Incomplete,
+			complete:   resp.Complete,
+			v4:         slices.Clone(resp.IPv4Peers),
+			v6:         slices.Clone(resp.IPv6Peers),
+			expire:     timecache.NowUnixNano() + int64(h.cfg.CacheTTL),
+		}
+	}
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not limited.
+	return ctx, nil
+}
+
+// rotate protects info hashes, which exceeded limit during
+// the last window, releases expired ones and resets counters
+func (h *hook) rotate(now int64) {
+	var protected int
+	for _, sh := range h.shards {
+		protected += h.rotateShard(sh, now)
+	}
+	PromProtectedHashes.Set(float64(protected))
+}
+
+// rotateShard rotates state of sh, returns the number of protected info hashes
+func (h *hook) rotateShard(sh *shard, now int64) int {
+	sh.Lock()
+	defer sh.Unlock()
+	for ih, n := range sh.counts {
+		if n > h.limit {
+			if _, isProtected := sh.protected[ih]; !isProtected {
+				logger.Info().Stringer("infoHash", ih).Uint64("announces", n).Msg("info hash protected")
+			}
+			sh.protected[ih] = now + int64(h.cfg.ProtectFor)
+		}
+	}
+	for ih, until := range sh.protected {
+		if until <= now {
+			delete(sh.protected, ih)
+			for _, seeding := range []bool{true, false} {
+				delete(sh.cache, cacheKey{ih, seeding, false})
+				delete(sh.cache, cacheKey{ih, seeding, true})
+			}
+			logger.Info().Stringer("infoHash", ih).Msg("info hash released")
+		}
+	}
+	sh.counts = make(map[bittorrent.InfoHash]uint64)
+	return len(sh.protected)
+}
+
+func (h *hook) run() {
+	t := time.NewTicker(h.cfg.Window)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.rotate(timecache.NowUnixNano())
+		}
+	}
+}
+
+// Close stops announce rate measurement
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
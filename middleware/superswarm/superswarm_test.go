@@ -0,0 +1,114 @@
+package superswarm
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+var ih = bittorrent.InfoHash("11111111111111111111")
+
+func newRequest(id byte) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Left:     100,
+		NumWant:  10,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.AddrFrom4([4]byte{1, 2, 3, id})}},
+		},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	_, err = build(conf.MapConfig{}, nil)
+	require.NotNil(t, err)
+
+	hk, err := build(conf.MapConfig{"max_rate": 0.1, "window": "1h", "cache_ttl": "1h"}, nil)
+	require.Nil(t, err)
+	h := hk.(*hook)
+	defer h.Close()
+
+	ctx := context.Background()
+	l := middleware.NewLogic(time.Minute, time.Minute, ps, []middleware.Hook{h}, nil, nil)
+
+	// 360 announces per hour are allowed
+	for i := 0; i < 360; i++ {
+		_, resp, err := l.HandleAnnounce(ctx, newRequest(1))
+		require.Nil(t, err)
+		require.Equal(t, time.Minute, resp.Interval)
+	}
+	h.rotate(timecache.NowUnixNano())
+	require.Equal(t, 0.0, metricValue(PromProtectedHashes))
+
+	for i := 0; i < 361; i++ {
+		_, _, err = l.HandleAnnounce(ctx, newRequest(1))
+		require.Nil(t, err)
+	}
+	h.rotate(timecache.NowUnixNano())
+	require.Equal(t, 1.0, metricValue(PromProtectedHashes))
+
+	require.Nil(t, ps.PutLeecher(ctx, ih, newRequest(2).Peers()[0]))
+	_, first, err := l.HandleAnnounce(ctx, newRequest(1))
+	require.Nil(t, err)
+	require.Equal(t, 2*time.Minute, first.Interval)
+	require.Equal(t, newRequest(2).Peers(), first.IPv4Peers)
+
+	// swarm changed, but cached peers are returned
+	require.Nil(t, ps.DeleteLeecher(ctx, ih, newRequest(2).Peers()[0]))
+	before := metricValue(PromCachedAnnounces)
+	_, second, err := l.HandleAnnounce(ctx, newRequest(3))
+	require.Nil(t, err)
+	require.Equal(t, first, second)
+	require.Equal(t, before+1, metricValue(PromCachedAnnounces))
+
+	// peers cached for IPv4 requesters are not returned to IPv6 ones
+	v6 := newRequest(4)
+	v6.RequestAddresses = bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("2001:db8::4")}}
+	v6Peer := newRequest(5)
+	v6Peer.RequestAddresses = bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("2001:db8::5")}}
+	require.Nil(t, ps.PutLeecher(ctx, ih, v6Peer.Peers()[0]))
+	_, fromV6, err := l.HandleAnnounce(ctx, v6)
+	require.Nil(t, err)
+	require.Equal(t, v6Peer.Peers(), fromV6.IPv6Peers)
+	require.Empty(t, fromV6.IPv4Peers)
+	require.Equal(t, before+1, metricValue(PromCachedAnnounces))
+
+	// other info hashes are not affected
+	req := newRequest(3)
+	req.InfoHash = bittorrent.InfoHash("22222222222222222222")
+	_, other, err := l.HandleAnnounce(ctx, req)
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, other.Interval)
+
+	// protection expires
+	h.rotate(timecache.Now().Add(defaultProtectFor).UnixNano())
+	require.Equal(t, 0.0, metricValue(PromProtectedHashes))
+	_, third, err := l.HandleAnnounce(ctx, newRequest(3))
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, third.Interval)
+	require.NotEqual(t, first.IPv4Peers, third.IPv4Peers)
+}
+
+// metricValue returns current value of counter or gauge
+func metricValue(m prometheus.Metric) float64 {
+	var out dto.Metric
+	_ = m.Write(&out)
+	return out.GetCounter().GetValue() + out.GetGauge().GetValue()
+}
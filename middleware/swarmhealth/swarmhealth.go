@@ -0,0 +1,287 @@
+// Package swarmhealth implements a Hook that detects peer-starved swarms
+// (swarms with leechers but without seeders), increases returned intervals
+// for them and asks previous seeders to rejoin.
+package swarmhealth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/webhook"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "swarm health"
+
+const (
+	// DefaultStorageCtx is the name of storage context where snatch history is stored
+	DefaultStorageCtx     = "MW_SWARM_HEALTH"
+	defaultHistorySize    = 50
+	defaultReseedInterval = time.Hour
+)
+
+var (
+	logger = log.NewLogger("middleware/swarm health")
+
+	errStorageNotProvided = errors.New("storage not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to detect starved swarms.
+type Config struct {
+	// StarvedIntervalMultiplier is the multiplier applied to interval and
+	// min interval returned to leechers of starved swarm.
+	// Values less or equal to 1 disable modification.
+	StarvedIntervalMultiplier float64 `cfg:"starved_interval_multiplier"`
+	// HistorySize is the maximum number of snatchers remembered for each swarm.
+	HistorySize int `cfg:"history_size"`
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey). If empty or not provided in request,
+	// peer ID is used.
+	UserParam string `cfg:"user_param"`
+	// StorageCtx is the name of storage context where snatch history is stored.
+	StorageCtx string `cfg:"storage_ctx"`
+	// ReseedInterval is the minimal period between two re-seed requests
+	// for the same swarm.
+	ReseedInterval time.Duration `cfg:"reseed_interval"`
+	// Webhook is the configuration of endpoint where re-seed requests are sent.
+	// If URL is not set, requests only logged.
+	Webhook webhook.SenderConfig
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if cfg.HistorySize <= 0 {
+		validCfg.HistorySize = defaultHistorySize
+		logger.Warn().
+			Str("name", "HistorySize").
+			Int("provided", cfg.HistorySize).
+			Int("default", validCfg.HistorySize).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.StorageCtx) == 0 {
+		validCfg.StorageCtx = DefaultStorageCtx
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", validCfg.StorageCtx).
+			Msg("falling back to default configuration")
+	}
+	if cfg.ReseedInterval <= 0 {
+		validCfg.ReseedInterval = defaultReseedInterval
+		logger.Warn().
+			Str("name", "ReseedInterval").
+			Dur("provided", cfg.ReseedInterval).
+			Dur("default", validCfg.ReseedInterval).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.Webhook.URL) > 0 {
+		validCfg.Webhook, err = cfg.Webhook.Validate()
+	}
+	return
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	if st == nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errStorageNotProvided)
+	}
+	h := &hook{
+		cfg:        cfg,
+		storage:    st,
+		lastReseed: make(map[bittorrent.InfoHash]int64),
+		closed:     make(chan any),
+	}
+	if len(cfg.Webhook.URL) > 0 {
+		h.sender = webhook.NewSender(cfg.Webhook)
+	}
+	h.wg.Add(1)
+	go h.runGC()
+	return h, nil
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.PeerStorage
+	sender  *webhook.Sender
+
+	lastReseed map[bittorrent.InfoHash]int64
+	sync.Mutex
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func (h *hook) userKey(req *bittorrent.AnnounceRequest) (key string) {
+	if len(h.cfg.UserParam) > 0 && req.Params != nil {
+		key, _ = req.Params.GetString(h.cfg.UserParam)
+	}
+	if len(key) == 0 {
+		key = req.ID.String()
+	}
+	return
+}
+
+// HandleAnnounce records snatchers and modifies response for starved swarms.
+// Should be used as pre hook, because response intervals are
+// already sent to client when post hooks are called.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	dry := middleware.DryRun(ctx)
+	if req.Event == bittorrent.Completed && !dry {
+		if err := h.remember(ctx, req); err != nil {
+			logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to store snatch history")
+		}
+	}
+	if req.Left == 0 || req.Event == bittorrent.Stopped {
+		return ctx, nil
+	}
+	leechers, seeders, _, err := h.storage.ScrapeSwarm(ctx, req.InfoHash.TruncateV1())
+	if err != nil || seeders > 0 || leechers == 0 {
+		return ctx, nil
+	}
+	if m := h.cfg.StarvedIntervalMultiplier; m > 1 {
+		resp.Interval = time.Duration(float64(resp.Interval) * m)
+		resp.MinInterval = time.Duration(float64(resp.MinInterval) * m)
+	}
+	if !dry && h.reseedAllowed(req.InfoHash) {
+		h.requestReseed(ctx, req, leechers)
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't change swarm health.
+	return ctx, nil
+}
+
+func historyKey(ih bittorrent.InfoHash) string {
+	return ih.TruncateV1().RawString()
+}
+
+func (h *hook) history(ctx context.Context, ih bittorrent.InfoHash) ([][]byte, error) {
+	b, err := h.storage.Load(ctx, h.cfg.StorageCtx, historyKey(ih))
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+	return bytes.Split(b, []byte{'\n'}), nil
+}
+
+// remember adds snatcher to the end of swarm history, if it is not there yet,
+// and drops the oldest entries exceeding HistorySize.
+// History is replaced with storage.Update, so concurrent
+// snatches (of other instances too) are not lost.
+func (h *hook) remember(ctx context.Context, req *bittorrent.AnnounceRequest) error {
+	user := []byte(h.userKey(req))
+	return storage.Update(ctx, h.storage, h.cfg.StorageCtx, historyKey(req.InfoHash), func(b []byte) ([]byte, error) {
+		var hist [][]byte
+		if len(b) > 0 {
+			hist = bytes.Split(b, []byte{'\n'})
+		}
+		for _, u := range hist {
+			if bytes.Equal(u, user) {
+				return b, nil
+			}
+		}
+		hist = append(hist, user)
+		if l := len(hist); l > h.cfg.HistorySize {
+			hist = hist[l-h.cfg.HistorySize:]
+		}
+		return bytes.Join(hist, []byte{'\n'}), nil
+	})
+}
+
+// reseedAllowed checks if ReseedInterval passed since the last re-seed request
+// for the swarm and marks swarm as requested
+func (h *hook) reseedAllowed(ih bittorrent.InfoHash) bool {
+	now := timecache.NowUnixNano()
+	h.Lock()
+	defer h.Unlock()
+	if t, exists := h.lastReseed[ih]; exists && now-t < int64(h.cfg.ReseedInterval) {
+		return false
+	}
+	h.lastReseed[ih] = now
+	return true
+}
+
+// gc deletes re-seed request moments older than ReseedInterval
+func (h *hook) gc(now int64) {
+	h.Lock()
+	defer h.Unlock()
+	for k, t := range h.lastReseed {
+		if now-t >= int64(h.cfg.ReseedInterval) {
+			delete(h.lastReseed, k)
+		}
+	}
+}
+
+func (h *hook) runGC() {
+	defer h.wg.Done()
+	t := time.NewTicker(h.cfg.ReseedInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.gc(timecache.NowUnixNano())
+		}
+	}
+}
+
+func (h *hook) requestReseed(ctx context.Context, req *bittorrent.AnnounceRequest, leechers uint32) {
+	hist, err := h.history(ctx, req.InfoHash)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to load snatch history")
+		return
+	}
+	seeders := make([]string, 0, len(hist))
+	for _, u := range hist {
+		seeders = append(seeders, string(u))
+	}
+	logger.Info().
+		Stringer("infoHash", req.InfoHash).
+		Uint32("leechers", leechers).
+		Int("seeders", len(seeders)).
+		Msg("swarm is starved, requesting re-seed")
+	if h.sender != nil {
+		e := webhook.NewEvent(ctx, webhook.EventReseed, req)
+		e.Seeders = seeders
+		h.sender.Push(e)
+	}
+}
+
+// Close stops garbage collection and sends pending re-seed requests
+func (h *hook) Close() (err error) {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+		h.wg.Wait()
+		if h.sender != nil {
+			err = h.sender.Close()
+		}
+	})
+	return
+}
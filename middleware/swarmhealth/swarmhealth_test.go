@@ -0,0 +1,112 @@
+package swarmhealth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware/webhook"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func newRequest(ih bittorrent.InfoHash, id byte, left uint64) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Left:     left,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{id},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	events := make(chan []webhook.Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ee []webhook.Event
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&ee))
+		events <- ee
+	}))
+	defer srv.Close()
+
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{
+		"starved_interval_multiplier": 2,
+		"webhook": map[string]any{
+			"url":            srv.URL,
+			"flush_interval": "10ms",
+		},
+	}, ps)
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHash("11111111111111111111")
+
+	completed := newRequest(ih, 1, 0)
+	completed.Event = bittorrent.Completed
+	_, err = h.HandleAnnounce(ctx, completed, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+
+	leecher := newRequest(ih, 2, 100)
+	require.Nil(t, ps.PutLeecher(ctx, ih, leecher.Peers()[0]))
+
+	resp := &bittorrent.AnnounceResponse{Interval: time.Minute, MinInterval: time.Second}
+	_, err = h.HandleAnnounce(ctx, leecher, resp)
+	require.Nil(t, err)
+	require.Equal(t, 2*time.Minute, resp.Interval)
+	require.Equal(t, 2*time.Second, resp.MinInterval)
+
+	select {
+	case ee := <-events:
+		require.Len(t, ee, 1)
+		require.Equal(t, webhook.EventReseed, ee[0].Event)
+		require.Equal(t, []string{completed.ID.String()}, ee[0].Seeders)
+	case <-time.After(time.Second):
+		require.FailNow(t, "re-seed event not sent")
+	}
+
+	// second request is rate limited
+	_, err = h.HandleAnnounce(ctx, leecher, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Nil(t, h.(*hook).Close())
+	require.Empty(t, events)
+
+	// swarm with seeder is not modified
+	require.Nil(t, ps.PutSeeder(ctx, ih, completed.Peers()[0]))
+	resp = &bittorrent.AnnounceResponse{Interval: time.Minute}
+	_, err = h.HandleAnnounce(ctx, leecher, resp)
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, resp.Interval)
+}
+
+func TestReseedGC(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+	hk, err := build(conf.MapConfig{"reseed_interval": "1h"}, ps)
+	require.Nil(t, err)
+	h := hk.(*hook)
+	defer h.Close()
+
+	ih := bittorrent.InfoHash("11111111111111111111")
+	require.True(t, h.reseedAllowed(ih))
+	require.False(t, h.reseedAllowed(ih))
+	h.gc(timecache.NowUnixNano())
+	require.Len(t, h.lastReseed, 1)
+	h.gc(timecache.Now().Add(time.Hour).UnixNano())
+	require.Empty(t, h.lastReseed)
+	require.True(t, h.reseedAllowed(ih))
+}
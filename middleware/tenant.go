@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/sot-tech/mochi/pkg/str2bytes"
+)
+
+var (
+	errTenantNameNotProvided  = errors.New("tenant name not provided")
+	errTenantMatchNotProvided = errors.New("neither hosts nor path prefix provided")
+
+	rootPath = []byte{'/'}
+)
+
+// Tenant is the virtual tracker, served by the same frontends as
+// the default one, but with its own Logic (middleware chains and storage).
+// Tenant matches request if its host is one of Hosts (if set) and
+// its path starts with PathPrefix (if set).
+type Tenant struct {
+	// Name identifies tenant in logs and metrics
+	Name string
+	// Hosts are the hosts of tenant's announce URLs (HTTP Host header
+	// without port). UDP requests do not provide host, so tenants
+	// with hosts are matched only by HTTP frontends.
+	Hosts []string
+	// PathPrefix is the prefix of tenant's announce URLs path (i.e. `/tracker1`),
+	// which is stripped before routing. UDP requests are matched by BEP41 URL data.
+	PathPrefix string
+	Logic      *Logic
+}
+
+// normalize checks Tenant and returns copy with lower-case hosts
+// and cleaned path prefix without trailing slash
+func (t Tenant) normalize() (Tenant, error) {
+	if len(t.Name) == 0 {
+		return t, errTenantNameNotProvided
+	}
+	if len(t.Hosts) == 0 && len(t.PathPrefix) == 0 {
+		return t, errTenantMatchNotProvided
+	}
+	hosts := make([]string, len(t.Hosts))
+	for i, h := range t.Hosts {
+		hosts[i] = strings.ToLower(h)
+	}
+	t.Hosts = hosts
+	if len(t.PathPrefix) > 0 {
+		if t.PathPrefix = path.Clean("/" + t.PathPrefix); t.PathPrefix == "/" {
+			t.PathPrefix = ""
+		}
+	}
+	return t, nil
+}
+
+// match checks if host and path belong to tenant and returns path without prefix
+func (t Tenant) match(host, p []byte) ([]byte, bool) {
+	if len(t.Hosts) > 0 {
+		found := false
+		for _, h := range t.Hosts {
+			if strings.EqualFold(str2bytes.BytesToString(host), h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return p, false
+		}
+	}
+	if l := len(t.PathPrefix); l > 0 {
+		if !strings.HasPrefix(str2bytes.BytesToString(p), t.PathPrefix) || (len(p) > l && p[l] != '/') {
+			return p, false
+		}
+		if p = p[l:]; len(p) == 0 {
+			p = rootPath
+		}
+	}
+	return p, true
+}
+
+// SetTenants sets virtual trackers, which requests are processed
+// by their own Logic instead of l. Tenants are matched in provided order.
+func (l *Logic) SetTenants(tenants ...Tenant) error {
+	out := make([]Tenant, 0, len(tenants))
+	for _, t := range tenants {
+		nt, err := t.normalize()
+		if err != nil {
+			return err
+		}
+		if nt.Logic == nil {
+			return errors.New("tenant " + nt.Name + " has no logic")
+		}
+		nt.Logic.tenant = nt.Name
+		out = append(out, nt)
+	}
+	l.tenants = out
+	return nil
+}
+
+// Tenant returns Logic of the first tenant matching host (may contain port)
+// and request path, and path with stripped tenant's prefix.
+// If none of tenants matched, l and unmodified path returned.
+func (l *Logic) Tenant(host, p []byte) (*Logic, []byte) {
+	if len(l.tenants) == 0 {
+		return l, p
+	}
+	host = stripPort(host)
+	for _, t := range l.tenants {
+		if tp, ok := t.match(host, p); ok {
+			return t.Logic, tp
+		}
+	}
+	return l, p
+}
+
+// Tenants returns Logic-s of all tenants
+func (l *Logic) Tenants() []*Logic {
+	out := make([]*Logic, len(l.tenants))
+	for i, t := range l.tenants {
+		out[i] = t.Logic
+	}
+	return out
+}
+
+// stripPort removes port from host[:port], [ipv6]:port or [ipv6]
+func stripPort(host []byte) []byte {
+	if len(host) > 0 && host[0] == '[' {
+		if i := bytes.IndexByte(host, ']'); i > 0 {
+			return host[1:i]
+		}
+		return host
+	}
+	if i := bytes.LastIndexByte(host, ':'); i >= 0 && bytes.IndexByte(host[:i], ':') < 0 {
+		return host[:i]
+	}
+	return host
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenant(t *testing.T) {
+	def := NewLogic(time.Minute, time.Minute, nil, nil, nil, nil)
+	byHost := NewLogic(time.Minute, time.Minute, nil, nil, nil, nil)
+	byPath := NewLogic(time.Minute, time.Minute, nil, nil, nil, nil)
+	both := NewLogic(time.Minute, time.Minute, nil, nil, nil, nil)
+
+	require.Error(t, def.SetTenants(Tenant{Name: "empty", Logic: byHost}))
+	require.Error(t, def.SetTenants(Tenant{PathPrefix: "/a", Logic: byHost}))
+	require.NoError(t, def.SetTenants(
+		Tenant{Name: "both", Hosts: []string{"b.example"}, PathPrefix: "/p/", Logic: both},
+		Tenant{Name: "host", Hosts: []string{"A.example"}, Logic: byHost},
+		Tenant{Name: "path", PathPrefix: "p", Logic: byPath},
+	))
+	require.Equal(t, []*Logic{both, byHost, byPath}, def.Tenants())
+	require.Equal(t, "host", byHost.tenant)
+
+	for _, c := range []struct {
+		host, path string
+		logic      *Logic
+		outPath    string
+	}{
+		{"tracker.example", "/announce", def, "/announce"},
+		{"a.example:6969", "/announce", byHost, "/announce"},
+		{"b.example", "/p/announce", both, "/announce"},
+		{"b.example", "/pp/announce", def, "/pp/announce"},
+		{"[::1]:6969", "/p", byPath, "/"},
+		{"", "/p/scrape", byPath, "/scrape"},
+	} {
+		l, p := def.Tenant([]byte(c.host), []byte(c.path))
+		require.Same(t, c.logic, l, c.host+c.path)
+		require.Equal(t, c.outPath, string(p), c.host+c.path)
+	}
+}
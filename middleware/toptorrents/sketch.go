@@ -0,0 +1,140 @@
+package toptorrents
+
+import (
+	"container/heap"
+	"slices"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// countMin is the count-min sketch, which estimates number
+// of occurrences of key with fixed memory. Estimation
+// may only exceed real value because of collisions.
+type countMin struct {
+	width uint64
+	rows  [][]uint32
+}
+
+func newCountMin(width, depth int) *countMin {
+	c := &countMin{width: uint64(width), rows: make([][]uint32, depth)}
+	for i := range c.rows {
+		c.rows[i] = make([]uint32, width)
+	}
+	return c
+}
+
+// add increments counters of key and returns new estimation
+// of occurrences and flag if key is (probably) seen first time
+func (c *countMin) add(key string) (estimate uint32, first bool) {
+	h := xxhash.Sum64String(key)
+	// double hashing: index_i = h1 + i*h2
+	h1, h2 := h&0xFFFFFFFF, h>>32|1
+	first = true
+	for i, row := range c.rows {
+		idx := (h1 + uint64(i)*h2) % c.width
+		if row[idx] != 0 {
+			first = false
+		}
+		row[idx]++
+		if i == 0 || row[idx] < estimate {
+			estimate = row[idx]
+		}
+	}
+	return
+}
+
+func (c *countMin) reset() {
+	for _, row := range c.rows {
+		clear(row)
+	}
+}
+
+// entry is the last known state of swarm
+type entry struct {
+	infoHash  string
+	seeders   uint32
+	leechers  uint32
+	announces uint32
+}
+
+// topK holds k entries with the greatest value.
+// Entries are kept in min-heap, so the least one
+// is replaced by new greater entry.
+type topK struct {
+	k       int
+	value   func(entry) uint32
+	entries []entry
+	index   map[string]int
+}
+
+func newTopK(k int, value func(entry) uint32) *topK {
+	return &topK{
+		k:       k,
+		value:   value,
+		entries: make([]entry, 0, k),
+		index:   make(map[string]int, k),
+	}
+}
+
+// heap.Interface implementation
+
+func (t *topK) Len() int { return len(t.entries) }
+
+func (t *topK) Less(i, j int) bool { return t.value(t.entries[i]) < t.value(t.entries[j]) }
+
+func (t *topK) Swap(i, j int) {
+	t.entries[i], t.entries[j] = t.entries[j], t.entries[i]
+	t.index[t.entries[i].infoHash], t.index[t.entries[j].infoHash] = i, j
+}
+
+func (t *topK) Push(x any) {
+	e := x.(entry)
+	t.index[e.infoHash] = len(t.entries)
+	t.entries = append(t.entries, e)
+}
+
+func (t *topK) Pop() any {
+	n := len(t.entries) - 1
+	e := t.entries[n]
+	t.entries = t.entries[:n]
+	delete(t.index, e.infoHash)
+	return e
+}
+
+// update replaces state of tracked swarm or adds new one
+// if it is greater than the least tracked
+func (t *topK) update(e entry) {
+	if i, ok := t.index[e.infoHash]; ok {
+		t.entries[i] = e
+		heap.Fix(t, i)
+	} else if len(t.entries) < t.k {
+		heap.Push(t, e)
+	} else if t.value(e) > t.value(t.entries[0]) {
+		delete(t.index, t.entries[0].infoHash)
+		t.entries[0] = e
+		t.index[e.infoHash] = 0
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns copy of entries sorted by value descending
+func (t *topK) sorted() []entry {
+	out := slices.Clone(t.entries)
+	slices.SortFunc(out, func(a, b entry) int {
+		va, vb := t.value(a), t.value(b)
+		switch {
+		case va > vb:
+			return -1
+		case va < vb:
+			return 1
+		default:
+			return 0
+		}
+	})
+	return out
+}
+
+func (t *topK) reset() {
+	t.entries = t.entries[:0]
+	clear(t.index)
+}
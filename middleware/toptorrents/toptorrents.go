@@ -0,0 +1,276 @@
+// Package toptorrents implements a Hook that tracks the most active swarms
+// by seeders, leechers and announce rate during interval with fixed memory
+// (count-min sketch and top-N heaps) and exposes them via admin API
+// and ops status page.
+package toptorrents
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/ops"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "top torrents"
+
+const (
+	defaultInterval = 5 * time.Minute
+	defaultTop      = 10
+	defaultWidth    = 1 << 16
+	defaultDepth    = 4
+)
+
+var (
+	logger = log.NewLogger("middleware/top torrents")
+
+	// PromActiveSwarms is an estimated number of swarms announced during the last interval
+	PromActiveSwarms = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mochi_middleware_top_torrents_active_swarms",
+		Help: "The estimated number of swarms announced during the last interval",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(PromActiveSwarms)
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Interval is the period after which statistics is published and reset.
+	Interval time.Duration
+	// Top is the number of swarms in each list.
+	Top int
+	// Width is the number of counters in one row of count-min sketch.
+	Width int
+	// Depth is the number of rows (hash functions) of count-min sketch.
+	Depth int
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() Config {
+	validCfg := cfg
+	if cfg.Interval <= 0 {
+		validCfg.Interval = defaultInterval
+		logger.Warn().
+			Str("name", "Interval").
+			Dur("provided", cfg.Interval).
+			Dur("default", validCfg.Interval).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Top <= 0 {
+		validCfg.Top = defaultTop
+		logger.Warn().
+			Str("name", "Top").
+			Int("provided", cfg.Top).
+			Int("default", validCfg.Top).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Width <= 0 {
+		validCfg.Width = defaultWidth
+		logger.Warn().
+			Str("name", "Width").
+			Int("provided", cfg.Width).
+			Int("default", validCfg.Width).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Depth <= 0 {
+		validCfg.Depth = defaultDepth
+		logger.Warn().
+			Str("name", "Depth").
+			Int("provided", cfg.Depth).
+			Int("default", validCfg.Depth).
+			Msg("falling back to default configuration")
+	}
+	return validCfg
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	cfg = cfg.Validate()
+	h := &hook{
+		cfg:         cfg,
+		announces:   newCountMin(cfg.Width, cfg.Depth),
+		byAnnounces: newTopK(cfg.Top, func(e entry) uint32 { return e.announces }),
+		bySeeders:   newTopK(cfg.Top, func(e entry) uint32 { return e.seeders }),
+		byLeechers:  newTopK(cfg.Top, func(e entry) uint32 { return e.leechers }),
+		start:       time.Now(),
+		closed:      make(chan any),
+	}
+	admin.Handle(http.MethodGet, "/stats/torrents", h.handleGetStats)
+	ops.SetTopSwarms(h.topSwarms)
+	go h.run()
+	return h, nil
+}
+
+// Torrent is the state of swarm in statistics
+type Torrent struct {
+	InfoHash  string `json:"info_hash"`
+	Seeders   uint32 `json:"seeders"`
+	Leechers  uint32 `json:"leechers"`
+	Announces uint32 `json:"announces"`
+	// AnnounceRate is the number of announces per second
+	AnnounceRate float64 `json:"announce_rate"`
+}
+
+// Stats is the statistics of swarms during interval
+type Stats struct {
+	ActiveSwarms   uint64    `json:"active_swarms"`
+	BySeeders      []Torrent `json:"by_seeders"`
+	ByLeechers     []Torrent `json:"by_leechers"`
+	ByAnnounceRate []Torrent `json:"by_announce_rate"`
+}
+
+type hook struct {
+	cfg Config
+
+	announces    *countMin
+	activeSwarms uint64
+	byAnnounces  *topK
+	bySeeders    *topK
+	byLeechers   *topK
+	// start of the current interval
+	start time.Time
+	// last statistics of completed interval
+	last *Stats
+	sync.Mutex
+
+	closed     chan any
+	onceCloser sync.Once
+}
+
+// HandleAnnounce counts announce and updates swarm state. May be used as post hook.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if middleware.DryRun(ctx) {
+		return ctx, nil
+	}
+	e := entry{infoHash: string(req.InfoHash.TruncateV1())}
+	if resp != nil {
+		e.seeders, e.leechers = resp.Complete, resp.Incomplete
+	}
+	h.Lock()
+	var first bool
+	e.announces, first = h.announces.add(e.infoHash)
+	if first {
+		h.activeSwarms++
+	}
+	h.byAnnounces.update(e)
+	h.bySeeders.update(e)
+	h.byLeechers.update(e)
+	h.Unlock()
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not counted.
+	return ctx, nil
+}
+
+// snapshot returns statistics of current interval, must be called under lock
+func (h *hook) snapshot(now time.Time) *Stats {
+	elapsed := now.Sub(h.start).Seconds()
+	convert := func(t *topK) []Torrent {
+		entries := t.sorted()
+		out := make([]Torrent, 0, len(entries))
+		for _, e := range entries {
+			tr := Torrent{
+				InfoHash:  bittorrent.InfoHash(e.infoHash).String(),
+				Seeders:   e.seeders,
+				Leechers:  e.leechers,
+				Announces: e.announces,
+			}
+			if elapsed > 0 {
+				tr.AnnounceRate = float64(e.announces) / elapsed
+			}
+			out = append(out, tr)
+		}
+		return out
+	}
+	return &Stats{
+		ActiveSwarms:   h.activeSwarms,
+		BySeeders:      convert(h.bySeeders),
+		ByLeechers:     convert(h.byLeechers),
+		ByAnnounceRate: convert(h.byAnnounces),
+	}
+}
+
+// Stats returns statistics of the last completed interval
+// or of the current one if no interval completed yet
+func (h *hook) Stats() *Stats {
+	h.Lock()
+	defer h.Unlock()
+	if h.last != nil {
+		return h.last
+	}
+	return h.snapshot(time.Now())
+}
+
+// rotate publishes statistics of current interval and resets state
+func (h *hook) rotate(now time.Time) {
+	h.Lock()
+	h.last = h.snapshot(now)
+	h.announces.reset()
+	h.activeSwarms = 0
+	h.byAnnounces.reset()
+	h.bySeeders.reset()
+	h.byLeechers.reset()
+	h.start = now
+	active := h.last.ActiveSwarms
+	h.Unlock()
+	PromActiveSwarms.Set(float64(active))
+}
+
+func (h *hook) run() {
+	t := time.NewTicker(h.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case now := <-t.C:
+			h.rotate(now)
+		}
+	}
+}
+
+// topSwarms returns swarms with the highest announce rate for ops status page
+func (h *hook) topSwarms() []ops.Swarm {
+	ts := h.Stats().ByAnnounceRate
+	out := make([]ops.Swarm, 0, len(ts))
+	for _, t := range ts {
+		out = append(out, ops.Swarm{InfoHash: t.InfoHash, Seeders: t.Seeders, Leechers: t.Leechers, AnnounceRate: t.AnnounceRate})
+	}
+	return out
+}
+
+func (h *hook) handleGetStats(ctx *fasthttp.RequestCtx) {
+	admin.WriteJSON(ctx, fasthttp.StatusOK, map[string]any{
+		"interval":   h.cfg.Interval.String(),
+		"statistics": h.Stats(),
+	})
+}
+
+// Close stops statistics rotation
+func (h *hook) Close() error {
+	h.onceCloser.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
@@ -0,0 +1,96 @@
+package toptorrents
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+func infoHash(i int) bittorrent.InfoHash {
+	ih, _ := bittorrent.NewInfoHashString(fmt.Sprintf("%040x", i))
+	return ih
+}
+
+func TestCountMin(t *testing.T) {
+	c := newCountMin(1024, 4)
+	n, first := c.add("a")
+	require.Equal(t, uint32(1), n)
+	require.True(t, first)
+	n, first = c.add("a")
+	require.Equal(t, uint32(2), n)
+	require.False(t, first)
+	n, _ = c.add("b")
+	require.Equal(t, uint32(1), n)
+	c.reset()
+	n, first = c.add("a")
+	require.Equal(t, uint32(1), n)
+	require.True(t, first)
+}
+
+func TestTopK(t *testing.T) {
+	tk := newTopK(2, func(e entry) uint32 { return e.seeders })
+	tk.update(entry{infoHash: "a", seeders: 1})
+	tk.update(entry{infoHash: "b", seeders: 5})
+	tk.update(entry{infoHash: "c", seeders: 3})
+	require.Equal(t, []entry{{infoHash: "b", seeders: 5}, {infoHash: "c", seeders: 3}}, tk.sorted())
+
+	// tracked entry updated in place
+	tk.update(entry{infoHash: "c", seeders: 10})
+	tk.update(entry{infoHash: "a", seeders: 2})
+	require.Equal(t, []entry{{infoHash: "c", seeders: 10}, {infoHash: "b", seeders: 5}}, tk.sorted())
+	require.Len(t, tk.index, 2)
+
+	tk.reset()
+	require.Empty(t, tk.sorted())
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{"interval": time.Hour, "top": 2}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	th := h.(*hook)
+
+	ctx := context.Background()
+	announce := func(i int, seeders, leechers uint32) {
+		_, err := h.HandleAnnounce(ctx,
+			&bittorrent.AnnounceRequest{InfoHash: infoHash(i)},
+			&bittorrent.AnnounceResponse{Complete: seeders, Incomplete: leechers})
+		require.Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		announce(1, 10, 1)
+	}
+	announce(2, 1, 20)
+	announce(2, 1, 20)
+	announce(3, 5, 5)
+
+	s := th.Stats()
+	require.Equal(t, uint64(3), s.ActiveSwarms)
+	require.Equal(t, infoHash(1).String(), s.BySeeders[0].InfoHash)
+	require.Equal(t, infoHash(3).String(), s.BySeeders[1].InfoHash)
+	require.Equal(t, infoHash(2).String(), s.ByLeechers[0].InfoHash)
+	require.Equal(t, infoHash(3).String(), s.ByLeechers[1].InfoHash)
+	require.Len(t, s.ByAnnounceRate, 2)
+	require.Equal(t, infoHash(1).String(), s.ByAnnounceRate[0].InfoHash)
+	require.Equal(t, uint32(3), s.ByAnnounceRate[0].Announces)
+	require.Equal(t, infoHash(2).String(), s.ByAnnounceRate[1].InfoHash)
+
+	// completed interval is published, new one starts from scratch
+	th.rotate(time.Now())
+	announce(4, 1, 1)
+	s = th.Stats()
+	require.Equal(t, uint64(3), s.ActiveSwarms)
+	require.Equal(t, infoHash(1).String(), s.BySeeders[0].InfoHash)
+	require.Greater(t, s.ByAnnounceRate[0].AnnounceRate, float64(0))
+
+	th.rotate(time.Now())
+	s = th.Stats()
+	require.Equal(t, uint64(1), s.ActiveSwarms)
+	require.Equal(t, infoHash(4).String(), s.BySeeders[0].InfoHash)
+}
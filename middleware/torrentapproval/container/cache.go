@@ -0,0 +1,75 @@
+package container
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/lru"
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+// DefaultCacheSize is the maximum number of hashes in Cache
+const DefaultCacheSize = 100000
+
+// Cache keeps approval decisions of Container, so hot hashes
+// do not trigger lookup in storage (i.e. Redis or PostgreSQL)
+// on every announce. Decisions of hashes reported by Notifier
+// are dropped immediately, other modifications of Container
+// become visible after cached decisions expire.
+type Cache struct {
+	Container
+	ttl, denyTTL int64
+	entries      *lru.Cache[bittorrent.InfoHash, bool]
+}
+
+// NewCache creates Cache of c, approvals are cached for ttl,
+// denials for denyTTL (not cached if denyTTL is not positive).
+// If cache is full, the least recently used decision is dropped.
+func NewCache(c Container, ttl, denyTTL time.Duration, size int) *Cache {
+	cache := &Cache{
+		Container: c,
+		ttl:       int64(ttl),
+		denyTTL:   int64(denyTTL),
+		entries:   lru.New[bittorrent.InfoHash, bool](size),
+	}
+	if n, isOk := c.(Notifier); isOk {
+		n.OnChange(cache.Invalidate)
+	}
+	return cache
+}
+
+// Approved returns cached decision of hash or checks it in Container.
+// Decision is not cached if Container returned error.
+func (c *Cache) Approved(ctx context.Context, hash bittorrent.InfoHash) (bool, error) {
+	now := timecache.NowUnixNano()
+	if approved, found := c.entries.Get(hash, now); found {
+		return approved, nil
+	}
+	approved, err := c.Container.Approved(ctx, hash)
+	if err != nil {
+		return approved, err
+	}
+	ttl := c.ttl
+	if !approved {
+		ttl = c.denyTTL
+	}
+	if ttl > 0 {
+		c.entries.Put(hash, approved, now+ttl)
+	}
+	return approved, nil
+}
+
+// Invalidate drops cached decisions of hashes
+func (c *Cache) Invalidate(hashes ...bittorrent.InfoHash) {
+	c.entries.Delete(hashes...)
+}
+
+// Close closes Container if it implements io.Closer
+func (c *Cache) Close() error {
+	if cl, isOk := c.Container.(io.Closer); isOk {
+		return cl.Close()
+	}
+	return nil
+}
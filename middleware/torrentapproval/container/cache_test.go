@@ -0,0 +1,84 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+var errLookup = errors.New("lookup failed")
+
+type countingContainer struct {
+	approved map[bittorrent.InfoHash]bool
+	lookups  int
+	err      error
+	onChange func(...bittorrent.InfoHash)
+}
+
+func (c *countingContainer) Approved(_ context.Context, ih bittorrent.InfoHash) (bool, error) {
+	c.lookups++
+	return c.approved[ih], c.err
+}
+
+func (c *countingContainer) OnChange(fn func(...bittorrent.InfoHash)) {
+	c.onChange = fn
+}
+
+func approved(t *testing.T, c Container, ih bittorrent.InfoHash) bool {
+	ok, err := c.Approved(context.Background(), ih)
+	require.Nil(t, err)
+	return ok
+}
+
+func TestCache(t *testing.T) {
+	approvedIH, _ := bittorrent.NewInfoHashString("3532cf2d327fad8448c075b4cb42c8136964a435")
+	denied, _ := bittorrent.NewInfoHashString("4532cf2d327fad8448c075b4cb42c8136964a435")
+	cc := &countingContainer{approved: map[bittorrent.InfoHash]bool{approvedIH: true}}
+
+	c := NewCache(cc, time.Hour, time.Hour, 1)
+	require.True(t, approved(t, c, approvedIH))
+	require.True(t, approved(t, c, approvedIH))
+	require.Equal(t, 1, cc.lookups)
+
+	// the least recently used decision is dropped
+	require.False(t, approved(t, c, denied))
+	require.False(t, approved(t, c, denied))
+	require.Equal(t, 2, cc.lookups)
+	require.True(t, approved(t, c, approvedIH))
+	require.Equal(t, 3, cc.lookups)
+
+	// modification is visible after expiration
+	cc.approved[approvedIH] = false
+	c.entries.Put(approvedIH, true, time.Now().Add(-time.Second).UnixNano())
+	require.False(t, approved(t, c, approvedIH))
+	require.False(t, approved(t, c, approvedIH))
+	require.Equal(t, 4, cc.lookups)
+
+	// reported modification is visible immediately
+	cc.approved[approvedIH] = true
+	cc.onChange(approvedIH)
+	require.True(t, approved(t, c, approvedIH))
+	require.Equal(t, 5, cc.lookups)
+
+	// errors are not cached
+	cc.err = errLookup
+	c.Invalidate(approvedIH)
+	_, err := c.Approved(context.Background(), approvedIH)
+	require.ErrorIs(t, err, errLookup)
+	_, err = c.Approved(context.Background(), approvedIH)
+	require.ErrorIs(t, err, errLookup)
+	require.Equal(t, 7, cc.lookups)
+	cc.err = nil
+
+	// denials are not cached
+	cc.lookups = 0
+	c = NewCache(cc, time.Hour, -1, DefaultCacheSize)
+	require.False(t, approved(t, c, denied))
+	require.False(t, approved(t, c, denied))
+	require.Equal(t, 2, cc.lookups)
+}
@@ -40,9 +40,18 @@ func Register(n string, c Builder) {
 	builders[n] = c
 }
 
-// Container holds InfoHash and checks if value approved or not
+// Container holds InfoHash and checks if value approved or not.
+// Error is returned if approval could not be checked (i.e. storage failure),
+// approval result is the default one of container in this case.
 type Container interface {
-	Approved(context.Context, bittorrent.InfoHash) bool
+	Approved(context.Context, bittorrent.InfoHash) (bool, error)
+}
+
+// Notifier is implemented by containers, which are able to report
+// modified hashes, so Cache invalidates their decisions
+type Notifier interface {
+	// OnChange registers fn to be called with added or removed hashes
+	OnChange(fn func(...bittorrent.InfoHash))
 }
 
 // GetContainer creates Container by its name and provided confBytes
@@ -1,7 +1,7 @@
 // Package directory implements container which
 // checks if hash present in any of torrent file
 // placed in some directory.
-// Note: Unlike List, this container also stores torrent name as value
+// Note: Unlike List, this container also stores torrent name and size as value
 package directory
 
 import (
@@ -22,7 +22,7 @@ import (
 	"github.com/sot-tech/mochi/middleware/torrentapproval/container/list"
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
-	"github.com/sot-tech/mochi/pkg/str2bytes"
+	"github.com/sot-tech/mochi/pkg/metadata"
 	"github.com/sot-tech/mochi/storage"
 )
 
@@ -96,7 +96,11 @@ type torrentRawInfoStruct struct {
 }
 
 type torrentNameInfoStruct struct {
-	Name string `bencode:"name"`
+	Name   string `bencode:"name"`
+	Length uint64 `bencode:"length"`
+	Files  []struct {
+		Length uint64 `bencode:"length"`
+	} `bencode:"files"`
 }
 
 func (d *directory) runScan(path string, period time.Duration) {
@@ -142,24 +146,26 @@ func (d *directory) runScan(path string, period time.Duration) {
 										Str("file", p).
 										Msg("unable to unmarshal torrent info")
 								}
-								if len(name.Name) == 0 {
-									name.Name = list.DUMMY
+								t := metadata.Torrent{Name: name.Name, Size: name.Length}
+								for _, f := range name.Files {
+									t.Size += f.Length
 								}
-								bName := str2bytes.StringToBytes(name.Name)
+								value := t.Value()
 								logger.Err(d.Storage.Put(context.Background(), d.StorageCtx, storage.Entry{
 									Key:   h1.RawString(),
-									Value: bName,
+									Value: value,
 								}, storage.Entry{
 									Key:   h2.RawString(),
-									Value: bName,
+									Value: value,
 								}, storage.Entry{
 									Key:   h2.TruncateV1().RawString(),
-									Value: bName,
+									Value: value,
 								})).
 									Str("file", p).
 									Stringer("infoHash", h1).
 									Stringer("infoHashV2", h2).
 									Msg("added torrent to approval list")
+								d.Notify(h1, h2)
 							}
 						}
 						if err != nil {
@@ -176,6 +182,7 @@ func (d *directory) runScan(path string, period time.Duration) {
 							Stringer("infoHash", ih[1]).
 							Stringer("infoHashV2", ih[1]).
 							Msg("deleted torrent from approval list")
+						d.Notify(ih[0], ih[1])
 					}
 				}
 				clear(tmpFiles)
@@ -5,11 +5,15 @@ package list
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sync"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/middleware/torrentapproval/container"
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metadata"
+	"github.com/sot-tech/mochi/pkg/replica"
 	"github.com/sot-tech/mochi/storage"
 )
 
@@ -23,16 +27,18 @@ func init() {
 type Config struct {
 	// HashList static list of HEX-encoded InfoHashes.
 	HashList []string `cfg:"hash_list"`
-	// If Invert set to true, all InfoHashes stored in HashList should be blacklisted.
+	// Torrents static list of InfoHashes or magnet links with metadata.
+	Torrents []metadata.Torrent
+	// If Invert set to true, all InfoHashes stored in HashList and Torrents should be blacklisted.
 	Invert bool
 	// StorageCtx is the name of storage context where to store hash list.
 	// It might be table name, REDIS record key or something else, depending on storage.
 	StorageCtx string `cfg:"storage_ctx"`
+	// Replica is the name of replicated set. If set, list may be modified
+	// through admin API and is synchronized with other instances.
+	Replica string
 }
 
-// DUMMY used as value placeholder if storage needs some value with
-const DUMMY = "_"
-
 func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, error) {
 	c := new(Config)
 	if err := conf.Unmarshal(c); err != nil {
@@ -53,25 +59,111 @@ func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, er
 		l.StorageCtx = container.DefaultStorageCtxName
 	}
 
-	if len(c.HashList) > 0 {
-		init := make([]storage.Entry, 0, len(c.HashList))
-		for _, hashString := range c.HashList {
-			ih, err := bittorrent.NewInfoHashString(hashString)
+	hashes := make([]string, 0, len(c.HashList)+len(c.Torrents))
+	for _, hashString := range c.HashList {
+		ih, err := bittorrent.NewInfoHashString(hashString)
+		if err != nil {
+			return nil, fmt.Errorf("whitelist : %s : %w", hashString, err)
+		}
+		hashes = append(hashes, ih.String())
+	}
+	var withMeta []string
+	if len(c.Torrents) > 0 {
+		l.values = make(map[string][]byte, len(c.Torrents))
+		for _, t := range c.Torrents {
+			ihs, err := torrentHashes(&t)
 			if err != nil {
-				return nil, fmt.Errorf("whitelist : %s : %w", hashString, err)
+				return nil, fmt.Errorf("whitelist : %w", err)
 			}
-			init = append(init, storage.Entry{Key: ih.RawString(), Value: []byte(DUMMY)})
-			if len(ih) == bittorrent.InfoHashV2Len {
-				init = append(init, storage.Entry{Key: ih.TruncateV1().RawString(), Value: []byte(DUMMY)})
+			v := t.Value()
+			for _, ih := range ihs {
+				hashes = append(hashes, ih.String())
+				withMeta = append(withMeta, ih.String())
+				l.values[ih.String()] = v
 			}
 		}
-		if err := l.Storage.Put(context.Background(), l.StorageCtx, init...); err != nil {
+	}
+
+	if len(c.Replica) > 0 {
+		set, err := replica.NewSet(replica.SetConfig{
+			Name:      c.Replica,
+			Storage:   st,
+			Normalize: normalizeHash,
+			OnChange:  l.apply,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create replicated set: %w", err)
+		}
+		if err = set.Seed(hashes...); err != nil {
+			return nil, fmt.Errorf("unable to put initial data: %w", err)
+		}
+		// hashes loaded from replicated state are stored without metadata
+		withMeta = slices.DeleteFunc(withMeta, func(h string) bool { return !set.Contains(h) })
+		l.apply(withMeta, nil)
+	} else if entries := l.entries(hashes); len(entries) > 0 {
+		if err := l.Storage.Put(context.Background(), l.StorageCtx, entries...); err != nil {
 			return nil, fmt.Errorf("unable to put initial data: %w", err)
 		}
 	}
 	return l, nil
 }
 
+func normalizeHash(s string) (string, error) {
+	ih, err := bittorrent.NewInfoHashString(s)
+	if err != nil {
+		return "", err
+	}
+	return ih.String(), nil
+}
+
+// storageKeys returns raw keys of HEX-encoded hash in storage
+func storageKeys(hash string) []string {
+	ih, err := bittorrent.NewInfoHashString(hash)
+	if err != nil {
+		return nil
+	}
+	if len(ih) == bittorrent.InfoHashV2Len {
+		return []string{ih.RawString(), ih.TruncateV1().RawString()}
+	}
+	return []string{ih.RawString()}
+}
+
+// entries returns storage entries of HEX-encoded hashes
+// with metadata from configuration or metadata.DUMMY value
+func (l *List) entries(hashes []string) []storage.Entry {
+	entries := make([]storage.Entry, 0, len(hashes))
+	for _, h := range hashes {
+		v, ok := l.values[h]
+		if !ok {
+			v = []byte(metadata.DUMMY)
+		}
+		for _, k := range storageKeys(h) {
+			entries = append(entries, storage.Entry{Key: k, Value: v})
+		}
+	}
+	return entries
+}
+
+// apply stores modifications of replicated set
+func (l *List) apply(added, removed []string) {
+	defer l.notifyHex(added, removed)
+	ctx := context.Background()
+	if entries := l.entries(added); len(entries) > 0 {
+		if err := l.Storage.Put(ctx, l.StorageCtx, entries...); err != nil {
+			logger.Error().Err(err).Msg("unable to store added hashes")
+		}
+	}
+	keys := make([]string, 0, len(removed))
+	for _, h := range removed {
+		keys = append(keys, storageKeys(h)...)
+	}
+	if len(keys) > 0 {
+		if err := l.Storage.Delete(ctx, l.StorageCtx, keys...); err != nil {
+			logger.Error().Err(err).Msg("unable to delete removed hashes")
+		}
+	}
+}
+
 // List work structure of hash list. Might be reused in another containers.
 type List struct {
 	// Invert see Config.Invert description.
@@ -80,24 +172,58 @@ type List struct {
 	Storage storage.DataStorage
 	// StorageCtx see Config.StorageCtx description.
 	StorageCtx string
+	// values are metadata of torrents from configuration by HEX-encoded hash
+	values map[string][]byte
+
+	mu       sync.Mutex
+	onChange []func(...bittorrent.InfoHash)
 }
 
-// Approved checks if specified hash is approved or not.
-// If List.Invert set to true and hash found in storage, function will return false,
-// that means that hash is blacklisted.
-func (l *List) Approved(ctx context.Context, hash bittorrent.InfoHash) (contains bool) {
-	var err error
-	if contains, err = l.Storage.Contains(ctx, l.StorageCtx, hash.RawString()); err == nil {
-		if len(hash) == bittorrent.InfoHashV2Len {
-			if containsV2, errV2 := l.Storage.Contains(ctx, l.StorageCtx, hash.TruncateV1().RawString()); err == nil {
-				contains = contains || containsV2
-			} else {
-				err = errV2
+// OnChange implements container.Notifier
+func (l *List) OnChange(fn func(...bittorrent.InfoHash)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onChange = append(l.onChange, fn)
+}
+
+// Notify reports added or removed hashes to functions registered with OnChange.
+// Truncated forms of v2 hashes are reported as well.
+func (l *List) Notify(hashes ...bittorrent.InfoHash) {
+	l.mu.Lock()
+	fns := l.onChange
+	l.mu.Unlock()
+	if len(fns) == 0 || len(hashes) == 0 {
+		return
+	}
+	for _, ih := range hashes {
+		if len(ih) == bittorrent.InfoHashV2Len {
+			hashes = append(hashes, ih.TruncateV1())
+		}
+	}
+	for _, fn := range fns {
+		fn(hashes...)
+	}
+}
+
+func (l *List) notifyHex(lists ...[]string) {
+	var hashes []bittorrent.InfoHash
+	for _, hs := range lists {
+		for _, h := range hs {
+			if ih, err := bittorrent.NewInfoHashString(h); err == nil {
+				hashes = append(hashes, ih)
 			}
 		}
 	}
-	if err != nil {
-		logger.Error().Err(err).Stringer("infoHash", hash).Msg("unable load hash information from storage")
+	l.Notify(hashes...)
+}
+
+// Approved checks if specified hash is approved or not.
+// If List.Invert set to true and hash found in storage, function will return false,
+// that means that hash is blacklisted.
+func (l *List) Approved(ctx context.Context, hash bittorrent.InfoHash) (bool, error) {
+	contains, err := l.Storage.Contains(ctx, l.StorageCtx, hash.RawString())
+	if err == nil && !contains && len(hash) == bittorrent.InfoHashV2Len {
+		contains, err = l.Storage.Contains(ctx, l.StorageCtx, hash.TruncateV1().RawString())
 	}
-	return contains != l.Invert
+	return contains != l.Invert, err
 }
@@ -0,0 +1,86 @@
+package list
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/metadata"
+)
+
+const (
+	btihPrefix = "urn:btih:"
+	// btmhPrefix is the prefix of BEP 52 multihash: `1220` is SHA-256 of 32 bytes
+	btmhPrefix = "urn:btmh:1220"
+)
+
+var errNoMagnetHash = errors.New("magnet link does not contain info hash")
+
+// torrentHashes returns info hashes of torrent and fills empty
+// metadata from magnet link. Hybrid torrent may have two hashes.
+func torrentHashes(t *metadata.Torrent) (hashes []bittorrent.InfoHash, err error) {
+	if len(t.InfoHash) > 0 {
+		var ih bittorrent.InfoHash
+		if ih, err = bittorrent.NewInfoHashString(t.InfoHash); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.InfoHash, err)
+		}
+		hashes = append(hashes, ih)
+	}
+	if len(t.Magnet) == 0 {
+		if len(hashes) == 0 {
+			err = errNoMagnetHash
+		}
+		return
+	}
+	var u *url.URL
+	if u, err = url.Parse(t.Magnet); err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("%s: not a magnet link", t.Magnet)
+	}
+	q := u.Query()
+	for _, xt := range q["xt"] {
+		var ih bittorrent.InfoHash
+		switch lxt := strings.ToLower(xt); {
+		case strings.HasPrefix(lxt, btihPrefix):
+			ih, err = parseBTIH(xt[len(btihPrefix):])
+		case strings.HasPrefix(lxt, btmhPrefix):
+			ih, err = bittorrent.NewInfoHashString(xt[len(btmhPrefix):])
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", xt, err)
+		}
+		hashes = append(hashes, ih)
+	}
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("%s: %w", t.Magnet, errNoMagnetHash)
+	}
+	if len(t.Name) == 0 {
+		t.Name = q.Get("dn")
+	}
+	if xl := q.Get("xl"); t.Size == 0 && len(xl) > 0 {
+		if t.Size, err = strconv.ParseUint(xl, 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: %w", xl, err)
+		}
+	}
+	return
+}
+
+// parseBTIH decodes HEX or base32 encoded v1 info hash
+func parseBTIH(s string) (bittorrent.InfoHash, error) {
+	if len(s) == base32.StdEncoding.EncodedLen(bittorrent.InfoHashV1Len) {
+		b, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return "", err
+		}
+		return bittorrent.NewInfoHash(b)
+	}
+	return bittorrent.NewInfoHashString(s)
+}
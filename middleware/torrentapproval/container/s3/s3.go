@@ -19,6 +19,7 @@ import (
 	"github.com/sot-tech/mochi/middleware/torrentapproval/container/list"
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metadata"
 	"github.com/sot-tech/mochi/pkg/str2bytes"
 	"github.com/sot-tech/mochi/storage"
 	"github.com/zeebo/bencode"
@@ -149,7 +150,7 @@ func (s *s3) scan(ctx context.Context, files map[string][2]bittorrent.InfoHash,
 							Msg("unable to unmarshal torrent info")
 					}
 					if len(name.Name) == 0 {
-						name.Name = list.DUMMY
+						name.Name = metadata.DUMMY
 					}
 					bName := str2bytes.StringToBytes(name.Name)
 					logger.Err(s.Storage.Put(ctx, s.StorageCtx, storage.Entry{
@@ -166,6 +167,7 @@ func (s *s3) scan(ctx context.Context, files map[string][2]bittorrent.InfoHash,
 						Stringer("infoHash", h1).
 						Stringer("infoHashV2", h2).
 						Msg("added torrent to approval list")
+					s.Notify(h1, h2)
 				}
 			}
 			if err != nil {
@@ -181,6 +183,7 @@ func (s *s3) scan(ctx context.Context, files map[string][2]bittorrent.InfoHash,
 					Stringer("infoHash", ih[1]).
 					Stringer("infoHashV2", ih[1]).
 					Msg("deleted torrent from approval list")
+				s.Notify(ih[0], ih[1])
 			}
 		}
 		clear(tmpFiles)
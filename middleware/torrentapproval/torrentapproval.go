@@ -4,28 +4,41 @@ package torrentapproval
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/middleware"
 	"github.com/sot-tech/mochi/middleware/torrentapproval/container"
+	"github.com/sot-tech/mochi/middleware/torrentapproval/container/list"
 	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
 	"github.com/sot-tech/mochi/storage"
 
 	// import directory watcher to enable appropriate support
 	_ "github.com/sot-tech/mochi/middleware/torrentapproval/container/directory"
 	_ "github.com/sot-tech/mochi/middleware/torrentapproval/container/s3"
-
-	// import static list to enable appropriate support
-	_ "github.com/sot-tech/mochi/middleware/torrentapproval/container/list"
 )
 
 // Name is the name by which this middleware is registered with Conf.
 const Name = "torrent approval"
 
-const internalStore = "internal"
+const (
+	internalStore = "internal"
+	// DefaultAutoApproveStorageCtx default ctx name for provisionally approved hashes
+	DefaultAutoApproveStorageCtx = "MW_APPROVAL_AUTO"
+)
+
+var (
+	logger = log.NewLogger("middleware/torrent approval")
+
+	errAutoApproveTTL = errors.New("auto approve TTL must not be less than 1s")
+)
 
 func init() {
 	middleware.RegisterBuilder(Name, build)
@@ -40,6 +53,27 @@ type baseConfig struct {
 	Storage conf.NamedMapConfig
 	// Configuration depends on used container
 	Configuration conf.MapConfig
+	// AutoApproveTTL if set, unknown hashes are provisionally approved
+	// on first announce and become rejected after this period
+	// until they are confirmed in Source
+	AutoApproveTTL time.Duration `cfg:"auto_approve_ttl"`
+	// AutoApproveStorageCtx is the name of storage context where to store
+	// first announce time of provisionally approved hashes
+	AutoApproveStorageCtx string `cfg:"auto_approve_storage_ctx"`
+	// FilterScrape if set, scrape returns zeroed data for unapproved hashes,
+	// so it is not revealed if tracker has seen them
+	FilterScrape bool `cfg:"filter_scrape"`
+	// RejectScrape if set, unapproved hashes are rejected in scrape
+	// response, data of other hashes is returned as usual
+	RejectScrape bool `cfg:"reject_scrape"`
+	// CacheTTL if set, approvals of Source are cached for this period,
+	// so hashes are not checked in Storage on every request
+	CacheTTL time.Duration `cfg:"cache_ttl"`
+	// CacheDenyTTL is the period of caching of denials,
+	// CacheTTL if zero, denials are not cached if negative
+	CacheDenyTTL time.Duration `cfg:"cache_deny_ttl"`
+	// CacheSize is the maximum number of cached hashes
+	CacheSize int `cfg:"cache_size"`
 }
 
 func build(config conf.MapConfig, st storage.PeerStorage) (h middleware.Hook, err error) {
@@ -69,33 +103,212 @@ func build(config conf.MapConfig, st storage.PeerStorage) (h middleware.Hook, er
 		return
 	}
 
+	var aa *autoApprove
+	if cfg.AutoApproveTTL > 0 {
+		// first announce time is stored in seconds
+		if cfg.AutoApproveTTL < time.Second {
+			return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errAutoApproveTTL)
+		}
+		var lc list.Config
+		if err = cfg.Configuration.Unmarshal(&lc); err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", Name, err)
+		}
+		if lc.Invert {
+			return nil, fmt.Errorf("invalid config for middleware %s: auto approve is not applicable to black list", Name)
+		}
+		aa = &autoApprove{
+			storage:    ds,
+			storageCtx: cfg.AutoApproveStorageCtx,
+			ttl:        cfg.AutoApproveTTL,
+		}
+		if len(aa.storageCtx) == 0 {
+			logger.Warn().
+				Str("name", "AutoApproveStorageCtx").
+				Str("provided", aa.storageCtx).
+				Str("default", DefaultAutoApproveStorageCtx).
+				Msg("falling back to default configuration")
+			aa.storageCtx = DefaultAutoApproveStorageCtx
+		}
+	}
+
 	var c container.Container
-	if c, err = container.GetContainer(cfg.Source, cfg.Configuration, ds); err == nil {
-		h = &hook{c, dsc}
+	if c, err = acquire(cfg, ds, dsc == nil); err == nil {
+		h = &hook{c, aa, dsc, cfg.FilterScrape, cfg.RejectScrape}
+	} else if dsc != nil {
+		_ = dsc.Close()
 	}
 	return h, err
 }
 
+var (
+	sharedMu sync.Mutex
+	// shared are containers (with cache) of middlewares with
+	// the same source configuration using tracker's storage
+	shared = make(map[string]*sharedContainer)
+)
+
+// sharedContainer is the container used by several middlewares,
+// it is closed when the last one closes it
+type sharedContainer struct {
+	container.Container
+	key  string
+	refs int
+}
+
+// acquire returns container configured by cfg, if share is set,
+// container is reused by middlewares with the same configuration
+func acquire(cfg baseConfig, ds storage.DataStorage, share bool) (container.Container, error) {
+	build := func() (c container.Container, err error) {
+		if c, err = container.GetContainer(cfg.Source, cfg.Configuration, ds); err == nil && cfg.CacheTTL > 0 {
+			c = newCache(c, cfg)
+		}
+		return
+	}
+	if !share {
+		return build()
+	}
+	key := fmt.Sprintf("%p|%s|%v|%d|%d|%d", ds, cfg.Source, cfg.Configuration, cfg.CacheTTL, cfg.CacheDenyTTL, cfg.CacheSize)
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if sc, exists := shared[key]; exists {
+		sc.refs++
+		return sc, nil
+	}
+	c, err := build()
+	if err != nil {
+		return nil, err
+	}
+	sc := &sharedContainer{Container: c, key: key, refs: 1}
+	shared[key] = sc
+	return sc, nil
+}
+
+func (sc *sharedContainer) Close() error {
+	sharedMu.Lock()
+	sc.refs--
+	last := sc.refs == 0
+	if last {
+		delete(shared, sc.key)
+	}
+	sharedMu.Unlock()
+	if cl, isOk := sc.Container.(io.Closer); isOk && last {
+		return cl.Close()
+	}
+	return nil
+}
+
+func newCache(c container.Container, cfg baseConfig) *container.Cache {
+	if cfg.CacheDenyTTL == 0 {
+		logger.Warn().
+			Str("name", "CacheDenyTTL").
+			Dur("provided", cfg.CacheDenyTTL).
+			Dur("default", cfg.CacheTTL).
+			Msg("falling back to default configuration")
+		cfg.CacheDenyTTL = cfg.CacheTTL
+	}
+	if cfg.CacheSize <= 0 {
+		logger.Warn().
+			Str("name", "CacheSize").
+			Int("provided", cfg.CacheSize).
+			Int("default", container.DefaultCacheSize).
+			Msg("falling back to default configuration")
+		cfg.CacheSize = container.DefaultCacheSize
+	}
+	return container.NewCache(c, cfg.CacheTTL, cfg.CacheDenyTTL, cfg.CacheSize)
+}
+
 // ErrTorrentUnapproved is the error returned when a torrent hash is invalid.
-var ErrTorrentUnapproved = bittorrent.ClientError("torrent not allowed by mochi")
+var ErrTorrentUnapproved = bittorrent.NewClientError(bittorrent.ReasonUnapprovedTorrent, "torrent not allowed by mochi")
+
+// autoApprove holds first announce time of unknown hashes
+// and approves them until TTL expires
+type autoApprove struct {
+	storage    storage.DataStorage
+	storageCtx string
+	ttl        time.Duration
+}
+
+// approved checks if hash was seen for the first time not earlier than TTL ago.
+// If hash was not seen yet, it's first announce time is stored and
+// hash is approved (but not stored in dry run, see middleware.DryRun).
+// If register is false, unseen hash is not approved and not stored.
+func (aa *autoApprove) approved(ctx context.Context, hash bittorrent.InfoHash, register bool) bool {
+	now := timecache.NowUnix()
+	key := hash.TruncateV1().RawString()
+	b, err := aa.storage.Load(ctx, aa.storageCtx, key)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", hash).Msg("unable load auto approve information from storage")
+		return false
+	}
+	if len(b) < 8 {
+		if !register {
+			return false
+		}
+		if middleware.DryRun(ctx) {
+			return true
+		}
+		if err = aa.storage.Put(ctx, aa.storageCtx, storage.Entry{
+			Key:   key,
+			Value: binary.BigEndian.AppendUint64(nil, uint64(now)),
+		}); err != nil {
+			logger.Error().Err(err).Stringer("infoHash", hash).Msg("unable to store auto approve information")
+			return false
+		}
+		logger.Info().Stringer("infoHash", hash).Msg("torrent provisionally approved")
+		return true
+	}
+	firstSeen := int64(binary.BigEndian.Uint64(b))
+	if time.Duration(now-firstSeen)*time.Second < aa.ttl {
+		return true
+	}
+	logger.Debug().
+		Stringer("infoHash", hash).
+		Time("firstSeen", time.Unix(firstSeen, 0)).
+		Msg("provisional approval expired")
+	return false
+}
 
 type hook struct {
 	hashContainer   container.Container
+	autoApprove     *autoApprove
 	providedStorage storage.DataStorage
+	filterScrape    bool
+	rejectScrape    bool
+}
+
+func (h *hook) approved(ctx context.Context, ih bittorrent.InfoHash, register bool) bool {
+	approved, err := h.hashContainer.Approved(ctx, ih)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", ih).Msg("unable load hash information from storage")
+	}
+	return approved || (h.autoApprove != nil && h.autoApprove.approved(ctx, ih, register))
 }
 
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
 	var err error
 
-	if !h.hashContainer.Approved(ctx, req.InfoHash) {
+	if !h.approved(ctx, req.InfoHash, true) {
 		err = ErrTorrentUnapproved
 	}
 
 	return ctx, err
 }
 
-func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
-	// Scrapes don't require any protection.
+// HandleScrape places zeroed data of unapproved hashes into response
+// if FilterScrape is set, or rejected hashes if RejectScrape is set,
+// so response hook does not fill it.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.filterScrape || h.rejectScrape {
+		for _, ih := range req.InfoHashes {
+			if !h.approved(ctx, ih, false) {
+				scr := bittorrent.Scrape{InfoHash: ih}
+				if h.rejectScrape {
+					scr.Failure = ErrTorrentUnapproved
+				}
+				resp.Data = append(resp.Data, scr)
+			}
+		}
+	}
 	return ctx, nil
 }
 
@@ -2,14 +2,21 @@ package torrentapproval
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/torrentapproval/container"
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metadata"
+	"github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/memory"
 )
 
@@ -99,3 +106,162 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleAnnounceAutoApprove(t *testing.T) {
+	st, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	cfg := conf.MapConfig{
+		"initial_source":   "list",
+		"auto_approve_ttl": "1h",
+		"configuration": map[string]any{
+			"hash_list": []string{"3532cf2d327fad8448c075b4cb42c8136964a435"},
+		},
+	}
+	h, err := build(cfg, st)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	unknown, err := bittorrent.NewInfoHashString("4532cf2d327fad8448c075b4cb42c8136964a435")
+	require.Nil(t, err)
+	req, resp := &bittorrent.AnnounceRequest{InfoHash: unknown}, &bittorrent.AnnounceResponse{}
+
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err, "unknown hash should be provisionally approved")
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err, "provisionally approved hash should be approved until TTL expires")
+
+	expired, err := bittorrent.NewInfoHashString("5532cf2d327fad8448c075b4cb42c8136964a435")
+	require.Nil(t, err)
+	err = st.Put(ctx, DefaultAutoApproveStorageCtx, storage.Entry{
+		Key:   expired.RawString(),
+		Value: binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(-2*time.Hour).Unix())),
+	})
+	require.Nil(t, err)
+	req.InfoHash = expired
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Equal(t, ErrTorrentUnapproved, err)
+
+	_, err = build(conf.MapConfig{
+		"initial_source":   "list",
+		"auto_approve_ttl": "1h",
+		"configuration":    map[string]any{"invert": true},
+	}, st)
+	require.NotNil(t, err, "auto approve should not be allowed in black list mode")
+
+	_, err = build(conf.MapConfig{
+		"initial_source":   "list",
+		"auto_approve_ttl": "500ms",
+		"configuration":    map[string]any{},
+	}, st)
+	require.ErrorIs(t, err, errAutoApproveTTL)
+}
+
+func TestHandleScrapeFilter(t *testing.T) {
+	st, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer st.Close()
+	h, err := build(conf.MapConfig{
+		"initial_source": "list",
+		"filter_scrape":  true,
+		"configuration": map[string]any{
+			"hash_list": []string{"3532cf2d327fad8448c075b4cb42c8136964a435"},
+		},
+	}, st)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	approved, _ := bittorrent.NewInfoHashString("3532cf2d327fad8448c075b4cb42c8136964a435")
+	unknown, _ := bittorrent.NewInfoHashString("4532cf2d327fad8448c075b4cb42c8136964a435")
+	peer := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	for _, ih := range []bittorrent.InfoHash{approved, unknown} {
+		require.Nil(t, st.PutSeeder(ctx, ih, peer))
+	}
+
+	l := middleware.NewLogic(time.Minute, time.Minute, st, []middleware.Hook{h}, nil, nil)
+	_, resp, err := l.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{unknown, approved}})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{
+		{InfoHash: unknown},
+		{InfoHash: approved, Complete: 1},
+	}, resp.Data)
+
+	h.(*hook).rejectScrape = true
+	_, resp, err = l.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{unknown, approved}})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{
+		{InfoHash: unknown, Failure: ErrTorrentUnapproved},
+		{InfoHash: approved, Complete: 1},
+	}, resp.Data)
+}
+
+func TestTorrentMetadata(t *testing.T) {
+	st, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer st.Close()
+	h, err := build(conf.MapConfig{
+		"initial_source": "list",
+		"configuration": map[string]any{
+			"torrents": []any{
+				map[string]any{"info_hash": "3532cf2d327fad8448c075b4cb42c8136964a435", "category": "video", "size": 1024},
+				map[string]any{
+					"magnet":   "magnet:?xt=urn:btih:MUZM6LJSP6WYISGAOW2MWQWICNUWJJBV&dn=Some+Name&xl=2048",
+					"category": "audio",
+				},
+				map[string]any{"info_hash": "5532cf2d327fad8448c075b4cb42c8136964a435"},
+			},
+		},
+	}, st)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	for ih, expected := range map[string]metadata.Torrent{
+		"3532cf2d327fad8448c075b4cb42c8136964a435": {Category: "video", Size: 1024},
+		"6532cf2d327fad8448c075b4cb42c8136964a435": {Name: "Some Name", Category: "audio", Size: 2048},
+		"5532cf2d327fad8448c075b4cb42c8136964a435": {},
+	} {
+		hash, _ := bittorrent.NewInfoHashString(ih)
+		_, err = h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{InfoHash: hash}, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err, ih)
+		torrent, found, err := metadata.Load(ctx, st, container.DefaultStorageCtxName, hash)
+		require.Nil(t, err)
+		require.True(t, found, ih)
+		require.Equal(t, expected, torrent, ih)
+	}
+
+	unknown, _ := bittorrent.NewInfoHashString("4532cf2d327fad8448c075b4cb42c8136964a435")
+	_, found, err := metadata.Load(ctx, st, container.DefaultStorageCtxName, unknown)
+	require.Nil(t, err)
+	require.False(t, found)
+
+	_, err = build(conf.MapConfig{
+		"initial_source": "list",
+		"configuration":  map[string]any{"torrents": []any{map[string]any{"magnet": "magnet:?dn=no+hash"}}},
+	}, st)
+	require.NotNil(t, err)
+}
+
+func TestSharedContainer(t *testing.T) {
+	st, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer st.Close()
+	cfg := conf.MapConfig{
+		"initial_source": "list",
+		"cache_ttl":      time.Minute,
+		"configuration": map[string]any{
+			"hash_list": []string{"3532cf2d327fad8448c075b4cb42c8136964a435"},
+		},
+	}
+	h1, err := build(cfg, st)
+	require.Nil(t, err)
+	h2, err := build(cfg, st)
+	require.Nil(t, err)
+	require.Same(t, h1.(*hook).hashContainer, h2.(*hook).hashContainer)
+
+	require.Nil(t, h1.(*hook).Close())
+	require.Len(t, shared, 1)
+	require.Nil(t, h2.(*hook).Close())
+	require.Empty(t, shared)
+}
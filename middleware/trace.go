@@ -0,0 +1,366 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/admin"
+)
+
+// Results of traced hooks and announce
+const (
+	TracePassed   = "passed"
+	TraceRejected = "rejected"
+	TraceFailed   = "failed"
+	TraceSkipped  = "skipped"
+	// TraceShadowed is the result of not enforced hook, which would reject announce
+	TraceShadowed = "shadowed"
+)
+
+// traceDefaultNumWant is the number of peers requested
+// by traced announce if `numwant` not provided
+const traceDefaultNumWant = 50
+
+var (
+	errTraceNoInfoHash = errors.New("info_hash not provided")
+	errTraceNoPeerID   = errors.New("peer_id not provided")
+	errTraceNoAddr     = errors.New("addr not provided")
+	errTraceFrontend   = errors.New("unknown frontend")
+)
+
+// traceArgs are query arguments of trace handler, which are
+// not passed to hooks as request parameters
+var traceArgs = map[string]bool{
+	"frontend": true, "host": true, "path": true, "addr": true, "info_hash": true, "peer_id": true,
+	"port": true, "event": true, "left": true, "downloaded": true, "uploaded": true, "numwant": true,
+	"corrupt": true, "redundant": true,
+}
+
+// TraceStep is the decision of single hook in announce trace
+type TraceStep struct {
+	Hook   string `json:"hook"`
+	Chain  string `json:"chain"`
+	Result string `json:"result"`
+	// Reason is the error returned by hook or the reason why hook skipped
+	Reason string `json:"reason,omitempty"`
+	// Changes are the fields of response modified by hook
+	Changes    []string `json:"changes,omitempty"`
+	DurationMs float64  `json:"duration_ms"`
+}
+
+// TraceResponse is the summary of response generated by traced announce
+type TraceResponse struct {
+	Interval    string `json:"interval"`
+	MinInterval string `json:"min_interval"`
+	Complete    uint32 `json:"complete"`
+	Incomplete  uint32 `json:"incomplete"`
+	IPv4Peers   int    `json:"ipv4_peers"`
+	IPv6Peers   int    `json:"ipv6_peers"`
+	Warning     string `json:"warning,omitempty"`
+}
+
+// Trace is the result of Logic.TraceAnnounce
+type Trace struct {
+	// Tenant is the name of tenant, which processed announce, empty for default one
+	Tenant string `json:"tenant,omitempty"`
+	// RequestID identifies traced announce in logs and webhook events
+	RequestID string         `json:"request_id,omitempty"`
+	Steps     []TraceStep    `json:"steps"`
+	Result    string         `json:"result"`
+	Error     string         `json:"error,omitempty"`
+	Response  *TraceResponse `json:"response,omitempty"`
+}
+
+// hookName returns the name of hook from configuration
+func hookName(h Hook) string {
+	if fh, isOk := h.(*filterHook); isOk {
+		h = fh.Hook
+	}
+	if th, isOk := h.(*timedHook); isOk {
+		return th.name
+	}
+	return fmt.Sprintf("%T", h)
+}
+
+// traceable returns the hook, which should be called by trace (without
+// metrics wrapper) and whether it is enforced, or the reason why hook is not called
+func traceable(h Hook) (_ Hook, enforced bool, skip string) {
+	if fh, isOk := h.(*filterHook); isOk {
+		if !fh.announce {
+			return nil, false, "hook handles only scrapes"
+		}
+		h = fh.Hook
+	}
+	enforced = true
+	if th, isOk := h.(*timedHook); isOk {
+		h, enforced = th.Hook, !th.shadow
+	}
+	if _, isOk := h.(*swarmInteractionHook); isOk {
+		return nil, false, "swarm is not modified by trace"
+	}
+	return h, enforced, ""
+}
+
+// rejectResult returns result of rejection by err and its reason
+func rejectResult(err error) (string, string) {
+	var clientErr bittorrent.ClientError
+	if errors.As(err, &clientErr) {
+		return TraceRejected, clientErr.Error()
+	}
+	return TraceFailed, err.Error()
+}
+
+// responseChanges returns names of fields, which differ in responses
+func responseChanges(before, after *bittorrent.AnnounceResponse) (out []string) {
+	if before.Interval != after.Interval {
+		out = append(out, "interval")
+	}
+	if before.MinInterval != after.MinInterval {
+		out = append(out, "min_interval")
+	}
+	if before.Complete != after.Complete {
+		out = append(out, "complete")
+	}
+	if before.Incomplete != after.Incomplete {
+		out = append(out, "incomplete")
+	}
+	if len(before.IPv4Peers) != len(after.IPv4Peers) {
+		out = append(out, "ipv4_peers")
+	}
+	if len(before.IPv6Peers) != len(after.IPv6Peers) {
+		out = append(out, "ipv6_peers")
+	}
+	if before.WarningMessage != after.WarningMessage {
+		out = append(out, "warning")
+	}
+	return
+}
+
+type dryRunKey struct{}
+
+// WithDryRun marks announce, which must not change state of hooks
+// (i.e. traced announce)
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// DryRun returns true if announce must not change state of hooks.
+// Hooks, which keep state (i.e. rate limiters, sessions or accounted transfer),
+// should make decision as usual, but not store it, and hooks, which only
+// record announces (i.e. statistics or events), should skip it.
+func DryRun(ctx context.Context) bool {
+	dry, _ := ctx.Value(dryRunKey{}).(bool)
+	return dry
+}
+
+// TraceAnnounce processes announce by RejectCache, pre and response hooks
+// the same way as HandleAnnounce, but records decision of every hook.
+// Swarm is not updated, post hooks and observers are not called,
+// rejections are not stored in RejectCache and hooks are called
+// in dry run mode (see DryRun), so state of tracker is not changed.
+func (l *Logic) TraceAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (tr Trace) {
+	ctx = WithDryRun(ctx)
+	tr.Tenant, tr.RequestID, tr.Result = l.tenant, bittorrent.RequestID(ctx), TracePassed
+	if err := l.rejectCache.Check(req.RequestAddresses, req.ID, req.Params); err != nil {
+		step := TraceStep{Hook: rejectCacheHookName, Chain: "cache"}
+		step.Result, step.Reason = rejectResult(err)
+		tr.Steps = append(tr.Steps, step)
+		tr.Result, tr.Error = step.Result, step.Reason
+		return
+	}
+	resp := l.newAnnounceResponse(req)
+	for _, chain := range []struct {
+		name  string
+		hooks []Hook
+	}{{"pre", l.preHooks}, {"response", l.responseHooks}} {
+		for _, h := range chain.hooks {
+			step := TraceStep{Hook: hookName(h), Chain: chain.name, Result: TracePassed}
+			th, enforced, skip := traceable(h)
+			if th == nil {
+				step.Result, step.Reason = TraceSkipped, skip
+				tr.Steps = append(tr.Steps, step)
+				continue
+			}
+			before := *resp
+			start := time.Now()
+			hCtx, err := th.HandleAnnounce(ctx, req, resp)
+			step.DurationMs = float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond)
+			if err != nil && !enforced {
+				_, step.Reason = rejectResult(err)
+				step.Result = TraceShadowed
+				tr.Steps = append(tr.Steps, step)
+				continue
+			}
+			if err != nil {
+				step.Result, step.Reason = rejectResult(err)
+				tr.Steps = append(tr.Steps, step)
+				tr.Result, tr.Error = step.Result, step.Reason
+				return
+			}
+			step.Changes = responseChanges(&before, resp)
+			tr.Steps = append(tr.Steps, step)
+			ctx = hCtx
+		}
+	}
+	tr.Response = &TraceResponse{
+		Interval:    resp.Interval.String(),
+		MinInterval: resp.MinInterval.String(),
+		Complete:    resp.Complete,
+		Incomplete:  resp.Incomplete,
+		IPv4Peers:   len(resp.IPv4Peers),
+		IPv6Peers:   len(resp.IPv6Peers),
+		Warning:     resp.WarningMessage,
+	}
+	return
+}
+
+// traceParams are request parameters of traced announce
+type traceParams map[string]string
+
+func (p traceParams) GetString(key string) (string, bool) {
+	v, ok := p[key]
+	return v, ok
+}
+
+func (p traceParams) MarshalZerologObject(e *zerolog.Event) {
+	for k, v := range p {
+		e.Str(k, v)
+	}
+}
+
+func (p traceParams) Extra() map[string]string {
+	return maps.Clone(p)
+}
+
+// parseTraceAnnounce builds announce request from query arguments
+func parseTraceAnnounce(args *fasthttp.Args) (req *bittorrent.AnnounceRequest, err error) {
+	params := traceParams{}
+	args.VisitAll(func(k, v []byte) {
+		if !traceArgs[string(k)] {
+			params[string(k)] = string(v)
+		}
+	})
+	req = &bittorrent.AnnounceRequest{Params: params, Event: bittorrent.None}
+
+	v := args.Peek("info_hash")
+	if len(v) == 0 {
+		return nil, errTraceNoInfoHash
+	}
+	var b []byte
+	if b, err = hex.DecodeString(string(v)); err == nil {
+		req.InfoHash, err = bittorrent.NewInfoHash(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if v = args.Peek("peer_id"); len(v) == 0 {
+		return nil, errTraceNoPeerID
+	}
+	if b, err = hex.DecodeString(string(v)); err == nil {
+		req.ID, err = bittorrent.NewPeerID(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if v = args.Peek("addr"); len(v) == 0 {
+		return nil, errTraceNoAddr
+	}
+	var addr netip.Addr
+	if addr, err = netip.ParseAddr(string(v)); err != nil {
+		return nil, err
+	}
+	req.RequestAddresses = bittorrent.RequestAddresses{{Addr: addr}}
+
+	if v = args.Peek("event"); len(v) > 0 {
+		req.EventProvided = true
+		if req.Event, err = bittorrent.NewEvent(string(v)); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range []struct {
+		name string
+		dst  *uint64
+	}{
+		{"left", &req.Left}, {"downloaded", &req.Downloaded}, {"uploaded", &req.Uploaded},
+		{"corrupt", &req.Corrupt}, {"redundant", &req.Redundant},
+	} {
+		if v = args.Peek(u.name); len(v) > 0 {
+			if *u.dst, err = strconv.ParseUint(string(v), 10, 64); err != nil {
+				return nil, fmt.Errorf("%s: %w", u.name, err)
+			}
+		}
+	}
+	var n uint64
+	if v = args.Peek("numwant"); len(v) > 0 {
+		if n, err = strconv.ParseUint(string(v), 10, 32); err != nil {
+			return nil, fmt.Errorf("numwant: %w", err)
+		}
+		req.NumWant, req.NumWantProvided = uint32(n), true
+	}
+	if v = args.Peek("port"); len(v) > 0 {
+		if n, err = strconv.ParseUint(string(v), 10, 16); err != nil {
+			return nil, bittorrent.ErrInvalidPort
+		}
+		req.Port = uint16(n)
+	}
+	if err = bittorrent.SanitizeAnnounce(req, math.MaxUint32, traceDefaultNumWant, false); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// TraceHandler creates admin API handler, which processes synthetic announce
+// described by query arguments with Logic.TraceAnnounce and returns Trace.
+// Logic is selected by `frontend` index (in order of logics) and tenant
+// by `host` and `path` query arguments.
+func TraceHandler(logics ...*Logic) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		args := ctx.QueryArgs()
+		i := 0
+		if v := args.Peek("frontend"); len(v) > 0 {
+			var err error
+			if i, err = strconv.Atoi(string(v)); err != nil {
+				admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+				return
+			}
+		}
+		if i < 0 || i >= len(logics) {
+			admin.WriteError(ctx, fasthttp.StatusBadRequest, errTraceFrontend)
+			return
+		}
+		req, err := parseTraceAnnounce(args)
+		if err != nil {
+			admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+			return
+		}
+		p := args.Peek("path")
+		if len(p) == 0 {
+			p = rootPath
+		}
+		l, _ := logics[i].Tenant(args.Peek("host"), p)
+		reqCtx := bittorrent.WithRequestID(bittorrent.InjectRouteParamsToContext(ctx, nil), bittorrent.NewRequestID())
+		tr := l.TraceAnnounce(reqCtx, req)
+		logger.Info().
+			Str("requestID", tr.RequestID).
+			Object("request", req).
+			Int("frontend", i).
+			Str("tenant", tr.Tenant).
+			Str("result", tr.Result).
+			Str("error", tr.Error).
+			Msg("announce traced")
+		admin.WriteJSON(ctx, fasthttp.StatusOK, tr)
+	}
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+// passkeyHook rejects announces without `passkey=good` parameter
+type passkeyHook struct {
+	nopHook
+}
+
+func (h *passkeyHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if pk, _ := req.GetString("passkey"); pk != "good" {
+		return ctx, errRejected
+	}
+	resp.AddWarning("passkey checked")
+	return ctx, nil
+}
+
+func TestTraceHandler(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	l := NewLogic(time.Minute, time.Minute, ps, []Hook{
+		&filterHook{Hook: &timedHook{Hook: &nopHook{}, name: "scrape only"}, scrape: true},
+		&timedHook{Hook: &passkeyHook{}, name: "passkey"},
+	}, nil, nil)
+	handler := TraceHandler(l)
+
+	request := func(uri string) (int, Trace) {
+		var req fasthttp.Request
+		req.SetRequestURI(uri)
+		rCtx := new(fasthttp.RequestCtx)
+		rCtx.Init(&req, nil, nil)
+		handler(rCtx)
+		var tr Trace
+		require.Nil(t, json.Unmarshal(rCtx.Response.Body(), &tr))
+		return rCtx.Response.StatusCode(), tr
+	}
+
+	ih := bittorrent.InfoHash("11111111111111111111")
+	base := "/trace/announce?info_hash=" + hex.EncodeToString([]byte(ih)) +
+		"&peer_id=" + hex.EncodeToString(make([]byte, bittorrent.PeerIDLen)) + "&addr=1.2.3.4&event=started"
+
+	for _, uri := range []string{"/trace/announce", base + "&port=6881&frontend=1", base, base + "&port=6881&left=x"} {
+		status, _ := request(uri)
+		require.Equal(t, fasthttp.StatusBadRequest, status, uri)
+	}
+
+	base += "&port=6881"
+	status, tr := request(base + "&passkey=bad")
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Equal(t, TraceRejected, tr.Result)
+	require.Equal(t, errRejected.Error(), tr.Error)
+	require.Nil(t, tr.Response)
+	require.Len(t, tr.Steps, 2)
+	require.Equal(t, TraceStep{Hook: "scrape only", Chain: "pre", Result: TraceSkipped, Reason: "hook handles only scrapes"}, tr.Steps[0])
+	require.Equal(t, "passkey", tr.Steps[1].Hook)
+	require.Equal(t, TraceRejected, tr.Steps[1].Result)
+
+	status, tr = request(base + "&passkey=good")
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Equal(t, TracePassed, tr.Result)
+	require.Len(t, tr.Steps, 3)
+	require.Equal(t, []string{"warning"}, tr.Steps[1].Changes)
+	require.Equal(t, peersHookName, tr.Steps[2].Hook)
+	require.Equal(t, TracePassed, tr.Steps[2].Result)
+	require.Equal(t, "passkey checked", tr.Response.Warning)
+	require.Equal(t, time.Minute.String(), tr.Response.Interval)
+
+	// swarm is not updated even if it is updated before response hooks
+	l = NewLogic(time.Minute, time.Minute, ps, nil, nil, []Hook{&timedHook{Hook: &nopHook{}, name: "response"}})
+	handler = TraceHandler(l)
+	status, tr = request(base)
+	require.Equal(t, fasthttp.StatusOK, status)
+	require.Equal(t, TracePassed, tr.Result)
+	require.Len(t, tr.Steps, 3)
+	require.Equal(t, TraceStep{Hook: swarmHookName, Chain: "response", Result: TraceSkipped, Reason: "swarm is not modified by trace"}, tr.Steps[1])
+	require.Equal(t, "response", tr.Steps[2].Hook)
+	leechers, seeders, _, err := ps.ScrapeSwarm(context.Background(), ih)
+	require.Nil(t, err)
+	require.Zero(t, leechers+seeders)
+}
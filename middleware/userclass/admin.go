@@ -0,0 +1,66 @@
+package userclass
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/storage"
+)
+
+type classResponse struct {
+	User  string `json:"user"`
+	Class *Class `json:"class"`
+}
+
+func (h *hook) handleListClasses(ctx *fasthttp.RequestCtx) {
+	out := make([]Class, 0, len(h.classes))
+	for _, c := range h.classes {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	admin.WriteJSON(ctx, fasthttp.StatusOK, out)
+}
+
+func (h *hook) handleGetClass(ctx *fasthttp.RequestCtx) {
+	user, _ := ctx.UserValue("user").(string)
+	c, found, err := h.Class(ctx, user)
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	resp := classResponse{User: user}
+	if found {
+		resp.Class = &c
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, resp)
+}
+
+// handleSetClass assigns class provided in `class` query argument to user
+func (h *hook) handleSetClass(ctx *fasthttp.RequestCtx) {
+	user, _ := ctx.UserValue("user").(string)
+	name := string(ctx.QueryArgs().Peek("class"))
+	c, ok := h.classes[name]
+	if !ok {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, fmt.Errorf("%w '%s'", errUnknownClass, name))
+		return
+	}
+	if err := h.storage.Put(ctx, h.cfg.StorageCtx, storage.Entry{Key: user, Value: []byte(name)}); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, classResponse{User: user, Class: &c})
+}
+
+func (h *hook) handleDeleteClass(ctx *fasthttp.RequestCtx) {
+	user, _ := ctx.UserValue("user").(string)
+	if err := h.storage.Delete(ctx, h.cfg.StorageCtx, user); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
@@ -0,0 +1,214 @@
+// Package userclass implements a Hook that resolves class of user
+// (i.e. "power user", "VIP") stored in DataStorage and passes its
+// policy to the next hooks through context.
+package userclass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "user class"
+
+// DefaultStorageCtx is the name of storage context where users' classes are stored
+const DefaultStorageCtx = "MW_USER_CLASS"
+
+var (
+	logger = log.NewLogger("middleware/user class")
+
+	errNoUserParam   = errors.New("user_param not provided")
+	errNoClasses     = errors.New("classes not provided")
+	errEmptyName     = errors.New("class name not provided")
+	errUnknownClass  = errors.New("unknown class")
+	errInvalidPolicy = errors.New("min_ratio and multipliers must not be negative")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Class is the set of policies applied to user
+type Class struct {
+	// Name of class
+	Name string `json:"name"`
+	// MinRatio overrides minimal ratio of warning middleware, zero means not set
+	MinRatio float64 `json:"min_ratio,omitempty"`
+	// MaxSlots overrides maximum slots of slots middleware,
+	// zero means not set, negative means no limit
+	MaxSlots int `json:"max_slots,omitempty"`
+	// DownloadMultiplier multiplies download multiplier of freeleech middleware
+	DownloadMultiplier float64 `json:"download_multiplier"`
+	// UploadMultiplier multiplies upload multiplier of freeleech middleware
+	UploadMultiplier float64 `json:"upload_multiplier"`
+}
+
+type classKey struct{}
+
+// FromContext returns class of user resolved by this middleware
+func FromContext(ctx context.Context) (c Class, found bool) {
+	c, found = ctx.Value(classKey{}).(Class)
+	return
+}
+
+// ClassConfig is the class definition in configuration.
+// Multipliers are 1 if not set.
+type ClassConfig struct {
+	Name               string
+	MinRatio           float64  `cfg:"min_ratio"`
+	MaxSlots           int      `cfg:"max_slots"`
+	DownloadMultiplier *float64 `cfg:"download_multiplier"`
+	UploadMultiplier   *float64 `cfg:"upload_multiplier"`
+}
+
+func (cc ClassConfig) class() (c Class, err error) {
+	c = Class{Name: cc.Name, MinRatio: cc.MinRatio, MaxSlots: cc.MaxSlots, DownloadMultiplier: 1, UploadMultiplier: 1}
+	if cc.DownloadMultiplier != nil {
+		c.DownloadMultiplier = *cc.DownloadMultiplier
+	}
+	if cc.UploadMultiplier != nil {
+		c.UploadMultiplier = *cc.UploadMultiplier
+	}
+	if len(c.Name) == 0 {
+		err = errEmptyName
+	} else if c.MinRatio < 0 || c.DownloadMultiplier < 0 || c.UploadMultiplier < 0 {
+		err = fmt.Errorf("class '%s': %w", c.Name, errInvalidPolicy)
+	}
+	return
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// UserParam is the name of announce query parameter which identifies
+	// user (i.e. passkey).
+	UserParam string `cfg:"user_param"`
+	// Classes list of class definitions.
+	Classes []ClassConfig
+	// DefaultClass is the name of class applied to users without
+	// assigned class. If empty, no class applied.
+	DefaultClass string `cfg:"default_class"`
+	// StorageCtx is the name of storage context where users' classes are stored.
+	StorageCtx string `cfg:"storage_ctx"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.UserParam) == 0 {
+		err = errNoUserParam
+		return
+	}
+	if len(cfg.Classes) == 0 {
+		err = errNoClasses
+		return
+	}
+	if len(cfg.StorageCtx) == 0 {
+		validCfg.StorageCtx = DefaultStorageCtx
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", validCfg.StorageCtx).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		cfg:     cfg,
+		storage: st,
+		classes: make(map[string]Class, len(cfg.Classes)),
+	}
+	for _, cc := range cfg.Classes {
+		var c Class
+		if c, err = cc.class(); err != nil {
+			return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+		}
+		h.classes[c.Name] = c
+	}
+	if len(cfg.DefaultClass) > 0 {
+		if _, ok := h.classes[cfg.DefaultClass]; !ok {
+			return nil, fmt.Errorf("invalid config for middleware %s: %w '%s'", Name, errUnknownClass, cfg.DefaultClass)
+		}
+	}
+	admin.Handle(http.MethodGet, "/class", h.handleListClasses)
+	admin.Handle(http.MethodGet, "/class/{user}", h.handleGetClass)
+	admin.HandleModerated(http.MethodPost, "/class/{user}", h.handleSetClass)
+	admin.HandleModerated(http.MethodDelete, "/class/{user}", h.handleDeleteClass)
+	return h, nil
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.DataStorage
+	classes map[string]Class
+}
+
+// Class returns class of user, or default class if user has no
+// class assigned or assigned class is not defined anymore.
+func (h *hook) Class(ctx context.Context, user string) (c Class, found bool, err error) {
+	var b []byte
+	if b, err = h.storage.Load(ctx, h.cfg.StorageCtx, user); err != nil {
+		return
+	}
+	if len(b) > 0 {
+		if c, found = h.classes[string(b)]; !found {
+			logger.Warn().Str("user", user).Bytes("class", b).Msg("user has undefined class")
+		}
+	}
+	if !found && len(h.cfg.DefaultClass) > 0 {
+		c, found = h.classes[h.cfg.DefaultClass]
+	}
+	return
+}
+
+// HandleAnnounce places user's class into context.
+// Should be used before middlewares, which consult class.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Params == nil {
+		return ctx, nil
+	}
+	user, _ := req.Params.GetString(h.cfg.UserParam)
+	if len(user) == 0 {
+		return ctx, nil
+	}
+	c, found, err := h.Class(ctx, user)
+	if err != nil {
+		logger.Error().Err(err).Str("user", user).Msg("unable to load user class")
+	} else if found {
+		ctx = context.WithValue(ctx, classKey{}, c)
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not affected by class.
+	return ctx, nil
+}
+
+// Erase deletes class assignment of user
+func (h *hook) Erase(ctx context.Context, s middleware.Subject) (middleware.ErasureReport, error) {
+	if len(s.User) == 0 {
+		return nil, nil
+	}
+	n, err := middleware.EraseKeys(ctx, h.storage, h.cfg.StorageCtx, s.User)
+	return middleware.ErasureReport{"class": n}, err
+}
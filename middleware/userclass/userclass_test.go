@@ -0,0 +1,99 @@
+package userclass
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+type params map[string]string
+
+func (p params) GetString(key string) (out string, found bool) {
+	out, found = p[key]
+	return
+}
+
+func (params) MarshalZerologObject(*zerolog.Event) {}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{
+		"user_param": "passkey",
+		"classes": []any{
+			map[string]any{"name": "user", "max_slots": 2},
+			map[string]any{"name": "vip", "max_slots": -1, "min_ratio": 0.1, "download_multiplier": 0},
+		},
+		"default_class": "user",
+	}, ps)
+	require.Nil(t, err)
+	hk := h.(*hook)
+
+	req := &bittorrent.AnnounceRequest{Params: params{"passkey": "user1"}}
+	resp := &bittorrent.AnnounceResponse{}
+
+	ctx, err := h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	c, found := FromContext(ctx)
+	require.True(t, found)
+	require.Equal(t, Class{Name: "user", MaxSlots: 2, DownloadMultiplier: 1, UploadMultiplier: 1}, c)
+
+	var rctx fasthttp.RequestCtx
+	rctx.SetUserValue("user", "user1")
+	rctx.QueryArgs().Set("class", "vip")
+	hk.handleSetClass(&rctx)
+	require.Equal(t, fasthttp.StatusOK, rctx.Response.StatusCode())
+
+	ctx, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	c, found = FromContext(ctx)
+	require.True(t, found)
+	require.Equal(t, Class{Name: "vip", MaxSlots: -1, MinRatio: 0.1, DownloadMultiplier: 0, UploadMultiplier: 1}, c)
+
+	rctx = fasthttp.RequestCtx{}
+	rctx.SetUserValue("user", "user1")
+	hk.handleGetClass(&rctx)
+	require.Equal(t, fasthttp.StatusOK, rctx.Response.StatusCode())
+	var cr classResponse
+	require.Nil(t, json.Unmarshal(rctx.Response.Body(), &cr))
+	require.NotNil(t, cr.Class)
+	require.Equal(t, "vip", cr.Class.Name)
+
+	rctx = fasthttp.RequestCtx{}
+	rctx.SetUserValue("user", "user1")
+	rctx.QueryArgs().Set("class", "unknown")
+	hk.handleSetClass(&rctx)
+	require.Equal(t, fasthttp.StatusBadRequest, rctx.Response.StatusCode())
+
+	// request without user does not get class
+	ctx, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{}, resp)
+	require.Nil(t, err)
+	_, found = FromContext(ctx)
+	require.False(t, found)
+}
+
+func TestBuild(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	_, err = build(conf.MapConfig{"user_param": "passkey"}, ps)
+	require.ErrorIs(t, err, errNoClasses)
+
+	_, err = build(conf.MapConfig{
+		"user_param":    "passkey",
+		"classes":       []any{map[string]any{"name": "user"}},
+		"default_class": "vip",
+	}, ps)
+	require.ErrorIs(t, err, errUnknownClass)
+}
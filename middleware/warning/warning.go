@@ -0,0 +1,109 @@
+// Package warning implements a Hook that sets warning message
+// in announce response, i.e. if client is outdated or ratio is too low.
+package warning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/freeleech"
+	"github.com/sot-tech/mochi/middleware/userclass"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "warning"
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+var errNoRules = errors.New("neither client_messages nor ratio_message provided")
+
+// Config represents all the values required by this middleware
+// to select warning messages.
+type Config struct {
+	// ClientMessages maps peer ID prefix (i.e. `-TR2`) to message
+	// which should be sent to such clients.
+	ClientMessages map[string]string `cfg:"client_messages"`
+	// MinRatio is the minimal uploaded/downloaded ratio, below which
+	// RatioMessage is sent.
+	MinRatio float64 `cfg:"min_ratio"`
+	// MinDownloaded is the amount of downloaded bytes in current session
+	// after which ratio is checked.
+	MinDownloaded uint64 `cfg:"min_downloaded"`
+	// RatioMessage is the message sent to peers with low ratio.
+	RatioMessage string `cfg:"ratio_message"`
+}
+
+type clientMessage struct {
+	prefix, message string
+}
+
+type hook struct {
+	clients       []clientMessage
+	minRatio      float64
+	minDownloaded uint64
+	ratioMessage  string
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if len(cfg.ClientMessages) == 0 && (len(cfg.RatioMessage) == 0 || cfg.MinRatio <= 0) {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errNoRules)
+	}
+	h := &hook{
+		clients:       make([]clientMessage, 0, len(cfg.ClientMessages)),
+		minRatio:      cfg.MinRatio,
+		minDownloaded: cfg.MinDownloaded,
+		ratioMessage:  cfg.RatioMessage,
+	}
+	for p, m := range cfg.ClientMessages {
+		if len(p) == 0 || len(p) > bittorrent.PeerIDLen {
+			return nil, fmt.Errorf("invalid config for middleware %s: invalid client prefix '%s'", Name, p)
+		}
+		h.clients = append(h.clients, clientMessage{p, m})
+	}
+	// the longest (most specific) prefix should be checked first
+	sort.Slice(h.clients, func(i, j int) bool {
+		return len(h.clients[i].prefix) > len(h.clients[j].prefix)
+	})
+	return h, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	id := req.ID.RawString()
+	for _, c := range h.clients {
+		if strings.HasPrefix(id, c.prefix) {
+			resp.AddWarning(c.message)
+			break
+		}
+	}
+	if len(h.ratioMessage) > 0 {
+		// multipliers are set by freeleech middleware, if it is configured before
+		m := freeleech.FromContext(ctx)
+		up, down := float64(req.Uploaded)*m.Upload, float64(req.Downloaded)*m.Download
+		minRatio := h.minRatio
+		if c, ok := userclass.FromContext(ctx); ok && c.MinRatio > 0 {
+			minRatio = c.MinRatio
+		}
+		if down > 0 && down >= float64(h.minDownloaded) && up/down < minRatio {
+			resp.AddWarning(h.ratioMessage)
+		}
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrape response does not contain warning message.
+	return ctx, nil
+}
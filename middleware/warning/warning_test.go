@@ -0,0 +1,45 @@
+package warning
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"client_messages": map[string]any{"-TR2": "your client is outdated"},
+		"min_ratio":       0.5,
+		"min_downloaded":  100,
+		"ratio_message":   "ratio low",
+	}, nil)
+	require.Nil(t, err)
+
+	cases := []struct {
+		id                   string
+		uploaded, downloaded uint64
+		expected             string
+	}{
+		{"-TR2940-000000000000", 0, 0, "your client is outdated"},
+		{"-TR3000-000000000000", 10, 1000, "ratio low"},
+		{"-TR2940-000000000000", 10, 1000, "your client is outdated; ratio low"},
+		{"-TR3000-000000000000", 10, 50, ""},
+		{"-TR3000-000000000000", 600, 1000, ""},
+	}
+	for _, c := range cases {
+		req := &bittorrent.AnnounceRequest{Uploaded: c.uploaded, Downloaded: c.downloaded}
+		req.ID, err = bittorrent.NewPeerID([]byte(c.id))
+		require.Nil(t, err)
+		resp := new(bittorrent.AnnounceResponse)
+		_, err = h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, c.expected, resp.WarningMessage)
+	}
+
+	_, err = build(conf.MapConfig{"min_ratio": 1}, nil)
+	require.ErrorIs(t, err, errNoRules)
+}
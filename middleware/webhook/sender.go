@@ -0,0 +1,212 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SenderConfig represents all the values required to
+// send events to HTTP endpoint.
+type SenderConfig struct {
+	// URL of endpoint, where to POST events.
+	URL string
+	// Secret key used to sign request body. If empty, requests are not signed.
+	Secret string
+	// BatchSize maximum number of events sent in one request.
+	BatchSize int `cfg:"batch_size"`
+	// FlushInterval maximum time between event occurred and sent.
+	FlushInterval time.Duration `cfg:"flush_interval"`
+	// QueueSize maximum number of events waiting for sending,
+	// new events are dropped if queue is full.
+	QueueSize int `cfg:"queue_size"`
+	// MaxRetries number of attempts to resend batch if endpoint
+	// returned error or non 2xx status.
+	MaxRetries int `cfg:"max_retries"`
+	// RetryDelay initial delay between two retries, doubles on every attempt.
+	RetryDelay time.Duration `cfg:"retry_delay"`
+	// Timeout of single HTTP request.
+	Timeout time.Duration
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg SenderConfig) Validate() (validCfg SenderConfig, err error) {
+	validCfg = cfg
+	if len(cfg.URL) == 0 {
+		err = errURLNotProvided
+		return
+	}
+	if cfg.BatchSize <= 0 {
+		validCfg.BatchSize = defaultBatchSize
+		logger.Warn().
+			Str("name", "BatchSize").
+			Int("provided", cfg.BatchSize).
+			Int("default", validCfg.BatchSize).
+			Msg("falling back to default configuration")
+	}
+	if cfg.FlushInterval <= 0 {
+		validCfg.FlushInterval = defaultFlushInterval
+		logger.Warn().
+			Str("name", "FlushInterval").
+			Dur("provided", cfg.FlushInterval).
+			Dur("default", validCfg.FlushInterval).
+			Msg("falling back to default configuration")
+	}
+	if cfg.QueueSize <= 0 {
+		validCfg.QueueSize = defaultQueueSize
+		logger.Warn().
+			Str("name", "QueueSize").
+			Int("provided", cfg.QueueSize).
+			Int("default", validCfg.QueueSize).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Timeout <= 0 {
+		validCfg.Timeout = defaultTimeout
+		logger.Warn().
+			Str("name", "Timeout").
+			Dur("provided", cfg.Timeout).
+			Dur("default", validCfg.Timeout).
+			Msg("falling back to default configuration")
+	}
+	if cfg.MaxRetries > 0 && cfg.RetryDelay <= 0 {
+		validCfg.RetryDelay = defaultRetryDelay
+		logger.Warn().
+			Str("name", "RetryDelay").
+			Dur("provided", cfg.RetryDelay).
+			Dur("default", validCfg.RetryDelay).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// Sender collects events into batches and sends them to HTTP endpoint
+// in background. May be used by another middleware to send own events.
+type Sender struct {
+	cfg        SenderConfig
+	client     *http.Client
+	queue      chan Event
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+// NewSender creates and starts Sender. Config should be validated.
+func NewSender(cfg SenderConfig) *Sender {
+	s := &Sender{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan Event, cfg.QueueSize),
+		closed: make(chan any),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Push places event into sending queue. Event is dropped if queue is full.
+func (s *Sender) Push(e Event) {
+	select {
+	case s.queue <- e:
+	default:
+		logger.Warn().Str("event", e.Event).Msg("webhook queue is full, dropping event")
+	}
+}
+
+func (s *Sender) run() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.cfg.FlushInterval)
+	defer t.Stop()
+	batch := make([]Event, 0, s.cfg.BatchSize)
+	add := func(e Event) {
+		batch = append(batch, e)
+		if len(batch) >= s.cfg.BatchSize {
+			s.send(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case <-s.closed:
+			for {
+				select {
+				case e := <-s.queue:
+					add(e)
+				default:
+					s.send(batch)
+					return
+				}
+			}
+		case e := <-s.queue:
+			add(e)
+		case <-t.C:
+			s.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *Sender) send(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to serialize webhook events")
+		return
+	}
+	delay := s.cfg.RetryDelay
+	for attempt := 0; ; attempt++ {
+		if err = s.post(body); err == nil || attempt >= s.cfg.MaxRetries {
+			break
+		}
+		logger.Debug().Err(err).Int("attempt", attempt+1).Msg("webhook request failed, retrying")
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err != nil {
+		logger.Error().Err(err).Int("count", len(batch)).Msg("unable to send webhook events")
+	}
+}
+
+func (s *Sender) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.cfg.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(s.cfg.Secret, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns HEX-encoded HMAC-SHA256 signature of body
+func Sign(secret string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Close sends pending events and stops sender
+func (s *Sender) Close() error {
+	s.onceCloser.Do(func() {
+		close(s.closed)
+		s.wg.Wait()
+	})
+	return nil
+}
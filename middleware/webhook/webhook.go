@@ -0,0 +1,186 @@
+// Package webhook implements a Hook that posts batched JSON notifications
+// about announce events to external HTTP endpoint.
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "webhook"
+
+// Event names, which may be provided in configuration
+const (
+	// EventCompleted is sent when peer finished downloading
+	EventCompleted = "completed"
+	// EventNewTorrent is sent when the first peer joined swarm
+	EventNewTorrent = "new_torrent"
+	// EventSwarmEmptied is sent when the last peer left swarm
+	EventSwarmEmptied = "swarm_emptied"
+	// EventRejected is sent when announce was rejected by any pre hook
+	EventRejected = "rejected"
+	// EventReseed is sent by swarm health middleware
+	// when swarm has leechers, but no seeders
+	EventReseed = "reseed"
+	// EventTooManyAddresses is sent by session middleware
+	// when user announced from too many addresses simultaneously
+	EventTooManyAddresses = "too_many_addresses"
+)
+
+// SignatureHeader is the HTTP header which contains HEX-encoded
+// HMAC-SHA256 signature of request body
+const SignatureHeader = "X-Mochi-Signature"
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = 5 * time.Second
+	defaultQueueSize     = 10000
+	defaultTimeout       = 5 * time.Second
+	defaultRetryDelay    = time.Second
+)
+
+var (
+	logger = log.NewLogger("middleware/webhook")
+
+	errURLNotProvided = errors.New("url not provided")
+	errNoEvents       = errors.New("events not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents all the values required by this middleware
+// to send webhooks.
+type Config struct {
+	SenderConfig
+	// Events list of event names to send.
+	Events []string
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if validCfg.SenderConfig, err = cfg.SenderConfig.Validate(); err != nil {
+		return
+	}
+	if len(cfg.Events) == 0 {
+		err = errNoEvents
+		return
+	}
+	for _, e := range cfg.Events {
+		switch e {
+		case EventCompleted, EventNewTorrent, EventSwarmEmptied, EventRejected:
+		default:
+			err = fmt.Errorf("unknown event '%s'", e)
+			return
+		}
+	}
+	return
+}
+
+// Event is the single notification sent to endpoint
+type Event struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	InfoHash   string    `json:"info_hash"`
+	PeerID     string    `json:"peer_id"`
+	Addr       string    `json:"addr"`
+	Port       uint16    `json:"port"`
+	Uploaded   uint64    `json:"uploaded"`
+	Downloaded uint64    `json:"downloaded"`
+	Left       uint64    `json:"left"`
+	Reason     string    `json:"reason,omitempty"`
+	Seeders    []string  `json:"seeders,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Addresses  []string  `json:"addresses,omitempty"`
+	// RequestID identifies announce, which produced event
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewEvent creates Event with specified name and fills
+// fields from announce request and its context
+func NewEvent(ctx context.Context, name string, req *bittorrent.AnnounceRequest) Event {
+	return Event{
+		Event:      name,
+		Time:       time.Now(),
+		InfoHash:   req.InfoHash.String(),
+		PeerID:     req.ID.String(),
+		Addr:       privacy.String(req.GetFirst()),
+		Port:       req.Port,
+		Uploaded:   req.Uploaded,
+		Downloaded: req.Downloaded,
+		Left:       req.Left,
+		RequestID:  bittorrent.RequestID(ctx),
+	}
+}
+
+type hook struct {
+	*Sender
+	events map[string]bool
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{
+		Sender: NewSender(cfg.SenderConfig),
+		events: make(map[string]bool, len(cfg.Events)),
+	}
+	for _, e := range cfg.Events {
+		h.events[e] = true
+	}
+	return h, nil
+}
+
+// HandleAnnounce detects completion of torrent.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if middleware.DryRun(ctx) {
+		return ctx, nil
+	}
+	if req.Event == bittorrent.Completed && h.events[EventCompleted] {
+		h.Push(NewEvent(ctx, EventCompleted, req))
+	}
+	return ctx, nil
+}
+
+// SwarmChanged implements middleware.SwarmObserver
+func (h *hook) SwarmChanged(ctx context.Context, req *bittorrent.AnnounceRequest, change middleware.SwarmChange) {
+	switch {
+	case change == middleware.SwarmCreated && h.events[EventNewTorrent]:
+		h.Push(NewEvent(ctx, EventNewTorrent, req))
+	case change == middleware.SwarmEmptied && h.events[EventSwarmEmptied]:
+		h.Push(NewEvent(ctx, EventSwarmEmptied, req))
+	}
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes do not produce events.
+	return ctx, nil
+}
+
+// AnnounceRejected implements middleware.RejectObserver
+func (h *hook) AnnounceRejected(ctx context.Context, req *bittorrent.AnnounceRequest, err error) {
+	if h.events[EventRejected] {
+		e := NewEvent(ctx, EventRejected, req)
+		e.Reason = err.Error()
+		h.Push(e)
+	}
+}
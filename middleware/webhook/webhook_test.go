@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+)
+
+func TestHandleAnnounce(t *testing.T) {
+	const secret = "secret"
+	var mu sync.Mutex
+	var received []Event
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, Sign(secret, body), r.Header.Get(SignatureHeader))
+		var events []Event
+		require.Nil(t, json.Unmarshal(body, &events))
+		received = append(received, events...)
+	}))
+	defer srv.Close()
+
+	h, err := build(conf.MapConfig{
+		"url":         srv.URL,
+		"secret":      secret,
+		"events":      []string{EventCompleted, EventSwarmEmptied, EventRejected},
+		"max_retries": 2,
+		"retry_delay": "1ms",
+	}, nil)
+	require.Nil(t, err)
+
+	ctx := bittorrent.WithRequestID(context.Background(), "request")
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: "11111111111111111111",
+		Event:    bittorrent.Completed,
+		RequestPeer: bittorrent.RequestPeer{
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+	}
+	_, err = h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{Complete: 1})
+	require.Nil(t, err)
+	req.Event = bittorrent.Started
+	_, err = h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{Complete: 1})
+	require.Nil(t, err)
+	h.(*hook).SwarmChanged(ctx, req, middleware.SwarmCreated)
+	h.(*hook).SwarmChanged(ctx, req, middleware.SwarmEmptied)
+	h.(*hook).AnnounceRejected(ctx, req, errors.New("some reason"))
+
+	require.Nil(t, h.(*hook).Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 3)
+	require.Equal(t, EventCompleted, received[0].Event)
+	require.Equal(t, "request", received[0].RequestID)
+	require.Equal(t, EventSwarmEmptied, received[1].Event)
+	require.Equal(t, EventRejected, received[2].Event)
+	require.Equal(t, "some reason", received[2].Reason)
+	require.Equal(t, "1.2.3.4", received[2].Addr)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{"url": "http://localhost", "events": []string{"unknown"}}, nil)
+	require.NotNil(t, err)
+	_, err = build(conf.MapConfig{"events": []string{EventCompleted}}, nil)
+	require.ErrorIs(t, err, errURLNotProvided)
+}
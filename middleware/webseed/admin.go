@@ -0,0 +1,74 @@
+package webseed
+
+import (
+	"encoding/json"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/admin"
+)
+
+// infoHash parses path parameter (HEX-encoded info hash)
+func infoHash(ctx *fasthttp.RequestCtx) (bittorrent.InfoHash, bool) {
+	s, _ := ctx.UserValue("infohash").(string)
+	ih, err := bittorrent.NewInfoHashString(s)
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return ih, false
+	}
+	return ih, true
+}
+
+func (h *hook) handleGetURLs(ctx *fasthttp.RequestCtx) {
+	ih, ok := infoHash(ctx)
+	if !ok {
+		return
+	}
+	urls, err := h.URLs(ctx, ih)
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	if urls == nil {
+		urls = []string{}
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, urls)
+}
+
+// handlePutURLs replaces web seeds with JSON array provided in body
+func (h *hook) handlePutURLs(ctx *fasthttp.RequestCtx) {
+	ih, ok := infoHash(ctx)
+	if !ok {
+		return
+	}
+	var urls []string
+	if err := json.Unmarshal(ctx.PostBody(), &urls); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	if err := validateURLs(urls); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	if err := h.putURLs(ctx, ih, urls); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	if urls == nil {
+		urls = []string{}
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, urls)
+}
+
+func (h *hook) handleDeleteURLs(ctx *fasthttp.RequestCtx) {
+	ih, ok := infoHash(ctx)
+	if !ok {
+		return
+	}
+	if err := h.putURLs(ctx, ih, nil); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
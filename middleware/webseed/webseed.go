@@ -0,0 +1,270 @@
+// Package webseed implements a Hook that adds HTTP web seed URLs (BEP 19)
+// registered for torrent to announce responses as `url-list`.
+// URLs are stored in DataStorage and may be modified through admin API.
+package webseed
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "web seed"
+
+const (
+	// DefaultStorageCtx is the name of storage context where URLs are stored
+	DefaultStorageCtx = "MW_WEBSEED"
+	defaultCacheTTL   = time.Minute
+	defaultCacheSize  = 10000
+)
+
+var (
+	logger = log.NewLogger("middleware/webseed")
+
+	errInvalidURL         = errors.New("web seed must be absolute http or https URL")
+	errStorageNotProvided = errors.New("storage not provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Torrent holds web seeds of specific torrent
+type Torrent struct {
+	// InfoHash HEX-encoded info hash
+	InfoHash string `cfg:"info_hash"`
+	// URLs of web seeds
+	URLs []string `cfg:"urls"`
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Torrents static list of web seeds, put into storage on start.
+	Torrents []Torrent `cfg:"torrents"`
+	// StorageCtx is the name of storage context where URLs are stored.
+	StorageCtx string `cfg:"storage_ctx"`
+	// IncludeSeeders if true, web seeds are sent to seeders too.
+	IncludeSeeders bool `cfg:"include_seeders"`
+	// CacheTTL is the period while URLs (or their absence) loaded
+	// from storage are cached in memory, negative value disables cache.
+	CacheTTL time.Duration `cfg:"cache_ttl"`
+	// CacheSize is the maximum number of cached torrents.
+	CacheSize int `cfg:"cache_size"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	for _, t := range cfg.Torrents {
+		if err = validateURLs(t.URLs); err != nil {
+			return
+		}
+	}
+	if len(cfg.StorageCtx) == 0 {
+		validCfg.StorageCtx = DefaultStorageCtx
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", validCfg.StorageCtx).
+			Msg("falling back to default configuration")
+	}
+	if cfg.CacheTTL == 0 {
+		validCfg.CacheTTL = defaultCacheTTL
+		logger.Warn().
+			Str("name", "CacheTTL").
+			Dur("provided", cfg.CacheTTL).
+			Dur("default", validCfg.CacheTTL).
+			Msg("falling back to default configuration")
+	}
+	if cfg.CacheSize <= 0 {
+		validCfg.CacheSize = defaultCacheSize
+		logger.Warn().
+			Str("name", "CacheSize").
+			Int("provided", cfg.CacheSize).
+			Int("default", validCfg.CacheSize).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+func validateURLs(urls []string) error {
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("%s: %w", s, errInvalidURL)
+		}
+	}
+	return nil
+}
+
+// storageKey returns key of torrent's web seeds
+func storageKey(ih bittorrent.InfoHash) string {
+	return ih.TruncateV1().RawString()
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	var err error
+	if err = config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if st == nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, errStorageNotProvided)
+	}
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for middleware %s: %w", Name, err)
+	}
+	h := &hook{cfg: cfg, storage: st, entries: make(map[string]*list.Element), lru: list.New()}
+	for _, t := range cfg.Torrents {
+		var ih bittorrent.InfoHash
+		if ih, err = bittorrent.NewInfoHashString(t.InfoHash); err != nil {
+			return nil, fmt.Errorf("invalid config for middleware %s: %s: %w", Name, t.InfoHash, err)
+		}
+		if err = h.initURLs(context.Background(), ih, t.URLs); err != nil {
+			return nil, fmt.Errorf("middleware %s: unable to put initial data: %w", Name, err)
+		}
+	}
+	admin.Handle(http.MethodGet, "/webseeds/{infohash}", h.handleGetURLs)
+	admin.HandleModerated(http.MethodPost, "/webseeds/{infohash}", h.handlePutURLs)
+	admin.HandleModerated(http.MethodDelete, "/webseeds/{infohash}", h.handleDeleteURLs)
+	return h, nil
+}
+
+type cacheEntry struct {
+	key   string
+	urls  []string
+	until int64
+}
+
+type hook struct {
+	cfg     Config
+	storage storage.DataStorage
+
+	entries map[string]*list.Element
+	// lru is the list of cached entries, the most recently used is at front
+	lru *list.List
+	sync.Mutex
+}
+
+// URLs returns web seeds of torrent
+func (h *hook) URLs(ctx context.Context, ih bittorrent.InfoHash) (urls []string, err error) {
+	var b []byte
+	if b, err = h.storage.Load(ctx, h.cfg.StorageCtx, storageKey(ih)); err == nil && len(b) > 0 {
+		err = json.Unmarshal(b, &urls)
+	}
+	return
+}
+
+// cachedURLs returns web seeds of torrent from cache or loads them from storage
+func (h *hook) cachedURLs(ctx context.Context, ih bittorrent.InfoHash) ([]string, error) {
+	if h.cfg.CacheTTL < 0 {
+		return h.URLs(ctx, ih)
+	}
+	key, now := storageKey(ih), timecache.NowUnixNano()
+	h.Lock()
+	if el, exists := h.entries[key]; exists {
+		if e := el.Value.(*cacheEntry); e.until > now {
+			h.lru.MoveToFront(el)
+			h.Unlock()
+			return e.urls, nil
+		}
+	}
+	h.Unlock()
+	urls, err := h.URLs(ctx, ih)
+	if err == nil {
+		h.cache(key, urls, now)
+	}
+	return urls, err
+}
+
+func (h *hook) cache(key string, urls []string, now int64) {
+	if h.cfg.CacheTTL < 0 {
+		return
+	}
+	e := &cacheEntry{key: key, urls: urls, until: now + int64(h.cfg.CacheTTL)}
+	h.Lock()
+	defer h.Unlock()
+	if el, exists := h.entries[key]; exists {
+		el.Value = e
+		h.lru.MoveToFront(el)
+		return
+	}
+	if h.lru.Len() >= h.cfg.CacheSize {
+		oldest := h.lru.Back()
+		delete(h.entries, oldest.Value.(*cacheEntry).key)
+		h.lru.Remove(oldest)
+	}
+	h.entries[key] = h.lru.PushFront(e)
+}
+
+func (h *hook) putURLs(ctx context.Context, ih bittorrent.InfoHash, urls []string) (err error) {
+	if len(urls) == 0 {
+		err = h.storage.Delete(ctx, h.cfg.StorageCtx, storageKey(ih))
+	} else {
+		var b []byte
+		if b, err = json.Marshal(urls); err == nil {
+			err = h.storage.Put(ctx, h.cfg.StorageCtx, storage.Entry{Key: storageKey(ih), Value: b})
+		}
+	}
+	if err == nil {
+		h.cache(storageKey(ih), urls, timecache.NowUnixNano())
+	}
+	return
+}
+
+// initURLs puts configured web seeds of torrent if there are no stored ones,
+// so URLs modified through admin API are not replaced on start
+func (h *hook) initURLs(ctx context.Context, ih bittorrent.InfoHash, urls []string) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(urls)
+	if err != nil {
+		return err
+	}
+	return storage.Update(ctx, h.storage, h.cfg.StorageCtx, storageKey(ih), func(old []byte) ([]byte, error) {
+		if len(old) > 0 {
+			return old, nil
+		}
+		return b, nil
+	})
+}
+
+// HandleAnnounce adds web seeds of torrent to response.
+// Storage errors are logged and do not reject announce.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Left == 0 && !h.cfg.IncludeSeeders {
+		return ctx, nil
+	}
+	urls, err := h.cachedURLs(ctx, req.InfoHash)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", req.InfoHash).Msg("unable to load web seeds")
+		return ctx, nil
+	}
+	resp.WebSeeds = append(resp.WebSeeds, urls...)
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't contain web seeds.
+	return ctx, nil
+}
@@ -0,0 +1,157 @@
+package webseed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+const (
+	ih1 = "1111111111111111111111111111111111111111"
+	ih2 = "2222222222222222222222222222222222222222"
+)
+
+func newRequest(ih string, left uint64) *bittorrent.AnnounceRequest {
+	h, _ := bittorrent.NewInfoHashString(ih)
+	return &bittorrent.AnnounceRequest{InfoHash: h, Left: left}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{
+		"torrents": []any{
+			map[string]any{"info_hash": ih1, "urls": []any{"https://example.com/files/"}},
+		},
+	}, ps)
+	require.Nil(t, err)
+
+	resp := new(bittorrent.AnnounceResponse)
+	_, err = h.HandleAnnounce(context.Background(), newRequest(ih1, 1), resp)
+	require.Nil(t, err)
+	require.Equal(t, []string{"https://example.com/files/"}, resp.WebSeeds)
+
+	// seeders and other torrents
+	for _, req := range []*bittorrent.AnnounceRequest{newRequest(ih1, 0), newRequest(ih2, 1)} {
+		resp = new(bittorrent.AnnounceResponse)
+		_, err = h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Empty(t, resp.WebSeeds)
+	}
+
+	_, err = build(conf.MapConfig{
+		"torrents": []any{map[string]any{"info_hash": ih1, "urls": []any{"ftp://example.com/"}}},
+	}, ps)
+	require.ErrorIs(t, err, errInvalidURL)
+
+	_, err = build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, errStorageNotProvided)
+}
+
+func TestInitURLs(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ih, _ := bittorrent.NewInfoHashString(ih1)
+	h, err := build(conf.MapConfig{}, ps)
+	require.Nil(t, err)
+	require.Nil(t, h.(*hook).putURLs(context.Background(), ih, []string{"http://example.com/admin"}))
+
+	h, err = build(conf.MapConfig{
+		"torrents": []any{
+			map[string]any{"info_hash": ih1, "urls": []any{"https://example.com/files/"}},
+		},
+	}, ps)
+	require.Nil(t, err)
+	urls, err := h.(*hook).URLs(context.Background(), ih)
+	require.Nil(t, err)
+	require.Equal(t, []string{"http://example.com/admin"}, urls)
+}
+
+func TestCache(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{"cache_size": 1}, ps)
+	require.Nil(t, err)
+	hk := h.(*hook)
+	ih, _ := bittorrent.NewInfoHashString(ih1)
+
+	resp := new(bittorrent.AnnounceResponse)
+	_, err = h.HandleAnnounce(context.Background(), newRequest(ih1, 1), resp)
+	require.Nil(t, err)
+	require.Empty(t, resp.WebSeeds)
+
+	// modification by other instance is not visible until cache expires
+	other, err := build(conf.MapConfig{}, ps)
+	require.Nil(t, err)
+	require.Nil(t, other.(*hook).putURLs(context.Background(), ih, []string{"http://example.com/a"}))
+	resp = new(bittorrent.AnnounceResponse)
+	_, err = h.HandleAnnounce(context.Background(), newRequest(ih1, 1), resp)
+	require.Nil(t, err)
+	require.Empty(t, resp.WebSeeds)
+
+	// own modification is visible immediately
+	require.Nil(t, hk.putURLs(context.Background(), ih, []string{"http://example.com/b"}))
+	resp = new(bittorrent.AnnounceResponse)
+	_, err = h.HandleAnnounce(context.Background(), newRequest(ih1, 1), resp)
+	require.Nil(t, err)
+	require.Equal(t, []string{"http://example.com/b"}, resp.WebSeeds)
+
+	// the least recently used entry is evicted
+	_, err = h.HandleAnnounce(context.Background(), newRequest(ih2, 1), new(bittorrent.AnnounceResponse))
+	require.Nil(t, err)
+	require.Equal(t, 1, hk.lru.Len())
+	_, cached := hk.entries[storageKey(ih)]
+	require.False(t, cached)
+}
+
+func TestAdmin(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	h, err := build(conf.MapConfig{}, ps)
+	require.Nil(t, err)
+	hk := h.(*hook)
+
+	var rctx fasthttp.RequestCtx
+	rctx.SetUserValue("infohash", ih2)
+	rctx.Request.SetBody([]byte(`["http://example.com/a"]`))
+	hk.handlePutURLs(&rctx)
+	require.Equal(t, fasthttp.StatusOK, rctx.Response.StatusCode())
+
+	ih, _ := bittorrent.NewInfoHashString(ih2)
+	urls, err := hk.URLs(context.Background(), ih)
+	require.Nil(t, err)
+	require.Equal(t, []string{"http://example.com/a"}, urls)
+
+	rctx = fasthttp.RequestCtx{}
+	rctx.SetUserValue("infohash", ih2)
+	rctx.Request.SetBody([]byte(`["example.com/a"]`))
+	hk.handlePutURLs(&rctx)
+	require.Equal(t, fasthttp.StatusBadRequest, rctx.Response.StatusCode())
+
+	rctx = fasthttp.RequestCtx{}
+	rctx.SetUserValue("infohash", ih2)
+	hk.handleDeleteURLs(&rctx)
+	require.Equal(t, fasthttp.StatusNoContent, rctx.Response.StatusCode())
+	urls, err = hk.URLs(context.Background(), ih)
+	require.Nil(t, err)
+	require.Empty(t, urls)
+
+	rctx = fasthttp.RequestCtx{}
+	rctx.SetUserValue("infohash", "invalid")
+	hk.handleGetURLs(&rctx)
+	require.Equal(t, fasthttp.StatusBadRequest, rctx.Response.StatusCode())
+}
@@ -0,0 +1,426 @@
+package admin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/storage"
+)
+
+const (
+	// AuditStorageCtx is the name of storage context where audit records are stored
+	AuditStorageCtx = "ADMIN_AUDIT"
+	// auditSeqKey is the key of the last used record number in AuditStorageCtx
+	auditSeqKey = "seq"
+
+	defaultAuditMaxValueSize = 64 << 10
+	defaultAuditQueryLimit   = 100
+	maxAuditQueryLimit       = 1000
+	// maxAuditScan is the maximum number of records in storage
+	// checked by single query
+	maxAuditScan = 10000
+)
+
+var (
+	auditLog atomic.Pointer[AuditLog]
+
+	errInvalidLimit = errors.New("limit must be positive")
+	errAuditClosed  = errors.New("audit log is closed")
+)
+
+type auditValuesKey struct{}
+
+type auditValues struct {
+	before, after any
+}
+
+// AuditConfig configures log of admin API mutations.
+// Log is disabled if neither File nor Storage is set.
+type AuditConfig struct {
+	// File is the path of file, where records are appended as JSON lines
+	File string `yaml:"file"`
+	// Storage enables storing of records in tracker's storage
+	Storage bool `yaml:"storage"`
+	// ActorHeader is the name of request header, which identifies
+	// initiator of mutation (i.e. set by authenticating proxy).
+	// Remote address is used if header is not set or not provided.
+	// Ignored if request is authenticated (see AuthConfig).
+	ActorHeader string `yaml:"actor_header"`
+	// MaxValueSize is the maximum size of recorded request, before
+	// and after values in bytes, larger values are omitted
+	MaxValueSize int `yaml:"max_value_size"`
+}
+
+// Enabled returns true if any destination of records is set
+func (c AuditConfig) Enabled() bool {
+	return len(c.File) > 0 || c.Storage
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (c AuditConfig) Validate() (validCfg AuditConfig) {
+	validCfg = c
+	if c.MaxValueSize <= 0 {
+		validCfg.MaxValueSize = defaultAuditMaxValueSize
+		logger.Warn().
+			Str("name", "Audit.MaxValueSize").
+			Int("provided", c.MaxValueSize).
+			Int("default", validCfg.MaxValueSize).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// AuditRecord is the record of admin API mutation
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Query  string    `json:"query,omitempty"`
+	Status int       `json:"status"`
+	// Request is JSON body of request
+	Request json.RawMessage `json:"request,omitempty"`
+	// Before is the state of modified object before mutation,
+	// provided by handler with SetAuditValues
+	Before json.RawMessage `json:"before,omitempty"`
+	// After is the state of modified object after mutation,
+	// provided by handler or JSON body of successful response
+	After json.RawMessage `json:"after,omitempty"`
+	// Error is the error message of failed request
+	Error string `json:"error,omitempty"`
+	// Truncated is set if any of values exceeded AuditConfig.MaxValueSize
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// AuditFilter selects records returned by AuditLog.Query
+type AuditFilter struct {
+	Actor string
+	// Path is the prefix of request path
+	Path string
+	// Since is the time of the oldest returned record
+	Since time.Time
+	Limit int
+}
+
+func (f AuditFilter) match(r AuditRecord) bool {
+	return (len(f.Actor) == 0 || r.Actor == f.Actor) &&
+		strings.HasPrefix(r.Path, f.Path) &&
+		!r.Time.Before(f.Since)
+}
+
+// AuditLog is the append-only log of admin API mutations,
+// records are written to file and/or DataStorage.
+type AuditLog struct {
+	cfg AuditConfig
+	mu  sync.Mutex
+	f   *os.File
+	ds  storage.DataStorage
+	seq uint64
+}
+
+// ConfigureAudit creates AuditLog with validated cfg and sets it
+// as log of all audited handlers (see Handle). Records are stored
+// in ds if AuditConfig.Storage is set. Returns nil log if cfg
+// is not enabled. Log must be closed after admin server.
+func ConfigureAudit(cfg AuditConfig, ds storage.DataStorage) (l *AuditLog, err error) {
+	if !cfg.Enabled() {
+		auditLog.Store(nil)
+		return
+	}
+	l = &AuditLog{cfg: cfg.Validate()}
+	if len(cfg.File) > 0 {
+		if l.f, err = os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600); err != nil {
+			return nil, fmt.Errorf("unable to open audit log: %w", err)
+		}
+	}
+	if cfg.Storage {
+		if ds == nil {
+			_ = l.Close()
+			return nil, errors.New("audit log storage not provided")
+		}
+		if !ds.Preservable() {
+			logger.Warn().Msg("audit log storage is not preservable, records will be lost after restart")
+		}
+		if l.seq, err = loadSeq(context.Background(), ds); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		l.ds = ds
+	}
+	auditLog.Store(l)
+	HandleUnaudited(http.MethodGet, "/audit_log", handleAuditLog)
+	logger.Debug().Str("file", cfg.File).Bool("storage", cfg.Storage).Msg("audit log configured")
+	return
+}
+
+func loadSeq(ctx context.Context, ds storage.DataStorage) (uint64, error) {
+	b, err := ds.Load(ctx, AuditStorageCtx, auditSeqKey)
+	if err != nil || len(b) == 0 {
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
+
+// Actor returns identifier of initiator of request: name of authenticated
+// credential, value of AuditConfig.ActorHeader if provided or remote address
+func Actor(ctx *fasthttp.RequestCtx) string {
+	if id, ok := ctx.UserValue(identityKey{}).(identity); ok {
+		return id.name
+	}
+	if l := auditLog.Load(); l != nil && len(l.cfg.ActorHeader) > 0 {
+		if v := ctx.Request.Header.Peek(l.cfg.ActorHeader); len(v) > 0 {
+			return string(v)
+		}
+	}
+	return ctx.RemoteAddr().String()
+}
+
+// SetAuditValues sets state of object modified by request
+// before and after mutation. If not called, JSON body
+// of successful response is recorded as after value.
+func SetAuditValues(ctx *fasthttp.RequestCtx, before, after any) {
+	ctx.SetUserValue(auditValuesKey{}, auditValues{before: before, after: after})
+}
+
+// audited wraps h, so every request processed by it is recorded to audit log
+func audited(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		h(ctx)
+		if l := auditLog.Load(); l != nil {
+			if err := l.Append(ctx, l.newRecord(ctx)); err != nil {
+				logger.Error().Err(err).Bytes("path", ctx.Path()).Msg("unable to write audit record")
+			}
+		}
+	}
+}
+
+// value returns b if it is valid non-null JSON, which fits AuditConfig.MaxValueSize
+func (l *AuditLog) value(b []byte, truncated *bool) json.RawMessage {
+	if b = bytes.TrimSpace(b); len(b) == 0 || string(b) == "null" || !json.Valid(b) {
+		return nil
+	}
+	if len(b) > l.cfg.MaxValueSize {
+		*truncated = true
+		return nil
+	}
+	return slices.Clone(b)
+}
+
+func (l *AuditLog) newRecord(ctx *fasthttp.RequestCtx) (r AuditRecord) {
+	r = AuditRecord{
+		Time:   time.Now().UTC(),
+		Actor:  Actor(ctx),
+		Method: string(ctx.Method()),
+		Path:   string(ctx.Path()),
+		Query:  ctx.QueryArgs().String(),
+		Status: ctx.Response.StatusCode(),
+	}
+	r.Request = l.value(ctx.PostBody(), &r.Truncated)
+	body := ctx.Response.Body()
+	if r.Status >= fasthttp.StatusBadRequest {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil {
+			r.Error = e.Error
+		}
+		return
+	}
+	if v, ok := ctx.UserValue(auditValuesKey{}).(auditValues); ok {
+		for _, p := range []struct {
+			v   any
+			out *json.RawMessage
+		}{{v.before, &r.Before}, {v.after, &r.After}} {
+			if b, err := json.Marshal(p.v); err == nil {
+				*p.out = l.value(b, &r.Truncated)
+			}
+		}
+	} else {
+		r.After = l.value(body, &r.Truncated)
+	}
+	return
+}
+
+// Append writes record to file and storage
+func (l *AuditLog) Append(ctx context.Context, r AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil && l.ds == nil {
+		return errAuditClosed
+	}
+	if l.f != nil {
+		if _, err = l.f.Write(append(b, '\n')); err != nil {
+			err = fmt.Errorf("unable to write audit log file: %w", err)
+		}
+	}
+	if l.ds != nil {
+		err = errors.Join(err, l.store(ctx, b))
+	}
+	return err
+}
+
+// store reserves the next number by atomic increment of stored sequence
+// (see storage.Update), so instances, which share the same storage,
+// do not overwrite records of each other, and puts record with it.
+// Must be called with locked mu.
+func (l *AuditLog) store(ctx context.Context, b []byte) error {
+	var seq uint64
+	err := storage.Update(ctx, l.ds, AuditStorageCtx, auditSeqKey, func(old []byte) ([]byte, error) {
+		seq = l.seq
+		if len(old) > 0 {
+			stored, err := strconv.ParseUint(string(old), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			seq = max(seq, stored)
+		}
+		seq++
+		return []byte(strconv.FormatUint(seq, 10)), nil
+	})
+	if err == nil {
+		err = l.ds.Put(ctx, AuditStorageCtx, storage.Entry{Key: strconv.FormatUint(seq, 10), Value: b})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to store audit record: %w", err)
+	}
+	l.seq = seq
+	return nil
+}
+
+// Query returns records matching filter, newest first.
+// Records are read from file if it is configured, otherwise from storage.
+func (l *AuditLog) Query(ctx context.Context, f AuditFilter) ([]AuditRecord, error) {
+	if f.Limit <= 0 {
+		f.Limit = defaultAuditQueryLimit
+	}
+	f.Limit = min(f.Limit, maxAuditQueryLimit)
+	if len(l.cfg.File) > 0 {
+		return l.queryFile(f)
+	}
+	return l.queryStorage(ctx, f)
+}
+
+func (l *AuditLog) queryFile(f AuditFilter) ([]AuditRecord, error) {
+	file, err := os.Open(l.cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	out := make([]AuditRecord, 0, f.Limit)
+	s := bufio.NewScanner(file)
+	// single record contains up to 3 values and metadata
+	s.Buffer(make([]byte, 0, 4096), 3*l.cfg.MaxValueSize+64<<10)
+	for s.Scan() {
+		var r AuditRecord
+		if err = json.Unmarshal(s.Bytes(), &r); err != nil || !f.match(r) {
+			continue
+		}
+		if len(out) == f.Limit {
+			out = slices.Delete(out, 0, 1)
+		}
+		out = append(out, r)
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(out)
+	return out, nil
+}
+
+func (l *AuditLog) queryStorage(ctx context.Context, f AuditFilter) ([]AuditRecord, error) {
+	l.mu.Lock()
+	ds := l.ds
+	l.mu.Unlock()
+	if ds == nil {
+		return nil, errAuditClosed
+	}
+	// records may be added by other instances
+	seq, err := loadSeq(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]AuditRecord, 0, f.Limit)
+	for i := 0; seq > 0 && i < maxAuditScan && len(out) < f.Limit; seq, i = seq-1, i+1 {
+		b, err := ds.Load(ctx, AuditStorageCtx, strconv.FormatUint(seq, 10))
+		if err != nil {
+			return nil, err
+		}
+		var r AuditRecord
+		if len(b) == 0 || json.Unmarshal(b, &r) != nil {
+			continue
+		}
+		if r.Time.Before(f.Since) {
+			break
+		}
+		if f.match(r) {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// Close closes audit log file and unsets log of audited handlers
+func (l *AuditLog) Close() (err error) {
+	auditLog.CompareAndSwap(l, nil)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		err = l.f.Close()
+		l.f = nil
+	}
+	l.ds = nil
+	return
+}
+
+// handleAuditLog returns records filtered by `actor`, `path` (prefix),
+// `since` (RFC 3339 time) and `limit` query arguments
+func handleAuditLog(ctx *fasthttp.RequestCtx) {
+	l := auditLog.Load()
+	if l == nil {
+		WriteError(ctx, fasthttp.StatusNotFound, errAuditClosed)
+		return
+	}
+	args := ctx.QueryArgs()
+	f := AuditFilter{Actor: string(args.Peek("actor")), Path: string(args.Peek("path"))}
+	var err error
+	if v := args.Peek("since"); len(v) > 0 {
+		if f.Since, err = time.Parse(time.RFC3339, string(v)); err != nil {
+			WriteError(ctx, fasthttp.StatusBadRequest, err)
+			return
+		}
+	}
+	if v := args.Peek("limit"); len(v) > 0 {
+		if f.Limit, err = strconv.Atoi(string(v)); err == nil && f.Limit <= 0 {
+			err = errInvalidLimit
+		}
+		if err != nil {
+			WriteError(ctx, fasthttp.StatusBadRequest, err)
+			return
+		}
+	}
+	records, err := l.Query(ctx, f)
+	if err != nil {
+		WriteError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	WriteJSON(ctx, fasthttp.StatusOK, records)
+}
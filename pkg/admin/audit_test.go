@@ -0,0 +1,154 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/conf"
+	sm "github.com/sot-tech/mochi/storage/memory"
+)
+
+func request(h fasthttp.RequestHandler, method, uri, body string, headers ...string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBodyString(body)
+	for i := 0; i+1 < len(headers); i += 2 {
+		ctx.Request.Header.Set(headers[i], headers[i+1])
+	}
+	h(ctx)
+	return ctx
+}
+
+func TestAuditLog(t *testing.T) {
+	ds, err := sm.Builder{}.NewDataStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ds.Close()
+	file := filepath.Join(t.TempDir(), "audit.log")
+	cfg := AuditConfig{File: file, Storage: true, ActorHeader: "X-Actor"}
+
+	l, err := ConfigureAudit(cfg, ds)
+	require.Nil(t, err)
+	require.NotNil(t, l)
+
+	set := audited(func(ctx *fasthttp.RequestCtx) {
+		SetAuditValues(ctx, map[string]int{"points": 1}, map[string]int{"points": 2})
+		WriteJSON(ctx, fasthttp.StatusOK, map[string]int{"points": 2})
+	})
+	plain := audited(func(ctx *fasthttp.RequestCtx) {
+		WriteJSON(ctx, fasthttp.StatusOK, map[string]string{"class": "vip"})
+	})
+	failed := audited(func(ctx *fasthttp.RequestCtx) {
+		WriteError(ctx, fasthttp.StatusBadRequest, errors.New("invalid points"))
+	})
+	request(set, http.MethodPost, "/bonus/user?points=2", "", "X-Actor", "alice")
+	request(plain, http.MethodPost, "/class/user", `{"class": "vip"}`)
+	request(failed, http.MethodPost, "/bonus/user?points=x", "", "X-Actor", "alice")
+	require.Nil(t, l.Close())
+
+	// records are restored from file and storage after restart
+	l, err = ConfigureAudit(cfg, ds)
+	require.Nil(t, err)
+	defer l.Close()
+	cfg.File = ""
+	fromStorage := &AuditLog{cfg: cfg.Validate(), ds: ds}
+	for _, ql := range []*AuditLog{l, fromStorage} {
+		records, err := ql.Query(context.Background(), AuditFilter{})
+		require.Nil(t, err)
+		require.Len(t, records, 3)
+
+		r := records[0]
+		require.Equal(t, "alice", r.Actor)
+		require.Equal(t, fasthttp.StatusBadRequest, r.Status)
+		require.Equal(t, "invalid points", r.Error)
+		require.Empty(t, r.After)
+
+		r = records[1]
+		require.Equal(t, "/class/user", r.Path)
+		require.NotEqual(t, "alice", r.Actor)
+		require.JSONEq(t, `{"class": "vip"}`, string(r.Request))
+		require.Empty(t, r.Before)
+		require.JSONEq(t, `{"class": "vip"}`, string(r.After))
+
+		r = records[2]
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/bonus/user", r.Path)
+		require.Equal(t, "points=2", r.Query)
+		require.JSONEq(t, `{"points": 1}`, string(r.Before))
+		require.JSONEq(t, `{"points": 2}`, string(r.After))
+
+		records, err = ql.Query(context.Background(), AuditFilter{Actor: "alice", Path: "/bonus", Limit: 1})
+		require.Nil(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, fasthttp.StatusBadRequest, records[0].Status)
+
+		records, err = ql.Query(context.Background(), AuditFilter{Since: time.Now().Add(time.Hour)})
+		require.Nil(t, err)
+		require.Empty(t, records)
+	}
+
+	ctx := request(handleAuditLog, http.MethodGet, "/audit_log?path=/class", "")
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	var records []AuditRecord
+	require.Nil(t, json.Unmarshal(ctx.Response.Body(), &records))
+	require.Len(t, records, 1)
+	require.Equal(t, "/class/user", records[0].Path)
+
+	ctx = request(handleAuditLog, http.MethodGet, "/audit_log?limit=0", "")
+	require.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func TestAuditValueSize(t *testing.T) {
+	l, err := ConfigureAudit(AuditConfig{File: filepath.Join(t.TempDir(), "audit.log"), MaxValueSize: 16}, nil)
+	require.Nil(t, err)
+	defer l.Close()
+	h := audited(func(ctx *fasthttp.RequestCtx) {
+		WriteJSON(ctx, fasthttp.StatusOK, map[string]string{"value": "longer than limit"})
+	})
+	request(h, http.MethodPut, "/tunables/name", `{"value": "1"}`)
+	records, err := l.Query(context.Background(), AuditFilter{})
+	require.Nil(t, err)
+	require.Len(t, records, 1)
+	require.True(t, records[0].Truncated)
+	require.JSONEq(t, `{"value": "1"}`, string(records[0].Request))
+	require.Empty(t, records[0].After)
+}
+
+func TestAuditSharedStorage(t *testing.T) {
+	ds, err := sm.Builder{}.NewDataStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ds.Close()
+	cfg := AuditConfig{Storage: true}.Validate()
+
+	// instances, which share storage, do not overwrite records of each other
+	const instances, records = 4, 25
+	var wg sync.WaitGroup
+	for i := range instances {
+		l := &AuditLog{cfg: cfg, ds: ds}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range records {
+				require.Nil(t, l.Append(context.Background(), AuditRecord{Path: strconv.Itoa(i)}))
+			}
+		}()
+	}
+	wg.Wait()
+	seq, err := loadSeq(context.Background(), ds)
+	require.Nil(t, err)
+	require.Equal(t, uint64(instances*records), seq)
+	l := &AuditLog{cfg: cfg, ds: ds}
+	stored, err := l.Query(context.Background(), AuditFilter{Limit: instances * records})
+	require.Nil(t, err)
+	require.Len(t, stored, instances*records)
+}
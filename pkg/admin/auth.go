@@ -0,0 +1,231 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Roles of admin API credentials, every role is allowed
+// to call endpoints of previous ones
+const (
+	// RoleReadOnly may call GET and HEAD endpoints
+	RoleReadOnly Role = "read_only"
+	// RoleModerator may also modify moderated objects, i.e. bans,
+	// replicated lists, user classes (see HandleModerated)
+	RoleModerator Role = "moderator"
+	// RoleAdmin may call any endpoint
+	RoleAdmin Role = "admin"
+)
+
+const bearerPrefix = "Bearer "
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("forbidden")
+	errUnknownRole  = errors.New("unknown role")
+	errEmptyToken   = errors.New("token not provided")
+	errDupToken     = errors.New("duplicate token")
+	errEmptyCN      = errors.New("common_name not provided")
+	errTLSRequired  = errors.New("tls_cert_path and tls_key_path required")
+	errCARequired   = errors.New("client_ca_path required to authenticate certificates")
+)
+
+type identityKey struct{}
+
+// Role is the set of admin API endpoints, credential may call
+type Role string
+
+func (r Role) rank() int {
+	switch r {
+	case RoleReadOnly:
+		return 1
+	case RoleModerator:
+		return 2
+	case RoleAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// allows returns true if r is allowed to call endpoints of required role
+func (r Role) allows(required Role) bool {
+	return r.rank() >= required.rank()
+}
+
+// TokenConfig is the static token, sent in `Authorization: Bearer <token>` header
+type TokenConfig struct {
+	// Name identifies owner of token in logs and audit records
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  Role   `yaml:"role"`
+}
+
+// CertificateConfig maps common name of client certificate to role
+type CertificateConfig struct {
+	CommonName string `yaml:"common_name"`
+	Role       Role   `yaml:"role"`
+}
+
+// AuthConfig configures TLS and authentication of admin API.
+// If neither tokens nor certificates provided, all requests are allowed.
+type AuthConfig struct {
+	// TLSCertPath and TLSKeyPath are paths of server's certificate and key,
+	// enable TLS if set
+	TLSCertPath string `yaml:"tls_cert_path"`
+	TLSKeyPath  string `yaml:"tls_key_path"`
+	// ClientCAPath is the path of PEM-encoded certificates of CAs,
+	// which issue client certificates
+	ClientCAPath string              `yaml:"client_ca_path"`
+	Tokens       []TokenConfig       `yaml:"tokens"`
+	Certificates []CertificateConfig `yaml:"certificates"`
+}
+
+// Enabled returns true if any credential is configured
+func (c AuthConfig) Enabled() bool {
+	return len(c.Tokens) > 0 || len(c.Certificates) > 0
+}
+
+// Validate checks that roles are known, credentials are not empty
+// and TLS is configured if certificates are used
+func (c AuthConfig) Validate() error {
+	tokens := make(map[string]bool, len(c.Tokens))
+	for i, t := range c.Tokens {
+		switch {
+		case len(t.Token) == 0:
+			return fmt.Errorf("tokens[%d]: %w", i, errEmptyToken)
+		case tokens[t.Token]:
+			return fmt.Errorf("tokens[%d]: %w", i, errDupToken)
+		case t.Role.rank() == 0:
+			return fmt.Errorf("tokens[%d]: %w '%s'", i, errUnknownRole, t.Role)
+		}
+		tokens[t.Token] = true
+	}
+	for i, cc := range c.Certificates {
+		switch {
+		case len(cc.CommonName) == 0:
+			return fmt.Errorf("certificates[%d]: %w", i, errEmptyCN)
+		case cc.Role.rank() == 0:
+			return fmt.Errorf("certificates[%d]: %w '%s'", i, errUnknownRole, cc.Role)
+		}
+	}
+	if (len(c.TLSCertPath) == 0) != (len(c.TLSKeyPath) == 0) ||
+		(len(c.TLSCertPath) == 0 && len(c.ClientCAPath) > 0) {
+		return errTLSRequired
+	}
+	if len(c.Certificates) > 0 && len(c.ClientCAPath) == 0 {
+		return errCARequired
+	}
+	return nil
+}
+
+// tlsConfig creates TLS configuration of server, nil if TLS is not enabled
+func (c AuthConfig) tlsConfig() (*tls.Config, error) {
+	if len(c.TLSCertPath) == 0 {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertPath, c.TLSKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load admin API certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(c.ClientCAPath) > 0 {
+		var b []byte
+		if b, err = os.ReadFile(c.ClientCAPath); err != nil {
+			return nil, fmt.Errorf("unable to load admin API client CA: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates found in admin API client CA")
+		}
+		// requests without certificate may be authenticated by token
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// identity is the authenticated credential
+type identity struct {
+	name string
+	role Role
+}
+
+// authenticator resolves credentials of requests
+type authenticator struct {
+	tokens []TokenConfig
+	certs  map[string]Role
+}
+
+func newAuthenticator(c AuthConfig) *authenticator {
+	if !c.Enabled() {
+		return nil
+	}
+	a := &authenticator{tokens: slices.Clone(c.Tokens), certs: make(map[string]Role, len(c.Certificates))}
+	for i := range a.tokens {
+		if len(a.tokens[i].Name) == 0 {
+			a.tokens[i].Name = fmt.Sprintf("token#%d", i)
+		}
+	}
+	for _, cc := range c.Certificates {
+		a.certs[cc.CommonName] = cc.Role
+	}
+	return a
+}
+
+// authenticate returns identity of bearer token or,
+// if token is not provided, of verified client certificate
+func (a *authenticator) authenticate(ctx *fasthttp.RequestCtx) (id identity, ok bool) {
+	if auth := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization); len(auth) > 0 {
+		if len(auth) <= len(bearerPrefix) || string(auth[:len(bearerPrefix)]) != bearerPrefix {
+			return
+		}
+		token := auth[len(bearerPrefix):]
+		// all tokens are compared to not reveal position of matching one
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+				id, ok = identity{name: t.Name, role: t.Role}, true
+			}
+		}
+		return
+	}
+	if state := ctx.TLSConnectionState(); state != nil && len(state.VerifiedChains) > 0 {
+		cn := state.VerifiedChains[0][0].Subject.CommonName
+		var role Role
+		if role, ok = a.certs[cn]; ok {
+			id = identity{name: cn, role: role}
+		}
+	}
+	return
+}
+
+// guard checks that request is authenticated by credential
+// of role, which allows required one, before calling h
+func (a *authenticator) guard(required Role, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id, ok := a.authenticate(ctx)
+		if !ok {
+			logger.Warn().Str("remote", ctx.RemoteAddr().String()).Bytes("path", ctx.Path()).Msg("unauthorized request")
+			ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, `Bearer realm="mochi admin"`)
+			WriteError(ctx, fasthttp.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		ctx.SetUserValue(identityKey{}, id)
+		if !id.role.allows(required) {
+			logger.Warn().Str("remote", ctx.RemoteAddr().String()).Str("identity", id.name).
+				Str("role", string(id.role)).Bytes("path", ctx.Path()).Msg("forbidden request")
+			WriteError(ctx, fasthttp.StatusForbidden, errForbidden)
+			return
+		}
+		h(ctx)
+	}
+}
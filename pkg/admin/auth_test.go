@@ -0,0 +1,187 @@
+package admin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func handleOK(ctx *fasthttp.RequestCtx) {
+	WriteJSON(ctx, fasthttp.StatusOK, map[string]string{"actor": Actor(ctx)})
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	for _, cfg := range []AuthConfig{
+		{Tokens: []TokenConfig{{Token: "a", Role: "root"}}},
+		{Tokens: []TokenConfig{{Role: RoleAdmin}}},
+		{Tokens: []TokenConfig{{Token: "a", Role: RoleAdmin}, {Token: "a", Role: RoleReadOnly}}},
+		{Certificates: []CertificateConfig{{CommonName: "a", Role: RoleAdmin}}, TLSCertPath: "c", TLSKeyPath: "k"},
+		{ClientCAPath: "ca"},
+		{TLSCertPath: "c"},
+	} {
+		require.NotNil(t, cfg.Validate(), cfg)
+	}
+	require.Nil(t, AuthConfig{}.Validate())
+}
+
+func TestGuard(t *testing.T) {
+	a := newAuthenticator(AuthConfig{Tokens: []TokenConfig{
+		{Name: "viewer", Token: "ro", Role: RoleReadOnly},
+		{Name: "mod", Token: "mod", Role: RoleModerator},
+		{Token: "admin", Role: RoleAdmin},
+	}})
+	for _, tt := range []struct {
+		auth     string
+		required Role
+		status   int
+		actor    string
+	}{
+		{"", RoleReadOnly, fasthttp.StatusUnauthorized, ""},
+		{"Basic cm86cm8=", RoleReadOnly, fasthttp.StatusUnauthorized, ""},
+		{"Bearer unknown", RoleReadOnly, fasthttp.StatusUnauthorized, ""},
+		{"Bearer ro", RoleReadOnly, fasthttp.StatusOK, "viewer"},
+		{"Bearer ro", RoleModerator, fasthttp.StatusForbidden, ""},
+		{"Bearer mod", RoleModerator, fasthttp.StatusOK, "mod"},
+		{"Bearer mod", RoleAdmin, fasthttp.StatusForbidden, ""},
+		{"Bearer admin", RoleAdmin, fasthttp.StatusOK, "token#2"},
+		{"Bearer admin", RoleReadOnly, fasthttp.StatusOK, "token#2"},
+	} {
+		ctx := request(a.guard(tt.required, handleOK), http.MethodGet, "/", "", fasthttp.HeaderAuthorization, tt.auth)
+		require.Equal(t, tt.status, ctx.Response.StatusCode(), tt)
+		if len(tt.actor) > 0 {
+			require.JSONEq(t, `{"actor": "`+tt.actor+`"}`, string(ctx.Response.Body()))
+		}
+	}
+}
+
+// newCert creates certificate signed by parent (self-signed if parent is nil)
+// and writes it and its key in PEM format into dir
+func newCert(t *testing.T, dir, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.Nil(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, cn+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, cn+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, dir, "ca", nil)
+	newCert(t, dir, "server", &ca)
+	moderator := newCert(t, dir, "moderator", &ca)
+	unknown := newCert(t, dir, "unknown", &ca)
+	Handle(http.MethodGet, "/test/auth", handleOK)
+	HandleModerated(http.MethodPost, "/test/auth", handleOK)
+	Handle(http.MethodDelete, "/test/auth", handleOK)
+
+	srv, err := New("127.0.0.1:16996", AuthConfig{
+		TLSCertPath:  filepath.Join(dir, "server.crt"),
+		TLSKeyPath:   filepath.Join(dir, "server.key"),
+		ClientCAPath: filepath.Join(dir, "ca.crt"),
+		Tokens:       []TokenConfig{{Name: "viewer", Token: "ro", Role: RoleReadOnly}},
+		Certificates: []CertificateConfig{{CommonName: "moderator", Role: RoleModerator}},
+	})
+	require.Nil(t, err)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	call := func(method, token string, cert *tls.Certificate) int {
+		cfg := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		req, err := http.NewRequest(method, "https://127.0.0.1:16996/test/auth", nil)
+		require.Nil(t, err)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "", nil))
+	require.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "", &unknown))
+	require.Equal(t, http.StatusOK, call(http.MethodGet, "ro", nil))
+	require.Equal(t, http.StatusForbidden, call(http.MethodPost, "ro", nil))
+	require.Equal(t, http.StatusOK, call(http.MethodGet, "", &moderator))
+	require.Equal(t, http.StatusOK, call(http.MethodPost, "", &moderator))
+	require.Equal(t, http.StatusForbidden, call(http.MethodDelete, "", &moderator))
+}
+
+func TestHandlePrivileged(t *testing.T) {
+	HandlePrivileged(http.MethodGet, "/test/privileged", handleOK)
+	handlersMU.Lock()
+	h := handlers[route{http.MethodGet, "/test/privileged"}]
+	delete(handlers, route{http.MethodGet, "/test/privileged"})
+	handlersMU.Unlock()
+	require.True(t, h.audited)
+	require.Equal(t, RoleAdmin, h.role)
+}
+
+func TestGroup(t *testing.T) {
+	defer func() {
+		handlersMU.Lock()
+		delete(handlers, route{http.MethodGet, "/test/group"})
+		delete(handlers, route{http.MethodGet, "/tenants/a/test/group"})
+		handlersMU.Unlock()
+	}()
+	Handle(http.MethodGet, "/test/group", handleOK)
+	// the same route of other group does not conflict
+	require.Nil(t, Group("/tenants/a", func() error {
+		Handle(http.MethodGet, "/test/group", handleOK)
+		return nil
+	}))
+	handlersMU.Lock()
+	_, found := handlers[route{http.MethodGet, "/tenants/a/test/group"}]
+	handlersMU.Unlock()
+	require.True(t, found)
+
+	err := Group("", func() error {
+		Handle(http.MethodGet, "/test/group", handleOK)
+		HandleModerated(http.MethodGet, "/test/group", handleOK)
+		return nil
+	})
+	require.ErrorIs(t, err, errDuplicateRoute)
+}
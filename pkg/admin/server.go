@@ -0,0 +1,233 @@
+// Package admin implements a standalone HTTP server for administrative API.
+// Any component (i.e. middleware) may register own handlers with Handle,
+// all registered handlers are served by Server. Mutations (requests
+// other than GET and HEAD) are recorded by AuditLog if it is configured.
+// Server may require static tokens or client certificates, mapped to roles,
+// which gate endpoints.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+const (
+	readTimeout  = time.Minute
+	writeTimeout = readTimeout
+)
+
+var (
+	logger = log.NewLogger("admin")
+
+	errAddrNotProvided = errors.New("admin listen address not provided")
+	errDuplicateRoute  = errors.New("admin handler already registered")
+
+	handlersMU sync.Mutex
+	handlers   = make(map[route]handler)
+	// current is the group of handlers being registered, see Group
+	current *group
+)
+
+type group struct {
+	prefix string
+	routes map[route]bool
+	err    error
+}
+
+type route struct {
+	method, path string
+}
+
+type handler struct {
+	h       fasthttp.RequestHandler
+	audited bool
+	// role is the minimal role required to call handler
+	role Role
+}
+
+func readOnly(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// defaultRole returns role required to call handler of method
+func defaultRole(method string) Role {
+	if readOnly(method) {
+		return RoleReadOnly
+	}
+	return RoleAdmin
+}
+
+// Handle registers handler for method and path. Path may contain
+// parameters in fasthttp/router format (i.e. `/bonus/{user}`).
+// If handler for the same method and path already registered, it is replaced,
+// unless both are registered in the same Group.
+// Requests to handlers of methods other than GET and HEAD are recorded
+// to audit log and allowed only to RoleAdmin if authentication is enabled.
+//
+// Handlers must be registered before Server created.
+func Handle(method, path string, h fasthttp.RequestHandler) {
+	handle(method, path, handler{h: h, audited: !readOnly(method), role: defaultRole(method)})
+}
+
+// HandleModerated registers handler like Handle, but it is
+// allowed to RoleModerator (i.e. for modification of bans).
+func HandleModerated(method, path string, h fasthttp.RequestHandler) {
+	handle(method, path, handler{h: h, audited: !readOnly(method), role: RoleModerator})
+}
+
+// HandlePrivileged registers handler like Handle, but it is always
+// recorded to audit log and allowed only to RoleAdmin regardless of method
+// (i.e. for GET endpoints, which process requests on behalf of clients).
+func HandlePrivileged(method, path string, h fasthttp.RequestHandler) {
+	handle(method, path, handler{h: h, audited: true, role: RoleAdmin})
+}
+
+// HandleUnaudited registers handler like Handle, but its requests
+// are never recorded to audit log (i.e. for requests of other trackers).
+func HandleUnaudited(method, path string, h fasthttp.RequestHandler) {
+	handle(method, path, handler{h: h, role: defaultRole(method)})
+}
+
+func handle(method, path string, h handler) {
+	if len(method) == 0 || len(path) == 0 || h.h == nil {
+		panic("admin: could not register handler with empty method, path or nil handler")
+	}
+	handlersMU.Lock()
+	defer handlersMU.Unlock()
+	if g := current; g != nil {
+		path = g.prefix + path
+		rt := route{method, path}
+		if g.routes[rt] {
+			g.err = errors.Join(g.err, fmt.Errorf("%w: %s %s", errDuplicateRoute, method, path))
+			return
+		}
+		g.routes[rt] = true
+	}
+	handlers[route{method, path}] = h
+}
+
+// Group calls fn and registers handlers registered by fn with path prefix
+// (i.e. `/tenants/{name}`), so components (middlewares) of several
+// virtual trackers do not replace handlers of each other.
+// Returns error if fn registered the same method and path more than once
+// (i.e. middleware with admin API is used twice in hooks chain).
+//
+// Group must not be called concurrently or inside another Group.
+func Group(prefix string, fn func() error) error {
+	g := &group{prefix: prefix, routes: make(map[route]bool)}
+	handlersMU.Lock()
+	current = g
+	handlersMU.Unlock()
+	err := fn()
+	handlersMU.Lock()
+	current = nil
+	handlersMU.Unlock()
+	return errors.Join(err, g.err)
+}
+
+// WriteJSON serializes v as JSON response with provided status code
+func WriteJSON(ctx *fasthttp.RequestCtx, status int, v any) {
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(status)
+	if err := json.NewEncoder(ctx).Encode(v); err != nil {
+		logger.Error().Err(err).Msg("unable to write response")
+	}
+}
+
+// WriteError writes JSON object with error message
+func WriteError(ctx *fasthttp.RequestCtx, status int, err error) {
+	WriteJSON(ctx, status, map[string]string{"error": err.Error()})
+}
+
+// Server represents a standalone HTTP server for serving administrative API.
+type Server struct {
+	listen string
+	srv    *fasthttp.Server
+}
+
+// Start starts admin server
+func (s *Server) Start() (err error) {
+	if s.srv.TLSConfig != nil {
+		err = s.srv.ListenAndServeTLS(s.listen, "", "")
+	} else {
+		err = s.srv.ListenAndServe(s.listen)
+	}
+	if err != nil {
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		} else {
+			logger.Error().Err(err).Msg("failed while serving admin API")
+		}
+	}
+	return err
+}
+
+// Close shuts down the server.
+func (s *Server) Close() error {
+	return s.srv.Shutdown()
+}
+
+// NewServer creates new admin server and starts it.
+// Equivalent of New and async Server.Start.
+func NewServer(addr string, auth AuthConfig) (*Server, error) {
+	s, err := New(addr, auth)
+	if err == nil {
+		go func() {
+			_ = s.Start()
+		}()
+	}
+	return s, err
+}
+
+// New creates a new instance of admin server with all registered handlers,
+// TLS and authentication configured by auth
+func New(addr string, auth AuthConfig) (*Server, error) {
+	if len(addr) == 0 {
+		return nil, errAddrNotProvided
+	}
+	if err := auth.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid admin API authentication: %w", err)
+	}
+	tlsConfig, err := auth.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	a := newAuthenticator(auth)
+	if a != nil && tlsConfig == nil {
+		logger.Warn().Msg("admin API tokens are sent without encryption, TLS should be enabled")
+	}
+
+	r := router.New()
+	handlersMU.Lock()
+	for rt, h := range handlers {
+		fn := h.h
+		if a != nil {
+			fn = a.guard(h.role, fn)
+		}
+		// rejected requests are also recorded
+		if h.audited {
+			fn = audited(fn)
+		}
+		r.Handle(rt.method, rt.path, fn)
+	}
+	handlersMU.Unlock()
+
+	return &Server{
+		listen: addr,
+		srv: &fasthttp.Server{
+			Handler:      r.Handler,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			TLSConfig:    tlsConfig,
+		},
+	}, nil
+}
@@ -0,0 +1,77 @@
+// Package affinity contains helpers for binding OS threads
+// to the specific set of CPUs.
+package affinity
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrUnsupported returned if CPU affinity can not be set on this platform
+	ErrUnsupported = errors.New("cpu affinity is not supported on this platform")
+
+	errInvalidCPUList = errors.New("invalid cpu list")
+)
+
+// CPUSet is the sorted list of unique CPU indices
+type CPUSet []int
+
+// Parse parses the CPU list in Linux cpuset format,
+// i.e. comma separated indices or inclusive ranges: `0-3,8,10-11`.
+func Parse(s string) (set CPUSet, err error) {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+		var first, last int
+		if first, err = strconv.Atoi(from); err == nil {
+			last = first
+			if isRange {
+				last, err = strconv.Atoi(to)
+			}
+		}
+		if err != nil || first < 0 || last < first {
+			return nil, fmt.Errorf("%w: '%s'", errInvalidCPUList, s)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			set = append(set, cpu)
+		}
+	}
+	slices.Sort(set)
+	return slices.Compact(set), nil
+}
+
+// String returns set in the same format, which accepted by Parse
+func (s CPUSet) String() string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		j := i
+		for j+1 < len(s) && s[j+1] == s[j]+1 {
+			j++
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.Itoa(s[i]))
+		if j > i {
+			sb.WriteByte('-')
+			sb.WriteString(strconv.Itoa(s[j]))
+		}
+		i = j
+	}
+	return sb.String()
+}
+
+// Pin binds the calling OS thread to CPUs of the set.
+// Caller must lock goroutine to its thread with runtime.LockOSThread
+// before calling Pin, otherwise goroutine may be moved to another
+// (not bound) thread.
+func (s CPUSet) Pin() error {
+	if len(s) == 0 {
+		return fmt.Errorf("%w: empty set", errInvalidCPUList)
+	}
+	return pin(s)
+}
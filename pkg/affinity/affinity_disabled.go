@@ -0,0 +1,10 @@
+//go:build !linux
+
+package affinity
+
+// Supported is true if CPU affinity can be set on this platform
+const Supported = false
+
+func pin(_ CPUSet) error {
+	return ErrUnsupported
+}
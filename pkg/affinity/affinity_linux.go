@@ -0,0 +1,17 @@
+//go:build linux
+
+package affinity
+
+import "golang.org/x/sys/unix"
+
+// Supported is true if CPU affinity can be set on this platform
+const Supported = true
+
+func pin(s CPUSet) error {
+	var set unix.CPUSet
+	for _, cpu := range s {
+		set.Set(cpu)
+	}
+	// pid 0 means the calling thread
+	return unix.SchedSetaffinity(0, &set)
+}
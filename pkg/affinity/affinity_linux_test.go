@@ -0,0 +1,32 @@
+//go:build linux
+
+package affinity
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestPin(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var orig unix.CPUSet
+	require.NoError(t, unix.SchedGetaffinity(0, &orig))
+	// restore original mask, so that unlocked thread is not bound
+	defer func() { _ = unix.SchedSetaffinity(0, &orig) }()
+
+	var cpu int
+	for !orig.IsSet(cpu) {
+		cpu++
+	}
+	require.NoError(t, CPUSet{cpu}.Pin())
+	var got unix.CPUSet
+	require.NoError(t, unix.SchedGetaffinity(0, &got))
+	require.Equal(t, 1, got.Count())
+	require.True(t, got.IsSet(cpu))
+
+	require.Error(t, CPUSet{}.Pin())
+}
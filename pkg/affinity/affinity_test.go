@@ -0,0 +1,32 @@
+package affinity
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for s, expected := range map[string]CPUSet{
+		"0":            {0},
+		"0-3":          {0, 1, 2, 3},
+		"8, 0-1,10-11": {0, 1, 8, 10, 11},
+		"1,1,0-1":      {0, 1},
+	} {
+		set, err := Parse(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, set, s)
+	}
+	for _, s := range []string{"", "a", "-1", "3-1", "1-", "1,,2", "0-b"} {
+		_, err := Parse(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestString(t *testing.T) {
+	for _, s := range []string{"0", "0-3", "0-1,8,10-11"} {
+		set, err := Parse(s)
+		require.NoError(t, err)
+		require.Equal(t, s, set.String())
+	}
+}
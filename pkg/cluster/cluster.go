@@ -0,0 +1,540 @@
+// Package cluster implements gossip-based membership and failure detection
+// of tracker nodes (SWIM protocol): every node periodically probes random
+// member directly or, if it does not respond, via other members, suspects
+// and then declares unresponsive members dead, and disseminates membership
+// changes piggybacked on probe messages, so all nodes converge to the
+// same member list without central coordination.
+package cluster
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+const (
+	defaultProbeInterval    = time.Second
+	defaultProbeTimeout     = 500 * time.Millisecond
+	defaultSuspicionTimeout = 5 * time.Second
+	defaultIndirectChecks   = 3
+	// deadRetention is the number of suspicion timeouts dead member is
+	// kept to reject stale alive messages about it
+	deadRetention = 10
+)
+
+var (
+	logger = log.NewLogger("cluster")
+
+	errNameNotProvided = errors.New("node name not provided")
+	errAddrNotProvided = errors.New("gossip address not provided")
+)
+
+// State of member
+type State uint8
+
+// Member states, ordered by precedence for the same incarnation
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member is the node of cluster
+type Member struct {
+	// Name is the unique identifier of node
+	Name string `json:"name"`
+	// Addr is the gossip address of node
+	Addr string `json:"addr"`
+	// Meta is the arbitrary data of node (i.e. RPC address)
+	Meta string `json:"meta,omitempty"`
+	// Incarnation is increased by node to refute suspicion
+	Incarnation uint64 `json:"inc"`
+	State       State  `json:"state"`
+}
+
+// Config holds gossip parameters
+type Config struct {
+	// Name is the unique identifier of this node
+	Name string
+	// Addr is the UDP address of gossip listener
+	Addr string
+	// AdvertiseAddr is the address of this node announced to other
+	// members, Addr if not set
+	AdvertiseAddr string `cfg:"advertise_addr"`
+	// Meta is the arbitrary data of this node, announced to other members
+	Meta string
+	// Seeds are gossip addresses of nodes used to join cluster
+	Seeds []string
+	// ProbeInterval is the period of member probes
+	ProbeInterval time.Duration `cfg:"probe_interval"`
+	// ProbeTimeout is the timeout of direct probe,
+	// after that member is probed via other members
+	ProbeTimeout time.Duration `cfg:"probe_timeout"`
+	// SuspicionTimeout is the time after suspected member declared dead
+	SuspicionTimeout time.Duration `cfg:"suspicion_timeout"`
+	// IndirectChecks is the number of members asked to
+	// probe member, which did not respond to direct probe
+	IndirectChecks int `cfg:"indirect_checks"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.Name) == 0 {
+		err = errNameNotProvided
+		return
+	}
+	if len(cfg.Addr) == 0 {
+		err = errAddrNotProvided
+		return
+	}
+	if len(cfg.AdvertiseAddr) == 0 {
+		validCfg.AdvertiseAddr = cfg.Addr
+	}
+	if cfg.ProbeInterval <= 0 {
+		validCfg.ProbeInterval = defaultProbeInterval
+		logger.Warn().
+			Str("name", "ProbeInterval").
+			Dur("provided", cfg.ProbeInterval).
+			Dur("default", validCfg.ProbeInterval).
+			Msg("falling back to default configuration")
+	}
+	if cfg.ProbeTimeout <= 0 || cfg.ProbeTimeout >= validCfg.ProbeInterval {
+		validCfg.ProbeTimeout = min(defaultProbeTimeout, validCfg.ProbeInterval/2)
+		logger.Warn().
+			Str("name", "ProbeTimeout").
+			Dur("provided", cfg.ProbeTimeout).
+			Dur("default", validCfg.ProbeTimeout).
+			Msg("falling back to default configuration")
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		validCfg.SuspicionTimeout = defaultSuspicionTimeout
+		logger.Warn().
+			Str("name", "SuspicionTimeout").
+			Dur("provided", cfg.SuspicionTimeout).
+			Dur("default", validCfg.SuspicionTimeout).
+			Msg("falling back to default configuration")
+	}
+	if cfg.IndirectChecks <= 0 {
+		validCfg.IndirectChecks = defaultIndirectChecks
+		logger.Warn().
+			Str("name", "IndirectChecks").
+			Int("provided", cfg.IndirectChecks).
+			Int("default", validCfg.IndirectChecks).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// memberState is the member with local time of last state change
+type memberState struct {
+	Member
+	changed time.Time
+}
+
+// update is the membership change disseminated to other members
+type update struct {
+	Member
+	transmits int
+}
+
+// Node is the member of cluster
+type Node struct {
+	cfg  Config
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	self    Member
+	members map[string]*memberState
+	updates []*update
+	// probeOrder is the shuffled list of members to probe
+	probeOrder []string
+	listeners  []func([]Member)
+
+	seq     atomic.Uint64
+	acksMU  sync.Mutex
+	acks    map[uint64]func()
+	changed chan struct{}
+	closed  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Start starts gossip listener and joins cluster via seeds
+func Start(provided Config) (*Node, error) {
+	cfg, err := provided.Validate()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:  cfg,
+		conn: conn,
+		// incarnation of restarted node must be greater than
+		// incarnation of its previous instance declared dead
+		self:    Member{Name: cfg.Name, Addr: cfg.AdvertiseAddr, Meta: cfg.Meta, Incarnation: uint64(time.Now().UnixNano())},
+		members: make(map[string]*memberState),
+		acks:    make(map[uint64]func()),
+		changed: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	n.wg.Add(3)
+	go n.receive()
+	go n.probe()
+	go n.dispatch()
+	n.join()
+	logger.Info().Str("name", cfg.Name).Str("addr", cfg.Addr).Strs("seeds", cfg.Seeds).Msg("gossip started")
+	return n, nil
+}
+
+// join sends own state to seeds, which respond with member list
+func (n *Node) join() {
+	n.mu.Lock()
+	self := n.self
+	n.mu.Unlock()
+	for _, s := range n.cfg.Seeds {
+		if s == n.cfg.AdvertiseAddr || s == n.cfg.Addr {
+			continue
+		}
+		n.send(s, &message{Type: msgPing, Seq: n.seq.Add(1), From: n.cfg.Name, Updates: []Member{self}})
+	}
+}
+
+// Self returns state of this node
+func (n *Node) Self() Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.self
+}
+
+// Members returns alive and suspected members including this node, sorted by name
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.membersLocked()
+}
+
+func (n *Node) membersLocked() []Member {
+	out := make([]Member, 0, len(n.members)+1)
+	out = append(out, n.self)
+	for _, m := range n.members {
+		if m.State != StateDead {
+			out = append(out, m.Member)
+		}
+	}
+	slices.SortFunc(out, func(a, b Member) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return out
+}
+
+// Subscribe registers fn, which is called with Members every time
+// member joined or declared dead. Calls are serialized.
+func (n *Node) Subscribe(fn func([]Member)) {
+	n.mu.Lock()
+	n.listeners = append(n.listeners, fn)
+	n.mu.Unlock()
+}
+
+func (n *Node) dispatch() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-n.changed:
+			n.mu.Lock()
+			members, listeners := n.membersLocked(), slices.Clone(n.listeners)
+			n.mu.Unlock()
+			for _, fn := range listeners {
+				fn(members)
+			}
+		}
+	}
+}
+
+func (n *Node) notify() {
+	select {
+	case n.changed <- struct{}{}:
+	default:
+	}
+}
+
+// queue adds membership change to be disseminated, previous
+// changes of the same member are replaced
+func (n *Node) queue(m Member) {
+	n.updates = slices.DeleteFunc(n.updates, func(u *update) bool {
+		return u.Name == m.Name
+	})
+	n.updates = append(n.updates, &update{Member: m})
+}
+
+// retransmitLimit is the number of messages each update is piggybacked to
+func (n *Node) retransmitLimit() int {
+	limit, size := 3, len(n.members)+1
+	for size > 0 {
+		limit++
+		size >>= 1
+	}
+	return limit
+}
+
+// piggyback returns updates, which should be sent within the next message
+func (n *Node) piggyback() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.updates) == 0 {
+		return nil
+	}
+	limit := n.retransmitLimit()
+	slices.SortStableFunc(n.updates, func(a, b *update) int {
+		return a.transmits - b.transmits
+	})
+	out := make([]Member, 0, min(len(n.updates), maxPiggyback))
+	for _, u := range n.updates {
+		if len(out) == maxPiggyback {
+			break
+		}
+		out = append(out, u.Member)
+		u.transmits++
+	}
+	n.updates = slices.DeleteFunc(n.updates, func(u *update) bool {
+		return u.transmits >= limit
+	})
+	return out
+}
+
+// merge applies membership change received from other member
+func (n *Node) merge(m Member) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if m.Name == n.self.Name {
+		if m.State != StateAlive && m.Incarnation >= n.self.Incarnation {
+			// refute suspicion
+			n.self.Incarnation = m.Incarnation + 1
+			n.queue(n.self)
+			logger.Info().Str("state", m.State.String()).Uint64("incarnation", n.self.Incarnation).Msg("suspicion refuted")
+		}
+		return
+	}
+	e, found := n.members[m.Name]
+	if !found {
+		if m.State == StateDead {
+			return
+		}
+		n.members[m.Name] = &memberState{Member: m, changed: time.Now()}
+		n.probeOrder = append(n.probeOrder, m.Name)
+		n.queue(m)
+		n.notify()
+		logger.Info().Str("name", m.Name).Str("addr", m.Addr).Msg("member joined")
+		return
+	}
+	if m.Incarnation < e.Incarnation || (m.Incarnation == e.Incarnation && m.State <= e.State) {
+		return
+	}
+	n.setState(e, m)
+}
+
+// setState replaces state of member, must be called with lock held
+func (n *Node) setState(e *memberState, m Member) {
+	wasDead := e.State == StateDead
+	e.Member, e.changed = m, time.Now()
+	n.queue(m)
+	if wasDead != (m.State == StateDead) {
+		n.notify()
+	}
+	logger.Info().Str("name", m.Name).Str("state", m.State.String()).Uint64("incarnation", m.Incarnation).Msg("member state changed")
+}
+
+// nextTarget returns the next member to probe, members are probed
+// in random order, every member is probed once per round
+func (n *Node) nextTarget() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for len(n.probeOrder) > 0 {
+		last := len(n.probeOrder) - 1
+		i := rand.IntN(len(n.probeOrder)) // nolint:gosec
+		name := n.probeOrder[i]
+		n.probeOrder[i] = n.probeOrder[last]
+		n.probeOrder = n.probeOrder[:last]
+		if m, ok := n.members[name]; ok && m.State != StateDead {
+			return m.Member, true
+		}
+	}
+	for name, m := range n.members {
+		if m.State != StateDead {
+			n.probeOrder = append(n.probeOrder, name)
+		}
+	}
+	return Member{}, false
+}
+
+// helpers returns up to k random alive members except target
+func (n *Node) helpers(target string, k int) []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out := make([]Member, 0, k)
+	for _, m := range n.members {
+		if m.Name != target && m.State == StateAlive {
+			out = append(out, m.Member)
+		}
+	}
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] }) // nolint:gosec
+	return out[:min(k, len(out))]
+}
+
+func (n *Node) probe() {
+	defer n.wg.Done()
+	t := time.NewTicker(n.cfg.ProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-t.C:
+			if target, ok := n.nextTarget(); ok {
+				if !n.probeMember(target) {
+					n.suspect(target)
+				}
+			}
+			n.expire()
+		}
+	}
+}
+
+// probeMember checks if target responds directly or via other members
+func (n *Node) probeMember(target Member) bool {
+	seq := n.seq.Add(1)
+	acked := make(chan struct{})
+	var once sync.Once
+	n.await(seq, func() { once.Do(func() { close(acked) }) })
+	defer n.forget(seq)
+	n.send(target.Addr, &message{Type: msgPing, Seq: seq, From: n.cfg.Name})
+	direct := time.NewTimer(n.cfg.ProbeTimeout)
+	defer direct.Stop()
+	select {
+	case <-acked:
+		return true
+	case <-n.closed:
+		return true
+	case <-direct.C:
+	}
+	for _, h := range n.helpers(target.Name, n.cfg.IndirectChecks) {
+		n.send(h.Addr, &message{Type: msgPingReq, Seq: seq, From: n.cfg.Name, Target: target.Addr})
+	}
+	indirect := time.NewTimer(n.cfg.ProbeInterval - n.cfg.ProbeTimeout)
+	defer indirect.Stop()
+	select {
+	case <-acked:
+		return true
+	case <-n.closed:
+		return true
+	case <-indirect.C:
+		return false
+	}
+}
+
+func (n *Node) suspect(target Member) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if e, ok := n.members[target.Name]; ok && e.State == StateAlive && e.Incarnation == target.Incarnation {
+		m := e.Member
+		m.State = StateSuspect
+		n.setState(e, m)
+	}
+}
+
+// expire declares dead members, which are suspected longer than
+// suspicion timeout, and forgets members dead for a long time
+func (n *Node) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	for name, e := range n.members {
+		switch e.State {
+		case StateSuspect:
+			if now.Sub(e.changed) >= n.cfg.SuspicionTimeout {
+				m := e.Member
+				m.State = StateDead
+				n.setState(e, m)
+			}
+		case StateDead:
+			if now.Sub(e.changed) >= deadRetention*n.cfg.SuspicionTimeout {
+				delete(n.members, name)
+			}
+		}
+	}
+}
+
+func (n *Node) await(seq uint64, fn func()) {
+	n.acksMU.Lock()
+	n.acks[seq] = fn
+	n.acksMU.Unlock()
+}
+
+func (n *Node) forget(seq uint64) {
+	n.acksMU.Lock()
+	delete(n.acks, seq)
+	n.acksMU.Unlock()
+}
+
+func (n *Node) acked(seq uint64) {
+	n.acksMU.Lock()
+	fn := n.acks[seq]
+	n.acksMU.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// Close announces that this node left cluster and stops gossip
+func (n *Node) Close() error {
+	n.mu.Lock()
+	self := n.self
+	self.State = StateDead
+	targets := make([]string, 0, len(n.members))
+	for _, m := range n.members {
+		if m.State != StateDead {
+			targets = append(targets, m.Addr)
+		}
+	}
+	n.mu.Unlock()
+	for _, addr := range targets {
+		n.send(addr, &message{Type: msgAck, From: n.cfg.Name, Updates: []Member{self}})
+	}
+	return n.stop()
+}
+
+// stop stops gossip without leave announcement
+func (n *Node) stop() error {
+	close(n.closed)
+	err := n.conn.Close()
+	n.wg.Wait()
+	return err
+}
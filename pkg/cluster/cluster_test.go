@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func startNode(t *testing.T, name, addr string, seeds ...string) *Node {
+	n, err := Start(Config{
+		Name:             name,
+		Addr:             addr,
+		Meta:             name + "-meta",
+		Seeds:            seeds,
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     20 * time.Millisecond,
+		SuspicionTimeout: 200 * time.Millisecond,
+		IndirectChecks:   1,
+	})
+	require.NoError(t, err)
+	return n
+}
+
+func names(ms []Member) (out []string) {
+	for _, m := range ms {
+		out = append(out, m.Name)
+	}
+	return
+}
+
+func TestValidate(t *testing.T) {
+	_, err := Config{Addr: "127.0.0.1:0"}.Validate()
+	require.ErrorIs(t, err, errNameNotProvided)
+	_, err = Config{Name: "a"}.Validate()
+	require.ErrorIs(t, err, errAddrNotProvided)
+	cfg, err := Config{Name: "a", Addr: "127.0.0.1:0", ProbeInterval: time.Second, ProbeTimeout: 2 * time.Second}.Validate()
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:0", cfg.AdvertiseAddr)
+	require.Equal(t, defaultProbeTimeout, cfg.ProbeTimeout)
+	require.Equal(t, defaultSuspicionTimeout, cfg.SuspicionTimeout)
+	require.Equal(t, defaultIndirectChecks, cfg.IndirectChecks)
+}
+
+func TestMembership(t *testing.T) {
+	const addrA, addrB, addrC = "127.0.0.1:17946", "127.0.0.1:17947", "127.0.0.1:17948"
+	a := startNode(t, "a", addrA)
+	defer a.Close()
+	var notified atomic.Int32
+	a.Subscribe(func([]Member) { notified.Add(1) })
+	b := startNode(t, "b", addrB, addrA)
+	c := startNode(t, "c", addrC, addrA)
+
+	all := []string{"a", "b", "c"}
+	for _, n := range []*Node{a, b, c} {
+		require.Eventually(t, func() bool {
+			return slices.Equal(all, names(n.Members()))
+		}, 5*time.Second, 10*time.Millisecond, n.cfg.Name)
+	}
+	require.Positive(t, notified.Load())
+	require.Equal(t, "b-meta", b.Members()[1].Meta)
+
+	// failed member is declared dead
+	require.NoError(t, c.stop())
+	for _, n := range []*Node{a, b} {
+		require.Eventually(t, func() bool {
+			return slices.Equal([]string{"a", "b"}, names(n.Members()))
+		}, 5*time.Second, 10*time.Millisecond, n.cfg.Name)
+	}
+
+	// left member is removed immediately
+	require.NoError(t, b.Close())
+	require.Eventually(t, func() bool {
+		return slices.Equal([]string{"a"}, names(a.Members()))
+	}, time.Second, 10*time.Millisecond)
+}
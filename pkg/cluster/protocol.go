@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+// Message types
+const (
+	msgPing    = "ping"
+	msgAck     = "ack"
+	msgPingReq = "ping-req"
+
+	// maxPiggyback is the maximum number of updates in message
+	maxPiggyback = 16
+	// maxDatagramSize is the size of receive buffer
+	maxDatagramSize = 65535
+)
+
+// message is the gossip datagram
+type message struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq"`
+	// From is the name of sender
+	From string `json:"from"`
+	// Target is the address of member, which should be probed (ping-req)
+	Target  string   `json:"target,omitempty"`
+	Updates []Member `json:"updates,omitempty"`
+}
+
+func (n *Node) send(addr string, msg *message) {
+	if len(msg.Updates) == 0 {
+		msg.Updates = n.piggyback()
+	}
+	b, err := json.Marshal(msg)
+	if err == nil {
+		var udpAddr *net.UDPAddr
+		if udpAddr, err = net.ResolveUDPAddr("udp", addr); err == nil {
+			_, err = n.conn.WriteToUDP(b, udpAddr)
+		}
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Debug().Err(err).Str("addr", addr).Str("type", msg.Type).Msg("unable to send message")
+	}
+}
+
+func (n *Node) receive() {
+	defer n.wg.Done()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		l, from, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error().Err(err).Msg("unable to read message")
+			continue
+		}
+		var msg message
+		if err = json.Unmarshal(buf[:l], &msg); err != nil {
+			logger.Debug().Err(err).Stringer("addr", from).Msg("malformed message")
+			continue
+		}
+		n.handle(&msg, from.String())
+	}
+}
+
+func (n *Node) handle(msg *message, from string) {
+	n.mu.Lock()
+	_, known := n.members[msg.From]
+	n.mu.Unlock()
+	for _, m := range msg.Updates {
+		n.merge(m)
+	}
+	switch msg.Type {
+	case msgPing:
+		resp := &message{Type: msgAck, Seq: msg.Seq, From: n.cfg.Name}
+		if !known {
+			// joined member receives the whole member list
+			resp.Updates = n.Members()
+		}
+		n.send(from, resp)
+	case msgPingReq:
+		seq := n.seq.Add(1)
+		origSeq := msg.Seq
+		n.await(seq, func() {
+			n.forget(seq)
+			n.send(from, &message{Type: msgAck, Seq: origSeq, From: n.cfg.Name})
+		})
+		// requester does not wait longer than probe interval
+		time.AfterFunc(n.cfg.ProbeInterval, func() { n.forget(seq) })
+		n.send(msg.Target, &message{Type: msgPing, Seq: seq, From: n.cfg.Name})
+	case msgAck:
+		n.acked(msg.Seq)
+	}
+}
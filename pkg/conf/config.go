@@ -4,6 +4,7 @@ package conf
 
 import (
 	"errors"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
 	"github.com/rs/zerolog"
@@ -26,8 +27,8 @@ func (m MapConfig) MarshalZerologObject(e *zerolog.Event) {
 
 // Unmarshal decodes receiver map into provided structure.
 // Decoder configured to automatically unmarshal inherited structures,
-// convert string-ed duration (1s, 2m, 3h...) into time.Duration and
-// string representation IP into net.IP.
+// convert string-ed duration (1s, 2m, 3h...) into time.Duration,
+// RFC 3339 time into time.Time and string representation IP into net.IP.
 // Tag used for decode customization is conf.TagName.
 func (m MapConfig) Unmarshal(into any) (err error) {
 	if m != nil {
@@ -35,6 +36,7 @@ func (m MapConfig) Unmarshal(into any) (err error) {
 			conf := &mapstructure.DecoderConfig{
 				DecodeHook: mapstructure.ComposeDecodeHookFunc(
 					mapstructure.StringToTimeDurationHookFunc(),
+					mapstructure.StringToTimeHookFunc(time.RFC3339),
 					mapstructure.StringToIPHookFunc(),
 				),
 				Squash:  true,
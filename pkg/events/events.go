@@ -0,0 +1,156 @@
+// Package events implements in-process bus of tracker events (new torrents,
+// completed downloads, rejections, storage GC runs), which are streamed to
+// subscribers, i.e. live dashboards connected to ops server.
+// Events are published only if there is at least one subscriber,
+// so bus does not add overhead to request processing otherwise.
+package events
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
+
+// Event types
+const (
+	// TypeNewTorrent is published on started announce to empty swarm
+	TypeNewTorrent = "new_torrent"
+	// TypeCompleted is published on completed announce
+	TypeCompleted = "completed"
+	// TypeSwarmEmptied is published on stopped announce of the last peer in swarm
+	TypeSwarmEmptied = "swarm_emptied"
+	// TypeRejected is published if announce rejected by middleware
+	TypeRejected = "rejected"
+	// TypeGC is published after storage garbage collection
+	TypeGC = "gc"
+	// TypeCorruption is published if peer reported excessive amount
+	// of corrupt data (i.e. swarm is poisoned)
+	TypeCorruption = "corruption"
+)
+
+// Types is the list of all known event types
+var Types = []string{TypeNewTorrent, TypeCompleted, TypeSwarmEmptied, TypeRejected, TypeGC, TypeCorruption}
+
+func init() {
+	prometheus.MustRegister(PromDroppedEvents)
+}
+
+// PromDroppedEvents is the number of events not delivered to slow subscribers
+var PromDroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mochi_events_dropped_total",
+	Help: "The number of events dropped because subscriber's buffer is full",
+})
+
+// Event is the tracker event. Fields, which are not applicable
+// to event type, are empty.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	InfoHash string    `json:"info_hash,omitempty"`
+	PeerID   string    `json:"peer_id,omitempty"`
+	// Addr is the first address of peer with applied privacy mode
+	Addr string `json:"addr,omitempty"`
+	Port uint16 `json:"port,omitempty"`
+	// RequestID identifies announce, which produced event
+	RequestID string `json:"request_id,omitempty"`
+	// Hook is the name of middleware, which rejected announce
+	Hook string `json:"hook,omitempty"`
+	// Reason is the message of rejection error or description of corruption
+	Reason string `json:"reason,omitempty"`
+	// Storage is the name of storage, which performed GC
+	Storage string `json:"storage,omitempty"`
+	// DurationMs is the duration of GC in milliseconds
+	DurationMs int64 `json:"duration_ms,omitempty"`
+}
+
+// Filter selects events delivered to subscriber.
+// Empty fields match any event.
+type Filter struct {
+	Types    []string
+	InfoHash string
+}
+
+func (f Filter) match(e *Event) bool {
+	return (len(f.Types) == 0 || slices.Contains(f.Types, e.Type)) &&
+		(len(f.InfoHash) == 0 || f.InfoHash == e.InfoHash)
+}
+
+// Subscription receives published events, which match filter.
+type Subscription struct {
+	// C is the channel of events, it is closed by Subscription.Close
+	C       <-chan Event
+	c       chan Event
+	filter  Filter
+	dropped atomic.Uint64
+}
+
+var (
+	subsMu      sync.RWMutex
+	subs        = make(map[*Subscription]struct{})
+	subsCounter atomic.Int32
+)
+
+// Subscribe creates subscription with buffer of provided size.
+// Events are dropped if buffer is full.
+func Subscribe(size int, filter Filter) *Subscription {
+	c := make(chan Event, max(size, 1))
+	s := &Subscription{C: c, c: c, filter: filter}
+	subsMu.Lock()
+	subs[s] = struct{}{}
+	subsCounter.Add(1)
+	subsMu.Unlock()
+	return s
+}
+
+// Dropped returns the number of events, which were not delivered because buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close removes subscription from bus and closes channel.
+func (s *Subscription) Close() {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	if _, exists := subs[s]; exists {
+		delete(subs, s)
+		subsCounter.Add(-1)
+		close(s.c)
+	}
+}
+
+// Enabled indicates that there is at least one subscriber.
+// Publishers should check it before constructing Event.
+func Enabled() bool {
+	return subsCounter.Load() > 0
+}
+
+// Publish sends event to all matching subscribers without blocking.
+// Time of event is set to current if it is zero.
+func Publish(e Event) {
+	if !Enabled() {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	subsMu.RLock()
+	defer subsMu.RUnlock()
+	for s := range subs {
+		if !s.filter.match(&e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped.Add(1)
+			if metrics.Enabled() {
+				PromDroppedEvents.Inc()
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	require.False(t, Enabled())
+	Publish(Event{Type: TypeGC})
+
+	all := Subscribe(1, Filter{})
+	completed := Subscribe(10, Filter{Types: []string{TypeCompleted}, InfoHash: "01"})
+	require.True(t, Enabled())
+
+	Publish(Event{Type: TypeCompleted, InfoHash: "01"})
+	Publish(Event{Type: TypeCompleted, InfoHash: "02"})
+	Publish(Event{Type: TypeGC})
+
+	e := <-all.C
+	require.Equal(t, TypeCompleted, e.Type)
+	require.False(t, e.Time.IsZero())
+	require.Equal(t, uint64(2), all.Dropped())
+
+	e = <-completed.C
+	require.Equal(t, "01", e.InfoHash)
+	require.Empty(t, completed.C)
+	require.Zero(t, completed.Dropped())
+
+	all.Close()
+	all.Close()
+	_, open := <-all.C
+	require.False(t, open)
+	require.True(t, Enabled())
+	completed.Close()
+	require.False(t, Enabled())
+}
@@ -0,0 +1,256 @@
+// Package export periodically writes the list of active info hashes
+// with seeders and leechers counts into file and provides it for
+// ops server (i.e. to feed search indexes or takedown tooling).
+package export
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Supported export formats
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+
+	defaultInterval = 10 * time.Minute
+)
+
+var (
+	logger = log.NewLogger("export")
+
+	errNotSupported = errors.New("storage does not support iteration over peers")
+)
+
+// Config holds export parameters
+type Config struct {
+	// Path of file, where list is written every Interval,
+	// empty value disables writing
+	Path string `yaml:"path"`
+	// Interval is the period between two writes
+	Interval time.Duration `yaml:"interval"`
+	// Format of file: json (default) or csv
+	Format string `yaml:"format"`
+	// MinPeers is the minimal number of peers (seeders and leechers)
+	// of exported swarm
+	MinPeers uint32 `yaml:"min_peers"`
+	// Endpoint enables `/export/swarms` on ops server
+	Endpoint bool `yaml:"endpoint"`
+}
+
+// Enabled returns true if list is written into file or served by ops server
+func (cfg Config) Enabled() bool {
+	return len(cfg.Path) > 0 || cfg.Endpoint
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	switch cfg.Format {
+	case "":
+		validCfg.Format = FormatJSON
+	case FormatJSON, FormatCSV:
+	default:
+		err = fmt.Errorf("unknown export format '%s'", cfg.Format)
+		return
+	}
+	if len(cfg.Path) > 0 && cfg.Interval <= 0 {
+		validCfg.Interval = defaultInterval
+		logger.Warn().
+			Str("name", "Interval").
+			Dur("provided", cfg.Interval).
+			Dur("default", validCfg.Interval).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// Swarm is the exported state of swarm
+type Swarm struct {
+	InfoHash string `json:"info_hash"`
+	Seeders  uint32 `json:"seeders"`
+	Leechers uint32 `json:"leechers"`
+}
+
+// List is the exported list of swarms
+type List struct {
+	Time   time.Time `json:"time"`
+	Swarms []Swarm   `json:"swarms"`
+}
+
+// Collect returns swarms stored in ps with at least minPeers peers
+// sorted by info hash. Storage must implement storage.Dumper.
+func Collect(ctx context.Context, ps storage.PeerStorage, minPeers uint32) (l List, err error) {
+	d, ok := ps.(storage.Dumper)
+	if !ok {
+		return l, errNotSupported
+	}
+	l.Time = time.Now()
+	counts := make(map[bittorrent.InfoHash]*Swarm)
+	err = d.Dump(ctx, func(ih bittorrent.InfoHash, _ bittorrent.Peer, seeder bool) error {
+		s := counts[ih]
+		if s == nil {
+			s = &Swarm{InfoHash: ih.String()}
+			counts[ih] = s
+		}
+		if seeder {
+			s.Seeders++
+		} else {
+			s.Leechers++
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	l.Swarms = make([]Swarm, 0, len(counts))
+	for _, s := range counts {
+		if s.Seeders+s.Leechers >= minPeers {
+			l.Swarms = append(l.Swarms, *s)
+		}
+	}
+	slices.SortFunc(l.Swarms, func(a, b Swarm) int {
+		return cmp.Compare(a.InfoHash, b.InfoHash)
+	})
+	return
+}
+
+// Write writes list in format (FormatJSON or FormatCSV).
+// CSV contains header and does not contain time of list.
+func Write(w io.Writer, format string, l List) error {
+	switch format {
+	case FormatJSON, "":
+		return json.NewEncoder(w).Encode(l)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"info_hash", "seeders", "leechers"})
+		for _, s := range l.Swarms {
+			_ = cw.Write([]string{
+				s.InfoHash,
+				strconv.FormatUint(uint64(s.Seeders), 10),
+				strconv.FormatUint(uint64(s.Leechers), 10),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown export format '%s'", format)
+	}
+}
+
+// Exporter periodically writes list of swarms into file
+type Exporter struct {
+	cfg Config
+	ps  storage.PeerStorage
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+// NewExporter creates Exporter and starts writing, if Config.Path is set
+func NewExporter(cfg Config, ps storage.PeerStorage) (*Exporter, error) {
+	var err error
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if _, ok := ps.(storage.Dumper); !ok {
+		return nil, errNotSupported
+	}
+	e := &Exporter{cfg: cfg, ps: ps, closed: make(chan any)}
+	if len(cfg.Path) > 0 {
+		e.wg.Add(1)
+		go e.run()
+	}
+	return e, nil
+}
+
+func (e *Exporter) run() {
+	defer e.wg.Done()
+	t := time.NewTicker(e.cfg.Interval)
+	defer t.Stop()
+	for {
+		if err := e.WriteFile(context.Background()); err != nil {
+			logger.Error().Err(err).Str("path", e.cfg.Path).Msg("unable to export swarms")
+		}
+		select {
+		case <-e.closed:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Export writes the current list of swarms in format into w
+// (format of configuration is used if empty)
+func (e *Exporter) Export(ctx context.Context, w io.Writer, format string) error {
+	l, err := Collect(ctx, e.ps, e.cfg.MinPeers)
+	if err != nil {
+		return err
+	}
+	return Write(w, cmp.Or(format, e.cfg.Format), l)
+}
+
+// WriteFile writes the current list of swarms into configured file.
+// List is written into temporary file, which replaces target,
+// so readers never see partially written list.
+func (e *Exporter) WriteFile(ctx context.Context) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(e.cfg.Path), "."+filepath.Base(e.cfg.Path)+".*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	l, err := Collect(ctx, e.ps, e.cfg.MinPeers)
+	if err != nil {
+		return
+	}
+	bw := bufio.NewWriter(f)
+	if err = Write(bw, e.cfg.Format, l); err != nil {
+		return
+	}
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	// temporary file is created only readable by owner
+	if err = f.Chmod(0o644); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), e.cfg.Path); err == nil {
+		logger.Debug().Str("path", e.cfg.Path).Int("swarms", len(l.Swarms)).Msg("swarms exported")
+	}
+	return
+}
+
+// Close stops writing
+func (e *Exporter) Close() error {
+	e.onceCloser.Do(func() {
+		close(e.closed)
+		e.wg.Wait()
+	})
+	return nil
+}
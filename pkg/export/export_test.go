@@ -0,0 +1,52 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestExport(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx := context.Background()
+	ih1, ih2 := bittorrent.InfoHash("11111111111111111111"), bittorrent.InfoHash("22222222222222222222")
+	require.Nil(t, ps.PutSeeder(ctx, ih2, bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}))
+	require.Nil(t, ps.PutLeecher(ctx, ih2, bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.5:6881")}))
+	require.Nil(t, ps.PutLeecher(ctx, ih1, bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}))
+
+	l, err := Collect(ctx, ps, 0)
+	require.Nil(t, err)
+	require.Equal(t, []Swarm{
+		{InfoHash: ih1.String(), Leechers: 1},
+		{InfoHash: ih2.String(), Seeders: 1, Leechers: 1},
+	}, l.Swarms)
+
+	_, err = NewExporter(Config{Format: "xml"}, ps)
+	require.NotNil(t, err)
+
+	path := filepath.Join(t.TempDir(), "swarms.csv")
+	e, err := NewExporter(Config{Path: path, Format: FormatCSV, MinPeers: 2}, ps)
+	require.Nil(t, err)
+	require.Nil(t, e.Close())
+	require.Nil(t, e.WriteFile(ctx))
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "info_hash,seeders,leechers\n"+ih2.String()+",1,1\n", string(b))
+
+	var buf bytes.Buffer
+	require.Nil(t, e.Export(ctx, &buf, FormatJSON))
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &l))
+	require.Equal(t, []Swarm{{InfoHash: ih2.String(), Seeders: 1, Leechers: 1}}, l.Swarms)
+}
@@ -0,0 +1,142 @@
+//go:build linux
+
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// journaldSocket is the path of systemd-journald native protocol socket
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldWriter sends events to systemd-journald using native protocol.
+// JSON fields of event are sent as upper-cased journal fields,
+// `message` field as MESSAGE.
+type journaldWriter struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+	tag  string
+	pool sync.Pool
+}
+
+func newJournaldWriter(tag string) (zerolog.LevelWriter, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{
+		conn: conn,
+		addr: &net.UnixAddr{Name: journaldSocket, Net: "unixgram"},
+		tag:  tag,
+		pool: sync.Pool{New: func() any { return new(bytes.Buffer) }},
+	}, nil
+}
+
+// journaldPriority maps zerolog level to syslog priority
+func journaldPriority(l zerolog.Level) byte {
+	switch l {
+	case zerolog.TraceLevel, zerolog.DebugLevel:
+		return '7'
+	case zerolog.InfoLevel, zerolog.NoLevel:
+		return '6'
+	case zerolog.WarnLevel:
+		return '4'
+	case zerolog.ErrorLevel:
+		return '3'
+	case zerolog.FatalLevel:
+		return '2'
+	case zerolog.PanicLevel:
+		return '0'
+	default:
+		return '5'
+	}
+}
+
+// appendField writes field in journald native format,
+// values with new lines are written in binary form
+func appendField(b *bytes.Buffer, key, value string) {
+	b.WriteString(key)
+	if strings.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+		b.WriteString(value)
+	} else {
+		b.WriteByte('\n')
+		_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value)
+	}
+	b.WriteByte('\n')
+}
+
+// journaldKey converts JSON field name into valid journal field name
+func journaldKey(k string) string {
+	k = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, k)
+	return strings.TrimLeft(k, "_0123456789")
+}
+
+func (jw *journaldWriter) Write(p []byte) (int, error) {
+	return jw.WriteLevel(zerolog.NoLevel, p)
+}
+
+// WriteLevel implements zerolog.LevelWriter
+func (jw *journaldWriter) WriteLevel(l zerolog.Level, p []byte) (n int, err error) {
+	b := jw.pool.Get().(*bytes.Buffer)
+	defer jw.pool.Put(b)
+	b.Reset()
+	b.WriteString("PRIORITY=")
+	b.WriteByte(journaldPriority(l))
+	b.WriteByte('\n')
+	appendField(b, "SYSLOG_IDENTIFIER", jw.tag)
+
+	var fields map[string]any
+	if err = json.Unmarshal(p, &fields); err != nil {
+		appendField(b, "MESSAGE", string(bytes.TrimSpace(p)))
+	} else {
+		for k, v := range fields {
+			var value string
+			if s, ok := v.(string); ok {
+				value = s
+			} else if bb, err := json.Marshal(v); err == nil {
+				value = string(bb)
+			} else {
+				value = fmt.Sprint(v)
+			}
+			switch k {
+			case zerolog.MessageFieldName:
+				k = "MESSAGE"
+			case zerolog.LevelFieldName:
+				continue
+			default:
+				if k = journaldKey(k); len(k) == 0 {
+					continue
+				}
+			}
+			appendField(b, k, value)
+		}
+	}
+	if _, err = jw.conn.WriteToUnix(b.Bytes(), jw.addr); err == nil {
+		n = len(p)
+	}
+	return
+}
+
+// Close closes journald socket
+func (jw *journaldWriter) Close() error {
+	return jw.conn.Close()
+}
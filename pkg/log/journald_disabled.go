@@ -0,0 +1,9 @@
+//go:build !linux
+
+package log
+
+import "github.com/rs/zerolog"
+
+func newJournaldWriter(_ string) (zerolog.LevelWriter, error) {
+	return nil, errUnsupported
+}
@@ -7,83 +7,213 @@
 package log
 
 import (
+	"fmt"
 	"io"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 
-	// needs for async file logging
-	_ "code.cloudfoundry.org/go-diodes"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/diode"
 	zl "github.com/rs/zerolog/log"
 )
 
 var (
-	root        = zl.Logger
-	rootMu      = sync.Mutex{}
-	customOut   io.WriteCloser
-	customOutMu = sync.Mutex{}
+	// base is the root logger without hooks, child loggers are derived from it
+	base   = zl.Logger
+	root   atomic.Pointer[zerolog.Logger]
+	rootMu = sync.Mutex{}
+	// generation is changed every time base is changed,
+	// child loggers are derived again on the next call
+	generation atomic.Uint64
+	// levels per-component levels, key is component name or
+	// its prefix, terminated by `/`
+	levels map[string]zerolog.Level
+	// sampling overrides values of all SampledLogger-s
+	sampling  *SamplingConfig
+	closers   []io.Closer
+	closersMu = sync.Mutex{}
 )
 
-// ConfigureLogger initializes root and all child loggers.
+func init() {
+	setBase(base)
+}
+
+// setBase replaces base and root loggers, must be called with locked rootMu
+func setBase(lg zerolog.Logger) {
+	base = lg
+	r := base.Hook(recentHook{})
+	root.Store(&r)
+	generation.Add(1)
+}
+
+// Config represents logging configuration
+type Config struct {
+	// Level default logging level: trace, debug, info, warn (default), error, fatal, panic
+	Level string `yaml:"level"`
+	// Levels per-component logging levels. Key is the component name (i.e. `frontend/udp`)
+	// or its parent (`storage` applies to `storage/redis` and others), dot may be used
+	// instead of slash (`frontend.udp`). The most specific key is used.
+	Levels map[string]string `yaml:"levels"`
+	// Outputs list of log sinks, if empty, logs are written to stderr
+	Outputs []OutputConfig `yaml:"outputs"`
+	// Sampling overrides sampling of hot path events (i.e. per-packet debug messages)
+	Sampling *SamplingConfig `yaml:"sampling"`
+}
+
+// SamplingConfig represents configuration of SampledLogger-s
+type SamplingConfig struct {
+	// Every logs 1 of Every events with the same key, 0 or 1 - every event
+	Every uint32 `yaml:"every"`
+	// PerSecond maximum number of events with the same key per second, 0 - not limited
+	PerSecond uint32 `yaml:"per_second"`
+}
+
+// ConfigureLogger initializes root and all child loggers with single output.
+// output might be `stderr`, `stdout` or file path.
 // NOTE: this function MUST be called before any child log call
 //
 //	otherwise any goroutine, which uses logger will wait logger initialization
-func ConfigureLogger(output, level string, formatted, colored bool) (err error) {
-	lvl := zerolog.WarnLevel
-	var w io.Writer
-	switch strings.ToLower(output) {
-	case "stderr", "":
-		w = os.Stderr
-	case "stdout":
-		w = os.Stdout
+func ConfigureLogger(output, level string, formatted, colored bool) error {
+	out := OutputConfig{Pretty: formatted, Colored: colored}
+	switch o := strings.ToLower(output); o {
+	case OutputStderr, "":
+		out.Type = OutputStderr
+	case OutputStdout:
+		out.Type = o
 	default:
-		if w, err = os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err == nil {
-			customOutMu.Lock()
-			defer customOutMu.Unlock()
-			customOut = diode.NewWriter(w, 1000, 0, func(missed int) {
-				zl.Warn().Int("count", missed).Msg("Logger dropped messages")
-			})
-			w = customOut
-		} else {
+		out.Type, out.Path = OutputFile, output
+	}
+	return Configure(Config{Level: level, Outputs: []OutputConfig{out}})
+}
+
+// Configure initializes root and all child loggers.
+// NOTE: this function MUST be called before any child log call
+//
+//	otherwise any goroutine, which uses logger will wait logger initialization
+func Configure(cfg Config) (err error) {
+	lvl := zerolog.WarnLevel
+	if len(cfg.Level) > 0 {
+		if lvl, err = zerolog.ParseLevel(strings.ToLower(cfg.Level)); err != nil {
 			return err
 		}
 	}
-	if formatted {
-		w = zerolog.ConsoleWriter{
-			Out:        w,
-			NoColor:    !colored,
-			TimeFormat: "2006-01-02 15:04:05.999",
+	minLvl := lvl
+	compLevels := make(map[string]zerolog.Level, len(cfg.Levels))
+	for comp, l := range cfg.Levels {
+		var compLvl zerolog.Level
+		if compLvl, err = zerolog.ParseLevel(strings.ToLower(l)); err != nil {
+			return fmt.Errorf("component '%s': %w", comp, err)
 		}
+		compLevels[strings.Trim(strings.ReplaceAll(comp, ".", "/"), "/")] = compLvl
+		minLvl = min(minLvl, compLvl)
 	}
-	if len(level) > 0 {
-		if logLevel, err := zerolog.ParseLevel(strings.ToLower(level)); err == nil {
-			lvl = logLevel
-		} else {
-			return err
+
+	outputs := cfg.Outputs
+	if len(outputs) == 0 {
+		outputs = []OutputConfig{{Type: OutputStderr}}
+	}
+	ws := make([]io.Writer, 0, len(outputs))
+	cls := make([]io.Closer, 0, len(outputs))
+	for _, o := range outputs {
+		var w io.Writer
+		var c io.Closer
+		if w, c, err = o.newWriter(); err != nil {
+			for _, c := range cls {
+				_ = c.Close()
+			}
+			return fmt.Errorf("output '%s': %w", o.Type, err)
+		}
+		ws = append(ws, w)
+		if c != nil {
+			cls = append(cls, c)
 		}
 	}
+	var w io.Writer
+	if len(ws) == 1 {
+		w = ws[0]
+	} else {
+		w = zerolog.MultiLevelWriter(ws...)
+	}
+
+	closersMu.Lock()
+	closers = append(closers, cls...)
+	closersMu.Unlock()
+
 	rootMu.Lock()
 	defer rootMu.Unlock()
-	root = zerolog.New(w).With().Timestamp().Logger()
-	zerolog.SetGlobalLevel(lvl)
+	levels = compLevels
+	sampling = cfg.Sampling
+	zerolog.SetGlobalLevel(minLvl)
+	setBase(zerolog.New(w).Level(lvl).With().Timestamp().Logger())
 	return nil
 }
 
+// SetLevel changes default logging level of root and all child loggers
+// at runtime. Per-component levels (Config.Levels) are not changed.
+func SetLevel(level string) error {
+	lvl, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil {
+		return err
+	}
+	rootMu.Lock()
+	defer rootMu.Unlock()
+	minLvl := lvl
+	for _, l := range levels {
+		minLvl = min(minLvl, l)
+	}
+	zerolog.SetGlobalLevel(minLvl)
+	setBase(base.Level(lvl))
+	return nil
+}
+
+// Level returns default logging level
+func Level() string {
+	rootMu.Lock()
+	defer rootMu.Unlock()
+	return base.GetLevel().String()
+}
+
+// componentLevel returns level of the most specific
+// configured component or false if not found
+func componentLevel(comp string) (zerolog.Level, bool) {
+	for {
+		if lvl, ok := levels[comp]; ok {
+			return lvl, true
+		}
+		i := strings.LastIndexByte(comp, '/')
+		if i < 0 {
+			return zerolog.NoLevel, false
+		}
+		comp = comp[:i]
+	}
+}
+
 // Logger is the holder for zerolog.Logger which
 // waits until root logger initialized to prevent
 // mixed logging format and output
 type Logger struct {
-	comp   string
-	zlOnce sync.Once
-	zerolog.Logger
+	comp string
+	// gen is the generation of base, from which lg is derived
+	gen atomic.Uint64
+	lg  atomic.Pointer[zerolog.Logger]
 }
 
-func (l *Logger) init() {
-	l.zlOnce.Do(func() {
-		l.Logger = root.With().Str("component", l.comp).Logger()
-	})
+// logger returns zerolog.Logger derived from the current base
+func (l *Logger) logger() *zerolog.Logger {
+	if gen := generation.Load(); l.gen.Load() != gen {
+		rootMu.Lock()
+		defer rootMu.Unlock()
+		if gen = generation.Load(); l.gen.Load() != gen {
+			lg := base
+			if lvl, ok := componentLevel(l.comp); ok {
+				lg = lg.Level(lvl)
+			}
+			lg = lg.With().Str("component", l.comp).Logger().Hook(recentHook{comp: l.comp})
+			l.lg.Store(&lg)
+			l.gen.Store(gen)
+		}
+	}
+	return l.lg.Load()
 }
 
 // ==== copied from zerolog ====
@@ -92,40 +222,35 @@ func (l *Logger) init() {
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Trace() *zerolog.Event {
-	l.init()
-	return l.Logger.Trace()
+	return l.logger().Trace()
 }
 
 // Debug starts a new message with debug level.
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Debug() *zerolog.Event {
-	l.init()
-	return l.Logger.Debug()
+	return l.logger().Debug()
 }
 
 // Info starts a new message with info level.
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Info() *zerolog.Event {
-	l.init()
-	return l.Logger.Info()
+	return l.logger().Info()
 }
 
 // Warn starts a new message with warn level.
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Warn() *zerolog.Event {
-	l.init()
-	return l.Logger.Warn()
+	return l.logger().Warn()
 }
 
 // Error starts a new message with error level.
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Error() *zerolog.Event {
-	l.init()
-	return l.Logger.Error()
+	return l.logger().Error()
 }
 
 // Err starts a new message with error level with err as a field if not nil or
@@ -133,8 +258,7 @@ func (l *Logger) Error() *zerolog.Event {
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Err(err error) *zerolog.Event {
-	l.init()
-	return l.Logger.Err(err)
+	return l.logger().Err(err)
 }
 
 // Fatal starts a new message with fatal level. The os.Exit(1) function
@@ -142,8 +266,7 @@ func (l *Logger) Err(err error) *zerolog.Event {
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Fatal() *zerolog.Event {
-	l.init()
-	return l.Logger.Fatal()
+	return l.logger().Fatal()
 }
 
 // Panic starts a new message with panic level. The panic() function
@@ -151,8 +274,7 @@ func (l *Logger) Fatal() *zerolog.Event {
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Panic() *zerolog.Event {
-	l.init()
-	return l.Logger.Panic()
+	return l.logger().Panic()
 }
 
 // WithLevel starts a new message with level. Unlike Fatal and Panic
@@ -161,8 +283,7 @@ func (l *Logger) Panic() *zerolog.Event {
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) WithLevel(level zerolog.Level) *zerolog.Event {
-	l.init()
-	return l.Logger.WithLevel(level)
+	return l.logger().WithLevel(level)
 }
 
 // Log starts a new message with no level. Setting GlobalLevel to Disabled
@@ -170,29 +291,25 @@ func (l *Logger) WithLevel(level zerolog.Level) *zerolog.Event {
 //
 // You must call Msg on the returned event in order to send the event.
 func (l *Logger) Log() *zerolog.Event {
-	l.init()
-	return l.Logger.Log()
+	return l.logger().Log()
 }
 
 // Print sends a log event using debug level and no extra field.
 // Arguments are handled in the manner of fmt.Print.
 func (l *Logger) Print(v ...any) {
-	l.init()
-	l.Logger.Print(v...)
+	l.logger().Print(v...)
 }
 
 // Printf sends a log event using debug level and no extra field.
 // Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Printf(format string, v ...any) {
-	l.init()
-	l.Logger.Printf(format, v...)
+	l.logger().Printf(format, v...)
 }
 
 // Write implements the io.Writer interface. This is useful to set as a writer
 // for the standard library log.
 func (l *Logger) Write(p []byte) (n int, err error) {
-	l.init()
-	return l.Logger.Write(p)
+	return l.logger().Write(p)
 }
 
 // Err starts a new message with error level with err as a field if not nil or
@@ -200,42 +317,42 @@ func (l *Logger) Write(p []byte) (n int, err error) {
 //
 // You must call Msg on the returned event in order to send the event.
 func Err(err error) *zerolog.Event {
-	return root.Err(err)
+	return root.Load().Err(err)
 }
 
 // Trace starts a new message with trace level.
 //
 // You must call Msg on the returned event in order to send the event.
 func Trace() *zerolog.Event {
-	return root.Trace()
+	return root.Load().Trace()
 }
 
 // Debug starts a new message with debug level.
 //
 // You must call Msg on the returned event in order to send the event.
 func Debug() *zerolog.Event {
-	return root.Debug()
+	return root.Load().Debug()
 }
 
 // Info starts a new message with info level.
 //
 // You must call Msg on the returned event in order to send the event.
 func Info() *zerolog.Event {
-	return root.Info()
+	return root.Load().Info()
 }
 
 // Warn starts a new message with warn level.
 //
 // You must call Msg on the returned event in order to send the event.
 func Warn() *zerolog.Event {
-	return root.Warn()
+	return root.Load().Warn()
 }
 
 // Error starts a new message with error level.
 //
 // You must call Msg on the returned event in order to send the event.
 func Error() *zerolog.Event {
-	return root.Error()
+	return root.Load().Error()
 }
 
 // Fatal starts a new message with fatal level. The os.Exit(1) function
@@ -243,7 +360,7 @@ func Error() *zerolog.Event {
 //
 // You must call Msg on the returned event in order to send the event.
 func Fatal() *zerolog.Event {
-	return root.Fatal()
+	return root.Load().Fatal()
 }
 
 // Panic starts a new message with panic level. The message is also sent
@@ -251,14 +368,14 @@ func Fatal() *zerolog.Event {
 //
 // You must call Msg on the returned event in order to send the event.
 func Panic() *zerolog.Event {
-	return root.Panic()
+	return root.Load().Panic()
 }
 
 // WithLevel starts a new message with level.
 //
 // You must call Msg on the returned event in order to send the event.
 func WithLevel(level zerolog.Level) *zerolog.Event {
-	return root.WithLevel(level)
+	return root.Load().WithLevel(level)
 }
 
 // Log starts a new message with no level. Setting zerolog.GlobalLevel to
@@ -266,29 +383,29 @@ func WithLevel(level zerolog.Level) *zerolog.Event {
 //
 // You must call Msg on the returned event in order to send the event.
 func Log() *zerolog.Event {
-	return root.Log()
+	return root.Load().Log()
 }
 
 // Print sends a log event using debug level and no extra field.
 // Arguments are handled in the manner of fmt.Print.
 func Print(v ...any) {
-	root.Print(v...)
+	root.Load().Print(v...)
 }
 
 // Printf sends a log event using debug level and no extra field.
 // Arguments are handled in the manner of fmt.Printf.
 func Printf(format string, v ...any) {
-	root.Printf(format, v...)
+	root.Load().Printf(format, v...)
 }
 
-// Close closes custom output writer if it configured
+// Close closes configured output writers (files, syslog etc.)
 func Close() {
-	customOutMu.Lock()
-	defer customOutMu.Unlock()
-	if customOut != nil {
-		_ = customOut.Close()
-		customOut = nil
+	closersMu.Lock()
+	defer closersMu.Unlock()
+	for _, c := range closers {
+		_ = c.Close()
 	}
+	closers = nil
 }
 
 // NewLogger creates child logger with specified component name
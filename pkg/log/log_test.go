@@ -0,0 +1,199 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComponentLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.log")
+	require.Nil(t, Configure(Config{
+		Level: "warn",
+		Levels: map[string]string{
+			"frontend.udp": "debug",
+			"storage":      "error",
+		},
+		Outputs: []OutputConfig{{Type: OutputFile, Path: path}},
+	}))
+
+	lvl, ok := componentLevel("storage/redis")
+	require.True(t, ok)
+	require.Equal(t, zerolog.ErrorLevel, lvl)
+	_, ok = componentLevel("frontend/http")
+	require.False(t, ok)
+
+	NewLogger("frontend/udp").Debug().Msg("udp debug")
+	NewLogger("frontend/http").Debug().Msg("http debug")
+	NewLogger("storage/redis").Warn().Msg("redis warn")
+	NewLogger("storage/redis").Error().Msg("redis error")
+	Info().Msg("root info")
+	Warn().Msg("root warn")
+	Close()
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	out := string(b)
+	require.Contains(t, out, "udp debug")
+	require.NotContains(t, out, "http debug")
+	require.NotContains(t, out, "redis warn")
+	require.Contains(t, out, "redis error")
+	require.NotContains(t, out, "root info")
+	require.Contains(t, out, "root warn")
+
+	require.NotNil(t, Configure(Config{Levels: map[string]string{"storage": "none"}}))
+	require.NotNil(t, Configure(Config{Outputs: []OutputConfig{{Type: "unknown"}}}))
+}
+
+func TestSetLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.log")
+	require.Nil(t, Configure(Config{
+		Level:   "warn",
+		Levels:  map[string]string{"storage": "error"},
+		Outputs: []OutputConfig{{Type: OutputFile, Path: path}},
+	}))
+	l, st := NewLogger("frontend/http"), NewLogger("storage/redis")
+	l.Info().Msg("info before")
+	require.Nil(t, SetLevel("info"))
+	require.Equal(t, "info", Level())
+	l.Info().Msg("info after")
+	st.Warn().Msg("storage warn")
+	Info().Msg("root info")
+	require.Nil(t, SetLevel("warn"))
+	l.Info().Msg("info restored")
+	require.NotNil(t, SetLevel("none"))
+	Close()
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	out := string(b)
+	require.NotContains(t, out, "info before")
+	require.Contains(t, out, "info after")
+	require.NotContains(t, out, "storage warn")
+	require.Contains(t, out, "root info")
+	require.NotContains(t, out, "info restored")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.log")
+	rf, err := newRotatingFile(path, 10, time.Hour, 2)
+	require.Nil(t, err)
+	line := []byte("12345678\n")
+	for i := 0; i < 5; i++ {
+		_, err = rf.Write(line)
+		require.Nil(t, err)
+		// backup names have millisecond precision
+		time.Sleep(2 * time.Millisecond)
+	}
+	require.Nil(t, rf.Close())
+	_, err = rf.Write(line)
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	rf.cleanup()
+	backups, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	require.Len(t, backups, 2)
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, string(line), string(b))
+	for _, bk := range backups {
+		require.True(t, strings.HasPrefix(bk, path+"."))
+	}
+}
+
+func TestRotatingFileRenameFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.log")
+	rf, err := newRotatingFile(path, 10, 0, 0)
+	require.Nil(t, err)
+	defer rf.Close()
+	line := []byte("12345678\n")
+	_, err = rf.Write(line)
+	require.Nil(t, err)
+
+	// rename fails, but file is reopened by the original path
+	require.Nil(t, os.Remove(path))
+	n, err := rf.Write(line)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Equal(t, len(line), n)
+	_, err = rf.Write(line)
+	require.Nil(t, err)
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, string(line), string(b))
+}
+
+func TestSampler(t *testing.T) {
+	s := NewSampler(3, 0)
+	var logged int
+	for i := 0; i < 9; i++ {
+		if s.Sample("a") {
+			logged++
+		}
+	}
+	require.Equal(t, 3, logged)
+	// keys are independent
+	require.True(t, s.Sample("b"))
+
+	s = NewSampler(0, 2)
+	require.True(t, s.Sample("a"))
+	require.True(t, s.Sample("a"))
+	require.False(t, s.Sample("a"))
+	require.True(t, s.Sample("b"))
+}
+
+func TestSampledLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.log")
+	require.Nil(t, Configure(Config{
+		Level:   "info",
+		Outputs: []OutputConfig{{Type: OutputFile, Path: path}},
+	}))
+	l := NewSampledLogger("sampled", 2, 0)
+	for i := 0; i < 4; i++ {
+		// disabled events do not affect sampling
+		l.Debug("key").Msg("debug")
+		l.Info("key").Int("i", i).Msg("info")
+	}
+	Close()
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	out := string(b)
+	require.NotContains(t, out, "debug")
+	require.Contains(t, out, `"i":0`)
+	require.NotContains(t, out, `"i":1`)
+	require.Contains(t, out, `"i":2`)
+	require.NotContains(t, out, `"i":3`)
+}
+
+func TestRecentErrors(t *testing.T) {
+	require.Nil(t, Configure(Config{
+		Level:   "info",
+		Outputs: []OutputConfig{{Type: OutputFile, Path: filepath.Join(t.TempDir(), "mochi.log")}},
+	}))
+	defer Close()
+	NewLogger("recent").Warn().Msg("recent warn")
+	NewLogger("recent").Error().Msg("recent error 1")
+	Error().Msg("recent error 2")
+
+	entries := RecentErrors()
+	require.GreaterOrEqual(t, len(entries), 2)
+	require.Equal(t, "recent error 2", entries[0].Message)
+	require.Empty(t, entries[0].Component)
+	require.Equal(t, "recent error 1", entries[1].Message)
+	require.Equal(t, "recent", entries[1].Component)
+	require.Equal(t, zerolog.ErrorLevel.String(), entries[1].Level)
+
+	for i := 0; i < recentSize*2; i++ {
+		Error().Msg("overflow")
+	}
+	entries = RecentErrors()
+	require.Len(t, entries, recentSize)
+	for _, e := range entries {
+		require.Equal(t, "overflow", e.Message)
+	}
+}
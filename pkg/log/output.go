@@ -0,0 +1,132 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	// needs for async file logging
+	_ "code.cloudfoundry.org/go-diodes"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/diode"
+	zl "github.com/rs/zerolog/log"
+)
+
+// Output types, which may be provided in OutputConfig.Type
+const (
+	OutputStderr   = "stderr"
+	OutputStdout   = "stdout"
+	OutputFile     = "file"
+	OutputSyslog   = "syslog"
+	OutputJournald = "journald"
+)
+
+const (
+	diodeSize        = 1000
+	defaultSyslogTag = "mochi"
+)
+
+var (
+	errPathNotProvided = errors.New("path not provided")
+	errUnsupported     = errors.New("output is not supported on this platform")
+)
+
+// OutputConfig represents configuration of single log sink
+type OutputConfig struct {
+	// Type of output: stderr, stdout, file, syslog or journald
+	Type string `yaml:"type"`
+	// Level minimal level of events written to this output,
+	// if empty, all events are written
+	Level string `yaml:"level"`
+	// Pretty enables human-readable output instead of JSON
+	// (stderr, stdout and file)
+	Pretty bool `yaml:"pretty"`
+	// Colored enables coloring of pretty output
+	Colored bool `yaml:"colored"`
+	// Path to log file (file)
+	Path string `yaml:"path"`
+	// MaxSize maximum size of log file in megabytes before it is rotated,
+	// 0 - file is not rotated (file)
+	MaxSize int `yaml:"max_size"`
+	// MaxAge maximum time to retain rotated files, 0 - not limited (file)
+	MaxAge time.Duration `yaml:"max_age"`
+	// MaxBackups maximum number of rotated files to retain, 0 - not limited (file)
+	MaxBackups int `yaml:"max_backups"`
+	// Network and Address of syslog server, if empty,
+	// local syslog is used (syslog)
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	// Tag of syslog messages or journald SYSLOG_IDENTIFIER,
+	// default is `mochi` (syslog, journald)
+	Tag string `yaml:"tag"`
+}
+
+// newWriter creates writer and closer (if applicable) for output
+func (o OutputConfig) newWriter() (w io.Writer, c io.Closer, err error) {
+	tag := o.Tag
+	if len(tag) == 0 {
+		tag = defaultSyslogTag
+	}
+	t := strings.ToLower(o.Type)
+	switch t {
+	case OutputStderr, "":
+		w = os.Stderr
+	case OutputStdout:
+		w = os.Stdout
+	case OutputFile:
+		if len(o.Path) == 0 {
+			return nil, nil, errPathNotProvided
+		}
+		var f io.WriteCloser
+		if f, err = newRotatingFile(o.Path, int64(o.MaxSize)<<20, o.MaxAge, o.MaxBackups); err != nil {
+			return
+		}
+		dw := diode.NewWriter(f, diodeSize, 0, func(missed int) {
+			zl.Warn().Int("count", missed).Msg("Logger dropped messages")
+		})
+		w, c = dw, dw
+	case OutputSyslog:
+		var sw zerolog.LevelWriter
+		if sw, err = newSyslogWriter(o.Network, o.Address, tag); err != nil {
+			return
+		}
+		w, c = sw, sw.(io.Closer)
+	case OutputJournald:
+		var jw zerolog.LevelWriter
+		if jw, err = newJournaldWriter(tag); err != nil {
+			return
+		}
+		w, c = jw, jw.(io.Closer)
+	default:
+		return nil, nil, fmt.Errorf("unknown output type '%s'", o.Type)
+	}
+	if o.Pretty {
+		switch t {
+		case OutputSyslog, OutputJournald:
+		default:
+			w = zerolog.ConsoleWriter{
+				Out:        w,
+				NoColor:    !o.Colored,
+				TimeFormat: "2006-01-02 15:04:05.999",
+			}
+		}
+	}
+	if len(o.Level) > 0 {
+		var lvl zerolog.Level
+		if lvl, err = zerolog.ParseLevel(strings.ToLower(o.Level)); err != nil {
+			if c != nil {
+				_ = c.Close()
+			}
+			return nil, nil, err
+		}
+		lw, ok := w.(zerolog.LevelWriter)
+		if !ok {
+			lw = zerolog.LevelWriterAdapter{Writer: w}
+		}
+		w = &zerolog.FilteredLevelWriter{Writer: lw, Level: lvl}
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package log
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// recentSize is the number of the latest errors kept in memory
+const recentSize = 50
+
+// Entry is the logged error kept in memory
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Component string    `json:"component,omitempty"`
+	Message   string    `json:"message"`
+}
+
+var (
+	recentMu  sync.Mutex
+	recent    [recentSize]Entry
+	recentPos int
+	recentLen int
+)
+
+// recentHook keeps messages of error, fatal and panic events,
+// fields of event are not available for hooks, so only
+// message and component are kept
+type recentHook struct {
+	comp string
+}
+
+func (h recentHook) Run(_ *zerolog.Event, level zerolog.Level, msg string) {
+	if level < zerolog.ErrorLevel || level > zerolog.PanicLevel {
+		return
+	}
+	recentMu.Lock()
+	recent[recentPos] = Entry{Time: time.Now(), Level: level.String(), Component: h.comp, Message: msg}
+	recentPos = (recentPos + 1) % recentSize
+	recentLen = min(recentLen+1, recentSize)
+	recentMu.Unlock()
+}
+
+// RecentErrors returns the latest logged errors, newest first
+func RecentErrors() []Entry {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	out := make([]Entry, 0, recentLen)
+	for i := 1; i <= recentLen; i++ {
+		out = append(out, recent[(recentPos-i+recentSize)%recentSize])
+	}
+	return out
+}
@@ -0,0 +1,139 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the suffix of rotated file name,
+// lexicographical order of formatted values matches chronological
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is the io.WriteCloser which writes into file
+// and renames it to `<path>.<time>` if size of file exceeds maxSize.
+// After rotation, backups older than maxAge or exceeding maxBackups
+// count are removed.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	rf.cleanup()
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() (err error) {
+	if rf.f, err = os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err == nil {
+		var fi os.FileInfo
+		if fi, err = rf.f.Stat(); err == nil {
+			rf.size = fi.Size()
+		} else {
+			_ = rf.f.Close()
+			rf.f = nil
+		}
+	}
+	return
+}
+
+// Write writes p into file, rotating it before write if needed.
+// If rotation failed, but file is reopened, p is written
+// and rotation error is returned.
+func (rf *rotatingFile) Write(p []byte) (n int, err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if rotateErr = rf.rotate(); rf.f == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err = rf.f.Write(p)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return
+}
+
+// rotate closes and renames file, then opens new one by the original path.
+// File is reopened even if close or rename failed, so writes are not disabled.
+func (rf *rotatingFile) rotate() error {
+	err := rf.f.Close()
+	rf.f = nil
+	if err == nil {
+		err = os.Rename(rf.path, rf.path+"."+time.Now().Format(backupTimeFormat))
+	}
+	if openErr := rf.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	if err == nil {
+		go rf.cleanup()
+	}
+	return err
+}
+
+// cleanup removes outdated backups
+func (rf *rotatingFile) cleanup() {
+	if rf.maxAge <= 0 && rf.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	prefix := rf.path + "."
+	backups = slices.DeleteFunc(backups, func(b string) bool {
+		_, err := time.Parse(backupTimeFormat, strings.TrimPrefix(b, prefix))
+		return err != nil
+	})
+	slices.Sort(backups)
+	if rf.maxBackups > 0 && len(backups) > rf.maxBackups {
+		for _, b := range backups[:len(backups)-rf.maxBackups] {
+			_ = os.Remove(b)
+		}
+		backups = backups[len(backups)-rf.maxBackups:]
+	}
+	if rf.maxAge > 0 {
+		cutoff := time.Now().Add(-rf.maxAge)
+		for _, b := range backups {
+			if fi, err := os.Stat(b); err == nil && fi.ModTime().Before(cutoff) {
+				_ = os.Remove(b)
+			}
+		}
+	}
+}
+
+// Close closes underlying file
+func (rf *rotatingFile) Close() (err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f != nil {
+		err = rf.f.Close()
+		rf.f = nil
+	}
+	return
+}
@@ -0,0 +1,138 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+// DefaultPerSecond is the default maximum number of hot path
+// events with the same key logged per second
+const DefaultPerSecond = 10
+
+// Sampler decides whether event with specified key should be logged.
+// Event is logged if it is each Every-th event with this key (if Every > 1)
+// and not more than PerSecond events with this key were logged
+// during current second (if PerSecond > 0).
+//
+// Keys should be static identifiers of log statements (i.e. "generate"),
+// not request values, because state is kept for every key.
+type Sampler struct {
+	// Every logs 1 of Every events, 0 or 1 - every event
+	Every uint32
+	// PerSecond maximum number of events per second, 0 - not limited
+	PerSecond uint32
+
+	mu   sync.RWMutex
+	keys map[string]*sampleState
+}
+
+type sampleState struct {
+	counter atomic.Uint32
+	second  atomic.Int64
+	logged  atomic.Uint32
+}
+
+// NewSampler creates Sampler, which logs 1 of every events
+// and at most perSecond events per second for each key
+func NewSampler(every, perSecond uint32) *Sampler {
+	return &Sampler{Every: every, PerSecond: perSecond}
+}
+
+func (s *Sampler) state(key string) *sampleState {
+	s.mu.RLock()
+	st, ok := s.keys[key]
+	s.mu.RUnlock()
+	if !ok {
+		s.mu.Lock()
+		if st, ok = s.keys[key]; !ok {
+			if s.keys == nil {
+				s.keys = make(map[string]*sampleState)
+			}
+			st = new(sampleState)
+			s.keys[key] = st
+		}
+		s.mu.Unlock()
+	}
+	return st
+}
+
+// Sample returns true if event with key should be logged
+func (s *Sampler) Sample(key string) bool {
+	st := s.state(key)
+	if s.Every > 1 && (st.counter.Add(1)-1)%s.Every != 0 {
+		return false
+	}
+	if s.PerSecond > 0 {
+		now := timecache.NowUnix()
+		if sec := st.second.Load(); sec != now && st.second.CompareAndSwap(sec, now) {
+			st.logged.Store(0)
+		}
+		if st.logged.Add(1) > s.PerSecond {
+			return false
+		}
+	}
+	return true
+}
+
+// SampledLogger is the Logger which drops events according to Sampler.
+// Level check is performed before sampling, so disabled
+// events do not affect sampler's state.
+type SampledLogger struct {
+	*Logger
+	*Sampler
+	sampleOnce sync.Once
+}
+
+// NewSampledLogger creates SampledLogger for component,
+// see NewSampler for every and perSecond description.
+// Values may be overridden by Config.Sampling.
+func NewSampledLogger(component string, every, perSecond uint32) *SampledLogger {
+	return &SampledLogger{Logger: NewLogger(component), Sampler: NewSampler(every, perSecond)}
+}
+
+func (l *SampledLogger) event(level zerolog.Level, key string) *zerolog.Event {
+	lg := l.logger()
+	l.sampleOnce.Do(func() {
+		rootMu.Lock()
+		defer rootMu.Unlock()
+		if sampling != nil {
+			l.Every, l.PerSecond = sampling.Every, sampling.PerSecond
+		}
+	})
+	if level < lg.GetLevel() || level < zerolog.GlobalLevel() || !l.Sample(key) {
+		return nil
+	}
+	return lg.WithLevel(level)
+}
+
+// Trace starts a new message with trace level if event with key is sampled.
+//
+// You must call Msg on the returned event in order to send the event.
+func (l *SampledLogger) Trace(key string) *zerolog.Event {
+	return l.event(zerolog.TraceLevel, key)
+}
+
+// Debug starts a new message with debug level if event with key is sampled.
+//
+// You must call Msg on the returned event in order to send the event.
+func (l *SampledLogger) Debug(key string) *zerolog.Event {
+	return l.event(zerolog.DebugLevel, key)
+}
+
+// Info starts a new message with info level if event with key is sampled.
+//
+// You must call Msg on the returned event in order to send the event.
+func (l *SampledLogger) Info(key string) *zerolog.Event {
+	return l.event(zerolog.InfoLevel, key)
+}
+
+// Warn starts a new message with warn level if event with key is sampled.
+//
+// You must call Msg on the returned event in order to send the event.
+func (l *SampledLogger) Warn(key string) *zerolog.Event {
+	return l.event(zerolog.WarnLevel, key)
+}
@@ -0,0 +1,28 @@
+//go:build !windows && !plan9
+
+package log
+
+import (
+	"log/syslog"
+
+	"github.com/rs/zerolog"
+)
+
+type syslogWriter struct {
+	zerolog.LevelWriter
+	w *syslog.Writer
+}
+
+func (sw syslogWriter) Close() error {
+	return sw.w.Close()
+}
+
+// newSyslogWriter connects to syslog server, if network and address
+// are empty, local syslog is used
+func newSyslogWriter(network, address, tag string) (zerolog.LevelWriter, error) {
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogWriter{LevelWriter: zerolog.SyslogLevelWriter(w), w: w}, nil
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package log
+
+import "github.com/rs/zerolog"
+
+func newSyslogWriter(_, _, _ string) (zerolog.LevelWriter, error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,76 @@
+// Package lru implements the size-limited cache of values with expiration,
+// if cache is full, the least recently used value is dropped.
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+	until int64
+}
+
+// Cache is the LRU cache of values with expiration time (unix nanoseconds),
+// it is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	size    int
+	entries map[K]*list.Element
+	// lru is the list of entries, the most recently used is at front
+	lru *list.List
+	mu  sync.Mutex
+}
+
+// New creates Cache, which holds at most size values
+func New[K comparable, V any](size int) *Cache[K, V] {
+	return &Cache[K, V]{
+		size:    max(size, 1),
+		entries: make(map[K]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns value of key, if it is not expired at now
+func (c *Cache[K, V]) Get(key K, now int64) (v V, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, exists := c.entries[key]; exists {
+		if e := el.Value.(*entry[K, V]); e.until > now {
+			c.lru.MoveToFront(el)
+			return e.value, true
+		}
+	}
+	return
+}
+
+// Put stores value of key till until
+func (c *Cache[K, V]) Put(key K, v V, until int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &entry[K, V]{key: key, value: v, until: until}
+	if el, exists := c.entries[key]; exists {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		delete(c.entries, oldest.Value.(*entry[K, V]).key)
+		c.lru.Remove(oldest)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+}
+
+// Delete drops values of keys
+func (c *Cache[K, V]) Delete(keys ...K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		if el, exists := c.entries[k]; exists {
+			delete(c.entries, k)
+			c.lru.Remove(el)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package lru
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	c := New[string, int](2)
+	c.Put("a", 1, 10)
+	c.Put("b", 2, 10)
+	v, found := c.Get("a", 0)
+	require.True(t, found)
+	require.Equal(t, 1, v)
+
+	// the least recently used value is dropped
+	c.Put("c", 3, 10)
+	_, found = c.Get("b", 0)
+	require.False(t, found)
+	_, found = c.Get("a", 0)
+	require.True(t, found)
+
+	// expired value is not returned
+	_, found = c.Get("c", 10)
+	require.False(t, found)
+
+	c.Put("a", 4, 20)
+	v, _ = c.Get("a", 10)
+	require.Equal(t, 4, v)
+	c.Delete("a", "unknown")
+	_, found = c.Get("a", 0)
+	require.False(t, found)
+}
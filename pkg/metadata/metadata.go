@@ -0,0 +1,75 @@
+// Package metadata provides metadata of approved torrents, stored by
+// `list` or `directory` containers of torrent approval middleware,
+// so it may be used by other middlewares (i.e. categories of freeleech).
+package metadata
+
+import (
+	"context"
+
+	"github.com/zeebo/bencode"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// DUMMY used as value placeholder if storage needs some value with
+const DUMMY = "_"
+
+// Torrent is the approved torrent with its metadata.
+// Metadata is stored bencoded as value of torrent's hashes in storage,
+// so it may be used by other middlewares (see Load).
+type Torrent struct {
+	// InfoHash HEX-encoded info hash, used only in configuration.
+	InfoHash string `cfg:"info_hash" bencode:"-"`
+	// Magnet link of torrent, used only in configuration.
+	// Hashes are taken from `xt` parameters, Name from `dn`
+	// and Size from `xl`, if they are not set explicitly.
+	Magnet string `cfg:"magnet" bencode:"-"`
+	// Name of torrent
+	Name string `cfg:"name" bencode:"name,omitempty"`
+	// Category of torrent
+	Category string `cfg:"category" bencode:"category,omitempty"`
+	// Size of torrent's content in bytes
+	Size uint64 `cfg:"size" bencode:"size,omitempty"`
+}
+
+// Value returns storage value of torrent: bencoded metadata
+// or DUMMY if there is no metadata
+func (t Torrent) Value() []byte {
+	if len(t.Name) == 0 && len(t.Category) == 0 && t.Size == 0 {
+		return []byte(DUMMY)
+	}
+	b, err := bencode.EncodeBytes(t)
+	if err != nil {
+		// should never happen
+		return []byte(DUMMY)
+	}
+	return b
+}
+
+// decode decodes metadata stored by List or directory container.
+// Values, which are not bencoded dictionaries, are treated as
+// torrent name (i.e. stored by `s3` container).
+func decode(b []byte) (t Torrent) {
+	if len(b) == 0 || string(b) == DUMMY {
+		return
+	}
+	if b[0] != 'd' || bencode.DecodeBytes(b, &t) != nil {
+		t = Torrent{Name: string(b)}
+	}
+	return
+}
+
+// Load returns metadata of approved torrent, stored by `list`
+// or `directory` containers in storageCtx of st.
+// found is false if hash is not stored.
+func Load(ctx context.Context, st storage.DataStorage, storageCtx string, ih bittorrent.InfoHash) (t Torrent, found bool, err error) {
+	var b []byte
+	if b, err = st.Load(ctx, storageCtx, ih.RawString()); err == nil && len(b) == 0 && len(ih) == bittorrent.InfoHashV2Len {
+		b, err = st.Load(ctx, storageCtx, ih.TruncateV1().RawString())
+	}
+	if found = err == nil && len(b) > 0; found {
+		t = decode(b)
+	}
+	return
+}
@@ -1,5 +1,6 @@
 // Package metrics implements a standalone HTTP server for serving pprof
-// profiles and Prometheus metrics.
+// profiles and Prometheus metrics and exporter, which pushes
+// the same metrics into StatsD (DogStatsD) server.
 package metrics
 
 import (
@@ -0,0 +1,298 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// StatsD tag formats, which may be provided in StatsDConfig.Format
+const (
+	// FormatDogStatsD writes labels as DogStatsD tags: `name:1|c|#label:value`
+	FormatDogStatsD = "dogstatsd"
+	// FormatStatsD appends label values to metric name: `name.value:1|c`
+	FormatStatsD = "statsd"
+)
+
+const (
+	defaultStatsDInterval   = 10 * time.Second
+	defaultStatsDPacketSize = 1432
+)
+
+var errStatsDAddrNotProvided = errors.New("statsd address not provided")
+
+// StatsDConfig represents all the values required to push metrics
+// into StatsD (or DogStatsD) server
+type StatsDConfig struct {
+	// Addr host:port of StatsD server (UDP)
+	Addr string `yaml:"addr"`
+	// Format of tags: dogstatsd (default) or statsd
+	Format string `yaml:"format"`
+	// Prefix prepended to metric names
+	Prefix string `yaml:"prefix"`
+	// Tags added to every metric (dogstatsd format only)
+	Tags map[string]string `yaml:"tags"`
+	// Interval between pushes, default is 10s
+	Interval time.Duration `yaml:"interval"`
+	// PacketSize maximum size of UDP datagram, default is 1432
+	PacketSize int `yaml:"packet_size"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg StatsDConfig) Validate() (validCfg StatsDConfig, err error) {
+	validCfg = cfg
+	if len(cfg.Addr) == 0 {
+		err = errStatsDAddrNotProvided
+		return
+	}
+	switch cfg.Format {
+	case "":
+		validCfg.Format = FormatDogStatsD
+	case FormatDogStatsD, FormatStatsD:
+	default:
+		err = fmt.Errorf("unknown statsd format '%s'", cfg.Format)
+		return
+	}
+	if cfg.Interval <= 0 {
+		validCfg.Interval = defaultStatsDInterval
+		logger.Warn().
+			Str("name", "StatsD.Interval").
+			Dur("provided", cfg.Interval).
+			Dur("default", validCfg.Interval).
+			Msg("falling back to default configuration")
+	}
+	if cfg.PacketSize <= 0 {
+		validCfg.PacketSize = defaultStatsDPacketSize
+		logger.Warn().
+			Str("name", "StatsD.PacketSize").
+			Int("provided", cfg.PacketSize).
+			Int("default", validCfg.PacketSize).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// StatsDExporter periodically gathers registered Prometheus metrics
+// and pushes them to StatsD server. Counters are sent as deltas
+// since previous push, gauges as values, histograms and summaries
+// as `_count` and `_sum` counters.
+type StatsDExporter struct {
+	cfg        StatsDConfig
+	gatherer   prometheus.Gatherer
+	conn       net.Conn
+	globalTags string
+	// previous values of counters
+	last       map[string]float64
+	buf        bytes.Buffer
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+// NewStatsDExporter creates exporter for default Prometheus registry and starts it
+func NewStatsDExporter(cfg StatsDConfig) (*StatsDExporter, error) {
+	e, err := newStatsDExporter(cfg, prometheus.DefaultGatherer)
+	if err == nil {
+		atomic.AddInt32(serverCounter, 1)
+		e.wg.Add(1)
+		go e.run()
+	}
+	return e, err
+}
+
+func newStatsDExporter(cfg StatsDConfig, g prometheus.Gatherer) (*StatsDExporter, error) {
+	var err error
+	if cfg, err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if conn, err = net.Dial("udp", cfg.Addr); err != nil {
+		return nil, err
+	}
+	e := &StatsDExporter{
+		cfg:      cfg,
+		gatherer: g,
+		conn:     conn,
+		last:     make(map[string]float64),
+		closed:   make(chan any),
+	}
+	if cfg.Format == FormatDogStatsD && len(cfg.Tags) > 0 {
+		tags := make([]string, 0, len(cfg.Tags))
+		for k, v := range cfg.Tags {
+			tags = append(tags, sanitizeStatsD(k)+":"+sanitizeStatsD(v))
+		}
+		slices.Sort(tags)
+		e.globalTags = strings.Join(tags, ",")
+	}
+	return e, nil
+}
+
+func (e *StatsDExporter) run() {
+	defer e.wg.Done()
+	defer atomic.AddInt32(serverCounter, -1)
+	t := time.NewTicker(e.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.closed:
+			e.push()
+			return
+		case <-t.C:
+			e.push()
+		}
+	}
+}
+
+// sanitizeStatsD replaces characters reserved by StatsD protocol
+func sanitizeStatsD(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		default:
+			return r
+		}
+	}, s)
+}
+
+// push gathers metrics and sends them to server
+func (e *StatsDExporter) push() {
+	mfs, err := e.gatherer.Gather()
+	if err != nil {
+		logger.Warn().Err(err).Msg("unable to gather some metrics")
+	}
+	e.buf.Reset()
+	for _, mf := range mfs {
+		name := e.cfg.Prefix + mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				e.counter(name, m.GetLabel(), m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				e.gauge(name, m.GetLabel(), m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				e.gauge(name, m.GetLabel(), m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				e.counter(name+"_count", m.GetLabel(), float64(h.GetSampleCount()))
+				e.counter(name+"_sum", m.GetLabel(), h.GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				e.counter(name+"_count", m.GetLabel(), float64(s.GetSampleCount()))
+				e.counter(name+"_sum", m.GetLabel(), s.GetSampleSum())
+			}
+		}
+	}
+	e.flush()
+}
+
+// counter sends difference between current and previous values
+func (e *StatsDExporter) counter(name string, labels []*dto.LabelPair, v float64) {
+	metric, tags := e.series(name, labels)
+	key := metric + "|" + tags
+	prev, ok := e.last[key]
+	e.last[key] = v
+	// counter was reset or appeared first time
+	if !ok || v < prev {
+		prev = 0
+	}
+	if delta := v - prev; delta != 0 {
+		e.write(metric, tags, delta, "c")
+	}
+}
+
+func (e *StatsDExporter) gauge(name string, labels []*dto.LabelPair, v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	metric, tags := e.series(name, labels)
+	e.write(metric, tags, v, "g")
+}
+
+// series returns metric name with appended label values for statsd format
+// or metric name and serialized tags for dogstatsd
+func (e *StatsDExporter) series(name string, labels []*dto.LabelPair) (metric, tags string) {
+	metric = sanitizeStatsD(name)
+	if len(labels) == 0 {
+		return
+	}
+	sb := strings.Builder{}
+	if e.cfg.Format == FormatStatsD {
+		sb.WriteString(metric)
+		for _, l := range labels {
+			sb.WriteByte('.')
+			sb.WriteString(sanitizeStatsD(strings.ReplaceAll(l.GetValue(), ".", "_")))
+		}
+		metric = sb.String()
+	} else {
+		for i, l := range labels {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(sanitizeStatsD(l.GetName()))
+			sb.WriteByte(':')
+			sb.WriteString(sanitizeStatsD(l.GetValue()))
+		}
+		tags = sb.String()
+	}
+	return
+}
+
+// write appends line into buffer and flushes buffer if packet size exceeded
+func (e *StatsDExporter) write(metric, tags string, v float64, typ string) {
+	if len(e.globalTags) > 0 {
+		if len(tags) > 0 {
+			tags += ","
+		}
+		tags += e.globalTags
+	}
+	line := make([]byte, 0, len(metric)+len(tags)+32)
+	line = append(line, metric...)
+	line = append(line, ':')
+	line = strconv.AppendFloat(line, v, 'f', -1, 64)
+	line = append(line, '|')
+	line = append(line, typ...)
+	if len(tags) > 0 {
+		line = append(line, "|#"...)
+		line = append(line, tags...)
+	}
+	if e.buf.Len() > 0 && e.buf.Len()+len(line)+1 > e.cfg.PacketSize {
+		e.flush()
+	}
+	if e.buf.Len() > 0 {
+		e.buf.WriteByte('\n')
+	}
+	e.buf.Write(line)
+}
+
+func (e *StatsDExporter) flush() {
+	if e.buf.Len() == 0 {
+		return
+	}
+	if _, err := e.conn.Write(e.buf.Bytes()); err != nil {
+		logger.Warn().Err(err).Msg("unable to send metrics to statsd")
+	}
+	e.buf.Reset()
+}
+
+// Close pushes metrics last time and closes connection
+func (e *StatsDExporter) Close() (err error) {
+	e.onceCloser.Do(func() {
+		close(e.closed)
+		e.wg.Wait()
+		err = e.conn.Close()
+	})
+	return
+}
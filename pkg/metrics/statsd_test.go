@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsDExporter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	read := func() []string {
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		b := make([]byte, 2048)
+		n, _, err := conn.ReadFrom(b)
+		require.Nil(t, err)
+		lines := strings.Split(string(b[:n]), "\n")
+		return lines
+	}
+
+	for _, tc := range []struct {
+		format   string
+		expected []string
+	}{
+		{FormatDogStatsD, []string{
+			"mochi.test_duration_count:1|c|#env:test",
+			"mochi.test_duration_sum:0.5|c|#env:test",
+			"mochi.test_gauge:42|g|#env:test",
+			"mochi.test_total:2|c|#action:announce,env:test",
+		}},
+		{FormatStatsD, []string{
+			"mochi.test_duration_count:1|c",
+			"mochi.test_duration_sum:0.5|c",
+			"mochi.test_gauge:42|g",
+			"mochi.test_total.announce:2|c",
+		}},
+	} {
+		reg := prometheus.NewRegistry()
+		cnt := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "test"}, []string{"action"})
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "test"})
+		hist := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_duration", Help: "test"})
+		reg.MustRegister(cnt, gauge, hist)
+		e, err := newStatsDExporter(StatsDConfig{
+			Addr:   conn.LocalAddr().String(),
+			Format: tc.format,
+			Prefix: "mochi.",
+			Tags:   map[string]string{"env": "test"},
+		}, reg)
+		require.Nil(t, err)
+
+		cnt.WithLabelValues("announce").Add(2)
+		gauge.Set(42)
+		hist.Observe(0.5)
+		e.push()
+		require.Equal(t, tc.expected, read())
+
+		// only deltas of counters are sent
+		cnt.WithLabelValues("announce").Add(1)
+		e.push()
+		got := read()
+		require.Contains(t, got, tc.expected[2])
+		require.NotContains(t, got, tc.expected[0])
+		if tc.format == FormatDogStatsD {
+			require.Contains(t, got, "mochi.test_total:1|c|#action:announce,env:test")
+		} else {
+			require.Contains(t, got, "mochi.test_total.announce:1|c")
+		}
+		require.Nil(t, e.conn.Close())
+	}
+
+	_, err = newStatsDExporter(StatsDConfig{Addr: conn.LocalAddr().String(), Format: "unknown"}, prometheus.NewRegistry())
+	require.NotNil(t, err)
+}
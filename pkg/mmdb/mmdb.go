@@ -0,0 +1,304 @@
+// Package mmdb implements minimal reader of MaxMind DB format
+// (GeoLite2/GeoIP2 databases), see https://maxmind.github.io/MaxMind-DB/
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+var (
+	metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+	// ErrInvalidDatabase returned if database is corrupted or has unsupported format
+	ErrInvalidDatabase = errors.New("invalid MaxMind database")
+)
+
+// data section types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Metadata contains database description
+type Metadata struct {
+	NodeCount    uint32
+	RecordSize   uint16
+	IPVersion    uint16
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+// Reader performs lookups in database loaded into memory.
+// Reader is safe for concurrent use.
+type Reader struct {
+	Metadata
+	tree      []byte
+	data      []byte
+	ipv4Start uint32
+}
+
+// Open reads database from file
+func Open(path string) (*Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(b)
+}
+
+// New creates Reader from database content
+func New(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidDatabase)
+	}
+	md := b[i+len(metadataMarker):]
+	v, _, err := decoder(md).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+	r := new(Reader)
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	r.DatabaseType, _ = m["database_type"].(string)
+	r.BuildEpoch, _ = m["build_epoch"].(uint64)
+	r.NodeCount, r.RecordSize, r.IPVersion = uint32(nodeCount), uint16(recordSize), uint16(ipVersion)
+	switch r.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, r.RecordSize)
+	}
+	if r.IPVersion != 4 && r.IPVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", ErrInvalidDatabase, r.IPVersion)
+	}
+	treeSize := int(r.NodeCount) * int(r.RecordSize) / 4
+	// search tree is followed by 16 zero bytes
+	if treeSize+16 > i {
+		return nil, fmt.Errorf("%w: search tree is truncated", ErrInvalidDatabase)
+	}
+	r.tree, r.data = b[:treeSize], b[treeSize+16:i]
+	if r.IPVersion == 6 {
+		// IPv4 addresses are stored in ::/96 subtree
+		for n := 0; n < 96 && r.ipv4Start < r.NodeCount; n++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns left (bit is 0) or right (bit is 1) record of node
+func (r *Reader) record(node uint32, bit byte) uint32 {
+	switch r.RecordSize {
+	case 24:
+		b := r.tree[node*6+uint32(bit)*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(r.tree[node*8+uint32(bit)*4:])
+	}
+}
+
+// Lookup returns data associated with the network which contains provided address.
+// Maps are returned as map[string]any, unsigned integers as uint64.
+func (r *Reader) Lookup(addr netip.Addr) (v any, found bool, err error) {
+	addr = addr.Unmap()
+	var node uint32
+	if addr.Is4() {
+		if r.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.IPVersion == 4 {
+		return
+	}
+	ip := addr.AsSlice()
+	for i := 0; i < len(ip)*8 && node < r.NodeCount; i++ {
+		node = r.record(node, (ip[i/8]>>(7-i%8))&1)
+	}
+	switch {
+	case node == r.NodeCount:
+		return
+	case node < r.NodeCount:
+		err = fmt.Errorf("%w: invalid node in search tree", ErrInvalidDatabase)
+		return
+	}
+	off := node - r.NodeCount - 16
+	if int(off) >= len(r.data) {
+		err = fmt.Errorf("%w: invalid data pointer", ErrInvalidDatabase)
+		return
+	}
+	v, _, err = decoder(r.data).decode(int(off), 0)
+	found = err == nil
+	return
+}
+
+// maxDepth is the maximum depth of nested maps, arrays and pointers,
+// same as in libmaxminddb
+const maxDepth = 512
+
+// decoder decodes values of data section
+type decoder []byte
+
+func (d decoder) bytes(off, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > len(d) {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidDatabase)
+	}
+	return d[off : off+n], nil
+}
+
+func uintFrom(b []byte) (v uint64) {
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return
+}
+
+// decode decodes value at offset and returns it with offset of the next value.
+// depth is the nesting level of value, see maxDepth.
+func (d decoder) decode(off, depth int) (v any, next int, err error) {
+	if depth > maxDepth {
+		err = fmt.Errorf("%w: maximum data structure depth exceeded", ErrInvalidDatabase)
+		return
+	}
+	var b []byte
+	if b, err = d.bytes(off, 1); err != nil {
+		return
+	}
+	ctrl := b[0]
+	off++
+	t := int(ctrl >> 5)
+	if t == typePointer {
+		size := int(ctrl>>3) & 0x3
+		if b, err = d.bytes(off, size+1); err != nil {
+			return
+		}
+		p := uintFrom(b)
+		switch size {
+		case 0:
+			p |= uint64(ctrl&0x7) << 8
+		case 1:
+			p = p | uint64(ctrl&0x7)<<16 + 2048
+		case 2:
+			p = p | uint64(ctrl&0x7)<<24 + 526336
+		}
+		v, _, err = d.decode(int(p), depth+1)
+		next = off + size + 1
+		return
+	}
+	if t == typeExtended {
+		if b, err = d.bytes(off, 1); err != nil {
+			return
+		}
+		t = 7 + int(b[0])
+		off++
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if b, err = d.bytes(off, n); err != nil {
+			return
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + int(b[0])
+		case 2:
+			size = 285 + int(uintFrom(b))
+		default:
+			size = 65821 + int(uintFrom(b))
+		}
+	}
+	switch t {
+	case typeMap:
+		m := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			var k, val any
+			if k, off, err = d.decode(off, depth+1); err != nil {
+				return
+			}
+			ks, ok := k.(string)
+			if !ok {
+				err = fmt.Errorf("%w: map key is not a string", ErrInvalidDatabase)
+				return
+			}
+			if val, off, err = d.decode(off, depth+1); err != nil {
+				return
+			}
+			m[ks] = val
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, size)
+		for i := 0; i < size; i++ {
+			var val any
+			if val, off, err = d.decode(off, depth+1); err != nil {
+				return
+			}
+			a = append(a, val)
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	case typeContainer, typeEndMarker:
+		return nil, off, nil
+	}
+	if b, err = d.bytes(off, size); err != nil {
+		return
+	}
+	next = off + size
+	switch t {
+	case typeString:
+		v = string(b)
+	case typeBytes, typeUint128:
+		v = append([]byte(nil), b...)
+	case typeDouble:
+		if size != 8 {
+			err = fmt.Errorf("%w: invalid double size", ErrInvalidDatabase)
+		} else {
+			v = math.Float64frombits(binary.BigEndian.Uint64(b))
+		}
+	case typeFloat:
+		if size != 4 {
+			err = fmt.Errorf("%w: invalid float size", ErrInvalidDatabase)
+		} else {
+			v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		}
+	case typeUint16, typeUint32, typeUint64:
+		v = uintFrom(b)
+	case typeInt32:
+		s := 32 - 8*uint(size)
+		v = int(int32(uint32(uintFrom(b))<<s) >> s)
+	default:
+		err = fmt.Errorf("%w: unknown data type %d", ErrInvalidDatabase, t)
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package mmdb
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/pkg/mmdb/test"
+)
+
+func TestLookup(t *testing.T) {
+	r, err := New(test.Build("Test", map[netip.Prefix]any{
+		netip.MustParsePrefix("1.2.3.0/24"): map[string]any{
+			"number": uint32(64500),
+			"name":   "Example",
+			"flags":  []any{true, false},
+			"ratio":  0.5,
+		},
+		netip.MustParsePrefix("2001:db8::/32"): "v6",
+	}))
+	require.Nil(t, err)
+	require.Equal(t, uint16(6), r.IPVersion)
+	require.Equal(t, "Test", r.DatabaseType)
+
+	v, found, err := r.Lookup(netip.MustParseAddr("1.2.3.4"))
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, map[string]any{
+		"number": uint64(64500),
+		"name":   "Example",
+		"flags":  []any{true, false},
+		"ratio":  0.5,
+	}, v)
+
+	v, found, err = r.Lookup(netip.MustParseAddr("::ffff:1.2.3.255"))
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, "Example", v.(map[string]any)["name"])
+
+	v, found, err = r.Lookup(netip.MustParseAddr("2001:db8::1"))
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, "v6", v)
+
+	_, found, err = r.Lookup(netip.MustParseAddr("1.2.4.1"))
+	require.Nil(t, err)
+	require.False(t, found)
+
+	_, err = New([]byte("not a database"))
+	require.ErrorIs(t, err, ErrInvalidDatabase)
+}
+
+func TestDecodeDepth(t *testing.T) {
+	// pointer to itself
+	_, _, err := decoder{0x20, 0x00}.decode(0, 0)
+	require.ErrorIs(t, err, ErrInvalidDatabase)
+
+	// nested single element arrays
+	nested := func(n int) decoder {
+		d := bytes.Repeat([]byte{0x01, 0x04}, n)
+		// true
+		return append(d, 0x01, 0x07)
+	}
+	_, _, err = nested(maxDepth+1).decode(0, 0)
+	require.ErrorIs(t, err, ErrInvalidDatabase)
+	v, _, err := nested(maxDepth).decode(0, 0)
+	require.Nil(t, err)
+	for range maxDepth {
+		v = v.([]any)[0]
+	}
+	require.Equal(t, true, v)
+}
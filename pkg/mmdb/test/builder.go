@@ -0,0 +1,160 @@
+// Package test contains builder of MaxMind databases used in tests.
+// Not used in production.
+package test
+
+import (
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"sort"
+)
+
+const recordSize = 24
+
+// record kinds
+const (
+	empty = iota
+	node
+	data
+)
+
+type record struct {
+	kind, value int
+}
+
+// Build creates IPv6 database (with IPv4 networks in ::/96 subtree)
+// with 24-bit records, where each network is associated with value.
+// Networks must not overlap. Supported value types: string, bool, int,
+// uint16, uint32, uint64, float64, []any and map[string]any.
+func Build(dbType string, networks map[netip.Prefix]any) []byte {
+	nodes := [][2]record{{}}
+	var section []byte
+	for p, v := range networks {
+		p = p.Masked()
+		ip, bits := p.Addr().As16(), p.Bits()
+		if p.Addr().Is4() {
+			ip = [16]byte{}
+			v4 := p.Addr().As4()
+			copy(ip[12:], v4[:])
+			bits += 96
+		}
+		n := 0
+		for i := 0; i < bits; i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if i == bits-1 {
+				nodes[n][bit] = record{data, len(section)}
+				break
+			}
+			if nodes[n][bit].kind != node {
+				nodes = append(nodes, [2]record{})
+				nodes[n][bit] = record{node, len(nodes) - 1}
+			}
+			n = nodes[n][bit].value
+		}
+		section = append(section, encode(v)...)
+	}
+	count := len(nodes)
+	out := make([]byte, 0, count*recordSize/4+16+len(section)+128)
+	for _, n := range nodes {
+		for _, r := range n {
+			var v int
+			switch r.kind {
+			case empty:
+				v = count
+			case node:
+				v = r.value
+			case data:
+				v = count + 16 + r.value
+			}
+			out = append(out, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, section...)
+	out = append(out, "\xab\xcd\xefMaxMind.com"...)
+	out = append(out, encode(map[string]any{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(6),
+		"database_type":               dbType,
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+	})...)
+	return out
+}
+
+func header(t, size int) (out []byte) {
+	var ctrl byte
+	if t > 7 {
+		out = []byte{0, byte(t - 7)}
+	} else {
+		ctrl = byte(t) << 5
+		out = []byte{0}
+	}
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		out = append(out, byte(size-29))
+	case size < 65821:
+		ctrl |= 30
+		out = binary.BigEndian.AppendUint16(out, uint16(size-285))
+	default:
+		ctrl |= 31
+		s := size - 65821
+		out = append(out, byte(s>>16), byte(s>>8), byte(s))
+	}
+	out[0] = ctrl
+	return
+}
+
+func encodeUint(t int, v uint64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append(header(t, len(b)), b...)
+}
+
+func encode(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(header(2, len(v)), v...)
+	case float64:
+		return binary.BigEndian.AppendUint64(header(3, 8), math.Float64bits(v))
+	case uint16:
+		return encodeUint(5, uint64(v))
+	case uint32:
+		return encodeUint(6, uint64(v))
+	case int:
+		return encodeUint(6, uint64(v))
+	case uint64:
+		return encodeUint(9, v)
+	case bool:
+		if v {
+			return header(14, 1)
+		}
+		return header(14, 0)
+	case []any:
+		out := header(11, len(v))
+		for _, e := range v {
+			out = append(out, encode(e)...)
+		}
+		return out
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := header(7, len(v))
+		for _, k := range keys {
+			out = append(out, encode(k)...)
+			out = append(out, encode(v[k])...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
@@ -0,0 +1,91 @@
+package ops
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/events"
+)
+
+const (
+	// eventsBufferSize is the number of events buffered for each stream,
+	// events are dropped if client does not keep up
+	eventsBufferSize = 1024
+	// eventsKeepAlive is the interval of comments sent to idle stream,
+	// so proxies and clients do not close connection
+	eventsKeepAlive = 15 * time.Second
+)
+
+// parseFilter reads event filter from `types` (comma-separated)
+// and `info_hash` (hex) query arguments
+func parseFilter(args *fasthttp.Args) (f events.Filter, err error) {
+	if types := string(args.Peek("types")); len(types) > 0 {
+		for _, t := range strings.Split(types, ",") {
+			if !slices.Contains(events.Types, t) {
+				return f, fmt.Errorf("unknown event type '%s'", t)
+			}
+			f.Types = append(f.Types, t)
+		}
+	}
+	if ih := strings.ToLower(string(args.Peek("info_hash"))); len(ih) > 0 {
+		if b, err := hex.DecodeString(ih); err != nil || (len(b) != 20 && len(b) != 32) {
+			return f, fmt.Errorf("invalid info hash '%s'", ih)
+		}
+		f.InfoHash = ih
+	}
+	return
+}
+
+// handleEvents streams events as Server-Sent Events until
+// client disconnects or server closed. Event name is the type
+// of event, data is the JSON representation of events.Event.
+func (s *Server) handleEvents(ctx *fasthttp.RequestCtx) {
+	filter, err := parseFilter(ctx.QueryArgs())
+	if err != nil {
+		writeError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "no-cache")
+	conn, remote := ctx.Conn(), ctx.RemoteAddr().String()
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		sub := events.Subscribe(eventsBufferSize, filter)
+		defer sub.Close()
+		logger.Info().Str("remote", remote).Strs("types", filter.Types).Str("infoHash", filter.InfoHash).
+			Msg("events stream opened")
+		t := time.NewTicker(eventsKeepAlive)
+		defer t.Stop()
+		// stream is not limited by write timeout of server,
+		// only single write is limited
+		write := func(format string, args ...any) error {
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := fmt.Fprintf(w, format, args...)
+			if err == nil {
+				err = w.Flush()
+			}
+			return err
+		}
+		err := write(": connected\n\n")
+		for err == nil {
+			select {
+			case <-s.closed:
+				return
+			case <-t.C:
+				err = write(": keep-alive\n\n")
+			case e := <-sub.C:
+				var b []byte
+				if b, err = json.Marshal(e); err == nil {
+					err = write("event: %s\ndata: %s\n\n", e.Type, b)
+				}
+			}
+		}
+		logger.Info().Err(err).Str("remote", remote).Uint64("dropped", sub.Dropped()).Msg("events stream closed")
+	})
+}
@@ -0,0 +1,51 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	swarmExport atomic.Pointer[func(context.Context, io.Writer, string) error]
+
+	errExportDisabled = errors.New("swarms export is not enabled")
+)
+
+// SetSwarmExport sets function, which writes the list of
+// active swarms in requested format for `/export/swarms`
+func SetSwarmExport(fn func(ctx context.Context, w io.Writer, format string) error) {
+	swarmExport.Store(&fn)
+}
+
+// handleExport writes the list of active swarms in format
+// from `format` query argument (json or csv)
+func handleExport(ctx *fasthttp.RequestCtx) {
+	fn := swarmExport.Load()
+	if fn == nil {
+		writeError(ctx, fasthttp.StatusNotFound, errExportDisabled)
+		return
+	}
+	format := string(ctx.QueryArgs().Peek("format"))
+	switch format {
+	case "csv":
+		ctx.SetContentType("text/csv; charset=utf-8")
+	case "":
+		format = "json"
+		fallthrough
+	case "json":
+		ctx.SetContentType("application/json")
+	default:
+		writeError(ctx, fasthttp.StatusBadRequest, errors.New("unknown format '"+format+"'"))
+		return
+	}
+	ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "no-cache")
+	if err := (*fn)(ctx, ctx, format); err != nil {
+		logger.Error().Err(err).Msg("unable to export swarms")
+		ctx.ResetBody()
+		writeError(ctx, fasthttp.StatusInternalServerError, err)
+	}
+}
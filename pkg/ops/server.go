@@ -0,0 +1,274 @@
+// Package ops implements a standalone HTTP server for runtime diagnostics:
+// pprof profiles, expvar variables, on-demand profile dumps, live
+// stream of tracker events, export of active swarms and optional
+// HTML status page.
+// All endpoints are guarded by bearer token.
+package ops
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+const (
+	readTimeout = time.Minute
+	// writeTimeout should be greater than maximal duration
+	// of CPU profile or trace, which may be requested
+	writeTimeout = readTimeout * 5
+
+	bearerPrefix = "Bearer "
+	basicPrefix  = "Basic "
+)
+
+var (
+	logger = log.NewLogger("ops")
+
+	errAddrNotProvided  = errors.New("ops listen address not provided")
+	errTokenNotProvided = errors.New("ops token not provided")
+	errUnauthorized     = errors.New("unauthorized")
+	errUnknownProfile   = errors.New("unknown profile")
+)
+
+// Config represents all the values required to start ops server
+type Config struct {
+	// Addr listen address
+	Addr string `yaml:"addr"`
+	// Token required in `Authorization: Bearer <token>` header
+	Token string `yaml:"token"`
+	// DumpDir directory where profile dumps are written,
+	// default is system's temporary directory
+	DumpDir string `yaml:"dump_dir"`
+	// StatusPage enables HTML status page at `/status`
+	StatusPage bool `yaml:"status_page"`
+}
+
+// Server represents a standalone HTTP server for serving diagnostics.
+type Server struct {
+	listen  string
+	token   []byte
+	dumpDir string
+	srv     *fasthttp.Server
+	// closed stops event streams, which otherwise block shutdown
+	closed     chan struct{}
+	onceCloser sync.Once
+}
+
+// Start starts ops server
+func (s *Server) Start() (err error) {
+	if err = s.srv.ListenAndServe(s.listen); err != nil {
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		} else {
+			logger.Error().Err(err).Msg("failed while serving ops")
+		}
+	}
+	return err
+}
+
+// Close shuts down the server.
+func (s *Server) Close() error {
+	s.onceCloser.Do(func() {
+		close(s.closed)
+	})
+	return s.srv.Shutdown()
+}
+
+// NewServer creates new ops server and starts it.
+// Equivalent of New and async Server.Start.
+func NewServer(cfg Config) (*Server, error) {
+	s, err := New(cfg)
+	if err == nil {
+		go func() {
+			_ = s.Start()
+		}()
+	}
+	return s, err
+}
+
+// New creates a new instance of ops server
+func New(cfg Config) (*Server, error) {
+	if len(cfg.Addr) == 0 {
+		return nil, errAddrNotProvided
+	}
+	if len(cfg.Token) == 0 {
+		return nil, errTokenNotProvided
+	}
+	if len(cfg.DumpDir) == 0 {
+		cfg.DumpDir = os.TempDir()
+		logger.Warn().
+			Str("name", "DumpDir").
+			Str("provided", "").
+			Str("default", cfg.DumpDir).
+			Msg("falling back to default configuration")
+	}
+
+	s := &Server{
+		listen:  cfg.Addr,
+		token:   []byte(cfg.Token),
+		dumpDir: cfg.DumpDir,
+		closed:  make(chan struct{}),
+	}
+
+	r := router.New()
+	r.GET("/debug/vars", s.guard(fasthttpadaptor.NewFastHTTPHandler(expvar.Handler())))
+	r.GET("/debug/runtime", s.guard(handleRuntime))
+	r.POST("/debug/dump/{profile}", s.guard(s.handleDump))
+	r.GET("/events", s.guard(s.handleEvents))
+	r.GET("/export/swarms", s.guard(handleExport))
+	if cfg.StatusPage {
+		r.GET("/status", s.guard(handleStatus))
+	}
+	r.GET("/debug/pprof/cmdline", s.guard(fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Cmdline)))
+	r.GET("/debug/pprof/symbol", s.guard(fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Symbol)))
+	r.GET("/debug/pprof/trace", s.guard(fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Trace)))
+	r.GET("/debug/pprof/profile", s.guard(fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Profile)))
+	r.GET("/debug/pprof/{path:*}", s.guard(fasthttpadaptor.NewFastHTTPHandlerFunc(pprof.Index)))
+
+	s.srv = &fasthttp.Server{
+		Handler:      r.Handler,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+	}
+	return s, nil
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, status int, v any) {
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(status)
+	if err := json.NewEncoder(ctx).Encode(v); err != nil {
+		logger.Error().Err(err).Msg("unable to write response")
+	}
+}
+
+func writeError(ctx *fasthttp.RequestCtx, status int, err error) {
+	writeJSON(ctx, status, map[string]string{"error": err.Error()})
+}
+
+// authorized checks bearer token or, for browsers, basic
+// authentication with any user name and token as password
+func (s *Server) authorized(ctx *fasthttp.RequestCtx) bool {
+	auth := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)
+	if len(auth) > len(bearerPrefix) && string(auth[:len(bearerPrefix)]) == bearerPrefix {
+		return subtle.ConstantTimeCompare(auth[len(bearerPrefix):], s.token) == 1
+	}
+	if len(auth) > len(basicPrefix) && string(auth[:len(basicPrefix)]) == basicPrefix {
+		b, err := base64.StdEncoding.DecodeString(string(auth[len(basicPrefix):]))
+		if err != nil {
+			return false
+		}
+		_, pass, ok := bytes.Cut(b, []byte{':'})
+		return ok && subtle.ConstantTimeCompare(pass, s.token) == 1
+	}
+	return false
+}
+
+// guard checks authorization before calling h
+func (s *Server) guard(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !s.authorized(ctx) {
+			logger.Warn().Str("remote", ctx.RemoteAddr().String()).Bytes("path", ctx.Path()).Msg("unauthorized request")
+			ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, `Basic realm="mochi ops"`)
+			writeError(ctx, fasthttp.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		h(ctx)
+	}
+}
+
+type runtimeStats struct {
+	Goroutines   int    `json:"goroutines"`
+	CPUs         int    `json:"cpus"`
+	MaxProcs     int    `json:"max_procs"`
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+}
+
+func handleRuntime(ctx *fasthttp.RequestCtx) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	writeJSON(ctx, fasthttp.StatusOK, runtimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		CPUs:         runtime.NumCPU(),
+		MaxProcs:     runtime.GOMAXPROCS(0),
+		HeapAlloc:    ms.HeapAlloc,
+		HeapInuse:    ms.HeapInuse,
+		HeapObjects:  ms.HeapObjects,
+		Sys:          ms.Sys,
+		NumGC:        ms.NumGC,
+		PauseTotalNs: ms.PauseTotalNs,
+	})
+}
+
+// handleDump writes profile with name from path (goroutine, heap, allocs...)
+// into file in dump directory. Optional `debug` query argument
+// is passed to pprof.Profile.WriteTo (i.e. `debug=2` for
+// goroutine stack traces in text form).
+func (s *Server) handleDump(ctx *fasthttp.RequestCtx) {
+	name, _ := ctx.UserValue("profile").(string)
+	p := rpprof.Lookup(name)
+	if p == nil {
+		writeError(ctx, fasthttp.StatusNotFound, errUnknownProfile)
+		return
+	}
+	var debug int
+	if arg := ctx.QueryArgs().Peek("debug"); len(arg) > 0 {
+		var err error
+		if debug, err = strconv.Atoi(string(arg)); err != nil {
+			writeError(ctx, fasthttp.StatusBadRequest, err)
+			return
+		}
+	}
+	if name == "heap" {
+		runtime.GC()
+	}
+	path, err := s.dump(p, debug)
+	if err != nil {
+		logger.Error().Err(err).Str("profile", name).Msg("unable to dump profile")
+		writeError(ctx, fasthttp.StatusInternalServerError, err)
+		return
+	}
+	logger.Info().Str("profile", name).Str("file", path).Msg("profile dumped")
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"file": path})
+}
+
+func (s *Server) dump(p *rpprof.Profile, debug int) (path string, err error) {
+	ext := "pprof"
+	if debug > 0 {
+		ext = "txt"
+	}
+	path = filepath.Join(s.dumpDir, fmt.Sprintf("mochi-%s-%d.%s", p.Name(), time.Now().UnixNano(), ext))
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600); err != nil {
+		return
+	}
+	if err = p.WriteTo(f, debug); err != nil {
+		_ = f.Close()
+		return
+	}
+	err = f.Close()
+	return
+}
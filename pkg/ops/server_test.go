@@ -0,0 +1,181 @@
+package ops
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/events"
+)
+
+func request(s *Server, method, uri, token string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	if len(token) > 0 {
+		ctx.Request.Header.Set(fasthttp.HeaderAuthorization, bearerPrefix+token)
+	}
+	s.srv.Handler(ctx)
+	return ctx
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{Addr: "127.0.0.1:0"})
+	require.ErrorIs(t, err, errTokenNotProvided)
+	_, err = New(Config{Token: "secret"})
+	require.ErrorIs(t, err, errAddrNotProvided)
+}
+
+func TestGuard(t *testing.T) {
+	s, err := New(Config{Addr: "127.0.0.1:0", Token: "secret", DumpDir: t.TempDir()})
+	require.Nil(t, err)
+
+	require.Equal(t, fasthttp.StatusUnauthorized, request(s, fasthttp.MethodGet, "/debug/runtime", "").Response.StatusCode())
+	require.Equal(t, fasthttp.StatusUnauthorized, request(s, fasthttp.MethodGet, "/debug/runtime", "wrong").Response.StatusCode())
+
+	ctx := request(s, fasthttp.MethodGet, "/debug/runtime", "secret")
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	var stats runtimeStats
+	require.Nil(t, json.Unmarshal(ctx.Response.Body(), &stats))
+	require.Positive(t, stats.Goroutines)
+
+	require.Equal(t, fasthttp.StatusOK, request(s, fasthttp.MethodGet, "/debug/vars", "secret").Response.StatusCode())
+
+	ctx = new(fasthttp.RequestCtx)
+	ctx.Request.Header.SetMethod(fasthttp.MethodGet)
+	ctx.Request.SetRequestURI("/debug/runtime")
+	ctx.Request.Header.Set(fasthttp.HeaderAuthorization, basicPrefix+base64.StdEncoding.EncodeToString([]byte("any:secret")))
+	s.srv.Handler(ctx)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	ctx = request(s, fasthttp.MethodGet, "/debug/runtime", "")
+	require.Equal(t, `Basic realm="mochi ops"`, string(ctx.Response.Header.Peek(fasthttp.HeaderWWWAuthenticate)))
+}
+
+func TestStatus(t *testing.T) {
+	s, err := New(Config{Addr: "127.0.0.1:0", Token: "secret", DumpDir: t.TempDir()})
+	require.Nil(t, err)
+	require.Equal(t, fasthttp.StatusNotFound, request(s, fasthttp.MethodGet, "/status", "secret").Response.StatusCode())
+
+	s, err = New(Config{Addr: "127.0.0.1:0", Token: "secret", DumpDir: t.TempDir(), StatusPage: true})
+	require.Nil(t, err)
+	require.Equal(t, fasthttp.StatusUnauthorized, request(s, fasthttp.MethodGet, "/status", "").Response.StatusCode())
+
+	SetTopSwarms(func() []Swarm {
+		return []Swarm{{InfoHash: "0102", Seeders: 3, Leechers: 4, AnnounceRate: 1.5}}
+	})
+	defer topSwarms.Store(nil)
+	ctx := request(s, fasthttp.MethodGet, "/status", "secret")
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.True(t, strings.HasPrefix(string(ctx.Response.Header.ContentType()), "text/html"))
+	body := string(ctx.Response.Body())
+	require.Contains(t, body, "Uptime")
+	require.Contains(t, body, "<code>0102</code>")
+	require.Contains(t, body, "1.50")
+
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "mochi_test_response_duration_milliseconds"},
+		[]string{"action", "address_family", "error"})
+	require.Nil(t, prometheus.Register(h))
+	defer prometheus.Unregister(h)
+	h.WithLabelValues("announce", "IPv4", "").Observe(2)
+	h.WithLabelValues("announce", "IPv6", "bad").Observe(4)
+	st, err := collectStatus()
+	require.Nil(t, err)
+	i := slices.IndexFunc(st.Frontends, func(fs frontendStats) bool { return fs.Frontend == "test" })
+	require.GreaterOrEqual(t, i, 0)
+	require.Equal(t, frontendStats{Frontend: "test", Action: "announce", Requests: 2, Errors: 1, AvgMs: 3}, st.Frontends[i])
+}
+
+func TestExport(t *testing.T) {
+	s, err := New(Config{Addr: "127.0.0.1:0", Token: "secret", DumpDir: t.TempDir()})
+	require.Nil(t, err)
+	require.Equal(t, fasthttp.StatusNotFound, request(s, fasthttp.MethodGet, "/export/swarms", "secret").Response.StatusCode())
+
+	SetSwarmExport(func(_ context.Context, w io.Writer, format string) error {
+		_, err := io.WriteString(w, format)
+		return err
+	})
+	defer swarmExport.Store(nil)
+	require.Equal(t, fasthttp.StatusUnauthorized, request(s, fasthttp.MethodGet, "/export/swarms", "").Response.StatusCode())
+	require.Equal(t, fasthttp.StatusBadRequest, request(s, fasthttp.MethodGet, "/export/swarms?format=xml", "secret").Response.StatusCode())
+	ctx := request(s, fasthttp.MethodGet, "/export/swarms?format=csv", "secret")
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Equal(t, "csv", string(ctx.Response.Body()))
+	require.Equal(t, "json", string(request(s, fasthttp.MethodGet, "/export/swarms", "secret").Response.Body()))
+}
+
+func TestDump(t *testing.T) {
+	s, err := New(Config{Addr: "127.0.0.1:0", Token: "secret", DumpDir: t.TempDir()})
+	require.Nil(t, err)
+
+	require.Equal(t, fasthttp.StatusNotFound, request(s, fasthttp.MethodPost, "/debug/dump/none", "secret").Response.StatusCode())
+
+	for _, uri := range []string{"/debug/dump/heap", "/debug/dump/goroutine?debug=2"} {
+		ctx := request(s, fasthttp.MethodPost, uri, "secret")
+		require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), uri)
+		var out map[string]string
+		require.Nil(t, json.Unmarshal(ctx.Response.Body(), &out))
+		fi, err := os.Stat(out["file"])
+		require.Nil(t, err)
+		require.Positive(t, fi.Size())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s, err := New(Config{Addr: "127.0.0.1:0", Token: "secret", DumpDir: t.TempDir()})
+	require.Nil(t, err)
+
+	for _, uri := range []string{"/events?types=unknown", "/events?info_hash=00"} {
+		require.Equal(t, fasthttp.StatusBadRequest, request(s, fasthttp.MethodGet, uri, "secret").Response.StatusCode(), uri)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		_ = s.srv.Serve(ln)
+	}()
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/events?types=completed", nil)
+	require.Nil(t, err)
+	req.Header.Set(fasthttp.HeaderAuthorization, bearerPrefix+"secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	require.Nil(t, err)
+	require.Equal(t, ": connected\n", line)
+
+	events.Publish(events.Event{Type: events.TypeGC})
+	events.Publish(events.Event{Type: events.TypeCompleted, InfoHash: "01"})
+	var lines []string
+	for len(lines) < 2 {
+		if line, err = r.ReadString('\n'); err != nil {
+			break
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	require.Nil(t, err)
+	require.Equal(t, "event: completed", lines[0])
+	require.True(t, strings.HasPrefix(lines[1], "data: "))
+	var e events.Event
+	require.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &e))
+	require.Equal(t, "01", e.InfoHash)
+}
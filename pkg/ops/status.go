@@ -0,0 +1,191 @@
+package ops
+
+import (
+	"cmp"
+	"html/template"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
+
+var (
+	started = time.Now()
+
+	topSwarms atomic.Pointer[func() []Swarm]
+
+	frontendMetricRe = regexp.MustCompile(`^mochi_(\w+)_response_duration_milliseconds$`)
+
+	statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>MoChi status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+td.num { text-align: right; }
+.note { color: #777; }
+</style>
+</head>
+<body>
+<h1>MoChi status</h1>
+<p>Uptime: {{.Uptime}}, started at {{.Started.Format "2006-01-02 15:04:05 MST"}}</p>
+{{if not .MetricsEnabled}}<p class="note">Metrics server is not enabled, frontend and storage statistics are not collected.</p>{{end}}
+<h2>Frontends</h2>
+{{if .Frontends}}<table>
+<tr><th>Frontend</th><th>Action</th><th>Requests</th><th>Errors</th><th>Average, ms</th></tr>
+{{range .Frontends}}<tr><td>{{.Frontend}}</td><td>{{.Action}}</td><td class="num">{{.Requests}}</td><td class="num">{{.Errors}}</td><td class="num">{{printf "%.2f" .AvgMs}}</td></tr>
+{{end}}</table>{{else}}<p class="note">No requests recorded.</p>{{end}}
+<h2>Storage</h2>
+<table>
+<tr><th>Info hashes</th><th>Seeders</th><th>Leechers</th></tr>
+<tr><td class="num">{{.Storage.InfoHashes}}</td><td class="num">{{.Storage.Seeders}}</td><td class="num">{{.Storage.Leechers}}</td></tr>
+</table>
+<h2>Top swarms</h2>
+{{if .Swarms}}<table>
+<tr><th>Info hash</th><th>Seeders</th><th>Leechers</th><th>Announces/s</th></tr>
+{{range .Swarms}}<tr><td><code>{{.InfoHash}}</code></td><td class="num">{{.Seeders}}</td><td class="num">{{.Leechers}}</td><td class="num">{{printf "%.2f" .AnnounceRate}}</td></tr>
+{{end}}</table>{{else}}<p class="note">Not available, enable <code>top torrents</code> middleware.</p>{{end}}
+<h2>Recent errors</h2>
+{{if .Errors}}<table>
+<tr><th>Time</th><th>Level</th><th>Component</th><th>Message</th></tr>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Level}}</td><td>{{.Component}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>{{else}}<p class="note">No errors.</p>{{end}}
+</body>
+</html>
+`))
+)
+
+// Swarm is the state of swarm shown in the list of top swarms
+type Swarm struct {
+	InfoHash     string
+	Seeders      uint32
+	Leechers     uint32
+	AnnounceRate float64
+}
+
+// SetTopSwarms sets function, which provides the list
+// of the most active swarms for status page
+func SetTopSwarms(fn func() []Swarm) {
+	topSwarms.Store(&fn)
+}
+
+type frontendStats struct {
+	Frontend string
+	Action   string
+	Requests uint64
+	Errors   uint64
+	AvgMs    float64
+}
+
+type storageStats struct {
+	InfoHashes uint64
+	Seeders    uint64
+	Leechers   uint64
+}
+
+type status struct {
+	Started        time.Time
+	Uptime         time.Duration
+	MetricsEnabled bool
+	Frontends      []frontendStats
+	Storage        storageStats
+	Swarms         []Swarm
+	Errors         []log.Entry
+}
+
+// collectStatus gathers statistics from prometheus registry,
+// top swarms provider and log
+func collectStatus() (st status, err error) {
+	st.Started = started
+	st.Uptime = time.Since(started).Truncate(time.Second)
+	st.MetricsEnabled = metrics.Enabled()
+	st.Errors = log.RecentErrors()
+	if fn := topSwarms.Load(); fn != nil {
+		st.Swarms = (*fn)()
+	}
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return
+	}
+	sums := make(map[[2]string]float64)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		switch name {
+		case "mochi_storage_infohashes_count":
+			st.Storage.InfoHashes = gaugeValue(mf.GetMetric())
+		case "mochi_storage_seeders_count":
+			st.Storage.Seeders = gaugeValue(mf.GetMetric())
+		case "mochi_storage_leechers_count":
+			st.Storage.Leechers = gaugeValue(mf.GetMetric())
+		}
+		m := frontendMetricRe.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			var action, errLabel string
+			for _, lp := range metric.GetLabel() {
+				switch lp.GetName() {
+				case "action":
+					action = lp.GetValue()
+				case "error":
+					errLabel = lp.GetValue()
+				}
+			}
+			i := slices.IndexFunc(st.Frontends, func(fs frontendStats) bool {
+				return fs.Frontend == m[1] && fs.Action == action
+			})
+			if i < 0 {
+				i = len(st.Frontends)
+				st.Frontends = append(st.Frontends, frontendStats{Frontend: m[1], Action: action})
+			}
+			cnt := metric.GetHistogram().GetSampleCount()
+			st.Frontends[i].Requests += cnt
+			if len(errLabel) > 0 {
+				st.Frontends[i].Errors += cnt
+			}
+			sums[[2]string{m[1], action}] += metric.GetHistogram().GetSampleSum()
+		}
+	}
+	for i, fs := range st.Frontends {
+		if fs.Requests > 0 {
+			st.Frontends[i].AvgMs = sums[[2]string{fs.Frontend, fs.Action}] / float64(fs.Requests)
+		}
+	}
+	slices.SortFunc(st.Frontends, func(a, b frontendStats) int {
+		return cmp.Or(strings.Compare(a.Frontend, b.Frontend), strings.Compare(a.Action, b.Action))
+	})
+	return
+}
+
+func gaugeValue(ms []*dto.Metric) (v uint64) {
+	for _, m := range ms {
+		v += uint64(m.GetGauge().GetValue())
+	}
+	return
+}
+
+// handleStatus renders status page
+func handleStatus(ctx *fasthttp.RequestCtx) {
+	st, err := collectStatus()
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to gather metrics")
+	}
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "no-cache")
+	if err = statusTemplate.Execute(ctx, st); err != nil {
+		logger.Error().Err(err).Msg("unable to write status page")
+	}
+}
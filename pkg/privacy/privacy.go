@@ -0,0 +1,180 @@
+// Package privacy implements anonymization of peer addresses, which
+// are written into logs, event streams and state exports.
+//
+// Address is truncated to the configured prefix (/24 for IPv4 and /48
+// for IPv6 by default) and, in hash mode, the prefix is replaced
+// with a keyed hash, so records of the same network may be correlated
+// without disclosing the network itself.
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+// Supported anonymization modes
+const (
+	// ModeNone disables anonymization
+	ModeNone = "none"
+	// ModeTruncate replaces address with network prefix, i.e. 192.0.2.0/24
+	ModeTruncate = "truncate"
+	// ModeHash replaces address with keyed hash of network prefix
+	ModeHash = "hash"
+
+	defaultIPv4Prefix = 24
+	defaultIPv6Prefix = 48
+	generatedKeyLen   = 32
+	// hashLen is the number of hash bytes in result
+	hashLen = 8
+	// invalidAddress is the placeholder of unparsable address
+	invalidAddress = "invalid"
+)
+
+var (
+	logger = log.NewLogger("privacy")
+
+	current atomic.Pointer[anonymizer]
+)
+
+// Config holds anonymization parameters
+type Config struct {
+	// Mode is one of: none (default), truncate or hash
+	Mode string `yaml:"mode"`
+	// IPv4Prefix is the number of IPv4 address bits kept
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	// IPv6Prefix is the number of IPv6 address bits kept
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+	// Key used to hash prefixes, if not set, random key is generated,
+	// so hashes are not comparable after restart
+	Key string `yaml:"key"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	switch cfg.Mode {
+	case "", ModeNone:
+		validCfg.Mode = ModeNone
+		return
+	case ModeTruncate, ModeHash:
+	default:
+		err = fmt.Errorf("unknown privacy mode '%s'", cfg.Mode)
+		return
+	}
+	if cfg.IPv4Prefix <= 0 || cfg.IPv4Prefix > 32 {
+		validCfg.IPv4Prefix = defaultIPv4Prefix
+		logger.Warn().
+			Str("name", "IPv4Prefix").
+			Int("provided", cfg.IPv4Prefix).
+			Int("default", validCfg.IPv4Prefix).
+			Msg("falling back to default configuration")
+	}
+	if cfg.IPv6Prefix <= 0 || cfg.IPv6Prefix > 128 {
+		validCfg.IPv6Prefix = defaultIPv6Prefix
+		logger.Warn().
+			Str("name", "IPv6Prefix").
+			Int("provided", cfg.IPv6Prefix).
+			Int("default", validCfg.IPv6Prefix).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Mode == ModeHash && len(cfg.Key) == 0 {
+		key := make([]byte, generatedKeyLen)
+		if _, err = rand.Read(key); err != nil {
+			return
+		}
+		validCfg.Key = string(key)
+		logger.Warn().
+			Str("name", "Key").
+			Str("provided", "").
+			Str("default", "<random>").
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+type anonymizer struct {
+	Config
+	hashes sync.Pool
+}
+
+// Configure sets process-wide anonymization parameters
+func Configure(cfg Config) (err error) {
+	if cfg, err = cfg.Validate(); err != nil {
+		return
+	}
+	if cfg.Mode == ModeNone {
+		current.Store(nil)
+		return
+	}
+	a := &anonymizer{Config: cfg}
+	key := []byte(cfg.Key)
+	a.hashes.New = func() any {
+		return hmac.New(sha256.New, key)
+	}
+	current.Store(a)
+	return
+}
+
+// Enabled returns true if addresses are anonymized
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// String returns representation of address, which may be written
+// into logs, event streams and exports. If anonymization is not
+// enabled, it is the same as netip.Addr.String.
+func String(addr netip.Addr) string {
+	a := current.Load()
+	if a == nil || !addr.IsValid() {
+		return addr.String()
+	}
+	addr = addr.Unmap()
+	bits := a.IPv4Prefix
+	if addr.Is6() {
+		bits = a.IPv6Prefix
+	}
+	prefix, _ := addr.WithZone("").Prefix(bits)
+	if a.Mode == ModeTruncate {
+		return prefix.String()
+	}
+	h := a.hashes.Get().(hash.Hash)
+	defer a.hashes.Put(h)
+	h.Reset()
+	b, _ := prefix.MarshalBinary()
+	h.Write(b)
+	var sum [sha256.Size]byte
+	return hex.EncodeToString(h.Sum(sum[:0])[:hashLen])
+}
+
+// ParseString parses textual address and returns its representation
+// (see String). If anonymization is enabled, but address is not
+// valid, placeholder is returned instead of provided value.
+func ParseString(s string) string {
+	if !Enabled() {
+		return s
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return invalidAddress
+	}
+	return String(addr)
+}
+
+// Stringer is the fmt.Stringer, which calls String lazily,
+// i.e. only if log event is enabled
+type Stringer netip.Addr
+
+// String implements fmt.Stringer
+func (s Stringer) String() string {
+	return String(netip.Addr(s))
+}
@@ -0,0 +1,76 @@
+package privacy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	cfg, err := Config{}.Validate()
+	require.NoError(t, err)
+	require.Equal(t, ModeNone, cfg.Mode)
+
+	_, err = Config{Mode: "unknown"}.Validate()
+	require.Error(t, err)
+
+	cfg, err = Config{Mode: ModeTruncate, IPv4Prefix: 33, IPv6Prefix: -1}.Validate()
+	require.NoError(t, err)
+	require.Equal(t, defaultIPv4Prefix, cfg.IPv4Prefix)
+	require.Equal(t, defaultIPv6Prefix, cfg.IPv6Prefix)
+	require.Empty(t, cfg.Key)
+
+	cfg, err = Config{Mode: ModeHash}.Validate()
+	require.NoError(t, err)
+	require.Len(t, cfg.Key, generatedKeyLen)
+}
+
+func TestTruncate(t *testing.T) {
+	require.NoError(t, Configure(Config{Mode: ModeTruncate}))
+	defer func() { require.NoError(t, Configure(Config{})) }()
+	require.True(t, Enabled())
+
+	require.Equal(t, "192.0.2.0/24", String(netip.MustParseAddr("192.0.2.15")))
+	require.Equal(t, "192.0.2.0/24", String(netip.MustParseAddr("::ffff:192.0.2.15")))
+	require.Equal(t, "2001:db8:1::/48", String(netip.MustParseAddr("2001:db8:1:2::1")))
+	require.Equal(t, "invalid IP", String(netip.Addr{}))
+	require.Equal(t, "192.0.2.0/24", ParseString("192.0.2.15"))
+	require.Equal(t, invalidAddress, ParseString("not an address"))
+	require.Equal(t, "192.0.2.0/24", Stringer(netip.MustParseAddr("192.0.2.15")).String())
+
+	require.NoError(t, Configure(Config{Mode: ModeTruncate, IPv4Prefix: 16}))
+	require.Equal(t, "192.0.0.0/16", String(netip.MustParseAddr("192.0.2.15")))
+}
+
+func TestHash(t *testing.T) {
+	require.NoError(t, Configure(Config{Mode: ModeHash, Key: "key"}))
+	defer func() { require.NoError(t, Configure(Config{})) }()
+
+	h := String(netip.MustParseAddr("192.0.2.15"))
+	require.Len(t, h, hashLen*2)
+	require.Equal(t, h, String(netip.MustParseAddr("192.0.2.200")))
+	require.NotEqual(t, h, String(netip.MustParseAddr("192.0.3.15")))
+
+	require.NoError(t, Configure(Config{Mode: ModeHash, Key: "other"}))
+	require.NotEqual(t, h, String(netip.MustParseAddr("192.0.2.15")))
+}
+
+func TestDisabled(t *testing.T) {
+	require.NoError(t, Configure(Config{Mode: ModeNone}))
+	require.False(t, Enabled())
+	require.Equal(t, "192.0.2.15", String(netip.MustParseAddr("192.0.2.15")))
+	require.Equal(t, "not an address", ParseString("not an address"))
+}
+
+func BenchmarkHash(b *testing.B) {
+	if err := Configure(Config{Mode: ModeHash, Key: "key"}); err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = Configure(Config{}) }()
+	addr := netip.MustParseAddr("2001:db8:1:2::1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = String(addr)
+	}
+}
@@ -0,0 +1,131 @@
+package replica
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/admin"
+)
+
+var (
+	registerOnce sync.Once
+
+	errUnknownSet = errors.New("unknown replicated set")
+)
+
+// RegisterHandlers registers admin API handlers of sets.
+// Handlers are process-global, so they must be registered
+// outside of admin.Group. Repeated calls do nothing.
+func RegisterHandlers() {
+	registerOnce.Do(func() {
+		admin.Handle(http.MethodGet, "/lists", handleNames)
+		admin.Handle(http.MethodGet, "/lists/{name}", handleGetKeys)
+		admin.HandleModerated(http.MethodPost, "/lists/{name}", handleModify)
+		admin.Handle(http.MethodGet, "/sync/{name}", handleDigest)
+		admin.HandleUnaudited(http.MethodPost, "/sync/{name}", handleExchange)
+	})
+}
+
+// Modification is the request of set modification
+type Modification struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// Digest is the response of digest request
+type Digest struct {
+	Buckets []uint64 `json:"buckets"`
+}
+
+// Exchange is the request and response of entries exchange:
+// requester sends its entries of differing buckets, responder
+// merges them and replies with own entries of these buckets.
+type Exchange struct {
+	Buckets []int   `json:"buckets,omitempty"`
+	Entries []Entry `json:"entries"`
+}
+
+func lookupSet(ctx *fasthttp.RequestCtx) *Set {
+	name, _ := ctx.UserValue("name").(string)
+	s := Lookup(name)
+	if s == nil {
+		admin.WriteError(ctx, fasthttp.StatusNotFound, errUnknownSet)
+	}
+	return s
+}
+
+func handleNames(ctx *fasthttp.RequestCtx) {
+	admin.WriteJSON(ctx, fasthttp.StatusOK, Names())
+}
+
+func handleGetKeys(ctx *fasthttp.RequestCtx) {
+	if s := lookupSet(ctx); s != nil {
+		admin.WriteJSON(ctx, fasthttp.StatusOK, s.Keys())
+	}
+}
+
+// handleModify adds and removes keys provided in JSON body
+func handleModify(ctx *fasthttp.RequestCtx) {
+	s := lookupSet(ctx)
+	if s == nil {
+		return
+	}
+	var m Modification
+	if err := json.Unmarshal(ctx.PostBody(), &m); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	keys, err := s.normalize(append(slices.Clone(m.Add), m.Remove...))
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	before := s.presence(keys)
+	if err = s.Add(m.Add...); err == nil {
+		err = s.Remove(m.Remove...)
+	}
+	if err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	admin.SetAuditValues(ctx, before, s.presence(keys))
+	admin.WriteJSON(ctx, fasthttp.StatusOK, s.Keys())
+}
+
+// presence returns map of keys to their presence in set
+func (s *Set) presence(keys []string) map[string]bool {
+	out := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		out[k] = s.Contains(k)
+	}
+	return out
+}
+
+func handleDigest(ctx *fasthttp.RequestCtx) {
+	if s := lookupSet(ctx); s != nil {
+		admin.WriteJSON(ctx, fasthttp.StatusOK, Digest{Buckets: s.digest()})
+	}
+}
+
+func handleExchange(ctx *fasthttp.RequestCtx) {
+	s := lookupSet(ctx)
+	if s == nil {
+		return
+	}
+	var req Exchange
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	resp := Exchange{Entries: s.bucketEntries(req.Buckets)}
+	if n := s.merge(req.Entries); n > 0 {
+		s.persist()
+		recordMerged(s.cfg.Name, n)
+	}
+	admin.WriteJSON(ctx, fasthttp.StatusOK, resp)
+}
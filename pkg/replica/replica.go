@@ -0,0 +1,361 @@
+// Package replica implements sets of keys (i.e. approval or ban lists),
+// which may be modified at runtime through admin API and are converged
+// between tracker instances by periodic anti-entropy synchronization.
+//
+// Every set is the last-writer-wins element set (CRDT): each key has
+// the stamp of its last addition or removal, and the latest stamp wins
+// on merge, so instances converge regardless of order of exchanges.
+// Removed keys are kept as tombstones.
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+const (
+	// StorageCtx is the name of storage context where state of sets is persisted
+	StorageCtx = "MW_REPLICA"
+	// buckets is the number of digest buckets
+	buckets = 64
+)
+
+var (
+	logger = log.NewLogger("replica")
+
+	setsMU sync.Mutex
+	sets   = make(map[string]*Set)
+
+	errNameNotProvided = errors.New("replica name not provided")
+)
+
+// Entry is the state of single key
+type Entry struct {
+	Key string `json:"key"`
+	// Stamp is the time (Unix nanoseconds) of last modification
+	Stamp int64 `json:"stamp"`
+	// Deleted is true if key is removed
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// newer returns true if e supersedes o. Removal wins if stamps are equal.
+func (e Entry) newer(o Entry) bool {
+	return e.Stamp > o.Stamp || (e.Stamp == o.Stamp && e.Deleted && !o.Deleted)
+}
+
+func (e Entry) hash() uint64 {
+	d := xxhash.New()
+	_, _ = d.WriteString(e.Key)
+	var b [9]byte
+	for i := 0; i < 8; i++ {
+		b[i] = byte(e.Stamp >> (i * 8))
+	}
+	if e.Deleted {
+		b[8] = 1
+	}
+	_, _ = d.Write(b[:])
+	return d.Sum64()
+}
+
+func bucket(key string) int {
+	return int(xxhash.Sum64String(key) % buckets)
+}
+
+// SetConfig is the configuration of replicated set
+type SetConfig struct {
+	// Name is the unique name of set, by which it is addressed
+	// in admin API and synchronized with other instances.
+	Name string
+	// Storage is the storage, where state of set is persisted, may be nil.
+	Storage storage.DataStorage
+	// Normalize checks key provided by admin and returns its canonical
+	// form, may be nil.
+	Normalize func(string) (string, error)
+	// OnChange is called after keys are added or removed, may be nil.
+	OnChange func(added, removed []string)
+}
+
+// Set is the replicated set of keys
+type Set struct {
+	cfg     SetConfig
+	mu      sync.RWMutex
+	clock   int64
+	entries map[string]Entry
+	// onChange are OnChange functions of all registrants of set
+	onChange []func(added, removed []string)
+}
+
+// NewSet creates set, restores its persisted state and registers it,
+// so it is available in admin API and synchronized. If set with the same
+// name is already registered (i.e. by another instance of middleware),
+// it is returned, cfg.OnChange is called with its current keys and then
+// along with previous ones, but Storage and Normalize of the first
+// registered set are used.
+func NewSet(cfg SetConfig) (*Set, error) {
+	if len(cfg.Name) == 0 {
+		return nil, errNameNotProvided
+	}
+	if s := Lookup(cfg.Name); s != nil {
+		s.observe(cfg.OnChange)
+		return s, nil
+	}
+	s := &Set{cfg: cfg, entries: make(map[string]Entry)}
+	if cfg.OnChange != nil {
+		s.onChange = append(s.onChange, cfg.OnChange)
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	setsMU.Lock()
+	if prev, exists := sets[cfg.Name]; exists {
+		// registered concurrently
+		setsMU.Unlock()
+		prev.observe(cfg.OnChange)
+		return prev, nil
+	}
+	sets[cfg.Name] = s
+	setsMU.Unlock()
+	return s, nil
+}
+
+// observe adds fn into OnChange functions of set
+// and calls it with current keys
+func (s *Set) observe(fn func(added, removed []string)) {
+	if fn == nil {
+		return
+	}
+	s.mu.Lock()
+	s.onChange = append(s.onChange, fn)
+	s.mu.Unlock()
+	if keys := s.Keys(); len(keys) > 0 {
+		fn(keys, nil)
+	}
+}
+
+// Reset removes all registered sets.
+// Should be called before new instance of tracker is created.
+func Reset() {
+	setsMU.Lock()
+	defer setsMU.Unlock()
+	sets = make(map[string]*Set)
+}
+
+// Lookup returns registered set by its name
+func Lookup(name string) *Set {
+	setsMU.Lock()
+	defer setsMU.Unlock()
+	return sets[name]
+}
+
+// Names returns names of all registered sets
+func Names() []string {
+	setsMU.Lock()
+	defer setsMU.Unlock()
+	names := make([]string, 0, len(sets))
+	for n := range sets {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (s *Set) load() error {
+	if s.cfg.Storage == nil {
+		return nil
+	}
+	b, err := s.cfg.Storage.Load(context.Background(), StorageCtx, s.cfg.Name)
+	if err != nil || len(b) == 0 {
+		return err
+	}
+	var entries []Entry
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	s.merge(entries)
+	return nil
+}
+
+func (s *Set) persist() {
+	if s.cfg.Storage == nil {
+		return
+	}
+	s.mu.RLock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	s.mu.RUnlock()
+	b, err := json.Marshal(entries)
+	if err == nil {
+		err = s.cfg.Storage.Put(context.Background(), StorageCtx, storage.Entry{Key: s.cfg.Name, Value: b})
+	}
+	if err != nil {
+		logger.Error().Err(err).Str("name", s.cfg.Name).Msg("unable to persist replicated set")
+	}
+}
+
+// Name returns name of set
+func (s *Set) Name() string {
+	return s.cfg.Name
+}
+
+// normalize returns canonical forms of keys
+func (s *Set) normalize(keys []string) ([]string, error) {
+	if s.cfg.Normalize == nil {
+		return keys, nil
+	}
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		var err error
+		if out[i], err = s.cfg.Normalize(k); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Seed adds keys, which are not known yet, with the lowest stamp,
+// so any runtime modification of these keys supersedes them.
+// Used to populate set from static configuration.
+func (s *Set) Seed(keys ...string) error {
+	keys, err := s.normalize(keys)
+	if err != nil {
+		return err
+	}
+	entries := make([]Entry, 0, len(keys))
+	s.mu.RLock()
+	for _, k := range keys {
+		if _, exists := s.entries[k]; !exists {
+			entries = append(entries, Entry{Key: k})
+		}
+	}
+	s.mu.RUnlock()
+	s.merge(entries)
+	return nil
+}
+
+// Add adds keys to set
+func (s *Set) Add(keys ...string) error {
+	return s.modify(keys, false)
+}
+
+// Remove removes keys from set
+func (s *Set) Remove(keys ...string) error {
+	return s.modify(keys, true)
+}
+
+func (s *Set) modify(keys []string, deleted bool) error {
+	keys, err := s.normalize(keys)
+	if err != nil {
+		return err
+	}
+	entries := make([]Entry, len(keys))
+	s.mu.Lock()
+	for i, k := range keys {
+		entries[i] = Entry{Key: k, Stamp: s.tick(), Deleted: deleted}
+	}
+	s.mu.Unlock()
+	if s.merge(entries) > 0 {
+		s.persist()
+	}
+	return nil
+}
+
+// tick returns stamp, which is greater than any seen before
+func (s *Set) tick() int64 {
+	s.clock = max(s.clock+1, time.Now().UnixNano())
+	return s.clock
+}
+
+// merge applies entries, which supersede known ones,
+// and returns the number of applied entries
+func (s *Set) merge(entries []Entry) (n int) {
+	var added, removed []string
+	s.mu.Lock()
+	for _, e := range entries {
+		old, exists := s.entries[e.Key]
+		if exists && !e.newer(old) {
+			continue
+		}
+		s.entries[e.Key] = e
+		s.clock = max(s.clock, e.Stamp)
+		n++
+		if e.Deleted {
+			if exists && !old.Deleted {
+				removed = append(removed, e.Key)
+			}
+		} else if !exists || old.Deleted {
+			added = append(added, e.Key)
+		}
+	}
+	onChange := s.onChange
+	s.mu.Unlock()
+	if len(added) > 0 || len(removed) > 0 {
+		for _, fn := range onChange {
+			fn(added, removed)
+		}
+	}
+	return
+}
+
+// Contains checks if key is in set
+func (s *Set) Contains(key string) bool {
+	s.mu.RLock()
+	e, exists := s.entries[key]
+	s.mu.RUnlock()
+	return exists && !e.Deleted
+}
+
+// Keys returns sorted keys of set
+func (s *Set) Keys() []string {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.entries))
+	for k, e := range s.entries {
+		if !e.Deleted {
+			keys = append(keys, k)
+		}
+	}
+	s.mu.RUnlock()
+	slices.Sort(keys)
+	return keys
+}
+
+// digest returns hashes of buckets of entries.
+// Buckets with different hashes contain different entries.
+func (s *Set) digest() []uint64 {
+	d := make([]uint64, buckets)
+	s.mu.RLock()
+	for _, e := range s.entries {
+		d[bucket(e.Key)] ^= e.hash()
+	}
+	s.mu.RUnlock()
+	return d
+}
+
+// bucketEntries returns entries (including tombstones) of specified buckets
+func (s *Set) bucketEntries(bb []int) []Entry {
+	var in [buckets]bool
+	for _, b := range bb {
+		if b >= 0 && b < buckets {
+			in[b] = true
+		}
+	}
+	var out []Entry
+	s.mu.RLock()
+	for _, e := range s.entries {
+		if in[bucket(e.Key)] {
+			out = append(out, e)
+		}
+	}
+	s.mu.RUnlock()
+	return out
+}
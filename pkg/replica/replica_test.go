@@ -0,0 +1,133 @@
+package replica
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func newLocal(name string) *Set {
+	return &Set{cfg: SetConfig{Name: name}, entries: make(map[string]Entry)}
+}
+
+func TestMerge(t *testing.T) {
+	var added, removed []string
+	s, err := NewSet(SetConfig{
+		Name: "merge",
+		OnChange: func(a, r []string) {
+			added, removed = append(added, a...), append(removed, r...)
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, s.Seed("a", "b"))
+	require.Nil(t, s.Remove("b"))
+	require.Nil(t, s.Seed("b"))
+	require.Equal(t, []string{"a"}, s.Keys())
+	require.Equal(t, []string{"a", "b"}, added)
+	require.Equal(t, []string{"b"}, removed)
+
+	// older modification is ignored, removal wins on equal stamps
+	require.Zero(t, s.merge([]Entry{{Key: "a", Stamp: -1, Deleted: true}}))
+	require.Equal(t, 1, s.merge([]Entry{{Key: "a", Deleted: true}}))
+	require.False(t, s.Contains("a"))
+	require.Zero(t, s.merge([]Entry{{Key: "a"}}))
+
+	// stamps are monotonic even if remote clock is ahead
+	future := time.Now().Add(time.Hour).UnixNano()
+	require.Equal(t, 1, s.merge([]Entry{{Key: "c", Stamp: future}}))
+	require.Nil(t, s.Remove("c"))
+	require.False(t, s.Contains("c"))
+}
+
+func TestPersist(t *testing.T) {
+	st, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer st.Close()
+	s, err := NewSet(SetConfig{Name: "persist", Storage: st})
+	require.Nil(t, err)
+	require.Nil(t, s.Add("a", "b"))
+	require.Nil(t, s.Remove("b"))
+
+	Reset()
+	var added []string
+	s, err = NewSet(SetConfig{Name: "persist", Storage: st, OnChange: func(a, _ []string) {
+		added = append(added, a...)
+	}})
+	require.Nil(t, err)
+	require.Nil(t, s.Seed("b"))
+	require.Equal(t, []string{"a"}, s.Keys())
+	require.Equal(t, []string{"a"}, added)
+}
+
+func TestShared(t *testing.T) {
+	var first, second []string
+	s, err := NewSet(SetConfig{Name: "shared", OnChange: func(a, r []string) {
+		first = append(first, a...)
+		first = append(first, r...)
+	}})
+	require.Nil(t, err)
+	require.Nil(t, s.Add("a"))
+
+	other, err := NewSet(SetConfig{Name: "shared", OnChange: func(a, r []string) {
+		second = append(second, a...)
+		second = append(second, r...)
+	}})
+	require.Nil(t, err)
+	require.Same(t, s, other)
+	require.Equal(t, []string{"a"}, second)
+
+	require.Nil(t, other.Remove("a"))
+	require.Nil(t, s.Add("b"))
+	require.Equal(t, []string{"a", "a", "b"}, first)
+	require.Equal(t, []string{"a", "a", "b"}, second)
+
+	Reset()
+	require.Nil(t, Lookup("shared"))
+}
+
+func TestSync(t *testing.T) {
+	remote, err := NewSet(SetConfig{Name: "sync"})
+	require.Nil(t, err)
+	RegisterHandlers()
+	srv, err := admin.New("127.0.0.1:16995", admin.AuthConfig{
+		Tokens: []admin.TokenConfig{{Name: "replica", Token: "secret", Role: admin.RoleAdmin}},
+	})
+	require.Nil(t, err)
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	local := newLocal("sync")
+	require.Nil(t, remote.Add("a", "b"))
+	require.Nil(t, local.Add("c", "b"))
+	require.Nil(t, local.Remove("b"))
+	for i := 0; i < 100; i++ {
+		require.Nil(t, remote.Add(string(rune('d'+i))))
+	}
+
+	s := NewSyncer(Config{Peers: []string{"http://127.0.0.1:16995/"}, Interval: time.Hour, Token: "secret"})
+	defer s.Close()
+	n, err := s.sync(context.Background(), local, s.cfg.Peers[0])
+	require.Nil(t, err)
+	require.Equal(t, 101, n)
+	require.Equal(t, remote.Keys(), local.Keys())
+	require.False(t, slices.Contains(remote.Keys(), "b"))
+	require.True(t, remote.Contains("c"))
+	require.Equal(t, remote.digest(), local.digest())
+
+	n, err = s.sync(context.Background(), local, s.cfg.Peers[0])
+	require.Nil(t, err)
+	require.Zero(t, n)
+
+	_, err = s.sync(context.Background(), newLocal("unknown"), s.cfg.Peers[0])
+	require.ErrorIs(t, err, errUnknownRemoteSet)
+}
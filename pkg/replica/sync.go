@@ -0,0 +1,214 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
+
+const (
+	defaultInterval = 30 * time.Second
+	defaultTimeout  = 5 * time.Second
+)
+
+var (
+	// promMerged is the number of entries received from other instances
+	promMerged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_replica_merged_entries_total",
+		Help: "The number of replicated set entries applied from other instances",
+	}, []string{"set"})
+
+	errUnknownRemoteSet = errors.New("set is not known by peer")
+)
+
+func init() {
+	prometheus.MustRegister(promMerged)
+}
+
+func recordMerged(name string, n int) {
+	if metrics.Enabled() {
+		promMerged.WithLabelValues(name).Add(float64(n))
+	}
+}
+
+// Config is the configuration of synchronization between instances
+type Config struct {
+	// Peers base URLs of admin API of other instances (i.e. `http://10.0.0.2:6881`)
+	Peers []string `yaml:"peers"`
+	// Interval is the period between two synchronizations
+	Interval time.Duration `yaml:"interval"`
+	// Timeout of single request to peer
+	Timeout time.Duration `yaml:"timeout"`
+	// Token is sent in `Authorization: Bearer <token>` header,
+	// if admin API of peers requires authentication
+	Token string `yaml:"token"`
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config) {
+	validCfg = cfg
+	validCfg.Peers = make([]string, 0, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		if p = strings.TrimRight(p, "/"); len(p) > 0 {
+			validCfg.Peers = append(validCfg.Peers, p)
+		}
+	}
+	if cfg.Interval <= 0 {
+		validCfg.Interval = defaultInterval
+		logger.Warn().
+			Str("name", "Interval").
+			Dur("provided", cfg.Interval).
+			Dur("default", validCfg.Interval).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Timeout <= 0 {
+		validCfg.Timeout = defaultTimeout
+		logger.Warn().
+			Str("name", "Timeout").
+			Dur("provided", cfg.Timeout).
+			Dur("default", validCfg.Timeout).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// Syncer periodically synchronizes all registered sets with peers.
+// Every round compares digests of sets and exchanges entries
+// of differing buckets in both directions, so sets converge even
+// if modification reached only one instance.
+type Syncer struct {
+	cfg    Config
+	client *http.Client
+
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+// NewSyncer creates Syncer and starts synchronization
+func NewSyncer(cfg Config) *Syncer {
+	cfg = cfg.Validate()
+	s := &Syncer{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		closed: make(chan any),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *Syncer) run() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-t.C:
+			s.SyncAll(context.Background())
+		}
+	}
+}
+
+// SyncAll synchronizes all registered sets with all peers
+func (s *Syncer) SyncAll(ctx context.Context) {
+	for _, name := range Names() {
+		set := Lookup(name)
+		if set == nil {
+			continue
+		}
+		for _, p := range s.cfg.Peers {
+			n, err := s.sync(ctx, set, p)
+			if err != nil {
+				logger.Warn().Err(err).Str("set", name).Str("peer", p).Msg("unable to synchronize set")
+				continue
+			}
+			if n > 0 {
+				set.persist()
+				recordMerged(name, n)
+				logger.Debug().Str("set", name).Str("peer", p).Int("entries", n).Msg("set synchronized")
+			}
+		}
+	}
+}
+
+// sync synchronizes set with peer and returns the number of applied entries
+func (s *Syncer) sync(ctx context.Context, set *Set, peer string) (int, error) {
+	u := peer + "/sync/" + url.PathEscape(set.Name())
+	var remote Digest
+	if err := s.do(ctx, http.MethodGet, u, nil, &remote); err != nil {
+		return 0, err
+	}
+	local := set.digest()
+	if len(remote.Buckets) != len(local) {
+		return 0, fmt.Errorf("unexpected number of buckets: %d", len(remote.Buckets))
+	}
+	var diff []int
+	for i, h := range local {
+		if remote.Buckets[i] != h {
+			diff = append(diff, i)
+		}
+	}
+	if len(diff) == 0 {
+		return 0, nil
+	}
+	var resp Exchange
+	if err := s.do(ctx, http.MethodPost, u, Exchange{Buckets: diff, Entries: set.bucketEntries(diff)}, &resp); err != nil {
+		return 0, err
+	}
+	return set.merge(resp.Entries), nil
+}
+
+func (s *Syncer) do(ctx context.Context, method, u string, body, out any) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.cfg.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNotFound:
+		return errUnknownRemoteSet
+	default:
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+}
+
+// Close stops synchronization
+func (s *Syncer) Close() error {
+	s.onceCloser.Do(func() {
+		close(s.closed)
+		s.wg.Wait()
+	})
+	return nil
+}
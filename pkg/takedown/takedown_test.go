@@ -0,0 +1,127 @@
+package takedown
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/pkg/replica"
+)
+
+const (
+	ih1 = "0123456789abcdef0123456789abcdef01234567"
+	ih2 = "89abcdef0123456789abcdef0123456789abcdef"
+)
+
+func TestParseFeed(t *testing.T) {
+	notices, err := ParseFeed([]byte(`[{"info_hash":"` + ih1 + `","id":"n1","reason":"dmca"},"` + ih2 + `"]`))
+	require.Nil(t, err)
+	require.Equal(t, []Notice{{InfoHash: ih1, ID: "n1", Reason: "dmca"}, {InfoHash: ih2}}, notices)
+
+	notices, err = ParseFeed([]byte("# feed\n" + ih1 + "\n\n " + ih2 + "\n"))
+	require.Nil(t, err)
+	require.Equal(t, []Notice{{InfoHash: ih1}, {InfoHash: ih2}}, notices)
+
+	notices, err = ParseFeed([]byte(`{"info_hash":"` + ih1 + `"}`))
+	require.Nil(t, err)
+	require.Equal(t, []Notice{{InfoHash: ih1}}, notices)
+
+	_, err = ParseFeed([]byte(`[{"info_hash":`))
+	require.NotNil(t, err)
+}
+
+func TestSubscriber(t *testing.T) {
+	set, err := replica.NewSet(replica.SetConfig{Name: "takedown_test"})
+	require.Nil(t, err)
+
+	feed := ih1 + "\n" + strings.ToUpper(ih2) + "\ninvalid\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(feed))
+	}))
+	defer srv.Close()
+
+	audit := filepath.Join(t.TempDir(), "audit.log")
+	cfg := Config{
+		Set:      set.Name(),
+		URL:      srv.URL,
+		Interval: time.Hour,
+		Headers:  map[string]string{"Authorization": "token"},
+		AuditLog: audit,
+	}
+	s, err := NewSubscriber(cfg)
+	require.Nil(t, err)
+	require.Nil(t, s.Poll(context.Background()))
+	require.Nil(t, s.Close())
+	require.True(t, set.Contains(ih1))
+	require.True(t, set.Contains(ih2))
+
+	f, err := os.Open(audit)
+	require.Nil(t, err)
+	var records []Record
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r Record
+		require.Nil(t, json.Unmarshal(sc.Bytes(), &r))
+		records = append(records, r)
+	}
+	_ = f.Close()
+	require.Len(t, records, 2)
+	require.Equal(t, SourceHTTP, records[0].Source)
+	require.Equal(t, ih2, records[1].InfoHash)
+
+	// hash removed by operator is not added again after restart
+	require.Nil(t, set.Remove(ih1))
+	s, err = NewSubscriber(cfg)
+	require.Nil(t, err)
+	defer s.Close()
+	require.Nil(t, s.Poll(context.Background()))
+	require.False(t, set.Contains(ih1))
+
+	require.Equal(t, 0, s.Apply(SourceNATS, []Notice{{InfoHash: ih2}}))
+
+	cfg.Headers = nil
+	s2, err := NewSubscriber(cfg)
+	require.Nil(t, err)
+	defer s2.Close()
+	require.NotNil(t, s2.Poll(context.Background()))
+
+	_, err = NewSubscriber(Config{Set: "not_exists", URL: srv.URL})
+	require.NotNil(t, err)
+}
+
+// comments is the endless feed of comment characters
+type comments struct{}
+
+func (comments) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '#'
+	}
+	return len(p), nil
+}
+
+func TestFeedTooLarge(t *testing.T) {
+	set, err := replica.NewSet(replica.SetConfig{Name: "takedown_large_test"})
+	require.Nil(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.CopyN(w, comments{}, maxFeedSize+1)
+	}))
+	defer srv.Close()
+	s, err := NewSubscriber(Config{Set: set.Name(), URL: srv.URL, Interval: time.Hour})
+	require.Nil(t, err)
+	defer s.Close()
+	require.ErrorIs(t, s.Poll(context.Background()), errFeedTooLarge)
+}
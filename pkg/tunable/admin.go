@@ -0,0 +1,72 @@
+package tunable
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/admin"
+)
+
+var registerOnce sync.Once
+
+// RegisterHandlers registers admin API handlers of parameters.
+// Handlers are process-global, so they must be registered
+// outside of admin.Group. Repeated calls do nothing.
+func RegisterHandlers() {
+	registerOnce.Do(func() {
+		admin.Handle(http.MethodGet, "/tunables", handleList)
+		admin.Handle(http.MethodGet, "/tunables/history", handleHistory)
+		admin.Handle(http.MethodPut, "/tunables/{name}", handleSet)
+		admin.Handle(http.MethodDelete, "/tunables/{name}", handleUnset)
+	})
+}
+
+// Modification is the request of parameter change
+type Modification struct {
+	Value string `json:"value"`
+}
+
+func writeChange(ctx *fasthttp.RequestCtx, c Change, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownParam):
+		admin.WriteError(ctx, fasthttp.StatusNotFound, err)
+	case errors.Is(err, ErrInvalidValue):
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+	case err != nil:
+		admin.WriteError(ctx, fasthttp.StatusInternalServerError, err)
+	default:
+		admin.SetAuditValues(ctx, c.Old, c.New)
+		admin.WriteJSON(ctx, fasthttp.StatusOK, c)
+	}
+}
+
+func handleList(ctx *fasthttp.RequestCtx) {
+	admin.WriteJSON(ctx, fasthttp.StatusOK, List())
+}
+
+func handleHistory(ctx *fasthttp.RequestCtx) {
+	admin.WriteJSON(ctx, fasthttp.StatusOK, History())
+}
+
+// handleSet applies value provided in JSON body
+func handleSet(ctx *fasthttp.RequestCtx) {
+	name, _ := ctx.UserValue("name").(string)
+	var m Modification
+	if err := json.Unmarshal(ctx.PostBody(), &m); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	c, err := Set(ctx, name, m.Value, admin.Actor(ctx))
+	writeChange(ctx, c, err)
+}
+
+// handleUnset applies initial value
+func handleUnset(ctx *fasthttp.RequestCtx) {
+	name, _ := ctx.UserValue("name").(string)
+	c, err := Unset(ctx, name, admin.Actor(ctx))
+	writeChange(ctx, c, err)
+}
@@ -0,0 +1,273 @@
+// Package tunable implements registry of runtime parameters (i.e. log level,
+// announce interval or rate limits), which may be changed through admin API
+// without configuration reload.
+//
+// Every change is logged and kept in history of recent changes and,
+// if persistence is enabled, stored in DataStorage and restored
+// when tracker is started again.
+package tunable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+const (
+	// StorageCtx is the name of storage context where changed values are persisted
+	StorageCtx = "MW_TUNABLE"
+	// historySize is the number of the latest changes kept in memory
+	historySize = 100
+)
+
+var (
+	logger = log.NewLogger("tunable")
+
+	promChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_tunable_changes_total",
+		Help: "The number of runtime parameter changes",
+	}, []string{"name"})
+
+	// ErrUnknownParam is returned if parameter with provided name is not registered
+	ErrUnknownParam = errors.New("unknown runtime parameter")
+	// ErrInvalidValue is returned (wrapped) if value is rejected by parameter
+	ErrInvalidValue = errors.New("invalid value of runtime parameter")
+
+	mu      sync.Mutex
+	params  = make(map[string]*param)
+	history []Change
+	store   storage.DataStorage
+)
+
+func init() {
+	prometheus.MustRegister(promChanges)
+}
+
+// Config is the configuration of runtime parameters
+type Config struct {
+	// Persist enables storing of changed values in tracker's storage,
+	// so they are restored on start
+	Persist bool `yaml:"persist"`
+}
+
+// Param is the runtime parameter
+type Param struct {
+	// Name is the unique name of parameter, by which it is addressed in admin API
+	Name string
+	// Help is the short description of parameter
+	Help string
+	// Get returns current value
+	Get func() string
+	// Set validates and applies new value
+	Set func(string) error
+}
+
+type param struct {
+	Param
+	// setters are Set functions of all instances, registered with the same name
+	setters []func(string) error
+	initial string
+}
+
+// Value is the state of registered parameter
+type Value struct {
+	Name    string `json:"name"`
+	Help    string `json:"help,omitempty"`
+	Value   string `json:"value"`
+	Initial string `json:"initial"`
+}
+
+// Change is the record of parameter change
+type Change struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+	Old  string    `json:"old"`
+	New  string    `json:"new"`
+	// By is the initiator of change (i.e. remote address of admin API client)
+	By string `json:"by"`
+}
+
+// Register registers runtime parameter. If parameter with the same
+// name is already registered (i.e. by another instance of middleware),
+// p.Set is called along with previous ones, but value is returned
+// by the first registered p.Get.
+func Register(p Param) {
+	if len(p.Name) == 0 || p.Get == nil || p.Set == nil {
+		panic("tunable: could not register parameter with empty name or nil functions")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if e, exists := params[p.Name]; exists {
+		e.setters = append(e.setters, p.Set)
+		return
+	}
+	params[p.Name] = &param{Param: p, setters: []func(string) error{p.Set}, initial: p.Get()}
+}
+
+// Duration creates Param, which value is time.Duration.
+// Invalid values must be rejected by set.
+func Duration(name, help string, get func() time.Duration, set func(time.Duration) error) Param {
+	return Param{
+		Name: name,
+		Help: help,
+		Get:  func() string { return get().String() },
+		Set: func(s string) error {
+			d, err := time.ParseDuration(s)
+			if err == nil {
+				err = set(d)
+			}
+			return err
+		},
+	}
+}
+
+// Uint creates Param, which value is unsigned integer.
+// Invalid values must be rejected by set.
+func Uint(name, help string, get func() uint64, set func(uint64) error) Param {
+	return Param{
+		Name: name,
+		Help: help,
+		Get:  func() string { return strconv.FormatUint(get(), 10) },
+		Set: func(s string) error {
+			n, err := strconv.ParseUint(s, 10, 64)
+			if err == nil {
+				err = set(n)
+			}
+			return err
+		},
+	}
+}
+
+// Reset removes all registered parameters, history and storage.
+// Should be called before new instance of tracker is created.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	params, history, store = make(map[string]*param), nil, nil
+}
+
+func (p *param) set(value string) error {
+	for _, set := range p.setters {
+		if err := set(value); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidValue, err)
+		}
+	}
+	return nil
+}
+
+// Restore enables persistence of changes in ds and applies
+// values persisted before to registered parameters.
+// Invalid persisted values are ignored.
+func Restore(ctx context.Context, ds storage.DataStorage) error {
+	mu.Lock()
+	defer mu.Unlock()
+	store = ds
+	for name, p := range params {
+		b, err := ds.Load(ctx, StorageCtx, name)
+		if err != nil {
+			return fmt.Errorf("unable to load runtime parameter '%s': %w", name, err)
+		}
+		if len(b) == 0 {
+			continue
+		}
+		if err = p.set(string(b)); err != nil {
+			logger.Warn().Err(err).Str("name", name).Bytes("value", b).Msg("ignoring invalid persisted runtime parameter")
+			continue
+		}
+		logger.Info().Str("name", name).Bytes("value", b).Msg("runtime parameter restored")
+	}
+	return nil
+}
+
+// record must be called with locked mu
+func record(c Change) {
+	logger.Warn().Str("name", c.Name).Str("old", c.Old).Str("new", c.New).Str("by", c.By).
+		Msg("runtime parameter changed")
+	promChanges.WithLabelValues(c.Name).Inc()
+	if len(history) >= historySize {
+		history = slices.Delete(history, 0, 1)
+	}
+	history = append(history, c)
+}
+
+// Set applies value to parameter with provided name and records change
+// initiated by `by`. If persistence enabled, value is stored,
+// error is returned if store failed, but value is already applied.
+func Set(ctx context.Context, name, value, by string) (c Change, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	p, exists := params[name]
+	if !exists {
+		return c, ErrUnknownParam
+	}
+	c = Change{Time: time.Now(), Name: name, Old: p.Get(), By: by}
+	if err = p.set(value); err != nil {
+		return
+	}
+	c.New = p.Get()
+	record(c)
+	if store != nil {
+		if err = store.Put(ctx, StorageCtx, storage.Entry{Key: name, Value: []byte(c.New)}); err != nil {
+			err = fmt.Errorf("value applied, but not persisted: %w", err)
+		}
+	}
+	return
+}
+
+// Unset applies initial (configured) value to parameter with provided
+// name and removes persisted value.
+func Unset(ctx context.Context, name, by string) (c Change, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	p, exists := params[name]
+	if !exists {
+		return c, ErrUnknownParam
+	}
+	c = Change{Time: time.Now(), Name: name, Old: p.Get(), By: by}
+	if err = p.set(p.initial); err != nil {
+		return
+	}
+	c.New = p.Get()
+	record(c)
+	if store != nil {
+		if err = store.Delete(ctx, StorageCtx, name); err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			err = fmt.Errorf("value applied, but not removed from storage: %w", err)
+		} else {
+			err = nil
+		}
+	}
+	return
+}
+
+// List returns values of all registered parameters sorted by name
+func List() []Value {
+	mu.Lock()
+	defer mu.Unlock()
+	out := make([]Value, 0, len(params))
+	for _, p := range params {
+		out = append(out, Value{Name: p.Name, Help: p.Help, Value: p.Get(), Initial: p.initial})
+	}
+	slices.SortFunc(out, func(a, b Value) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return out
+}
+
+// History returns the latest changes of parameters, newest first
+func History() []Change {
+	mu.Lock()
+	defer mu.Unlock()
+	out := slices.Clone(history)
+	slices.Reverse(out)
+	return out
+}
@@ -0,0 +1,112 @@
+package tunable
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	sm "github.com/sot-tech/mochi/storage/memory"
+)
+
+func register(name string, v *time.Duration) {
+	Register(Duration(name, "test", func() time.Duration { return *v }, func(d time.Duration) error {
+		if d <= 0 {
+			return errors.New("must be positive")
+		}
+		*v = d
+		return nil
+	}))
+}
+
+func TestSet(t *testing.T) {
+	Reset()
+	a, b := time.Second, time.Second
+	register("interval", &a)
+	register("interval", &b)
+
+	_, err := Set(context.TODO(), "unknown", "1s", "test")
+	require.ErrorIs(t, err, ErrUnknownParam)
+	_, err = Set(context.TODO(), "interval", "-1s", "test")
+	require.ErrorIs(t, err, ErrInvalidValue)
+	_, err = Set(context.TODO(), "interval", "invalid", "test")
+	require.ErrorIs(t, err, ErrInvalidValue)
+
+	c, err := Set(context.TODO(), "interval", "1m", "test")
+	require.Nil(t, err)
+	require.Equal(t, "1s", c.Old)
+	require.Equal(t, "1m0s", c.New)
+	require.Equal(t, time.Minute, a)
+	require.Equal(t, time.Minute, b)
+	require.Equal(t, []Value{{Name: "interval", Help: "test", Value: "1m0s", Initial: "1s"}}, List())
+
+	c, err = Unset(context.TODO(), "interval", "test")
+	require.Nil(t, err)
+	require.Equal(t, "1s", c.New)
+	require.Equal(t, time.Second, b)
+
+	h := History()
+	require.Len(t, h, 2)
+	require.Equal(t, "1s", h[0].New)
+	require.Equal(t, "1m0s", h[1].New)
+}
+
+func TestRestore(t *testing.T) {
+	ps, err := sm.Builder{}.NewDataStorage(conf.MapConfig{})
+	require.Nil(t, err)
+	defer ps.Close()
+
+	Reset()
+	v := time.Second
+	register("interval", &v)
+	require.Nil(t, Restore(context.TODO(), ps))
+	_, err = Set(context.TODO(), "interval", "1h", "test")
+	require.Nil(t, err)
+
+	// next start
+	Reset()
+	v = time.Second
+	register("interval", &v)
+	require.Nil(t, ps.Put(context.TODO(), StorageCtx, storage.Entry{Key: "unregistered", Value: []byte("1s")}))
+	require.Nil(t, Restore(context.TODO(), ps))
+	require.Equal(t, time.Hour, v)
+
+	_, err = Unset(context.TODO(), "interval", "test")
+	require.Nil(t, err)
+	b, err := ps.Load(context.TODO(), StorageCtx, "interval")
+	require.Nil(t, err)
+	require.Empty(t, b)
+}
+
+func TestAdmin(t *testing.T) {
+	Reset()
+	v := time.Second
+	register("interval", &v)
+
+	var ctx fasthttp.RequestCtx
+	ctx.SetUserValue("name", "interval")
+	ctx.Request.SetBodyString(`{"value":"30s"}`)
+	handleSet(&ctx)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	var c Change
+	require.Nil(t, json.Unmarshal(ctx.Response.Body(), &c))
+	require.Equal(t, "30s", c.New)
+	require.Equal(t, 30*time.Second, v)
+
+	ctx = fasthttp.RequestCtx{}
+	ctx.SetUserValue("name", "interval")
+	ctx.Request.SetBodyString(`{"value":"0s"}`)
+	handleSet(&ctx)
+	require.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+
+	ctx = fasthttp.RequestCtx{}
+	ctx.SetUserValue("name", "unknown")
+	handleUnset(&ctx)
+	require.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// States of circuit breaker, values of mochi_storage_breaker_state gauge
+const (
+	BreakerClosed = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+const (
+	defaultBreakerMinRequests      = 20
+	defaultBreakerWindow           = 10 * time.Second
+	defaultBreakerOpenTimeout      = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 5
+)
+
+// ErrStorageUnavailable is returned (wrapped into bittorrent.RetryError)
+// by PeerStorage wrapped with breaker while breaker is open,
+// without request to underlying storage
+var ErrStorageUnavailable = bittorrent.NewRetryableError(bittorrent.ReasonRetry, "storage is unavailable, retry later")
+
+// BreakerConfig configures circuit breaker around storage.
+// Breaker is disabled if FailureRatio is zero.
+type BreakerConfig struct {
+	// FailureRatio is the fraction of failed requests within Window,
+	// above which breaker opens
+	FailureRatio float64 `cfg:"failure_ratio"`
+	// MinRequests is the minimal number of requests within Window
+	// to calculate FailureRatio
+	MinRequests int `cfg:"min_requests"`
+	// Window is the period of failures counting
+	Window time.Duration `cfg:"window"`
+	// SlowThreshold if set, requests processed longer are counted as failed
+	SlowThreshold time.Duration `cfg:"slow_threshold"`
+	// OpenTimeout is the time, after which open breaker lets
+	// HalfOpenRequests probe requests to storage
+	OpenTimeout time.Duration `cfg:"open_timeout"`
+	// HalfOpenRequests is the number of successful probe requests
+	// required to close breaker
+	HalfOpenRequests int `cfg:"half_open_requests"`
+}
+
+// Enabled returns true if breaker is configured
+func (c BreakerConfig) Enabled() bool {
+	return c.FailureRatio > 0
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (c BreakerConfig) Validate() (validCfg BreakerConfig) {
+	validCfg = c
+	if c.FailureRatio > 1 {
+		validCfg.FailureRatio = 1
+		logger.Warn().
+			Str("name", "Breaker.FailureRatio").
+			Float64("provided", c.FailureRatio).
+			Float64("default", validCfg.FailureRatio).
+			Msg("falling back to default configuration")
+	}
+	if c.MinRequests <= 0 {
+		validCfg.MinRequests = defaultBreakerMinRequests
+		logger.Warn().
+			Str("name", "Breaker.MinRequests").
+			Int("provided", c.MinRequests).
+			Int("default", validCfg.MinRequests).
+			Msg("falling back to default configuration")
+	}
+	if c.Window <= 0 {
+		validCfg.Window = defaultBreakerWindow
+		logger.Warn().
+			Str("name", "Breaker.Window").
+			Dur("provided", c.Window).
+			Dur("default", validCfg.Window).
+			Msg("falling back to default configuration")
+	}
+	if c.OpenTimeout <= 0 {
+		validCfg.OpenTimeout = defaultBreakerOpenTimeout
+		logger.Warn().
+			Str("name", "Breaker.OpenTimeout").
+			Dur("provided", c.OpenTimeout).
+			Dur("default", validCfg.OpenTimeout).
+			Msg("falling back to default configuration")
+	}
+	if c.HalfOpenRequests <= 0 {
+		validCfg.HalfOpenRequests = defaultBreakerHalfOpenRequests
+		logger.Warn().
+			Str("name", "Breaker.HalfOpenRequests").
+			Int("provided", c.HalfOpenRequests).
+			Int("default", validCfg.HalfOpenRequests).
+			Msg("falling back to default configuration")
+	}
+	return
+}
+
+// breaker stops requests to storage by returning ErrStorageUnavailable
+// if too many of them failed or were slow, and lets a few probe requests
+// after OpenTimeout to check if storage is recovered.
+// Ping, Dump and Close are not limited.
+type breaker struct {
+	PeerStorage
+	cfg      BreakerConfig
+	name     string
+	errOpen  error
+	gauge    prometheus.Gauge
+	rejected prometheus.Counter
+	now      func() time.Time
+
+	mu    sync.Mutex
+	state int
+	// generation changes with every state change,
+	// results of requests started in previous state are ignored
+	generation          uint64
+	windowStart, opened time.Time
+	requests, failures  int
+	probes, probed      int
+}
+
+type dumpingBreaker struct {
+	*breaker
+	Dumper
+}
+
+// WithBreaker wraps ps with circuit breaker configured with validated cfg.
+// name is the label of breaker's metrics (i.e. storage driver name).
+// Returned storage implements Dumper if ps does.
+func WithBreaker(ps PeerStorage, name string, cfg BreakerConfig) PeerStorage {
+	b := &breaker{
+		PeerStorage: ps,
+		cfg:         cfg,
+		name:        name,
+		errOpen:     bittorrent.RetryError{ClientError: ErrStorageUnavailable, RetryIn: cfg.OpenTimeout},
+		gauge:       PromBreakerState.WithLabelValues(name),
+		rejected:    PromBreakerRejectedCount.WithLabelValues(name),
+		now:         time.Now,
+	}
+	b.gauge.Set(BreakerClosed)
+	if d, ok := ps.(Dumper); ok {
+		return dumpingBreaker{breaker: b, Dumper: d}
+	}
+	return b
+}
+
+// setState must be called with locked mu
+func (b *breaker) setState(state int, now time.Time) {
+	if b.state == state {
+		return
+	}
+	switch state {
+	case BreakerOpen:
+		logger.Warn().Str("storage", b.name).Int("requests", b.requests).Int("failures", b.failures).
+			Msg("storage circuit breaker opened")
+	case BreakerHalfOpen:
+		logger.Info().Str("storage", b.name).Msg("storage circuit breaker is half-open, probing storage")
+	case BreakerClosed:
+		logger.Info().Str("storage", b.name).Msg("storage circuit breaker closed")
+	}
+	b.state = state
+	b.generation++
+	b.windowStart, b.opened = now, now
+	b.requests, b.failures, b.probes, b.probed = 0, 0, 0, 0
+	b.gauge.Set(float64(state))
+}
+
+// allow checks if request may be sent to storage and
+// returns generation, which should be passed to done
+func (b *breaker) allow() (generation uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.state == BreakerOpen && now.Sub(b.opened) >= b.cfg.OpenTimeout {
+		b.setState(BreakerHalfOpen, now)
+	}
+	switch b.state {
+	case BreakerOpen:
+		return 0, false
+	case BreakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return 0, false
+		}
+		b.probes++
+	}
+	return b.generation, true
+}
+
+// failed returns true if error is caused by storage (not by client)
+// or request processed too long
+func (b *breaker) failed(err error, elapsed time.Duration) bool {
+	if b.cfg.SlowThreshold > 0 && elapsed > b.cfg.SlowThreshold {
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var clientErr bittorrent.ClientError
+	return !errors.As(err, &clientErr)
+}
+
+func (b *breaker) done(generation uint64, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	now := b.now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.setState(BreakerOpen, now)
+		} else if b.probed++; b.probed >= b.cfg.HalfOpenRequests {
+			b.setState(BreakerClosed, now)
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) > b.cfg.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.cfg.MinRequests && float64(b.failures) >= b.cfg.FailureRatio*float64(b.requests) {
+			b.setState(BreakerOpen, now)
+		}
+	}
+}
+
+func (b *breaker) call(fn func() error) error {
+	generation, ok := b.allow()
+	if !ok {
+		b.rejected.Inc()
+		return b.errOpen
+	}
+	start := b.now()
+	err := fn()
+	b.done(generation, b.failed(err, b.now().Sub(start)))
+	return err
+}
+
+func (b *breaker) Put(ctx context.Context, storeCtx string, values ...Entry) error {
+	return b.call(func() error { return b.PeerStorage.Put(ctx, storeCtx, values...) })
+}
+
+func (b *breaker) Contains(ctx context.Context, storeCtx string, key string) (contains bool, err error) {
+	err = b.call(func() (err error) {
+		contains, err = b.PeerStorage.Contains(ctx, storeCtx, key)
+		return
+	})
+	return
+}
+
+func (b *breaker) Load(ctx context.Context, storeCtx string, key string) (v []byte, err error) {
+	err = b.call(func() (err error) {
+		v, err = b.PeerStorage.Load(ctx, storeCtx, key)
+		return
+	})
+	return
+}
+
+func (b *breaker) Delete(ctx context.Context, storeCtx string, keys ...string) error {
+	return b.call(func() error { return b.PeerStorage.Delete(ctx, storeCtx, keys...) })
+}
+
+func (b *breaker) CompareAndSwap(ctx context.Context, storeCtx, key string, old, value []byte) (swapped bool, err error) {
+	cs, ok := b.PeerStorage.(CompareAndSwapper)
+	if !ok {
+		return false, ErrCompareAndSwapNotSupported
+	}
+	err = b.call(func() (err error) {
+		swapped, err = cs.CompareAndSwap(ctx, storeCtx, key, old, value)
+		return
+	})
+	return
+}
+
+func (b *breaker) Admit(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if _, ok := b.PeerStorage.(Admitter); !ok {
+		return nil
+	}
+	return b.call(func() error { return Admit(ctx, b.PeerStorage, ih, peer) })
+}
+
+func (b *breaker) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return b.call(func() error { return b.PeerStorage.PutSeeder(ctx, ih, peer) })
+}
+
+func (b *breaker) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return b.call(func() error { return b.PeerStorage.DeleteSeeder(ctx, ih, peer) })
+}
+
+func (b *breaker) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return b.call(func() error { return b.PeerStorage.PutLeecher(ctx, ih, peer) })
+}
+
+func (b *breaker) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return b.call(func() error { return b.PeerStorage.DeleteLeecher(ctx, ih, peer) })
+}
+
+func (b *breaker) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return b.call(func() error { return b.PeerStorage.GraduateLeecher(ctx, ih, peer) })
+}
+
+func (b *breaker) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+	err = b.call(func() (err error) {
+		peers, err = b.PeerStorage.AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+		return
+	})
+	return
+}
+
+func (b *breaker) AnnouncePeersFunc(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool) error {
+	return b.call(func() error { return b.PeerStorage.AnnouncePeersFunc(ctx, ih, forSeeder, numWant, v6, fn) })
+}
+
+func (b *breaker) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
+	err = b.call(func() (err error) {
+		leechers, seeders, snatched, err = b.PeerStorage.ScrapeSwarm(ctx, ih)
+		return
+	})
+	return
+}
+
+// Counts implements Counter with Counter of underlying storage or ScrapeSwarm
+func (b *breaker) Counts(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, err error) {
+	err = b.call(func() (err error) {
+		leechers, seeders, err = Counts(ctx, b.PeerStorage, ih)
+		return
+	})
+	return
+}
@@ -0,0 +1,102 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+	"github.com/sot-tech/mochi/storage/test"
+)
+
+var errBackend = errors.New("backend failure")
+
+// failingStorage returns err from ScrapeSwarm if set
+type failingStorage struct {
+	storage.PeerStorage
+	err   error
+	calls int
+}
+
+func (s *failingStorage) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	s.calls++
+	if s.err != nil {
+		return 0, 0, 0, s.err
+	}
+	return s.PeerStorage.ScrapeSwarm(ctx, ih)
+}
+
+func TestBreaker(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.NoError(t, err)
+	defer ps.Close()
+	fs := &failingStorage{PeerStorage: ps}
+	cfg := storage.BreakerConfig{
+		FailureRatio: 0.5, MinRequests: 4, HalfOpenRequests: 2, OpenTimeout: 50 * time.Millisecond,
+	}.Validate()
+	b := storage.WithBreaker(fs, "test", cfg)
+	_, isDumper := b.(storage.Dumper)
+	require.False(t, isDumper)
+	_, isDumper = storage.WithBreaker(ps, "test", cfg).(storage.Dumper)
+	require.True(t, isDumper)
+
+	ctx, ih := context.Background(), bittorrent.InfoHash("11111111111111111111")
+	scrape := func() error {
+		_, _, _, err := b.ScrapeSwarm(ctx, ih)
+		return err
+	}
+
+	// client errors and cancellations are not failures
+	fs.err = storage.ErrResourceDoesNotExist
+	for range 4 {
+		require.ErrorIs(t, scrape(), storage.ErrResourceDoesNotExist)
+	}
+	fs.err = context.Canceled
+	require.ErrorIs(t, scrape(), context.Canceled)
+
+	// 5 of 10 requests within window failed
+	fs.err = errBackend
+	for range 5 {
+		require.ErrorIs(t, scrape(), errBackend)
+	}
+	// breaker is open, storage is not requested
+	calls := fs.calls
+	err = scrape()
+	require.ErrorIs(t, err, storage.ErrStorageUnavailable)
+	var retryErr bittorrent.RetryError
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, calls, fs.calls)
+	// not limited methods
+	require.NoError(t, b.Ping(ctx))
+
+	// failed probe opens breaker again
+	time.Sleep(60 * time.Millisecond)
+	require.ErrorIs(t, scrape(), errBackend)
+	require.ErrorIs(t, scrape(), storage.ErrStorageUnavailable)
+
+	// successful probes close breaker
+	time.Sleep(60 * time.Millisecond)
+	fs.err = nil
+	require.NoError(t, scrape())
+	require.NoError(t, scrape())
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	require.NoError(t, b.PutSeeder(ctx, ih, peer))
+	_, seeders, err := storage.Counts(ctx, b, ih)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), seeders)
+}
+
+func TestBreakerConformance(t *testing.T) {
+	test.RunConformanceTests(t, func() storage.PeerStorage {
+		ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+		require.NoError(t, err)
+		return storage.WithBreaker(ps, "test", storage.BreakerConfig{FailureRatio: 1}.Validate())
+	})
+}
@@ -0,0 +1,434 @@
+// Package cluster implements the storage interface, which distributes swarms
+// between tracker nodes. Every member owns a slice of info hash space
+// (consistent hash ring over member list) and keeps owned swarms in its
+// local storage (i.e. memory), operations with swarms owned by other
+// members are forwarded to the owner via internal RPC.
+// Arbitrary data (storage.DataStorage) is kept in local storage of every member.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/admin"
+	membership "github.com/sot-tech/mochi/pkg/cluster"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+const (
+	// Name - registered name of the storage
+	Name = "cluster"
+
+	defaultVirtualNodes = 128
+	defaultTimeout      = time.Second
+)
+
+var (
+	logger = log.NewLogger("storage/cluster")
+
+	errSelfNotProvided = errors.New("self address not provided")
+	errSelfNotMember   = errors.New("self address is not in members")
+
+	// promForwards is the number of operations forwarded to other members
+	promForwards = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_storage_cluster_forwards_total",
+		Help: "The number of swarm operations forwarded to other cluster members",
+	}, []string{"method", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(promForwards)
+	storage.RegisterDriver(Name, builder{})
+}
+
+// Config holds the configuration of cluster storage
+type Config struct {
+	// Self is the address of this member in Members
+	Self string
+	// ListenAddr is the address of RPC listener, Self if not set
+	ListenAddr string `cfg:"listen_addr"`
+	// Members are the RPC addresses of all members including Self
+	Members []string
+	// VirtualNodes is the number of ring points of every member
+	VirtualNodes int `cfg:"virtual_nodes"`
+	// Timeout of forwarded operation
+	Timeout time.Duration
+	// Local is the storage of owned swarms and data, memory if not set
+	Local conf.NamedMapConfig
+	// Gossip enables discovery of members, if set, Members
+	// are replaced with alive members discovered via gossip
+	Gossip *membership.Config
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+func (cfg Config) Validate() (validCfg Config, err error) {
+	validCfg = cfg
+	if len(cfg.Self) == 0 {
+		err = errSelfNotProvided
+		return
+	}
+	if len(cfg.Members) == 0 {
+		validCfg.Members = []string{cfg.Self}
+	} else if !slices.Contains(cfg.Members, cfg.Self) {
+		err = errSelfNotMember
+		return
+	}
+	if len(cfg.ListenAddr) == 0 {
+		validCfg.ListenAddr = cfg.Self
+	}
+	if cfg.VirtualNodes <= 0 {
+		validCfg.VirtualNodes = defaultVirtualNodes
+		logger.Warn().
+			Str("name", "VirtualNodes").
+			Int("provided", cfg.VirtualNodes).
+			Int("default", validCfg.VirtualNodes).
+			Msg("falling back to default configuration")
+	}
+	if cfg.Timeout <= 0 {
+		validCfg.Timeout = defaultTimeout
+		logger.Warn().
+			Str("name", "Timeout").
+			Dur("provided", cfg.Timeout).
+			Dur("default", validCfg.Timeout).
+			Msg("falling back to default configuration")
+	}
+	if len(cfg.Local.Name) == 0 {
+		validCfg.Local = conf.NamedMapConfig{Name: memory.Name, Config: conf.MapConfig{}}
+	} else if validCfg.Local.Config == nil {
+		validCfg.Local.Config = conf.MapConfig{}
+	}
+	if cfg.Gossip != nil {
+		gc := *cfg.Gossip
+		if len(gc.Name) == 0 {
+			gc.Name = cfg.Self
+		}
+		// members advertise their RPC addresses
+		gc.Meta = cfg.Self
+		validCfg.Gossip = &gc
+	}
+	return
+}
+
+type builder struct{}
+
+func (builder) NewDataStorage(icfg conf.MapConfig) (storage.DataStorage, error) {
+	return builder{}.NewPeerStorage(icfg)
+}
+
+func (builder) NewPeerStorage(icfg conf.MapConfig) (storage.PeerStorage, error) {
+	var cfg Config
+	if err := icfg.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	return newStore(cfg)
+}
+
+type store struct {
+	storage.PeerStorage
+	cfg     Config
+	ring    atomic.Pointer[ring]
+	members sync.Map // address -> *member
+	ln      net.Listener
+	// conns are accepted connections of other members
+	conns sync.Map
+	wg    sync.WaitGroup
+	node  *membership.Node
+
+	onceCloser sync.Once
+	closeErr   error
+}
+
+func newStore(provided Config) (*store, error) {
+	cfg, err := provided.Validate()
+	if err != nil {
+		return nil, err
+	}
+	local, err := storage.NewPeerStorage(cfg.Local)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create local storage: %w", err)
+	}
+	srv := rpc.NewServer()
+	if err = srv.RegisterName(serviceName, &Swarm{st: local}); err == nil {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", cfg.ListenAddr); err == nil {
+			s := &store{PeerStorage: local, cfg: cfg, ln: ln}
+			s.ring.Store(newRing(cfg.Members, cfg.VirtualNodes))
+			s.wg.Add(1)
+			go s.serve(srv)
+			if cfg.Gossip != nil {
+				if s.node, err = membership.Start(*cfg.Gossip); err != nil {
+					_ = s.Close()
+					return nil, fmt.Errorf("unable to start gossip: %w", err)
+				}
+				s.node.Subscribe(s.updateMembers)
+				s.updateMembers(s.node.Members())
+			}
+			admin.Handle(http.MethodGet, "/cluster/members", s.handleGetMembers)
+			admin.Handle(http.MethodPut, "/cluster/members", s.handlePutMembers)
+			logger.Info().Str("self", cfg.Self).Strs("members", cfg.Members).Msg("cluster member started")
+			return s, nil
+		}
+	}
+	_ = local.Close()
+	return nil, err
+}
+
+func (s *store) serve(srv *rpc.Server) {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error().Err(err).Msg("unable to accept connection")
+			}
+			return
+		}
+		s.conns.Store(conn, nil)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			srv.ServeConn(conn)
+			s.conns.Delete(conn)
+		}()
+	}
+}
+
+// SetMembers replaces member list, swarms are redistributed
+// between members on the next operations
+func (s *store) SetMembers(members []string) error {
+	if !slices.Contains(members, s.cfg.Self) {
+		return errSelfNotMember
+	}
+	r := newRing(members, s.cfg.VirtualNodes)
+	s.ring.Store(r)
+	s.members.Range(func(k, v any) bool {
+		if !slices.Contains(r.members, k.(string)) {
+			s.members.Delete(k)
+			_ = v.(*member).close()
+		}
+		return true
+	})
+	logger.Info().Strs("members", r.members).Msg("cluster members updated")
+	return nil
+}
+
+// updateMembers re-shards ring with alive members discovered via gossip
+func (s *store) updateMembers(ms []membership.Member) {
+	members := make([]string, 0, len(ms))
+	for _, m := range ms {
+		if len(m.Meta) > 0 {
+			members = append(members, m.Meta)
+		}
+	}
+	if err := s.SetMembers(members); err != nil {
+		logger.Error().Err(err).Strs("members", members).Msg("unable to update members")
+	}
+}
+
+// remote returns client of owner of info hash or nil if this member is the owner
+func (s *store) remote(ih bittorrent.InfoHash) *member {
+	addr := s.ring.Load().owner(ih)
+	if addr == s.cfg.Self {
+		return nil
+	}
+	if m, ok := s.members.Load(addr); ok {
+		return m.(*member)
+	}
+	m, _ := s.members.LoadOrStore(addr, &member{addr: addr, timeout: s.cfg.Timeout})
+	return m.(*member)
+}
+
+func (s *store) forward(ctx context.Context, m *member, method string, args, reply any) error {
+	err := m.call(ctx, method, args, reply)
+	if metrics.Enabled() {
+		result := "ok"
+		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+			result = "error"
+		}
+		promForwards.WithLabelValues(method, result).Inc()
+	}
+	if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+		logger.Debug().Err(err).Str("member", m.addr).Str("method", method).Msg("forwarding failed")
+	}
+	return err
+}
+
+func (s *store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if m := s.remote(ih); m != nil {
+		return s.forward(ctx, m, "Put", PeerArgs{
+			InfoHash: string(ih), Peer: newPeer(peer), Seeder: true, Lifetime: storage.PeerLifetime(ctx, peer.Addr().Is6()),
+		}, &struct{}{})
+	}
+	return s.PeerStorage.PutSeeder(ctx, ih, peer)
+}
+
+func (s *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if m := s.remote(ih); m != nil {
+		return s.forward(ctx, m, "Delete", PeerArgs{InfoHash: string(ih), Peer: newPeer(peer), Seeder: true}, &struct{}{})
+	}
+	return s.PeerStorage.DeleteSeeder(ctx, ih, peer)
+}
+
+func (s *store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if m := s.remote(ih); m != nil {
+		return s.forward(ctx, m, "Put", PeerArgs{
+			InfoHash: string(ih), Peer: newPeer(peer), Lifetime: storage.PeerLifetime(ctx, peer.Addr().Is6()),
+		}, &struct{}{})
+	}
+	return s.PeerStorage.PutLeecher(ctx, ih, peer)
+}
+
+func (s *store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if m := s.remote(ih); m != nil {
+		return s.forward(ctx, m, "Delete", PeerArgs{InfoHash: string(ih), Peer: newPeer(peer)}, &struct{}{})
+	}
+	return s.PeerStorage.DeleteLeecher(ctx, ih, peer)
+}
+
+func (s *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if m := s.remote(ih); m != nil {
+		return s.forward(ctx, m, "Graduate", PeerArgs{
+			InfoHash: string(ih), Peer: newPeer(peer), Lifetime: storage.PeerLifetime(ctx, peer.Addr().Is6()),
+		}, &struct{}{})
+	}
+	return s.PeerStorage.GraduateLeecher(ctx, ih, peer)
+}
+
+func (s *store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+	if m := s.remote(ih); m != nil {
+		err = s.announceRemote(ctx, m, ih, forSeeder, numWant, v6, func(p bittorrent.Peer) bool {
+			peers = append(peers, p)
+			return true
+		})
+		return
+	}
+	return s.PeerStorage.AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+}
+
+func (s *store) AnnouncePeersFunc(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool) error {
+	if m := s.remote(ih); m != nil {
+		return s.announceRemote(ctx, m, ih, forSeeder, numWant, v6, fn)
+	}
+	return s.PeerStorage.AnnouncePeersFunc(ctx, ih, forSeeder, numWant, v6, fn)
+}
+
+func (s *store) announceRemote(ctx context.Context, m *member, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool) error {
+	if numWant <= 0 {
+		return nil
+	}
+	var peers []Peer
+	err := s.forward(ctx, m, "Announce", AnnounceArgs{InfoHash: string(ih), ForSeeder: forSeeder, NumWant: numWant, V6: v6}, &peers)
+	for _, p := range peers {
+		if !fn(p.peer()) {
+			break
+		}
+	}
+	return err
+}
+
+func (s *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	if m := s.remote(ih); m != nil {
+		var reply ScrapeReply
+		err := s.forward(ctx, m, "Scrape", string(ih), &reply)
+		return reply.Leechers, reply.Seeders, reply.Snatched, err
+	}
+	return s.PeerStorage.ScrapeSwarm(ctx, ih)
+}
+
+// Counts returns counts of local swarm with storage.Counts,
+// counts of remote swarm are taken from forwarded scrape
+func (s *store) Counts(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, error) {
+	if s.remote(ih) != nil {
+		leechers, seeders, _, err := s.ScrapeSwarm(ctx, ih)
+		return leechers, seeders, err
+	}
+	return storage.Counts(ctx, s.PeerStorage, ih)
+}
+
+// Admit checks peer in storage of swarm's owner
+func (s *store) Admit(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if m := s.remote(ih); m != nil {
+		return s.forward(ctx, m, "Admit", PeerArgs{InfoHash: string(ih), Peer: newPeer(peer)}, &struct{}{})
+	}
+	return storage.Admit(ctx, s.PeerStorage, ih, peer)
+}
+
+// CompareAndSwap replaces data in local storage, if it supports it
+func (s *store) CompareAndSwap(ctx context.Context, storeCtx, key string, old, value []byte) (bool, error) {
+	if cs, ok := s.PeerStorage.(storage.CompareAndSwapper); ok {
+		return cs.CompareAndSwap(ctx, storeCtx, key, old, value)
+	}
+	return false, storage.ErrCompareAndSwapNotSupported
+}
+
+// Dump iterates over swarms owned by this member, if local storage supports it
+func (s *store) Dump(ctx context.Context, fn func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error) error {
+	if d, ok := s.PeerStorage.(storage.Dumper); ok {
+		return d.Dump(ctx, fn)
+	}
+	return errors.New("local storage does not support dump")
+}
+
+func (s *store) handleGetMembers(ctx *fasthttp.RequestCtx) {
+	admin.WriteJSON(ctx, fasthttp.StatusOK, map[string]any{
+		"self":    s.cfg.Self,
+		"members": s.ring.Load().members,
+	})
+}
+
+// handlePutMembers replaces member list with JSON array from request body,
+// i.e. by external service discovery
+func (s *store) handlePutMembers(ctx *fasthttp.RequestCtx) {
+	var members []string
+	if err := json.Unmarshal(ctx.PostBody(), &members); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	if err := s.SetMembers(members); err != nil {
+		admin.WriteError(ctx, fasthttp.StatusBadRequest, err)
+		return
+	}
+	s.handleGetMembers(ctx)
+}
+
+func (s *store) Close() error {
+	s.onceCloser.Do(func() {
+		var err error
+		if s.node != nil {
+			// leave cluster before listener stopped, so
+			// other members stop forwarding operations
+			err = s.node.Close()
+		}
+		err = errors.Join(err, s.ln.Close())
+		s.conns.Range(func(k, _ any) bool {
+			_ = k.(net.Conn).Close()
+			return true
+		})
+		s.members.Range(func(k, v any) bool {
+			s.members.Delete(k)
+			_ = v.(*member).close()
+			return true
+		})
+		s.wg.Wait()
+		s.closeErr = errors.Join(err, s.PeerStorage.Close())
+	})
+	return s.closeErr
+}
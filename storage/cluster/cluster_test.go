@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"net/rpc"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	membership "github.com/sot-tech/mochi/pkg/cluster"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/test"
+)
+
+const (
+	addrA = "127.0.0.1:16990"
+	addrB = "127.0.0.1:16991"
+)
+
+func newMembers(t *testing.T) (a, b *store) {
+	var err error
+	members := []string{addrA, addrB}
+	a, err = newStore(Config{Self: addrA, Members: members})
+	require.NoError(t, err)
+	b, err = newStore(Config{Self: addrB, Members: members})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	return
+}
+
+// infoHashOf returns random info hash owned by member
+func infoHashOf(t *testing.T, r *ring, member string) bittorrent.InfoHash {
+	b := make([]byte, bittorrent.InfoHashV1Len)
+	for {
+		_, err := rand.Read(b)
+		require.NoError(t, err)
+		if ih := bittorrent.InfoHash(b); r.owner(ih) == member {
+			return ih
+		}
+	}
+}
+
+func TestStorage(t *testing.T) {
+	// dump iterates over owned swarms only, so all swarms must be owned by single member
+	test.RunConformanceTests(t, func() storage.PeerStorage {
+		s, err := newStore(Config{Self: addrA})
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestForward(t *testing.T) {
+	a, b := newMembers(t)
+	ctx := context.Background()
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+
+	ih := infoHashOf(t, a.ring.Load(), addrB)
+	require.NoError(t, a.PutSeeder(ctx, ih, peer))
+	_, seeders, _, err := b.PeerStorage.ScrapeSwarm(ctx, ih)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), seeders)
+	_, seeders, _, err = a.PeerStorage.ScrapeSwarm(ctx, ih)
+	require.NoError(t, err)
+	require.Zero(t, seeders)
+	_, seeders, _, err = a.ScrapeSwarm(ctx, ih)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), seeders)
+
+	peers, err := a.AnnouncePeers(ctx, ih, false, 10, false)
+	require.NoError(t, err)
+	require.Equal(t, []bittorrent.Peer{peer}, peers)
+
+	// V2 hash is owned by owner of truncated hash
+	require.Equal(t, addrB, a.ring.Load().owner(bittorrent.InfoHash(string(ih)+"123456789012")))
+
+	// after member removed, swarms are owned by remaining members
+	require.ErrorIs(t, a.SetMembers([]string{addrB}), errSelfNotMember)
+	require.NoError(t, a.SetMembers([]string{addrA}))
+	_, seeders, _, err = a.ScrapeSwarm(ctx, ih)
+	require.NoError(t, err)
+	require.Zero(t, seeders)
+}
+
+func TestGossip(t *testing.T) {
+	const rpcA, rpcB = "127.0.0.1:16992", "127.0.0.1:16993"
+	gossip := func(addr string, seeds ...string) *membership.Config {
+		return &membership.Config{
+			Addr:             addr,
+			Seeds:            seeds,
+			ProbeInterval:    50 * time.Millisecond,
+			ProbeTimeout:     20 * time.Millisecond,
+			SuspicionTimeout: 200 * time.Millisecond,
+		}
+	}
+	a, err := newStore(Config{Self: rpcA, Gossip: gossip("127.0.0.1:17949")})
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := newStore(Config{Self: rpcB, Gossip: gossip("127.0.0.1:17950", "127.0.0.1:17949")})
+	require.NoError(t, err)
+
+	for _, s := range []*store{a, b} {
+		require.Eventually(t, func() bool {
+			return slices.Equal([]string{rpcA, rpcB}, s.ring.Load().members)
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// swarms of left member are re-sharded
+	require.NoError(t, b.Close())
+	require.Eventually(t, func() bool {
+		return slices.Equal([]string{rpcA}, a.ring.Load().members)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// slowSwarm replies to scrape after timeout of member
+type slowSwarm struct{}
+
+func (slowSwarm) Scrape(_ string, reply *ScrapeReply) error {
+	time.Sleep(50 * time.Millisecond)
+	reply.Seeders = 1
+	return nil
+}
+
+func TestCallTimeout(t *testing.T) {
+	srv := rpc.NewServer()
+	require.NoError(t, srv.RegisterName(serviceName, slowSwarm{}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go srv.Accept(ln)
+
+	m := &member{addr: ln.Addr().String(), timeout: 10 * time.Millisecond}
+	defer m.close()
+	var reply ScrapeReply
+	require.ErrorIs(t, m.call(context.Background(), "Scrape", "", &reply), context.DeadlineExceeded)
+	// late reply is not decoded into caller's value
+	time.Sleep(100 * time.Millisecond)
+	require.Zero(t, reply.Seeders)
+
+	m.timeout = time.Second
+	require.NoError(t, m.call(context.Background(), "Scrape", "", &reply))
+	require.Equal(t, uint32(1), reply.Seeders)
+}
@@ -0,0 +1,58 @@
+package cluster
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// ring is the consistent hash ring of cluster members
+type ring struct {
+	members []string
+	points  []uint64
+	owners  []string
+}
+
+// newRing creates ring with vnodes points for every member
+func newRing(members []string, vnodes int) *ring {
+	r := &ring{members: slices.Clone(members)}
+	slices.Sort(r.members)
+	r.members = slices.Compact(r.members)
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(r.members)*vnodes)
+	for _, m := range r.members {
+		for i := 0; i < vnodes; i++ {
+			points = append(points, point{xxhash.Sum64String(m + "#" + strconv.Itoa(i)), m})
+		}
+	}
+	slices.SortFunc(points, func(a, b point) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	r.points, r.owners = make([]uint64, len(points)), make([]string, len(points))
+	for i, p := range points {
+		r.points[i], r.owners[i] = p.hash, p.owner
+	}
+	return r
+}
+
+// owner returns member, which owns info hash. V2 hashes are owned
+// by the owner of truncated hash, so they address the same swarm.
+func (r *ring) owner(ih bittorrent.InfoHash) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := xxhash.Sum64String(string(ih.TruncateV1()))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
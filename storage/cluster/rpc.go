@@ -0,0 +1,185 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// serviceName is the name of RPC service of swarm operations
+const serviceName = "Swarm"
+
+// Peer is the wire representation of bittorrent.Peer. It is required
+// because bittorrent.Peer inherits binary marshaller of netip.AddrPort,
+// which does not encode peer ID.
+type Peer struct {
+	ID       bittorrent.PeerID
+	AddrPort netip.AddrPort
+}
+
+func newPeer(p bittorrent.Peer) Peer {
+	return Peer{ID: p.ID, AddrPort: p.AddrPort}
+}
+
+func (p Peer) peer() bittorrent.Peer {
+	return bittorrent.Peer{ID: p.ID, AddrPort: p.AddrPort}
+}
+
+// PeerArgs is the argument of forwarded peer modification
+type PeerArgs struct {
+	InfoHash string
+	Peer     Peer
+	Seeder   bool
+	// Lifetime is the lifetime of peer set by storage.WithPeerLifetime
+	Lifetime time.Duration
+}
+
+// AnnounceArgs is the argument of forwarded peers selection
+type AnnounceArgs struct {
+	InfoHash  string
+	ForSeeder bool
+	NumWant   int
+	V6        bool
+}
+
+// ScrapeReply is the result of forwarded scrape
+type ScrapeReply struct {
+	Leechers, Seeders, Snatched uint32
+}
+
+// Swarm is the RPC service, which executes operations forwarded
+// by other members on the local storage of this member.
+// Operations are not forwarded further, even if this member
+// is not the owner of swarm in its own ring.
+type Swarm struct {
+	st storage.PeerStorage
+}
+
+// Put adds seeder or leecher into swarm
+func (s *Swarm) Put(args PeerArgs, _ *struct{}) error {
+	ctx, ih := storage.WithPeerLifetime(context.Background(), args.Lifetime, args.Lifetime), bittorrent.InfoHash(args.InfoHash)
+	if args.Seeder {
+		return s.st.PutSeeder(ctx, ih, args.Peer.peer())
+	}
+	return s.st.PutLeecher(ctx, ih, args.Peer.peer())
+}
+
+// Delete removes seeder or leecher from swarm
+func (s *Swarm) Delete(args PeerArgs, _ *struct{}) error {
+	ctx, ih := context.Background(), bittorrent.InfoHash(args.InfoHash)
+	if args.Seeder {
+		return s.st.DeleteSeeder(ctx, ih, args.Peer.peer())
+	}
+	return s.st.DeleteLeecher(ctx, ih, args.Peer.peer())
+}
+
+// Graduate promotes leecher to seeder
+func (s *Swarm) Graduate(args PeerArgs, _ *struct{}) error {
+	ctx := storage.WithPeerLifetime(context.Background(), args.Lifetime, args.Lifetime)
+	return s.st.GraduateLeecher(ctx, bittorrent.InfoHash(args.InfoHash), args.Peer.peer())
+}
+
+// Admit checks if peer may be put into swarm
+func (s *Swarm) Admit(args PeerArgs, _ *struct{}) error {
+	return storage.Admit(context.Background(), s.st, bittorrent.InfoHash(args.InfoHash), args.Peer.peer())
+}
+
+// Announce selects peers of swarm
+func (s *Swarm) Announce(args AnnounceArgs, reply *[]Peer) error {
+	return s.st.AnnouncePeersFunc(context.Background(), bittorrent.InfoHash(args.InfoHash), args.ForSeeder, args.NumWant, args.V6,
+		func(p bittorrent.Peer) bool {
+			*reply = append(*reply, newPeer(p))
+			return true
+		})
+}
+
+// Scrape returns counts of swarm
+func (s *Swarm) Scrape(infoHash string, reply *ScrapeReply) (err error) {
+	reply.Leechers, reply.Seeders, reply.Snatched, err = s.st.ScrapeSwarm(context.Background(), bittorrent.InfoHash(infoHash))
+	return
+}
+
+// member is the client of remote member, connection
+// is established on the first call and after failures
+type member struct {
+	addr    string
+	timeout time.Duration
+	mu      sync.Mutex
+	client  *rpc.Client
+}
+
+func (m *member) getClient() (*rpc.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		conn, err := net.DialTimeout("tcp", m.addr, m.timeout)
+		if err != nil {
+			return nil, err
+		}
+		m.client = rpc.NewClient(conn)
+	}
+	return m.client, nil
+}
+
+// reset closes broken connection, so it is re-established by next call
+func (m *member) reset(c *rpc.Client) {
+	m.mu.Lock()
+	if m.client == c {
+		m.client = nil
+	}
+	m.mu.Unlock()
+	_ = c.Close()
+}
+
+func (m *member) call(ctx context.Context, method string, args, reply any) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	c, err := m.getClient()
+	if err != nil {
+		return err
+	}
+	// reply is decoded into call-local value and copied after call is done,
+	// because call may be still in-flight after ctx is done
+	local := reflect.New(reflect.TypeOf(reply).Elem())
+	call := c.Go(serviceName+"."+method, args, local.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if err = call.Error; err == nil {
+			reflect.ValueOf(reply).Elem().Set(local.Elem())
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	var srvErr rpc.ServerError
+	if errors.As(err, &srvErr) {
+		// errors are transmitted as strings, so
+		// well-known ones are restored to be matched by callers
+		switch string(srvErr) {
+		case storage.ErrResourceDoesNotExist.Error():
+			err = storage.ErrResourceDoesNotExist
+		case storage.ErrTooManyPeersPerIP.Error():
+			err = storage.ErrTooManyPeersPerIP
+		}
+	} else if err != nil {
+		m.reset(c)
+	}
+	return err
+}
+
+func (m *member) close() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		err = m.client.Close()
+		m.client = nil
+	}
+	return
+}
@@ -12,6 +12,7 @@ package keydb
 import (
 	"context"
 	"errors"
+	"strings"
 
 	"github.com/redis/go-redis/v9"
 
@@ -22,13 +23,20 @@ import (
 	r "github.com/sot-tech/mochi/storage/redis"
 )
 
-const expireMemberCmd = "EXPIREMEMBER"
+const (
+	expireMemberCmd = "EXPIREMEMBER"
+	// compatibility is the only accepted compatibility mode,
+	// KeyDB supports all features of redis storage
+	compatibility = "keydb"
+)
 
 var (
 	logger = log.NewLogger("storage/keydb")
 	// errNotKeyDB returned from initializer if connected does not support KeyDB
 	// specific command (EXPIREMEMBER)
 	errNotKeyDB = errors.New("provided instance seems not KeyDB")
+	// errNotKeyDBCompatibility returned from initializer if compatibility mode is not keydb
+	errNotKeyDBCompatibility = errors.New("keydb storage supports only keydb compatibility mode")
 )
 
 func init() {
@@ -61,6 +69,10 @@ func (b builder) NewDataStorage(icfg conf.MapConfig) (storage.DataStorage, error
 
 func newStore(cfg r.Config) (*store, error) {
 	var err error
+	if c := strings.ToLower(cfg.Compatibility); len(c) > 0 && c != compatibility {
+		return nil, errNotKeyDBCompatibility
+	}
+	cfg.Compatibility = r.CompatibilityRedis
 	if cfg, err = cfg.Validate(); err != nil {
 		return nil, err
 	}
@@ -100,14 +112,24 @@ type store struct {
 	peerTTL uint
 }
 
-func (s *store) addPeer(ctx context.Context, infoHashKey, peerID string) (err error) {
+// ttl returns expiration of peer in seconds, lifetime
+// set by storage.WithPeerLifetime overrides configured one
+func (s *store) ttl(ctx context.Context, v6 bool) uint {
+	if d := storage.PeerLifetime(ctx, v6); d > 0 {
+		return uint(d.Seconds())
+	}
+	return s.peerTTL
+}
+
+func (s *store) addPeer(ctx context.Context, infoHashKey, peerID string, ttl uint) (err error) {
 	logger.Trace().
 		Str("infoHashKey", infoHashKey).
 		Str("peerID", peerID).
 		Msg("add peer")
-	if err = s.SAdd(ctx, infoHashKey, peerID).Err(); err == nil {
-		err = s.Process(ctx, redis.NewCmd(ctx, expireMemberCmd, infoHashKey, peerID, s.peerTTL))
-	}
+	_, err = s.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, infoHashKey, peerID)
+		return pipe.Process(ctx, redis.NewCmd(ctx, expireMemberCmd, infoHashKey, peerID, ttl))
+	})
 	return
 }
 
@@ -126,7 +148,8 @@ func (s *store) delPeer(ctx context.Context, infoHashKey, peerID string) error {
 }
 
 func (s *store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return s.addPeer(ctx, r.InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), r.PackPeer(peer))
+	isV6 := peer.Addr().Is6()
+	return s.addPeer(ctx, r.InfoHashKey(ih.RawString(), true, isV6), r.PackPeer(peer), s.ttl(ctx, isV6))
 }
 
 func (s *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
@@ -134,7 +157,8 @@ func (s *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer b
 }
 
 func (s *store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return s.addPeer(ctx, r.InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), r.PackPeer(peer))
+	isV6 := peer.Addr().Is6()
+	return s.addPeer(ctx, r.InfoHashKey(ih.RawString(), false, isV6), r.PackPeer(peer), s.ttl(ctx, isV6))
 }
 
 func (s *store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
@@ -151,14 +175,14 @@ func (s *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, pee
 	ihLeecherKey := r.InfoHashKey(infoHash, false, peer.Addr().Is6())
 	var moved bool
 	if moved, err = s.SMove(ctx, ihLeecherKey, ihSeederKey, peerID).Result(); err == nil {
-		if !moved {
-			err = s.SAdd(ctx, ihSeederKey, peerID).Err()
-		}
-		if err != nil {
-			if err = s.Process(ctx, redis.NewCmd(ctx, expireMemberCmd, ihSeederKey, peerID, s.peerTTL)); err == nil {
-				err = s.HIncrBy(ctx, r.CountDownloadsKey, infoHash, 1).Err()
+		_, err = s.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			if !moved {
+				pipe.SAdd(ctx, ihSeederKey, peerID)
 			}
-		}
+			_ = pipe.Process(ctx, redis.NewCmd(ctx, expireMemberCmd, ihSeederKey, peerID, s.ttl(ctx, peer.Addr().Is6())))
+			pipe.HIncrBy(ctx, r.CountDownloadsKey, infoHash, 1)
+			return nil
+		})
 	}
 	return err
 }
@@ -172,9 +196,25 @@ func (s *store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSe
 		Bool("v6", v6).
 		Msg("announce peers")
 
-	return s.GetPeers(ctx, ih, forSeeder, numWant, v6, func(ctx context.Context, infoHashKey string, maxCount int) *redis.StringSliceCmd {
-		return s.SRandMemberN(ctx, infoHashKey, int64(maxCount))
-	})
+	return s.GetPeers(ctx, ih, forSeeder, numWant, v6, s.randMembers)
+}
+
+// AnnouncePeersFunc is the same function as redis.AnnouncePeersFunc
+func (s *store) AnnouncePeersFunc(
+	ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool,
+) error {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Bool("forSeeder", forSeeder).
+		Int("numWant", numWant).
+		Bool("v6", v6).
+		Msg("announce peers")
+
+	return s.GetPeersFunc(ctx, ih, forSeeder, numWant, v6, s.randMembers, fn)
+}
+
+func (s *store) randMembers(ctx context.Context, infoHashKey string, maxCount int) *redis.StringSliceCmd {
+	return s.SRandMemberN(ctx, infoHashKey, int64(maxCount))
 }
 
 // ScrapeSwarm is the same function as redis.ScrapeSwarm except `SCard` call instead of `HLen`
@@ -184,3 +224,8 @@ func (s *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32
 		Msg("scrape swarm")
 	return s.ScrapeIH(ctx, ih, s.SCard)
 }
+
+// Counts is the same function as redis.Counts except `SCard` call instead of `HLen`
+func (s *store) Counts(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, error) {
+	return s.CountIH(ctx, ih, redis.Pipeliner.SCard)
+}
@@ -28,6 +28,22 @@ func createNew() s.PeerStorage {
 	return ps
 }
 
-func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
+func TestStorage(t *testing.T) { test.RunConformanceTests(t, createNew) }
 
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
+
+func TestCompatibility(t *testing.T) {
+	c := cfg
+	c.Compatibility = r.CompatibilityDragonfly
+	if _, err := newStore(c); err != errNotKeyDBCompatibility {
+		t.Fatalf("expected %v, got %v", errNotKeyDBCompatibility, err)
+	}
+	c.Compatibility = "KeyDB"
+	ps, err := newStore(c)
+	if err == errNotKeyDBCompatibility {
+		t.Fatalf("expected mode accepted regardless of case")
+	}
+	if err == nil {
+		_ = ps.Close()
+	}
+}
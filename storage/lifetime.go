@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+type peerLifetimeKey struct{}
+
+type peerLifetimes struct {
+	v4, v6 time.Duration
+}
+
+func init() {
+	// peers may be stored in post hooks
+	bittorrent.PreserveContextKey(peerLifetimeKey{})
+}
+
+// WithPeerLifetime returns copy of ctx, which makes storage keep IPv4 peers
+// put with this context for v4 and IPv6 peers for v6 instead of configured
+// peer lifetime. Zero value means configured lifetime.
+// Used by frontends to set lifetime per frontend and address family.
+func WithPeerLifetime(ctx context.Context, v4, v6 time.Duration) context.Context {
+	if v4 <= 0 && v6 <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, peerLifetimeKey{}, peerLifetimes{v4: v4, v6: v6})
+}
+
+// PeerLifetime returns lifetime of IPv4 or IPv6 peer set by WithPeerLifetime or zero
+func PeerLifetime(ctx context.Context, v6 bool) time.Duration {
+	l, _ := ctx.Value(peerLifetimeKey{}).(peerLifetimes)
+	if v6 {
+		return l.v6
+	}
+	return l.v4
+}
+
+// PeerLifetimeShift returns the difference between lifetime set by WithPeerLifetime
+// and configured lifetime, or zero if any of them is not set.
+// Storages add shift to modification time of peer, so garbage collection
+// with single cutoff removes peers according to their own lifetime.
+func PeerLifetimeShift(ctx context.Context, v6 bool, configured time.Duration) time.Duration {
+	if d := PeerLifetime(ctx, v6); d > 0 && configured > 0 {
+		return d - configured
+	}
+	return 0
+}
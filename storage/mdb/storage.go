@@ -8,6 +8,7 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"math/rand/v2"
 	"net/netip"
 	"os"
 	"sync"
@@ -74,6 +75,7 @@ type config struct {
 var (
 	errPathNotProvided  = errors.New("lmdb path not provided")
 	errPathNotDirectory = errors.New("lmdb path is not directory")
+	errClosed           = errors.New("lmdb storage is closed")
 )
 
 func (cfg config) validate() (config, error) {
@@ -130,6 +132,11 @@ type mdb struct {
 	onceCloser      sync.Once
 	closed          chan any
 	wg              sync.WaitGroup
+	// peerLifetime is the lifetime used by garbage collection,
+	// see storage.PeerLifetimeShift
+	peerLifetime time.Duration
+	// envMu guards lmdbEnv from being closed during transaction
+	envMu sync.RWMutex
 }
 
 func newStorage(cfg config) (*mdb, error) {
@@ -211,14 +218,39 @@ func (m *mdb) Close() (err error) {
 		if m.lmdbEnv != nil {
 			close(m.closed)
 			m.wg.Wait()
+			m.envMu.Lock()
+			defer m.envMu.Unlock()
 			logger.Info().Msg("LMDB exiting. Flushing databases to disk")
-			_ = m.Sync(true)
+			_ = m.lmdbEnv.Sync(true)
 			err = m.lmdbEnv.Close()
 		}
 	})
 	return
 }
 
+// env calls fn if storage is not closed, closed LMDB environment
+// must not be used
+func (m *mdb) env(fn func() error) error {
+	m.envMu.RLock()
+	defer m.envMu.RUnlock()
+	select {
+	case <-m.closed:
+		return errClosed
+	default:
+		return fn()
+	}
+}
+
+// View runs read-only transaction op
+func (m *mdb) View(op lmdb.TxnOp) error {
+	return m.env(func() error { return m.lmdbEnv.View(op) })
+}
+
+// Update runs read-write transaction op
+func (m *mdb) Update(op lmdb.TxnOp) error {
+	return m.env(func() error { return m.lmdbEnv.Update(op) })
+}
+
 const keySeparator = '_'
 
 func ignoreNotFound(err error) error {
@@ -283,6 +315,25 @@ func (m *mdb) Load(_ context.Context, storeCtx string, key string) (v []byte, er
 	return
 }
 
+// CompareAndSwap - storage.CompareAndSwapper implementation
+func (m *mdb) CompareAndSwap(_ context.Context, storeCtx, key string, old, value []byte) (swapped bool, err error) {
+	err = m.Update(func(txn *lmdb.Txn) (err error) {
+		k := composeKey(storeCtx, key)
+		var cur []byte
+		if cur, err = ignoreNotFoundData(txn.Get(m.dataDB, k)); err != nil {
+			return
+		}
+		if swapped = bytes.Equal(cur, old); !swapped {
+			return
+		}
+		if len(value) == 0 {
+			return ignoreNotFound(txn.Del(m.dataDB, k, nil))
+		}
+		return txn.Put(m.dataDB, k, value, 0)
+	})
+	return
+}
+
 func (m *mdb) Delete(_ context.Context, storeCtx string, keys ...string) (err error) {
 	if len(keys) > 0 {
 		err = m.Update(func(txn *lmdb.Txn) (err error) {
@@ -352,12 +403,17 @@ func composeIHKey(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) (ih
 	return
 }
 
-func (m *mdb) putPeer(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error {
-	ihKey := composeIHKey(ih, peer, seeder)
+// now returns modification time (unix seconds) of peer put with ctx
+func (m *mdb) now(ctx context.Context, peer bittorrent.Peer) int64 {
+	return timecache.NowUnix() + int64(storage.PeerLifetimeShift(ctx, peer.Addr().Is6(), m.peerLifetime).Seconds())
+}
+
+func (m *mdb) putPeer(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error {
+	ihKey, now := composeIHKey(ih, peer, seeder), m.now(ctx, peer)
 	return m.Update(func(txn *lmdb.Txn) (err error) {
 		var b []byte
 		if b, err = txn.PutReserve(m.peersDB, ihKey, 8, 0); err == nil {
-			binary.BigEndian.PutUint64(b, uint64(timecache.NowUnix()))
+			binary.BigEndian.PutUint64(b, uint64(now))
 		}
 		return
 	})
@@ -370,24 +426,24 @@ func (m *mdb) delPeer(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool)
 	})
 }
 
-func (m *mdb) PutSeeder(_ context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return m.putPeer(ih, peer, true)
+func (m *mdb) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return m.putPeer(ctx, ih, peer, true)
 }
 
 func (m *mdb) DeleteSeeder(_ context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
 	return m.delPeer(ih, peer, true)
 }
 
-func (m *mdb) PutLeecher(_ context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return m.putPeer(ih, peer, false)
+func (m *mdb) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return m.putPeer(ctx, ih, peer, false)
 }
 
 func (m *mdb) DeleteLeecher(_ context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
 	return m.delPeer(ih, peer, false)
 }
 
-func (m *mdb) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	ihKey := composeIHKey(ih, peer, false)
+func (m *mdb) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	ihKey, now := composeIHKey(ih, peer, false), m.now(ctx, peer)
 	return m.Update(func(txn *lmdb.Txn) (err error) {
 		if err = ignoreNotFound(txn.Del(m.peersDB, ihKey, nil)); err != nil {
 			return
@@ -397,7 +453,7 @@ func (m *mdb) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash, peer bi
 		if b, err = txn.PutReserve(m.peersDB, ihKey, 8, 0); err != nil {
 			return
 		}
-		binary.BigEndian.PutUint64(b, uint64(timecache.NowUnixNano()))
+		binary.BigEndian.PutUint64(b, uint64(now))
 
 		ihPrefix := ihKey[:len(ihKey)-packedPeerLen]
 		ihPrefix[0], ihPrefix[1] = downloadedPrefix, countPrefix
@@ -416,7 +472,40 @@ func (m *mdb) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash, peer bi
 	})
 }
 
-func (m *mdb) scanPeers(ctx context.Context, prefix []byte, readRaw bool, fn func(k, v []byte) bool) (err error) {
+func (m *mdb) scanPeers(ctx context.Context, prefix []byte, readRaw bool, fn func(k, v []byte) bool) error {
+	return m.scanPeersFrom(ctx, prefix, prefix, readRaw, fn)
+}
+
+// scanRandomPeers scans peers with prefix starting from the peer with random
+// index and wraps around to the first peer, so every scan, stopped by fn
+// before the end, returns different peers instead of the first ones
+func (m *mdb) scanRandomPeers(ctx context.Context, prefix []byte, fn func(k, v []byte) bool) (err error) {
+	var cnt int
+	if err = m.scanPeers(ctx, prefix, true, func(_, _ []byte) bool {
+		cnt++
+		return true
+	}); err != nil || cnt == 0 {
+		return
+	}
+	start, i, next := rand.IntN(cnt), 0, true
+	err = m.scanPeers(ctx, prefix, true, func(k, v []byte) bool {
+		if i++; i > start {
+			next = fn(k, v)
+		}
+		return next
+	})
+	if err == nil && next && start > 0 {
+		i = 0
+		err = m.scanPeers(ctx, prefix, true, func(k, v []byte) bool {
+			i++
+			return i <= start && fn(k, v)
+		})
+	}
+	return
+}
+
+// scanPeersFrom calls fn for keys with prefix starting from key from
+func (m *mdb) scanPeersFrom(ctx context.Context, prefix, from []byte, readRaw bool, fn func(k, v []byte) bool) (err error) {
 	m.wg.Add(1)
 	prefixLen := len(prefix)
 	err = m.View(func(txn *lmdb.Txn) (err error) {
@@ -426,7 +515,7 @@ func (m *mdb) scanPeers(ctx context.Context, prefix []byte, readRaw bool, fn fun
 		if prefixLen == 0 {
 			op = lmdb.First
 		}
-		if scanner.SetNext(prefix, nil, op, lmdb.Next) {
+		if scanner.SetNext(from, nil, op, lmdb.Next) {
 		loop:
 			for scanner.Scan() {
 				select {
@@ -458,20 +547,35 @@ func (m *mdb) scanPeers(ctx context.Context, prefix []byte, readRaw bool, fn fun
 }
 
 func (m *mdb) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+	if numWant <= 0 {
+		return
+	}
 	peers = make([]bittorrent.Peer, 0, numWant)
+	err = m.AnnouncePeersFunc(ctx, ih, forSeeder, numWant, v6, func(p bittorrent.Peer) bool {
+		peers = append(peers, p)
+		return true
+	})
+	return
+}
+
+func (m *mdb) AnnouncePeersFunc(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool) (err error) {
+	if numWant <= 0 {
+		return
+	}
 	prefix, prefixLen := composeIHKeyPrefix(ih.Bytes(), false, v6, 0)
-	appendFn := func(k, _ []byte) bool {
-		peers = append(peers, unpackPeer(k[prefixLen:]))
+	next := true
+	rangeFn := func(k, _ []byte) bool {
 		numWant--
-		return numWant > 0
+		next = fn(unpackPeer(k[prefixLen:]))
+		return next && numWant > 0
 	}
 	if forSeeder {
-		err = m.scanPeers(ctx, prefix, true, appendFn)
+		err = m.scanRandomPeers(ctx, prefix, rangeFn)
 	} else {
 		prefix[0] = seederPrefix
-		if err = m.scanPeers(ctx, prefix, true, appendFn); err == nil && numWant > 0 {
+		if err = m.scanRandomPeers(ctx, prefix, rangeFn); err == nil && next && numWant > 0 {
 			prefix[0] = leecherPrefix
-			err = m.scanPeers(ctx, prefix, true, appendFn)
+			err = m.scanRandomPeers(ctx, prefix, rangeFn)
 		}
 	}
 	return
@@ -516,6 +620,16 @@ func (m *mdb) countPeers(ctx context.Context, scanPrefix []byte) (cnt uint32, er
 	return
 }
 
+// Counts - storage.Counter implementation, the same as ScrapeSwarm without downloads read
+func (m *mdb) Counts(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, err error) {
+	scanPrefix, _ := composeIHKeyPrefix(ih.Bytes(), false, false, 0)
+	if leechers, err = m.countPeers(ctx, scanPrefix); err == nil {
+		scanPrefix[0], scanPrefix[1] = seederPrefix, ipv4Prefix
+		seeders, err = m.countPeers(ctx, scanPrefix)
+	}
+	return
+}
+
 func (m *mdb) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
 	scanPrefix, _ := composeIHKeyPrefix(ih.Bytes(), false, false, 0)
 	if leechers, err = m.countPeers(ctx, scanPrefix); err != nil {
@@ -574,7 +688,38 @@ func (m *mdb) gc(cutoff time.Time) {
 	}
 }
 
+// Dump - storage.Dumper implementation.
+// Keys are collected in one read transaction before fn is called,
+// so fn may interact with storage.
+func (m *mdb) Dump(ctx context.Context, fn func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error) error {
+	var keys [][]byte
+	err := m.scanPeers(ctx, nil, false, func(k, _ []byte) bool {
+		if l := len(k); (l == v1IHKeyLen || l == v2IHKeyPen) &&
+			(k[0] == seederPrefix || k[0] == leecherPrefix) &&
+			(k[1] == ipv4Prefix || k[1] == ipv6Prefix) &&
+			k[2] == keySeparator {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		ih, err := bittorrent.NewInfoHash(k[3 : len(k)-packedPeerLen-1])
+		if err != nil {
+			logger.Warn().Err(err).Bytes("key", k).Msg("unable to decode info hash")
+			continue
+		}
+		if err = fn(ih, unpackPeer(k[len(k)-packedPeerLen:]), k[0] == seederPrefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *mdb) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
+	m.peerLifetime = peerLifeTime
 	m.wg.Add(1)
 	go func() {
 		defer m.wg.Done()
@@ -585,7 +730,9 @@ func (m *mdb) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 			case <-m.closed:
 				return
 			case <-t.C:
+				start := time.Now()
 				m.gc(time.Now().Add(-peerLifeTime))
+				storage.RecordGC(Name, start)
 				t.Reset(gcInterval)
 			}
 		}
@@ -593,6 +740,8 @@ func (m *mdb) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 }
 
 func (m *mdb) Ping(_ context.Context) error {
-	_, err := m.Info()
-	return err
+	return m.env(func() error {
+		_, err := m.Info()
+		return err
+	})
 }
@@ -3,10 +3,15 @@
 package mdb
 
 import (
+	"context"
 	"fmt"
+	"net/netip"
 	"os"
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
 	s "github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
@@ -35,15 +40,38 @@ func createNew() s.PeerStorage {
 }
 
 func TestStorage(t *testing.T) {
-	tmpDir, err := os.MkdirTemp(tmpPath, "lmdb*")
-	if err != nil {
-		t.Error(err)
-	}
-	t.Cleanup(func() {
-		_ = os.RemoveAll(tmpDir)
+	// every conformance test requires empty database
+	test.RunConformanceTests(t, func() s.PeerStorage {
+		cfg.Path = t.TempDir()
+		return createNew()
 	})
-	cfg.Path = tmpDir
-	test.RunTests(t, createNew())
+}
+
+func TestRandomPeers(t *testing.T) {
+	cfg.Path = t.TempDir()
+	ps := createNew()
+	defer ps.Close()
+
+	ctx, ih := context.Background(), bittorrent.InfoHash("11111111111111111111")
+	for i := range 50 {
+		// peer IDs of the same client share prefix
+		id := bittorrent.PeerID{'-', 'q', 'B', '4', '5', '2', '0', '-', byte(i)}
+		p := bittorrent.Peer{ID: id, AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881)}
+		require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	}
+	first := make(map[bittorrent.PeerID]struct{})
+	for range 200 {
+		peers, err := ps.AnnouncePeers(ctx, ih, false, 1, false)
+		require.Nil(t, err)
+		require.Len(t, peers, 1)
+		first[peers[0].ID] = struct{}{}
+	}
+	// clustered keys do not make the same peers returned
+	require.Greater(t, len(first), 25)
+
+	peers, err := ps.AnnouncePeers(ctx, ih, false, 100, false)
+	require.Nil(t, err)
+	require.Len(t, peers, 50)
 }
 
 func BenchmarkStorage(b *testing.B) {
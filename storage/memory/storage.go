@@ -3,10 +3,14 @@
 package memory
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
+	"hash/maphash"
 	"math"
+	"math/rand/v2"
+	"net/netip"
 	"runtime"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -54,6 +58,15 @@ func (Builder) NewPeerStorage(icfg conf.MapConfig) (storage.PeerStorage, error)
 
 type config struct {
 	ShardCount int `cfg:"shard_count"`
+	// MinUpdateInterval is the period since the last write of peer,
+	// during which repeated puts of the same peer are skipped.
+	MinUpdateInterval time.Duration `cfg:"min_update_interval"`
+	// MaxPeersPerIP is the maximum number of distinct peers (peer ID and port)
+	// with the same IP address in one swarm. Zero means no limit.
+	MaxPeersPerIP int `cfg:"max_peers_per_ip"`
+	// EvictExcess makes storage replace the oldest peer of IP address,
+	// which reached MaxPeersPerIP, with new one instead of rejecting new peer.
+	EvictExcess bool `cfg:"evict_excess"`
 }
 
 func (cfg config) validate() config {
@@ -68,6 +81,24 @@ func (cfg config) validate() config {
 			Msg("falling back to default configuration")
 	}
 
+	if cfg.MinUpdateInterval < 0 {
+		validcfg.MinUpdateInterval = 0
+		logger.Warn().
+			Str("name", "MinUpdateInterval").
+			Dur("provided", cfg.MinUpdateInterval).
+			Dur("default", validcfg.MinUpdateInterval).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.MaxPeersPerIP < 0 {
+		validcfg.MaxPeersPerIP = 0
+		logger.Warn().
+			Str("name", "MaxPeersPerIP").
+			Int("provided", cfg.MaxPeersPerIP).
+			Int("default", validcfg.MaxPeersPerIP).
+			Msg("falling back to default configuration")
+	}
+
 	return validcfg
 }
 
@@ -75,7 +106,11 @@ func peerStorage(provided config) (storage.PeerStorage, error) {
 	cfg := provided.validate()
 	ps := &peerStore{
 		shards:      make([]*peerShard, cfg.ShardCount*2),
-		DataStorage: dataStorage(),
+		seed:        maphash.MakeSeed(),
+		dataStore:   dataStorage(),
+		minUpdate:   cfg.MinUpdateInterval.Nanoseconds(),
+		maxPerIP:    cfg.MaxPeersPerIP,
+		evictExcess: cfg.EvictExcess,
 		closed:      make(chan any),
 	}
 
@@ -104,14 +139,16 @@ func (p *ihSwarm) get(k bittorrent.InfoHash) (v swarm, ok bool) {
 	return
 }
 
-func (p *ihSwarm) getOrCreate(k bittorrent.InfoHash) (v swarm) {
+// getOrCreate returns swarm or creates new one,
+// peers of created swarm are indexed by IP if byIP set
+func (p *ihSwarm) getOrCreate(k bittorrent.InfoHash, byIP bool) (v swarm) {
 	var ok bool
 	if v, ok = p.get(k); !ok {
 		p.Lock()
 		if v, ok = p.m[k]; !ok {
 			v = swarm{
-				seeders:  &peers{m: make(map[bittorrent.Peer]int64)},
-				leechers: &peers{m: make(map[bittorrent.Peer]int64)},
+				seeders:  newPeers(byIP),
+				leechers: newPeers(byIP),
 			}
 			p.m[k] = v
 		}
@@ -129,8 +166,11 @@ func (p *ihSwarm) del(k bittorrent.InfoHash) (ok bool) {
 	return
 }
 
-func (p *ihSwarm) len() int {
-	return len(p.m)
+func (p *ihSwarm) len() (l int) {
+	p.RLock()
+	l = len(p.m)
+	p.RUnlock()
+	return
 }
 
 func (p *ihSwarm) keys(fn func(k bittorrent.InfoHash) bool) {
@@ -151,9 +191,20 @@ type swarm struct {
 
 type peers struct {
 	m map[bittorrent.Peer]int64
+	// byIP contains peers of each IP address,
+	// it is maintained only if per IP limit is set
+	byIP map[netip.Addr][]bittorrent.Peer
 	sync.RWMutex
 }
 
+func newPeers(byIP bool) *peers {
+	p := &peers{m: make(map[bittorrent.Peer]int64)}
+	if byIP {
+		p.byIP = make(map[netip.Addr][]bittorrent.Peer)
+	}
+	return p
+}
+
 func (p *peers) get(k bittorrent.Peer) (v int64, ok bool) {
 	p.RLock()
 	v, ok = p.m[k]
@@ -163,6 +214,10 @@ func (p *peers) get(k bittorrent.Peer) (v int64, ok bool) {
 
 func (p *peers) set(k bittorrent.Peer, v int64) {
 	p.Lock()
+	if _, exists := p.m[k]; !exists && p.byIP != nil {
+		ip := k.Addr()
+		p.byIP[ip] = append(p.byIP[ip], k)
+	}
 	p.m[k] = v
 	p.Unlock()
 }
@@ -171,13 +226,39 @@ func (p *peers) del(k bittorrent.Peer) (ok bool) {
 	p.Lock()
 	if _, ok = p.m[k]; ok {
 		delete(p.m, k)
+		if p.byIP != nil {
+			ip := k.Addr()
+			if l := slices.DeleteFunc(p.byIP[ip], func(e bittorrent.Peer) bool { return e == k }); len(l) > 0 {
+				p.byIP[ip] = l
+			} else {
+				delete(p.byIP, ip)
+			}
+		}
 	}
 	p.Unlock()
 	return
 }
 
-func (p *peers) len() int {
-	return len(p.m)
+// oldest returns the number of peers with IP address
+// and the least recently updated one of them
+func (p *peers) oldest(ip netip.Addr) (n int, peer bittorrent.Peer, mtime int64) {
+	p.RLock()
+	defer p.RUnlock()
+	l := p.byIP[ip]
+	mtime = math.MaxInt64
+	for _, k := range l {
+		if v := p.m[k]; v < mtime {
+			peer, mtime = k, v
+		}
+	}
+	return len(l), peer, mtime
+}
+
+func (p *peers) len() (l int) {
+	p.RLock()
+	l = len(p.m)
+	p.RUnlock()
+	return
 }
 
 func (p *peers) keys(fn func(k bittorrent.Peer) bool) bool {
@@ -191,6 +272,29 @@ func (p *peers) keys(fn func(k bittorrent.Peer) bool) bool {
 	return true
 }
 
+// sample calls fn for n randomly selected peers (or all peers, if there
+// are not more than n) until fn returns false. Returns false if it did.
+// Selection sampling (Knuth's algorithm S) selects every peer with probability
+// of wanted/left, so the subset is uniform, but the whole map may be iterated.
+func (p *peers) sample(n int, fn func(k bittorrent.Peer) bool) bool {
+	p.RLock()
+	defer p.RUnlock()
+	left := len(p.m)
+	for k := range p.m {
+		if n <= 0 {
+			break
+		}
+		if rand.IntN(left) < n {
+			n--
+			if !fn(k) {
+				return false
+			}
+		}
+		left--
+	}
+	return true
+}
+
 func (p *peers) forEach(fn func(k bittorrent.Peer, v int64) bool) {
 	p.RLock()
 	for k, v := range p.m {
@@ -202,8 +306,19 @@ func (p *peers) forEach(fn func(k bittorrent.Peer, v int64) bool) {
 }
 
 type peerStore struct {
-	storage.DataStorage
+	*dataStore
 	shards []*peerShard
+	// seed is the random per-process key of shard index hash,
+	// so crafted info hashes can not be placed in the same shard
+	seed maphash.Seed
+	// minUpdate see config.MinUpdateInterval
+	minUpdate int64
+	// maxPerIP and evictExcess see config.MaxPeersPerIP and config.EvictExcess
+	maxPerIP    int
+	evictExcess bool
+	// peerLifetime is the lifetime used by garbage collection,
+	// see storage.PeerLifetimeShift
+	peerLifetime time.Duration
 
 	closed     chan any
 	wg         sync.WaitGroup
@@ -213,6 +328,7 @@ type peerStore struct {
 var _ storage.PeerStorage = &peerStore{}
 
 func (ps *peerStore) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
+	ps.peerLifetime = peerLifeTime
 	ps.wg.Add(1)
 	go func() {
 		defer ps.wg.Done()
@@ -227,9 +343,9 @@ func (ps *peerStore) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 				logger.Trace().Time("before", before).Msg("purging peers with no announces")
 				start := time.Now()
 				ps.gc(before)
-				duration := time.Since(start)
-				logger.Debug().Dur("timeTaken", duration).Msg("gc complete")
-				storage.PromGCDurationMilliseconds.Observe(float64(duration.Milliseconds()))
+				logger.Debug().Dur("timeTaken", time.Since(start)).Msg("gc complete")
+				storage.RecordGC(Name, start)
+				t.Reset(gcInterval)
 			}
 		}
 	}()
@@ -268,18 +384,78 @@ func (ps *peerStore) ScheduleStatisticsCollection(reportInterval time.Duration)
 	}()
 }
 
+// now returns modification time of peer put with ctx
+func (ps *peerStore) now(ctx context.Context, p bittorrent.Peer) int64 {
+	return timecache.NowUnixNano() + storage.PeerLifetimeShift(ctx, p.Addr().Is6(), ps.peerLifetime).Nanoseconds()
+}
+
 func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, v6 bool) uint32 {
 	// There are twice the amount of shards specified by the user, the first
 	// half is dedicated to IPv4 swarms and the second half is dedicated to
 	// IPv6 swarms.
-	idx := binary.BigEndian.Uint32(infoHash.Bytes()[:4]) % (uint32(len(ps.shards)) / 2)
+	idx := uint32(maphash.String(ps.seed, string(infoHash)) % uint64(len(ps.shards)/2))
 	if v6 {
 		idx += uint32(len(ps.shards) / 2)
 	}
 	return idx
 }
 
-func (ps *peerStore) PutSeeder(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+// admit checks if new peer p does not exceed the limit of peers with
+// the same IP address in swarm, if it does, the oldest peer of this address
+// is deleted or storage.ErrTooManyPeersPerIP returned. Concurrent puts may
+// exceed the limit, since check and put are not atomic.
+func (ps *peerStore) admit(sh *peerShard, sw swarm, p bittorrent.Peer) error {
+	if ps.maxPerIP <= 0 {
+		return nil
+	}
+	ip := p.Addr()
+	ns, s, smtime := sw.seeders.oldest(ip)
+	nl, l, lmtime := sw.leechers.oldest(ip)
+	if ns+nl < ps.maxPerIP {
+		return nil
+	}
+	if !ps.evictExcess {
+		storage.RecordIPLimited(false)
+		return storage.ErrTooManyPeersPerIP
+	}
+	if nl > 0 && (ns == 0 || lmtime < smtime) {
+		if sw.leechers.del(l) {
+			sh.numLeechers.Add(decrUint64)
+		}
+	} else if sw.seeders.del(s) {
+		sh.numSeeders.Add(decrUint64)
+	}
+	storage.RecordIPLimited(true)
+	return nil
+}
+
+// Admit implements storage.Admitter: new peer is rejected with
+// storage.ErrTooManyPeersPerIP if its address reached the limit in swarm
+// and excess peers are not evicted.
+func (ps *peerStore) Admit(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if ps.maxPerIP <= 0 || ps.evictExcess {
+		return nil
+	}
+	sw, ok := ps.shards[ps.shardIndex(ih, p.Addr().Is6())].swarms.get(ih)
+	if !ok {
+		return nil
+	}
+	if _, exists := sw.seeders.get(p); exists {
+		return nil
+	}
+	if _, exists := sw.leechers.get(p); exists {
+		return nil
+	}
+	ns, _, _ := sw.seeders.oldest(p.Addr())
+	nl, _, _ := sw.leechers.oldest(p.Addr())
+	if ns+nl < ps.maxPerIP {
+		return nil
+	}
+	storage.RecordIPLimited(false)
+	return storage.ErrTooManyPeersPerIP
+}
+
+func (ps *peerStore) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -291,13 +467,23 @@ func (ps *peerStore) PutSeeder(_ context.Context, ih bittorrent.InfoHash, p bitt
 		Msg("put seeder")
 
 	sh := ps.shards[ps.shardIndex(ih, p.Addr().Is6())]
-	sw := sh.swarms.getOrCreate(ih)
-
-	if _, exists := sw.seeders.get(p); !exists {
+	sw := sh.swarms.getOrCreate(ih, ps.maxPerIP > 0)
+
+	now := ps.now(ctx, p)
+	if mtime, exists := sw.seeders.get(p); !exists {
+		// leecher, which becomes seeder, is not new peer of swarm
+		if _, isLeecher := sw.leechers.get(p); !isLeecher {
+			if err := ps.admit(sh, sw, p); err != nil {
+				return err
+			}
+		}
 		sh.numSeeders.Add(1)
+	} else if d := now - mtime; d >= 0 && d < ps.minUpdate {
+		storage.RecordCoalescedWrite()
+		return nil
 	}
 
-	sw.seeders.set(p, timecache.NowUnixNano())
+	sw.seeders.set(p, now)
 
 	return nil
 }
@@ -325,7 +511,7 @@ func (ps *peerStore) DeleteSeeder(_ context.Context, ih bittorrent.InfoHash, p b
 	return
 }
 
-func (ps *peerStore) PutLeecher(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -337,13 +523,22 @@ func (ps *peerStore) PutLeecher(_ context.Context, ih bittorrent.InfoHash, p bit
 		Msg("put leecher")
 
 	sh := ps.shards[ps.shardIndex(ih, p.Addr().Is6())]
-	sw := sh.swarms.getOrCreate(ih)
+	sw := sh.swarms.getOrCreate(ih, ps.maxPerIP > 0)
 
-	if _, exists := sw.leechers.get(p); !exists {
+	now := ps.now(ctx, p)
+	if mtime, exists := sw.leechers.get(p); !exists {
+		if _, isSeeder := sw.seeders.get(p); !isSeeder {
+			if err := ps.admit(sh, sw, p); err != nil {
+				return err
+			}
+		}
 		sh.numLeechers.Add(1)
+	} else if d := now - mtime; d >= 0 && d < ps.minUpdate {
+		storage.RecordCoalescedWrite()
+		return nil
 	}
 
-	sw.leechers.set(p, timecache.NowUnixNano())
+	sw.leechers.set(p, now)
 
 	return nil
 }
@@ -371,7 +566,7 @@ func (ps *peerStore) DeleteLeecher(_ context.Context, ih bittorrent.InfoHash, p
 	return
 }
 
-func (ps *peerStore) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -383,22 +578,37 @@ func (ps *peerStore) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash,
 		Msg("graduate leecher")
 
 	sh := ps.shards[ps.shardIndex(ih, p.Addr().Is6())]
-	sw := sh.swarms.getOrCreate(ih)
+	sw := sh.swarms.getOrCreate(ih, ps.maxPerIP > 0)
 
 	if sw.leechers.del(p) {
 		sh.numLeechers.Add(decrUint64)
 	}
 
 	if _, exists := sw.seeders.get(p); !exists {
+		// graduated leecher is already deleted, so it is not limited
+		if err := ps.admit(sh, sw, p); err != nil {
+			return err
+		}
 		sh.numSeeders.Add(1)
 	}
 
-	sw.seeders.set(p, timecache.NowUnixNano())
+	sw.seeders.set(p, ps.now(ctx, p))
 
 	return nil
 }
 
-func (ps *peerStore) AnnouncePeers(_ context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+func (ps *peerStore) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+	err = ps.AnnouncePeersFunc(ctx, ih, forSeeder, numWant, v6, func(p bittorrent.Peer) bool {
+		if peers == nil {
+			peers = make([]bittorrent.Peer, 0, numWant/2)
+		}
+		peers = append(peers, p)
+		return true
+	})
+	return
+}
+
+func (ps *peerStore) AnnouncePeersFunc(_ context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -411,23 +621,24 @@ func (ps *peerStore) AnnouncePeers(_ context.Context, ih bittorrent.InfoHash, fo
 		Bool("v6", v6).
 		Msg("announce peers")
 
+	if numWant <= 0 {
+		return nil
+	}
 	if sw, ok := ps.shards[ps.shardIndex(ih, v6)].swarms.get(ih); ok {
-		peers = make([]bittorrent.Peer, 0, numWant/2)
 		rangeFn := func(p bittorrent.Peer) bool {
-			peers = append(peers, p)
 			numWant--
-			return numWant > 0
+			return fn(p) && numWant > 0
 		}
 		if forSeeder {
-			sw.leechers.keys(rangeFn)
+			sw.leechers.sample(numWant, rangeFn)
 		} else {
-			if sw.seeders.keys(rangeFn) {
-				sw.leechers.keys(rangeFn)
+			if sw.seeders.sample(numWant, rangeFn) {
+				sw.leechers.sample(numWant, rangeFn)
 			}
 		}
 	}
 
-	return
+	return nil
 }
 
 func (ps *peerStore) countPeers(ih bittorrent.InfoHash, v6 bool) (leechers, seeders uint32) {
@@ -456,12 +667,64 @@ func (ps *peerStore) ScrapeSwarm(_ context.Context, ih bittorrent.InfoHash) (lee
 	return
 }
 
-func dataStorage() storage.DataStorage {
+// Counts - storage.Counter implementation, returns sizes of swarm maps
+func (ps *peerStore) Counts(_ context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, _ error) {
+	leechers, seeders = ps.countPeers(ih, false)
+	l, s := ps.countPeers(ih, true)
+	return leechers + l, seeders + s, nil
+}
+
+// Dump - storage.Dumper implementation.
+// Peers of each swarm are copied before fn is called, so fn
+// may interact with storage.
+func (ps *peerStore) Dump(ctx context.Context, fn func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error) error {
+	var seeders, leechers []bittorrent.Peer
+	collect := func(out *[]bittorrent.Peer) func(bittorrent.Peer) bool {
+		*out = (*out)[:0]
+		return func(p bittorrent.Peer) bool {
+			*out = append(*out, p)
+			return true
+		}
+	}
+	for _, shard := range ps.shards {
+		infoHashes := make([]bittorrent.InfoHash, 0, shard.swarms.len())
+		shard.swarms.keys(func(ih bittorrent.InfoHash) bool {
+			infoHashes = append(infoHashes, ih)
+			return true
+		})
+		for _, ih := range infoHashes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			sw, exists := shard.swarms.get(ih)
+			if !exists {
+				continue
+			}
+			sw.seeders.keys(collect(&seeders))
+			sw.leechers.keys(collect(&leechers))
+			for _, p := range seeders {
+				if err := fn(ih, p, true); err != nil {
+					return err
+				}
+			}
+			for _, p := range leechers {
+				if err := fn(ih, p, false); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func dataStorage() *dataStore {
 	return new(dataStore)
 }
 
 type dataStore struct {
 	sync.Map
+	// casMu serializes CompareAndSwap calls
+	casMu sync.Mutex
 }
 
 func (ds *dataStore) Put(_ context.Context, ctx string, values ...storage.Entry) error {
@@ -504,6 +767,20 @@ func (ds *dataStore) Delete(_ context.Context, ctx string, keys ...string) error
 	return nil
 }
 
+// CompareAndSwap - storage.CompareAndSwapper implementation
+func (ds *dataStore) CompareAndSwap(ctx context.Context, storeCtx, key string, old, value []byte) (bool, error) {
+	ds.casMu.Lock()
+	defer ds.casMu.Unlock()
+	cur, _ := ds.Load(ctx, storeCtx, key)
+	if !bytes.Equal(cur, old) {
+		return false, nil
+	}
+	if len(value) == 0 {
+		return true, ds.Delete(ctx, storeCtx, key)
+	}
+	return true, ds.Put(ctx, storeCtx, storage.Entry{Key: key, Value: value})
+}
+
 func (*dataStore) Preservable() bool { return false }
 
 func (ds *dataStore) Close() error { return nil }
@@ -1,8 +1,15 @@
 package memory
 
 import (
+	"context"
+	"fmt"
+	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
@@ -15,6 +22,147 @@ func createNew() storage.PeerStorage {
 	return ps
 }
 
-func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
+func TestStorage(t *testing.T) { test.RunConformanceTests(t, createNew) }
 
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
+
+func TestMinUpdateInterval(t *testing.T) {
+	ps, err := peerStorage(config{ShardCount: 1, MinUpdateInterval: time.Hour})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx, ih := context.Background(), bittorrent.InfoHash("00000000000000000001")
+	p := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+
+	require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	sw, _ := ps.(*peerStore).shards[0].swarms.get(ih)
+	sw.seeders.set(p, 1)
+	// peer is updated because mtime is older than interval
+	require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	mtime, _ := sw.seeders.get(p)
+	require.NotEqual(t, int64(1), mtime)
+	sw.seeders.set(p, mtime-1)
+	require.Nil(t, ps.PutSeeder(ctx, ih, p))
+	coalesced, _ := sw.seeders.get(p)
+	require.Equal(t, mtime-1, coalesced)
+
+	_, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+}
+
+func TestPeerLifetime(t *testing.T) {
+	ps, err := peerStorage(config{ShardCount: 1})
+	require.Nil(t, err)
+	defer ps.Close()
+	ps.(*peerStore).peerLifetime = 30 * time.Minute
+	ih := bittorrent.InfoHash("00000000000000000001")
+	short := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	long := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("[::1]:6881")}
+	ctx := storage.WithPeerLifetime(context.Background(), time.Minute, time.Hour)
+
+	require.Nil(t, ps.PutSeeder(ctx, ih, short))
+	require.Nil(t, ps.PutSeeder(ctx, ih, long))
+	// cutoff of configured lifetime after 2 minutes
+	ps.(*peerStore).gc(time.Now().Add(2*time.Minute - 30*time.Minute))
+	peers, err := ps.AnnouncePeers(context.Background(), ih, false, 10, false)
+	require.Nil(t, err)
+	require.Empty(t, peers)
+	peers, err = ps.AnnouncePeers(context.Background(), ih, false, 10, true)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{long}, peers)
+
+	// cutoff of configured lifetime after 45 minutes
+	ps.(*peerStore).gc(time.Now().Add(45*time.Minute - 30*time.Minute))
+	peers, err = ps.AnnouncePeers(context.Background(), ih, false, 10, true)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{long}, peers)
+}
+
+func TestSample(t *testing.T) {
+	p := &peers{m: make(map[bittorrent.Peer]int64)}
+	for i := range 100 {
+		p.m[bittorrent.Peer{AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{1, 2, 3, byte(i)}), 6881)}] = 0
+	}
+	selected := make(map[bittorrent.Peer]int)
+	for range 300 {
+		var n int
+		p.sample(10, func(k bittorrent.Peer) bool {
+			selected[k]++
+			n++
+			return true
+		})
+		require.Equal(t, 10, n)
+	}
+	// chance of any peer to be never selected is negligible (100 * 0.9^300)
+	require.Len(t, selected, 100)
+
+	var n int
+	require.True(t, p.sample(1000, func(bittorrent.Peer) bool {
+		n++
+		return true
+	}))
+	require.Equal(t, 100, n)
+}
+
+func TestShardIndex(t *testing.T) {
+	ps, err := peerStorage(config{ShardCount: 16})
+	require.Nil(t, err)
+	defer ps.Close()
+	// hashes with the same prefix are not placed in the same shard
+	shards := make(map[uint32]bool)
+	for i := 0; i < 100; i++ {
+		ih := bittorrent.InfoHash(fmt.Sprintf("0000%016d", i))
+		idx := ps.(*peerStore).shardIndex(ih, false)
+		require.Less(t, idx, uint32(16))
+		require.Equal(t, idx+16, ps.(*peerStore).shardIndex(ih, true))
+		shards[idx] = true
+	}
+	require.Greater(t, len(shards), 1)
+}
+
+func TestMaxPeersPerIP(t *testing.T) {
+	ctx, ih := context.Background(), bittorrent.InfoHash("00000000000000000001")
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{ID: bittorrent.PeerID{byte(port)}, AddrPort: netip.AddrPortFrom(netip.MustParseAddr("1.2.3.4"), port)}
+	}
+	other := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("4.3.2.1:6881")}
+
+	ps, err := peerStorage(config{ShardCount: 1, MaxPeersPerIP: 2})
+	require.Nil(t, err)
+	defer ps.Close()
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(1)))
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer(2)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, other))
+	require.ErrorIs(t, ps.PutLeecher(ctx, ih, peer(3)), storage.ErrTooManyPeersPerIP)
+	require.ErrorIs(t, ps.PutSeeder(ctx, ih, peer(3)), storage.ErrTooManyPeersPerIP)
+	require.ErrorIs(t, storage.Admit(ctx, ps, ih, peer(3)), storage.ErrTooManyPeersPerIP)
+	require.Nil(t, storage.Admit(ctx, ps, ih, peer(1)))
+	// known peers are updated and graduated
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(1)))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peer(1)))
+	require.ErrorIs(t, ps.GraduateLeecher(ctx, ih, peer(3)), storage.ErrTooManyPeersPerIP)
+	// deleted peer releases slot
+	require.Nil(t, ps.DeleteSeeder(ctx, ih, peer(1)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(3)))
+	leechers, seeders, err := storage.Counts(ctx, ps, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), leechers)
+	require.Equal(t, uint32(1), seeders)
+
+	ps, err = peerStorage(config{ShardCount: 1, MaxPeersPerIP: 2, EvictExcess: true})
+	require.Nil(t, err)
+	defer ps.Close()
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer(1)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(2)))
+	require.Nil(t, storage.Admit(ctx, ps, ih, peer(3)))
+	sw, _ := ps.(*peerStore).shards[0].swarms.get(ih)
+	sw.seeders.set(peer(1), 1)
+	// the oldest peer is replaced
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(3)))
+	_, found := sw.seeders.get(peer(1))
+	require.False(t, found)
+	leechers, seeders, err = storage.Counts(ctx, ps, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), leechers)
+	require.Equal(t, uint32(0), seeders)
+}
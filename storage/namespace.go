@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// namespaced isolates data and swarms of a virtual tracker inside
+// shared PeerStorage: data contexts are prefixed with namespace and
+// info hashes are replaced with hash of namespace and info hash.
+type namespaced struct {
+	PeerStorage
+	ns string
+}
+
+// Namespace wraps ps so that data and swarms stored via returned
+// PeerStorage are not visible via ps or other namespaces.
+// Close of returned storage does not close ps.
+func Namespace(ps PeerStorage, ns string) PeerStorage {
+	return &namespaced{PeerStorage: ps, ns: ns}
+}
+
+func (s *namespaced) storeCtx(storeCtx string) string {
+	return s.ns + ":" + storeCtx
+}
+
+// infoHash maps info hash to namespace preserving its length.
+// The first InfoHashV1Len bytes of V2 hash are mapped the same
+// way as V1 hash, so truncated V2 hashes match V1 ones.
+func (s *namespaced) infoHash(ih bittorrent.InfoHash) bittorrent.InfoHash {
+	v1 := ih.TruncateV1()
+	h := sha256.New()
+	h.Write([]byte(s.ns))
+	h.Write([]byte{0})
+	h.Write([]byte(v1))
+	var sum [sha256.Size]byte
+	out := h.Sum(sum[:0])[:len(v1)]
+	if len(ih) > len(v1) {
+		out = append(out, ih[len(v1):]...)
+	}
+	return bittorrent.InfoHash(out)
+}
+
+func (s *namespaced) Put(ctx context.Context, storeCtx string, values ...Entry) error {
+	return s.PeerStorage.Put(ctx, s.storeCtx(storeCtx), values...)
+}
+
+func (s *namespaced) Contains(ctx context.Context, storeCtx string, key string) (bool, error) {
+	return s.PeerStorage.Contains(ctx, s.storeCtx(storeCtx), key)
+}
+
+func (s *namespaced) Load(ctx context.Context, storeCtx string, key string) ([]byte, error) {
+	return s.PeerStorage.Load(ctx, s.storeCtx(storeCtx), key)
+}
+
+func (s *namespaced) Delete(ctx context.Context, storeCtx string, keys ...string) error {
+	return s.PeerStorage.Delete(ctx, s.storeCtx(storeCtx), keys...)
+}
+
+func (s *namespaced) CompareAndSwap(ctx context.Context, storeCtx, key string, old, value []byte) (bool, error) {
+	if cs, ok := s.PeerStorage.(CompareAndSwapper); ok {
+		return cs.CompareAndSwap(ctx, s.storeCtx(storeCtx), key, old, value)
+	}
+	return false, ErrCompareAndSwapNotSupported
+}
+
+func (s *namespaced) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return s.PeerStorage.PutSeeder(ctx, s.infoHash(ih), peer)
+}
+
+func (s *namespaced) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return s.PeerStorage.DeleteSeeder(ctx, s.infoHash(ih), peer)
+}
+
+func (s *namespaced) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return s.PeerStorage.PutLeecher(ctx, s.infoHash(ih), peer)
+}
+
+func (s *namespaced) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return s.PeerStorage.DeleteLeecher(ctx, s.infoHash(ih), peer)
+}
+
+func (s *namespaced) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return s.PeerStorage.GraduateLeecher(ctx, s.infoHash(ih), peer)
+}
+
+func (s *namespaced) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) ([]bittorrent.Peer, error) {
+	return s.PeerStorage.AnnouncePeers(ctx, s.infoHash(ih), forSeeder, numWant, v6)
+}
+
+func (s *namespaced) AnnouncePeersFunc(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool) error {
+	return s.PeerStorage.AnnouncePeersFunc(ctx, s.infoHash(ih), forSeeder, numWant, v6, fn)
+}
+
+func (s *namespaced) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	return s.PeerStorage.ScrapeSwarm(ctx, s.infoHash(ih))
+}
+
+// Counts - Counter implementation, falls back to ScrapeSwarm of wrapped storage
+func (s *namespaced) Counts(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, error) {
+	return Counts(ctx, s.PeerStorage, s.infoHash(ih))
+}
+
+// Admit - Admitter implementation, admits peer if wrapped storage does not implement it
+func (s *namespaced) Admit(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return Admit(ctx, s.PeerStorage, s.infoHash(ih), peer)
+}
+
+// Close does nothing, wrapped storage is closed by its owner
+func (s *namespaced) Close() error {
+	return nil
+}
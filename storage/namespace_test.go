@@ -0,0 +1,52 @@
+package storage_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestNamespace(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(conf.MapConfig{})
+	require.NoError(t, err)
+	defer ps.Close()
+	ns1, ns2 := storage.Namespace(ps, "t1"), storage.Namespace(ps, "t2")
+
+	ctx := context.Background()
+	ihV1 := bittorrent.InfoHash("11111111111111111111")
+	ihV2 := bittorrent.InfoHash(string(ihV1) + "222222222222")
+	peer := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	require.NoError(t, ns1.PutSeeder(ctx, ihV1, peer))
+	require.NoError(t, ns1.PutLeecher(ctx, ihV2, peer))
+
+	_, seeders, _, err := ns1.ScrapeSwarm(ctx, ihV1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), seeders)
+	for _, st := range []storage.PeerStorage{ps, ns2} {
+		_, seeders, _, err = st.ScrapeSwarm(ctx, ihV1)
+		require.NoError(t, err)
+		require.Zero(t, seeders)
+	}
+
+	require.NoError(t, ns1.Put(ctx, "ctx", storage.Entry{Key: "k", Value: []byte("v")}))
+	found, err := ns1.Contains(ctx, "ctx", "k")
+	require.NoError(t, err)
+	require.True(t, found)
+	found, err = ns2.Contains(ctx, "ctx", "k")
+	require.NoError(t, err)
+	require.False(t, found)
+	found, err = ps.Contains(ctx, "ctx", "k")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// shared storage is not closed by namespace
+	require.NoError(t, ns1.Close())
+	require.NoError(t, ps.Ping(ctx))
+}
@@ -4,6 +4,7 @@
 package pg
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -20,12 +21,15 @@ import (
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
 	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/privacy"
 	"github.com/sot-tech/mochi/pkg/timecache"
 	"github.com/sot-tech/mochi/storage"
 )
 
 const (
 	defaultPingQuery = "SELECT 0"
+	// casLockQuery serializes CompareAndSwap calls of the same key till the end of transaction
+	casLockQuery = "SELECT pg_advisory_xact_lock(hashtext(@context), hashtext(@key))"
 
 	errRequiredParameterNotSetMsg = "required parameter not provided: %s"
 	errRequiredColumnsNotFoundMsg = "one or more required columns not found in result set: %v"
@@ -252,9 +256,12 @@ func (cfg config) validateFull() (config, error) {
 type store struct {
 	config
 	*pgxpool.Pool
-	wg         sync.WaitGroup
-	closed     chan any
-	onceCloser sync.Once
+	// peerLifetime is the lifetime used by garbage collection,
+	// see storage.PeerLifetimeShift
+	peerLifetime time.Duration
+	wg           sync.WaitGroup
+	closed       chan any
+	onceCloser   sync.Once
 }
 
 func (s *store) txBatch(ctx context.Context, batch *pgx.Batch) (err error) {
@@ -313,6 +320,29 @@ func (s *store) Delete(ctx context.Context, storeCtx string, keys ...string) (er
 	return
 }
 
+// CompareAndSwap - storage.CompareAndSwapper implementation.
+// Value is checked and replaced with data queries inside transaction
+// with advisory lock of the key.
+func (s *store) CompareAndSwap(ctx context.Context, storeCtx, key string, old, value []byte) (swapped bool, err error) {
+	err = pgx.BeginFunc(ctx, s.Pool, func(tx pgx.Tx) (err error) {
+		if _, err = tx.Exec(ctx, casLockQuery, pgx.NamedArgs{pCtx: storeCtx, pKey: key}); err != nil {
+			return
+		}
+		var cur []byte
+		if err = noResultErr(tx.QueryRow(ctx, s.Data.GetQuery, pgx.NamedArgs{pCtx: storeCtx, pKey: []byte(key)}).Scan(&cur)); err != nil {
+			return
+		}
+		if swapped = bytes.Equal(cur, old); !swapped {
+			return
+		}
+		if _, err = tx.Exec(ctx, s.Data.DelQuery, pgx.NamedArgs{pCtx: storeCtx, pKey: [][]byte{[]byte(key)}}); err == nil && len(value) > 0 {
+			_, err = tx.Exec(ctx, s.Data.AddQuery, pgx.NamedArgs{pCtx: storeCtx, pKey: []byte(key), pValue: value})
+		}
+		return
+	})
+	return
+}
+
 func (s *store) Preservable() bool {
 	return true
 }
@@ -321,6 +351,7 @@ func (s *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 	if len(s.GCQuery) == 0 {
 		return
 	}
+	s.peerLifetime = peerLifeTime
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -339,7 +370,7 @@ func (s *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 				} else {
 					logger.Debug().Dur("timeTaken", duration).Msg("GC complete")
 				}
-				storage.PromGCDurationMilliseconds.Observe(float64(duration.Milliseconds()))
+				storage.RecordGC("pg", start)
 				t.Reset(gcInterval)
 			}
 		}
@@ -395,7 +426,7 @@ func (s *store) putPeer(ctx context.Context, ih []byte, peer bittorrent.Peer, se
 		pPort:     peer.Port(),
 		pSeeder:   seeder,
 		pV6:       peer.Addr().Is6(),
-		pCreated:  timecache.Now(),
+		pCreated:  timecache.Now().Add(storage.PeerLifetimeShift(ctx, peer.Addr().Is6(), s.peerLifetime)),
 	})
 	return
 }
@@ -507,12 +538,16 @@ func (s *store) getPeers(ctx context.Context, ih []byte, seeders bool, maxCount
 			if err == nil {
 				peers = append(peers, peer)
 			} else {
-				logger.Warn().
+				e := logger.Warn().
 					Err(err).
-					Hex("peerID", id).
-					IPAddr("ip", ip).
-					Int("port", port).
-					Msg("unable to scan/construct peer")
+					Hex("peerID", id)
+				if privacy.Enabled() {
+					addr, _ := netip.AddrFromSlice(ip)
+					e = e.Stringer("ip", privacy.Stringer(addr))
+				} else {
+					e = e.IPAddr("ip", ip)
+				}
+				e.Int("port", port).Msg("unable to scan/construct peer")
 			}
 		}
 	}
@@ -526,6 +561,9 @@ func (s *store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSe
 		Int("numWant", numWant).
 		Bool("v6", v6).
 		Msg("announce peers")
+	if numWant <= 0 {
+		return
+	}
 	ihb := ih.Bytes()
 	if forSeeder {
 		peers, err = s.getPeers(ctx, ihb, false, numWant, v6)
@@ -549,6 +587,18 @@ func (s *store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSe
 	return
 }
 
+// AnnouncePeersFunc calls fn for peers selected by AnnouncePeers,
+// because rows are scanned before peers are returned
+func (s *store) AnnouncePeersFunc(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool) error {
+	peers, err := s.AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+	for _, p := range peers {
+		if !fn(p) {
+			break
+		}
+	}
+	return err
+}
+
 func (s *store) countPeers(ctx context.Context, ih []byte) (seeders uint32, leechers uint32, err error) {
 	var rows pgx.Rows
 	if len(ih) == 0 {
@@ -588,6 +638,12 @@ func (s *store) countPeers(ctx context.Context, ih []byte) (seeders uint32, leec
 	return
 }
 
+// Counts - storage.Counter implementation, the same as ScrapeSwarm without downloads query
+func (s *store) Counts(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, err error) {
+	seeders, leechers, err = s.countPeers(ctx, ih.Bytes())
+	return
+}
+
 func (s *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
 	logger.Trace().
 		Stringer("infoHash", ih).
@@ -609,11 +665,13 @@ func (s *store) Ping(ctx context.Context) error {
 }
 
 func (s *store) Close() error {
-	go func() {
-		close(s.closed)
-		s.wg.Wait()
-		logger.Info().Msg("pg exiting. mochi does not clear data in database when exiting.")
-		s.Pool.Close()
-	}()
+	s.onceCloser.Do(func() {
+		go func() {
+			close(s.closed)
+			s.wg.Wait()
+			logger.Info().Msg("pg exiting. mochi does not clear data in database when exiting.")
+			s.Pool.Close()
+		}()
+	})
 	return nil
 }
@@ -91,6 +91,6 @@ func createNew() s.PeerStorage {
 	return ps
 }
 
-func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
+func TestStorage(t *testing.T) { test.RunConformanceTests(t, createNew) }
 
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
@@ -1,7 +1,14 @@
 // Package storage contains prometheus specific globals, used by storages
 package storage
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/pkg/events"
+	"github.com/sot-tech/mochi/pkg/metrics"
+)
 
 func init() {
 	// Register the metrics.
@@ -10,6 +17,10 @@ func init() {
 		PromInfoHashesCount,
 		PromSeedersCount,
 		PromLeechersCount,
+		PromCoalescedWritesCount,
+		PromIPLimitedPeersCount,
+		PromBreakerState,
+		PromBreakerRejectedCount,
 	)
 }
 
@@ -42,4 +53,59 @@ var (
 		Name: "mochi_storage_leechers_count",
 		Help: "The number of leechers tracked",
 	})
+
+	// PromCoalescedWritesCount is a counter of peer puts, which were skipped
+	// because peer was updated within minimal update interval.
+	PromCoalescedWritesCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mochi_storage_coalesced_writes_total",
+		Help: "The number of repeated announces, which did not update peer in storage",
+	})
+
+	// PromIPLimitedPeersCount is a counter of new peers, which exceeded
+	// limit of peers with the same IP address in swarm.
+	PromIPLimitedPeersCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_storage_ip_limited_peers_total",
+		Help: "The number of new peers, which exceeded limit of peers per IP address in swarm",
+	}, []string{"action"})
+
+	// PromBreakerState is a gauge of storage circuit breaker state:
+	// BreakerClosed, BreakerOpen or BreakerHalfOpen.
+	PromBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mochi_storage_breaker_state",
+		Help: "The state of storage circuit breaker: 0 - closed, 1 - open, 2 - half-open",
+	}, []string{"storage"})
+
+	// PromBreakerRejectedCount is a counter of storage requests
+	// rejected by open circuit breaker.
+	PromBreakerRejectedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mochi_storage_breaker_rejected_total",
+		Help: "The number of storage requests rejected by open circuit breaker",
+	}, []string{"storage"})
 )
+
+// RecordCoalescedWrite increments PromCoalescedWritesCount if metrics enabled
+func RecordCoalescedWrite() {
+	if metrics.Enabled() {
+		PromCoalescedWritesCount.Inc()
+	}
+}
+
+// RecordIPLimited increments PromIPLimitedPeersCount with action
+// `evicted` or `rejected` if metrics enabled
+func RecordIPLimited(evicted bool) {
+	if metrics.Enabled() {
+		action := "rejected"
+		if evicted {
+			action = "evicted"
+		}
+		PromIPLimitedPeersCount.WithLabelValues(action).Inc()
+	}
+}
+
+// RecordGC records duration of garbage collection started at start
+// in PromGCDurationMilliseconds and publishes GC event of storage driver
+func RecordGC(driver string, start time.Time) {
+	duration := time.Since(start)
+	PromGCDurationMilliseconds.Observe(float64(duration.Milliseconds()))
+	events.Publish(events.Event{Type: events.TypeGC, Storage: driver, DurationMs: duration.Milliseconds()})
+}
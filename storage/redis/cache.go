@@ -0,0 +1,203 @@
+package redis
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+// invalidateChannel is the channel, to which redis sends
+// invalidation messages of tracked keys if redirection enabled
+const invalidateChannel = "__redis__:invalidate"
+
+type cacheEntry struct {
+	members []string
+	loaded  int64
+	expire  int64
+}
+
+// swarmCache keeps members of swarms locally and serves membership
+// reads without requests to redis. It uses server-assisted client side
+// caching: swarms are read through connections with enabled tracking
+// (CLIENT TRACKING), and redis sends invalidation messages of modified
+// keys to dedicated connection subscribed to invalidateChannel.
+//
+// go-redis does not handle RESP3 push messages in regular connections,
+// so invalidations are redirected to RESP2 Pub/Sub connection.
+//
+// Every put of peer modifies swarm, so invalidated swarm is not dropped,
+// but served until refresh period since the last read expires,
+// otherwise hot swarms would be read from redis on every announce.
+type swarmCache struct {
+	opts         *redis.Options
+	size         int
+	ttl, refresh int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+
+	// tracked is the client with enabled tracking, it is re-created
+	// every time invalidation connection re-connects, since
+	// tracking of old connections is redirected to non-existent client.
+	// trackedMu is held for reading while client is used, so
+	// replaced client is closed after all reads are finished.
+	tracked   *redis.Client
+	trackedMu sync.RWMutex
+	redirect  atomic.Int64
+	sub       *redis.Client
+	pubSub    *redis.PubSub
+	wg        sync.WaitGroup
+}
+
+func newSwarmCache(opts *redis.Options, size int, ttl, refresh int64) (*swarmCache, error) {
+	c := &swarmCache{
+		opts:    opts,
+		size:    size,
+		ttl:     ttl,
+		refresh: refresh,
+		entries: make(map[string]*cacheEntry, size),
+	}
+	subOpts := *opts
+	subOpts.Protocol, subOpts.PoolSize = 2, 1
+	subOpts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		id, err := cn.ClientID(ctx).Result()
+		if err == nil {
+			c.redirect.Store(id)
+			c.reset()
+		}
+		return err
+	}
+	c.sub = redis.NewClient(&subOpts)
+	c.pubSub = c.sub.Subscribe(context.Background(), invalidateChannel)
+	// Receive forces connection and waits for subscription confirmation
+	if _, err := c.pubSub.Receive(context.Background()); err != nil {
+		_ = c.pubSub.Close()
+		_ = c.sub.Close()
+		if c.tracked != nil {
+			_ = c.tracked.Close()
+		}
+		return nil, err
+	}
+	c.wg.Add(1)
+	go c.listen()
+	return c, nil
+}
+
+// reset drops all entries and replaces tracked client with new one,
+// which redirects invalidations to the current subscriber
+func (c *swarmCache) reset() {
+	trackedOpts := *c.opts
+	// RESP3 connection receives push message if redirection is broken
+	trackedOpts.Protocol = 2
+	redirect := c.redirect.Load()
+	trackedOpts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		return cn.Process(ctx, redis.NewCmd(ctx, "CLIENT", "TRACKING", "ON", "REDIRECT", redirect))
+	}
+	c.mu.Lock()
+	c.entries = make(map[string]*cacheEntry, c.size)
+	c.mu.Unlock()
+	c.trackedMu.Lock()
+	old := c.tracked
+	c.tracked = redis.NewClient(&trackedOpts)
+	c.trackedMu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	logger.Debug().Int64("redirect", redirect).Msg("swarm cache reset")
+}
+
+func (c *swarmCache) listen() {
+	defer c.wg.Done()
+	for msg := range c.pubSub.Channel() {
+		if msg.Channel == invalidateChannel {
+			c.invalidate(msg.PayloadSlice...)
+		}
+	}
+}
+
+// invalidate drops placeholders of keys, which are being read,
+// and limits expiration of cached swarms to refresh period
+func (c *swarmCache) invalidate(keys ...string) {
+	c.mu.Lock()
+	for _, k := range keys {
+		if e := c.entries[k]; e != nil {
+			if e.members == nil {
+				delete(c.entries, k)
+			} else {
+				e.expire = min(e.expire, e.loaded+c.refresh)
+			}
+		}
+	}
+	c.mu.Unlock()
+}
+
+// members returns cached members of swarm or reads them
+// from redis and stores in cache
+func (c *swarmCache) members(ctx context.Context, key string) ([]string, error) {
+	now := timecache.NowUnixNano()
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil && e.members != nil && e.expire > now {
+		c.mu.Unlock()
+		return e.members, nil
+	}
+	if e == nil && len(c.entries) >= c.size {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	// placeholder is removed by invalidation, which may arrive
+	// while members are being read, read result is stored only
+	// if placeholder is still in place
+	fill := new(cacheEntry)
+	c.entries[key] = fill
+	c.mu.Unlock()
+
+	c.trackedMu.RLock()
+	members, err := c.tracked.HKeys(ctx, key).Result()
+	c.trackedMu.RUnlock()
+	c.mu.Lock()
+	if c.entries[key] == fill {
+		if err == nil {
+			fill.members, fill.loaded, fill.expire = members, now, now+c.ttl
+		} else {
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+	return members, err
+}
+
+// randMembers returns up to count members of swarm starting from
+// random position, it is used instead of HRANDFIELD
+func (c *swarmCache) randMembers(ctx context.Context, key string, count int) *redis.StringSliceCmd {
+	members, err := c.members(ctx, key)
+	if n := len(members); err == nil && n > count {
+		out, start := make([]string, 0, count), rand.IntN(n)
+		out = append(out, members[start:min(start+count, n)]...)
+		out = append(out, members[:count-len(out)]...)
+		members = out
+	}
+	return redis.NewStringSliceResult(members, err)
+}
+
+// Close stops listening of invalidations and closes clients
+func (c *swarmCache) Close() error {
+	err := c.pubSub.Close()
+	c.wg.Wait()
+	if err1 := c.sub.Close(); err == nil {
+		err = err1
+	}
+	c.trackedMu.Lock()
+	defer c.trackedMu.Unlock()
+	if err1 := c.tracked.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package redis
+
+import (
+	"context"
+	"math"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func TestRandMembers(t *testing.T) {
+	members := []string{"a", "b", "c", "d", "e"}
+	c := &swarmCache{entries: map[string]*cacheEntry{
+		"swarm": {members: members, expire: math.MaxInt64},
+	}}
+	for i := 0; i < 100; i++ {
+		got, err := c.randMembers(context.Background(), "swarm", 3).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 3 {
+			t.Fatalf("expected 3 members, got %v", got)
+		}
+		slices.Sort(got)
+		if len(slices.Compact(got)) != 3 {
+			t.Fatalf("expected distinct members, got %v", got)
+		}
+	}
+	if got, _ := c.randMembers(context.Background(), "swarm", 10).Result(); !slices.Equal(got, members) {
+		t.Fatalf("expected all members, got %v", got)
+	}
+	// invalidated swarm is served until refresh period expires
+	c.refresh = int64(time.Hour)
+	c.entries["swarm"].loaded = time.Now().UnixNano()
+	c.invalidate("swarm")
+	if got, _ := c.randMembers(context.Background(), "swarm", 10).Result(); !slices.Equal(got, members) {
+		t.Fatalf("expected stale members, got %v", got)
+	}
+	c.refresh = 0
+	c.invalidate("swarm")
+	if e := c.entries["swarm"]; e.expire > time.Now().UnixNano() {
+		t.Fatal("expected invalidated entry expired")
+	}
+	// placeholder of swarm being read is removed
+	c.entries["swarm"] = new(cacheEntry)
+	c.invalidate("swarm")
+	if len(c.entries) > 0 {
+		t.Fatal("expected invalidated placeholder removed")
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	c := cfg
+	c.CacheSize, c.CacheTTL, c.CacheRefreshInterval = 10, time.Hour, 10*time.Millisecond
+	ps, err := NewStore(c)
+	if err != nil {
+		t.Skip("redis is not available: ", err)
+	}
+	defer ps.Close()
+	ctx, ih := context.Background(), bittorrent.InfoHash("00000000000000000003")
+	p1 := bittorrent.Peer{ID: bittorrent.PeerID{1}, AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	p2 := bittorrent.Peer{ID: bittorrent.PeerID{2}, AddrPort: netip.MustParseAddrPort("1.2.3.5:6881")}
+
+	if err = ps.PutSeeder(ctx, ih, p1); err != nil {
+		t.Fatal(err)
+	}
+	defer ps.DeleteSeeder(ctx, ih, p1)
+	peers, err := ps.AnnouncePeers(ctx, ih, false, 10, false)
+	if err != nil || len(peers) != 1 {
+		t.Fatalf("expected 1 peer, got %v (%v)", peers, err)
+	}
+	if err = ps.PutSeeder(ctx, ih, p2); err != nil {
+		t.Fatal(err)
+	}
+	defer ps.DeleteSeeder(ctx, ih, p2)
+	// invalidation is delivered asynchronously
+	for i := 0; i < 10; i++ {
+		if peers, err = ps.AnnouncePeers(ctx, ih, false, 10, false); err == nil && len(peers) == 2 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expected 2 peers after invalidation, got %v (%v)", peers, err)
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Server-side scripts execute peer modification with counters update
+// atomically in one round trip. Scripts are called with EVALSHA,
+// and loaded with EVAL if server does not have them cached (NOSCRIPT).
+// Counters are changed only if peer is actually added or deleted.
+var (
+	// putScript adds peer to swarm, if it is absent or was updated
+	// earlier than minimal update interval.
+	// KEYS: swarm, counter, swarms set; ARGV: peer, now, minimal update interval.
+	// Returns 0 if write skipped.
+	putScript = redis.NewScript(`
+local interval = tonumber(ARGV[3])
+if interval > 0 then
+	local mtime = redis.call('HGET', KEYS[1], ARGV[1])
+	local d = mtime and tonumber(ARGV[2]) - tonumber(mtime)
+	if d and d >= 0 and d < interval then
+		return 0
+	end
+end
+if redis.call('HSET', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	redis.call('INCR', KEYS[2])
+end
+redis.call('SADD', KEYS[3], KEYS[1])
+return 1
+`)
+
+	// delScript removes peer from swarm.
+	// KEYS: swarm, counter; ARGV: peer.
+	// Returns the number of deleted peers.
+	delScript = redis.NewScript(`
+local deleted = redis.call('HDEL', KEYS[1], ARGV[1])
+if deleted > 0 then
+	redis.call('DECR', KEYS[2])
+end
+return deleted
+`)
+
+	// graduateScript moves peer from leechers to seeders and increments downloads.
+	// KEYS: leechers swarm, seeders swarm, leechers counter, seeders counter, swarms set, downloads;
+	// ARGV: peer, now, info hash.
+	graduateScript = redis.NewScript(`
+if redis.call('HDEL', KEYS[1], ARGV[1]) > 0 then
+	redis.call('DECR', KEYS[3])
+end
+if redis.call('HSET', KEYS[2], ARGV[1], ARGV[2]) == 1 then
+	redis.call('INCR', KEYS[4])
+end
+redis.call('SADD', KEYS[5], KEYS[2])
+redis.call('HINCRBY', KEYS[6], ARGV[3], 1)
+return 1
+`)
+
+	// casScript replaces data value if it equals to expected,
+	// empty expected value matches absent key, empty new value deletes key.
+	// KEYS: data context; ARGV: key, expected value, new value.
+	// Returns 0 if value differs.
+	casScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1]) or ''
+if cur ~= ARGV[2] then
+	return 0
+end
+if ARGV[3] == '' then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+else
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+end
+return 1
+`)
+)
+
+func (ps *store) putPeerScript(ctx context.Context, infoHashKey, peerCountKey, peerID string, now int64) error {
+	written, err := putScript.Run(ctx, ps.UniversalClient, []string{infoHashKey, peerCountKey, IHKey},
+		peerID, now, ps.minUpdate).Int()
+	if err == nil && written == 0 {
+		storage.RecordCoalescedWrite()
+	}
+	return err
+}
+
+func (ps *store) delPeerScript(ctx context.Context, infoHashKey, peerCountKey, peerID string) error {
+	deleted, err := delScript.Run(ctx, ps.UniversalClient, []string{infoHashKey, peerCountKey}, peerID).Int()
+	if err == nil && deleted == 0 {
+		err = storage.ErrResourceDoesNotExist
+	}
+	return err
+}
+
+func (ps *store) graduateLeecherScript(ctx context.Context, infoHash, ihSeederKey, ihLeecherKey, peerID string, now int64) error {
+	return graduateScript.Run(ctx, ps.UniversalClient,
+		[]string{ihLeecherKey, ihSeederKey, CountLeecherKey, CountSeederKey, IHKey, CountDownloadsKey},
+		peerID, now, infoHash).Err()
+}
@@ -32,6 +32,7 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -55,6 +56,13 @@ const (
 	defaultReadTimeout    = time.Second * 15
 	defaultWriteTimeout   = time.Second * 15
 	defaultConnectTimeout = time.Second * 15
+	defaultCacheTTL       = time.Second * 10
+	defaultCacheRefresh   = time.Second
+	defaultPipelineSize   = 64
+	// CompatibilityRedis is the default compatibility mode
+	CompatibilityRedis = "redis"
+	// CompatibilityDragonfly is the compatibility mode for Dragonfly server
+	CompatibilityDragonfly = "dragonfly"
 	// PrefixKey prefix which will be prepended to ctx argument in storage.DataStorage calls
 	PrefixKey = "CHI_"
 	// IHKey redis hash key for all info hashes
@@ -115,7 +123,29 @@ func NewStore(cfg Config) (storage.PeerStorage, error) {
 		return nil, err
 	}
 
-	return &store{Connection: rs, closed: make(chan any)}, nil
+	ps := &store{
+		Connection: rs,
+		minUpdate:  cfg.MinUpdateInterval.Nanoseconds(),
+		// keys of swarm and counters belong to different slots,
+		// so they can not be accessed by the same script in cluster
+		scripts:      !cfg.Cluster && !cfg.NoScripts,
+		pipelineSize: cfg.PipelineSize,
+		closed:       make(chan any),
+	}
+	if cfg.CacheSize > 0 {
+		// tracking connections and invalidation connection
+		// must be connected to the same server
+		if cl, ok := rs.UniversalClient.(*redis.Client); ok {
+			if ps.cache, err = newSwarmCache(cl.Options(), cfg.CacheSize, cfg.CacheTTL.Nanoseconds(), cfg.CacheRefreshInterval.Nanoseconds()); err != nil {
+				_ = rs.Close()
+				return nil, err
+			}
+		} else {
+			logger.Warn().Msg("client side caching is supported only by standalone redis, disabling")
+		}
+	}
+
+	return ps, nil
 }
 
 // Config holds the configuration of a redis PeerStorage.
@@ -134,6 +164,26 @@ type Config struct {
 	ReadTimeout    time.Duration `cfg:"read_timeout"`
 	WriteTimeout   time.Duration `cfg:"write_timeout"`
 	ConnectTimeout time.Duration `cfg:"connect_timeout"`
+	// MinUpdateInterval is the period since the last write of peer,
+	// during which repeated puts of the same peer are skipped.
+	MinUpdateInterval time.Duration `cfg:"min_update_interval"`
+	// CacheSize is the maximal number of swarms, which members are cached
+	// locally and invalidated by redis server, zero disables caching.
+	CacheSize int `cfg:"cache_size"`
+	// CacheTTL is the maximal period, during which cached swarm is served
+	// without being read from redis, even if no invalidation received.
+	CacheTTL time.Duration `cfg:"cache_ttl"`
+	// CacheRefreshInterval is the minimal period between reads of cached
+	// swarm from redis, during which invalidated swarm is still served.
+	CacheRefreshInterval time.Duration `cfg:"cache_refresh_interval"`
+	// Compatibility is the type of server (redis or dragonfly),
+	// features, which are not supported by server, are disabled.
+	Compatibility string `cfg:"compatibility"`
+	// NoScripts disables server-side scripts, peers are modified by transactions.
+	NoScripts bool `cfg:"no_scripts"`
+	// PipelineSize is the maximal number of commands sent
+	// in one round trip during garbage collection and dump.
+	PipelineSize int `cfg:"pipeline_size"`
 }
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -192,6 +242,73 @@ func (cfg Config) Validate() (Config, error) {
 			Msg("falling back to default configuration")
 	}
 
+	if cfg.MinUpdateInterval < 0 {
+		validCfg.MinUpdateInterval = 0
+		logger.Warn().
+			Str("name", "minUpdateInterval").
+			Dur("provided", cfg.MinUpdateInterval).
+			Dur("default", validCfg.MinUpdateInterval).
+			Msg("falling back to default configuration")
+	}
+
+	switch validCfg.Compatibility = strings.ToLower(cfg.Compatibility); validCfg.Compatibility {
+	case CompatibilityRedis, CompatibilityDragonfly:
+	default:
+		validCfg.Compatibility = CompatibilityRedis
+		logger.Warn().
+			Str("name", "compatibility").
+			Str("provided", cfg.Compatibility).
+			Str("default", validCfg.Compatibility).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.PipelineSize <= 0 {
+		validCfg.PipelineSize = defaultPipelineSize
+		logger.Warn().
+			Str("name", "pipelineSize").
+			Int("provided", cfg.PipelineSize).
+			Int("default", validCfg.PipelineSize).
+			Msg("falling back to default configuration")
+	}
+
+	// Dragonfly does not support redirection of tracking invalidations
+	if validCfg.Compatibility == CompatibilityDragonfly && cfg.CacheSize > 0 {
+		validCfg.CacheSize = 0
+		logger.Warn().
+			Str("name", "cacheSize").
+			Int("provided", cfg.CacheSize).
+			Int("default", validCfg.CacheSize).
+			Str("compatibility", validCfg.Compatibility).
+			Msg("client side caching is not supported, falling back to default configuration")
+	}
+
+	if validCfg.CacheSize < 0 {
+		validCfg.CacheSize = 0
+		logger.Warn().
+			Str("name", "cacheSize").
+			Int("provided", cfg.CacheSize).
+			Int("default", validCfg.CacheSize).
+			Msg("falling back to default configuration")
+	}
+
+	if validCfg.CacheSize > 0 && cfg.CacheTTL <= 0 {
+		validCfg.CacheTTL = defaultCacheTTL
+		logger.Warn().
+			Str("name", "cacheTTL").
+			Dur("provided", cfg.CacheTTL).
+			Dur("default", validCfg.CacheTTL).
+			Msg("falling back to default configuration")
+	}
+
+	if validCfg.CacheSize > 0 && (cfg.CacheRefreshInterval <= 0 || cfg.CacheRefreshInterval > validCfg.CacheTTL) {
+		validCfg.CacheRefreshInterval = min(defaultCacheRefresh, validCfg.CacheTTL)
+		logger.Warn().
+			Str("name", "cacheRefreshInterval").
+			Dur("provided", cfg.CacheRefreshInterval).
+			Dur("default", validCfg.CacheRefreshInterval).
+			Msg("falling back to default configuration")
+	}
+
 	if cfg.TLS {
 		for _, cert := range cfg.CACerts {
 			if _, err := os.Stat(cert); err != nil {
@@ -243,31 +360,36 @@ func (cfg Config) Connect() (con Connection, err error) {
 			WriteTimeout: cfg.WriteTimeout,
 			PoolSize:     cfg.PoolSize,
 			TLSConfig:    tlsConf,
+			// deadlines of requests (frontend's request_timeout)
+			// are preferred over read and write timeouts
+			ContextTimeoutEnabled: true,
 		})
 	case cfg.Sentinel:
 		rs = redis.NewFailoverClient(&redis.FailoverOptions{
-			SentinelAddrs:    cfg.Addresses,
-			SentinelUsername: cfg.Login,
-			SentinelPassword: cfg.Password,
-			MasterName:       cfg.SentinelMaster,
-			DialTimeout:      cfg.ConnectTimeout,
-			ReadTimeout:      cfg.ReadTimeout,
-			WriteTimeout:     cfg.WriteTimeout,
-			PoolSize:         cfg.PoolSize,
-			DB:               cfg.DB,
-			TLSConfig:        tlsConf,
+			SentinelAddrs:         cfg.Addresses,
+			SentinelUsername:      cfg.Login,
+			SentinelPassword:      cfg.Password,
+			MasterName:            cfg.SentinelMaster,
+			DialTimeout:           cfg.ConnectTimeout,
+			ReadTimeout:           cfg.ReadTimeout,
+			WriteTimeout:          cfg.WriteTimeout,
+			PoolSize:              cfg.PoolSize,
+			DB:                    cfg.DB,
+			TLSConfig:             tlsConf,
+			ContextTimeoutEnabled: true,
 		})
 	default:
 		rs = redis.NewClient(&redis.Options{
-			Addr:         cfg.Addresses[0],
-			Username:     cfg.Login,
-			Password:     cfg.Password,
-			DialTimeout:  cfg.ConnectTimeout,
-			ReadTimeout:  cfg.ReadTimeout,
-			WriteTimeout: cfg.WriteTimeout,
-			PoolSize:     cfg.PoolSize,
-			DB:           cfg.DB,
-			TLSConfig:    tlsConf,
+			Addr:                  cfg.Addresses[0],
+			Username:              cfg.Login,
+			Password:              cfg.Password,
+			DialTimeout:           cfg.ConnectTimeout,
+			ReadTimeout:           cfg.ReadTimeout,
+			WriteTimeout:          cfg.WriteTimeout,
+			PoolSize:              cfg.PoolSize,
+			DB:                    cfg.DB,
+			TLSConfig:             tlsConf,
+			ContextTimeoutEnabled: true,
 		})
 	}
 	if err = rs.Ping(context.Background()).Err(); err == nil && !errors.Is(err, redis.Nil) {
@@ -280,6 +402,7 @@ func (cfg Config) Connect() (con Connection, err error) {
 }
 
 func (ps *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
+	ps.peerLifetime = peerLifeTime
 	ps.wg.Add(1)
 	go func() {
 		defer ps.wg.Done()
@@ -292,9 +415,8 @@ func (ps *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
 			case <-t.C:
 				start := time.Now()
 				ps.gc(time.Now().Add(-peerLifeTime))
-				duration := time.Since(start)
-				logger.Debug().Dur("timeTaken", duration).Msg("gc complete")
-				storage.PromGCDurationMilliseconds.Observe(float64(duration.Milliseconds()))
+				logger.Debug().Dur("timeTaken", time.Since(start)).Msg("gc complete")
+				storage.RecordGC("redis", start)
 				t.Reset(gcInterval)
 			}
 		}
@@ -337,9 +459,21 @@ type Connection struct {
 
 type store struct {
 	Connection
-	closed     chan any
-	wg         sync.WaitGroup
-	onceCloser sync.Once
+	// minUpdate see Config.MinUpdateInterval
+	minUpdate int64
+	// scripts is true if peers are modified by server-side scripts
+	// instead of transactions
+	scripts bool
+	// cache is nil if client side caching disabled
+	cache *swarmCache
+	// pipelineSize see Config.PipelineSize
+	pipelineSize int
+	// peerLifetime is the lifetime used by garbage collection,
+	// see storage.PeerLifetimeShift
+	peerLifetime time.Duration
+	closed       chan any
+	wg           sync.WaitGroup
+	onceCloser   sync.Once
 }
 
 func (ps *store) count(key string, getLength bool) (n uint64) {
@@ -356,8 +490,9 @@ func (ps *store) count(key string, getLength bool) (n uint64) {
 	return
 }
 
-func (ps *store) getClock() int64 {
-	return timecache.NowUnixNano()
+// getClock returns modification time of IPv4 or IPv6 peer put with ctx
+func (ps *store) getClock(ctx context.Context, v6 bool) int64 {
+	return timecache.NowUnixNano() + storage.PeerLifetimeShift(ctx, v6, ps.peerLifetime).Nanoseconds()
 }
 
 func (ps *store) tx(ctx context.Context, txf func(tx redis.Pipeliner) error) (err error) {
@@ -409,13 +544,24 @@ func InfoHashKey(infoHash string, seeder, v6 bool) (infoHashKey string) {
 	return
 }
 
-func (ps *store) putPeer(ctx context.Context, infoHashKey, peerCountKey, peerID string) error {
+func (ps *store) putPeer(ctx context.Context, infoHashKey, peerCountKey, peerID string, now int64) error {
 	logger.Trace().
 		Str("infoHashKey", infoHashKey).
 		Str("peerID", peerID).
 		Msg("put peer")
+	if ps.scripts {
+		return ps.putPeerScript(ctx, infoHashKey, peerCountKey, peerID, now)
+	}
+	if ps.minUpdate > 0 {
+		// if peer is absent or request failed, it is written as usual,
+		// modification time moved backward (shorter lifetime) is always written
+		if mtime, err := ps.HGet(ctx, infoHashKey, peerID).Int64(); err == nil && now >= mtime && now-mtime < ps.minUpdate {
+			storage.RecordCoalescedWrite()
+			return nil
+		}
+	}
 	return ps.tx(ctx, func(tx redis.Pipeliner) (err error) {
-		if err = tx.HSet(ctx, infoHashKey, peerID, ps.getClock()).Err(); err != nil {
+		if err = tx.HSet(ctx, infoHashKey, peerID, now).Err(); err != nil {
 			return
 		}
 		if err = tx.Incr(ctx, peerCountKey).Err(); err != nil {
@@ -431,6 +577,9 @@ func (ps *store) delPeer(ctx context.Context, infoHashKey, peerCountKey, peerID
 		Str("infoHashKey", infoHashKey).
 		Str("peerID", peerID).
 		Msg("del peer")
+	if ps.scripts {
+		return ps.delPeerScript(ctx, infoHashKey, peerCountKey, peerID)
+	}
 	deleted, err := ps.HDel(ctx, infoHashKey, peerID).Uint64()
 	err = NoResultErr(err)
 	if err == nil {
@@ -455,7 +604,8 @@ func PackPeer(p bittorrent.Peer) string {
 }
 
 func (ps *store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return ps.putPeer(ctx, InfoHashKey(ih.RawString(), true, peer.Addr().Is6()), CountSeederKey, PackPeer(peer))
+	isV6 := peer.Addr().Is6()
+	return ps.putPeer(ctx, InfoHashKey(ih.RawString(), true, isV6), CountSeederKey, PackPeer(peer), ps.getClock(ctx, isV6))
 }
 
 func (ps *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
@@ -463,7 +613,8 @@ func (ps *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer
 }
 
 func (ps *store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
-	return ps.putPeer(ctx, InfoHashKey(ih.RawString(), false, peer.Addr().Is6()), CountLeecherKey, PackPeer(peer))
+	isV6 := peer.Addr().Is6()
+	return ps.putPeer(ctx, InfoHashKey(ih.RawString(), false, isV6), CountLeecherKey, PackPeer(peer), ps.getClock(ctx, isV6))
 }
 
 func (ps *store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
@@ -478,6 +629,10 @@ func (ps *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, pe
 
 	infoHash, peerID, isV6 := ih.RawString(), PackPeer(peer), peer.Addr().Is6()
 	ihSeederKey, ihLeecherKey := InfoHashKey(infoHash, true, isV6), InfoHashKey(infoHash, false, isV6)
+	now := ps.getClock(ctx, isV6)
+	if ps.scripts {
+		return ps.graduateLeecherScript(ctx, infoHash, ihSeederKey, ihLeecherKey, peerID, now)
+	}
 
 	return ps.tx(ctx, func(tx redis.Pipeliner) error {
 		deleted, err := tx.HDel(ctx, ihLeecherKey, peerID).Uint64()
@@ -488,7 +643,7 @@ func (ps *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, pe
 			}
 		}
 		if err == nil {
-			err = tx.HSet(ctx, ihSeederKey, peerID, ps.getClock()).Err()
+			err = tx.HSet(ctx, ihSeederKey, peerID, now).Err()
 		}
 		if err == nil {
 			err = tx.Incr(ctx, CountSeederKey).Err()
@@ -532,13 +687,18 @@ func UnpackPeer(data string) (peer bittorrent.Peer, err error) {
 	return
 }
 
-func (ps *Connection) parsePeersList(peersResult *redis.StringSliceCmd) (peers []bittorrent.Peer, err error) {
+// rangePeersList decodes peers from peersResult and calls fn for each
+// of them until fn returns false. Returns number of decoded peers.
+func (ps *Connection) rangePeersList(peersResult *redis.StringSliceCmd, fn func(bittorrent.Peer) bool) (n int, err error) {
 	var peerIDs []string
 	peerIDs, err = peersResult.Result()
 	if err = NoResultErr(err); err == nil {
 		for _, peerID := range peerIDs {
 			if p, err := UnpackPeer(peerID); err == nil {
-				peers = append(peers, p)
+				n++
+				if !fn(p) {
+					break
+				}
 			} else {
 				logger.Error().Err(err).Str("peerID", peerID).Msg("unable to decode peer")
 			}
@@ -556,39 +716,71 @@ type getPeersFn func(context.Context, string, int) *redis.StringSliceCmd
 func (ps *Connection) GetPeers(
 	ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, maxCount int, isV6 bool, membersFn getPeersFn,
 ) (out []bittorrent.Peer, err error) {
+	err = ps.GetPeersFunc(ctx, ih, forSeeder, maxCount, isV6, membersFn, func(p bittorrent.Peer) bool {
+		out = append(out, p)
+		return true
+	})
+	return
+}
+
+// GetPeersFunc retrieves peers the same way as GetPeers, but instead
+// of collecting them calls fn for each peer until fn returns false.
+func (ps *Connection) GetPeersFunc(
+	ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, maxCount int, isV6 bool, membersFn getPeersFn,
+	fn func(bittorrent.Peer) bool,
+) (err error) {
+	if maxCount <= 0 {
+		return
+	}
 	infoHash := ih.RawString()
 
-	infoHashKeys := make([]string, 1, 2)
+	var infoHashKeys [2]string
+	keys := infoHashKeys[:1]
 
 	if forSeeder {
-		infoHashKeys[0] = InfoHashKey(infoHash, false, isV6)
+		keys[0] = InfoHashKey(infoHash, false, isV6)
 	} else {
-		infoHashKeys[0] = InfoHashKey(infoHash, true, isV6)
-		infoHashKeys = append(infoHashKeys, InfoHashKey(infoHash, false, isV6))
+		keys[0] = InfoHashKey(infoHash, true, isV6)
+		keys = append(keys, InfoHashKey(infoHash, false, isV6))
 	}
 
-	for _, infoHashKey := range infoHashKeys {
-		var peers []bittorrent.Peer
-		peers, err = ps.parsePeersList(membersFn(ctx, infoHashKey, maxCount))
-		maxCount -= len(peers)
-		out = append(out, peers...)
-		if err != nil || maxCount <= 0 {
+	var total int
+	next := true
+	rangeFn := func(p bittorrent.Peer) bool {
+		next = fn(p)
+		return next
+	}
+	for _, infoHashKey := range keys {
+		var n int
+		n, err = ps.rangePeersList(membersFn(ctx, infoHashKey, maxCount), rangeFn)
+		maxCount -= n
+		total += n
+		if err != nil || !next || maxCount <= 0 {
 			break
 		}
 	}
 
-	if l := len(out); err == nil {
-		if l == 0 {
+	if err == nil {
+		if total == 0 {
 			err = storage.ErrResourceDoesNotExist
 		}
-	} else if l > 0 {
-		err = nil
+	} else if total > 0 {
 		logger.Warn().Err(err).Stringer("infoHash", ih).Msg("error occurred while retrieving peers")
+		err = nil
 	}
 
 	return
 }
 
+// membersFn returns function to read swarm members,
+// cached if client side caching enabled
+func (ps *store) membersFn() getPeersFn {
+	if ps.cache != nil {
+		return ps.cache.randMembers
+	}
+	return ps.HRandField
+}
+
 func (ps *store) AnnouncePeers(
 	ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool,
 ) ([]bittorrent.Peer, error) {
@@ -599,7 +791,20 @@ func (ps *store) AnnouncePeers(
 		Bool("v6", v6).
 		Msg("announce peers")
 
-	return ps.GetPeers(ctx, ih, forSeeder, numWant, v6, ps.HRandField)
+	return ps.GetPeers(ctx, ih, forSeeder, numWant, v6, ps.membersFn())
+}
+
+func (ps *store) AnnouncePeersFunc(
+	ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool,
+) error {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Bool("forSeeder", forSeeder).
+		Int("numWant", numWant).
+		Bool("v6", v6).
+		Msg("announce peers")
+
+	return ps.GetPeersFunc(ctx, ih, forSeeder, numWant, v6, ps.membersFn(), fn)
 }
 
 type getPeerCountFn func(context.Context, string) *redis.IntCmd
@@ -642,6 +847,35 @@ func (ps *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint3
 	return ps.ScrapeIH(ctx, ih, ps.HLen)
 }
 
+// CountIH returns seeders and leechers count for specified info hash
+// with single round trip, countFn queues count command into pipeline
+// (i.e. redis.Pipeliner.HLen method expression)
+func (ps *Connection) CountIH(
+	ctx context.Context, ih bittorrent.InfoHash, countFn func(redis.Pipeliner, context.Context, string) *redis.IntCmd,
+) (
+	leechersCount, seedersCount uint32, err error,
+) {
+	infoHash := ih.RawString()
+	var cmds [4]*redis.IntCmd
+	_, err = ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		cmds[0] = countFn(p, ctx, InfoHashKey(infoHash, false, false))
+		cmds[1] = countFn(p, ctx, InfoHashKey(infoHash, false, true))
+		cmds[2] = countFn(p, ctx, InfoHashKey(infoHash, true, false))
+		cmds[3] = countFn(p, ctx, InfoHashKey(infoHash, true, true))
+		return nil
+	})
+	if err = NoResultErr(err); err == nil {
+		leechersCount = uint32(cmds[0].Val() + cmds[1].Val())
+		seedersCount = uint32(cmds[2].Val() + cmds[3].Val())
+	}
+	return
+}
+
+// Counts - storage.Counter implementation
+func (ps *store) Counts(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, error) {
+	return ps.CountIH(ctx, ih, redis.Pipeliner.HLen)
+}
+
 const argNumErrorMsg = "ERR wrong number of arguments"
 
 // Put - storage.DataStorage implementation
@@ -703,6 +937,12 @@ func (ps *Connection) Delete(ctx context.Context, storeCtx string, keys ...strin
 	return
 }
 
+// CompareAndSwap - storage.CompareAndSwapper implementation
+func (ps *Connection) CompareAndSwap(ctx context.Context, storeCtx, key string, old, value []byte) (bool, error) {
+	swapped, err := casScript.Run(ctx, ps.UniversalClient, []string{PrefixKey + storeCtx}, key, old, value).Int()
+	return swapped == 1, err
+}
+
 // Preservable - storage.DataStorage implementation
 func (*Connection) Preservable() bool {
 	return true
@@ -763,107 +1003,185 @@ func (ps *store) gc(cutoff time.Time) {
 	// list all infoHashKeys in the group
 	infoHashKeys, err := ps.SMembers(context.Background(), IHKey).Result()
 	err = NoResultErr(err)
+	if err != nil {
+		logger.Error().Err(err).
+			Str("hashSet", IHKey).
+			Msg("unable to fetch info hash peers")
+		return
+	}
+	for chunk := range slices.Chunk(infoHashKeys, ps.pipelineSize) {
+		// list all (peer, timeout) pairs for the chunk of info hashes in one round trip,
+		// errors are checked for each command separately
+		cmds := make([]*redis.MapStringStringCmd, len(chunk))
+		_, _ = ps.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			for i, infoHashKey := range chunk {
+				cmds[i] = pipe.HGetAll(context.Background(), infoHashKey)
+			}
+			return nil
+		})
+		for i, infoHashKey := range chunk {
+			ps.gcSwarm(infoHashKey, cmds[i], cutoffNanos)
+		}
+	}
+}
+
+// gcSwarm removes peers of swarm, which were modified before cutoffNanos,
+// and removes swarm from info hash set if it is empty
+func (ps *store) gcSwarm(infoHashKey string, peersCmd *redis.MapStringStringCmd, cutoffNanos int64) {
+	var cntKey string
+	var seeder bool
+	if seeder = strings.HasPrefix(infoHashKey, IH4SeederKey) || strings.HasPrefix(infoHashKey,
+		IH6SeederKey); seeder {
+		cntKey = CountSeederKey
+	} else if strings.HasPrefix(infoHashKey, IH4LeecherKey) || strings.HasPrefix(infoHashKey, IH6LeecherKey) {
+		cntKey = CountLeecherKey
+	} else {
+		logger.Warn().Str("infoHashKey", infoHashKey).Msg("unexpected record found in info hash set")
+		return
+	}
+	peerList, err := peersCmd.Result()
+	err = NoResultErr(err)
 	if err == nil {
-		for _, infoHashKey := range infoHashKeys {
-			var cntKey string
-			var seeder bool
-			if seeder = strings.HasPrefix(infoHashKey, IH4SeederKey) || strings.HasPrefix(infoHashKey,
-				IH6SeederKey); seeder {
-				cntKey = CountSeederKey
-			} else if strings.HasPrefix(infoHashKey, IH4LeecherKey) || strings.HasPrefix(infoHashKey, IH6LeecherKey) {
-				cntKey = CountLeecherKey
+		peersToRemove := make([]string, 0)
+		for peerID, timeStamp := range peerList {
+			if mtime, err := strconv.ParseInt(timeStamp, 10, 64); err == nil {
+				if mtime <= cutoffNanos {
+					logger.Trace().Str("peerID", peerID).Msg("adding peer to remove list")
+					peersToRemove = append(peersToRemove, peerID)
+				}
 			} else {
-				logger.Warn().Str("infoHashKey", infoHashKey).Msg("unexpected record found in info hash set")
-				continue
+				logger.Error().Err(err).
+					Str("infoHashKey", infoHashKey).
+					Str("peerID", peerID).
+					Str("timestamp", timeStamp).
+					Msg("unable to decode peer timestamp")
 			}
-			// list all (peer, timeout) pairs for the ih
-			peerList, err := ps.HGetAll(context.Background(), infoHashKey).Result()
+		}
+		if len(peersToRemove) > 0 {
+			removedPeerCount, err := ps.HDel(context.Background(), infoHashKey, peersToRemove...).Result()
 			err = NoResultErr(err)
-			if err == nil {
-				peersToRemove := make([]string, 0)
-				for peerID, timeStamp := range peerList {
-					if mtime, err := strconv.ParseInt(timeStamp, 10, 64); err == nil {
-						if mtime <= cutoffNanos {
-							logger.Trace().Str("peerID", peerID).Msg("adding peer to remove list")
-							peersToRemove = append(peersToRemove, peerID)
-						}
-					} else {
-						logger.Error().Err(err).
-							Str("infoHashKey", infoHashKey).
-							Str("peerID", peerID).
-							Str("timestamp", timeStamp).
-							Msg("unable to decode peer timestamp")
-					}
-				}
-				if len(peersToRemove) > 0 {
-					removedPeerCount, err := ps.HDel(context.Background(), infoHashKey, peersToRemove...).Result()
-					err = NoResultErr(err)
-					if err != nil {
-						if strings.Contains(err.Error(), argNumErrorMsg) {
-							logger.Warn().Msg("This Redis version/implementation does not support variadic arguments for HDEL")
-							for _, k := range peersToRemove {
-								count, err := ps.HDel(context.Background(), infoHashKey, k).Result()
-								err = NoResultErr(err)
-								if err != nil {
-									logger.Error().Err(err).
-										Str("infoHashKey", infoHashKey).
-										Str("peerID", k).
-										Msg("unable to delete peer")
-								} else {
-									removedPeerCount += count
-								}
-							}
-						} else {
-							logger.Error().Err(err).
-								Str("infoHashKey", infoHashKey).
-								Strs("peerIDs", peersToRemove).
-								Msg("unable to delete peers")
-						}
-					}
-					if removedPeerCount > 0 { // DECR seeder/leecher counter
-						if err = ps.DecrBy(context.Background(), cntKey, removedPeerCount).Err(); err != nil {
+			if err != nil {
+				if strings.Contains(err.Error(), argNumErrorMsg) {
+					logger.Warn().Msg("This Redis version/implementation does not support variadic arguments for HDEL")
+					for _, k := range peersToRemove {
+						count, err := ps.HDel(context.Background(), infoHashKey, k).Result()
+						err = NoResultErr(err)
+						if err != nil {
 							logger.Error().Err(err).
 								Str("infoHashKey", infoHashKey).
-								Str("countKey", cntKey).
-								Msg("unable to decrement seeder/leecher peer count")
+								Str("peerID", k).
+								Msg("unable to delete peer")
+						} else {
+							removedPeerCount += count
 						}
 					}
+				} else {
+					logger.Error().Err(err).
+						Str("infoHashKey", infoHashKey).
+						Strs("peerIDs", peersToRemove).
+						Msg("unable to delete peers")
 				}
-
-				err = NoResultErr(ps.Watch(context.Background(), func(_ *redis.Tx) (err error) {
-					var infoHashCount uint64
-					infoHashCount, err = ps.HLen(context.Background(), infoHashKey).Uint64()
-					err = NoResultErr(err)
-					if err == nil && infoHashCount == 0 {
-						// Empty hashes are not shown among existing keys,
-						// in other words, it's removed automatically after `HDEL` the last field.
-						err = NoResultErr(ps.SRem(context.Background(), IHKey, infoHashKey).Err())
-					}
-					return err
-				}, infoHashKey))
-				if err != nil {
+			}
+			if removedPeerCount > 0 { // DECR seeder/leecher counter
+				if err = ps.DecrBy(context.Background(), cntKey, removedPeerCount).Err(); err != nil {
 					logger.Error().Err(err).
 						Str("infoHashKey", infoHashKey).
-						Msg("unable to clean info hash records")
+						Str("countKey", cntKey).
+						Msg("unable to decrement seeder/leecher peer count")
 				}
-			} else {
-				logger.Error().Err(err).
-					Str("infoHashKey", infoHashKey).
-					Msg("unable to fetch info hash peers")
 			}
 		}
+
+		err = NoResultErr(ps.Watch(context.Background(), func(_ *redis.Tx) (err error) {
+			var infoHashCount uint64
+			infoHashCount, err = ps.HLen(context.Background(), infoHashKey).Uint64()
+			err = NoResultErr(err)
+			if err == nil && infoHashCount == 0 {
+				// Empty hashes are not shown among existing keys,
+				// in other words, it's removed automatically after `HDEL` the last field.
+				err = NoResultErr(ps.SRem(context.Background(), IHKey, infoHashKey).Err())
+			}
+			return err
+		}, infoHashKey))
+		if err != nil {
+			logger.Error().Err(err).
+				Str("infoHashKey", infoHashKey).
+				Msg("unable to clean info hash records")
+		}
 	} else {
 		logger.Error().Err(err).
-			Str("hashSet", IHKey).
+			Str("infoHashKey", infoHashKey).
 			Msg("unable to fetch info hash peers")
 	}
 }
 
+// Dump - storage.Dumper implementation
+func (ps *store) Dump(ctx context.Context, fn func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error) error {
+	infoHashKeys, err := ps.SMembers(ctx, IHKey).Result()
+	if err = NoResultErr(err); err != nil {
+		return err
+	}
+	for chunk := range slices.Chunk(infoHashKeys, ps.pipelineSize) {
+		cmds := make([]*redis.StringSliceCmd, len(chunk))
+		_, _ = ps.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, infoHashKey := range chunk {
+				cmds[i] = pipe.HKeys(ctx, infoHashKey)
+			}
+			return nil
+		})
+		for i, infoHashKey := range chunk {
+			if err = dumpSwarm(infoHashKey, cmds[i], fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dumpSwarm(infoHashKey string, peersCmd *redis.StringSliceCmd, fn func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error) error {
+	var seeder bool
+	var infoHash string
+	switch {
+	case strings.HasPrefix(infoHashKey, IH4SeederKey), strings.HasPrefix(infoHashKey, IH6SeederKey):
+		seeder, infoHash = true, infoHashKey[len(IH4SeederKey):]
+	case strings.HasPrefix(infoHashKey, IH4LeecherKey), strings.HasPrefix(infoHashKey, IH6LeecherKey):
+		infoHash = infoHashKey[len(IH4LeecherKey):]
+	default:
+		logger.Warn().Str("infoHashKey", infoHashKey).Msg("unexpected record found in info hash set")
+		return nil
+	}
+	ih, err := bittorrent.NewInfoHash(str2bytes.StringToBytes(infoHash))
+	if err != nil {
+		logger.Warn().Err(err).Str("infoHashKey", infoHashKey).Msg("unable to decode info hash")
+		return nil
+	}
+	peerIDs, err := peersCmd.Result()
+	if err = NoResultErr(err); err != nil {
+		return err
+	}
+	for _, peerID := range peerIDs {
+		p, err := UnpackPeer(peerID)
+		if err != nil {
+			logger.Error().Err(err).Str("peerID", peerID).Msg("unable to decode peer")
+			continue
+		}
+		if err = fn(ih, p, seeder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ps *store) Close() (err error) {
 	ps.onceCloser.Do(func() {
 		close(ps.closed)
 		ps.wg.Wait()
 		logger.Info().Msg("redis exiting. mochi does not clear data in redis when exiting. mochi keys have prefix " + PrefixKey)
+		if ps.cache != nil {
+			if err = ps.cache.Close(); err != nil {
+				logger.Warn().Err(err).Msg("unable to close swarm cache")
+			}
+		}
 		err = ps.UniversalClient.Close()
 	})
 	return
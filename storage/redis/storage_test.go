@@ -1,10 +1,13 @@
 package redis
 
 import (
+	"context"
 	"fmt"
+	"net/netip"
 	"testing"
 	"time"
 
+	"github.com/sot-tech/mochi/bittorrent"
 	s "github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
@@ -26,6 +29,92 @@ func createNew() s.PeerStorage {
 	return ps
 }
 
-func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
+func TestStorage(t *testing.T) { test.RunConformanceTests(t, createNew) }
 
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
+
+func TestMinUpdateInterval(t *testing.T) {
+	c := cfg
+	c.MinUpdateInterval = time.Hour
+	ps, err := NewStore(c)
+	if err != nil {
+		t.Skip("redis is not available: ", err)
+	}
+	defer ps.Close()
+	ctx, ih := context.Background(), bittorrent.InfoHash("00000000000000000001")
+	p := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	key, peerID := InfoHashKey(ih.RawString(), true, false), PackPeer(p)
+
+	if err = ps.PutSeeder(ctx, ih, p); err != nil {
+		t.Fatal(err)
+	}
+	defer ps.DeleteSeeder(ctx, ih, p)
+	st := ps.(*store)
+	if err = st.HSet(ctx, key, peerID, st.getClock(ctx, false)-1).Err(); err != nil {
+		t.Fatal(err)
+	}
+	mtime, _ := st.HGet(ctx, key, peerID).Int64()
+	if err = ps.PutSeeder(ctx, ih, p); err != nil {
+		t.Fatal(err)
+	}
+	if coalesced, _ := st.HGet(ctx, key, peerID).Int64(); coalesced != mtime {
+		t.Fatalf("expected peer not updated, mtime %d, got %d", mtime, coalesced)
+	}
+}
+
+func TestScriptCounters(t *testing.T) {
+	ps, err := NewStore(cfg)
+	if err != nil {
+		t.Skip("redis is not available: ", err)
+	}
+	defer ps.Close()
+	ctx, ih := context.Background(), bittorrent.InfoHash("00000000000000000002")
+	p := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("1.2.3.4:6881")}
+	st := ps.(*store)
+	count := func() int64 {
+		n, _ := st.Get(ctx, CountSeederKey).Int64()
+		return n
+	}
+
+	before := count()
+	for i := 0; i < 3; i++ {
+		if err = ps.PutSeeder(ctx, ih, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(); n != before+1 {
+		t.Fatalf("expected %d seeders counted, got %d", before+1, n)
+	}
+	if err = ps.DeleteSeeder(ctx, ih, p); err != nil {
+		t.Fatal(err)
+	}
+	if err = ps.DeleteSeeder(ctx, ih, p); err != s.ErrResourceDoesNotExist {
+		t.Fatalf("expected %v, got %v", s.ErrResourceDoesNotExist, err)
+	}
+	if n := count(); n != before {
+		t.Fatalf("expected %d seeders counted, got %d", before, n)
+	}
+}
+
+func TestValidateCompatibility(t *testing.T) {
+	c := cfg
+	c.Compatibility, c.CacheSize = "Dragonfly", 10
+	v, err := c.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Compatibility != CompatibilityDragonfly || v.CacheSize != 0 {
+		t.Fatalf("expected dragonfly mode without cache, got %s, %d", v.Compatibility, v.CacheSize)
+	}
+	if v.PipelineSize != defaultPipelineSize {
+		t.Fatalf("expected default pipeline size, got %d", v.PipelineSize)
+	}
+
+	c.Compatibility, c.CacheSize, c.PipelineSize = "unknown", 10, 8
+	if v, err = c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if v.Compatibility != CompatibilityRedis || v.CacheSize != 10 || v.PipelineSize != 8 {
+		t.Fatalf("expected redis mode with cache, got %s, %d, %d", v.Compatibility, v.CacheSize, v.PipelineSize)
+	}
+}
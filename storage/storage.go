@@ -4,8 +4,10 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 	"time"
 
@@ -38,6 +40,8 @@ type Config struct {
 	PeerLifetime time.Duration `cfg:"peer_lifetime"`
 	// PrometheusReportingInterval period of statistics data polling
 	PrometheusReportingInterval time.Duration `cfg:"prometheus_reporting_interval"`
+	// Breaker configures circuit breaker around storage
+	Breaker BreakerConfig `cfg:"breaker"`
 }
 
 func (c Config) sanitizeGCConfig() (gcInterval, peerTTL time.Duration) {
@@ -96,7 +100,11 @@ type Driver interface {
 // ErrResourceDoesNotExist is the error returned by all delete methods and the
 // AnnouncePeers method of the PeerStorage interface if the requested resource
 // does not exist.
-var ErrResourceDoesNotExist = bittorrent.ClientError("resource does not exist")
+var ErrResourceDoesNotExist = bittorrent.NewClientError(bittorrent.ReasonNotFound, "resource does not exist")
+
+// ErrTooManyPeersPerIP is returned by put methods of the PeerStorage interface
+// if storage limits peers with the same IP address in swarm and limit is reached.
+var ErrTooManyPeersPerIP = bittorrent.NewRetryableError(bittorrent.ReasonLimitExceeded, "too many peers from your address for this torrent")
 
 // DataStorage is the interface, used for implementing store for arbitrary data
 type DataStorage interface {
@@ -181,9 +189,22 @@ type PeerStorage interface {
 	// - if seeder is false, should ideally return more seeders than
 	//   leechers
 	//
+	// If numWant is not positive, nil Peers and no error are returned
+	// without accessing the Swarm.
+	//
 	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
 	AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error)
 
+	// AnnouncePeersFunc selects Peers the same way as AnnouncePeers, but
+	// instead of collecting them, calls fn for each selected Peer, so
+	// that caller may serialize Peers without intermediate slice.
+	// Selection stops when numWant Peers passed or fn returned false.
+	// fn may be called while storage holds internal locks, so it must
+	// not interact with storage.
+	//
+	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
+	AnnouncePeersFunc(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool, fn func(bittorrent.Peer) bool) error
+
 	// ScrapeSwarm returns information required to answer a Scrape request
 	// about a Swarm identified by the given InfoHash.
 	// The AddressFamily indicates whether or not the IPv6 swarm should be
@@ -216,6 +237,107 @@ type StatisticsCollector interface {
 	ScheduleStatisticsCollection(reportInterval time.Duration)
 }
 
+// Dumper marks that this storage is able to iterate over
+// all stored peers (i.e. to export tracker state)
+type Dumper interface {
+	// Dump calls fn for every stored peer of every swarm.
+	// Iteration stops if fn returns error, which is returned from Dump.
+	Dump(ctx context.Context, fn func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error) error
+}
+
+// Counter marks that this storage is able to return the number of peers
+// in swarm cheaper than ScrapeSwarm (i.e. without reading downloads count
+// or with single request), it is used to fill announce responses.
+type Counter interface {
+	// Counts returns the number of leechers and seeders in the Swarm
+	// identified by the provided InfoHash, zeros if Swarm does not exist.
+	Counts(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, err error)
+}
+
+// Counts returns the number of leechers and seeders in the Swarm with
+// Counter implementation of ps or with ScrapeSwarm if ps does not implement it.
+func Counts(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, err error) {
+	if c, ok := ps.(Counter); ok {
+		return c.Counts(ctx, ih)
+	}
+	leechers, seeders, _, err = ps.ScrapeSwarm(ctx, ih)
+	return
+}
+
+// Admitter marks that this storage limits peers of swarm (i.e. by IP address),
+// so the limit is checked before announce response is generated
+// and not only when peer is stored after it.
+type Admitter interface {
+	// Admit returns error (i.e. ErrTooManyPeersPerIP) if new peer
+	// would be rejected by put methods.
+	Admit(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error
+}
+
+// Admit checks peer with Admitter implementation of ps,
+// peer is admitted if ps does not implement it.
+func Admit(ctx context.Context, ps PeerStorage, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if a, ok := ps.(Admitter); ok {
+		return a.Admit(ctx, ih, peer)
+	}
+	return nil
+}
+
+// CompareAndSwapper marks that this data storage is able to replace value
+// atomically, so concurrent modifications of the same key by several
+// tracker instances do not overwrite each other.
+type CompareAndSwapper interface {
+	// CompareAndSwap stores value of key in specified context if current
+	// value equals to old. Empty old means that key must not exist,
+	// empty value means that key must be deleted.
+	// swapped is false if current value differs.
+	CompareAndSwap(ctx context.Context, storeCtx, key string, old, value []byte) (swapped bool, err error)
+}
+
+// ErrCompareAndSwapNotSupported is returned by CompareAndSwap of wrapping
+// storages if wrapped storage does not implement CompareAndSwapper.
+var ErrCompareAndSwapNotSupported = errors.New("storage does not support compare-and-swap")
+
+// maxUpdateAttempts is the number of CompareAndSwap calls in Update
+const maxUpdateAttempts = 100
+
+var errUpdateConflict = errors.New("value is modified concurrently")
+
+// Update replaces value of key in specified context with the result of fn
+// called with current value. If ds implements CompareAndSwapper, fn is called
+// again with new value until it is stored without concurrent modification,
+// so fn must not have side effects. Otherwise value is stored with Put.
+// If fn returns empty value, key is deleted.
+func Update(ctx context.Context, ds DataStorage, storeCtx, key string, fn func(old []byte) ([]byte, error)) error {
+	cs, _ := ds.(CompareAndSwapper)
+	for range maxUpdateAttempts {
+		old, err := ds.Load(ctx, storeCtx, key)
+		if err != nil {
+			return err
+		}
+		var value []byte
+		if value, err = fn(old); err != nil {
+			return err
+		}
+		if cs != nil {
+			var swapped bool
+			if swapped, err = cs.CompareAndSwap(ctx, storeCtx, key, old, value); err == nil {
+				if swapped {
+					return nil
+				}
+				continue
+			}
+			if !errors.Is(err, ErrCompareAndSwapNotSupported) {
+				return err
+			}
+		}
+		if len(value) == 0 {
+			return ds.Delete(ctx, storeCtx, key)
+		}
+		return ds.Put(ctx, storeCtx, Entry{Key: key, Value: value})
+	}
+	return fmt.Errorf("%s: %w", key, errUpdateConflict)
+}
+
 // RegisterDriver makes a Driver available by the provided name.
 //
 // If called twice with the same name, the name is blank, or if the provided
@@ -238,6 +360,26 @@ func RegisterDriver(name string, d Driver) {
 	drivers[name] = d
 }
 
+// Registered returns true if Driver with provided name is registered
+func Registered(name string) bool {
+	driversMU.RLock()
+	defer driversMU.RUnlock()
+	_, ok := drivers[name]
+	return ok
+}
+
+// Names returns sorted names of all registered Driver-s
+func Names() []string {
+	driversMU.RLock()
+	defer driversMU.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for n := range drivers {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names
+}
+
 // NewDataStorage attempts to initialize a new DataStorage instance from
 // the list of registered drivers.
 func NewDataStorage(cfg conf.NamedMapConfig) (DataStorage, error) {
@@ -306,6 +448,11 @@ func NewPeerStorage(cfg conf.NamedMapConfig) (ps PeerStorage, err error) {
 			Msg("storage does not support statistics collection")
 	}
 
+	if c.Breaker.Enabled() {
+		logger.Info().Str("name", cfg.Name).Msg("enabling storage circuit breaker")
+		ps = WithBreaker(ps, cfg.Name, c.Breaker.Validate())
+	}
+
 	logger.Info().Str("name", cfg.Name).Msg("storage started")
 
 	return
@@ -0,0 +1,312 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Builder creates new empty PeerStorage. It is called for every
+// conformance test, storage is closed by test.
+type Builder func() storage.PeerStorage
+
+const (
+	concurrentWorkers = 8
+	concurrentPeers   = 50
+)
+
+func peerOf(a, b, c byte, v6 bool) bittorrent.Peer {
+	var addr netip.Addr
+	if v6 {
+		addr = netip.AddrFrom16([16]byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, a, b, c})
+	} else {
+		addr = netip.AddrFrom4([4]byte{10, a, b, c})
+	}
+	return bittorrent.Peer{ID: bittorrent.PeerID{a, b, c}, AddrPort: netip.AddrPortFrom(addr, 6881)}
+}
+
+func requireCounts(t *testing.T, ps storage.PeerStorage, ih bittorrent.InfoHash, leechers, seeders uint32) {
+	l, s, _, err := ps.ScrapeSwarm(context.TODO(), ih)
+	require.Nil(t, err)
+	require.Equal(t, leechers, l, "scrape leechers")
+	require.Equal(t, seeders, s, "scrape seeders")
+	l, s, err = storage.Counts(context.TODO(), ps, ih)
+	require.Nil(t, err)
+	require.Equal(t, leechers, l, "counts leechers")
+	require.Equal(t, seeders, s, "counts seeders")
+}
+
+func announce(t *testing.T, ps storage.PeerStorage, ih bittorrent.InfoHash, v6 bool) []bittorrent.Peer {
+	peers, err := ps.AnnouncePeers(context.TODO(), ih, false, 1000, v6)
+	if errors.Is(err, storage.ErrResourceDoesNotExist) {
+		err = nil
+	}
+	require.Nil(t, err)
+	return peers
+}
+
+// AddressFamilies checks that announces return peers only of requested
+// address family and scrapes count peers of both families
+func AddressFamilies(t *testing.T, ps storage.PeerStorage) {
+	ih := randIH(false)
+	v4, v6 := peerOf(1, 1, 1, false), peerOf(1, 1, 1, true)
+	require.Nil(t, ps.PutSeeder(context.TODO(), ih, v4))
+	require.Nil(t, ps.PutLeecher(context.TODO(), ih, v6))
+
+	require.Equal(t, []bittorrent.Peer{v4}, announce(t, ps, ih, false))
+	require.Equal(t, []bittorrent.Peer{v6}, announce(t, ps, ih, true))
+	requireCounts(t, ps, ih, 1, 1)
+
+	require.Nil(t, ps.DeleteSeeder(context.TODO(), ih, v4))
+	require.Empty(t, announce(t, ps, ih, false))
+	require.Equal(t, []bittorrent.Peer{v6}, announce(t, ps, ih, true))
+	require.Nil(t, ps.DeleteLeecher(context.TODO(), ih, v6))
+	requireCounts(t, ps, ih, 0, 0)
+}
+
+// ScrapeConsistency checks that scrape and counts reflect every
+// modification of swarm
+func ScrapeConsistency(t *testing.T, ps storage.PeerStorage) {
+	ih := randIH(false)
+	var leechers []bittorrent.Peer
+	for i := range byte(4) {
+		p := peerOf(2, i, 1, i%2 == 1)
+		leechers = append(leechers, p)
+		require.Nil(t, ps.PutLeecher(context.TODO(), ih, p))
+	}
+	requireCounts(t, ps, ih, 4, 0)
+
+	// repeated announce does not change counters
+	require.Nil(t, ps.PutLeecher(context.TODO(), ih, leechers[0]))
+	requireCounts(t, ps, ih, 4, 0)
+
+	require.Nil(t, ps.GraduateLeecher(context.TODO(), ih, leechers[0]))
+	require.Nil(t, ps.GraduateLeecher(context.TODO(), ih, leechers[1]))
+	requireCounts(t, ps, ih, 2, 2)
+
+	// graduation of unknown peer adds seeder
+	require.Nil(t, ps.GraduateLeecher(context.TODO(), ih, peerOf(2, 9, 1, false)))
+	requireCounts(t, ps, ih, 2, 3)
+
+	require.Nil(t, ps.DeleteSeeder(context.TODO(), ih, leechers[0]))
+	require.Nil(t, ps.DeleteLeecher(context.TODO(), ih, leechers[2]))
+	requireCounts(t, ps, ih, 1, 2)
+
+	// deletion of missing peer does not change counters
+	err := ps.DeleteLeecher(context.TODO(), ih, leechers[0])
+	if errors.Is(err, storage.ErrResourceDoesNotExist) {
+		err = nil
+	}
+	require.Nil(t, err)
+	requireCounts(t, ps, ih, 1, 2)
+
+	require.Nil(t, ps.DeleteSeeder(context.TODO(), ih, leechers[1]))
+	require.Nil(t, ps.DeleteSeeder(context.TODO(), ih, peerOf(2, 9, 1, false)))
+	require.Nil(t, ps.DeleteLeecher(context.TODO(), ih, leechers[3]))
+	requireCounts(t, ps, ih, 0, 0)
+}
+
+// Concurrency checks that concurrent modifications of the same swarm
+// are not lost. Should be run with race detector.
+func Concurrency(t *testing.T, ps storage.PeerStorage) {
+	ih := randIH(false)
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWorkers)
+	run := func(fn func(w, i byte) error) {
+		for w := range byte(concurrentWorkers) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range byte(concurrentPeers) {
+					if err := fn(w, i); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		select {
+		case err := <-errs:
+			require.Nil(t, err)
+		default:
+		}
+	}
+
+	run(func(w, i byte) error {
+		p := peerOf(3, w, i, i%3 == 0)
+		if err := ps.PutLeecher(context.TODO(), ih, p); err != nil {
+			return err
+		}
+		if i%2 == 0 {
+			if err := ps.GraduateLeecher(context.TODO(), ih, p); err != nil {
+				return err
+			}
+		}
+		_, _, _, err := ps.ScrapeSwarm(context.TODO(), ih)
+		if err == nil {
+			_, err = ps.AnnouncePeers(context.TODO(), ih, i%2 == 0, 10, p.Addr().Is6())
+		}
+		return err
+	})
+	half := uint32(concurrentWorkers * concurrentPeers / 2)
+	requireCounts(t, ps, ih, half, half)
+	require.Len(t, append(announce(t, ps, ih, false), announce(t, ps, ih, true)...), int(2*half))
+
+	run(func(w, i byte) error {
+		p := peerOf(3, w, i, i%3 == 0)
+		if i%2 == 0 {
+			return ps.DeleteSeeder(context.TODO(), ih, p)
+		}
+		return ps.DeleteLeecher(context.TODO(), ih, p)
+	})
+	requireCounts(t, ps, ih, 0, 0)
+}
+
+// GarbageCollection checks that peers, which did not announce
+// during peer lifetime, are removed by scheduled garbage collection
+func GarbageCollection(t *testing.T, ps storage.PeerStorage) {
+	gc, ok := ps.(storage.GarbageCollector)
+	if !ok {
+		t.Skip("storage does not implement storage.GarbageCollector")
+	}
+	ih := randIH(false)
+	v4, v6 := peerOf(4, 1, 1, false), peerOf(4, 1, 1, true)
+	require.Nil(t, ps.PutSeeder(context.TODO(), ih, v4))
+	require.Nil(t, ps.PutLeecher(context.TODO(), ih, v6))
+	requireCounts(t, ps, ih, 1, 1)
+
+	gc.ScheduleGC(100*time.Millisecond, 500*time.Millisecond)
+	require.Eventually(t, func() bool {
+		l, s, _, err := ps.ScrapeSwarm(context.TODO(), ih)
+		return err == nil && l == 0 && s == 0
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Empty(t, announce(t, ps, ih, false))
+	require.Empty(t, announce(t, ps, ih, true))
+}
+
+// CompareAndSwap checks that data is replaced only if it is not
+// modified and concurrent storage.Update calls are not lost
+func CompareAndSwap(t *testing.T, ps storage.PeerStorage) {
+	cs, ok := ps.(storage.CompareAndSwapper)
+	if !ok {
+		t.Skip("storage does not implement storage.CompareAndSwapper")
+	}
+	const storeCtx, key = "test_cas", "key"
+	// value may be left by previous run in persistent storage
+	require.Nil(t, ps.Delete(context.TODO(), storeCtx, key))
+	swapped, err := cs.CompareAndSwap(context.TODO(), storeCtx, key, nil, []byte("a"))
+	require.Nil(t, err)
+	require.True(t, swapped)
+	swapped, err = cs.CompareAndSwap(context.TODO(), storeCtx, key, nil, []byte("b"))
+	require.Nil(t, err)
+	require.False(t, swapped)
+	swapped, err = cs.CompareAndSwap(context.TODO(), storeCtx, key, []byte("a"), nil)
+	require.Nil(t, err)
+	require.True(t, swapped)
+	v, err := ps.Load(context.TODO(), storeCtx, key)
+	require.Nil(t, err)
+	require.Empty(t, v)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWorkers)
+	for range concurrentWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range concurrentPeers / 10 {
+				if err := storage.Update(context.TODO(), ps, storeCtx, key, func(old []byte) ([]byte, error) {
+					n, _ := strconv.Atoi(string(old))
+					return []byte(strconv.Itoa(n + 1)), nil
+				}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case err = <-errs:
+		require.Nil(t, err)
+	default:
+	}
+	v, err = ps.Load(context.TODO(), storeCtx, key)
+	require.Nil(t, err)
+	require.Equal(t, strconv.Itoa(concurrentWorkers*concurrentPeers/10), string(v))
+}
+
+// requireFails checks that fn returns error or panics in reasonable time
+func requireFails(t *testing.T, name string, fn func() error) {
+	res := make(chan any, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				res <- r
+			}
+		}()
+		res <- fn()
+	}()
+	select {
+	case r := <-res:
+		require.NotNil(t, r, "%s on closed storage succeeded", name)
+	case <-time.After(10 * time.Second):
+		require.Fail(t, name+" on closed storage hung")
+	}
+}
+
+// ClosedStore checks that operations on closed storage fail (return error
+// or panic) instead of silently succeeding or hanging, and
+// that storage may be closed more than once
+func ClosedStore(t *testing.T, ps storage.PeerStorage) {
+	ih, p := randIH(false), peerOf(5, 1, 1, false)
+	require.Nil(t, ps.Ping(context.TODO()))
+	require.Nil(t, ps.Close())
+
+	requireFails(t, "PutSeeder", func() error { return ps.PutSeeder(context.TODO(), ih, p) })
+	requireFails(t, "AnnouncePeers", func() error {
+		_, err := ps.AnnouncePeers(context.TODO(), ih, false, 10, false)
+		return err
+	})
+	requireFails(t, "ScrapeSwarm", func() error {
+		_, _, _, err := ps.ScrapeSwarm(context.TODO(), ih)
+		return err
+	})
+
+	require.Nil(t, ps.Close())
+}
+
+// RunConformanceTests checks that PeerStorage created by builder
+// conforms to interface (RunTests) and to behavior expected by tracker:
+// isolation of address families, consistency of scrapes, concurrent
+// modifications, garbage collection, compare-and-swap of data and closing.
+// Every test uses new storage built by builder.
+func RunConformanceTests(t *testing.T, builder Builder) {
+	t.Run("Interface", func(t *testing.T) { RunTests(t, builder()) })
+	for _, tt := range []struct {
+		name string
+		fn   func(*testing.T, storage.PeerStorage)
+	}{
+		{"AddressFamilies", AddressFamilies},
+		{"ScrapeConsistency", ScrapeConsistency},
+		{"Concurrency", Concurrency},
+		{"GarbageCollection", GarbageCollection},
+		{"CompareAndSwap", CompareAndSwap},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := builder()
+			defer func() { require.Nil(t, ps.Close()) }()
+			tt.fn(t, ps)
+		})
+	}
+	t.Run("ClosedStore", func(t *testing.T) { ClosedStore(t, builder()) })
+}
@@ -444,6 +444,18 @@ func (bh *benchHolder) AnnounceSeeder1kInfoHash(b *testing.B) {
 	})
 }
 
+// AnnounceLeecherFunc behaves like AnnounceLeecher, but peers are
+// selected with AnnouncePeersFunc without collecting them.
+//
+// AnnounceLeecherFunc can run in parallel.
+func (bh *benchHolder) AnnounceLeecherFunc(b *testing.B) {
+	bh.runBenchmark(b, true, putPeers, func(_ int, ps storage.PeerStorage, bd *benchData) error {
+		return ps.AnnouncePeersFunc(context.TODO(), bd.infoHashes[0], false, 50, bd.peers[0].Addr().Is6(), func(bittorrent.Peer) bool {
+			return true
+		})
+	})
+}
+
 // ScrapeSwarm benchmarks the ScrapeSwarm method of a storage.PeerStorage.
 // The swarm scraped has 500 seeders and 500 leechers.
 //
@@ -493,6 +505,10 @@ func RunBenchmarks(b *testing.B, newStorage benchStorageConstructor) {
 	b.Run("BenchmarkAnnounceLeecher1kInfoHash", bh.AnnounceLeecher1kInfoHash)
 	b.Run("BenchmarkAnnounceSeeder", bh.AnnounceSeeder)
 	b.Run("BenchmarkAnnounceSeeder1kInfoHash", bh.AnnounceSeeder1kInfoHash)
+	b.Run("BenchmarkAnnounceLeecherFunc", bh.AnnounceLeecherFunc)
 	b.Run("BenchmarkScrapeSwarm", bh.ScrapeSwarm)
 	b.Run("BenchmarkScrapeSwarm1kInfoHash", bh.ScrapeSwarm1kInfoHash)
+	b.Run("BenchmarkMixHotSwarms", bh.MixHotSwarms)
+	b.Run("BenchmarkMixLongTail", bh.MixLongTail)
+	b.Run("BenchmarkMixLongTailGC", bh.MixLongTailGC)
 }
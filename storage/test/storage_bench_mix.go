@@ -0,0 +1,244 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+const (
+	// fixtureSeed makes fixture the same in every run,
+	// so results of different revisions are comparable
+	fixtureSeed     = 0x6d6f636869
+	fixtureSwarms   = 10000
+	fixturePool     = 20000
+	fixtureMaxSwarm = 2000
+	// every fixtureSeederEach peer in swarm is seeder
+	fixtureSeederEach = 3
+	// fixtureV6Each peer in pool has IPv6 address
+	fixtureV6Each = 5
+
+	mixNumWant = 50
+	// hot swarms receive mixHotPercent of requests
+	mixHotSwarms  = 10
+	mixHotPercent = 90
+	// exponent of long tail Zipf distribution
+	mixZipfS = 1.1
+
+	mixGCInterval   = 50 * time.Millisecond
+	mixPeerLifetime = 100 * time.Millisecond
+)
+
+// fixture is the deterministic set of swarms with sizes decreasing
+// as 1/rank (the largest has fixtureMaxSwarm peers, the smallest has one).
+// Peers of swarm are the window of size swarmSize[i] in peers pool.
+type fixture struct {
+	infoHashes []bittorrent.InfoHash
+	swarmSize  []int
+	offsets    []int
+	peers      []bittorrent.Peer
+}
+
+func newFixture(seed uint64, swarms, pool, maxSwarm int) *fixture {
+	r := rand.New(rand.NewPCG(seed, seed))
+	f := &fixture{
+		infoHashes: make([]bittorrent.InfoHash, swarms),
+		swarmSize:  make([]int, swarms),
+		offsets:    make([]int, swarms),
+		peers:      make([]bittorrent.Peer, pool),
+	}
+	b := make([]byte, bittorrent.InfoHashV1Len)
+	for i := range f.infoHashes {
+		for j := range b {
+			b[j] = byte(r.Uint32())
+		}
+		f.infoHashes[i], _ = bittorrent.NewInfoHash(b)
+		f.swarmSize[i] = int(math.Max(1, math.Ceil(float64(maxSwarm)/float64(i+1))))
+		f.offsets[i] = r.IntN(pool)
+	}
+	for i := range f.peers {
+		var addr netip.Addr
+		if i%fixtureV6Each == 0 {
+			var ip [16]byte
+			for j := range ip {
+				ip[j] = byte(r.Uint32())
+			}
+			addr = netip.AddrFrom16(ip)
+		} else {
+			addr = netip.AddrFrom4([4]byte{byte(r.Uint32()), byte(r.Uint32()), byte(r.Uint32()), byte(r.Uint32())})
+		}
+		var id bittorrent.PeerID
+		for j := range id {
+			id[j] = byte(r.Uint32())
+		}
+		// nolint:gosec
+		f.peers[i] = bittorrent.Peer{ID: id, AddrPort: netip.AddrPortFrom(addr, uint16(r.IntN(math.MaxUint16-1024)+1024))}
+	}
+	return f
+}
+
+// peer returns n-th peer of swarm, peers with n >= swarmSize
+// are not preloaded and used as newcomers
+func (f *fixture) peer(swarm, n int) bittorrent.Peer {
+	return f.peers[(f.offsets[swarm]+n)%len(f.peers)]
+}
+
+// load puts peers of all swarms into storage
+func (f *fixture) load(ps storage.PeerStorage) (err error) {
+	ctx := context.Background()
+	for i, ih := range f.infoHashes {
+		for n := 0; n < f.swarmSize[i] && err == nil; n++ {
+			if n%fixtureSeederEach == 0 {
+				err = ps.PutSeeder(ctx, ih, f.peer(i, n))
+			} else {
+				err = ps.PutLeecher(ctx, ih, f.peer(i, n))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return
+}
+
+// swarmPicker returns index of swarm for the next request
+type swarmPicker func(r *rand.Rand) int
+
+func hotSwarms(r *rand.Rand) int {
+	if r.IntN(100) < mixHotPercent {
+		return r.IntN(mixHotSwarms)
+	}
+	return r.IntN(fixtureSwarms)
+}
+
+func longTail() func(r *rand.Rand) swarmPicker {
+	return func(r *rand.Rand) swarmPicker {
+		z := rand.NewZipf(r, mixZipfS, 1, fixtureSwarms-1)
+		return func(*rand.Rand) int {
+			return int(z.Uint64())
+		}
+	}
+}
+
+// mixOp executes one request of announce mix:
+//   - 75% - periodic announce of known peer (put and announce),
+//   - 8% - announce of new leecher (put and announce),
+//   - 4% - completion of new leecher (graduate),
+//   - 5% - stop of new peer (delete),
+//   - 8% - scrape.
+func (f *fixture) mixOp(ctx context.Context, ps storage.PeerStorage, r *rand.Rand, swarm int) (err error) {
+	ih, size := f.infoHashes[swarm], f.swarmSize[swarm]
+	switch op := r.IntN(100); {
+	case op < 75:
+		n := r.IntN(size)
+		p, seeder := f.peer(swarm, n), n%fixtureSeederEach == 0
+		if seeder {
+			err = ps.PutSeeder(ctx, ih, p)
+		} else {
+			err = ps.PutLeecher(ctx, ih, p)
+		}
+		if err == nil {
+			_, err = ps.AnnouncePeers(ctx, ih, seeder, mixNumWant, p.Addr().Is6())
+		}
+	case op < 83:
+		p := f.peer(swarm, size+r.IntN(size+1))
+		if err = ps.PutLeecher(ctx, ih, p); err == nil {
+			_, err = ps.AnnouncePeers(ctx, ih, false, mixNumWant, p.Addr().Is6())
+		}
+	case op < 87:
+		err = ps.GraduateLeecher(ctx, ih, f.peer(swarm, size+r.IntN(size+1)))
+	case op < 92:
+		p := f.peer(swarm, size+r.IntN(size+1))
+		if err = ps.DeleteLeecher(ctx, ih, p); errors.Is(err, storage.ErrResourceDoesNotExist) {
+			err = ps.DeleteSeeder(ctx, ih, p)
+		}
+	default:
+		_, _, _, err = ps.ScrapeSwarm(ctx, ih)
+	}
+	// newcomers may be already deleted or purged by GC
+	if errors.Is(err, storage.ErrResourceDoesNotExist) {
+		err = nil
+	}
+	return
+}
+
+// getFixture returns fixture generated once, because
+// generation takes noticeable time
+var getFixture = sync.OnceValue(func() *fixture {
+	return newFixture(fixtureSeed, fixtureSwarms, fixturePool, fixtureMaxSwarm)
+})
+
+// runMixBenchmark loads fixture into new storage and executes
+// mix of requests in parallel, swarms are chosen by newPicker.
+// If gc is set, storage GC (if supported) runs concurrently.
+func (bh *benchHolder) runMixBenchmark(b *testing.B, newPicker func(r *rand.Rand) swarmPicker, gc bool) {
+	f := getFixture()
+	ps := bh.st()
+	if err := f.load(ps); err != nil {
+		b.Fatal(err)
+	}
+	if gc {
+		gcs, ok := ps.(storage.GarbageCollector)
+		if !ok {
+			_ = ps.Close()
+			b.Skip("storage does not support GC")
+		}
+		gcs.ScheduleGC(mixGCInterval, mixPeerLifetime)
+	}
+	var seq atomic.Uint64
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := seq.Add(1)
+		r := rand.New(rand.NewPCG(fixtureSeed, n))
+		pick := newPicker(r)
+		for pb.Next() {
+			if err := f.mixOp(ctx, ps, r, pick(r)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	if err := ps.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// MixHotSwarms benchmarks mix of announces and scrapes, where 90% of
+// requests are addressed to 10 largest swarms (i.e. new popular release)
+// and the rest are evenly distributed among 10000 swarms.
+//
+// MixHotSwarms runs in parallel.
+func (bh *benchHolder) MixHotSwarms(b *testing.B) {
+	bh.runMixBenchmark(b, func(*rand.Rand) swarmPicker { return hotSwarms }, false)
+}
+
+// MixLongTail benchmarks mix of announces and scrapes, where swarms
+// are chosen with Zipf distribution (few large swarms and a lot of
+// small ones), which is typical for public tracker.
+//
+// MixLongTail runs in parallel.
+func (bh *benchHolder) MixLongTail(b *testing.B) {
+	bh.runMixBenchmark(b, longTail(), false)
+}
+
+// MixLongTailGC behaves like MixLongTail with storage garbage collection
+// running every 50ms concurrently, so most of rarely announced peers
+// are purged during benchmark.
+//
+// MixLongTailGC runs in parallel, skipped if storage does not support GC.
+func (bh *benchHolder) MixLongTailGC(b *testing.B) {
+	bh.runMixBenchmark(b, longTail(), true)
+}
@@ -1,5 +1,8 @@
 // Package test contains storage tests.
 // Not used in production.
+//
+// Third-party storage drivers may use RunConformanceTests
+// to check their implementations.
 package test
 
 import (
@@ -86,6 +89,10 @@ func (th *testHolder) ScrapeSwarm(t *testing.T) {
 		require.Equal(t, uint32(0), s)
 		require.Equal(t, uint32(0), l)
 		require.Equal(t, uint32(0), n)
+		l, s, err := storage.Counts(context.TODO(), th.st, c.ih)
+		require.Nil(t, err)
+		require.Zero(t, l)
+		require.Zero(t, s)
 	}
 }
 
@@ -107,6 +114,10 @@ func (th *testHolder) LeecherPutAnnounceDeleteAnnounce(t *testing.T) {
 		l, s, _, _ := th.st.ScrapeSwarm(context.TODO(), c.ih)
 		require.Equal(t, uint32(2), l)
 		require.Equal(t, uint32(0), s)
+		l, s, err = storage.Counts(context.TODO(), th.st, c.ih)
+		require.Nil(t, err)
+		require.Equal(t, uint32(2), l)
+		require.Equal(t, uint32(0), s)
 
 		err = th.st.DeleteLeecher(context.TODO(), c.ih, c.peer)
 		require.Nil(t, err)
@@ -199,6 +210,63 @@ func (th *testHolder) LeecherPutGraduateAnnounceDeleteAnnounce(t *testing.T) {
 	}
 }
 
+func (th *testHolder) SeederPutAnnounceFuncDelete(t *testing.T) {
+	for _, c := range testData {
+		isV6 := c.peer.Addr().Is6()
+		peer := v4Peer
+		if isV6 {
+			peer = v6Peer
+		}
+		err := th.st.PutSeeder(context.TODO(), c.ih, c.peer)
+		require.Nil(t, err)
+		err = th.st.PutLeecher(context.TODO(), c.ih, peer)
+		require.Nil(t, err)
+
+		var peers []bittorrent.Peer
+		err = th.st.AnnouncePeersFunc(context.TODO(), c.ih, false, 50, isV6, func(p bittorrent.Peer) bool {
+			peers = append(peers, p)
+			return true
+		})
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c.peer))
+		require.True(t, containsPeer(peers, peer))
+
+		// selection stops if fn returned false or numWant reached
+		var calls int
+		err = th.st.AnnouncePeersFunc(context.TODO(), c.ih, false, 50, isV6, func(bittorrent.Peer) bool {
+			calls++
+			return false
+		})
+		require.Nil(t, err)
+		require.Equal(t, 1, calls)
+
+		calls = 0
+		err = th.st.AnnouncePeersFunc(context.TODO(), c.ih, false, 1, isV6, func(bittorrent.Peer) bool {
+			calls++
+			return true
+		})
+		require.Nil(t, err)
+		require.Equal(t, 1, calls)
+
+		// nothing is selected if peers are not wanted
+		calls = 0
+		err = th.st.AnnouncePeersFunc(context.TODO(), c.ih, false, 0, isV6, func(bittorrent.Peer) bool {
+			calls++
+			return true
+		})
+		require.Nil(t, err)
+		require.Zero(t, calls)
+		peers, err = th.st.AnnouncePeers(context.TODO(), c.ih, false, 0, isV6)
+		require.Nil(t, err)
+		require.Nil(t, peers)
+
+		err = th.st.DeleteLeecher(context.TODO(), c.ih, peer)
+		require.Nil(t, err)
+		err = th.st.DeleteSeeder(context.TODO(), c.ih, c.peer)
+		require.Nil(t, err)
+	}
+}
+
 func (th *testHolder) CustomPutContainsLoadDelete(t *testing.T) {
 	for _, c := range testData {
 		err := th.st.Put(context.TODO(), kvStoreCtx, storage.Entry{Key: c.peer.String(), Value: []byte(c.ih.RawString())})
@@ -274,6 +342,40 @@ func (th *testHolder) CustomBulkPutContainsLoadDelete(t *testing.T) {
 	}
 }
 
+func (th *testHolder) PutDumpDelete(t *testing.T) {
+	d := th.st.(storage.Dumper)
+	for _, c := range testData {
+		require.Nil(t, th.st.PutSeeder(context.TODO(), c.ih, c.peer))
+	}
+	type dumped struct {
+		hashPeer
+		seeder bool
+	}
+	var got []dumped
+	err := d.Dump(context.TODO(), func(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) error {
+		got = append(got, dumped{hashPeer{ih, peer}, seeder})
+		return nil
+	})
+	require.Nil(t, err)
+	for _, c := range testData {
+		require.Contains(t, got, dumped{c, true})
+	}
+
+	// iteration stops on error
+	errStop := errors.New("stop")
+	var calls int
+	err = d.Dump(context.TODO(), func(bittorrent.InfoHash, bittorrent.Peer, bool) error {
+		calls++
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, 1, calls)
+
+	for _, c := range testData {
+		require.Nil(t, th.st.DeleteSeeder(context.TODO(), c.ih, c.peer))
+	}
+}
+
 // RunTests tests a PeerStorage implementation against the interface.
 func RunTests(t *testing.T, p storage.PeerStorage) {
 	th := testHolder{st: p}
@@ -302,9 +404,16 @@ func RunTests(t *testing.T, p storage.PeerStorage) {
 	// Test PutLeecher -> Graduate -> Announce -> DeleteLeecher -> Announce
 	t.Run("LeecherPutGraduateAnnounceDeleteAnnounce", th.LeecherPutGraduateAnnounceDeleteAnnounce)
 
+	// Test PutSeeder -> AnnounceFunc -> DeleteSeeder
+	t.Run("SeederPutAnnounceFuncDelete", th.SeederPutAnnounceFuncDelete)
+
 	t.Run("CustomPutContainsLoadDelete", th.CustomPutContainsLoadDelete)
 	t.Run("CustomBulkPutContainsLoadDelete", th.CustomBulkPutContainsLoadDelete)
 
+	if _, ok := th.st.(storage.Dumper); ok {
+		t.Run("PutDumpDelete", th.PutDumpDelete)
+	}
+
 	e := th.st.Close()
 	require.Nil(t, e)
 }
@@ -0,0 +1,120 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+var errBencodeTrailing = errors.New("bencode: trailing data")
+
+// bdecode strictly decodes bencoded value (BEP 3): integers are checked
+// for leading zeros, dictionary keys must be sorted and whole input must
+// be consumed. Result is int64, string, []any or map[string]any.
+func bdecode(b []byte) (any, error) {
+	v, rest, err := bdecodeValue(b)
+	if err == nil && len(rest) > 0 {
+		err = errBencodeTrailing
+	}
+	return v, err
+}
+
+func bdecodeValue(b []byte) (v any, rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, errors.New("bencode: unexpected end of data")
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return nil, nil, errors.New("bencode: unterminated integer")
+		}
+		s := string(b[1:end])
+		if s == "-0" || (len(s) > 1 && s[0] == '0') || (len(s) > 2 && s[:2] == "-0") {
+			return nil, nil, fmt.Errorf("bencode: invalid integer '%s'", s)
+		}
+		var i int64
+		if i, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("bencode: invalid integer '%s'", s)
+		}
+		return i, b[end+1:], nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return nil, nil, errors.New("bencode: unterminated string length")
+		}
+		s := string(b[:colon])
+		var l uint64
+		if l, err = strconv.ParseUint(s, 10, 31); err != nil || (len(s) > 1 && s[0] == '0') {
+			return nil, nil, fmt.Errorf("bencode: invalid string length '%s'", s)
+		}
+		b = b[colon+1:]
+		if uint64(len(b)) < l {
+			return nil, nil, errors.New("bencode: string exceeds data")
+		}
+		return string(b[:l]), b[l:], nil
+	case c == 'l':
+		list := make([]any, 0)
+		for b = b[1:]; len(b) > 0 && b[0] != 'e'; {
+			if v, b, err = bdecodeValue(b); err != nil {
+				return
+			}
+			list = append(list, v)
+		}
+		if len(b) == 0 {
+			return nil, nil, errors.New("bencode: unterminated list")
+		}
+		return list, b[1:], nil
+	case c == 'd':
+		dict := make(map[string]any)
+		var prev *string
+		for b = b[1:]; len(b) > 0 && b[0] != 'e'; {
+			var k any
+			if k, b, err = bdecodeValue(b); err != nil {
+				return
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, nil, errors.New("bencode: non-string dictionary key")
+			}
+			if prev != nil && *prev >= key {
+				return nil, nil, fmt.Errorf("bencode: unsorted or duplicate key '%s'", key)
+			}
+			prev = &key
+			if dict[key], b, err = bdecodeValue(b); err != nil {
+				return
+			}
+		}
+		if len(b) == 0 {
+			return nil, nil, errors.New("bencode: unterminated dictionary")
+		}
+		return dict, b[1:], nil
+	default:
+		return nil, nil, fmt.Errorf("bencode: unexpected byte '%c'", c)
+	}
+}
+
+func TestBdecode(t *testing.T) {
+	v, err := bdecode([]byte("d8:completei1e5:filesld1:ai-2eee5:peers0:e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := v.(map[string]any)
+	if d["complete"] != int64(1) || d["peers"] != "" || len(d["files"].([]any)) != 1 {
+		t.Fatalf("unexpected result: %v", v)
+	}
+	for _, s := range []string{
+		"", "i", "i1", "ie", "i01e", "i-0e", "i-01e", "i1x2e",
+		"1", "1:", "2:a", "01:a", "-1:a",
+		"l", "li1e", "d", "d1:a", "di1ei1ee", "d1:bi1e1:ai2ee", "d1:ai1e1:ai2ee",
+		"i1ei2e", "x",
+	} {
+		if _, err = bdecode([]byte(s)); err == nil {
+			t.Errorf("%q expected to be rejected", s)
+		}
+	}
+}
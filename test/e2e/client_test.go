@@ -0,0 +1,364 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventNone      = ""
+	eventCompleted = "completed"
+	eventStarted   = "started"
+	eventStopped   = "stopped"
+
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+	udpAnnounceLen    = 98
+
+	clientTimeout = 2 * time.Second
+)
+
+var (
+	errMalformedResponse = errors.New("malformed response")
+	errNoResponse        = errors.New("no response")
+
+	udpEvents = map[string]uint32{
+		eventNone:      0,
+		eventCompleted: 1,
+		eventStarted:   2,
+		eventStopped:   3,
+	}
+)
+
+// announce holds parameters of announce request
+type announce struct {
+	infoHash []byte
+	peerID   []byte
+	port     uint16
+	left     uint64
+	event    string
+	numWant  uint32
+}
+
+// announceResult is the protocol-independent announce response
+type announceResult struct {
+	// failure is the failure reason (HTTP) or error message (UDP)
+	failure     string
+	interval    int64
+	minInterval int64
+	seeders     int64
+	leechers    int64
+	peers       []netip.AddrPort
+}
+
+// scrapeResult is the protocol-independent scrape statistics of one swarm
+type scrapeResult struct {
+	seeders    int64
+	leechers   int64
+	downloaded int64
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
+
+// httpClient is the BEP 3 client with compact peers list support (BEP 23)
+type httpClient struct {
+	base   string
+	client *http.Client
+}
+
+func newHTTPClient(addr string) *httpClient {
+	return &httpClient{
+		base:   "http://" + addr,
+		client: &http.Client{Timeout: clientTimeout},
+	}
+}
+
+// get sends raw request and decodes response as bencoded dictionary
+// if HTTP status is OK
+func (c *httpClient) get(pathAndQuery string) (status int, resp map[string]any, err error) {
+	var r *http.Response
+	if r, err = c.client.Get(c.base + pathAndQuery); err != nil {
+		return
+	}
+	defer r.Body.Close()
+	status = r.StatusCode
+	var body []byte
+	if body, err = io.ReadAll(r.Body); err != nil || status != http.StatusOK {
+		return
+	}
+	var v any
+	if v, err = bdecode(body); err != nil {
+		return status, nil, fmt.Errorf("%w: %q", err, body)
+	}
+	var ok bool
+	if resp, ok = v.(map[string]any); !ok {
+		err = fmt.Errorf("%w: top-level value is not a dictionary", errMalformedResponse)
+	}
+	return
+}
+
+func (c *httpClient) announce(a announce) (res announceResult, err error) {
+	q := url.Values{
+		"info_hash":  []string{string(a.infoHash)},
+		"peer_id":    []string{string(a.peerID)},
+		"port":       []string{strconv.FormatUint(uint64(a.port), 10)},
+		"uploaded":   []string{"0"},
+		"downloaded": []string{"0"},
+		"left":       []string{strconv.FormatUint(a.left, 10)},
+		"numwant":    []string{strconv.FormatUint(uint64(a.numWant), 10)},
+		"compact":    []string{"1"},
+	}
+	if len(a.event) > 0 {
+		q.Set("event", a.event)
+	}
+	var status int
+	var resp map[string]any
+	if status, resp, err = c.get("/announce?" + q.Encode()); err != nil {
+		return
+	}
+	if status != http.StatusOK {
+		return res, fmt.Errorf("unexpected status %d", status)
+	}
+	if f, ok := resp["failure reason"]; ok {
+		res.failure, _ = f.(string)
+		return
+	}
+	for _, f := range []struct {
+		key string
+		val *int64
+	}{
+		{"interval", &res.interval},
+		{"min interval", &res.minInterval},
+		{"complete", &res.seeders},
+		{"incomplete", &res.leechers},
+	} {
+		var ok bool
+		if *f.val, ok = resp[f.key].(int64); !ok {
+			return res, fmt.Errorf("%w: '%s' is missing or not an integer", errMalformedResponse, f.key)
+		}
+	}
+	for key, size := range map[string]int{"peers": net.IPv4len, "peers6": net.IPv6len} {
+		v, ok := resp[key]
+		if !ok {
+			continue
+		}
+		var compact string
+		if compact, ok = v.(string); !ok {
+			return res, fmt.Errorf("%w: '%s' is not a compact string", errMalformedResponse, key)
+		}
+		var peers []netip.AddrPort
+		if peers, err = parseCompactPeers([]byte(compact), size); err != nil {
+			return
+		}
+		res.peers = append(res.peers, peers...)
+	}
+	return
+}
+
+func (c *httpClient) scrape(infoHashes ...[]byte) (res map[string]scrapeResult, failure string, err error) {
+	parts := make([]string, 0, len(infoHashes))
+	for _, ih := range infoHashes {
+		parts = append(parts, "info_hash="+url.QueryEscape(string(ih)))
+	}
+	var status int
+	var resp map[string]any
+	if status, resp, err = c.get("/scrape?" + strings.Join(parts, "&")); err != nil {
+		return
+	}
+	if status != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %d", status)
+	}
+	if f, ok := resp["failure reason"]; ok {
+		failure, _ = f.(string)
+		return
+	}
+	files, ok := resp["files"].(map[string]any)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: 'files' is missing or not a dictionary", errMalformedResponse)
+	}
+	res = make(map[string]scrapeResult, len(files))
+	for ih, v := range files {
+		var stats map[string]any
+		if stats, ok = v.(map[string]any); !ok {
+			return nil, "", fmt.Errorf("%w: file entry is not a dictionary", errMalformedResponse)
+		}
+		var s scrapeResult
+		s.seeders, _ = stats["complete"].(int64)
+		s.leechers, _ = stats["incomplete"].(int64)
+		s.downloaded, _ = stats["downloaded"].(int64)
+		res[ih] = s
+	}
+	return
+}
+
+func parseCompactPeers(b []byte, ipLen int) ([]netip.AddrPort, error) {
+	size := ipLen + 2
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("%w: compact peers length %d is not a multiple of %d", errMalformedResponse, len(b), size)
+	}
+	peers := make([]netip.AddrPort, 0, len(b)/size)
+	for ; len(b) > 0; b = b[size:] {
+		addr, _ := netip.AddrFromSlice(b[:ipLen])
+		peers = append(peers, netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b[ipLen:size])))
+	}
+	return peers, nil
+}
+
+// udpClient is the BEP 15 client
+type udpClient struct {
+	conn   net.Conn
+	connID []byte
+	buf    []byte
+}
+
+func newUDPClient(addr string) (*udpClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpClient{conn: conn, buf: make([]byte, 2048)}, nil
+}
+
+// send writes raw packet and waits for response not longer than timeout.
+// Returns errNoResponse if timeout elapsed.
+func (c *udpClient) send(packet []byte, timeout time.Duration) ([]byte, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(packet); err != nil {
+		return nil, err
+	}
+	n, err := c.conn.Read(c.buf)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = errNoResponse
+		}
+		return nil, err
+	}
+	return bytes.Clone(c.buf[:n]), nil
+}
+
+// exchange sets random transaction ID to request, sends it and checks
+// response header. If tracker responded with error, failure is set.
+func (c *udpClient) exchange(req []byte, action uint32) (resp []byte, failure string, err error) {
+	txID := randomBytes(4)
+	copy(req[12:16], txID)
+	if resp, err = c.send(req, clientTimeout); err != nil {
+		return
+	}
+	if len(resp) < 8 {
+		return nil, "", fmt.Errorf("%w: response length %d", errMalformedResponse, len(resp))
+	}
+	if !bytes.Equal(resp[4:8], txID) {
+		return nil, "", fmt.Errorf("%w: transaction ID mismatch", errMalformedResponse)
+	}
+	switch a := binary.BigEndian.Uint32(resp[:4]); a {
+	case action:
+		return resp[8:], "", nil
+	case udpActionError:
+		return nil, strings.TrimRight(string(resp[8:]), "\x00"), nil
+	default:
+		return nil, "", fmt.Errorf("%w: unexpected action %d", errMalformedResponse, a)
+	}
+}
+
+func (c *udpClient) connect() error {
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	resp, failure, err := c.exchange(req, udpActionConnect)
+	if err == nil {
+		if len(failure) > 0 {
+			err = errors.New(failure)
+		} else if len(resp) != 8 {
+			err = fmt.Errorf("%w: connect response length %d", errMalformedResponse, len(resp))
+		}
+	}
+	if err == nil {
+		c.connID = resp
+	}
+	return err
+}
+
+// header returns request with connection ID and action set
+func (c *udpClient) header(size int, action uint32) []byte {
+	req := make([]byte, size)
+	copy(req[:8], c.connID)
+	binary.BigEndian.PutUint32(req[8:12], action)
+	return req
+}
+
+func (c *udpClient) announce(a announce) (res announceResult, err error) {
+	event, ok := udpEvents[a.event]
+	if !ok {
+		return res, fmt.Errorf("unknown event '%s'", a.event)
+	}
+	req := c.header(udpAnnounceLen, udpActionAnnounce)
+	copy(req[16:36], a.infoHash)
+	copy(req[36:56], a.peerID)
+	binary.BigEndian.PutUint64(req[64:72], a.left)
+	binary.BigEndian.PutUint32(req[80:84], event)
+	copy(req[88:92], randomBytes(4))
+	binary.BigEndian.PutUint32(req[92:96], a.numWant)
+	binary.BigEndian.PutUint16(req[96:98], a.port)
+	var resp []byte
+	if resp, res.failure, err = c.exchange(req, udpActionAnnounce); err != nil || len(res.failure) > 0 {
+		return
+	}
+	if len(resp) < 12 {
+		return res, fmt.Errorf("%w: announce response length %d", errMalformedResponse, len(resp))
+	}
+	res.interval = int64(binary.BigEndian.Uint32(resp[:4]))
+	res.leechers = int64(binary.BigEndian.Uint32(resp[4:8]))
+	res.seeders = int64(binary.BigEndian.Uint32(resp[8:12]))
+	// IPv4 socket is used, so peers are IPv4
+	res.peers, err = parseCompactPeers(resp[12:], net.IPv4len)
+	return
+}
+
+func (c *udpClient) scrape(infoHashes ...[]byte) (res []scrapeResult, failure string, err error) {
+	req := c.header(16, udpActionScrape)
+	for _, ih := range infoHashes {
+		req = append(req, ih...)
+	}
+	var resp []byte
+	if resp, failure, err = c.exchange(req, udpActionScrape); err != nil || len(failure) > 0 {
+		return
+	}
+	if len(resp) != len(infoHashes)*12 {
+		return nil, "", fmt.Errorf("%w: scrape response length %d", errMalformedResponse, len(resp))
+	}
+	for ; len(resp) > 0; resp = resp[12:] {
+		res = append(res, scrapeResult{
+			seeders:    int64(binary.BigEndian.Uint32(resp[:4])),
+			downloaded: int64(binary.BigEndian.Uint32(resp[4:8])),
+			leechers:   int64(binary.BigEndian.Uint32(resp[8:12])),
+		})
+	}
+	return
+}
+
+func (c *udpClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,21 @@
+// Package e2e contains end-to-end tests of the tracker.
+//
+// Tests start tracker with HTTP and UDP frontends on top of each available
+// storage driver and exercise it with independent BEP 3 and BEP 15 client
+// implementations, including malformed requests (truncated packets,
+// invalid query parameters etc.).
+//
+// Tests are excluded from regular build and should be run with e2e tag:
+//
+//	go test -tags e2e ./test/e2e/
+//
+// Memory storage is always tested, LMDB is tested if mochi built with cgo.
+// External storages are tested only if their addresses are provided:
+//
+//	MOCHI_E2E_REDIS=127.0.0.1:6379 \
+//	MOCHI_E2E_KEYDB=127.0.0.1:6380 \
+//	MOCHI_E2E_PG="host=127.0.0.1 database=test user=postgres" \
+//	go test -tags e2e ./test/e2e/
+//
+// Note: PostgreSQL tables mo_peers, mo_downloads and mo_kv are re-created.
+package e2e
@@ -0,0 +1,507 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sot-tech/mochi/frontend"
+	_ "github.com/sot-tech/mochi/frontend/http"
+	_ "github.com/sot-tech/mochi/frontend/udp"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	_ "github.com/sot-tech/mochi/storage/keydb"
+	_ "github.com/sot-tech/mochi/storage/mdb"
+	_ "github.com/sot-tech/mochi/storage/memory"
+	_ "github.com/sot-tech/mochi/storage/pg"
+	_ "github.com/sot-tech/mochi/storage/redis"
+)
+
+const (
+	announceInterval    = 30 * time.Minute
+	minAnnounceInterval = 15 * time.Minute
+
+	// eventuallyTimeout is the maximum time to wait until asynchronous
+	// swarm update is visible
+	eventuallyTimeout = 5 * time.Second
+	// silenceTimeout is the time to wait for response, which should not be sent
+	silenceTimeout = 300 * time.Millisecond
+
+	pgCreateTablesQuery = `
+DROP TABLE IF EXISTS mo_peers;
+CREATE UNLOGGED TABLE mo_peers (
+	info_hash bytea NOT NULL,
+	peer_id bytea NOT NULL,
+	address inet NOT NULL,
+	port int4 NOT NULL,
+	is_seeder bool NOT NULL,
+	is_v6 bool NOT NULL,
+	created timestamp NOT NULL DEFAULT current_timestamp,
+	PRIMARY KEY (info_hash, peer_id, address, port)
+);
+
+CREATE INDEX mo_peers_created_idx ON mo_peers(created);
+CREATE INDEX mo_peers_announce_idx ON mo_peers(info_hash, is_seeder, is_v6);
+
+DROP TABLE IF EXISTS mo_downloads;
+CREATE UNLOGGED TABLE mo_downloads (
+	info_hash bytea PRIMARY KEY NOT NULL,
+	downloads int NOT NULL DEFAULT 1
+);
+
+DROP TABLE IF EXISTS mo_kv;
+CREATE TABLE mo_kv (
+	context varchar NOT NULL,
+	name bytea NOT NULL,
+	value bytea,
+	PRIMARY KEY (context, name)
+);
+`
+)
+
+// driver describes storage under test. config returns storage
+// configuration or skips test if storage is not available.
+type driver struct {
+	name   string
+	config func(t *testing.T) conf.MapConfig
+}
+
+func envAddr(t *testing.T, name string) string {
+	v := os.Getenv(name)
+	if len(v) == 0 {
+		t.Skip(name + " is not set")
+	}
+	return v
+}
+
+var drivers = []driver{
+	{"memory", func(*testing.T) conf.MapConfig {
+		return conf.MapConfig{}
+	}},
+	{"lmdb", func(t *testing.T) conf.MapConfig {
+		if !storage.Registered("lmdb") {
+			t.Skip("lmdb storage requires cgo")
+		}
+		return conf.MapConfig{"path": t.TempDir(), "max_size": 64 << 20}
+	}},
+	{"redis", func(t *testing.T) conf.MapConfig {
+		return conf.MapConfig{"addresses": []string{envAddr(t, "MOCHI_E2E_REDIS")}}
+	}},
+	{"keydb", func(t *testing.T) conf.MapConfig {
+		return conf.MapConfig{"addresses": []string{envAddr(t, "MOCHI_E2E_KEYDB")}}
+	}},
+	{"pg", func(t *testing.T) conf.MapConfig {
+		connStr := envAddr(t, "MOCHI_E2E_PG")
+		ctx := context.Background()
+		c, err := pgx.Connect(ctx, connStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close(ctx)
+		if _, err = c.Exec(ctx, pgCreateTablesQuery); err != nil {
+			t.Fatal(err)
+		}
+		return pgConfig(connStr)
+	}},
+}
+
+// pgConfig returns configuration of pg storage for tables
+// created with pgCreateTablesQuery (see docs/storage/postgres.md)
+func pgConfig(connStr string) conf.MapConfig {
+	return conf.MapConfig{
+		"connection_string": connStr,
+		"ping_query":        "SELECT 1",
+		"peer": map[string]any{
+			"add_query":             "INSERT INTO mo_peers VALUES(@info_hash, @peer_id, @address, @port, @is_seeder, @is_v6, @created) ON CONFLICT (info_hash, peer_id, address, port) DO UPDATE SET created = EXCLUDED.created, is_seeder = EXCLUDED.is_seeder",
+			"del_query":             "DELETE FROM mo_peers WHERE info_hash=@info_hash AND peer_id=@peer_id AND address=@address AND port=@port AND is_seeder=@is_seeder",
+			"graduate_query":        "UPDATE mo_peers SET is_seeder=TRUE WHERE info_hash=@info_hash AND peer_id=@peer_id AND address=@address AND port=@port AND NOT is_seeder",
+			"count_query":           "SELECT COUNT(1) FILTER (WHERE is_seeder) AS seeders, COUNT(1) FILTER (WHERE NOT is_seeder) AS leechers FROM mo_peers",
+			"count_seeders_column":  "seeders",
+			"count_leechers_column": "leechers",
+			"by_info_hash_clause":   "WHERE info_hash = @info_hash",
+		},
+		"announce": map[string]any{
+			"query":          "SELECT peer_id, address, port FROM mo_peers WHERE info_hash=@info_hash AND is_seeder=@is_seeder AND is_v6=@is_v6 LIMIT @count",
+			"peer_id_column": "peer_id",
+			"address_column": "address",
+			"port_column":    "port",
+		},
+		"downloads": map[string]any{
+			"get_query": "SELECT downloads FROM mo_downloads where info_hash=@info_hash",
+			"inc_query": "INSERT INTO mo_downloads VALUES(@info_hash) ON CONFLICT(info_hash) DO UPDATE SET downloads = mo_downloads.downloads + 1",
+		},
+		"data": map[string]any{
+			"add_query": "INSERT INTO mo_kv VALUES(@context, @key, @value) ON CONFLICT (context, name) DO NOTHING",
+			"get_query": "SELECT value FROM mo_kv WHERE context=@context AND name=@key",
+			"del_query": "DELETE FROM mo_kv WHERE context=@context AND name = ANY(@key)",
+		},
+		"gc_query":              "DELETE FROM mo_peers WHERE created <= @created",
+		"info_hash_count_query": "SELECT COUNT(DISTINCT info_hash) as info_hashes FROM mo_peers",
+	}
+}
+
+// tracker is the running tracker instance with HTTP and UDP frontends
+type tracker struct {
+	httpAddr string
+	udpAddr  string
+}
+
+// freeAddr returns local address with port, which is not used at the moment
+func freeAddr(t *testing.T, network string) string {
+	var addr string
+	if network == "udp" {
+		c, err := net.ListenPacket(network, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = c.LocalAddr().String()
+		_ = c.Close()
+	} else {
+		l, err := net.Listen(network, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		_ = l.Close()
+	}
+	return addr
+}
+
+// startTracker starts frontends with storage created from d and
+// waits until they accept requests. Tracker is stopped on test cleanup.
+func startTracker(t *testing.T, d driver) *tracker {
+	ps, err := storage.NewPeerStorage(conf.NamedMapConfig{Name: d.name, Config: d.config(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ps.Close() })
+	logic := middleware.NewLogic(announceInterval, minAnnounceInterval, ps, nil, nil, nil)
+	tr := &tracker{httpAddr: freeAddr(t, "tcp"), udpAddr: freeAddr(t, "udp")}
+	for _, fc := range []conf.NamedMapConfig{
+		{Name: "http", Config: conf.MapConfig{"addr": tr.httpAddr}},
+		{Name: "udp", Config: conf.MapConfig{"addr": tr.udpAddr, "private_key": "mochi-e2e-test"}},
+	} {
+		var f frontend.Frontend
+		if f, err = frontend.NewFrontend(fc, logic); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), eventuallyTimeout)
+			defer cancel()
+			_ = f.Drain(ctx)
+		})
+	}
+
+	eventually(t, "HTTP frontend started", func() error {
+		c, err := net.DialTimeout("tcp", tr.httpAddr, clientTimeout)
+		if err == nil {
+			_ = c.Close()
+		}
+		return err
+	})
+	eventually(t, "UDP frontend started", func() error {
+		c, err := newUDPClient(tr.udpAddr)
+		if err == nil {
+			defer c.Close()
+			err = c.connect()
+		}
+		return err
+	})
+	return tr
+}
+
+// eventually calls fn until it returns nil or eventuallyTimeout elapsed
+func eventually(t *testing.T, what string, fn func() error) {
+	t.Helper()
+	deadline := time.Now().Add(eventuallyTimeout)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %v", what, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// client is the protocol-independent tracker client
+type client interface {
+	announce(a announce) (announceResult, error)
+	scrapeSwarm(infoHash []byte) (scrapeResult, error)
+}
+
+func (c *httpClient) scrapeSwarm(infoHash []byte) (scrapeResult, error) {
+	res, failure, err := c.scrape(infoHash)
+	if err == nil && len(failure) > 0 {
+		err = fmt.Errorf("scrape failed: %s", failure)
+	}
+	if err != nil {
+		return scrapeResult{}, err
+	}
+	return res[string(infoHash)], nil
+}
+
+func (c *udpClient) scrapeSwarm(infoHash []byte) (scrapeResult, error) {
+	res, failure, err := c.scrape(infoHash)
+	if err == nil && len(failure) > 0 {
+		err = fmt.Errorf("scrape failed: %s", failure)
+	}
+	if err != nil {
+		return scrapeResult{}, err
+	}
+	return res[0], nil
+}
+
+func mustAnnounce(t *testing.T, c client, a announce) announceResult {
+	t.Helper()
+	res, err := c.announce(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.failure) > 0 {
+		t.Fatalf("announce failed: %s", res.failure)
+	}
+	return res
+}
+
+func expectScrape(t *testing.T, c client, ih []byte, expected scrapeResult) {
+	t.Helper()
+	eventually(t, "scrape", func() error {
+		res, err := c.scrapeSwarm(ih)
+		// downloads are not counted by every storage (i.e. memory)
+		res.downloaded = 0
+		if err == nil && res != expected {
+			err = fmt.Errorf("expected %+v, got %+v", expected, res)
+		}
+		return err
+	})
+}
+
+func newUDPConnected(t *testing.T, addr string) *udpClient {
+	c, err := newUDPClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	if err = c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestE2E(t *testing.T) {
+	for _, d := range drivers {
+		t.Run(d.name, func(t *testing.T) {
+			tr := startTracker(t, d)
+			newHTTP := func() client { return newHTTPClient(tr.httpAddr) }
+			newUDP := func() client { return newUDPConnected(t, tr.udpAddr) }
+			for _, tc := range []struct {
+				name            string
+				seeder, leecher func() client
+			}{
+				{"HTTP", newHTTP, newHTTP},
+				{"UDP", newUDP, newUDP},
+				{"HTTPSeederUDPLeecher", newHTTP, newUDP},
+				{"UDPSeederHTTPLeecher", newUDP, newHTTP},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					testSwarmLifecycle(t, tc.seeder(), tc.leecher())
+				})
+			}
+			t.Run("HTTPMalformed", func(t *testing.T) {
+				testHTTPMalformed(t, tr.httpAddr)
+			})
+			t.Run("UDPMalformed", func(t *testing.T) {
+				testUDPMalformed(t, tr.udpAddr)
+			})
+		})
+	}
+}
+
+// testSwarmLifecycle checks that seeder is returned to leecher,
+// leecher becomes seeder after completion and stopped peer
+// is removed from swarm
+func testSwarmLifecycle(t *testing.T, seeder, leecher client) {
+	ih := randomBytes(20)
+	seederAddr := netip.MustParseAddrPort("127.0.0.1:20001")
+	seed := announce{infoHash: ih, peerID: randomBytes(20), port: seederAddr.Port(), event: eventStarted, numWant: 50}
+	leech := announce{infoHash: ih, peerID: randomBytes(20), port: 20002, left: 1000, event: eventStarted, numWant: 50}
+
+	res := mustAnnounce(t, seeder, seed)
+	if res.interval != int64(announceInterval/time.Second) {
+		t.Fatalf("expected interval %d, got %d", int64(announceInterval/time.Second), res.interval)
+	}
+
+	eventually(t, "seeder returned to leecher", func() error {
+		res := mustAnnounce(t, leecher, leech)
+		if res.seeders != 1 || !slices.Contains(res.peers, seederAddr) {
+			return fmt.Errorf("seeder %s not found in %+v", seederAddr, res)
+		}
+		return nil
+	})
+	expectScrape(t, seeder, ih, scrapeResult{seeders: 1, leechers: 1})
+	expectScrape(t, leecher, ih, scrapeResult{seeders: 1, leechers: 1})
+
+	leech.event, leech.left = eventCompleted, 0
+	mustAnnounce(t, leecher, leech)
+	expectScrape(t, seeder, ih, scrapeResult{seeders: 2})
+
+	seed.event = eventStopped
+	mustAnnounce(t, seeder, seed)
+	expectScrape(t, leecher, ih, scrapeResult{seeders: 1})
+}
+
+// testHTTPMalformed sends invalid requests and checks that tracker
+// responds with valid bencoded failure or HTTP error and keeps working
+func testHTTPMalformed(t *testing.T, addr string) {
+	c := newHTTPClient(addr)
+	ih := url20(randomBytes(20))
+	peerID := url20(randomBytes(20))
+	valid := "info_hash=" + ih + "&peer_id=" + peerID + "&port=6881&uploaded=0&downloaded=0&left=0&compact=1"
+	for _, tc := range []struct {
+		name, path string
+	}{
+		{"NoParams", "/announce"},
+		{"ShortInfoHash", "/announce?info_hash=abc&peer_id=" + peerID + "&port=6881&left=0&uploaded=0&downloaded=0"},
+		{"LongInfoHash", "/announce?info_hash=" + ih + "abc&peer_id=" + peerID + "&port=6881&left=0&uploaded=0&downloaded=0"},
+		{"MultipleInfoHashes", "/announce?" + valid + "&info_hash=" + url20(randomBytes(20))},
+		{"NoPeerID", "/announce?info_hash=" + ih + "&port=6881&left=0&uploaded=0&downloaded=0"},
+		{"BadPercentEncoding", "/announce?info_hash=%zz%zz&peer_id=" + peerID + "&port=6881&left=0&uploaded=0&downloaded=0"},
+		{"TruncatedPercentEncoding", "/announce?" + valid + "&info_hash=%1"},
+		{"BadPort", strings.Replace("/announce?"+valid, "port=6881", "port=99999", 1)},
+		{"ZeroPort", strings.Replace("/announce?"+valid, "port=6881", "port=0", 1)},
+		{"NegativeLeft", strings.Replace("/announce?"+valid, "left=0", "left=-1", 1)},
+		{"NotNumericLeft", strings.Replace("/announce?"+valid, "left=0", "left=abc", 1)},
+		{"UnknownEvent", "/announce?" + valid + "&event=exploded"},
+		{"ScrapeNoInfoHash", "/scrape"},
+		{"ScrapeShortInfoHash", "/scrape?info_hash=abc"},
+		{"UnknownPath", "/nowhere"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, resp, err := c.get(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status < http.StatusBadRequest {
+				if status != http.StatusOK {
+					t.Fatalf("unexpected status %d", status)
+				}
+				if f, _ := resp["failure reason"].(string); len(f) == 0 {
+					t.Fatalf("expected failure reason, got %v", resp)
+				}
+				if _, ok := resp["interval"]; ok {
+					t.Fatalf("failure response contains interval: %v", resp)
+				}
+			}
+		})
+	}
+
+	t.Run("RawGarbage", func(t *testing.T) {
+		for _, garbage := range []string{
+			"GARBAGE\r\n\r\n",
+			"GET /announce?" + valid + " HTTP/1.1\r\nHost:", // headers truncated
+			"\x00\x01\x02\x03\r\n\r\n",
+		} {
+			conn, err := net.DialTimeout("tcp", addr, clientTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetDeadline(time.Now().Add(silenceTimeout))
+			if _, err = conn.Write([]byte(garbage)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 512)
+			n, _ := conn.Read(buf)
+			if strings.HasPrefix(string(buf[:n]), "HTTP/1.1 200") {
+				t.Fatalf("malformed request accepted: %q", buf[:n])
+			}
+			_ = conn.Close()
+		}
+	})
+
+	// tracker should still work
+	mustAnnounce(t, c, announce{infoHash: randomBytes(20), peerID: randomBytes(20), port: 6881, numWant: 1})
+}
+
+func url20(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		_, _ = fmt.Fprintf(&sb, "%%%02x", c)
+	}
+	return sb.String()
+}
+
+// testUDPMalformed sends invalid packets and checks that tracker
+// either does not respond or responds with error and keeps working
+func testUDPMalformed(t *testing.T, addr string) {
+	c := newUDPConnected(t, addr)
+	valid := c.header(udpAnnounceLen, udpActionAnnounce)
+	copy(valid[16:36], randomBytes(20))
+	copy(valid[36:56], randomBytes(20))
+	binary.BigEndian.PutUint16(valid[96:98], 6881)
+
+	wrongProtocol := make([]byte, 16)
+	copy(wrongProtocol[:8], randomBytes(8))
+	badConnID := append([]byte(nil), valid...)
+	copy(badConnID[:8], randomBytes(8))
+	unknownAction := append([]byte(nil), valid...)
+	unknownAction[11] = 42
+	scrapeTruncatedHash := append(c.header(16, udpActionScrape), randomBytes(10)...)
+
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		// silent means that tracker should not respond,
+		// otherwise error response expected
+		silent bool
+	}{
+		{"Empty", nil, true},
+		{"OneByte", []byte{0}, true},
+		{"TruncatedHeader", valid[:15], true},
+		{"WrongProtocolID", wrongProtocol, true},
+		{"BadConnectionID", badConnID, false},
+		{"TruncatedAnnounce", valid[:56], false},
+		{"UnknownAction", unknownAction, false},
+		{"ScrapeNoInfoHash", c.header(16, udpActionScrape), false},
+		{"ScrapeTruncatedInfoHash", scrapeTruncatedHash, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			packet := append([]byte(nil), tc.packet...)
+			txID := randomBytes(4)
+			if len(packet) >= 16 {
+				copy(packet[12:16], txID)
+			}
+			resp, err := c.send(packet, silenceTimeout)
+			if tc.silent {
+				if err != errNoResponse {
+					t.Fatalf("expected no response, got %x (%v)", resp, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp) <= 8 || binary.BigEndian.Uint32(resp[:4]) != udpActionError || string(resp[4:8]) != string(txID) {
+				t.Fatalf("expected error response, got %x", resp)
+			}
+		})
+	}
+
+	// tracker should still work
+	mustAnnounce(t, c, announce{infoHash: randomBytes(20), peerID: randomBytes(20), port: 6881, numWant: 1})
+}
@@ -0,0 +1,170 @@
+package tracker
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/sot-tech/mochi/frontend"
+	fh "github.com/sot-tech/mochi/frontend/http"
+	fu "github.com/sot-tech/mochi/frontend/udp"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/export"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/ops"
+	"github.com/sot-tech/mochi/pkg/privacy"
+	"github.com/sot-tech/mochi/pkg/replica"
+	"github.com/sot-tech/mochi/pkg/takedown"
+	"github.com/sot-tech/mochi/pkg/tunable"
+	sm "github.com/sot-tech/mochi/storage/memory"
+)
+
+// Config represents the configuration used for Tracker start.
+type Config struct {
+	// TODO(jzelinskie): Evaluate whether we would like to make
+	//  AnnounceInterval and MinAnnounceInterval optional.
+	// We can make Conf extensible enough that you can program a new response
+	// generator at the cost of making it possible for users to create config that
+	// won't compose a functional tracker.
+	AnnounceInterval    time.Duration            `yaml:"announce_interval"`
+	MinAnnounceInterval time.Duration            `yaml:"min_announce_interval"`
+	MetricsAddr         string                   `yaml:"metrics_addr"`
+	StatsD              metrics.StatsDConfig     `yaml:"statsd"`
+	AdminAddr           string                   `yaml:"admin_addr"`
+	AdminAuth           admin.AuthConfig         `yaml:"admin_auth"`
+	AdminAudit          admin.AuditConfig        `yaml:"admin_audit"`
+	Replication         replica.Config           `yaml:"replication"`
+	Ops                 ops.Config               `yaml:"ops"`
+	Export              export.Config            `yaml:"export"`
+	Takedown            takedown.Config          `yaml:"takedown"`
+	Log                 *log.Config              `yaml:"log"`
+	Privacy             privacy.Config           `yaml:"privacy"`
+	ClientErrors        frontend.ErrorsConfig    `yaml:"client_errors"`
+	Admission           frontend.AdmissionConfig `yaml:"admission"`
+	Tunables            tunable.Config           `yaml:"tunables"`
+	DrainTimeout        time.Duration            `yaml:"drain_timeout"`
+	StoppedGracePeriod  time.Duration            `yaml:"stopped_grace_period"`
+	ScrapeCacheTTL      time.Duration            `yaml:"scrape_cache_ttl"`
+	Private             bool                     `yaml:"private"`
+	Frontends           []FrontendConfig         `yaml:"frontends"`
+	Tenants             []TenantConfig           `yaml:"tenants"`
+	Storage             conf.NamedMapConfig      `yaml:"storage"`
+	PreHooks            []middleware.HookConfig  `yaml:"prehooks"`
+	PostHooks           []middleware.HookConfig  `yaml:"posthooks"`
+	ResponseHooks       []middleware.HookConfig  `yaml:"responsehooks"`
+}
+
+// FrontendConfig is the configuration of single frontend.
+// Besides frontend's own configuration, it may specify
+// middleware chains, which replace corresponding top-level
+// chains for this frontend, and private mode.
+type FrontendConfig struct {
+	conf.NamedMapConfig `yaml:",inline"`
+	// Private overrides top-level Private for this frontend if set
+	Private       *bool                   `yaml:"private"`
+	PreHooks      []middleware.HookConfig `yaml:"prehooks"`
+	PostHooks     []middleware.HookConfig `yaml:"posthooks"`
+	ResponseHooks []middleware.HookConfig `yaml:"responsehooks"`
+}
+
+func (fc FrontendConfig) isPrivate(def bool) bool {
+	if fc.Private != nil {
+		return *fc.Private
+	}
+	return def
+}
+
+// hasOwnChain returns true if any of middleware chains is set.
+// Empty, but not nil chain (i.e. `prehooks: []`) disables
+// corresponding top-level chain.
+func (fc FrontendConfig) hasOwnChain() bool {
+	return fc.PreHooks != nil || fc.PostHooks != nil || fc.ResponseHooks != nil
+}
+
+// TenantConfig is the configuration of virtual tracker, served by
+// all frontends. Requests are matched by host and/or path prefix of
+// announce URL. Middleware chains and private mode are inherited from
+// top-level configuration unless set.
+type TenantConfig struct {
+	Name       string   `yaml:"name"`
+	Hosts      []string `yaml:"hosts"`
+	PathPrefix string   `yaml:"path_prefix"`
+	// Storage is the own peer storage of tenant. If not set, top-level
+	// storage is shared, but data and swarms are namespaced by tenant name.
+	Storage       *conf.NamedMapConfig    `yaml:"storage"`
+	Private       *bool                   `yaml:"private"`
+	PreHooks      []middleware.HookConfig `yaml:"prehooks"`
+	PostHooks     []middleware.HookConfig `yaml:"posthooks"`
+	ResponseHooks []middleware.HookConfig `yaml:"responsehooks"`
+}
+
+func (tc TenantConfig) isPrivate(def bool) bool {
+	if tc.Private != nil {
+		return *tc.Private
+	}
+	return def
+}
+
+// QuickConfig is the simple configuration for quick start without config file.
+// Includes in-memory store, http and udp frontends without any middleware.
+var QuickConfig = &Config{
+	Frontends: []FrontendConfig{
+		{
+			NamedMapConfig: conf.NamedMapConfig{
+				Name:   fh.Name,
+				Config: conf.MapConfig{},
+			},
+		},
+		{
+			NamedMapConfig: conf.NamedMapConfig{
+				Name:   fu.Name,
+				Config: conf.MapConfig{},
+			},
+		},
+	},
+	Storage: conf.NamedMapConfig{
+		Name:   sm.Name,
+		Config: conf.MapConfig{},
+	},
+	PreHooks:      []middleware.HookConfig{},
+	PostHooks:     []middleware.HookConfig{},
+	ResponseHooks: []middleware.HookConfig{},
+}
+
+// ParseConfigFile returns a new Config given the path to a YAML
+// configuration file.
+//
+// It supports relative and absolute paths and environment variables.
+func ParseConfigFile(path string) (*Config, error) {
+	return parseConfigFile(path, false)
+}
+
+// ParseConfigFileStrict is the same as ParseConfigFile,
+// but unknown fields are treated as errors.
+func ParseConfigFileStrict(path string) (*Config, error) {
+	return parseConfigFile(path, true)
+}
+
+// parseConfigFile decodes configuration file, if strict is set,
+// unknown fields are treated as errors
+func parseConfigFile(path string, strict bool) (*Config, error) {
+	if path == "" {
+		return nil, errors.New("no config path specified")
+	}
+
+	f, err := os.Open(os.ExpandEnv(path))
+	if err == nil {
+		defer f.Close()
+		cfgFile := new(Config)
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(strict)
+		err = dec.Decode(cfgFile)
+		return cfgFile, err
+	}
+	return nil, err
+}
@@ -0,0 +1,81 @@
+package mochitest
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// bdecode decodes bencoded value (BEP 3), whole input must be consumed.
+// Result is int64, string, []any or map[string]any.
+func bdecode(b []byte) (any, error) {
+	v, rest, err := bdecodeValue(b)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("%w: trailing data", ErrMalformedResponse)
+	}
+	return v, err
+}
+
+func bdecodeValue(b []byte) (v any, rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end of data", ErrMalformedResponse)
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return nil, nil, fmt.Errorf("%w: unterminated integer", ErrMalformedResponse)
+		}
+		var i int64
+		if i, err = strconv.ParseInt(string(b[1:end]), 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid integer", ErrMalformedResponse)
+		}
+		return i, b[end+1:], nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return nil, nil, fmt.Errorf("%w: unterminated string length", ErrMalformedResponse)
+		}
+		var l uint64
+		if l, err = strconv.ParseUint(string(b[:colon]), 10, 31); err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid string length", ErrMalformedResponse)
+		}
+		if b = b[colon+1:]; uint64(len(b)) < l {
+			return nil, nil, fmt.Errorf("%w: string exceeds data", ErrMalformedResponse)
+		}
+		return string(b[:l]), b[l:], nil
+	case c == 'l':
+		list := make([]any, 0)
+		for b = b[1:]; len(b) > 0 && b[0] != 'e'; {
+			if v, b, err = bdecodeValue(b); err != nil {
+				return
+			}
+			list = append(list, v)
+		}
+		if len(b) == 0 {
+			return nil, nil, fmt.Errorf("%w: unterminated list", ErrMalformedResponse)
+		}
+		return list, b[1:], nil
+	case c == 'd':
+		dict := make(map[string]any)
+		for b = b[1:]; len(b) > 0 && b[0] != 'e'; {
+			var k any
+			if k, b, err = bdecodeValue(b); err != nil {
+				return
+			}
+			key, isOk := k.(string)
+			if !isOk {
+				return nil, nil, fmt.Errorf("%w: non-string dictionary key", ErrMalformedResponse)
+			}
+			if dict[key], b, err = bdecodeValue(b); err != nil {
+				return
+			}
+		}
+		if len(b) == 0 {
+			return nil, nil, fmt.Errorf("%w: unterminated dictionary", ErrMalformedResponse)
+		}
+		return dict, b[1:], nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unexpected byte '%c'", ErrMalformedResponse, c)
+	}
+}
@@ -0,0 +1,324 @@
+package mochitest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	fh "github.com/sot-tech/mochi/frontend/http"
+)
+
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+	udpAnnounceLen    = 98
+)
+
+var (
+	// ErrMalformedResponse returned if tracker response could not be decoded
+	ErrMalformedResponse = errors.New("malformed response")
+
+	errTxIDMismatch = errors.New("transaction ID mismatch")
+
+	udpEvents = map[bittorrent.Event]uint32{
+		bittorrent.None:      0,
+		bittorrent.Completed: 1,
+		bittorrent.Started:   2,
+		bittorrent.Stopped:   3,
+	}
+)
+
+// Announce holds parameters of announce request.
+type Announce struct {
+	InfoHash bittorrent.InfoHash
+	PeerID   bittorrent.PeerID
+	Port     uint16
+	Left     uint64
+	Event    bittorrent.Event
+	// NumWant is the number of peers requested, zero means default
+	NumWant uint32
+	// Params are additional query parameters of HTTP announce (i.e. passkey)
+	Params url.Values
+}
+
+// AnnounceHTTP sends compact announce to HTTP frontend. Failure reason
+// returned by tracker is returned as bittorrent.ClientError.
+// Peer IDs of returned peers are not set.
+func (t *Tracker) AnnounceHTTP(a Announce) (*bittorrent.AnnounceResponse, error) {
+	q := url.Values{
+		"info_hash":  {a.InfoHash.RawString()},
+		"peer_id":    {string(a.PeerID[:])},
+		"port":       {strconv.FormatUint(uint64(a.Port), 10)},
+		"left":       {strconv.FormatUint(a.Left, 10)},
+		"uploaded":   {"0"},
+		"downloaded": {"0"},
+		"compact":    {"1"},
+	}
+	if a.Event != bittorrent.None {
+		q.Set("event", a.Event.String())
+	}
+	if a.NumWant > 0 {
+		q.Set("numwant", strconv.FormatUint(uint64(a.NumWant), 10))
+	}
+	for k, v := range a.Params {
+		q[k] = v
+	}
+	d, err := t.getHTTP(fh.DefaultAnnounceRoute, q)
+	if err != nil {
+		return nil, err
+	}
+	resp := &bittorrent.AnnounceResponse{
+		Interval:    time.Duration(intValue(d, "interval")) * time.Second,
+		MinInterval: time.Duration(intValue(d, "min interval")) * time.Second,
+		Complete:    uint32(intValue(d, "complete")),
+		Incomplete:  uint32(intValue(d, "incomplete")),
+	}
+	resp.WarningMessage, _ = d["warning message"].(string)
+	peers, _ := d["peers"].(string)
+	if resp.IPv4Peers, err = compactPeers([]byte(peers), net.IPv4len); err == nil {
+		peers, _ = d["peers6"].(string)
+		resp.IPv6Peers, err = compactPeers([]byte(peers), net.IPv6len)
+	}
+	return resp, err
+}
+
+// ScrapeHTTP sends scrape of provided info hashes to HTTP frontend.
+func (t *Tracker) ScrapeHTTP(infoHashes ...bittorrent.InfoHash) (*bittorrent.ScrapeResponse, error) {
+	q := make(url.Values)
+	for _, ih := range infoHashes {
+		q.Add("info_hash", ih.RawString())
+	}
+	d, err := t.getHTTP(fh.DefaultScrapeRoute, q)
+	if err != nil {
+		return nil, err
+	}
+	files, _ := d["files"].(map[string]any)
+	resp := new(bittorrent.ScrapeResponse)
+	for _, ih := range infoHashes {
+		f, _ := files[ih.RawString()].(map[string]any)
+		if reason, isOk := f["failure reason"].(string); isOk {
+			resp.Data = append(resp.Data, bittorrent.Scrape{InfoHash: ih, Failure: bittorrent.ClientError{Message: reason}})
+			continue
+		}
+		resp.Data = append(resp.Data, bittorrent.Scrape{
+			InfoHash:   ih,
+			Snatches:   uint32(intValue(f, "downloaded")),
+			Complete:   uint32(intValue(f, "complete")),
+			Incomplete: uint32(intValue(f, "incomplete")),
+		})
+	}
+	return resp, nil
+}
+
+// getHTTP sends request to HTTP frontend and returns decoded dictionary
+func (t *Tracker) getHTTP(route string, q url.Values) (map[string]any, error) {
+	c := http.Client{Timeout: Timeout}
+	r, err := c.Get("http://" + t.HTTPAddr + route + "?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", r.Status)
+	}
+	v, err := bdecode(body)
+	if err != nil {
+		return nil, err
+	}
+	d, isOk := v.(map[string]any)
+	if !isOk {
+		return nil, fmt.Errorf("%w: top-level value is not a dictionary", ErrMalformedResponse)
+	}
+	if reason, isOk := d["failure reason"].(string); isOk {
+		code, _ := d["failure code"].(string)
+		return nil, bittorrent.NewClientError(code, reason)
+	}
+	return d, nil
+}
+
+func intValue(d map[string]any, key string) int64 {
+	v, _ := d[key].(int64)
+	return v
+}
+
+func compactPeers(b []byte, ipLen int) (peers bittorrent.Peers, err error) {
+	if len(b)%(ipLen+2) != 0 {
+		return nil, fmt.Errorf("%w: invalid compact peers length %d", ErrMalformedResponse, len(b))
+	}
+	for ; len(b) > 0; b = b[ipLen+2:] {
+		addr, _ := netip.AddrFromSlice(b[:ipLen])
+		peers = append(peers, bittorrent.Peer{
+			AddrPort: netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b[ipLen:])),
+		})
+	}
+	return
+}
+
+// AnnounceUDP connects to UDP frontend and sends announce (BEP 15).
+// Error message returned by tracker is returned as bittorrent.ClientError.
+// Announce.Params are not sent.
+func (t *Tracker) AnnounceUDP(a Announce) (*bittorrent.AnnounceResponse, error) {
+	c, err := dialUDP(t.UDPAddr, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	req := c.header(udpAnnounceLen, udpActionAnnounce)
+	req = append(req, a.InfoHash.TruncateV1().RawString()...)
+	req = append(req, a.PeerID[:]...)
+	req = binary.BigEndian.AppendUint64(req, 0)
+	req = binary.BigEndian.AppendUint64(req, a.Left)
+	req = binary.BigEndian.AppendUint64(req, 0)
+	req = binary.BigEndian.AppendUint32(req, udpEvents[a.Event])
+	// IP address and key
+	req = binary.BigEndian.AppendUint64(req, 0)
+	numWant := uint32(math.MaxUint32)
+	if a.NumWant > 0 {
+		numWant = a.NumWant
+	}
+	req = binary.BigEndian.AppendUint32(req, numWant)
+	req = binary.BigEndian.AppendUint16(req, a.Port)
+	b, err := c.exchange(req, udpActionAnnounce)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 12 {
+		return nil, fmt.Errorf("%w: announce response too short", ErrMalformedResponse)
+	}
+	resp := &bittorrent.AnnounceResponse{
+		Interval:   time.Duration(binary.BigEndian.Uint32(b)) * time.Second,
+		Incomplete: binary.BigEndian.Uint32(b[4:]),
+		Complete:   binary.BigEndian.Uint32(b[8:]),
+	}
+	ipLen := net.IPv4len
+	if netip.MustParseAddrPort(c.RemoteAddr().String()).Addr().Is6() {
+		ipLen = net.IPv6len
+	}
+	peers, err := compactPeers(b[12:], ipLen)
+	if ipLen == net.IPv4len {
+		resp.IPv4Peers = peers
+	} else {
+		resp.IPv6Peers = peers
+	}
+	return resp, err
+}
+
+// ScrapeUDP connects to UDP frontend and sends scrape
+// of provided info hashes (BEP 15).
+func (t *Tracker) ScrapeUDP(infoHashes ...bittorrent.InfoHash) (*bittorrent.ScrapeResponse, error) {
+	c, err := dialUDP(t.UDPAddr, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	req := c.header(16+len(infoHashes)*bittorrent.InfoHashV1Len, udpActionScrape)
+	for _, ih := range infoHashes {
+		req = append(req, ih.TruncateV1().RawString()...)
+	}
+	b, err := c.exchange(req, udpActionScrape)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != len(infoHashes)*12 {
+		return nil, fmt.Errorf("%w: invalid scrape response length %d", ErrMalformedResponse, len(b))
+	}
+	resp := new(bittorrent.ScrapeResponse)
+	for i, ih := range infoHashes {
+		s := b[i*12:]
+		resp.Data = append(resp.Data, bittorrent.Scrape{
+			InfoHash:   ih,
+			Complete:   binary.BigEndian.Uint32(s),
+			Snatches:   binary.BigEndian.Uint32(s[4:]),
+			Incomplete: binary.BigEndian.Uint32(s[8:]),
+		})
+	}
+	return resp, nil
+}
+
+// udpConn is the UDP connection with obtained connection ID
+type udpConn struct {
+	net.Conn
+	timeout time.Duration
+	connID  uint64
+	txID    uint32
+}
+
+// dialUDP opens connection to UDP frontend and obtains connection ID
+func dialUDP(addr string, timeout time.Duration) (*udpConn, error) {
+	nc, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &udpConn{Conn: nc, timeout: timeout}
+	req := c.header(16, udpActionConnect)
+	// connect request holds protocol ID instead of connection ID
+	binary.BigEndian.PutUint64(req, udpProtocolID)
+	b, err := c.exchange(req, udpActionConnect)
+	if err == nil && len(b) != 8 {
+		err = fmt.Errorf("%w: invalid connect response length %d", ErrMalformedResponse, len(b))
+	}
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	c.connID = binary.BigEndian.Uint64(b)
+	return c, nil
+}
+
+// header returns request with connection ID, action and new transaction ID
+func (c *udpConn) header(size int, action uint32) []byte {
+	var txID [4]byte
+	_, _ = rand.Read(txID[:])
+	c.txID = binary.BigEndian.Uint32(txID[:])
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint64(b, c.connID)
+	b = binary.BigEndian.AppendUint32(b, action)
+	return binary.BigEndian.AppendUint32(b, c.txID)
+}
+
+// exchange sends request and returns response payload after
+// action and transaction ID if action matches expected one
+func (c *udpConn) exchange(req []byte, action uint32) ([]byte, error) {
+	if err := c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2048)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 8 {
+		return nil, fmt.Errorf("%w: response too short", ErrMalformedResponse)
+	}
+	if binary.BigEndian.Uint32(buf[4:]) != c.txID {
+		return nil, errTxIDMismatch
+	}
+	switch a := binary.BigEndian.Uint32(buf); a {
+	case action:
+		return buf[8:n], nil
+	case udpActionError:
+		return nil, bittorrent.ClientError{Message: string(buf[8:n])}
+	default:
+		return nil, fmt.Errorf("%w: unexpected action %d", ErrMalformedResponse, a)
+	}
+}
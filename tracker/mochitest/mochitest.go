@@ -0,0 +1,120 @@
+// Package mochitest provides utilities for integration testing with MoChi:
+// it starts in-process tracker with in-memory storage and HTTP and UDP
+// frontends on random local ports and sends announces and scrapes to it.
+package mochitest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	fh "github.com/sot-tech/mochi/frontend/http"
+	fu "github.com/sot-tech/mochi/frontend/udp"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	sm "github.com/sot-tech/mochi/storage/memory"
+	"github.com/sot-tech/mochi/tracker"
+)
+
+const (
+	// AnnounceInterval is the announce interval of started tracker
+	AnnounceInterval = 30 * time.Minute
+	// MinAnnounceInterval is the minimal announce interval of started tracker
+	MinAnnounceInterval = 15 * time.Minute
+
+	// Timeout is the time to wait for response of tracker
+	Timeout = 2 * time.Second
+)
+
+// Tracker is the running tracker instance.
+type Tracker struct {
+	*tracker.Tracker
+	// HTTPAddr is the address of HTTP frontend (host:port)
+	HTTPAddr string
+	// UDPAddr is the address of UDP frontend (host:port)
+	UDPAddr string
+}
+
+// Config returns configuration of tracker with memory storage and
+// HTTP and UDP frontends listening on httpAddr and udpAddr.
+func Config(httpAddr, udpAddr string) *tracker.Config {
+	return &tracker.Config{
+		AnnounceInterval:    AnnounceInterval,
+		MinAnnounceInterval: MinAnnounceInterval,
+		Frontends: []tracker.FrontendConfig{
+			{NamedMapConfig: conf.NamedMapConfig{Name: fh.Name, Config: conf.MapConfig{"addr": httpAddr}}},
+			{NamedMapConfig: conf.NamedMapConfig{Name: fu.Name, Config: conf.MapConfig{"addr": udpAddr}}},
+		},
+		Storage:       conf.NamedMapConfig{Name: sm.Name, Config: conf.MapConfig{}},
+		PreHooks:      []middleware.HookConfig{},
+		PostHooks:     []middleware.HookConfig{},
+		ResponseHooks: []middleware.HookConfig{},
+	}
+}
+
+// New starts tracker configured with Config on free local ports and waits
+// until frontends accept requests. Provided functions may modify configuration
+// before start (i.e. add hooks). Tracker is stopped on test cleanup.
+func New(tb testing.TB, configure ...func(cfg *tracker.Config)) *Tracker {
+	tb.Helper()
+	t := &Tracker{HTTPAddr: freeAddr(tb, "tcp"), UDPAddr: freeAddr(tb, "udp")}
+	cfg := Config(t.HTTPAddr, t.UDPAddr)
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	var err error
+	if t.Tracker, err = tracker.New(cfg); err != nil {
+		tb.Fatal(err)
+	}
+	if err = t.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(t.Stop)
+
+	deadline := time.Now().Add(Timeout)
+	for {
+		if err = t.ping(); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		tb.Fatal("tracker not started: ", err)
+	}
+	return t
+}
+
+// ping checks if both frontends accept requests
+func (t *Tracker) ping() error {
+	c, err := net.DialTimeout("tcp", t.HTTPAddr, Timeout)
+	if err != nil {
+		return err
+	}
+	_ = c.Close()
+	u, err := dialUDP(t.UDPAddr, 100*time.Millisecond)
+	if err == nil {
+		_ = u.Close()
+	}
+	return err
+}
+
+// freeAddr returns local address with port, which is not used at the moment
+func freeAddr(tb testing.TB, network string) (addr string) {
+	tb.Helper()
+	if network == "udp" {
+		c, err := net.ListenPacket(network, "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		addr = c.LocalAddr().String()
+		_ = c.Close()
+	} else {
+		l, err := net.Listen(network, "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		addr = l.Addr().String()
+		_ = l.Close()
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package mochitest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/clientapproval"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/tracker"
+)
+
+var (
+	ih     = bittorrent.InfoHash("00000000000000000001")
+	seeder = bittorrent.PeerID{'-', 'T', 'R', '3', '0', '0', '0', '-', 1}
+	leech  = bittorrent.PeerID{'-', 'T', 'R', '3', '0', '0', '0', '-', 2}
+)
+
+func TestAnnounceScrape(t *testing.T) {
+	tr := New(t)
+
+	resp, err := tr.AnnounceHTTP(Announce{InfoHash: ih, PeerID: seeder, Port: 6881, Event: bittorrent.Started})
+	require.NoError(t, err)
+	require.Equal(t, AnnounceInterval, resp.Interval)
+	require.Equal(t, MinAnnounceInterval, resp.MinInterval)
+
+	require.Eventually(t, func() bool {
+		resp, err = tr.AnnounceUDP(Announce{InfoHash: ih, PeerID: leech, Port: 6882, Left: 1, Event: bittorrent.Started})
+		return err == nil && len(resp.IPv4Peers) == 1
+	}, Timeout, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, uint16(6881), resp.IPv4Peers[0].AddrPort.Port())
+	require.Equal(t, AnnounceInterval, resp.Interval)
+
+	require.Eventually(t, func() bool {
+		var sr *bittorrent.ScrapeResponse
+		sr, err = tr.ScrapeHTTP(ih)
+		return err == nil && sr.Data[0].Complete == 1 && sr.Data[0].Incomplete == 1
+	}, Timeout, 10*time.Millisecond)
+	require.NoError(t, err)
+	sr, err := tr.ScrapeUDP(ih)
+	require.NoError(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1, Incomplete: 1}, sr.Data[0])
+
+	leechers, seeders, _, err := tr.Storage().ScrapeSwarm(context.Background(), ih)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), seeders)
+	require.Equal(t, uint32(1), leechers)
+}
+
+func TestFailure(t *testing.T) {
+	tr := New(t, func(cfg *tracker.Config) {
+		cfg.PreHooks = []middleware.HookConfig{{NamedMapConfig: conf.NamedMapConfig{
+			Name:   clientapproval.Name,
+			Config: conf.MapConfig{"client_id_list": []string{"XX0000"}},
+		}}}
+	})
+	var ce bittorrent.ClientError
+	_, err := tr.AnnounceHTTP(Announce{InfoHash: ih, PeerID: seeder, Port: 6881})
+	require.True(t, errors.As(err, &ce), err)
+	require.Equal(t, bittorrent.ReasonUnapprovedClient, ce.Code)
+	_, err = tr.AnnounceUDP(Announce{InfoHash: ih, PeerID: seeder, Port: 6881})
+	require.True(t, errors.As(err, &ce), err)
+}
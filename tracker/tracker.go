@@ -0,0 +1,505 @@
+// Package tracker contains top-level logic of MoChi server: it creates
+// storage, middleware chains and frontends from configuration and manages
+// their lifecycle, so MoChi might be embedded into another program.
+//
+// Only HTTP and UDP frontends and memory storage are registered by this
+// package, other storages and middleware must be registered with blank
+// imports of their packages (see cmd/mochi/config.go).
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/sot-tech/mochi/frontend"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/private"
+	"github.com/sot-tech/mochi/pkg/admin"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/export"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/pkg/ops"
+	"github.com/sot-tech/mochi/pkg/replica"
+	"github.com/sot-tech/mochi/pkg/takedown"
+	"github.com/sot-tech/mochi/pkg/tunable"
+	"github.com/sot-tech/mochi/storage"
+)
+
+const defaultDrainTimeout = 10 * time.Second
+
+// Tracker represents the state of an instance.
+type Tracker struct {
+	cfg *Config
+	// trackers BitTorrent frontends, drained before shutdown
+	trackers     []frontend.Frontend
+	drainTimeout time.Duration
+	frontends    []io.Closer
+	hooks        []middleware.Hook
+	storage      storage.PeerStorage
+	// tenantStorages are own storages of tenants
+	tenantStorages []io.Closer
+	logics         []*middleware.Logic
+	allLogics      []*middleware.Logic
+	stores         []storage.PeerStorage
+	started        bool
+	onceStopper    sync.Once
+}
+
+// New creates storage and middleware chains of tracker configured with cfg.
+// Frontends and auxiliary servers are not started until Start is called.
+// If error returned, all created resources are released.
+func New(cfg *Config) (t *Tracker, err error) {
+	t = &Tracker{cfg: cfg}
+	defer func() {
+		if err != nil {
+			t.Stop()
+			t = nil
+		}
+	}()
+	if t.drainTimeout = cfg.DrainTimeout; t.drainTimeout <= 0 {
+		t.drainTimeout = defaultDrainTimeout
+		log.Warn().
+			Str("name", "DrainTimeout").
+			Dur("provided", cfg.DrainTimeout).
+			Dur("default", t.drainTimeout).
+			Msg("falling back to default configuration")
+	}
+
+	// runtime parameters and replicated sets are registered by hooks
+	// and tracker itself, previous ones are dropped
+	tunable.Reset()
+	replica.Reset()
+
+	t.storage, err = storage.NewPeerStorage(cfg.Storage)
+	if err != nil {
+		return t, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	if len(cfg.Frontends) == 0 {
+		return t, errors.New("no frontends configured")
+	}
+
+	anyPrivate := cfg.Private
+	for _, fc := range cfg.Frontends {
+		anyPrivate = anyPrivate || fc.isPrivate(cfg.Private)
+	}
+	for _, tc := range cfg.Tenants {
+		anyPrivate = anyPrivate || tc.isPrivate(cfg.Private)
+	}
+	if anyPrivate && cfg.MinAnnounceInterval <= 0 {
+		log.Warn().
+			Str("name", "MinAnnounceInterval").
+			Dur("provided", cfg.MinAnnounceInterval).
+			Dur("default", cfg.AnnounceInterval).
+			Msg("falling back to default configuration")
+		cfg.MinAnnounceInterval = cfg.AnnounceInterval
+	}
+
+	// hooks must be created before admin server, so
+	// all chains are built before starting frontends
+	var global *middleware.Logic
+	t.logics = make([]*middleware.Logic, len(cfg.Frontends))
+	for i := range cfg.Frontends {
+		fc := &cfg.Frontends[i]
+		private := fc.isPrivate(cfg.Private)
+		if private {
+			if fc.Config == nil {
+				fc.Config = conf.MapConfig{}
+			}
+			fc.Config["allow_ip_spoofing"] = false
+		}
+		if !fc.hasOwnChain() && private == cfg.Private {
+			if global == nil {
+				if global, err = t.newLogic("", t.storage, cfg.Private, cfg.PreHooks, cfg.PostHooks, cfg.ResponseHooks); err != nil {
+					return t, err
+				}
+			}
+			t.logics[i] = global
+			continue
+		}
+		pre, post, response := cfg.PreHooks, cfg.PostHooks, cfg.ResponseHooks
+		if fc.PreHooks != nil {
+			pre = fc.PreHooks
+		}
+		if fc.PostHooks != nil {
+			post = fc.PostHooks
+		}
+		if fc.ResponseHooks != nil {
+			response = fc.ResponseHooks
+		}
+		// admin handlers of own chain are served with prefix of frontend
+		prefix := "/frontends/" + fc.Name
+		if len(fc.Name) == 0 {
+			prefix = "/frontends/" + strconv.Itoa(i)
+		}
+		if t.logics[i], err = t.newLogic(prefix, t.storage, private, pre, post, response); err != nil {
+			return t, fmt.Errorf("frontend #%d (%s): %w", i, fc.Name, err)
+		}
+	}
+
+	var tenants []middleware.Tenant
+	if tenants, t.stores, err = t.newTenants(); err != nil {
+		return t, err
+	}
+	t.allLogics = uniqueLogics(t.logics)
+	for _, l := range t.allLogics {
+		if err = l.SetTenants(tenants...); err != nil {
+			return t, fmt.Errorf("failed to configure tenants: %w", err)
+		}
+	}
+	for _, tn := range tenants {
+		t.allLogics = append(t.allLogics, tn.Logic)
+	}
+	t.registerTunables()
+	if cfg.Tunables.Persist {
+		if err = tunable.Restore(context.Background(), t.storage); err != nil {
+			return t, fmt.Errorf("failed to restore runtime parameters: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// Start starts metrics, admin and other auxiliary servers and
+// BitTorrent frontends. Start must be called only once.
+// If error returned, tracker is stopped.
+func (t *Tracker) Start() (err error) {
+	if t.started {
+		return errors.New("tracker already started")
+	}
+	t.started = true
+	defer func() {
+		if err != nil {
+			t.Stop()
+		}
+	}()
+	cfg := t.cfg
+	if len(cfg.MetricsAddr) > 0 {
+		log.Info().Str("addr", cfg.MetricsAddr).Msg("starting metrics server")
+		t.frontends = append(t.frontends, metrics.NewServer(cfg.MetricsAddr))
+	} else {
+		log.Info().Msg("metrics disabled because of empty address")
+	}
+
+	if len(cfg.StatsD.Addr) > 0 {
+		log.Info().Str("addr", cfg.StatsD.Addr).Msg("starting statsd exporter")
+		var e *metrics.StatsDExporter
+		if e, err = metrics.NewStatsDExporter(cfg.StatsD); err != nil {
+			return fmt.Errorf("failed to start statsd exporter: %w", err)
+		}
+		t.frontends = append(t.frontends, e)
+	}
+
+	if len(cfg.Ops.Addr) > 0 {
+		log.Info().Str("addr", cfg.Ops.Addr).Msg("starting ops server")
+		var s *ops.Server
+		if s, err = ops.NewServer(cfg.Ops); err != nil {
+			return fmt.Errorf("failed to start ops server: %w", err)
+		}
+		t.frontends = append(t.frontends, s)
+	}
+
+	if cfg.Export.Enabled() {
+		if cfg.Export.Endpoint && len(cfg.Ops.Addr) == 0 {
+			return errors.New("export endpoint requires ops server")
+		}
+		log.Info().Str("path", cfg.Export.Path).Bool("endpoint", cfg.Export.Endpoint).Msg("starting swarms export")
+		var e *export.Exporter
+		if e, err = export.NewExporter(cfg.Export, t.storage); err != nil {
+			return fmt.Errorf("failed to start swarms export: %w", err)
+		}
+		if cfg.Export.Endpoint {
+			ops.SetSwarmExport(e.Export)
+		}
+		t.frontends = append(t.frontends, e)
+	}
+
+	if len(cfg.AdminAddr) > 0 {
+		admin.Handle(http.MethodDelete, "/data", middleware.EraseHandler(t.stores, t.allLogics...))
+		admin.HandlePrivileged(http.MethodGet, "/trace/announce", middleware.TraceHandler(t.logics...))
+		// handlers of process-global sets and parameters are not prefixed
+		replica.RegisterHandlers()
+		tunable.RegisterHandlers()
+		var l *admin.AuditLog
+		if l, err = admin.ConfigureAudit(cfg.AdminAudit, t.storage); err != nil {
+			return fmt.Errorf("failed to configure admin audit log: %w", err)
+		}
+		if l != nil {
+			t.frontends = append(t.frontends, l)
+		}
+		log.Info().Str("addr", cfg.AdminAddr).Msg("starting admin server")
+		var s *admin.Server
+		if s, err = admin.NewServer(cfg.AdminAddr, cfg.AdminAuth); err != nil {
+			return fmt.Errorf("failed to start admin server: %w", err)
+		}
+		t.frontends = append(t.frontends, s)
+	}
+
+	if len(cfg.Replication.Peers) > 0 {
+		if len(cfg.AdminAddr) == 0 {
+			return errors.New("replication requires admin_addr to serve peers")
+		}
+		log.Info().Strs("peers", cfg.Replication.Peers).Msg("starting replication of lists")
+		t.frontends = append(t.frontends, replica.NewSyncer(cfg.Replication))
+	}
+
+	if cfg.Takedown.Enabled() {
+		log.Info().Str("set", cfg.Takedown.Set).Str("url", cfg.Takedown.URL).Str("subject", cfg.Takedown.NATS.Subject).Msg("starting takedown feed")
+		var s *takedown.Subscriber
+		if s, err = takedown.NewSubscriber(cfg.Takedown); err != nil {
+			return fmt.Errorf("failed to start takedown feed: %w", err)
+		}
+		t.frontends = append(t.frontends, s)
+	}
+
+	if err = frontend.ConfigureErrors(cfg.ClientErrors); err != nil {
+		return fmt.Errorf("failed to configure client errors: %w", err)
+	}
+	if err = frontend.ConfigureAdmission(cfg.Admission); err != nil {
+		return fmt.Errorf("failed to configure admission control: %w", err)
+	}
+	for i, fc := range cfg.Frontends {
+		var f frontend.Frontend
+		if f, err = frontend.NewFrontend(fc.NamedMapConfig, t.logics[i]); err != nil {
+			return fmt.Errorf("failed to configure frontends: %w", err)
+		}
+		t.trackers = append(t.trackers, f)
+	}
+
+	return nil
+}
+
+// Storage returns shared peer storage of tracker.
+func (t *Tracker) Storage() storage.PeerStorage {
+	return t.storage
+}
+
+// Hooks returns all middleware hooks created for
+// frontends and tenants, including private mode hooks.
+func (t *Tracker) Hooks() []middleware.Hook {
+	return slices.Clone(t.hooks)
+}
+
+// Logics returns tracker logics of frontends (without duplicates)
+// and tenants, which might be used to process requests directly.
+func (t *Tracker) Logics() []*middleware.Logic {
+	return slices.Clone(t.allLogics)
+}
+
+// Frontends returns started BitTorrent frontends.
+func (t *Tracker) Frontends() []frontend.Frontend {
+	return slices.Clone(t.trackers)
+}
+
+// uniqueLogics returns logics without duplicates,
+// since frontends may share the same logic
+func uniqueLogics(logics []*middleware.Logic) (out []*middleware.Logic) {
+	for _, l := range logics {
+		if !slices.Contains(out, l) {
+			out = append(out, l)
+		}
+	}
+	return
+}
+
+// newTenants creates logics of virtual trackers and returns them
+// with all peer storages: shared and own storages of tenants
+func (t *Tracker) newTenants() ([]middleware.Tenant, []storage.PeerStorage, error) {
+	cfg := t.cfg
+	stores := []storage.PeerStorage{t.storage}
+	tenants := make([]middleware.Tenant, 0, len(cfg.Tenants))
+	names := make(map[string]bool, len(cfg.Tenants))
+	for i, tc := range cfg.Tenants {
+		if names[tc.Name] {
+			return nil, nil, fmt.Errorf("tenant #%d: duplicate name '%s'", i, tc.Name)
+		}
+		names[tc.Name] = true
+		var st storage.PeerStorage
+		if tc.Storage != nil {
+			var err error
+			if st, err = storage.NewPeerStorage(*tc.Storage); err != nil {
+				return nil, nil, fmt.Errorf("tenant #%d (%s): failed to create storage: %w", i, tc.Name, err)
+			}
+			t.tenantStorages = append(t.tenantStorages, st)
+			stores = append(stores, st)
+		} else {
+			st = storage.Namespace(t.storage, tc.Name)
+		}
+		pre, post, response := cfg.PreHooks, cfg.PostHooks, cfg.ResponseHooks
+		if tc.PreHooks != nil {
+			pre = tc.PreHooks
+		}
+		if tc.PostHooks != nil {
+			post = tc.PostHooks
+		}
+		if tc.ResponseHooks != nil {
+			response = tc.ResponseHooks
+		}
+		l, err := t.newLogic("/tenants/"+tc.Name, st, tc.isPrivate(cfg.Private), pre, post, response)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tenant #%d (%s): %w", i, tc.Name, err)
+		}
+		tenants = append(tenants, middleware.Tenant{
+			Name:       tc.Name,
+			Hosts:      tc.Hosts,
+			PathPrefix: tc.PathPrefix,
+			Logic:      l,
+		})
+		log.Info().Str("name", tc.Name).Strs("hosts", tc.Hosts).Str("pathPrefix", tc.PathPrefix).
+			Bool("ownStorage", tc.Storage != nil).Msg("tenant configured")
+	}
+	return tenants, stores, nil
+}
+
+// newLogic creates hooks chain and tracker logic,
+// which uses this chain and st. Admin handlers of hooks
+// are registered with prefix (see admin.Group).
+func (t *Tracker) newLogic(prefix string, st storage.PeerStorage, private bool, pre, post, response []middleware.HookConfig) (l *middleware.Logic, err error) {
+	err = admin.Group(prefix, func() (err error) {
+		l, err = t.buildLogic(st, private, pre, post, response)
+		return
+	})
+	return
+}
+
+// buildLogic creates hooks chain and tracker logic, see newLogic
+func (t *Tracker) buildLogic(st storage.PeerStorage, private bool, pre, post, response []middleware.HookConfig) (*middleware.Logic, error) {
+	cfg := t.cfg
+	preHooks, err := middleware.NewHooks(pre, st)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure pre-hooks: %w", err)
+	}
+
+	if private {
+		if preHooks, err = applyPrivate(cfg, preHooks, st); err != nil {
+			return nil, fmt.Errorf("failed to configure private mode: %w", err)
+		}
+	}
+	t.hooks = append(t.hooks, preHooks...)
+
+	postHooks, err := middleware.NewHooks(post, st)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure post-hooks: %w", err)
+	}
+	t.hooks = append(t.hooks, postHooks...)
+
+	responseHooks, err := middleware.NewHooks(response, st)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure response hooks: %w", err)
+	}
+	t.hooks = append(t.hooks, responseHooks...)
+
+	l := middleware.NewLogic(cfg.AnnounceInterval, cfg.MinAnnounceInterval, st, preHooks, postHooks, responseHooks)
+	l.SetStoppedGracePeriod(cfg.StoppedGracePeriod)
+	l.SetScrapeCacheTTL(cfg.ScrapeCacheTTL)
+	return l, nil
+}
+
+// applyPrivate checks if announces are authenticated by any of pre hooks
+// and prepends private middleware, which enforces minimal announce interval
+// and rejects scrapes if they are not authenticated.
+func applyPrivate(cfg *Config, preHooks []middleware.Hook, st storage.PeerStorage) ([]middleware.Hook, error) {
+	announce, scrape := middleware.Authenticates(preHooks)
+	if !announce {
+		return nil, errors.New("no pre hook authenticates announces")
+	}
+	if !scrape {
+		log.Warn().Msg("no pre hook authenticates scrapes, scrape disabled")
+	}
+	ph, err := middleware.NewHooks([]middleware.HookConfig{{
+		NamedMapConfig: conf.NamedMapConfig{
+			Name: private.Name,
+			Config: conf.MapConfig{
+				"min_interval": cfg.MinAnnounceInterval,
+				"allow_scrape": scrape,
+			},
+		},
+	}}, st)
+	if err != nil {
+		return nil, err
+	}
+	return append(ph, preHooks...), nil
+}
+
+// Stop shuts down an instance of Tracker.
+// BitTorrent frontends stop accepting new requests and
+// process in-flight ones within drain timeout, then
+// other servers, middleware and storage are closed,
+// so pending data is flushed. Repeated calls do nothing.
+func (t *Tracker) Stop() {
+	t.onceStopper.Do(t.stop)
+}
+
+func (t *Tracker) stop() {
+	log.Debug().Dur("timeout", t.drainTimeout).Msg("draining frontends")
+	drainGroup(t.trackers, t.drainTimeout).Msg("frontends drained")
+
+	log.Debug().Msg("stopping metrics and admin servers")
+	closeGroup(t.frontends).Msg("servers stopped")
+
+	log.Debug().Msg("stopping middleware")
+	var closers []io.Closer
+	for _, h := range t.hooks {
+		if c, isOk := h.(io.Closer); isOk {
+			closers = append(closers, c)
+		}
+	}
+	closeGroup(closers).Msg("hooks stopped")
+
+	if t.storage != nil {
+		log.Debug().Msg("stopping peer store")
+		log.Err(t.storage.Close()).Msg("peer store stopped")
+	}
+	if len(t.tenantStorages) > 0 {
+		closeGroup(t.tenantStorages).Msg("tenant peer stores stopped")
+	}
+}
+
+func drainGroup(fs []frontend.Frontend, timeout time.Duration) *zerolog.Event {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return runGroup(len(fs), func(i int) error {
+		return fs[i].Drain(ctx)
+	})
+}
+
+func closeGroup(cls []io.Closer) *zerolog.Event {
+	return runGroup(len(cls), func(i int) error {
+		return cls[i].Close()
+	})
+}
+
+func runGroup(l int, fn func(i int) error) *zerolog.Event {
+	errs := make([]error, l)
+	wg := sync.WaitGroup{}
+	wg.Add(l)
+	for i := 0; i < l; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	nnErrs := make([]error, 0, l)
+	for _, e := range errs {
+		if e != nil {
+			nnErrs = append(nnErrs, e)
+		}
+	}
+	var evt *zerolog.Event
+	if len(nnErrs) > 0 {
+		evt = log.Error().Errs("errors", nnErrs)
+	} else {
+		evt = log.Info()
+	}
+	return evt
+}
@@ -0,0 +1,159 @@
+package tracker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	fh "github.com/sot-tech/mochi/frontend/http"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/blocklist"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/tunable"
+	sm "github.com/sot-tech/mochi/storage/memory"
+)
+
+func testConfig() *Config {
+	return &Config{
+		Frontends: []FrontendConfig{{
+			NamedMapConfig: conf.NamedMapConfig{
+				Name:   fh.Name,
+				Config: conf.MapConfig{"addr": "127.0.0.1:0"},
+			},
+		}},
+		Storage: conf.NamedMapConfig{Name: sm.Name, Config: conf.MapConfig{}},
+	}
+}
+
+func TestNew(t *testing.T) {
+	cfg := testConfig()
+	cfg.Frontends = nil
+	tr, err := New(cfg)
+	require.Error(t, err)
+	require.Nil(t, tr)
+
+	cfg = testConfig()
+	cfg.PreHooks = []middleware.HookConfig{{NamedMapConfig: conf.NamedMapConfig{Name: "no such hook"}}}
+	_, err = New(cfg)
+	require.Error(t, err)
+}
+
+func TestTracker(t *testing.T) {
+	tr, err := New(testConfig())
+	require.NoError(t, err)
+	require.NotNil(t, tr.Storage())
+	require.Empty(t, tr.Frontends())
+	require.Len(t, tr.Logics(), 1)
+
+	// storage is available before frontends started
+	ih := bittorrent.InfoHash("00000000000000000001")
+	peer := bittorrent.Peer{
+		ID:       bittorrent.PeerID{1},
+		AddrPort: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), 6881),
+	}
+	require.NoError(t, tr.Storage().PutSeeder(context.Background(), ih, peer))
+
+	require.NoError(t, tr.Start())
+	require.Error(t, tr.Start())
+	require.Len(t, tr.Frontends(), 1)
+
+	_, resp, err := tr.Logics()[0].HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		Left:     1,
+		NumWant:  10,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{2},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.2")}},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), resp.Complete)
+
+	tr.Stop()
+	tr.Stop()
+}
+
+func TestTunables(t *testing.T) {
+	cfg := testConfig()
+	cfg.AnnounceInterval, cfg.MinAnnounceInterval = 30*time.Minute, 15*time.Minute
+	cfg.Tunables.Persist = true
+	tr, err := New(cfg)
+	require.NoError(t, err)
+	defer tr.Stop()
+	l := tr.Logics()[0]
+
+	_, err = tunable.Set(context.Background(), "announce_interval", "10m", "test")
+	require.ErrorIs(t, err, tunable.ErrInvalidValue)
+	_, err = tunable.Set(context.Background(), "min_announce_interval", "5m", "test")
+	require.NoError(t, err)
+	_, err = tunable.Set(context.Background(), "announce_interval", "10m", "test")
+	require.NoError(t, err)
+	interval, minInterval := l.Intervals()
+	require.Equal(t, 10*time.Minute, interval)
+	require.Equal(t, 5*time.Minute, minInterval)
+
+	_, err = tunable.Set(context.Background(), "max_numwant", "5", "test")
+	require.NoError(t, err)
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("00000000000000000001"),
+		NumWant:  10,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID{1},
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}},
+		},
+	}
+	_, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), req.NumWant)
+	require.Equal(t, 10*time.Minute, resp.Interval)
+
+	level := log.Level()
+	_, err = tunable.Set(context.Background(), "log_level", "invalid", "test")
+	require.ErrorIs(t, err, tunable.ErrInvalidValue)
+	_, err = tunable.Unset(context.Background(), "log_level", "test")
+	require.NoError(t, err)
+	require.Equal(t, level, log.Level())
+
+	// changed values are persisted
+	b, err := tr.Storage().Load(context.Background(), tunable.StorageCtx, "announce_interval")
+	require.NoError(t, err)
+	require.Equal(t, "10m0s", string(b))
+}
+
+func TestGlobalAdminHandlers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	// replicated set is created in the chain with admin prefix
+	cfg := testConfig()
+	cfg.AdminAddr = addr
+	cfg.Frontends[0].PreHooks = []middleware.HookConfig{{NamedMapConfig: conf.NamedMapConfig{
+		Name:   blocklist.Name,
+		Config: conf.MapConfig{"replica": "global_handlers"},
+	}}}
+	tr, err := New(cfg)
+	require.NoError(t, err)
+	defer tr.Stop()
+	require.NoError(t, tr.Start())
+
+	for _, path := range []string{"/sync/global_handlers", "/lists/global_handlers", "/tunables"} {
+		var resp *http.Response
+		require.Eventually(t, func() bool {
+			resp, err = http.Get("http://" + addr + path)
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
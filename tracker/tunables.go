@@ -0,0 +1,71 @@
+package tracker
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/tunable"
+)
+
+var (
+	errInvalidInterval    = errors.New("announce interval must be positive and not less than minimal interval")
+	errInvalidMinInterval = errors.New("minimal announce interval must not be negative or greater than announce interval")
+	errInvalidNumWant     = errors.New("numwant limit is too large")
+)
+
+// registerTunables registers runtime parameters of tracker,
+// which are applied to all logics
+func (t *Tracker) registerTunables() {
+	tunable.Register(tunable.Param{
+		Name: "log_level",
+		Help: "default logging level",
+		Get:  log.Level,
+		Set:  log.SetLevel,
+	})
+	intervals := func() (time.Duration, time.Duration) {
+		return t.allLogics[0].Intervals()
+	}
+	tunable.Register(tunable.Duration("announce_interval", "announce interval returned to clients",
+		func() time.Duration {
+			interval, _ := intervals()
+			return interval
+		},
+		func(d time.Duration) error {
+			if _, minInterval := intervals(); d <= 0 || d < minInterval {
+				return errInvalidInterval
+			}
+			for _, l := range t.allLogics {
+				_, minInterval := l.Intervals()
+				l.SetIntervals(d, minInterval)
+			}
+			return nil
+		}))
+	tunable.Register(tunable.Duration("min_announce_interval", "minimal announce interval returned to clients",
+		func() time.Duration {
+			_, minInterval := intervals()
+			return minInterval
+		},
+		func(d time.Duration) error {
+			if interval, _ := intervals(); d < 0 || d > interval {
+				return errInvalidMinInterval
+			}
+			for _, l := range t.allLogics {
+				interval, _ := l.Intervals()
+				l.SetIntervals(interval, d)
+			}
+			return nil
+		}))
+	tunable.Register(tunable.Uint("max_numwant", "limit of announces' numwant below frontends' max_numwant, 0 - not limited",
+		func() uint64 { return uint64(t.allLogics[0].MaxNumWant()) },
+		func(n uint64) error {
+			if n > math.MaxUint32 {
+				return errInvalidNumWant
+			}
+			for _, l := range t.allLogics {
+				l.SetMaxNumWant(uint32(n))
+			}
+			return nil
+		}))
+}